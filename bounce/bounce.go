@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package bounce decides how stanzas that couldn't be delivered
+// are answered back to their senders.
+package bounce
+
+import (
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	stanzaErrorNamespace    = "urn:ietf:params:xml:ns:xmpp-stanzas"
+	blockingErrorsNamespace = "urn:xmpp:blocking:errors"
+)
+
+const quotaExceededText = "Recipient offline storage is full, retry later"
+
+const spamText = "Message has been rejected as spam"
+
+const filteredText = "Stanza has been rejected by server policy"
+
+// Reason represents the reason a stanza couldn't be delivered.
+type Reason int
+
+const (
+	// UnknownRecipient represents a non existing or unreachable recipient.
+	UnknownRecipient Reason = iota
+
+	// Blocked represents a recipient that has blocked the stanza sender.
+	Blocked
+
+	// QuotaExceeded represents a recipient whose offline storage is full.
+	QuotaExceeded
+
+	// Spam represents a stanza rejected by the spam filter.
+	Spam
+
+	// Filtered represents a stanza dropped by a rewrite rule.
+	Filtered
+
+	// BlockedRecipient represents a recipient the stanza sender has blocked.
+	BlockedRecipient
+
+	// PrivacyDenied represents a stanza denied by its sender privacy list.
+	PrivacyDenied
+)
+
+// Response returns the error stanza to be sent back to the sender of an
+// undeliverable stanza, or nil if it has to be silently dropped.
+//
+// Blocked stanzas are answered exactly as those addressed to an unknown
+// recipient if cfg enables it, so that senders can't detect being blocked.
+func Response(stanza xml.Element, reason Reason, cfg *config.Bounce) xml.Element {
+	if !isAnswerable(stanza) {
+		return nil
+	}
+	switch reason {
+	case UnknownRecipient:
+		return unknownRecipientResponse(stanza)
+	case Blocked:
+		if cfg != nil && cfg.FakeBlockedErrors {
+			return unknownRecipientResponse(stanza)
+		}
+	case QuotaExceeded:
+		text := xml.NewElementNamespace("text", stanzaErrorNamespace)
+		text.SetLanguage("en")
+		text.SetText(quotaExceededText)
+
+		errEl := xml.NewElementFromElement(xml.ErrResourceConstraint.(*xml.StanzaError).Element())
+		errEl.AppendElement(text)
+		return errorResponse(stanza, errEl)
+	case Spam:
+		return policyViolationResponse(stanza, spamText)
+	case Filtered:
+		return policyViolationResponse(stanza, filteredText)
+	case BlockedRecipient:
+		// XEP-0191: Blocking Command (https://xmpp.org/extensions/xep-0191.html)
+		errEl := xml.NewElementFromElement(xml.ErrNotAcceptable.(*xml.StanzaError).Element())
+		errEl.AppendElement(xml.NewElementNamespace("blocked", blockingErrorsNamespace))
+		return errorResponse(stanza, errEl)
+	case PrivacyDenied:
+		// XEP-0016: Privacy Lists (https://xmpp.org/extensions/xep-0016.html)
+		return errorResponse(stanza, xml.ErrNotAcceptable.(*xml.StanzaError).Element())
+	}
+	return nil
+}
+
+// unknownRecipientResponse must depend on nothing but the stanza
+// itself, since it's also used to mask blocked ones.
+func unknownRecipientResponse(stanza xml.Element) xml.Element {
+	return errorResponse(stanza, xml.ErrServiceUnavailable.(*xml.StanzaError).Element())
+}
+
+func policyViolationResponse(stanza xml.Element, reason string) xml.Element {
+	text := xml.NewElementNamespace("text", stanzaErrorNamespace)
+	text.SetLanguage("en")
+	text.SetText(reason)
+
+	errEl := xml.NewElementFromElement(xml.ErrPolicyViolation.(*xml.StanzaError).Element())
+	errEl.AppendElement(text)
+	return errorResponse(stanza, errEl)
+}
+
+func errorResponse(stanza xml.Element, errEl xml.Element) xml.Element {
+	resp := xml.NewElementFromElement(stanza)
+	resp.SetFrom(stanza.To())
+	resp.SetTo(stanza.From())
+	resp.SetType(xml.ErrorType)
+	resp.AppendElement(errEl)
+	return resp
+}
+
+func isAnswerable(stanza xml.Element) bool {
+	switch stanza.Name() {
+	case "message":
+		return stanza.Type() != xml.ErrorType
+	case "iq":
+		return stanza.Type() == xml.GetType || stanza.Type() == xml.SetType
+	default:
+		// never answer presences
+		return false
+	}
+}
@@ -0,0 +1,135 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package bounce
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestBounce_UnknownRecipient(t *testing.T) {
+	msg := tUtilBounceMessage(xml.ChatType)
+
+	resp := Response(msg, UnknownRecipient, nil)
+	require.NotNil(t, resp)
+	require.Equal(t, "message", resp.Name())
+	require.Equal(t, xml.ErrorType, resp.Type())
+	require.Equal(t, "juliet@jackal.im/garden", resp.From())
+	require.Equal(t, "romeo@jackal.im/balcony", resp.To())
+	require.Equal(t, "Hi", resp.FindElement("body").Text())
+	require.NotNil(t, resp.Error().FindElementNamespace("service-unavailable", stanzaErrorNamespace))
+
+	// original stanza is left untouched
+	require.Equal(t, xml.ChatType, msg.Type())
+	require.Nil(t, msg.Error())
+}
+
+func TestBounce_Blocked(t *testing.T) {
+	msg := tUtilBounceMessage(xml.ChatType)
+
+	require.Nil(t, Response(msg, Blocked, nil))
+	require.Nil(t, Response(msg, Blocked, &config.Bounce{}))
+
+	// blocked stanzas must be indistinguishable from unknown recipient ones
+	unknown := Response(msg, UnknownRecipient, nil)
+	blocked := Response(msg, Blocked, &config.Bounce{FakeBlockedErrors: true})
+	require.NotNil(t, blocked)
+	require.Equal(t, []byte(unknown.String()), []byte(blocked.String()))
+}
+
+func TestBounce_QuotaExceeded(t *testing.T) {
+	resp := Response(tUtilBounceMessage(xml.NormalType), QuotaExceeded, nil)
+	require.NotNil(t, resp)
+
+	errEl := resp.Error()
+	require.Equal(t, "wait", errEl.Type())
+	require.NotNil(t, errEl.FindElementNamespace("resource-constraint", stanzaErrorNamespace))
+	require.Equal(t, quotaExceededText, errEl.FindElementNamespace("text", stanzaErrorNamespace).Text())
+}
+
+func TestBounce_Spam(t *testing.T) {
+	resp := Response(tUtilBounceMessage(xml.ChatType), Spam, nil)
+	require.NotNil(t, resp)
+
+	errEl := resp.Error()
+	require.Equal(t, "modify", errEl.Type())
+	require.NotNil(t, errEl.FindElementNamespace("policy-violation", stanzaErrorNamespace))
+	require.Equal(t, spamText, errEl.FindElementNamespace("text", stanzaErrorNamespace).Text())
+}
+
+func TestBounce_Filtered(t *testing.T) {
+	resp := Response(tUtilBounceMessage(xml.ChatType), Filtered, nil)
+	require.NotNil(t, resp)
+
+	errEl := resp.Error()
+	require.Equal(t, "modify", errEl.Type())
+	require.NotNil(t, errEl.FindElementNamespace("policy-violation", stanzaErrorNamespace))
+	require.Equal(t, filteredText, errEl.FindElementNamespace("text", stanzaErrorNamespace).Text())
+}
+
+func TestBounce_BlockedRecipient(t *testing.T) {
+	resp := Response(tUtilBounceMessage(xml.ChatType), BlockedRecipient, nil)
+	require.NotNil(t, resp)
+	require.Equal(t, "juliet@jackal.im/garden", resp.From())
+	require.Equal(t, "romeo@jackal.im/balcony", resp.To())
+
+	errEl := resp.Error()
+	require.Equal(t, "modify", errEl.Type())
+	require.NotNil(t, errEl.FindElementNamespace("not-acceptable", stanzaErrorNamespace))
+	require.NotNil(t, errEl.FindElementNamespace("blocked", blockingErrorsNamespace))
+}
+
+func TestBounce_PrivacyDenied(t *testing.T) {
+	resp := Response(tUtilBounceMessage(xml.ChatType), PrivacyDenied, nil)
+	require.NotNil(t, resp)
+	require.Equal(t, "juliet@jackal.im/garden", resp.From())
+	require.Equal(t, "romeo@jackal.im/balcony", resp.To())
+
+	errEl := resp.Error()
+	require.Equal(t, "modify", errEl.Type())
+	require.NotNil(t, errEl.FindElementNamespace("not-acceptable", stanzaErrorNamespace))
+	require.Nil(t, errEl.FindElementNamespace("blocked", blockingErrorsNamespace))
+}
+
+func TestBounce_NotAnswerable(t *testing.T) {
+	from, _ := xml.NewJID("romeo", "jackal.im", "balcony", true)
+	to, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	// error messages
+	require.Nil(t, Response(tUtilBounceMessage(xml.ErrorType), UnknownRecipient, nil))
+
+	// presences
+	require.Nil(t, Response(xml.NewPresence(from, to, xml.AvailableType), UnknownRecipient, nil))
+	require.Nil(t, Response(xml.NewPresence(from, to, xml.SubscribeType), QuotaExceeded, nil))
+
+	// IQ responses
+	for _, iqType := range []string{xml.ResultType, xml.ErrorType} {
+		iq := xml.NewIQType("iq_1", iqType)
+		iq.SetFromJID(from)
+		iq.SetToJID(to)
+		require.Nil(t, Response(iq, UnknownRecipient, nil))
+	}
+	iq := xml.NewIQType("iq_1", xml.GetType)
+	iq.SetFromJID(from)
+	iq.SetToJID(to)
+	require.NotNil(t, Response(iq, UnknownRecipient, nil))
+}
+
+func tUtilBounceMessage(messageType string) *xml.Message {
+	from, _ := xml.NewJID("romeo", "jackal.im", "balcony", true)
+	to, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	msg := xml.NewMessageType("message_1", messageType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	body := xml.NewElementName("body")
+	body.SetText("Hi")
+	msg.AppendElement(body)
+	return msg
+}
@@ -0,0 +1,385 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package client implements a minimal XMPP client, intended for
+// integration tests and for embedding bots into Go programs.
+//
+// Only the negotiation steps jackal itself requires are supported: STARTTLS
+// or direct TLS, SASL PLAIN and SCRAM authentication, resource binding and
+// session establishment. Stanzas are exchanged using the same xml.Element
+// types the server is built upon.
+package client
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const defaultTimeout = time.Second * 10
+
+const (
+	jabberClientNamespace = "jabber:client"
+	streamNamespace       = "http://etherx.jabber.org/streams"
+	tlsNamespace          = "urn:ietf:params:xml:ns:xmpp-tls"
+	saslNamespace         = "urn:ietf:params:xml:ns:xmpp-sasl"
+	bindNamespace         = "urn:ietf:params:xml:ns:xmpp-bind"
+	sessionNamespace      = "urn:ietf:params:xml:ns:xmpp-session"
+)
+
+// ErrTimeout is returned when no element has been received within the expected time.
+var ErrTimeout = errors.New("client: timeout waiting for element")
+
+// ErrClosed is returned when operating over a closed client.
+var ErrClosed = errors.New("client: closed")
+
+// ErrStartTLSRequired is returned when server doesn't offer STARTTLS
+// over a connection that hasn't been secured by means of direct TLS.
+var ErrStartTLSRequired = errors.New("client: server doesn't support STARTTLS")
+
+// Config represents a client configuration.
+type Config struct {
+	// Addr is the server address, in host:port form.
+	Addr string
+
+	// Domain is the XMPP domain the stream is opened against.
+	Domain string
+
+	// Username and Password are the credentials used to log in.
+	Username string
+	Password string
+
+	// Resource is the resource requested on bind. Server assigns one if empty.
+	Resource string
+
+	// TLS is the configuration used to secure the connection.
+	// If nil, server certificate gets verified against Domain.
+	TLS *tls.Config
+
+	// DirectTLS establishes the TLS session right after connecting,
+	// instead of negotiating it by means of STARTTLS.
+	DirectTLS bool
+
+	// Mechanism forces the SASL mechanism used to authenticate.
+	// If empty, the strongest supported mechanism offered by server is used.
+	Mechanism string
+
+	// Timeout bounds connection establishment and every negotiation step.
+	// Defaults to 10 seconds.
+	Timeout time.Duration
+}
+
+// Client represents an XMPP client connection.
+type Client struct {
+	cfg      Config
+	conn     net.Conn
+	features xml.Element
+	jid      *xml.JID
+
+	wMu sync.Mutex
+
+	elemCh   chan xml.Element
+	readErr  error
+	closeCh  chan struct{}
+	closeMu  sync.Mutex
+	isClosed bool
+}
+
+// Dial connects to the server and logs in, returning a client
+// ready to exchange stanzas.
+func Dial(cfg Config) (*Client, error) {
+	c, err := Connect(cfg)
+	if err != nil {
+		return nil, err
+	}
+	if err := c.Login(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Connect opens a secured stream against the server, without authenticating.
+// Unauthenticated streams can be used to register new accounts.
+func Connect(cfg Config) (*Client, error) {
+	if cfg.Timeout == 0 {
+		cfg.Timeout = defaultTimeout
+	}
+	conn, err := net.DialTimeout("tcp", cfg.Addr, cfg.Timeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &Client{cfg: cfg, conn: conn, closeCh: make(chan struct{})}
+	if err := c.secure(); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// from now on elements are read from a single parser, as stream restarts
+	// are only requested once every pending element has been consumed.
+	c.elemCh = make(chan xml.Element, 32)
+	go c.readLoop(xml.NewParserTransportType(bufio.NewReader(c.conn), config.SocketTransportType))
+
+	if err := c.openStream(); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// Login authenticates the stream, binds a resource and starts a session.
+func (c *Client) Login() error {
+	mechanism, err := c.selectMechanism()
+	if err != nil {
+		return err
+	}
+	if err := c.authenticate(mechanism); err != nil {
+		return err
+	}
+	if err := c.openStream(); err != nil {
+		return err
+	}
+	if err := c.bind(); err != nil {
+		return err
+	}
+	if c.features.FindElementNamespace("session", sessionNamespace) != nil {
+		return c.startSession()
+	}
+	return nil
+}
+
+// JID returns the bound client JID, or nil if not bound yet.
+func (c *Client) JID() *xml.JID {
+	return c.jid
+}
+
+// Features returns the last stream features advertised by server.
+func (c *Client) Features() xml.Element {
+	return c.features
+}
+
+// Send writes an element to the stream.
+func (c *Client) Send(elem xml.Element) error {
+	buf := new(bytes.Buffer)
+	elem.ToXML(buf, true)
+	return c.writeBytes(buf.Bytes())
+}
+
+// Receive waits for the next element sent by server,
+// bounded by the configured timeout.
+func (c *Client) Receive() (xml.Element, error) {
+	return c.ReceiveTimeout(c.cfg.Timeout)
+}
+
+// ReceiveTimeout waits up to timeout for the next element sent by server.
+func (c *Client) ReceiveTimeout(timeout time.Duration) (xml.Element, error) {
+	tm := time.NewTimer(timeout)
+	defer tm.Stop()
+
+	select {
+	case elem, ok := <-c.elemCh:
+		if !ok {
+			return nil, c.readErr
+		}
+		return elem, nil
+	case <-c.closeCh:
+		return nil, ErrClosed
+	case <-tm.C:
+		return nil, ErrTimeout
+	}
+}
+
+// Close closes the stream and its underlying connection.
+func (c *Client) Close() error {
+	c.closeMu.Lock()
+	if c.isClosed {
+		c.closeMu.Unlock()
+		return nil
+	}
+	c.isClosed = true
+	close(c.closeCh)
+	c.closeMu.Unlock()
+
+	c.writeBytes([]byte("</stream:stream>"))
+	return c.conn.Close()
+}
+
+func (c *Client) secure() error {
+	tlsCfg := c.cfg.TLS
+	if tlsCfg == nil {
+		tlsCfg = &tls.Config{ServerName: c.cfg.Domain}
+	}
+	if c.cfg.DirectTLS {
+		return c.handshakeTLS(tlsCfg)
+	}
+	// STARTTLS negotiation is read synchronously, as the parser
+	// has to be discarded along with the plain connection.
+	c.conn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+	defer c.conn.SetDeadline(time.Time{})
+
+	if err := c.writeBytes([]byte(c.streamHeader())); err != nil {
+		return err
+	}
+	p := xml.NewParserTransportType(c.conn, config.SocketTransportType)
+	features, err := c.readFeatures(func() (xml.Element, error) { return p.ParseElement() })
+	if err != nil {
+		return err
+	}
+	if features.FindElementNamespace("starttls", tlsNamespace) == nil {
+		return ErrStartTLSRequired
+	}
+	if err := c.Send(xml.NewElementNamespace("starttls", tlsNamespace)); err != nil {
+		return err
+	}
+	elem, err := p.ParseElement()
+	if err != nil {
+		return err
+	}
+	if elem.Name() != "proceed" || elem.Namespace() != tlsNamespace {
+		return fmt.Errorf("client: STARTTLS failed: %s", elem.Name())
+	}
+	return c.handshakeTLS(tlsCfg)
+}
+
+func (c *Client) handshakeTLS(cfg *tls.Config) error {
+	tlsConn := tls.Client(c.conn, cfg)
+	tlsConn.SetDeadline(time.Now().Add(c.cfg.Timeout))
+	if err := tlsConn.Handshake(); err != nil {
+		return err
+	}
+	tlsConn.SetDeadline(time.Time{})
+	c.conn = tlsConn
+	return nil
+}
+
+func (c *Client) openStream() error {
+	if err := c.writeBytes([]byte(c.streamHeader())); err != nil {
+		return err
+	}
+	features, err := c.readFeatures(c.Receive)
+	if err != nil {
+		return err
+	}
+	c.features = features
+	return nil
+}
+
+func (c *Client) readFeatures(next func() (xml.Element, error)) (xml.Element, error) {
+	elem, err := next()
+	if err != nil {
+		return nil, err
+	}
+	if elem.Name() != "stream:stream" {
+		return nil, fmt.Errorf("client: unexpected stream element: %s", elem.Name())
+	}
+	elem, err = next()
+	if err != nil {
+		return nil, err
+	}
+	if elem.Name() != "stream:features" {
+		return nil, fmt.Errorf("client: unexpected stream element: %s", elem.Name())
+	}
+	return elem, nil
+}
+
+func (c *Client) bind() error {
+	bind := xml.NewElementNamespace("bind", bindNamespace)
+	if len(c.cfg.Resource) > 0 {
+		res := xml.NewElementName("resource")
+		res.SetText(c.cfg.Resource)
+		bind.AppendElement(res)
+	}
+	result, err := c.sendIQ(bind)
+	if err != nil {
+		return err
+	}
+	jidElem := result.FindElementNamespace("bind", bindNamespace)
+	if jidElem != nil {
+		jidElem = jidElem.FindElement("jid")
+	}
+	if jidElem == nil {
+		return errors.New("client: bind result without jid")
+	}
+	j, err := xml.NewJIDString(jidElem.Text(), false)
+	if err != nil {
+		return err
+	}
+	c.jid = j
+	return nil
+}
+
+func (c *Client) startSession() error {
+	_, err := c.sendIQ(xml.NewElementNamespace("session", sessionNamespace))
+	return err
+}
+
+// sendIQ sends a set IQ carrying payload during stream negotiation,
+// expecting its result to be the next received element.
+func (c *Client) sendIQ(payload xml.Element) (xml.Element, error) {
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.AppendElement(payload)
+	if err := c.Send(iq); err != nil {
+		return nil, err
+	}
+	elem, err := c.Receive()
+	if err != nil {
+		return nil, err
+	}
+	if elem.Name() != "iq" || elem.ID() != iq.ID() {
+		return nil, fmt.Errorf("client: unexpected element: %s", elem.Name())
+	}
+	if elem.Type() != xml.ResultType {
+		return nil, fmt.Errorf("client: %s failed: %s", payload.Name(), stanzaErrorName(elem))
+	}
+	return elem, nil
+}
+
+func (c *Client) streamHeader() string {
+	return fmt.Sprintf(`<?xml version="1.0"?><stream:stream xmlns="%s" xmlns:stream="%s" to="%s" version="1.0">`,
+		jabberClientNamespace, streamNamespace, c.cfg.Domain)
+}
+
+func (c *Client) writeBytes(b []byte) error {
+	c.wMu.Lock()
+	defer c.wMu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(c.cfg.Timeout))
+	_, err := c.conn.Write(b)
+	return err
+}
+
+func (c *Client) readLoop(p *xml.Parser) {
+	for {
+		elem, err := p.ParseElement()
+		if err != nil {
+			c.closeMu.Lock()
+			if c.isClosed {
+				err = ErrClosed
+			}
+			c.closeMu.Unlock()
+			c.readErr = err
+			close(c.elemCh)
+			return
+		}
+		select {
+		case c.elemCh <- elem:
+		case <-c.closeCh:
+		}
+	}
+}
+
+func stanzaErrorName(elem xml.Element) string {
+	if errElem := elem.Error(); errElem != nil && errElem.ElementsCount() > 0 {
+		return errElem.Elements()[0].Name()
+	}
+	return elem.Type()
+}
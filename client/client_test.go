@@ -0,0 +1,188 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package client
+
+import (
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestScramMechanism(t *testing.T) {
+	// RFC 5802 test vector
+	m := newScramMechanism(sha1.New, "user", "pencil")
+	m.cNonce = "fyko+d2lbbFgONRv9qkxdawL"
+	b, err := m.start()
+	require.Nil(t, err)
+	require.Equal(t, "n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL", string(b))
+
+	b, err = m.next([]byte("r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"))
+	require.Nil(t, err)
+	require.Equal(t, "c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts=", string(b))
+	require.Nil(t, m.verify([]byte("v=rmF9pqV8S7suAoZWja4dJRkFsKQ=")))
+	require.Equal(t, ErrAuthenticationFailed, m.verify([]byte("v=AAAA")))
+
+	// RFC 7677 test vector
+	m = newScramMechanism(sha256.New, "user", "pencil")
+	m.cNonce = "rOprNGfwEbeRWgbNEkqO"
+	_, err = m.start()
+	require.Nil(t, err)
+
+	b, err = m.next([]byte("r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"))
+	require.Nil(t, err)
+	require.Equal(t, "c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ=", string(b))
+	require.Nil(t, m.verify([]byte("v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4=")))
+
+	// server nonce must extend client one
+	m = newScramMechanism(sha1.New, "user", "pencil")
+	_, err = m.start()
+	require.Nil(t, err)
+	_, err = m.next([]byte("r=abcd,s=QSXCR+Q6sek8bf92,i=4096"))
+	require.Equal(t, ErrAuthenticationFailed, err)
+}
+
+func TestClient_DirectTLS(t *testing.T) {
+	ln := tUtilListenTLS(t)
+	defer ln.Close()
+
+	srvErrCh := make(chan error, 1)
+	go func() {
+		srvErrCh <- tUtilServeScript(ln, []string{
+			`<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`,
+			`auth:<success xmlns="urn:ietf:params:xml:ns:xmpp-sasl"/>`,
+			`<stream:features><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"/></stream:features>`,
+			`iq:<iq type="result" id="%s"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><jid>ortuman@jackal.im/balcony</jid></bind></iq>`,
+			`message:<message from="noelia@jackal.im/garden" to="ortuman@jackal.im/balcony"><body>Hi!</body></message>`,
+		})
+	}()
+	c, err := Dial(Config{
+		Addr:      ln.Addr().String(),
+		Domain:    "jackal.im",
+		Username:  "ortuman",
+		Password:  "1234",
+		Resource:  "balcony",
+		TLS:       &tls.Config{InsecureSkipVerify: true},
+		DirectTLS: true,
+		Timeout:   time.Second * 5,
+	})
+	require.Nil(t, err)
+	defer c.Close()
+	require.Equal(t, "ortuman@jackal.im/balcony", c.JID().String())
+
+	msg := xml.NewElementName("message")
+	msg.SetTo("noelia@jackal.im")
+	require.Nil(t, c.Send(msg))
+
+	elem, err := c.Receive()
+	require.Nil(t, err)
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "Hi!", elem.FindElement("body").Text())
+
+	// nothing else to receive
+	_, err = c.ReceiveTimeout(time.Millisecond * 50)
+	require.Equal(t, ErrTimeout, err)
+
+	require.Nil(t, c.Close())
+	require.Nil(t, <-srvErrCh)
+
+	_, err = c.Receive()
+	require.Equal(t, ErrClosed, err)
+}
+
+func TestClient_AuthenticationFailure(t *testing.T) {
+	ln := tUtilListenTLS(t)
+	defer ln.Close()
+
+	go tUtilServeScript(ln, []string{
+		`<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`,
+		`auth:<failure xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><not-authorized/></failure>`,
+	})
+	cfg := Config{
+		Addr:      ln.Addr().String(),
+		Domain:    "jackal.im",
+		Username:  "ortuman",
+		Password:  "bad",
+		TLS:       &tls.Config{InsecureSkipVerify: true},
+		DirectTLS: true,
+		Timeout:   time.Second * 5,
+	}
+	cfg.Mechanism = MechanismScramSHA1
+	c, err := Connect(cfg)
+	require.Nil(t, err)
+	require.Equal(t, ErrNoMechanism, c.Login())
+	c.Close()
+
+	go tUtilServeScript(ln, []string{
+		`<stream:features><mechanisms xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><mechanism>PLAIN</mechanism></mechanisms></stream:features>`,
+		`auth:<failure xmlns="urn:ietf:params:xml:ns:xmpp-sasl"><not-authorized/></failure>`,
+	})
+	cfg.Mechanism = ""
+	_, err = Dial(cfg)
+	require.Equal(t, ErrAuthenticationFailed, err)
+}
+
+func tUtilListenTLS(t *testing.T) net.Listener {
+	cer, err := tls.LoadX509KeyPair("../testdata/cert/test.server.crt", "../testdata/cert/test.server.key")
+	require.Nil(t, err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", &tls.Config{Certificates: []tls.Certificate{cer}})
+	require.Nil(t, err)
+	return ln
+}
+
+// tUtilServeScript accepts a single connection, answering every received
+// stream header with the next scripted features and every other element
+// with the next scripted response prefixed by its name.
+// A '%s' within a response is replaced by the received element identifier.
+func tUtilServeScript(ln net.Listener, script []string) error {
+	conn, err := ln.Accept()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	p := xml.NewParserTransportType(conn, config.SocketTransportType)
+	for _, step := range script {
+		elem, err := p.ParseElement()
+		if err != nil {
+			return err
+		}
+		resp := step
+		if elem.Name() == "stream:stream" {
+			io.WriteString(conn, `<?xml version="1.0"?><stream:stream xmlns="jabber:client" xmlns:stream="http://etherx.jabber.org/streams" from="jackal.im" version="1.0">`)
+		} else {
+			prefix := elem.Name() + ":"
+			if len(resp) < len(prefix) || resp[:len(prefix)] != prefix {
+				return fmt.Errorf("unexpected element: %s", elem.Name())
+			}
+			resp = resp[len(prefix):]
+			if elem.Name() == "auth" {
+				if _, err := base64.StdEncoding.DecodeString(elem.Text()); err != nil {
+					return err
+				}
+			}
+		}
+		if len(elem.ID()) > 0 {
+			resp = fmt.Sprintf(resp, elem.ID())
+		}
+		io.WriteString(conn, resp)
+	}
+	// wait for client to close the stream
+	_, err = p.ParseElement()
+	if err == xml.ErrStreamClosedByPeer {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,241 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package client
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"hash"
+	"strconv"
+	"strings"
+
+	"github.com/ortuman/jackal/xml"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// Supported SASL mechanisms, in order of preference.
+const (
+	MechanismScramSHA256 = "SCRAM-SHA-256"
+	MechanismScramSHA1   = "SCRAM-SHA-1"
+	MechanismPlain       = "PLAIN"
+)
+
+var supportedMechanisms = []string{MechanismScramSHA256, MechanismScramSHA1, MechanismPlain}
+
+// ErrAuthenticationFailed is returned when server rejects client credentials.
+var ErrAuthenticationFailed = errors.New("client: authentication failed")
+
+// ErrNoMechanism is returned when server doesn't offer any supported SASL mechanism.
+var ErrNoMechanism = errors.New("client: no supported SASL mechanism offered")
+
+// saslMechanism represents a client side SASL exchange.
+type saslMechanism interface {
+	// start returns the initial response.
+	start() ([]byte, error)
+
+	// next returns the response to a server challenge.
+	next(challenge []byte) ([]byte, error)
+
+	// verify checks the additional data sent along with success.
+	verify(data []byte) error
+}
+
+func (c *Client) selectMechanism() (string, error) {
+	var offered []string
+	if mechanisms := c.features.FindElementNamespace("mechanisms", saslNamespace); mechanisms != nil {
+		for _, m := range mechanisms.FindElements("mechanism") {
+			offered = append(offered, m.Text())
+		}
+	}
+	isOffered := func(mechanism string) bool {
+		for _, m := range offered {
+			if m == mechanism {
+				return true
+			}
+		}
+		return false
+	}
+	if len(c.cfg.Mechanism) > 0 {
+		if !isOffered(c.cfg.Mechanism) {
+			return "", ErrNoMechanism
+		}
+		return c.cfg.Mechanism, nil
+	}
+	for _, m := range supportedMechanisms {
+		if isOffered(m) {
+			return m, nil
+		}
+	}
+	return "", ErrNoMechanism
+}
+
+func (c *Client) authenticate(mechanism string) error {
+	var m saslMechanism
+	switch mechanism {
+	case MechanismPlain:
+		m = &plainMechanism{username: c.cfg.Username, password: c.cfg.Password}
+	case MechanismScramSHA1:
+		m = newScramMechanism(sha1.New, c.cfg.Username, c.cfg.Password)
+	case MechanismScramSHA256:
+		m = newScramMechanism(sha256.New, c.cfg.Username, c.cfg.Password)
+	default:
+		return fmt.Errorf("client: unsupported SASL mechanism: %s", mechanism)
+	}
+	resp, err := m.start()
+	if err != nil {
+		return err
+	}
+	auth := xml.NewElementNamespace("auth", saslNamespace)
+	auth.SetAttribute("mechanism", mechanism)
+	auth.SetText(base64.StdEncoding.EncodeToString(resp))
+	if err := c.Send(auth); err != nil {
+		return err
+	}
+	for {
+		elem, err := c.Receive()
+		if err != nil {
+			return err
+		}
+		if elem.Namespace() != saslNamespace {
+			return fmt.Errorf("client: unexpected element: %s", elem.Name())
+		}
+		if elem.Name() == "failure" {
+			return ErrAuthenticationFailed
+		}
+		data, err := base64.StdEncoding.DecodeString(elem.Text())
+		if err != nil {
+			return err
+		}
+		switch elem.Name() {
+		case "challenge":
+			resp, err := m.next(data)
+			if err != nil {
+				return err
+			}
+			respElem := xml.NewElementNamespace("response", saslNamespace)
+			respElem.SetText(base64.StdEncoding.EncodeToString(resp))
+			if err := c.Send(respElem); err != nil {
+				return err
+			}
+		case "success":
+			return m.verify(data)
+		default:
+			return fmt.Errorf("client: unexpected element: %s", elem.Name())
+		}
+	}
+}
+
+type plainMechanism struct {
+	username string
+	password string
+}
+
+func (m *plainMechanism) start() ([]byte, error) {
+	return []byte("\x00" + m.username + "\x00" + m.password), nil
+}
+
+func (m *plainMechanism) next(challenge []byte) ([]byte, error) {
+	return nil, ErrAuthenticationFailed
+}
+
+func (m *plainMechanism) verify(data []byte) error {
+	return nil
+}
+
+type scramMechanism struct {
+	h           func() hash.Hash
+	username    string
+	password    string
+	cNonce      string
+	firstBare   string
+	authMessage string
+	saltedPass  []byte
+}
+
+const scramGS2Header = "n,,"
+
+func newScramMechanism(h func() hash.Hash, username, password string) *scramMechanism {
+	return &scramMechanism{h: h, username: username, password: password}
+}
+
+func (m *scramMechanism) start() ([]byte, error) {
+	if len(m.cNonce) == 0 {
+		b := make([]byte, 24)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		m.cNonce = base64.RawStdEncoding.EncodeToString(b)
+	}
+	username := strings.NewReplacer("=", "=3D", ",", "=2C").Replace(m.username)
+	m.firstBare = "n=" + username + ",r=" + m.cNonce
+	return []byte(scramGS2Header + m.firstBare), nil
+}
+
+func (m *scramMechanism) next(challenge []byte) ([]byte, error) {
+	var nonce, salt string
+	var iterations int
+	for _, p := range strings.Split(string(challenge), ",") {
+		if len(p) < 2 || p[1] != '=' {
+			continue
+		}
+		switch p[0] {
+		case 'r':
+			nonce = p[2:]
+		case 's':
+			salt = p[2:]
+		case 'i':
+			iterations, _ = strconv.Atoi(p[2:])
+		}
+	}
+	if !strings.HasPrefix(nonce, m.cNonce) || len(nonce) == len(m.cNonce) || iterations <= 0 {
+		return nil, ErrAuthenticationFailed
+	}
+	saltBytes, err := base64.StdEncoding.DecodeString(salt)
+	if err != nil {
+		return nil, ErrAuthenticationFailed
+	}
+	m.saltedPass = pbkdf2.Key([]byte(m.password), saltBytes, iterations, m.h().Size(), m.h)
+
+	finalBare := "c=" + base64.StdEncoding.EncodeToString([]byte(scramGS2Header)) + ",r=" + nonce
+	m.authMessage = m.firstBare + "," + string(challenge) + "," + finalBare
+
+	clientKey := m.hmac(m.saltedPass, []byte("Client Key"))
+	storedKey := m.h()
+	storedKey.Write(clientKey)
+	clientSignature := m.hmac(storedKey.Sum(nil), []byte(m.authMessage))
+
+	proof := make([]byte, len(clientKey))
+	for i := range clientKey {
+		proof[i] = clientKey[i] ^ clientSignature[i]
+	}
+	return []byte(finalBare + ",p=" + base64.StdEncoding.EncodeToString(proof)), nil
+}
+
+func (m *scramMechanism) verify(data []byte) error {
+	if m.saltedPass == nil || !strings.HasPrefix(string(data), "v=") {
+		return ErrAuthenticationFailed
+	}
+	serverSignature, err := base64.StdEncoding.DecodeString(string(data[2:]))
+	if err != nil {
+		return ErrAuthenticationFailed
+	}
+	serverKey := m.hmac(m.saltedPass, []byte("Server Key"))
+	if !hmac.Equal(serverSignature, m.hmac(serverKey, []byte(m.authMessage))) {
+		return ErrAuthenticationFailed
+	}
+	return nil
+}
+
+func (m *scramMechanism) hmac(key, b []byte) []byte {
+	mac := hmac.New(m.h, key)
+	mac.Write(b)
+	return mac.Sum(nil)
+}
@@ -0,0 +1,110 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// maxElementDepth bounds element nesting accepted by the decoder.
+const maxElementDepth = 256
+
+// encodeElement writes elem compact binary representation:
+// name, text, attribute count, attributes (label and value),
+// child element count and child elements.
+func encodeElement(buf *bytes.Buffer, elem xml.Element) {
+	writeString(buf, elem.Name())
+	writeString(buf, elem.Text())
+	attrs := elem.Attributes()
+	writeUvarint(buf, uint64(len(attrs)))
+	for _, attr := range attrs {
+		writeString(buf, attr.Label)
+		writeString(buf, attr.Value)
+	}
+	elements := elem.Elements()
+	writeUvarint(buf, uint64(len(elements)))
+	for _, child := range elements {
+		encodeElement(buf, child)
+	}
+}
+
+func decodeElement(r *bytes.Reader, depth int) (xml.Element, error) {
+	if depth > maxElementDepth {
+		return nil, ErrMalformedFrame
+	}
+	name, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	text, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	elem := xml.NewElementName(name)
+	elem.SetText(text)
+
+	attrc, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < attrc; i++ {
+		label, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		value, err := readString(r)
+		if err != nil {
+			return nil, err
+		}
+		elem.SetAttribute(label, value)
+	}
+	elemc, err := readCount(r)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < elemc; i++ {
+		child, err := decodeElement(r, depth+1)
+		if err != nil {
+			return nil, err
+		}
+		elem.AppendElement(child)
+	}
+	return elem, nil
+}
+
+func writeUvarint(buf *bytes.Buffer, v uint64) {
+	var b [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(b[:], v)
+	buf.Write(b[:n])
+}
+
+func writeString(buf *bytes.Buffer, s string) {
+	writeUvarint(buf, uint64(len(s)))
+	buf.WriteString(s)
+}
+
+// readCount reads an item count, which can never exceed
+// the number of remaining bytes as every item takes at least one.
+func readCount(r *bytes.Reader) (int, error) {
+	n, err := binary.ReadUvarint(r)
+	if err != nil || n > uint64(r.Len()) {
+		return 0, ErrMalformedFrame
+	}
+	return int(n), nil
+}
+
+func readString(r *bytes.Reader) (string, error) {
+	n, err := readCount(r)
+	if err != nil {
+		return "", err
+	}
+	b := make([]byte, n)
+	r.Read(b)
+	return string(b), nil
+}
@@ -0,0 +1,239 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package cluster defines the internal wire format used to
+// forward stanzas between jackal cluster nodes.
+//
+// Every frame is laid out as follows (integers are big endian):
+//
+//	length   uint32  number of bytes that follow
+//	version  uint8   protocol version (0 for hello frames)
+//	kind     uint8   frame kind
+//	body     []byte
+//
+// Hello frame body:
+//
+//	node     string  sender node identifier
+//	min      uint8   lowest supported protocol version
+//	max      uint8   highest supported protocol version
+//
+// Stanza frame body (version 1):
+//
+//	flags    uint8   delivery flags
+//	node     string  sender node identifier
+//	to       string  destination JID
+//	element  []byte  element binary representation
+//
+// Elements are encoded as their name, text, attribute count followed by
+// every attribute label and value, and child element count followed by
+// every child element.
+//
+// Strings are encoded as an uvarint length followed by its bytes,
+// and counts as uvarints.
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	// MinProtocolVersion is the lowest frame protocol version supported by this node.
+	MinProtocolVersion uint8 = 1
+
+	// MaxProtocolVersion is the highest frame protocol version supported by this node.
+	MaxProtocolVersion uint8 = 1
+)
+
+// MaxFrameSize is the maximum accepted frame length.
+const MaxFrameSize = 1024 * 1024
+
+const (
+	helloFrameKind  uint8 = 1
+	stanzaFrameKind uint8 = 2
+)
+
+// DeliveryFlags represents a set of stanza forwarding options.
+type DeliveryFlags uint8
+
+const (
+	// StoreOffline requests the stanza to be archived whenever
+	// destination has no available resource on the receiving node.
+	StoreOffline DeliveryFlags = 1 << iota
+
+	// Tracked marks the stanza as subject to delivery tracking.
+	Tracked
+)
+
+var (
+	// ErrFrameTooLarge is returned when decoding a frame exceeding MaxFrameSize.
+	ErrFrameTooLarge = errors.New("cluster: frame too large")
+
+	// ErrMalformedFrame is returned when decoding an inconsistent frame.
+	ErrMalformedFrame = errors.New("cluster: malformed frame")
+
+	// ErrNoCommonVersion is returned whenever two nodes share no protocol version.
+	ErrNoCommonVersion = errors.New("cluster: no common protocol version")
+)
+
+// Hello represents the frame exchanged by two nodes on connection
+// in order to agree on the protocol version to be used.
+type Hello struct {
+	Node       string
+	MinVersion uint8
+	MaxVersion uint8
+}
+
+// NegotiateVersion returns the highest protocol version
+// supported by both this node and the remote hello sender.
+func NegotiateVersion(remote *Hello) (uint8, error) {
+	max := MaxProtocolVersion
+	if remote.MaxVersion < max {
+		max = remote.MaxVersion
+	}
+	min := MinProtocolVersion
+	if remote.MinVersion > min {
+		min = remote.MinVersion
+	}
+	if max < min {
+		return 0, ErrNoCommonVersion
+	}
+	return max, nil
+}
+
+// StanzaFrame represents a stanza forwarded from one node to another.
+type StanzaFrame struct {
+	Version  uint8
+	Flags    DeliveryFlags
+	FromNode string
+	To       *xml.JID
+	Element  xml.Element
+}
+
+// EncodeHello writes a hello frame to w.
+func EncodeHello(w io.Writer, h *Hello) error {
+	body := new(bytes.Buffer)
+	writeString(body, h.Node)
+	body.WriteByte(h.MinVersion)
+	body.WriteByte(h.MaxVersion)
+	return writeFrame(w, 0, helloFrameKind, body.Bytes())
+}
+
+// EncodeStanza writes a stanza frame to w.
+func EncodeStanza(w io.Writer, f *StanzaFrame) error {
+	if f.Version < MinProtocolVersion || f.Version > MaxProtocolVersion {
+		return fmt.Errorf("cluster: unsupported protocol version: %d", f.Version)
+	}
+	body := new(bytes.Buffer)
+	body.WriteByte(uint8(f.Flags))
+	writeString(body, f.FromNode)
+	writeString(body, f.To.String())
+	encodeElement(body, f.Element)
+	return writeFrame(w, f.Version, stanzaFrameKind, body.Bytes())
+}
+
+// Decode reads a single frame from r, returning either a *Hello or a *StanzaFrame value.
+func Decode(r io.Reader) (interface{}, error) {
+	var hdr [6]byte
+	if _, err := io.ReadFull(r, hdr[:4]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(hdr[:4])
+	if length > MaxFrameSize {
+		return nil, ErrFrameTooLarge
+	}
+	if length < 2 {
+		return nil, ErrMalformedFrame
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	version, kind, body := b[0], b[1], bytes.NewReader(b[2:])
+
+	switch kind {
+	case helloFrameKind:
+		h, err := decodeHello(body)
+		if err != nil {
+			return nil, err
+		}
+		return h, nil
+	case stanzaFrameKind:
+		if version < MinProtocolVersion || version > MaxProtocolVersion {
+			return nil, fmt.Errorf("cluster: unsupported protocol version: %d", version)
+		}
+		f, err := decodeStanza(version, body)
+		if err != nil {
+			return nil, err
+		}
+		return f, nil
+	}
+	return nil, fmt.Errorf("cluster: unrecognized frame kind: %d", kind)
+}
+
+func decodeHello(r *bytes.Reader) (*Hello, error) {
+	var h Hello
+	var err error
+	if h.Node, err = readString(r); err != nil {
+		return nil, err
+	}
+	if h.MinVersion, err = r.ReadByte(); err != nil {
+		return nil, ErrMalformedFrame
+	}
+	if h.MaxVersion, err = r.ReadByte(); err != nil {
+		return nil, ErrMalformedFrame
+	}
+	if r.Len() > 0 || h.MinVersion > h.MaxVersion {
+		return nil, ErrMalformedFrame
+	}
+	return &h, nil
+}
+
+func decodeStanza(version uint8, r *bytes.Reader) (*StanzaFrame, error) {
+	f := &StanzaFrame{Version: version}
+	flags, err := r.ReadByte()
+	if err != nil {
+		return nil, ErrMalformedFrame
+	}
+	f.Flags = DeliveryFlags(flags)
+	if f.FromNode, err = readString(r); err != nil {
+		return nil, err
+	}
+	to, err := readString(r)
+	if err != nil {
+		return nil, err
+	}
+	if f.To, err = xml.NewJIDString(to, true); err != nil {
+		return nil, err
+	}
+	if f.Element, err = decodeElement(r, 0); err != nil {
+		return nil, err
+	}
+	if r.Len() > 0 {
+		return nil, ErrMalformedFrame
+	}
+	return f, nil
+}
+
+func writeFrame(w io.Writer, version, kind uint8, body []byte) error {
+	length := len(body) + 2
+	if length > MaxFrameSize {
+		return ErrFrameTooLarge
+	}
+	b := make([]byte, 6, 6+len(body))
+	binary.BigEndian.PutUint32(b, uint32(length))
+	b[4] = version
+	b[5] = kind
+	_, err := w.Write(append(b, body...))
+	return err
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package cluster
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math/rand"
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFrame_Hello(t *testing.T) {
+	buf := new(bytes.Buffer)
+	require.Nil(t, EncodeHello(buf, &Hello{Node: "node1", MinVersion: 1, MaxVersion: 3}))
+
+	frame, err := Decode(buf)
+	require.Nil(t, err)
+	h, ok := frame.(*Hello)
+	require.True(t, ok)
+	require.Equal(t, "node1", h.Node)
+	require.Equal(t, uint8(1), h.MinVersion)
+	require.Equal(t, uint8(3), h.MaxVersion)
+
+	// inconsistent version range
+	buf.Reset()
+	EncodeHello(buf, &Hello{Node: "node1", MinVersion: 2, MaxVersion: 1})
+	_, err = Decode(buf)
+	require.Equal(t, ErrMalformedFrame, err)
+}
+
+func TestFrame_NegotiateVersion(t *testing.T) {
+	v, err := NegotiateVersion(&Hello{MinVersion: 1, MaxVersion: MaxProtocolVersion + 2})
+	require.Nil(t, err)
+	require.Equal(t, MaxProtocolVersion, v)
+
+	v, err = NegotiateVersion(&Hello{MinVersion: 0, MaxVersion: MinProtocolVersion})
+	require.Nil(t, err)
+	require.Equal(t, MinProtocolVersion, v)
+
+	_, err = NegotiateVersion(&Hello{MinVersion: MaxProtocolVersion + 1, MaxVersion: MaxProtocolVersion + 2})
+	require.Equal(t, ErrNoCommonVersion, err)
+}
+
+func TestFrame_Stanza(t *testing.T) {
+	msg := tUtilFrameMessage()
+	to, _ := xml.NewJIDString("noelia@jackal.im/garden", false)
+
+	buf := new(bytes.Buffer)
+	err := EncodeStanza(buf, &StanzaFrame{
+		Version:  MaxProtocolVersion,
+		Flags:    StoreOffline | Tracked,
+		FromNode: "node1",
+		To:       to,
+		Element:  msg,
+	})
+	require.Nil(t, err)
+
+	// frames can be read one after another from a stream
+	EncodeHello(buf, &Hello{Node: "node1", MinVersion: 1, MaxVersion: 1})
+
+	frame, err := Decode(buf)
+	require.Nil(t, err)
+	f, ok := frame.(*StanzaFrame)
+	require.True(t, ok)
+	require.Equal(t, MaxProtocolVersion, f.Version)
+	require.Equal(t, StoreOffline|Tracked, f.Flags)
+	require.Equal(t, "node1", f.FromNode)
+	require.Equal(t, to.String(), f.To.String())
+	require.Equal(t, msg.String(), f.Element.String())
+
+	frame, err = Decode(buf)
+	require.Nil(t, err)
+	_, ok = frame.(*Hello)
+	require.True(t, ok)
+
+	_, err = Decode(buf)
+	require.Equal(t, io.EOF, err)
+
+	// unsupported version
+	err = EncodeStanza(buf, &StanzaFrame{Version: MaxProtocolVersion + 1, To: to, Element: msg})
+	require.NotNil(t, err)
+}
+
+func TestFrame_DecodeErrors(t *testing.T) {
+	// too large
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, MaxFrameSize+1)
+	_, err := Decode(bytes.NewReader(b))
+	require.Equal(t, ErrFrameTooLarge, err)
+
+	// truncated
+	buf := new(bytes.Buffer)
+	EncodeHello(buf, &Hello{Node: "node1", MinVersion: 1, MaxVersion: 1})
+	_, err = Decode(bytes.NewReader(buf.Bytes()[:buf.Len()-1]))
+	require.Equal(t, io.ErrUnexpectedEOF, err)
+
+	// unknown kind
+	_, err = Decode(bytes.NewReader([]byte{0, 0, 0, 2, 1, 99}))
+	require.NotNil(t, err)
+
+	// unsupported version
+	_, err = Decode(bytes.NewReader([]byte{0, 0, 0, 2, MaxProtocolVersion + 1, stanzaFrameKind}))
+	require.NotNil(t, err)
+
+	// trailing bytes
+	buf.Reset()
+	to, _ := xml.NewJIDString("noelia@jackal.im", false)
+	EncodeStanza(buf, &StanzaFrame{Version: MaxProtocolVersion, To: to, Element: tUtilFrameMessage()})
+	b = append([]byte{}, buf.Bytes()...)
+	b = append(b, 0xff)
+	binary.BigEndian.PutUint32(b, binary.BigEndian.Uint32(b)+1)
+	_, err = Decode(bytes.NewReader(b))
+	require.Equal(t, ErrMalformedFrame, err)
+
+	// nesting too deep
+	el := xml.NewElementName("e")
+	for i := 0; i < maxElementDepth+1; i++ {
+		parent := xml.NewElementName("e")
+		parent.AppendElement(el)
+		el = parent
+	}
+	buf.Reset()
+	EncodeStanza(buf, &StanzaFrame{Version: MaxProtocolVersion, To: to, Element: el})
+	_, err = Decode(buf)
+	require.Equal(t, ErrMalformedFrame, err)
+}
+
+// TestFrame_DecodeFuzz feeds the decoder with randomly mutated frames,
+// making sure it never panics nor returns a frame along with an error.
+func TestFrame_DecodeFuzz(t *testing.T) {
+	to, _ := xml.NewJIDString("noelia@jackal.im/garden", false)
+	buf := new(bytes.Buffer)
+	EncodeStanza(buf, &StanzaFrame{Version: MaxProtocolVersion, FromNode: "node1", To: to, Element: tUtilFrameMessage()})
+	stanzaFrame := append([]byte{}, buf.Bytes()...)
+	buf.Reset()
+	EncodeHello(buf, &Hello{Node: "node1", MinVersion: 1, MaxVersion: 1})
+	helloFrame := append([]byte{}, buf.Bytes()...)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 20000; i++ {
+		seed := stanzaFrame
+		if i%4 == 0 {
+			seed = helloFrame
+		}
+		b := append([]byte{}, seed...)
+		switch rnd.Intn(3) {
+		case 0: // flip random bytes, keeping the length prefix
+			for j := 0; j < 1+rnd.Intn(8); j++ {
+				b[4+rnd.Intn(len(b)-4)] = byte(rnd.Intn(256))
+			}
+		case 1: // truncate
+			b = b[:rnd.Intn(len(b))]
+		case 2: // random garbage
+			b = make([]byte, rnd.Intn(64))
+			rnd.Read(b)
+		}
+		frame, err := Decode(bytes.NewReader(b))
+		if err != nil {
+			require.Nil(t, frame)
+			continue
+		}
+		// re-encoding a decoded frame must always succeed
+		buf.Reset()
+		switch f := frame.(type) {
+		case *Hello:
+			err = EncodeHello(buf, f)
+		case *StanzaFrame:
+			err = EncodeStanza(buf, f)
+		}
+		require.Nil(t, err)
+	}
+}
+
+func BenchmarkFrame_RoundTrip(b *testing.B) {
+	msg := tUtilFrameMessage()
+	to, _ := xml.NewJIDString("noelia@jackal.im/garden", false)
+	f := &StanzaFrame{Version: MaxProtocolVersion, FromNode: "node1", To: to, Element: msg}
+
+	buf := new(bytes.Buffer)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		EncodeStanza(buf, f)
+		if _, err := Decode(buf); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkFrame_XMLRoundTrip(b *testing.B) {
+	msg := tUtilFrameMessage()
+
+	buf := new(bytes.Buffer)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		buf.Reset()
+		msg.ToXML(buf, true)
+		if _, err := xml.NewParser(buf).ParseElement(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func tUtilFrameMessage() xml.Element {
+	msg := xml.NewElementName("message")
+	msg.SetID("abcd1234")
+	msg.SetFrom("ortuman@jackal.im/balcony")
+	msg.SetTo("noelia@jackal.im/garden")
+	msg.SetType("chat")
+	body := xml.NewElementName("body")
+	body.SetText("Hi noelia! Are you coming to the party tonight? I'll bring some <snacks> & drinks.")
+	msg.AppendElement(body)
+	thread := xml.NewElementName("thread")
+	thread.SetText("e0ffe42b28561960c6b12b944a092794b9683a38")
+	msg.AppendElement(thread)
+	return msg
+}
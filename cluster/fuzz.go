@@ -0,0 +1,34 @@
+//go:build gofuzz
+// +build gofuzz
+
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package cluster
+
+import "bytes"
+
+// Fuzz is the go-fuzz entry point for the frame decoder.
+func Fuzz(data []byte) int {
+	frame, err := Decode(bytes.NewReader(data))
+	if err != nil {
+		if frame != nil {
+			panic("frame returned along with an error")
+		}
+		return 0
+	}
+	// re-encoding a decoded frame must always succeed
+	buf := new(bytes.Buffer)
+	switch f := frame.(type) {
+	case *Hello:
+		err = EncodeHello(buf, f)
+	case *StanzaFrame:
+		err = EncodeStanza(buf, f)
+	}
+	if err != nil {
+		panic(err)
+	}
+	return 1
+}
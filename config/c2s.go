@@ -5,15 +5,26 @@
 
 package config
 
-import "errors"
+import (
+	"errors"
+	"runtime"
+)
+
+const defaultWorkerQueueSize = 256
 
 // C2S represents a client-to-server manager configuration.
 type C2S struct {
-	Domains []string
+	Domains         []string
+	Admins          []string
+	Workers         int
+	WorkerQueueSize int
 }
 
 type c2sProxyType struct {
-	Domains []string `yaml:"domains"`
+	Domains         []string `yaml:"domains"`
+	Admins          []string `yaml:"admins"`
+	Workers         int      `yaml:"workers"`
+	WorkerQueueSize int      `yaml:"worker_queue_size"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -25,6 +36,18 @@ func (c *C2S) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if len(p.Domains) == 0 {
 		return errors.New("config.C2S: no domain specified")
 	}
+	if p.Workers < 0 || p.WorkerQueueSize < 0 {
+		return errors.New("config.C2S: workers and worker_queue_size must be positive")
+	}
 	c.Domains = p.Domains
+	c.Admins = p.Admins
+	c.Workers = p.Workers
+	if c.Workers == 0 {
+		c.Workers = runtime.NumCPU()
+	}
+	c.WorkerQueueSize = p.WorkerQueueSize
+	if c.WorkerQueueSize == 0 {
+		c.WorkerQueueSize = defaultWorkerQueueSize
+	}
 	return nil
 }
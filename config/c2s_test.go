@@ -30,3 +30,26 @@ func TestC2SBadConfig(t *testing.T) {
 	err := yaml.Unmarshal([]byte("domains"), &c2s)
 	require.NotNil(t, err)
 }
+
+func TestC2SWorkers(t *testing.T) {
+	c2s := C2S{}
+	err := yaml.Unmarshal([]byte("domains: [jackal.im]"), &c2s)
+	require.Nil(t, err)
+	require.True(t, c2s.Workers > 0)
+	require.Equal(t, defaultWorkerQueueSize, c2s.WorkerQueueSize)
+
+	err = yaml.Unmarshal([]byte("{domains: [jackal.im], workers: 8, worker_queue_size: 64}"), &c2s)
+	require.Nil(t, err)
+	require.Equal(t, 8, c2s.Workers)
+	require.Equal(t, 64, c2s.WorkerQueueSize)
+
+	err = yaml.Unmarshal([]byte("{domains: [jackal.im], workers: -1}"), &c2s)
+	require.NotNil(t, err)
+}
+
+func TestC2SAdmins(t *testing.T) {
+	c2s := C2S{}
+	err := yaml.Unmarshal([]byte("{domains: [jackal.im], admins: [admin@jackal.im]}"), &c2s)
+	require.Nil(t, err)
+	require.Equal(t, []string{"admin@jackal.im"}, c2s.Admins)
+}
@@ -18,10 +18,16 @@ type Config struct {
 	Debug   struct {
 		Port int `yaml:"port"`
 	} `yaml:"debug"`
-	Logger  Logger   `yaml:"logger"`
-	Storage Storage  `yaml:"storage"`
-	C2S     C2S      `yaml:"c2s"`
-	Servers []Server `yaml:"servers"`
+	Metrics struct {
+		BindAddress string `yaml:"bind_addr"`
+		Port        int    `yaml:"port"`
+	} `yaml:"metrics"`
+	Logger       Logger       `yaml:"logger"`
+	Storage      Storage      `yaml:"storage"`
+	C2S          C2S          `yaml:"c2s"`
+	RosterSync   RosterSync   `yaml:"roster_sync"`
+	FeatureFlags FeatureFlags `yaml:"feature_flags"`
+	Servers      []Server     `yaml:"servers"`
 }
 
 // FromFile loads default global configuration from
@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+)
+
+// FeatureFlags represents feature flags configuration.
+// Overrides admin API is served whenever Port is greater than zero.
+type FeatureFlags struct {
+	BindAddress string
+	Port        int
+	Tokens      []string
+	Flags       []FeatureFlag
+}
+
+// FeatureFlag represents a feature flag definition.
+// Whenever not enabled by default, the flag is enabled
+// for a Rollout percentage of users.
+type FeatureFlag struct {
+	Name    string `yaml:"name"`
+	Enabled bool   `yaml:"enabled"`
+	Rollout int    `yaml:"rollout"`
+}
+
+type featureFlagsProxyType struct {
+	BindAddress string        `yaml:"bind_addr"`
+	Port        int           `yaml:"port"`
+	Tokens      []string      `yaml:"tokens"`
+	Flags       []FeatureFlag `yaml:"flags"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (f *FeatureFlags) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := featureFlagsProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.Port > 0 && len(p.Tokens) == 0 {
+		return errors.New("config.FeatureFlags: no access token specified")
+	}
+	for _, tk := range p.Tokens {
+		if len(tk) == 0 {
+			return errors.New("config.FeatureFlags: empty access token")
+		}
+	}
+	names := map[string]struct{}{}
+	for _, flag := range p.Flags {
+		if len(flag.Name) == 0 {
+			return errors.New("config.FeatureFlags: flag name must be specified")
+		}
+		if _, ok := names[flag.Name]; ok {
+			return fmt.Errorf("config.FeatureFlags: duplicated flag: %s", flag.Name)
+		}
+		if flag.Rollout < 0 || flag.Rollout > 100 {
+			return fmt.Errorf("config.FeatureFlags: %s rollout must be a percentage", flag.Name)
+		}
+		names[flag.Name] = struct{}{}
+	}
+	f.BindAddress = p.BindAddress
+	f.Port = p.Port
+	f.Tokens = p.Tokens
+	f.Flags = p.Flags
+	return nil
+}
@@ -0,0 +1,56 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestFeatureFlagsLoad(t *testing.T) {
+	ff := FeatureFlags{}
+	err := yaml.Unmarshal([]byte(`
+port: 9091
+tokens: [s3cr3t]
+flags:
+  - name: vacation
+    enabled: yes
+  - name: carbons
+    rollout: 5
+`), &ff)
+	require.Nil(t, err)
+	require.Equal(t, 9091, ff.Port)
+	require.Equal(t, []string{"s3cr3t"}, ff.Tokens)
+	require.Equal(t, []FeatureFlag{{Name: "vacation", Enabled: true}, {Name: "carbons", Rollout: 5}}, ff.Flags)
+}
+
+func TestFeatureFlagsBadConfig(t *testing.T) {
+	ff := FeatureFlags{}
+	err := yaml.Unmarshal([]byte("port: 9091"), &ff)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte(`
+flags:
+  - enabled: yes
+`), &ff)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte(`
+flags:
+  - name: carbons
+  - name: carbons
+`), &ff)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte(`
+flags:
+  - name: carbons
+    rollout: 101
+`), &ff)
+	require.NotNil(t, err)
+}
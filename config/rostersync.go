@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package config
+
+import (
+	"errors"
+	"fmt"
+	"path"
+)
+
+// RosterSync represents roster sync API configuration.
+type RosterSync struct {
+	BindAddress string
+	Port        int
+	Tokens      []RosterSyncToken
+}
+
+// RosterSyncToken represents a roster sync API access token
+// along with the username patterns it's allowed to watch.
+type RosterSyncToken struct {
+	Token     string   `yaml:"token"`
+	Usernames []string `yaml:"usernames"`
+}
+
+type rosterSyncProxyType struct {
+	BindAddress string            `yaml:"bind_addr"`
+	Port        int               `yaml:"port"`
+	Tokens      []RosterSyncToken `yaml:"tokens"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (r *RosterSync) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := rosterSyncProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if p.Port > 0 && len(p.Tokens) == 0 {
+		return errors.New("config.RosterSync: no access token specified")
+	}
+	for _, tk := range p.Tokens {
+		if len(tk.Token) == 0 {
+			return errors.New("config.RosterSync: empty access token")
+		}
+		for _, pattern := range tk.Usernames {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("config.RosterSync: malformed username pattern: %s", pattern)
+			}
+		}
+	}
+	r.BindAddress = p.BindAddress
+	r.Port = p.Port
+	r.Tokens = p.Tokens
+	return nil
+}
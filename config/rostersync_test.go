@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package config
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"gopkg.in/yaml.v2"
+)
+
+func TestRosterSyncLoad(t *testing.T) {
+	rs := RosterSync{}
+	err := yaml.Unmarshal([]byte(`
+port: 9090
+tokens:
+  - token: s3cr3t
+    usernames: ["crm_*", ortuman]
+`), &rs)
+	require.Nil(t, err)
+	require.Equal(t, 9090, rs.Port)
+	require.Equal(t, 1, len(rs.Tokens))
+	require.Equal(t, "s3cr3t", rs.Tokens[0].Token)
+	require.Equal(t, []string{"crm_*", "ortuman"}, rs.Tokens[0].Usernames)
+}
+
+func TestRosterSyncBadConfig(t *testing.T) {
+	rs := RosterSync{}
+	err := yaml.Unmarshal([]byte("port: 9090"), &rs)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte(`
+port: 9090
+tokens:
+  - usernames: [ortuman]
+`), &rs)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte(`
+port: 9090
+tokens:
+  - token: s3cr3t
+    usernames: ["crm_["]
+`), &rs)
+	require.NotNil(t, err)
+}
@@ -18,6 +18,15 @@ const defaultTransportBufferSize = 4096
 const defaultTransportConnectTimeout = 5
 const defaultTransportKeepAlive = 120
 
+// SCRAM verifiers are only derived whenever any SCRAM mechanism is enabled,
+// given that, unlike password hashes, they're cheap to brute force once
+// leaked. A higher iteration count slows down brute forcing as well as
+// every SCRAM authentication.
+const (
+	defaultScramIterations = 100000
+	minScramIterations     = 4096
+)
+
 // ServerType represents a server type (c2s, s2s).
 type ServerType int
 
@@ -83,6 +92,108 @@ func (tt TransportType) String() string {
 	return ""
 }
 
+// LargePayloadPolicy represents the way oversized element text is handled.
+type LargePayloadPolicy int
+
+const (
+	// KeepLargePayload keeps oversized element text in memory.
+	KeepLargePayload LargePayloadPolicy = iota
+
+	// SpoolLargePayload spools oversized element text to a temporary file.
+	SpoolLargePayload
+
+	// TruncateLargePayload truncates oversized element text.
+	TruncateLargePayload
+)
+
+// PingMode represents the way peer liveness is probed.
+type PingMode int
+
+const (
+	// IQPing sends ping IQs, expecting their pongs.
+	IQPing PingMode = iota
+
+	// WhitespacePing writes whitespace keepalives, expecting no reply.
+	WhitespacePing
+)
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (m *PingMode) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var mode string
+	if err := unmarshal(&mode); err != nil {
+		return err
+	}
+	switch mode {
+	case "", "iq":
+		*m = IQPing
+	case "whitespace":
+		*m = WhitespacePing
+	default:
+		return fmt.Errorf("config.ModPing: unrecognized mode: %s", mode)
+	}
+	return nil
+}
+
+// OfflineQueuePolicy represents the way messages addressed
+// to users whose offline queue is full are handled.
+type OfflineQueuePolicy int
+
+const (
+	// BounceOnFullQueue bounces incoming messages back to their senders.
+	BounceOnFullQueue OfflineQueuePolicy = iota
+
+	// DropOldestOnFullQueue drops the oldest queued messages,
+	// making room for incoming ones.
+	DropOldestOnFullQueue
+)
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (p *OfflineQueuePolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var policy string
+	if err := unmarshal(&policy); err != nil {
+		return err
+	}
+	switch policy {
+	case "", "bounce":
+		*p = BounceOnFullQueue
+	case "drop_oldest":
+		*p = DropOldestOnFullQueue
+	default:
+		return fmt.Errorf("config.ModOffline: unrecognized queue policy: %s", policy)
+	}
+	return nil
+}
+
+// CSIPolicy represents the way low importance stanzas
+// addressed to inactive clients are handled.
+type CSIPolicy int
+
+const (
+	// QueueWhileInactive queues low importance stanzas, delivering
+	// the most recent ones once client becomes active again.
+	QueueWhileInactive CSIPolicy = iota
+
+	// DropWhileInactive drops low importance stanzas.
+	DropWhileInactive
+)
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (p *CSIPolicy) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var policy string
+	if err := unmarshal(&policy); err != nil {
+		return err
+	}
+	switch policy {
+	case "", "queue":
+		*p = QueueWhileInactive
+	case "drop":
+		*p = DropWhileInactive
+	default:
+		return fmt.Errorf("config.ModCSI: unrecognized policy: %s", policy)
+	}
+	return nil
+}
+
 // CompressionLevel represents a stream compression level.
 type CompressionLevel int
 
@@ -120,13 +231,26 @@ type Server struct {
 	ResourceConflict ResourceConflictPolicy
 	Transport        Transport
 	SASL             []string
+	ScramIterations  int
+	PasswordHashing  PasswordHashing
 	TLS              TLS
 	Modules          map[string]struct{}
 	Compression      Compression
+	StanzaDump       StanzaDump
+	LargePayload     LargePayload
+	Bounce           Bounce
+	Rewrite          []RewriteRule
 	ModOffline       ModOffline
 	ModRegistration  ModRegistration
 	ModVersion       ModVersion
 	ModPing          ModPing
+	ModVacation      ModVacation
+	ModTracking      ModTracking
+	ModFooter        ModFooter
+	ModSpam          ModSpam
+	ModMAM           ModMAM
+	ModStreamMgmt    ModStreamMgmt
+	ModCSI           ModCSI
 }
 
 type serverProxyType struct {
@@ -135,18 +259,33 @@ type serverProxyType struct {
 	ResourceConflict string          `yaml:"resource_conflict"`
 	Transport        Transport       `yaml:"transport"`
 	SASL             []string        `yaml:"sasl"`
+	ScramIterations  int             `yaml:"scram_iteration_count"`
+	PasswordHashing  PasswordHashing `yaml:"password_hashing"`
 	TLS              TLS             `yaml:"tls"`
 	Modules          []string        `yaml:"modules"`
 	Compression      Compression     `yaml:"compression"`
+	StanzaDump       StanzaDump      `yaml:"stanza_dump"`
+	LargePayload     LargePayload    `yaml:"large_payload"`
+	Bounce           Bounce          `yaml:"bounce"`
+	Rewrite          []RewriteRule   `yaml:"rewrite"`
 	ModOffline       ModOffline      `yaml:"mod_offline"`
 	ModRegistration  ModRegistration `yaml:"mod_registration"`
 	ModVersion       ModVersion      `yaml:"mod_version"`
 	ModPing          ModPing         `yaml:"mod_ping"`
+	ModVacation      ModVacation     `yaml:"mod_vacation"`
+	ModTracking      ModTracking     `yaml:"mod_tracking"`
+	ModFooter        ModFooter       `yaml:"mod_footer"`
+	ModSpam          ModSpam         `yaml:"mod_spam"`
+	ModMAM           ModMAM          `yaml:"mod_mam"`
+	ModStreamMgmt    ModStreamMgmt   `yaml:"mod_stream_mgmt"`
+	ModCSI           ModCSI          `yaml:"mod_csi"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
 func (s *Server) UnmarshalYAML(unmarshal func(interface{}) error) error {
-	p := serverProxyType{}
+	p := serverProxyType{
+		ModRegistration: ModRegistration{RequireSecured: true},
+	}
 	if err := unmarshal(&p); err != nil {
 		return err
 	}
@@ -180,29 +319,130 @@ func (s *Server) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			return fmt.Errorf("config.Server: unrecognized SASL mechanism: %s", sasl)
 		}
 	}
+	// validate SCRAM iteration count
+	switch {
+	case p.ScramIterations == 0:
+		s.ScramIterations = defaultScramIterations
+	case p.ScramIterations < minScramIterations:
+		return fmt.Errorf("config.Server: scram_iteration_count must be at least %d", minScramIterations)
+	default:
+		s.ScramIterations = p.ScramIterations
+	}
+	s.PasswordHashing = p.PasswordHashing
+	if s.PasswordHashing.Cost == 0 {
+		s.PasswordHashing = PasswordHashing{Algorithm: BCrypt, Cost: defaultBCryptCost}
+	}
+	// validate rewrite rules
+	ruleNames := map[string]struct{}{}
+	for _, rule := range p.Rewrite {
+		if _, ok := ruleNames[rule.Name]; ok {
+			return fmt.Errorf("config.Server: duplicated rewrite rule: %s", rule.Name)
+		}
+		ruleNames[rule.Name] = struct{}{}
+	}
+	if p.StanzaDump.Size < 0 {
+		return errors.New("config.Server: stanza_dump size must be positive")
+	}
+	if p.ModOffline.QueuePolicy == DropOldestOnFullQueue && p.ModOffline.QueueSize <= 0 {
+		return errors.New("config.Server: mod_offline drop_oldest queue policy requires a positive queue_size")
+	}
+	if p.ModPing.SendTimeout < 0 || p.ModPing.SendTimeout > p.ModPing.SendInterval {
+		return errors.New("config.Server: mod_ping send_timeout must be positive and not larger than send_interval")
+	}
+	if p.ModPing.InactiveSendInterval != 0 && p.ModPing.InactiveSendInterval < p.ModPing.SendInterval {
+		return errors.New("config.Server: mod_ping inactive_send_interval must not be smaller than send_interval")
+	}
+	if p.ModPing.MaxMissed < 0 {
+		return errors.New("config.Server: mod_ping max_missed must be positive")
+	}
+	if p.ModPing.Jitter < 0 || p.ModPing.Jitter >= 1 {
+		return errors.New("config.Server: mod_ping jitter must be within [0, 1)")
+	}
+	if p.ModPing.S2S.SendTimeout < 0 || p.ModPing.S2S.SendTimeout > p.ModPing.S2S.SendInterval {
+		return errors.New("config.Server: mod_ping s2s send_timeout must be positive and not larger than send_interval")
+	}
+	if p.ModMAM.MaxPageSize < 0 {
+		return errors.New("config.Server: mod_mam max_page_size must be positive")
+	}
+	switch p.ModMAM.Default {
+	case "", "always", "roster", "never":
+		break
+	default:
+		return fmt.Errorf("config.Server: unrecognized mod_mam default: %s", p.ModMAM.Default)
+	}
+	if p.ModStreamMgmt.ResumeTimeout < 0 {
+		return errors.New("config.Server: mod_stream_mgmt resume_timeout must be positive")
+	}
+	if p.ModStreamMgmt.MaxQueueSize < 0 {
+		return errors.New("config.Server: mod_stream_mgmt max_queue_size must be positive")
+	}
+	if p.ModStreamMgmt.MaxResumable < 0 {
+		return errors.New("config.Server: mod_stream_mgmt max_resumable must be positive")
+	}
+	if p.ModStreamMgmt.MaxResumeFailures < 0 {
+		return errors.New("config.Server: mod_stream_mgmt max_resume_failures must be positive")
+	}
+	if p.ModStreamMgmt.MaxPersistedQueueSize < 0 {
+		return errors.New("config.Server: mod_stream_mgmt max_persisted_queue_size must be positive")
+	}
+	if p.ModCSI.MaxQueueSize < 0 {
+		return errors.New("config.Server: mod_csi max_queue_size must be positive")
+	}
+	// validate registration notification recipients
+	for _, jid := range p.ModRegistration.NotifyJIDs {
+		if !isBareJID(jid) {
+			return fmt.Errorf("config.Server: malformed registration notify jid: %s", jid)
+		}
+	}
 	// validate modules
 	s.Modules = map[string]struct{}{}
 	for _, module := range p.Modules {
 		switch module {
-		case "roster", "private", "vcard", "registration", "version", "ping", "offline":
+		case "roster", "private", "vcard", "registration", "version", "ping", "offline", "vacation", "tracking", "stats", "footer", "spam", "forwarding", "offline_retrieval", "mam", "stream_mgmt", "blocking", "privacy", "csi":
 			break
 		default:
 			return fmt.Errorf("config.Server: unrecognized module: %s", module)
 		}
 		s.Modules[module] = struct{}{}
 	}
+	if _, ok := s.Modules["offline_retrieval"]; ok {
+		if _, ok := s.Modules["offline"]; !ok {
+			return errors.New("config.Server: offline_retrieval module requires offline module")
+		}
+	}
 	s.ID = p.ID
 	s.Transport = p.Transport
 	s.SASL = p.SASL
 	s.TLS = p.TLS
 	s.Compression = p.Compression
+	s.StanzaDump = p.StanzaDump
+	s.LargePayload = p.LargePayload
+	s.Bounce = p.Bounce
+	s.Rewrite = p.Rewrite
 	s.ModOffline = p.ModOffline
 	s.ModRegistration = p.ModRegistration
 	s.ModVersion = p.ModVersion
 	s.ModPing = p.ModPing
+	s.ModVacation = p.ModVacation
+	s.ModTracking = p.ModTracking
+	s.ModFooter = p.ModFooter
+	s.ModSpam = p.ModSpam
+	s.ModMAM = p.ModMAM
+	s.ModStreamMgmt = p.ModStreamMgmt
+	s.ModCSI = p.ModCSI
 	return nil
 }
 
+// IsScramEnabled returns whether or not any SCRAM mechanism is enabled.
+func (s *Server) IsScramEnabled() bool {
+	for _, sasl := range s.SASL {
+		if sasl == "scram_sha_1" || sasl == "scram_sha_256" {
+			return true
+		}
+	}
+	return false
+}
+
 // Transport represents an XMPP stream transport configuration.
 type Transport struct {
 	Type           TransportType
@@ -268,13 +508,31 @@ type TLS struct {
 	PrivKeyFile string `yaml:"privkey_path"`
 }
 
+// defaultCompressionFlushWindow is the default time (in milliseconds)
+// compressed data can be kept buffered once a minimum flush size is set.
+const defaultCompressionFlushWindow = 50
+
 // Compression represents a server stream compression configuration.
 type Compression struct {
 	Level CompressionLevel
+
+	// MinFlushSize is the amount of written bytes below which compressed
+	// data is kept buffered, so that small stanzas get coalesced.
+	MinFlushSize int
+
+	// FlushWindow is the maximum time (in milliseconds) compressed data
+	// can be kept buffered.
+	FlushWindow int
+
+	// DisableOverTLS prevents offering compression over secured streams.
+	DisableOverTLS bool
 }
 
 type compressionProxyType struct {
-	Level string `yaml:"level"`
+	Level          string `yaml:"level"`
+	MinFlushSize   int    `yaml:"min_flush_size"`
+	FlushWindow    int    `yaml:"flush_window"`
+	DisableOverTLS bool   `yaml:"disable_over_tls"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -295,19 +553,433 @@ func (c *Compression) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	default:
 		return fmt.Errorf("config.Compress: unrecognized compression level: %s", p.Level)
 	}
+	if p.MinFlushSize < 0 {
+		return fmt.Errorf("config.Compress: invalid minimum flush size: %d", p.MinFlushSize)
+	}
+	c.MinFlushSize = p.MinFlushSize
+	c.FlushWindow = p.FlushWindow
+	if c.MinFlushSize > 0 && c.FlushWindow <= 0 {
+		c.FlushWindow = defaultCompressionFlushWindow
+	}
+	c.DisableOverTLS = p.DisableOverTLS
+	return nil
+}
+
+// PasswordHashAlgorithm represents a password hashing algorithm.
+type PasswordHashAlgorithm int
+
+const (
+	// BCrypt represents 'bcrypt' password hashing algorithm.
+	BCrypt PasswordHashAlgorithm = iota
+
+	// Argon2id represents 'argon2id' password hashing algorithm.
+	Argon2id
+)
+
+// String returns PasswordHashAlgorithm string representation.
+func (a PasswordHashAlgorithm) String() string {
+	switch a {
+	case BCrypt:
+		return "bcrypt"
+	case Argon2id:
+		return "argon2id"
+	}
+	return ""
+}
+
+const (
+	defaultBCryptCost   = 10
+	minBCryptCost       = 4
+	maxBCryptCost       = 31
+	defaultArgon2idCost = 3
+)
+
+// PasswordHashing represents the way account passwords get hashed before being stored.
+//
+// Cost stands for the bcrypt cost factor, or the number of passes over
+// memory when using argon2id.
+type PasswordHashing struct {
+	Algorithm PasswordHashAlgorithm
+	Cost      int
+}
+
+type passwordHashingProxyType struct {
+	Algorithm string `yaml:"algorithm"`
+	Cost      int    `yaml:"cost"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (h *PasswordHashing) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := passwordHashingProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	switch p.Algorithm {
+	case "", "bcrypt":
+		h.Algorithm = BCrypt
+		switch {
+		case p.Cost == 0:
+			h.Cost = defaultBCryptCost
+		case p.Cost < minBCryptCost || p.Cost > maxBCryptCost:
+			return fmt.Errorf("config.PasswordHashing: bcrypt cost must be between %d and %d", minBCryptCost, maxBCryptCost)
+		default:
+			h.Cost = p.Cost
+		}
+	case "argon2id":
+		h.Algorithm = Argon2id
+		switch {
+		case p.Cost == 0:
+			h.Cost = defaultArgon2idCost
+		case p.Cost < 0:
+			return errors.New("config.PasswordHashing: argon2id cost must be positive")
+		default:
+			h.Cost = p.Cost
+		}
+	default:
+		return fmt.Errorf("config.PasswordHashing: unrecognized algorithm: %s", p.Algorithm)
+	}
+	return nil
+}
+
+// StanzaDump represents a stream stanza dump configuration.
+// Dumps are disabled whenever size is zero.
+type StanzaDump struct {
+	Size int    `yaml:"size"`
+	File string `yaml:"file"`
+}
+
+const defaultLargePayloadThreshold = 64 * 1024
+
+var defaultLargePayloadNamespaces = []string{"vcard-temp", "urn:xmpp:bob"}
+
+// LargePayload represents the handling of oversized element text
+// (such as vCard photos or bits of binary data) while parsing stanzas.
+//
+// Policy applies to text larger than Threshold bytes within Namespaces
+// qualified elements, while stanzas whose decoded size exceeds
+// MaxStanzaSize bytes are rejected altogether (unlimited if zero).
+type LargePayload struct {
+	Policy        LargePayloadPolicy
+	Threshold     int
+	Namespaces    []string
+	SpoolDir      string
+	MaxStanzaSize int
+}
+
+type largePayloadProxyType struct {
+	Policy        string   `yaml:"policy"`
+	Threshold     int      `yaml:"threshold"`
+	Namespaces    []string `yaml:"namespaces"`
+	SpoolDir      string   `yaml:"spool_dir"`
+	MaxStanzaSize int      `yaml:"max_stanza_size"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (l *LargePayload) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := largePayloadProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	switch p.Policy {
+	case "", "keep":
+		l.Policy = KeepLargePayload
+	case "spool":
+		l.Policy = SpoolLargePayload
+	case "truncate":
+		l.Policy = TruncateLargePayload
+	default:
+		return fmt.Errorf("config.LargePayload: unrecognized policy: %s", p.Policy)
+	}
+	if p.Threshold < 0 || p.MaxStanzaSize < 0 {
+		return errors.New("config.LargePayload: sizes must be positive")
+	}
+	l.Threshold = p.Threshold
+	if l.Threshold == 0 {
+		l.Threshold = defaultLargePayloadThreshold
+	}
+	l.Namespaces = p.Namespaces
+	if len(l.Namespaces) == 0 {
+		l.Namespaces = defaultLargePayloadNamespaces
+	}
+	l.SpoolDir = p.SpoolDir
+	l.MaxStanzaSize = p.MaxStanzaSize
+	return nil
+}
+
+// Bounce represents the way undeliverable stanzas are answered.
+// Whenever FakeBlockedErrors is set, stanzas dropped because its sender
+// has been blocked are answered as if the recipient didn't exist.
+type Bounce struct {
+	FakeBlockedErrors bool `yaml:"fake_blocked_errors"`
+}
+
+// RewriteDirection represents the direction of stanzas a rewrite rule applies to.
+type RewriteDirection int
+
+const (
+	// RewriteBoth represents stanzas crossing the boundary in any direction.
+	RewriteBoth RewriteDirection = iota
+
+	// RewriteInbound represents stanzas entering the server.
+	RewriteInbound
+
+	// RewriteOutbound represents stanzas leaving the server.
+	RewriteOutbound
+)
+
+// RewriteAction represents the action taken on stanzas matching a rewrite rule.
+type RewriteAction int
+
+const (
+	// RewriteDrop removes matching child elements.
+	RewriteDrop RewriteAction = iota + 1
+
+	// RewriteRename qualifies matching child elements with another namespace.
+	RewriteRename
+
+	// RewriteBounce drops the whole stanza, bouncing it back to its sender.
+	RewriteBounce
+)
+
+// RewriteRule represents a stanza rewriting rule applied at stream boundaries.
+// A rule matches stanzas containing any child element qualified by Namespace,
+// optionally restricted by Direction, by the Domain stanzas are exchanged with
+// and by Stanza name (message, presence or iq).
+type RewriteRule struct {
+	Name      string
+	Direction RewriteDirection
+	Domain    string
+	Stanza    string
+	Namespace string
+	Action    RewriteAction
+	RenameTo  string
+}
+
+type rewriteRuleProxyType struct {
+	Name      string `yaml:"name"`
+	Direction string `yaml:"direction"`
+	Domain    string `yaml:"domain"`
+	Stanza    string `yaml:"stanza"`
+	Namespace string `yaml:"namespace"`
+	Action    string `yaml:"action"`
+	RenameTo  string `yaml:"rename_to"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (r *RewriteRule) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := rewriteRuleProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	if len(p.Name) == 0 {
+		return errors.New("config.RewriteRule: rule name must be specified")
+	}
+	if len(p.Namespace) == 0 {
+		return fmt.Errorf("config.RewriteRule: %s: namespace must be specified", p.Name)
+	}
+	switch p.Direction {
+	case "":
+		r.Direction = RewriteBoth
+	case "in":
+		r.Direction = RewriteInbound
+	case "out":
+		r.Direction = RewriteOutbound
+	default:
+		return fmt.Errorf("config.RewriteRule: %s: unrecognized direction: %s", p.Name, p.Direction)
+	}
+	switch p.Stanza {
+	case "", "message", "presence", "iq":
+		break
+	default:
+		return fmt.Errorf("config.RewriteRule: %s: unrecognized stanza: %s", p.Name, p.Stanza)
+	}
+	switch p.Action {
+	case "drop":
+		r.Action = RewriteDrop
+	case "rename":
+		if len(p.RenameTo) == 0 {
+			return fmt.Errorf("config.RewriteRule: %s: rename_to must be specified", p.Name)
+		}
+		r.Action = RewriteRename
+	case "bounce":
+		r.Action = RewriteBounce
+	default:
+		return fmt.Errorf("config.RewriteRule: %s: unrecognized action: %s", p.Name, p.Action)
+	}
+	r.Name = p.Name
+	r.Domain = p.Domain
+	r.Stanza = p.Stanza
+	r.Namespace = p.Namespace
+	r.RenameTo = p.RenameTo
 	return nil
 }
 
 // ModOffline represents Offline Storage module configuration.
+// QueuePolicy determines what happens to messages addressed to users
+// whose offline queue already holds QueueSize messages.
 type ModOffline struct {
-	QueueSize int `yaml:"queue_size"`
+	QueueSize   int                `yaml:"queue_size"`
+	QueuePolicy OfflineQueuePolicy `yaml:"queue_policy"`
 }
 
 // ModRegistration represents XMPP In-Band Registration module (XEP-0077) configuration.
+// RequireSecured (enabled by default) refuses registrations over unencrypted streams.
+// Whenever registration isn't allowed, RedirectURL optionally points entities
+// to an out of band registration page.
+// KickOnPasswordChange disconnects every other account session after a password change.
+//
+// Whenever RemovalGracePeriod is greater than zero, cancelled accounts are
+// disabled and kept for that many seconds before being definitively deleted.
+// Logging back in within that period is refused, unless RestoreOnLogin is set,
+// in which case it cancels the removal.
+//
+// MaxPerConnection limits the accounts a single stream can register (defaults to one),
+// while MaxPerIP limits accounts registered from the same remote address
+// within IPWindow seconds (unlimited if zero). MaxPerWindow limits accounts
+// registered server wide within Window seconds (unlimited if zero).
+//
+// DenyList optionally names a file holding reserved username patterns,
+// while Veto optionally configures an external registration approval hook.
+//
+// Blacklist holds reserved username patterns as well, and Whitelist the only
+// usernames allowed to register whenever not empty, following deny-list syntax.
+//
+// Fields declares additional registration fields, requested by means of
+// a data form (XEP-0004) along with username and password.
+//
+// Whenever RequireEmail is set, an email address is requested as well,
+// new accounts remaining pending until its emailed token gets confirmed.
+//
+// NotifyJIDs lists the bare JIDs notified of every new account.
 type ModRegistration struct {
-	AllowRegistration bool `yaml:"allow_registration"`
-	AllowChange       bool `yaml:"allow_change"`
-	AllowCancel       bool `yaml:"allow_cancel"`
+	AllowRegistration    bool   `yaml:"allow_registration"`
+	RedirectURL          string `yaml:"redirect_url"`
+	RequireSecured       bool   `yaml:"require_secured"`
+	AllowChange          bool   `yaml:"allow_change"`
+	KickOnPasswordChange bool   `yaml:"kick_on_password_change"`
+	AllowCancel          bool   `yaml:"allow_cancel"`
+	RemovalGracePeriod   int    `yaml:"removal_grace_period"`
+	RestoreOnLogin       bool   `yaml:"restore_on_login"`
+	MaxPerConnection     int    `yaml:"max_per_connection"`
+	MaxPerIP             int    `yaml:"max_per_ip"`
+	IPWindow             int    `yaml:"ip_window"`
+	MaxPerWindow         int    `yaml:"max_per_window"`
+	Window               int    `yaml:"window"`
+	DenyList             string `yaml:"deny_list"`
+
+	Blacklist []string `yaml:"blacklist"`
+	Whitelist []string `yaml:"whitelist"`
+
+	Fields []RegistrationField `yaml:"fields"`
+
+	RequireEmail      bool              `yaml:"require_email"`
+	EmailVerification EmailVerification `yaml:"email_verification"`
+
+	TokenRequired bool `yaml:"token_required"`
+	InviteTTL     int  `yaml:"invite_ttl"`
+
+	NotifyJIDs []string `yaml:"notify_jids"`
+
+	PasswordPolicy PasswordPolicy   `yaml:"password_policy"`
+	PasswordReset  PasswordReset    `yaml:"password_reset"`
+	Veto           RegistrationVeto `yaml:"veto"`
+}
+
+// RegistrationField represents an additional registration form field.
+// Type is either 'text-single' (default) or 'text-private'.
+type RegistrationField struct {
+	Var      string
+	Label    string
+	Type     string
+	Required bool
+}
+
+type registrationFieldProxyType struct {
+	Var      string `yaml:"var"`
+	Label    string `yaml:"label"`
+	Type     string `yaml:"type"`
+	Required bool   `yaml:"required"`
+}
+
+// UnmarshalYAML satisfies Unmarshaler interface.
+func (f *RegistrationField) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	p := registrationFieldProxyType{}
+	if err := unmarshal(&p); err != nil {
+		return err
+	}
+	switch p.Var {
+	case "":
+		return errors.New("config.RegistrationField: field var must be specified")
+	case "FORM_TYPE", "username", "password":
+		return fmt.Errorf("config.RegistrationField: reserved field var: %s", p.Var)
+	}
+	switch p.Type {
+	case "":
+		p.Type = "text-single"
+	case "text-single", "text-private":
+		break
+	default:
+		return fmt.Errorf("config.RegistrationField: %s: unrecognized type: %s", p.Var, p.Type)
+	}
+	f.Var = p.Var
+	f.Label = p.Label
+	f.Type = p.Type
+	f.Required = p.Required
+	return nil
+}
+
+// RegistrationVeto represents a synchronous pre-registration hook
+// configuration. Registration candidates are posted to URL, being
+// rejected whenever the endpoint responds with a 403 status code.
+//
+// Timeout (in milliseconds) bounds every request, after which registration
+// is allowed if FailOpen is set or rejected otherwise. Verdicts are cached
+// for CacheTTL seconds per remote address and username.
+type RegistrationVeto struct {
+	URL      string `yaml:"url"`
+	Timeout  int    `yaml:"timeout"`
+	FailOpen bool   `yaml:"fail_open"`
+	CacheTTL int    `yaml:"cache_ttl"`
+}
+
+// PasswordPolicy represents the strength policy enforced on registration
+// and password change. MixedClasses requires at least three out of lowercase,
+// uppercase, digit and symbol characters, while DenyCommon rejects the most
+// common passwords. Zero values disable every rule.
+type PasswordPolicy struct {
+	MinLength    int  `yaml:"min_length"`
+	MixedClasses bool `yaml:"mixed_classes"`
+	DenyCommon   bool `yaml:"deny_common"`
+}
+
+// PasswordReset represents in-band password reset configuration.
+// Tokens are mailed to the verified registration email address, or to
+// the account vCard one if VCardFallback is set and the account has
+// no registration address at all.
+type PasswordReset struct {
+	Enabled       bool `yaml:"enabled"`
+	TokenTTL      int  `yaml:"token_ttl"`
+	MaxPerAccount int  `yaml:"max_per_account"`
+	MaxPerIP      int  `yaml:"max_per_ip"`
+	VCardFallback bool `yaml:"vcard_fallback"`
+	SMTP          SMTP `yaml:"smtp"`
+}
+
+// EmailVerification represents registration email verification configuration.
+// Pending accounts are allowed to log in, being pointed to verification,
+// unless BlockLogin is set.
+type EmailVerification struct {
+	TokenTTL   int  `yaml:"token_ttl"`
+	BlockLogin bool `yaml:"block_login"`
+	SMTP       SMTP `yaml:"smtp"`
+}
+
+// SMTP represents an outgoing mail relay configuration.
+type SMTP struct {
+	Addr     string `yaml:"addr"`
+	Username string `yaml:"username"`
+	Password string `yaml:"password"`
+	From     string `yaml:"from"`
 }
 
 // ModVersion represents XMPP Software Version module (XEP-0092) configuration.
@@ -316,7 +988,157 @@ type ModVersion struct {
 }
 
 // ModPing represents XMPP Ping module (XEP-0199) configuration.
+// SendTimeout is the time a sent ping waits for its pong, never
+// exceeding SendInterval (defaults to 32 seconds), while MaxMissed
+// is the number of consecutive unanswered pings tolerated before
+// disconnecting (defaults to one).
+//
+// Jitter randomizes every ping interval by up to that fraction
+// of SendInterval (e.g. 0.1 meaning ±10%).
+//
+// Pongs are only accepted from the pinged full JID, or from
+// any of its account resources if MatchBareJID is set.
+//
+// Clients declared inactive (XEP-0352) legitimately send nothing, so
+// they're pinged every InactiveSendInterval seconds instead, never
+// less than SendInterval (defaults to four times SendInterval).
+//
+// Mode selects between ping IQs (default) and whitespace keepalives,
+// the latter being lighter but telling peer liveness from write
+// errors only, so that SendTimeout and MaxMissed don't apply.
+//
+// S2S overrides sending settings for server-to-server streams.
 type ModPing struct {
+	Send                 bool       `yaml:"send"`
+	SendInterval         int        `yaml:"send_interval"`
+	SendTimeout          int        `yaml:"send_timeout"`
+	InactiveSendInterval int        `yaml:"inactive_send_interval"`
+	MaxMissed            int        `yaml:"max_missed"`
+	Jitter               float64    `yaml:"jitter"`
+	MatchBareJID         bool       `yaml:"match_bare_jid"`
+	Mode                 PingMode   `yaml:"mode"`
+	S2S                  ModPingS2S `yaml:"s2s"`
+}
+
+// ModPingS2S represents XMPP Ping module server-to-server
+// streams keepalive configuration.
+type ModPingS2S struct {
 	Send         bool `yaml:"send"`
 	SendInterval int  `yaml:"send_interval"`
+	SendTimeout  int  `yaml:"send_timeout"`
+}
+
+// ModVacation represents Vacation Messages module (XEP-0109) configuration.
+type ModVacation struct {
+	ReplyInterval int `yaml:"reply_interval"`
+}
+
+// ModTracking represents message delivery tracking module configuration.
+type ModTracking struct {
+	TrustedJIDs []string `yaml:"trusted_jids"`
+	WebhookURL  string   `yaml:"webhook_url"`
+}
+
+// ModFooter represents message footer module configuration.
+type ModFooter struct {
+	Footers []MessageFooter `yaml:"footers"`
+}
+
+// MessageFooter represents the footer appended to messages
+// sent from a virtual host crossing any of the configured boundaries.
+type MessageFooter struct {
+	// Domain is the virtual host whose users messages get the footer appended.
+	Domain string `yaml:"domain"`
+	Text   string `yaml:"text"`
+
+	// Remote applies the footer to messages leaving the server.
+	Remote bool `yaml:"remote"`
+
+	// Local applies the footer to messages delivered to local users.
+	Local bool `yaml:"local"`
+
+	// Domains applies the footer to messages addressed to any of these domains.
+	Domains []string `yaml:"domains"`
+}
+
+// ModSpam represents first contact spam filtering module configuration.
+// Messages sent to users that didn't subscribe the sender to its presence
+// get scored, being marked once the score reaches MarkThreshold, diverted
+// to recipient quarantine queue once reaching QuarantineThreshold, or bounced
+// once reaching BounceThreshold. Zero valued thresholds are disabled.
+type ModSpam struct {
+	MarkThreshold       float64       `yaml:"mark_threshold"`
+	QuarantineThreshold float64       `yaml:"quarantine_threshold"`
+	BounceThreshold     float64       `yaml:"bounce_threshold"`
+	QuarantineSize      int           `yaml:"quarantine_size"`
+	Heuristic           SpamHeuristic `yaml:"heuristic"`
+}
+
+// SpamHeuristic represents built-in spam scorer configuration.
+// Zero valued fields take their default values.
+type SpamHeuristic struct {
+	// URLWeight is the score added by every URL contained in a message body.
+	URLWeight float64 `yaml:"url_weight"`
+
+	// RateLimit is the number of messages a domain can send within RateWindow
+	// seconds before RateWeight gets added for every exceeding one.
+	RateWindow int     `yaml:"rate_window"`
+	RateLimit  int     `yaml:"rate_limit"`
+	RateWeight float64 `yaml:"rate_weight"`
+
+	// SimilarityWeight is the score added for every one of the last
+	// RecentMessages bodies whose estimated similarity reaches SimilarityThreshold.
+	RecentMessages      int     `yaml:"recent_messages"`
+	SimilarityThreshold float64 `yaml:"similarity_threshold"`
+	SimilarityWeight    float64 `yaml:"similarity_weight"`
+}
+
+// ModMAM represents XMPP Message Archive Management module (XEP-0313) configuration.
+// MaxPageSize bounds the messages returned by every query (defaults to 50),
+// while Default sets which messages get archived for users that didn't set
+// their own preferences: 'always' (default), 'roster' or 'never'.
+type ModMAM struct {
+	MaxPageSize int    `yaml:"max_page_size"`
+	Default     string `yaml:"default"`
+}
+
+// ModStreamMgmt represents XMPP Stream Management (XEP-0198) configuration.
+// Sessions whose connection gets lost can be resumed within ResumeTimeout
+// seconds (resumption is not offered if zero), while streams holding more than
+// MaxQueueSize unacknowledged stanzas are terminated (defaults to 1000).
+//
+// MaxResumable limits the resumable sessions an account can hold, evicting
+// the least recently used one beyond it (defaults to 10). MaxResumeFailures
+// limits failed resumption attempts per remote address and minute (defaults to 10).
+//
+// Resumable sessions are persisted on graceful shutdown, so that they can
+// be resumed after a restart, as long as they hold no more than
+// MaxPersistedQueueSize unacknowledged stanzas (defaults to 100). Larger
+// queues are delivered to offline storage instead.
+type ModStreamMgmt struct {
+	ResumeTimeout         int `yaml:"resume_timeout"`
+	MaxQueueSize          int `yaml:"max_queue_size"`
+	MaxResumable          int `yaml:"max_resumable"`
+	MaxResumeFailures     int `yaml:"max_resume_failures"`
+	MaxPersistedQueueSize int `yaml:"max_persisted_queue_size"`
+}
+
+// ModCSI represents XMPP Client State Indication (XEP-0352) configuration.
+// Presence updates and chat state notifications addressed to inactive
+// clients are handled as of Policy, queued ones being flushed whenever
+// more than MaxQueueSize are held (defaults to 100).
+type ModCSI struct {
+	Policy       CSIPolicy `yaml:"policy"`
+	MaxQueueSize int       `yaml:"max_queue_size"`
+}
+
+// isBareJID reports whether s looks like a 'node@domain' JID,
+// leaving stringprep validation to the xml package.
+func isBareJID(s string) bool {
+	i := strings.IndexByte(s, '@')
+	if i <= 0 || i == len(s)-1 {
+		return false
+	}
+	node, domain := s[:i], s[i+1:]
+	return !strings.ContainsAny(node, "\"&'/:<>@ \t") && !strings.ContainsAny(domain, "@/ \t")
 }
@@ -24,6 +24,38 @@ func TestTypeStrings(t *testing.T) {
 	require.Equal(t, "best", BestCompression.String())
 	require.Equal(t, "speed", SpeedCompression.String())
 	require.Equal(t, "", CompressionLevel(99).String())
+
+	require.Equal(t, "bcrypt", BCrypt.String())
+	require.Equal(t, "argon2id", Argon2id.String())
+	require.Equal(t, "", PasswordHashAlgorithm(99).String())
+}
+
+func TestPasswordHashingConfig(t *testing.T) {
+	h := PasswordHashing{}
+	err := yaml.Unmarshal([]byte("{}"), &h)
+	require.Nil(t, err)
+	require.Equal(t, BCrypt, h.Algorithm)
+	require.Equal(t, defaultBCryptCost, h.Cost)
+
+	h = PasswordHashing{}
+	err = yaml.Unmarshal([]byte("{algorithm: bcrypt, cost: 12}"), &h)
+	require.Nil(t, err)
+	require.Equal(t, 12, h.Cost)
+
+	h = PasswordHashing{}
+	err = yaml.Unmarshal([]byte("{algorithm: argon2id}"), &h)
+	require.Nil(t, err)
+	require.Equal(t, Argon2id, h.Algorithm)
+	require.Equal(t, defaultArgon2idCost, h.Cost)
+
+	err = yaml.Unmarshal([]byte("{algorithm: bcrypt, cost: 3}"), &h)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{algorithm: bcrypt, cost: 32}"), &h)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{algorithm: argon2id, cost: -1}"), &h)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{algorithm: md5}"), &h)
+	require.NotNil(t, err)
 }
 
 func TestCompressionConfig(t *testing.T) {
@@ -45,6 +77,49 @@ func TestCompressionConfig(t *testing.T) {
 
 	err = yaml.Unmarshal([]byte("level"), &cmp)
 	require.NotNil(t, err)
+
+	// flush buffering
+	cmp = Compression{}
+	err = yaml.Unmarshal([]byte("{level: default, min_flush_size: 512, disable_over_tls: true}"), &cmp)
+	require.Nil(t, err)
+	require.Equal(t, 512, cmp.MinFlushSize)
+	require.Equal(t, defaultCompressionFlushWindow, cmp.FlushWindow)
+	require.True(t, cmp.DisableOverTLS)
+
+	err = yaml.Unmarshal([]byte("{level: default, min_flush_size: 512, flush_window: 20}"), &cmp)
+	require.Nil(t, err)
+	require.Equal(t, 20, cmp.FlushWindow)
+
+	err = yaml.Unmarshal([]byte("{level: default, min_flush_size: -1}"), &cmp)
+	require.NotNil(t, err)
+}
+
+func TestLargePayloadConfig(t *testing.T) {
+	lp := LargePayload{}
+	err := yaml.Unmarshal([]byte("{}"), &lp)
+	require.Nil(t, err)
+	require.Equal(t, KeepLargePayload, lp.Policy)
+	require.Equal(t, defaultLargePayloadThreshold, lp.Threshold)
+	require.Equal(t, defaultLargePayloadNamespaces, lp.Namespaces)
+
+	lp = LargePayload{}
+	err = yaml.Unmarshal([]byte("{policy: spool, threshold: 1024, namespaces: [vcard-temp], spool_dir: /tmp, max_stanza_size: 8388608}"), &lp)
+	require.Nil(t, err)
+	require.Equal(t, SpoolLargePayload, lp.Policy)
+	require.Equal(t, 1024, lp.Threshold)
+	require.Equal(t, []string{"vcard-temp"}, lp.Namespaces)
+	require.Equal(t, "/tmp", lp.SpoolDir)
+	require.Equal(t, 8388608, lp.MaxStanzaSize)
+
+	err = yaml.Unmarshal([]byte("{policy: truncate}"), &lp)
+	require.Nil(t, err)
+	require.Equal(t, TruncateLargePayload, lp.Policy)
+
+	err = yaml.Unmarshal([]byte("{policy: drop}"), &lp)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{max_stanza_size: -1}"), &lp)
+	require.NotNil(t, err)
 }
 
 func TestTransportConfig(t *testing.T) {
@@ -114,6 +189,21 @@ sasl: [plain, digest_md5, scram_sha_1, scram_sha_256]
 	err = yaml.Unmarshal([]byte(authCfg), &s)
 	require.Nil(t, err)
 	require.Equal(t, 4, len(s.SASL))
+	require.True(t, s.IsScramEnabled())
+	require.Equal(t, 100000, s.ScramIterations)
+	require.Equal(t, PasswordHashing{Algorithm: BCrypt, Cost: defaultBCryptCost}, s.PasswordHashing)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, sasl: [plain], scram_iteration_count: 10000}"), &s)
+	require.Nil(t, err)
+	require.False(t, s.IsScramEnabled())
+	require.Equal(t, 10000, s.ScramIterations)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, scram_iteration_count: 1024}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, password_hashing: {algorithm: argon2id, cost: 4}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, PasswordHashing{Algorithm: Argon2id, Cost: 4}, s.PasswordHashing)
 
 	// invalid auth mechanism...
 	err = yaml.Unmarshal([]byte("{id: default, type: c2s, sasl: [invalid]}"), &s)
@@ -132,6 +222,174 @@ modules: [roster, private, vcard, registration, version, ping, offline]
 	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [invalid]}"), &s)
 	require.NotNil(t, err)
 
+	// offline retrieval requires offline storage...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [offline_retrieval]}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [offline, offline_retrieval]}"), &s)
+	require.Nil(t, err)
+
+	// message archive management...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [mam], mod_mam: {max_page_size: 20, default: roster}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, ModMAM{MaxPageSize: 20, Default: "roster"}, s.ModMAM)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_mam: {max_page_size: -1}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_mam: {default: sometimes}}"), &s)
+	require.NotNil(t, err)
+
+	// stream management...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [stream_mgmt], mod_stream_mgmt: {resume_timeout: 300, max_queue_size: 500}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, ModStreamMgmt{ResumeTimeout: 300, MaxQueueSize: 500}, s.ModStreamMgmt)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_stream_mgmt: {resume_timeout: -1}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_stream_mgmt: {max_resumable: 2, max_resume_failures: 5}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, ModStreamMgmt{MaxResumable: 2, MaxResumeFailures: 5}, s.ModStreamMgmt)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_stream_mgmt: {max_resumable: -1}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_stream_mgmt: {max_queue_size: -1}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_stream_mgmt: {max_persisted_queue_size: 50}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, ModStreamMgmt{MaxPersistedQueueSize: 50}, s.ModStreamMgmt)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_stream_mgmt: {max_persisted_queue_size: -1}}"), &s)
+	require.NotNil(t, err)
+
+	// client state indication...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [csi]}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, ModCSI{Policy: QueueWhileInactive}, s.ModCSI)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, modules: [csi], mod_csi: {policy: drop, max_queue_size: 50}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, ModCSI{Policy: DropWhileInactive, MaxQueueSize: 50}, s.ModCSI)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_csi: {policy: delay}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_csi: {max_queue_size: -1}}"), &s)
+	require.NotNil(t, err)
+
+	// registration requires secured streams by default...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_registration: {allow_registration: true}}"), &s)
+	require.Nil(t, err)
+	require.True(t, s.ModRegistration.AllowRegistration)
+	require.True(t, s.ModRegistration.RequireSecured)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s}"), &s)
+	require.Nil(t, err)
+	require.True(t, s.ModRegistration.RequireSecured)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_registration: {require_secured: false}}"), &s)
+	require.Nil(t, err)
+	require.False(t, s.ModRegistration.RequireSecured)
+
+	// registration notification recipients...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_registration: {notify_jids: [admin@jackal.im]}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, []string{"admin@jackal.im"}, s.ModRegistration.NotifyJIDs)
+
+	for _, jid := range []string{"admin", "@jackal.im", "admin@", "admin@jackal.im/balcony", "ad min@jackal.im", "a@b@jackal.im"} {
+		err = yaml.Unmarshal([]byte(`{id: default, type: c2s, mod_registration: {notify_jids: ["`+jid+`"]}}`), &s)
+		require.NotNil(t, err, jid)
+	}
+
+	// offline queue policy...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_offline: {queue_size: 100}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, BounceOnFullQueue, s.ModOffline.QueuePolicy)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_offline: {queue_size: 100, queue_policy: drop_oldest}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, DropOldestOnFullQueue, s.ModOffline.QueuePolicy)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_offline: {queue_policy: drop_oldest}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_offline: {queue_size: 100, queue_policy: discard}}"), &s)
+	require.NotNil(t, err)
+
+	// ping timeout...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 300, send_timeout: 30}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, 30, s.ModPing.SendTimeout)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, send_timeout: 300}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, max_missed: -1}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, inactive_send_interval: 600}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, 600, s.ModPing.InactiveSendInterval)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, inactive_send_interval: 10}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, jitter: 0.1}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, 0.1, s.ModPing.Jitter)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, jitter: 1.5}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, IQPing, s.ModPing.Mode)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, mode: whitespace}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, WhitespacePing, s.ModPing.Mode)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send: true, send_interval: 30, mode: icmp}}"), &s)
+	require.NotNil(t, err)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send_interval: 30, s2s: {send: true, send_interval: 120, send_timeout: 60}}}"), &s)
+	require.Nil(t, err)
+	require.True(t, s.ModPing.S2S.Send)
+	require.Equal(t, 120, s.ModPing.S2S.SendInterval)
+	require.Equal(t, 60, s.ModPing.S2S.SendTimeout)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, mod_ping: {send_interval: 30, s2s: {send: true, send_interval: 10, send_timeout: 60}}}"), &s)
+	require.NotNil(t, err)
+
+	// stanza dump...
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, stanza_dump: {size: 50, file: dump.log}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, 50, s.StanzaDump.Size)
+	require.Equal(t, "dump.log", s.StanzaDump.File)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, stanza_dump: {size: -1}}"), &s)
+	require.NotNil(t, err)
+
+	// rewrite rules...
+	rewriteCfg := `
+id: default
+type: c2s
+rewrite:
+  - {name: a, namespace: "urn:a", action: drop}
+  - {name: b, namespace: "urn:b", action: bounce}
+`
+	err = yaml.Unmarshal([]byte(rewriteCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, 2, len(s.Rewrite))
+	require.Equal(t, "a", s.Rewrite[0].Name)
+	require.Equal(t, "b", s.Rewrite[1].Name)
+
+	err = yaml.Unmarshal([]byte("{id: default, type: c2s, rewrite: [{name: a, namespace: a, action: drop}, {name: a, namespace: b, action: drop}]}"), &s)
+	require.NotNil(t, err)
+
 	// invalid type
 	err = yaml.Unmarshal([]byte("{id: default, type: invalid}"), &s)
 	require.NotNil(t, err)
@@ -140,3 +398,84 @@ modules: [roster, private, vcard, registration, version, ping, offline]
 	err = yaml.Unmarshal([]byte("type"), &s)
 	require.NotNil(t, err)
 }
+
+func TestRewriteRuleConfig(t *testing.T) {
+	r := RewriteRule{}
+	err := yaml.Unmarshal([]byte("{name: strip, direction: out, domain: legacy.org, stanza: message, namespace: 'urn:x', action: drop}"), &r)
+	require.Nil(t, err)
+	require.Equal(t, "strip", r.Name)
+	require.Equal(t, RewriteOutbound, r.Direction)
+	require.Equal(t, "legacy.org", r.Domain)
+	require.Equal(t, "message", r.Stanza)
+	require.Equal(t, "urn:x", r.Namespace)
+	require.Equal(t, RewriteDrop, r.Action)
+
+	r = RewriteRule{}
+	err = yaml.Unmarshal([]byte("{name: markers, direction: in, namespace: 'urn:x', action: rename, rename_to: 'urn:y'}"), &r)
+	require.Nil(t, err)
+	require.Equal(t, RewriteInbound, r.Direction)
+	require.Equal(t, RewriteRename, r.Action)
+	require.Equal(t, "urn:y", r.RenameTo)
+
+	r = RewriteRule{}
+	err = yaml.Unmarshal([]byte("{name: reject, namespace: 'urn:x', action: bounce}"), &r)
+	require.Nil(t, err)
+	require.Equal(t, RewriteBoth, r.Direction)
+	require.Equal(t, RewriteBounce, r.Action)
+
+	// missing name
+	err = yaml.Unmarshal([]byte("{namespace: 'urn:x', action: drop}"), &r)
+	require.NotNil(t, err)
+
+	// missing namespace
+	err = yaml.Unmarshal([]byte("{name: a, action: drop}"), &r)
+	require.NotNil(t, err)
+
+	// missing rename target
+	err = yaml.Unmarshal([]byte("{name: a, namespace: 'urn:x', action: rename}"), &r)
+	require.NotNil(t, err)
+
+	// invalid direction
+	err = yaml.Unmarshal([]byte("{name: a, direction: sideways, namespace: 'urn:x', action: drop}"), &r)
+	require.NotNil(t, err)
+
+	// invalid stanza
+	err = yaml.Unmarshal([]byte("{name: a, stanza: body, namespace: 'urn:x', action: drop}"), &r)
+	require.NotNil(t, err)
+
+	// invalid action
+	err = yaml.Unmarshal([]byte("{name: a, namespace: 'urn:x', action: invalid}"), &r)
+	require.NotNil(t, err)
+
+	// invalid yaml
+	err = yaml.Unmarshal([]byte("name"), &r)
+	require.NotNil(t, err)
+}
+
+func TestRegistrationFieldConfig(t *testing.T) {
+	f := RegistrationField{}
+	err := yaml.Unmarshal([]byte("{var: email, label: Email, required: true}"), &f)
+	require.Nil(t, err)
+	require.Equal(t, "email", f.Var)
+	require.Equal(t, "Email", f.Label)
+	require.Equal(t, "text-single", f.Type)
+	require.True(t, f.Required)
+
+	f = RegistrationField{}
+	err = yaml.Unmarshal([]byte("{var: invite, type: text-private}"), &f)
+	require.Nil(t, err)
+	require.Equal(t, "text-private", f.Type)
+	require.False(t, f.Required)
+
+	// missing var
+	err = yaml.Unmarshal([]byte("{label: Email}"), &f)
+	require.NotNil(t, err)
+
+	// reserved var
+	err = yaml.Unmarshal([]byte("{var: password}"), &f)
+	require.NotNil(t, err)
+
+	// invalid type
+	err = yaml.Unmarshal([]byte("{var: email, type: list-multi}"), &f)
+	require.NotNil(t, err)
+}
@@ -8,10 +8,35 @@ package config
 import (
 	"errors"
 	"fmt"
+	"regexp"
 )
 
 const defaultMySQLPoolSize = 16
 
+const defaultRosterTombstoneRetention = 30 * 24 * 3600 // 30 days
+
+const defaultStorageQueryTimeout = 10 // seconds
+
+const (
+	defaultNegativeCacheSize = 10000
+	defaultNegativeCacheTTL  = 30 // seconds
+)
+
+const (
+	defaultRedisAddress   = "127.0.0.1:6379"
+	defaultRedisUserTTL   = 300  // seconds
+	defaultRedisRosterTTL = 300  // seconds
+	defaultRedisVCardTTL  = 3600 // seconds
+)
+
+var tenantRegexp = regexp.MustCompile("^[a-z0-9_]{1,32}$")
+
+// IsValidTenant returns whether or not tenant is a valid storage tenant identifier,
+// made of up to 32 lowercase letters, digits or underscores.
+func IsValidTenant(tenant string) bool {
+	return tenantRegexp.MatchString(tenant)
+}
+
 // StorageType represents a storage manager type.
 type StorageType int
 
@@ -24,6 +49,23 @@ const (
 
 	// Mock represents a in-memory storage type.
 	Mock
+
+	// SQLite represents a SQLite storage type.
+	SQLite
+
+	// Redis represents a Redis storage type.
+	Redis
+)
+
+// RedisMode represents the role played by Redis.
+type RedisMode int
+
+const (
+	// RedisStorage holds every stored entity in Redis.
+	RedisStorage RedisMode = iota
+
+	// RedisCache caches entities read from another storage type in Redis.
+	RedisCache
 )
 
 // Storage represents an storage manager configuration.
@@ -31,6 +73,67 @@ type Storage struct {
 	Type     StorageType
 	MySQL    *MySQLDb
 	BadgerDB *BadgerDb
+	SQLite   *SQLiteDb
+	Usage    StorageUsage
+
+	// Redis configures either Redis storage or, with any other storage
+	// type, a Redis read-through cache in front of it (nil if disabled).
+	Redis *RedisDb
+
+	// Tenant optionally isolates every stored entity from those of other
+	// servers sharing the same MySQL, BadgerDB, SQLite or Redis storage.
+	Tenant string
+
+	// Encryption optionally encrypts stored payloads (nil if disabled).
+	Encryption *StorageEncryption
+
+	// NegativeCache optionally remembers nonexistent usernames (nil if disabled).
+	NegativeCache *StorageNegativeCache
+
+	// RosterTombstoneRetention is the number of seconds deleted roster items
+	// are remembered, so that roster changes can include removals.
+	RosterTombstoneRetention int
+
+	// OfflineMessageTTL is the number of seconds offline messages are kept
+	// before being discarded undelivered. Zero value keeps them indefinitely.
+	OfflineMessageTTL int
+
+	// QueryTimeout is the default number of seconds a storage
+	// operation may take before being abandoned.
+	QueryTimeout int
+}
+
+// StorageUsage represents storage usage sampling configuration.
+type StorageUsage struct {
+	// Interval is the number of seconds between samples, zero disables sampling.
+	Interval int `yaml:"interval"`
+
+	// GrowthThreshold is the growth percentage between two consecutive
+	// samples above which a warning is logged, zero disables alerting.
+	GrowthThreshold float64 `yaml:"growth_threshold"`
+}
+
+// StorageEncryption represents stored payloads encryption configuration.
+//
+// Payloads are encrypted using data keys kept in KeyRingFile, wrapped by a
+// base64 encoded 256 bits master key read from one of MasterKey, MasterKeyFile
+// or the output of MasterKeyCommand.
+type StorageEncryption struct {
+	KeyRingFile      string `yaml:"keyring_path"`
+	MasterKey        string `yaml:"master_key"`
+	MasterKeyFile    string `yaml:"master_key_path"`
+	MasterKeyCommand string `yaml:"master_key_command"`
+}
+
+// StorageNegativeCache represents nonexistent users cache configuration.
+//
+// Up to Size usernames reported as nonexistent by account existence checks
+// are remembered for TTL seconds, sparing storage lookups to dictionary
+// attacks. Usernames get evicted as soon as they're registered through
+// this server, while TTL bounds staleness regarding other servers.
+type StorageNegativeCache struct {
+	Size int `yaml:"size"`
+	TTL  int `yaml:"ttl"`
 }
 
 // MySQLDb represents MySQL storage configuration.
@@ -47,10 +150,54 @@ type BadgerDb struct {
 	DataDir string `yaml:"data_dir"`
 }
 
+// SQLiteDb represents SQLite storage configuration.
+type SQLiteDb struct {
+	Path string `yaml:"path"`
+}
+
+// RedisDb represents Redis storage configuration.
+//
+// In RedisCache mode users, rosters and vCards are cached for
+// their TTL seconds, and evicted as soon as they're updated or
+// deleted through this server.
+type RedisDb struct {
+	Mode     RedisMode
+	Address  string
+	Password string
+	Database int
+	TTL      RedisTTL
+}
+
+// RedisTTL represents per entity Redis cache TTLs, in seconds.
+type RedisTTL struct {
+	User   int `yaml:"user"`
+	Roster int `yaml:"roster"`
+	VCard  int `yaml:"vcard"`
+}
+
+type redisProxyType struct {
+	Mode     string   `yaml:"mode"`
+	Address  string   `yaml:"addr"`
+	Password string   `yaml:"password"`
+	Database int      `yaml:"db"`
+	TTL      RedisTTL `yaml:"ttl"`
+}
+
 type storageProxyType struct {
-	Type     string    `yaml:"type"`
-	MySQL    *MySQLDb  `yaml:"mysql"`
-	BadgerDB *BadgerDb `yaml:"badgerdb"`
+	Type     string          `yaml:"type"`
+	MySQL    *MySQLDb        `yaml:"mysql"`
+	BadgerDB *BadgerDb       `yaml:"badgerdb"`
+	SQLite   *SQLiteDb       `yaml:"sqlite"`
+	Redis    *redisProxyType `yaml:"redis"`
+	Usage    StorageUsage    `yaml:"usage"`
+	Tenant   string          `yaml:"tenant"`
+
+	Encryption    *StorageEncryption    `yaml:"encryption"`
+	NegativeCache *StorageNegativeCache `yaml:"negative_cache"`
+
+	RosterTombstoneRetention int `yaml:"roster_tombstone_retention"`
+	OfflineMessageTTL        int `yaml:"offline_message_ttl"`
+	QueryTimeout             int `yaml:"query_timeout"`
 }
 
 // UnmarshalYAML satisfies Unmarshaler interface.
@@ -59,6 +206,67 @@ func (s *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	if err := unmarshal(&p); err != nil {
 		return err
 	}
+	if p.Usage.Interval < 0 || p.Usage.GrowthThreshold < 0 {
+		return errors.New("config.Storage: usage interval and growth threshold must be positive")
+	}
+	s.Usage = p.Usage
+
+	if len(p.Tenant) > 0 && !IsValidTenant(p.Tenant) {
+		return fmt.Errorf("config.Storage: invalid tenant: %s", p.Tenant)
+	}
+	s.Tenant = p.Tenant
+
+	if e := p.Encryption; e != nil {
+		if len(e.KeyRingFile) == 0 {
+			return errors.New("config.Storage: encryption keyring_path must be specified")
+		}
+		var sources int
+		for _, src := range []string{e.MasterKey, e.MasterKeyFile, e.MasterKeyCommand} {
+			if len(src) > 0 {
+				sources++
+			}
+		}
+		if sources != 1 {
+			return errors.New("config.Storage: exactly one of encryption master_key, master_key_path or master_key_command must be specified")
+		}
+	}
+	s.Encryption = p.Encryption
+
+	if nc := p.NegativeCache; nc != nil {
+		if nc.Size < 0 || nc.TTL < 0 {
+			return errors.New("config.Storage: negative cache size and ttl must be positive")
+		}
+		if nc.Size == 0 {
+			nc.Size = defaultNegativeCacheSize
+		}
+		if nc.TTL == 0 {
+			nc.TTL = defaultNegativeCacheTTL
+		}
+	}
+	s.NegativeCache = p.NegativeCache
+
+	if p.QueryTimeout < 0 {
+		return errors.New("config.Storage: query timeout must be positive")
+	}
+	s.QueryTimeout = p.QueryTimeout
+	if s.QueryTimeout == 0 {
+		s.QueryTimeout = defaultStorageQueryTimeout
+	}
+
+	if err := s.unmarshalRedis(p.Type, p.Redis); err != nil {
+		return err
+	}
+
+	s.RosterTombstoneRetention = p.RosterTombstoneRetention
+	if s.RosterTombstoneRetention <= 0 {
+		s.RosterTombstoneRetention = defaultRosterTombstoneRetention
+	}
+
+	if p.OfflineMessageTTL < 0 {
+		return errors.New("config.Storage: offline message TTL must be positive")
+	}
+	s.OfflineMessageTTL = p.OfflineMessageTTL
+
 	switch p.Type {
 	case "mysql":
 		if p.MySQL == nil {
@@ -83,7 +291,27 @@ func (s *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 			s.BadgerDB.DataDir = "./data"
 		}
 
+	case "sqlite":
+		s.Type = SQLite
+
+		s.SQLite = p.SQLite
+		if s.SQLite == nil {
+			s.SQLite = &SQLiteDb{}
+		}
+		if len(s.SQLite.Path) == 0 {
+			s.SQLite.Path = "./jackal.db"
+		}
+
+	case "redis":
+		if s.Redis == nil {
+			return errors.New("config.Storage: couldn't read Redis configuration")
+		}
+		s.Type = Redis
+
 	case "mock":
+		if len(s.Tenant) > 0 {
+			return errors.New("config.Storage: tenants not supported by mock storage")
+		}
 		s.Type = Mock
 
 	case "":
@@ -94,3 +322,45 @@ func (s *Storage) UnmarshalYAML(unmarshal func(interface{}) error) error {
 	}
 	return nil
 }
+
+func (s *Storage) unmarshalRedis(storageType string, p *redisProxyType) error {
+	s.Redis = nil
+	if p == nil {
+		return nil
+	}
+	r := &RedisDb{Address: p.Address, Password: p.Password, Database: p.Database, TTL: p.TTL}
+	switch p.Mode {
+	case "":
+		if storageType != "redis" {
+			r.Mode = RedisCache
+		}
+	case "storage":
+		if storageType != "redis" {
+			return errors.New("config.Storage: redis storage mode requires redis storage type")
+		}
+	case "cache":
+		if storageType == "redis" {
+			return errors.New("config.Storage: redis cache mode requires a non redis storage type")
+		}
+		r.Mode = RedisCache
+	default:
+		return fmt.Errorf("config.Storage: unrecognized redis mode: %s", p.Mode)
+	}
+	if r.TTL.User < 0 || r.TTL.Roster < 0 || r.TTL.VCard < 0 {
+		return errors.New("config.Storage: redis ttl values must be positive")
+	}
+	if len(r.Address) == 0 {
+		r.Address = defaultRedisAddress
+	}
+	if r.TTL.User == 0 {
+		r.TTL.User = defaultRedisUserTTL
+	}
+	if r.TTL.Roster == 0 {
+		r.TTL.Roster = defaultRedisRosterTTL
+	}
+	if r.TTL.VCard == 0 {
+		r.TTL.VCard = defaultRedisVCardTTL
+	}
+	s.Redis = r
+	return nil
+}
@@ -21,6 +21,7 @@ func TestStorageConfig(t *testing.T) {
 	err := yaml.Unmarshal([]byte(mockCfg), &s)
 	require.Nil(t, err)
 	require.Equal(t, Mock, s.Type)
+	require.Equal(t, defaultRosterTombstoneRetention, s.RosterTombstoneRetention)
 
 	mySQLCfg := `
   type: mysql
@@ -60,6 +61,156 @@ func TestStorageConfig(t *testing.T) {
 	err = yaml.Unmarshal([]byte(invalidMySQLCfg), &s)
 	require.NotNil(t, err)
 
+	usageCfg := `
+  type: mock
+  roster_tombstone_retention: 3600
+  offline_message_ttl: 86400
+  usage:
+    interval: 300
+    growth_threshold: 20
+`
+	err = yaml.Unmarshal([]byte(usageCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, StorageUsage{Interval: 300, GrowthThreshold: 20}, s.Usage)
+	require.Equal(t, 3600, s.RosterTombstoneRetention)
+	require.Equal(t, 86400, s.OfflineMessageTTL)
+
+	invalidTTLCfg := `
+  type: mock
+  offline_message_ttl: -1
+`
+	err = yaml.Unmarshal([]byte(invalidTTLCfg), &s)
+	require.NotNil(t, err)
+
+	invalidUsageCfg := `
+  type: mock
+  usage:
+    interval: -1
+`
+	err = yaml.Unmarshal([]byte(invalidUsageCfg), &s)
+	require.NotNil(t, err)
+
+	tenantCfg := `
+  type: badgerdb
+  tenant: event_42
+  badgerdb:
+    data_dir: ./data
+`
+	err = yaml.Unmarshal([]byte(tenantCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, "event_42", s.Tenant)
+
+	for _, tenant := range []string{"Event", "event-42", "a/b", "abcdefghijklmnopqrstuvwxyz0123456789"} {
+		err = yaml.Unmarshal([]byte("{type: badgerdb, badgerdb: {}, tenant: "+tenant+"}"), &s)
+		require.NotNil(t, err)
+	}
+	err = yaml.Unmarshal([]byte("{type: mock, tenant: event_42}"), &s)
+	require.NotNil(t, err)
+
+	sqliteCfg := `
+  type: sqlite
+  sqlite:
+    path: /var/lib/jackal/jackal.db
+`
+	err = yaml.Unmarshal([]byte(sqliteCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, SQLite, s.Type)
+	require.Equal(t, "/var/lib/jackal/jackal.db", s.SQLite.Path)
+
+	err = yaml.Unmarshal([]byte("{type: sqlite}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, "./jackal.db", s.SQLite.Path)
+
+	err = yaml.Unmarshal([]byte("{type: mock, query_timeout: 3}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, 3, s.QueryTimeout)
+	err = yaml.Unmarshal([]byte("{type: mock}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, 10, s.QueryTimeout)
+	err = yaml.Unmarshal([]byte("{type: mock, query_timeout: -1}"), &s)
+	require.NotNil(t, err)
+
+	redisCfg := `
+  type: redis
+  redis:
+    addr: 10.0.0.1:6379
+    db: 2
+`
+	err = yaml.Unmarshal([]byte(redisCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, Redis, s.Type)
+	require.Equal(t, RedisStorage, s.Redis.Mode)
+	require.Equal(t, "10.0.0.1:6379", s.Redis.Address)
+	require.Equal(t, 2, s.Redis.Database)
+
+	redisCacheCfg := `
+  type: sqlite
+  redis:
+    mode: cache
+    ttl:
+      roster: 60
+`
+	err = yaml.Unmarshal([]byte(redisCacheCfg), &s)
+	require.Nil(t, err)
+	require.Equal(t, SQLite, s.Type)
+	require.Equal(t, RedisCache, s.Redis.Mode)
+	require.Equal(t, "127.0.0.1:6379", s.Redis.Address)
+	require.Equal(t, RedisTTL{User: 300, Roster: 60, VCard: 3600}, s.Redis.TTL)
+
+	err = yaml.Unmarshal([]byte("{type: sqlite}"), &s)
+	require.Nil(t, err)
+	require.Nil(t, s.Redis)
+
+	err = yaml.Unmarshal([]byte("{type: redis}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{type: redis, redis: {mode: cache}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{type: sqlite, redis: {mode: storage}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{type: sqlite, redis: {mode: disk}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{type: sqlite, redis: {ttl: {vcard: -1}}}"), &s)
+	require.NotNil(t, err)
+
+	encryptionCfg := `
+  type: badgerdb
+  badgerdb:
+    data_dir: ./data
+  encryption:
+    keyring_path: /var/lib/jackal/keyring.json
+    master_key_command: vault read -field=key secret/jackal
+`
+	err = yaml.Unmarshal([]byte(encryptionCfg), &s)
+	require.Nil(t, err)
+	require.NotNil(t, s.Encryption)
+	require.Equal(t, "/var/lib/jackal/keyring.json", s.Encryption.KeyRingFile)
+	require.Equal(t, "vault read -field=key secret/jackal", s.Encryption.MasterKeyCommand)
+
+	err = yaml.Unmarshal([]byte("{type: mock}"), &s)
+	require.Nil(t, err)
+	require.Nil(t, s.Encryption)
+
+	// missing keyring
+	err = yaml.Unmarshal([]byte("{type: mock, encryption: {master_key: a2V5}}"), &s)
+	require.NotNil(t, err)
+
+	// missing or ambiguous master key
+	err = yaml.Unmarshal([]byte("{type: mock, encryption: {keyring_path: k.json}}"), &s)
+	require.NotNil(t, err)
+	err = yaml.Unmarshal([]byte("{type: mock, encryption: {keyring_path: k.json, master_key: a2V5, master_key_path: key}}"), &s)
+	require.NotNil(t, err)
+
+	// negative cache
+	require.Nil(t, s.NegativeCache)
+	err = yaml.Unmarshal([]byte("{type: mock, negative_cache: {}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, &StorageNegativeCache{Size: defaultNegativeCacheSize, TTL: defaultNegativeCacheTTL}, s.NegativeCache)
+	err = yaml.Unmarshal([]byte("{type: mock, negative_cache: {size: 100, ttl: 5}}"), &s)
+	require.Nil(t, err)
+	require.Equal(t, &StorageNegativeCache{Size: 100, TTL: 5}, s.NegativeCache)
+	err = yaml.Unmarshal([]byte("{type: mock, negative_cache: {ttl: -1}}"), &s)
+	require.NotNil(t, err)
+
 	invalidCfg := `
   type: invalid
 `
@@ -0,0 +1,63 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package credentials
+
+import (
+	"crypto/subtle"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ortuman/jackal/util"
+	"golang.org/x/crypto/argon2"
+)
+
+const argon2idPrefix = "$argon2id$"
+
+// argon2id parameters as recommended by RFC 9106 for memory constrained
+// environments, time being the configured cost.
+const (
+	argon2idMemory  = 64 * 1024
+	argon2idThreads = 4
+	argon2idSaltLen = 16
+	argon2idKeyLen  = 32
+)
+
+var b64 = base64.RawStdEncoding
+
+// argon2idHash hashes password formatting it as '$argon2id$v=19$m=65536,t=3,p=4$salt$key'.
+func argon2idHash(password string, time int) (string, error) {
+	salt := util.RandomBytes(argon2idSaltLen)
+	key := argon2.IDKey([]byte(password), salt, uint32(time), argon2idMemory, argon2idThreads, argon2idKeyLen)
+	return fmt.Sprintf("%sv=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2idPrefix, argon2.Version, argon2idMemory, time, argon2idThreads, b64.EncodeToString(salt), b64.EncodeToString(key)), nil
+}
+
+func argon2idVerify(hash, password string) bool {
+	sp := strings.Split(hash, "$")
+	if len(sp) != 6 {
+		return false
+	}
+	var version int
+	if _, err := fmt.Sscanf(sp[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return false
+	}
+	var memory, time uint32
+	var threads uint8
+	if _, err := fmt.Sscanf(sp[3], "m=%d,t=%d,p=%d", &memory, &time, &threads); err != nil {
+		return false
+	}
+	salt, err := b64.DecodeString(sp[4])
+	if err != nil {
+		return false
+	}
+	key, err := b64.DecodeString(sp[5])
+	if err != nil || len(key) == 0 {
+		return false
+	}
+	derived := argon2.IDKey([]byte(password), salt, time, memory, threads, uint32(len(key)))
+	return subtle.ConstantTimeCompare(derived, key) == 1
+}
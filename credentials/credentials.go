@@ -0,0 +1,102 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package credentials derives and verifies the credentials stored
+// in place of account passwords: a password hash (bcrypt or argon2id)
+// and, whenever SCRAM is enabled, a SCRAM verifier, so that no plain-text
+// password is ever persisted.
+package credentials
+
+import (
+	"crypto/subtle"
+	"strings"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage/model"
+	"golang.org/x/crypto/bcrypt"
+)
+
+// Hasher derives account credentials from plain-text passwords.
+type Hasher struct {
+	cfg             config.PasswordHashing
+	scramIterations int
+}
+
+// NewHasher returns a credentials hasher hashing passwords as specified
+// in cfg and deriving SCRAM verifiers using scramIterations iterations,
+// or none at all if zero. A verifier can be brute forced way faster than
+// a password hash, so it should only be derived whenever SCRAM
+// mechanisms are enabled.
+func NewHasher(cfg *config.PasswordHashing, scramIterations int) *Hasher {
+	return &Hasher{cfg: *cfg, scramIterations: scramIterations}
+}
+
+// ScramIterations returns the iteration count used to derive SCRAM verifiers,
+// or zero if they're not derived.
+func (h *Hasher) ScramIterations() int {
+	return h.scramIterations
+}
+
+// Hash returns password hash in its modular crypt format representation.
+func (h *Hasher) Hash(password string) (string, error) {
+	switch h.cfg.Algorithm {
+	case config.Argon2id:
+		return argon2idHash(password, h.cfg.Cost)
+	default:
+		b, err := bcrypt.GenerateFromPassword([]byte(password), h.cfg.Cost)
+		if err != nil {
+			return "", err
+		}
+		return string(b), nil
+	}
+}
+
+// SetPassword replaces user credentials with the ones derived from password,
+// clearing any plain-text password previously stored.
+func (h *Hasher) SetPassword(user *model.User, password string) error {
+	hash, err := h.Hash(password)
+	if err != nil {
+		return err
+	}
+	user.Password = ""
+	user.PasswordHash = hash
+	user.Verifier = nil
+	if h.scramIterations > 0 {
+		user.Verifier = NewScramVerifier(password, h.scramIterations)
+	}
+	return nil
+}
+
+// Verify reports whether password matches user stored credentials,
+// whatever the way they were stored.
+func Verify(user *model.User, password string) bool {
+	switch {
+	case len(user.PasswordHash) > 0:
+		return verifyHash(user.PasswordHash, password)
+	case user.Verifier != nil:
+		return VerifyScramPassword(user.Verifier, password)
+	case len(user.Password) > 0:
+		return subtle.ConstantTimeCompare([]byte(user.Password), []byte(password)) == 1
+	}
+	return false
+}
+
+// NeedsUpgrade reports whether user credentials are to be derived again
+// from its password once successfully authenticated, that is, whenever the
+// password is stored in plain text, any of the credentials is missing, or
+// a SCRAM verifier is stored while not being derived anymore.
+func (h *Hasher) NeedsUpgrade(user *model.User) bool {
+	if len(user.Password) > 0 || len(user.PasswordHash) == 0 {
+		return true
+	}
+	return (user.Verifier == nil) == (h.scramIterations > 0)
+}
+
+func verifyHash(hash, password string) bool {
+	if strings.HasPrefix(hash, argon2idPrefix) {
+		return argon2idVerify(hash, password)
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
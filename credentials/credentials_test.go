@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package credentials
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestHasher_BCrypt(t *testing.T) {
+	h := NewHasher(&config.PasswordHashing{Algorithm: config.BCrypt, Cost: bcrypt.MinCost}, 4096)
+	require.Equal(t, 4096, h.ScramIterations())
+
+	hash, err := h.Hash("1234")
+	require.Nil(t, err)
+	require.NotEqual(t, "1234", hash)
+	cost, err := bcrypt.Cost([]byte(hash))
+	require.Nil(t, err)
+	require.Equal(t, bcrypt.MinCost, cost)
+
+	user := &model.User{Username: "ortuman", Password: "1234"}
+	require.True(t, h.NeedsUpgrade(user))
+	require.Nil(t, h.SetPassword(user, "1234"))
+	require.Equal(t, "", user.Password)
+	require.False(t, h.NeedsUpgrade(user))
+	require.True(t, Verify(user, "1234"))
+	require.False(t, Verify(user, "12345"))
+	require.True(t, VerifyScramPassword(user.Verifier, "1234"))
+}
+
+func TestHasher_Argon2id(t *testing.T) {
+	h := NewHasher(&config.PasswordHashing{Algorithm: config.Argon2id, Cost: 1}, 4096)
+
+	hash, err := h.Hash("1234")
+	require.Nil(t, err)
+	require.True(t, strings.HasPrefix(hash, "$argon2id$v=19$m=65536,t=1,p=4$"))
+
+	hash2, _ := h.Hash("1234")
+	require.NotEqual(t, hash, hash2) // salted
+
+	user := &model.User{Username: "ortuman"}
+	require.Nil(t, h.SetPassword(user, "1234"))
+	require.True(t, Verify(user, "1234"))
+	require.False(t, Verify(user, "12345"))
+
+	// malformed hashes never match
+	for _, malformed := range []string{"$argon2id$", "$argon2id$v=16$m=65536,t=1,p=4$c2FsdA$a2V5", "$argon2id$v=19$m=x$c2FsdA$a2V5", "$argon2id$v=19$m=65536,t=1,p=4$.$a2V5"} {
+		require.False(t, Verify(&model.User{PasswordHash: malformed}, "1234"))
+	}
+}
+
+func TestHasher_NoScram(t *testing.T) {
+	h := NewHasher(&config.PasswordHashing{Algorithm: config.BCrypt, Cost: bcrypt.MinCost}, 0)
+	require.Equal(t, 0, h.ScramIterations())
+
+	user := &model.User{Username: "ortuman"}
+	require.Nil(t, h.SetPassword(user, "1234"))
+	require.Nil(t, user.Verifier)
+	require.False(t, h.NeedsUpgrade(user))
+	require.True(t, Verify(user, "1234"))
+
+	// previously derived verifiers get discarded
+	user.Verifier = NewScramVerifier("1234", 4096)
+	require.True(t, h.NeedsUpgrade(user))
+	require.Nil(t, h.SetPassword(user, "1234"))
+	require.Nil(t, user.Verifier)
+}
+
+func TestVerify(t *testing.T) {
+	// plain-text password
+	user := &model.User{Password: "1234"}
+	require.True(t, Verify(user, "1234"))
+	require.False(t, Verify(user, "12345"))
+
+	// SCRAM verifier only
+	h := NewHasher(&config.PasswordHashing{Algorithm: config.BCrypt, Cost: bcrypt.MinCost}, 4096)
+	user = &model.User{Verifier: NewScramVerifier("1234", 4096)}
+	require.True(t, h.NeedsUpgrade(user))
+	require.True(t, Verify(user, "1234"))
+	require.False(t, Verify(user, "12345"))
+
+	// no credentials at all
+	require.False(t, Verify(&model.User{}, ""))
+}
@@ -0,0 +1,60 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package credentials
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"crypto/sha256"
+	"hash"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/util"
+	"golang.org/x/crypto/pbkdf2"
+)
+
+// ScramKeys derives SCRAM stored and server keys from password (https://tools.ietf.org/html/rfc5802#section-3).
+func ScramKeys(h func() hash.Hash, password, salt []byte, iterations int) (storedKey, serverKey []byte) {
+	saltedPassword := pbkdf2.Key(password, salt, iterations, h().Size(), h)
+
+	m := hmac.New(h, saltedPassword)
+	m.Write([]byte("Client Key"))
+	clientKey := m.Sum(nil)
+
+	sh := h()
+	sh.Write(clientKey)
+	storedKey = sh.Sum(nil)
+
+	m = hmac.New(h, saltedPassword)
+	m.Write([]byte("Server Key"))
+	serverKey = m.Sum(nil)
+	return
+}
+
+// NewScramVerifier derives a SCRAM verifier suitable for both
+// SCRAM-SHA-1 and SCRAM-SHA-256 mechanisms from password.
+func NewScramVerifier(password string, iterations int) *model.ScramVerifier {
+	v := &model.ScramVerifier{
+		Salt:           util.RandomBytes(32),
+		IterationCount: iterations,
+	}
+	v.StoredKeySHA1, v.ServerKeySHA1 = ScramKeys(sha1.New, []byte(password), v.Salt, iterations)
+	v.StoredKeySHA256, v.ServerKeySHA256 = ScramKeys(sha256.New, []byte(password), v.Salt, iterations)
+	return v
+}
+
+// VerifyScramPassword reports whether password matches v verifier.
+func VerifyScramPassword(v *model.ScramVerifier, password string) bool {
+	h, storedKey := sha256.New, v.StoredKeySHA256
+	if len(storedKey) == 0 {
+		h, storedKey = sha1.New, v.StoredKeySHA1
+	}
+	if len(storedKey) == 0 {
+		return false
+	}
+	sk, _ := ScramKeys(h, []byte(password), v.Salt, v.IterationCount)
+	return hmac.Equal(sk, storedKey)
+}
@@ -0,0 +1,294 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package denylist implements reserved name lists maintained in external files.
+//
+// Every non blank line holds a single pattern. Lines starting with '#'
+// are comments, lines prefixed by 're:' hold a regular expression and
+// any other line holds a glob pattern (as accepted by path.Match).
+// Patterns must match the whole name and are evaluated case insensitively.
+package denylist
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+)
+
+const regexPrefix = "re:"
+
+const defaultWatchInterval = time.Second * 5
+
+// PatternError describes a pattern that could not be compiled.
+type PatternError struct {
+	File string
+	Line int
+	Err  error
+}
+
+func (e *PatternError) Error() string {
+	return fmt.Sprintf("denylist: %s:%d: %v", e.File, e.Line, e.Err)
+}
+
+// PatternErrors is returned when one or more patterns of a list
+// could not be compiled. Any other pattern is still applied.
+type PatternErrors []*PatternError
+
+func (e PatternErrors) Error() string {
+	s := make([]string, len(e))
+	for i, err := range e {
+		s[i] = err.Error()
+	}
+	return strings.Join(s, "; ")
+}
+
+type pattern struct {
+	glob string
+	re   *regexp.Regexp
+}
+
+func (p *pattern) matches(name string) bool {
+	if p.re != nil {
+		return p.re.MatchString(name)
+	}
+	ok, _ := path.Match(p.glob, name)
+	return ok
+}
+
+// List represents a deny-list loaded from a file.
+type List struct {
+	path     string
+	mu       sync.RWMutex
+	patterns []pattern
+	modTime  time.Time
+	quitCh   chan struct{}
+	quitOnce sync.Once
+}
+
+// New returns a list loaded from path file.
+// A non nil list is returned along with a PatternErrors error
+// whenever only some of its patterns could not be compiled.
+func New(path string) (*List, error) {
+	l := &List{path: path, quitCh: make(chan struct{})}
+	if err := l.Reload(); err != nil {
+		if _, ok := err.(PatternErrors); !ok {
+			return nil, err
+		}
+		return l, err
+	}
+	return l, nil
+}
+
+// Path returns list file path.
+func (l *List) Path() string {
+	return l.path
+}
+
+// Matches returns whether or not name matches any list pattern.
+func (l *List) Matches(name string) bool {
+	name = strings.ToLower(name)
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	for i := range l.patterns {
+		if l.patterns[i].matches(name) {
+			return true
+		}
+	}
+	return false
+}
+
+// Len returns the number of list patterns.
+func (l *List) Len() int {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return len(l.patterns)
+}
+
+// Reload reads list file again replacing current patterns.
+// Previous patterns are kept if the file can't be read.
+func (l *List) Reload() error {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return err
+	}
+	b, err := ioutil.ReadFile(l.path)
+	if err != nil {
+		return err
+	}
+	patterns, errs := parse(l.path, b)
+
+	l.mu.Lock()
+	l.patterns = patterns
+	l.modTime = fi.ModTime()
+	l.mu.Unlock()
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// Watch periodically checks list file for modifications,
+// reloading it whenever changed until Close is called.
+// A zero interval means the default one.
+func (l *List) Watch(interval time.Duration) {
+	if interval == 0 {
+		interval = defaultWatchInterval
+	}
+	go l.loop(interval)
+}
+
+// Close stops watching list file.
+func (l *List) Close() {
+	l.quitOnce.Do(func() { close(l.quitCh) })
+}
+
+func (l *List) loop(interval time.Duration) {
+	tc := time.NewTicker(interval)
+	defer tc.Stop()
+	for {
+		select {
+		case <-tc.C:
+			if !l.modified() {
+				continue
+			}
+			if err := l.Reload(); err != nil {
+				log.Errorf("%v", err)
+				continue
+			}
+			log.Infof("denylist: reloaded %s", l.path)
+		case <-l.quitCh:
+			return
+		}
+	}
+}
+
+func (l *List) modified() bool {
+	fi, err := os.Stat(l.path)
+	if err != nil {
+		return false
+	}
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return !fi.ModTime().Equal(l.modTime)
+}
+
+func parse(file string, b []byte) ([]pattern, PatternErrors) {
+	var patterns []pattern
+	var errs PatternErrors
+
+	sc := bufio.NewScanner(bytes.NewReader(b))
+	line := 0
+	for sc.Scan() {
+		line++
+		s := strings.TrimSpace(sc.Text())
+		if len(s) == 0 || strings.HasPrefix(s, "#") {
+			continue
+		}
+		if strings.HasPrefix(s, regexPrefix) {
+			re, err := regexp.Compile("^(?i:" + s[len(regexPrefix):] + ")$")
+			if err != nil {
+				errs = append(errs, &PatternError{File: file, Line: line, Err: err})
+				continue
+			}
+			patterns = append(patterns, pattern{re: re})
+			continue
+		}
+		glob := strings.ToLower(s)
+		if _, err := path.Match(glob, ""); err != nil {
+			errs = append(errs, &PatternError{File: file, Line: line, Err: fmt.Errorf("%v: %s", err, s)})
+			continue
+		}
+		patterns = append(patterns, pattern{glob: glob})
+	}
+	return patterns, errs
+}
+
+// shared lists
+var (
+	lists   = make(map[string]*List)
+	listsMu sync.Mutex
+)
+
+// Open returns the list shared by every caller for path file, loading
+// and watching it the first time it's requested. Load errors are
+// logged, an unreadable file resulting in an empty list until it
+// becomes available.
+func Open(path string) *List {
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	if l := lists[path]; l != nil {
+		return l
+	}
+	l := &List{path: path, quitCh: make(chan struct{})}
+	if err := l.Reload(); err != nil {
+		log.Errorf("%v", err)
+	}
+	l.Watch(0)
+	lists[path] = l
+	return l
+}
+
+// inlineFile names in-memory lists on pattern errors.
+const inlineFile = "<inline>"
+
+// compiled holds in-memory lists shared by pattern set
+var (
+	compiled   = make(map[string]*List)
+	compiledMu sync.Mutex
+)
+
+// Compile returns the in-memory list shared by every caller for patterns,
+// so that configured patterns get compiled only once. Pattern errors are
+// logged, any other pattern being still applied.
+func Compile(patterns []string) *List {
+	key := strings.Join(patterns, "\n")
+
+	compiledMu.Lock()
+	defer compiledMu.Unlock()
+	if l := compiled[key]; l != nil {
+		return l
+	}
+	l := &List{quitCh: make(chan struct{})}
+	ps, errs := parse(inlineFile, []byte(key))
+	if len(errs) > 0 {
+		log.Errorf("%v", errs)
+	}
+	l.patterns = ps
+	compiled[key] = l
+	return l
+}
+
+// ReloadAll reloads every shared list, logging any error.
+func ReloadAll() {
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	for _, l := range lists {
+		if err := l.Reload(); err != nil {
+			log.Errorf("%v", err)
+			continue
+		}
+		log.Infof("denylist: reloaded %s", l.path)
+	}
+}
+
+// CloseAll stops watching and releases every shared list.
+func CloseAll() {
+	listsMu.Lock()
+	defer listsMu.Unlock()
+	for p, l := range lists {
+		l.Close()
+		delete(lists, p)
+	}
+}
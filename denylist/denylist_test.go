@@ -0,0 +1,150 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package denylist
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestDenyList_Patterns(t *testing.T) {
+	p := tUtilDenyListFile(t, `
+# reserved accounts
+admin*
+?oot
+re:(web|post)master
+re:support[0-9]+
+`)
+	defer os.RemoveAll(filepath.Dir(p))
+
+	l, err := New(p)
+	require.Nil(t, err)
+	require.Equal(t, 4, l.Len())
+
+	// glob
+	require.True(t, l.Matches("admin"))
+	require.True(t, l.Matches("Administrator"))
+	require.True(t, l.Matches("root"))
+	require.False(t, l.Matches("rooted"))
+	require.False(t, l.Matches("sysadmin"))
+
+	// regex
+	require.True(t, l.Matches("webmaster"))
+	require.True(t, l.Matches("PostMaster"))
+	require.True(t, l.Matches("support42"))
+	require.False(t, l.Matches("webmasters"))
+	require.False(t, l.Matches("support"))
+
+	require.False(t, l.Matches("ortuman"))
+}
+
+func TestDenyList_PatternErrors(t *testing.T) {
+	p := tUtilDenyListFile(t, "admin\nre:(unclosed\nroot\n[z-\n")
+	defer os.RemoveAll(filepath.Dir(p))
+
+	l, err := New(p)
+	require.NotNil(t, l)
+	errs, ok := err.(PatternErrors)
+	require.True(t, ok)
+	require.Equal(t, 2, len(errs))
+	require.Equal(t, 2, errs[0].Line)
+	require.Equal(t, 4, errs[1].Line)
+	require.Equal(t, p, errs[0].File)
+
+	// valid patterns are still applied
+	require.Equal(t, 2, l.Len())
+	require.True(t, l.Matches("admin"))
+	require.True(t, l.Matches("root"))
+
+	_, err = New(filepath.Join(filepath.Dir(p), "missing"))
+	require.NotNil(t, err)
+}
+
+func TestDenyList_Reload(t *testing.T) {
+	p := tUtilDenyListFile(t, "admin\n")
+	defer os.RemoveAll(filepath.Dir(p))
+
+	l, err := New(p)
+	require.Nil(t, err)
+	require.False(t, l.Matches("noelia"))
+
+	require.Nil(t, ioutil.WriteFile(p, []byte("admin\nnoel*\n"), 0644))
+	require.Nil(t, l.Reload())
+	require.True(t, l.Matches("noelia"))
+
+	// unreadable file keeps previous patterns
+	os.Remove(p)
+	require.NotNil(t, l.Reload())
+	require.True(t, l.Matches("noelia"))
+}
+
+func TestDenyList_Watch(t *testing.T) {
+	p := tUtilDenyListFile(t, "admin\n")
+	defer os.RemoveAll(filepath.Dir(p))
+
+	l, err := New(p)
+	require.Nil(t, err)
+	l.Watch(time.Millisecond * 10)
+	defer l.Close()
+	require.False(t, l.Matches("ortuman"))
+
+	require.Nil(t, ioutil.WriteFile(p, []byte("re:ortu.*\n"), 0644))
+	mt := time.Now().Add(time.Second)
+	require.Nil(t, os.Chtimes(p, mt, mt))
+
+	deadline := time.Now().Add(time.Second * 2)
+	for !l.Matches("ortuman") && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 10)
+	}
+	require.True(t, l.Matches("ortuman"))
+	require.False(t, l.Matches("admin"))
+}
+
+func TestDenyList_Open(t *testing.T) {
+	p := tUtilDenyListFile(t, "admin\n")
+	defer os.RemoveAll(filepath.Dir(p))
+	defer CloseAll()
+
+	l := Open(p)
+	require.True(t, l == Open(p))
+	require.True(t, l.Matches("admin"))
+
+	require.Nil(t, ioutil.WriteFile(p, []byte("root\n"), 0644))
+	ReloadAll()
+	require.False(t, l.Matches("admin"))
+	require.True(t, l.Matches("root"))
+
+	// missing files result in empty lists
+	l = Open(filepath.Join(filepath.Dir(p), "missing"))
+	require.Equal(t, 0, l.Len())
+}
+
+func TestDenyList_Compile(t *testing.T) {
+	patterns := []string{"admin", "re:post(master|mistress)", "xmpp*", "re:(bad"}
+	l := Compile(patterns)
+	require.True(t, l == Compile(patterns))
+	require.Equal(t, 3, l.Len())
+
+	require.True(t, l.Matches("Admin"))
+	require.True(t, l.Matches("POSTMASTER"))
+	require.True(t, l.Matches("xmpp-bot"))
+	require.False(t, l.Matches("ortuman"))
+
+	require.False(t, l == Compile([]string{"admin"}))
+}
+
+func tUtilDenyListFile(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "denylist")
+	require.Nil(t, err)
+	p := filepath.Join(dir, "reserved.txt")
+	require.Nil(t, ioutil.WriteFile(p, []byte(content), 0644))
+	return p
+}
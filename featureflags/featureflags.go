@@ -0,0 +1,299 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package featureflags implements configuration driven feature flags
+// along with per user overrides kept in storage, allowing features
+// to be rolled out gradually.
+package featureflags
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"net/http"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// maxCachedUsers bounds the number of users whose overrides are kept in memory.
+const maxCachedUsers = 16384
+
+// ErrUnknownFlag is returned when overriding a flag not defined in configuration.
+var ErrUnknownFlag = errors.New("featureflags: unknown flag")
+
+// singleton interface
+var (
+	inst        *Flags
+	instMu      sync.RWMutex
+	initialized uint32
+)
+
+// Flags evaluates feature flags for a given user.
+type Flags struct {
+	cfg       *config.FeatureFlags
+	srv       *http.Server
+	flags     map[string]config.FeatureFlag
+	mu        sync.RWMutex
+	gen       uint64
+	overrides map[string]map[string]bool
+}
+
+// New returns a feature flags evaluator for cfg flag definitions.
+func New(cfg *config.FeatureFlags) *Flags {
+	f := &Flags{
+		cfg:       cfg,
+		flags:     make(map[string]config.FeatureFlag),
+		overrides: make(map[string]map[string]bool),
+	}
+	for _, flag := range cfg.Flags {
+		f.flags[flag.Name] = flag
+	}
+	return f
+}
+
+// Initialize initializes the feature flags sub system,
+// starting the admin HTTP listener whenever a port has been configured.
+func Initialize(cfg *config.FeatureFlags) {
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		inst = New(cfg)
+		if cfg.Port > 0 {
+			inst.srv = &http.Server{
+				Addr:    fmt.Sprintf("%s:%d", cfg.BindAddress, cfg.Port),
+				Handler: inst.serveMux(),
+			}
+			go inst.listen()
+		}
+	}
+}
+
+// Instance returns global feature flags evaluator,
+// or nil if the sub system has not been initialized.
+func Instance() *Flags {
+	instMu.RLock()
+	defer instMu.RUnlock()
+	return inst
+}
+
+// Shutdown shuts down feature flags sub system.
+func Shutdown() {
+	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		if inst.srv != nil {
+			inst.srv.Close()
+		}
+		inst = nil
+	}
+}
+
+// Enabled returns whether or not name flag is enabled for username.
+// Every flag is considered enabled if the sub system has not been initialized.
+func Enabled(name, username string) bool {
+	if f := Instance(); f != nil {
+		return f.Enabled(name, username)
+	}
+	return true
+}
+
+// Enabled returns whether or not name flag is enabled for username.
+// Flags not defined in configuration are always enabled.
+//
+// User overrides are fetched from storage the first time a user is
+// evaluated and cached from then on, so that evaluating a flag
+// doesn't require a storage round trip.
+func (f *Flags) Enabled(name, username string) bool {
+	flag, ok := f.flags[name]
+	if !ok {
+		return true
+	}
+	if len(username) > 0 {
+		if enabled, ok := f.override(name, username); ok {
+			return enabled
+		}
+	}
+	return flag.Enabled || inRollout(&flag, username)
+}
+
+// SetOverride overrides name flag value for username.
+func (f *Flags) SetOverride(name, username string, enabled bool) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if _, ok := f.flags[name]; !ok {
+		return ErrUnknownFlag
+	}
+	ff := model.FeatureFlag{Name: name, Username: username, Enabled: enabled}
+	if err := storage.Instance().InsertOrUpdateFeatureFlag(ctx, &ff); err != nil {
+		return err
+	}
+	f.invalidate(username)
+	return nil
+}
+
+// RemoveOverride removes name flag override for username,
+// making its configured value apply again.
+func (f *Flags) RemoveOverride(name, username string) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if _, ok := f.flags[name]; !ok {
+		return ErrUnknownFlag
+	}
+	if err := storage.Instance().DeleteFeatureFlag(ctx, name, username); err != nil {
+		return err
+	}
+	f.invalidate(username)
+	return nil
+}
+
+type flagState struct {
+	Name       string `json:"name"`
+	Username   string `json:"username"`
+	Enabled    bool   `json:"enabled"`
+	Overridden bool   `json:"overridden"`
+}
+
+// ServeHTTP serves user flag overrides admin API.
+// Request path is expected to be in the form of '/flags/{name}/{username}'.
+//
+// GET returns flag state for the user, PUT sets an override
+// from a {"enabled": bool} body and DELETE removes it.
+func (f *Flags) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !f.isAuthorized(r.Header.Get("Authorization")) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/flags/"), "/")
+	if len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+		http.NotFound(w, r)
+		return
+	}
+	name, username := parts[0], parts[1]
+	if _, ok := f.flags[name]; !ok {
+		http.NotFound(w, r)
+		return
+	}
+	var err error
+	switch r.Method {
+	case http.MethodGet:
+		state := flagState{Name: name, Username: username, Enabled: f.Enabled(name, username)}
+		_, state.Overridden = f.override(name, username)
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&state)
+		return
+
+	case http.MethodPut:
+		var body struct {
+			Enabled *bool `json:"enabled"`
+		}
+		if json.NewDecoder(r.Body).Decode(&body) != nil || body.Enabled == nil {
+			http.Error(w, http.StatusText(http.StatusBadRequest), http.StatusBadRequest)
+			return
+		}
+		err = f.SetOverride(name, username, *body.Enabled)
+
+	case http.MethodDelete:
+		err = f.RemoveOverride(name, username)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func (f *Flags) override(name, username string) (enabled bool, ok bool) {
+	f.mu.RLock()
+	overrides, cached := f.overrides[username]
+	gen := f.gen
+	f.mu.RUnlock()
+
+	if !cached {
+		ctx, cancel := storage.QueryContext()
+		ffs, err := storage.Instance().FetchFeatureFlags(ctx, username)
+		cancel()
+		if err != nil {
+			log.Error(err)
+			return false, false
+		}
+		overrides = make(map[string]bool, len(ffs))
+		for _, ff := range ffs {
+			overrides[ff.Name] = ff.Enabled
+		}
+		f.mu.Lock()
+		// discard fetched overrides if modified in the meantime
+		if f.gen == gen {
+			if len(f.overrides) >= maxCachedUsers {
+				f.overrides = make(map[string]map[string]bool)
+			}
+			f.overrides[username] = overrides
+		}
+		f.mu.Unlock()
+	}
+	enabled, ok = overrides[name]
+	return
+}
+
+func (f *Flags) invalidate(username string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.overrides, username)
+	f.gen++
+}
+
+func (f *Flags) isAuthorized(authorization string) bool {
+	const bearerPrefix = "Bearer "
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, bearerPrefix)
+	for _, tk := range f.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(tk), []byte(token)) == 1 {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *Flags) serveMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/flags/", f)
+	return mux
+}
+
+func (f *Flags) listen() {
+	log.Infof("feature flags: listening at %s", f.srv.Addr)
+	if err := f.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Error(err)
+	}
+}
+
+// inRollout returns whether or not username falls within flag rollout percentage.
+// Users are deterministically bucketed so that the verdict is stable across sessions.
+func inRollout(flag *config.FeatureFlag, username string) bool {
+	if flag.Rollout == 0 || len(username) == 0 {
+		return false
+	}
+	h := fnv.New32a()
+	h.Write([]byte(flag.Name + ":" + username))
+	return int(h.Sum32()%100) < flag.Rollout
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package featureflags
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlags_Defaults(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	f := New(tUtilFlagsConfig())
+	require.True(t, f.Enabled("vacation", "ortuman"))
+	require.False(t, f.Enabled("carbons", "ortuman"))
+	require.True(t, f.Enabled("undefined", "ortuman"))
+
+	// not initialized sub system
+	require.True(t, Enabled("carbons", "ortuman"))
+
+	// roughly half of the users fall within rollout, always getting the same verdict
+	var enabled int
+	for i := 0; i < 1000; i++ {
+		username := fmt.Sprintf("user%d", i)
+		if f.Enabled("mam", username) {
+			enabled++
+			require.True(t, f.Enabled("mam", username))
+		}
+	}
+	require.True(t, enabled > 400 && enabled < 600)
+	require.False(t, f.Enabled("mam", ""))
+}
+
+func TestFlags_Overrides(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	storage.Instance().InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "carbons", Username: "ortuman", Enabled: true})
+
+	f := New(tUtilFlagsConfig())
+	require.True(t, f.Enabled("carbons", "ortuman"))
+	require.False(t, f.Enabled("carbons", "noelia"))
+
+	// overrides are cached
+	storage.ActivateMockedError()
+	require.True(t, f.Enabled("carbons", "ortuman"))
+	require.False(t, f.Enabled("carbons", "noelia"))
+	require.NotNil(t, f.SetOverride("carbons", "noelia", true))
+	storage.DeactivateMockedError()
+
+	// cache is invalidated on change
+	require.Nil(t, f.SetOverride("carbons", "noelia", true))
+	require.True(t, f.Enabled("carbons", "noelia"))
+	require.Nil(t, f.SetOverride("vacation", "noelia", false))
+	require.False(t, f.Enabled("vacation", "noelia"))
+
+	require.Nil(t, f.RemoveOverride("carbons", "noelia"))
+	require.False(t, f.Enabled("carbons", "noelia"))
+	require.True(t, f.Enabled("carbons", "ortuman"))
+
+	require.Equal(t, ErrUnknownFlag, f.SetOverride("undefined", "noelia", false))
+}
+
+func TestFlags_ServeHTTP(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	f := New(tUtilFlagsConfig())
+	srv := httptest.NewServer(f.serveMux())
+	defer srv.Close()
+
+	do := func(method, path, token, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if len(token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+	resp := do(http.MethodGet, "/flags/carbons/ortuman", "", "")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp = do(http.MethodGet, "/flags/carbons/ortuman", "b4dt0k3n", "")
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+
+	resp = do(http.MethodGet, "/flags/undefined/ortuman", "s3cr3t", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = do(http.MethodGet, "/flags/carbons", "s3cr3t", "")
+	require.Equal(t, http.StatusNotFound, resp.StatusCode)
+	resp = do(http.MethodPut, "/flags/carbons/ortuman", "s3cr3t", "{}")
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPut, "/flags/carbons/ortuman", "s3cr3t", `{"enabled": true}`)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.True(t, f.Enabled("carbons", "ortuman"))
+
+	var state flagState
+	resp = do(http.MethodGet, "/flags/carbons/ortuman", "s3cr3t", "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&state))
+	resp.Body.Close()
+	require.Equal(t, flagState{Name: "carbons", Username: "ortuman", Enabled: true, Overridden: true}, state)
+
+	resp = do(http.MethodDelete, "/flags/carbons/ortuman", "s3cr3t", "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.False(t, f.Enabled("carbons", "ortuman"))
+}
+
+func tUtilFlagsConfig() *config.FeatureFlags {
+	return &config.FeatureFlags{
+		Tokens: []string{"s3cr3t"},
+		Flags: []config.FeatureFlag{
+			{Name: "vacation", Enabled: true},
+			{Name: "carbons"},
+			{Name: "mam", Rollout: 50},
+		},
+	}
+}
@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/importer"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+)
+
+const importUsageStr = `
+Usage: jackal import [options] <file>...
+
+Imports XEP-0227 server data exports (ejabberd, prosody-migrator)
+into the configured storage.
+
+Import Options:
+    -c, --config <file>    Configuration file path
+`
+
+func runImport(args []string) {
+	var configFile string
+
+	fs := flag.NewFlagSet("import", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "/etc/jackal/jackal.yaml", "Configuration file path.")
+	fs.StringVar(&configFile, "c", "/etc/jackal/jackal.yml", "Configuration file path.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "%s\n", importUsageStr)
+	}
+	fs.Parse(args)
+
+	if fs.NArg() == 0 {
+		fs.Usage()
+		return
+	}
+	var cfg config.Config
+	if err := config.FromFile(configFile, &cfg); err != nil {
+		fmt.Fprintf(os.Stderr, "jackal: %v\n", err)
+		return
+	}
+	log.Initialize(&cfg.Logger)
+	defer log.Shutdown()
+
+	storage.Initialize(&cfg.Storage)
+	defer storage.Shutdown()
+
+	if err := decorateEncryptedStorage(&cfg.Storage); err != nil {
+		fmt.Fprintf(os.Stderr, "jackal: %v\n", err)
+		return
+	}
+
+	for _, filename := range fs.Args() {
+		if err := importFile(filename, cfg.C2S.Domains); err != nil {
+			fmt.Fprintf(os.Stderr, "jackal: %s: %v\n", filename, err)
+			return
+		}
+	}
+}
+
+func importFile(filename string, domains []string) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	report, err := importer.ImportXEP0227(f, domains)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(os.Stdout, "%s:\n%s", filename, report)
+	return nil
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package importer
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	pieNamespace       = "urn:xmpp:pie:0"
+	legacyPieNamespace = "http://www.xmpp.org/extensions/xep-0227.html#ns"
+)
+
+const (
+	rosterNamespace  = "jabber:iq:roster"
+	privateNamespace = "jabber:iq:private"
+	vCardNamespace   = "vcard-temp"
+)
+
+// ejabberd exports SCRAM credentials as 'scram:StoredKey,ServerKey,Salt,IterationCount'
+const scramPasswordPrefix = "scram:"
+
+var errUnrecognizedExport = errors.New("importer: unrecognized XEP-0227 export")
+
+// Report summarizes the outcome of an import process.
+type Report struct {
+	Users               int
+	RosterItems         int
+	RosterNotifications int
+	VCards              int
+	PrivateXML          int
+	OfflineMessages     int
+
+	// Unmapped contains a description of every source item
+	// that couldn't be mapped into jackal's storage model.
+	Unmapped []string
+}
+
+// String returns a human readable representation of the report.
+func (r *Report) String() string {
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "users: %d\n", r.Users)
+	fmt.Fprintf(buf, "roster items: %d\n", r.RosterItems)
+	fmt.Fprintf(buf, "roster notifications: %d\n", r.RosterNotifications)
+	fmt.Fprintf(buf, "vcards: %d\n", r.VCards)
+	fmt.Fprintf(buf, "private xml: %d\n", r.PrivateXML)
+	fmt.Fprintf(buf, "offline messages: %d\n", r.OfflineMessages)
+	fmt.Fprintf(buf, "unmapped: %d\n", len(r.Unmapped))
+	for _, u := range r.Unmapped {
+		fmt.Fprintf(buf, "  - %s\n", u)
+	}
+	return buf.String()
+}
+
+type importer struct {
+	domains map[string]struct{}
+	report  Report
+}
+
+// ImportXEP0227 reads a XEP-0227 (piefxis) server data export from r,
+// as produced by ejabberd or prosody-migrator, and writes its content
+// into the configured storage. Only data belonging to any of the given
+// local domains is imported.
+// Storage failures abort the process, while entities that couldn't be
+// mapped are skipped and reported.
+func ImportXEP0227(r io.Reader, domains []string) (*Report, error) {
+	im := &importer{domains: make(map[string]struct{})}
+	for _, domain := range domains {
+		im.domains[domain] = struct{}{}
+	}
+	root, err := xml.NewParser(r).ParseElement()
+	if err != nil {
+		return nil, err
+	}
+	if root.Name() != "server-data" {
+		return nil, errUnrecognizedExport
+	}
+	switch root.Namespace() {
+	case pieNamespace, legacyPieNamespace:
+		break
+	default:
+		return nil, errUnrecognizedExport
+	}
+	for _, host := range root.FindElements("host") {
+		if err := im.importHost(host); err != nil {
+			return nil, err
+		}
+	}
+	return &im.report, nil
+}
+
+func (im *importer) importHost(host xml.Element) error {
+	domain := host.Attribute("jid")
+	if !im.isLocalDomain(domain) {
+		im.unmapped("host %s: not a local domain", domain)
+		return nil
+	}
+	for _, user := range host.FindElements("user") {
+		if err := im.importUser(user, domain); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importUser(user xml.Element, domain string) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	userJID, err := xml.NewJID(user.Attribute("name"), domain, "", false)
+	if err != nil {
+		im.unmapped("user %s@%s: %v", user.Attribute("name"), domain, err)
+		return nil
+	}
+	password := user.Attribute("password")
+	if strings.HasPrefix(password, scramPasswordPrefix) || user.FindElement("scram-credentials") != nil {
+		// jackal stores plaintext passwords... SCRAM keys can't be reverted
+		im.unmapped("user %s: SCRAM credentials can't be converted into a plaintext password", userJID)
+		return nil
+	}
+	if len(password) == 0 {
+		im.unmapped("user %s: missing password", userJID)
+		return nil
+	}
+	if err := storage.Instance().InsertOrUpdateUser(ctx, &model.User{Username: userJID.Node(), Password: password}); err != nil {
+		return err
+	}
+	im.report.Users++
+
+	for _, elem := range user.Elements() {
+		switch {
+		case elem.Name() == "query" && elem.Namespace() == rosterNamespace:
+			err = im.importRoster(elem, userJID)
+		case elem.Name() == "query" && elem.Namespace() == privateNamespace:
+			err = im.importPrivateXML(elem, userJID)
+		case elem.Name() == "vCard" && elem.Namespace() == vCardNamespace:
+			err = im.importVCard(elem, userJID)
+		case elem.Name() == "offline-messages":
+			err = im.importOfflineMessages(elem, userJID)
+		case elem.Name() == "presence":
+			err = im.importRosterNotification(elem, userJID)
+		default:
+			im.unmapped("user %s: unsupported element <%s xmlns='%s'>", userJID, elem.Name(), elem.Namespace())
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (im *importer) importRoster(query xml.Element, userJID *xml.JID) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	for _, item := range query.FindElements("item") {
+		contactJID, err := xml.NewJIDString(item.Attribute("jid"), false)
+		if err != nil {
+			im.unmapped("user %s: roster item %s: %v", userJID, item.Attribute("jid"), err)
+			continue
+		}
+		if !im.isLocalDomain(contactJID.Domain()) || len(contactJID.Node()) == 0 {
+			im.unmapped("user %s: roster item %s: not a local user", userJID, contactJID)
+			continue
+		}
+		subscription := item.Attribute("subscription")
+		switch subscription {
+		case "":
+			subscription = "none"
+		case "none", "from", "to", "both":
+			break
+		default:
+			im.unmapped("user %s: roster item %s: unrecognized subscription '%s'", userJID, contactJID, subscription)
+			continue
+		}
+		ri := &model.RosterItem{
+			User:         userJID.Node(),
+			Contact:      contactJID.Node(),
+			Name:         item.Attribute("name"),
+			Subscription: subscription,
+			Ask:          item.Attribute("ask") == "subscribe",
+		}
+		for _, group := range item.FindElements("group") {
+			ri.Groups = append(ri.Groups, group.Text())
+		}
+		if err := storage.Instance().InsertOrUpdateRosterItem(ctx, ri); err != nil {
+			return err
+		}
+		im.report.RosterItems++
+	}
+	return nil
+}
+
+func (im *importer) importRosterNotification(presence xml.Element, userJID *xml.JID) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if presence.Type() != xml.SubscribeType {
+		im.unmapped("user %s: unsupported presence of type '%s'", userJID, presence.Type())
+		return nil
+	}
+	fromJID, err := xml.NewJIDString(presence.From(), false)
+	if err != nil {
+		im.unmapped("user %s: subscription request from %s: %v", userJID, presence.From(), err)
+		return nil
+	}
+	if !im.isLocalDomain(fromJID.Domain()) || len(fromJID.Node()) == 0 {
+		im.unmapped("user %s: subscription request from %s: not a local user", userJID, fromJID)
+		return nil
+	}
+	rn := &model.RosterNotification{
+		User:     fromJID.Node(),
+		Contact:  userJID.Node(),
+		Elements: presence.Elements(),
+	}
+	if err := storage.Instance().InsertOrUpdateRosterNotification(ctx, rn); err != nil {
+		return err
+	}
+	im.report.RosterNotifications++
+	return nil
+}
+
+func (im *importer) importPrivateXML(query xml.Element, userJID *xml.JID) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	// group private elements by namespace
+	var namespaces []string
+	elems := make(map[string][]xml.Element)
+	for _, elem := range query.Elements() {
+		ns := elem.Namespace()
+		if len(ns) == 0 {
+			im.unmapped("user %s: private element <%s> has no namespace", userJID, elem.Name())
+			continue
+		}
+		if _, ok := elems[ns]; !ok {
+			namespaces = append(namespaces, ns)
+		}
+		elems[ns] = append(elems[ns], elem)
+	}
+	for _, ns := range namespaces {
+		if err := storage.Instance().InsertOrUpdatePrivateXML(ctx, elems[ns], ns, userJID.Node()); err != nil {
+			return err
+		}
+		im.report.PrivateXML++
+	}
+	return nil
+}
+
+func (im *importer) importVCard(vCard xml.Element, userJID *xml.JID) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().InsertOrUpdateVCard(ctx, vCard, userJID.Node()); err != nil {
+		return err
+	}
+	im.report.VCards++
+	return nil
+}
+
+func (im *importer) importOfflineMessages(offlineMessages xml.Element, userJID *xml.JID) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	var messages []xml.Element
+	for _, message := range offlineMessages.Elements() {
+		if message.Name() != "message" {
+			im.unmapped("user %s: unsupported offline element <%s>", userJID, message.Name())
+			continue
+		}
+		messages = append(messages, message)
+	}
+	if len(messages) == 0 {
+		return nil
+	}
+	if err := storage.Instance().InsertOfflineMessages(ctx, messages, userJID.Node()); err != nil {
+		return err
+	}
+	im.report.OfflineMessages += len(messages)
+	return nil
+}
+
+func (im *importer) isLocalDomain(domain string) bool {
+	_, ok := im.domains[domain]
+	return ok
+}
+
+func (im *importer) unmapped(format string, args ...interface{}) {
+	im.report.Unmapped = append(im.report.Unmapped, fmt.Sprintf(format, args...))
+}
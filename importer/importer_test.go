@@ -0,0 +1,115 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package importer
+
+import (
+	"context"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/stretchr/testify/require"
+)
+
+func TestImportXEP0227(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	f, err := os.Open("../testdata/import/ejabberd.xml")
+	require.Nil(t, err)
+	defer f.Close()
+
+	report, err := ImportXEP0227(f, []string{"jackal.im"})
+	require.Nil(t, err)
+	require.Equal(t, 1, report.Users)
+	require.Equal(t, 2, report.RosterItems)
+	require.Equal(t, 1, report.RosterNotifications)
+	require.Equal(t, 1, report.VCards)
+	require.Equal(t, 2, report.PrivateXML)
+	require.Equal(t, 2, report.OfflineMessages)
+	require.Equal(t, 5, len(report.Unmapped))
+
+	// users
+	usr, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
+	require.NotNil(t, usr)
+	require.Equal(t, "1234", usr.Password)
+
+	for _, username := range []string{"noelia", "romeo", "hamlet", "juliet"} {
+		exists, _ := storage.Instance().UserExists(context.Background(), username)
+		require.False(t, exists)
+	}
+	// roster
+	ri, _ := storage.Instance().FetchRosterItem(context.Background(), "ortuman", "noelia")
+	require.NotNil(t, ri)
+	require.Equal(t, "Noelia", ri.Name)
+	require.Equal(t, "both", ri.Subscription)
+	require.Equal(t, []string{"Family", "Friends"}, ri.Groups)
+
+	ri, _ = storage.Instance().FetchRosterItem(context.Background(), "ortuman", "romeo")
+	require.NotNil(t, ri)
+	require.Equal(t, "none", ri.Subscription)
+	require.True(t, ri.Ask)
+
+	rns, _ := storage.Instance().FetchRosterNotifications(context.Background(), "ortuman")
+	require.Equal(t, 1, len(rns))
+	require.Equal(t, "hamlet", rns[0].User)
+
+	// vCard
+	vCard, _ := storage.Instance().FetchVCard(context.Background(), "ortuman")
+	require.NotNil(t, vCard)
+	require.Equal(t, "ortuman", vCard.FindElement("NICKNAME").Text())
+
+	// private XML
+	prv, _ := storage.Instance().FetchPrivateXML(context.Background(), "storage:bookmarks", "ortuman")
+	require.Equal(t, 1, len(prv))
+	prv, _ = storage.Instance().FetchPrivateXML(context.Background(), "exodus:prefs", "ortuman")
+	require.Equal(t, 1, len(prv))
+
+	// offline messages
+	msgs, _ := storage.Instance().FetchOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "Hi!", msgs[0].Message.FindElement("body").Text())
+
+	require.True(t, strings.Contains(report.String(), "offline messages: 2"))
+}
+
+func TestImportXEP0227LegacyNamespace(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	f, err := os.Open("../testdata/import/prosody.xml")
+	require.Nil(t, err)
+	defer f.Close()
+
+	report, err := ImportXEP0227(f, []string{"jackal.im"})
+	require.Nil(t, err)
+	require.Equal(t, 1, report.Users)
+	require.Equal(t, 1, report.RosterItems)
+	require.Equal(t, 0, len(report.Unmapped))
+}
+
+func TestImportXEP0227Errors(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	_, err := ImportXEP0227(strings.NewReader("<server-data xmlns='jabber:client'/>"), []string{"jackal.im"})
+	require.Equal(t, errUnrecognizedExport, err)
+
+	_, err = ImportXEP0227(strings.NewReader("<server-data xmlns='urn:xmpp:pie:0'"), []string{"jackal.im"})
+	require.NotNil(t, err)
+
+	f, err := os.Open("../testdata/import/ejabberd.xml")
+	require.Nil(t, err)
+	defer f.Close()
+
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	_, err = ImportXEP0227(f, []string{"jackal.im"})
+	require.Equal(t, storage.ErrMockedError, err)
+}
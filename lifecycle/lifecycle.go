@@ -0,0 +1,142 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package lifecycle
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+const defaultStopTimeout = time.Second * 10
+
+// Subsystem represents a server subsystem whose lifecycle
+// is controlled by a manager.
+type Subsystem interface {
+	// Name returns subsystem name.
+	Name() string
+
+	// Start starts the subsystem.
+	Start() error
+
+	// Stop stops the subsystem, releasing any associated resource.
+	Stop() error
+}
+
+type funcSubsystem struct {
+	name  string
+	start func() error
+	stop  func() error
+}
+
+// NewSubsystem returns a subsystem backed by a pair of start and stop functions.
+// Any of them may be nil.
+func NewSubsystem(name string, start func() error, stop func() error) Subsystem {
+	return &funcSubsystem{name: name, start: start, stop: stop}
+}
+
+func (s *funcSubsystem) Name() string { return s.name }
+
+func (s *funcSubsystem) Start() error {
+	if s.start != nil {
+		return s.start()
+	}
+	return nil
+}
+
+func (s *funcSubsystem) Stop() error {
+	if s.stop != nil {
+		return s.stop()
+	}
+	return nil
+}
+
+// Errors represents an aggregation of subsystem errors.
+type Errors []error
+
+// Error satisfies error interface.
+func (e Errors) Error() string {
+	var msgs []string
+	for _, err := range e {
+		msgs = append(msgs, err.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+// Manager starts subsystems in registration order
+// and stops them in reverse order.
+type Manager struct {
+	stopTimeout time.Duration
+	subsystems  []Subsystem
+	started     []Subsystem
+}
+
+// New returns a new lifecycle manager instance.
+// Every subsystem is given at most stopTimeout to stop.
+func New(stopTimeout time.Duration) *Manager {
+	if stopTimeout <= 0 {
+		stopTimeout = defaultStopTimeout
+	}
+	return &Manager{stopTimeout: stopTimeout}
+}
+
+// Register appends subsystems to the manager.
+// Subsystems should be registered in dependency order.
+func (m *Manager) Register(subsystems ...Subsystem) {
+	m.subsystems = append(m.subsystems, subsystems...)
+}
+
+// Start starts every registered subsystem in order.
+// In case one of them fails, the already started ones are stopped
+// and the start error is returned.
+func (m *Manager) Start() error {
+	for _, s := range m.subsystems {
+		if err := s.Start(); err != nil {
+			startErr := fmt.Errorf("lifecycle: %s: %v", s.Name(), err)
+			if stopErr := m.Stop(); stopErr != nil {
+				return append(Errors{startErr}, stopErr.(Errors)...)
+			}
+			return startErr
+		}
+		m.started = append(m.started, s)
+	}
+	return nil
+}
+
+// Stop stops every started subsystem in reverse order,
+// returning the aggregation of every stop error.
+func (m *Manager) Stop() error {
+	var errs Errors
+	for i := len(m.started) - 1; i >= 0; i-- {
+		if err := m.stopSubsystem(m.started[i]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	m.started = nil
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+func (m *Manager) stopSubsystem(s Subsystem) error {
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- s.Stop()
+	}()
+	tm := time.NewTimer(m.stopTimeout)
+	defer tm.Stop()
+
+	select {
+	case err := <-errCh:
+		if err != nil {
+			return fmt.Errorf("lifecycle: %s: %v", s.Name(), err)
+		}
+		return nil
+	case <-tm.C:
+		return fmt.Errorf("lifecycle: %s: stop timeout", s.Name())
+	}
+}
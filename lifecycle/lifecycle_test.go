@@ -0,0 +1,130 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package lifecycle
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+type eventRecorder struct {
+	mu     sync.Mutex
+	events []string
+}
+
+func (r *eventRecorder) record(event string) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.events = append(r.events, event)
+}
+
+func (r *eventRecorder) recorded() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return append([]string(nil), r.events...)
+}
+
+type fakeSubsystem struct {
+	name     string
+	events   *eventRecorder
+	startErr error
+	stopErr  error
+	stopWait time.Duration
+}
+
+func (f *fakeSubsystem) Name() string { return f.name }
+
+func (f *fakeSubsystem) Start() error {
+	if f.startErr != nil {
+		return f.startErr
+	}
+	f.events.record("start:" + f.name)
+	return nil
+}
+
+func (f *fakeSubsystem) Stop() error {
+	time.Sleep(f.stopWait)
+	f.events.record("stop:" + f.name)
+	return f.stopErr
+}
+
+func TestManager_Ordering(t *testing.T) {
+	events := &eventRecorder{}
+	m := New(time.Second)
+	m.Register(
+		&fakeSubsystem{name: "log", events: events},
+		&fakeSubsystem{name: "storage", events: events},
+		&fakeSubsystem{name: "server", events: events},
+	)
+	require.Nil(t, m.Start())
+	require.Nil(t, m.Stop())
+	require.Equal(t, []string{
+		"start:log", "start:storage", "start:server",
+		"stop:server", "stop:storage", "stop:log",
+	}, events.recorded())
+
+	// already stopped...
+	require.Nil(t, m.Stop())
+}
+
+func TestManager_StartFailure(t *testing.T) {
+	events := &eventRecorder{}
+	m := New(time.Second)
+	m.Register(
+		&fakeSubsystem{name: "log", events: events},
+		&fakeSubsystem{name: "storage", events: events, startErr: errors.New("unreachable")},
+		&fakeSubsystem{name: "server", events: events},
+	)
+	err := m.Start()
+	require.NotNil(t, err)
+	require.Equal(t, "lifecycle: storage: unreachable", err.Error())
+	require.Equal(t, []string{"start:log", "stop:log"}, events.recorded())
+}
+
+func TestManager_StopErrors(t *testing.T) {
+	events := &eventRecorder{}
+	m := New(time.Millisecond * 50)
+	m.Register(
+		&fakeSubsystem{name: "log", events: events},
+		&fakeSubsystem{name: "storage", events: events, stopErr: errors.New("broken pipe")},
+		&fakeSubsystem{name: "server", events: events, stopWait: time.Millisecond * 250},
+	)
+	require.Nil(t, m.Start())
+
+	err := m.Stop()
+	require.NotNil(t, err)
+	errs, ok := err.(Errors)
+	require.True(t, ok)
+	require.Equal(t, 2, len(errs))
+	require.Equal(t, "lifecycle: server: stop timeout", errs[0].Error())
+	require.Equal(t, "lifecycle: storage: broken pipe", errs[1].Error())
+	require.True(t, strings.Contains(err.Error(), "; "))
+
+	// timed out subsystem doesn't delay the rest of them
+	require.Equal(t, []string{"start:log", "start:storage", "start:server", "stop:storage", "stop:log"}, events.recorded())
+}
+
+func TestManager_FuncSubsystem(t *testing.T) {
+	var started, stopped bool
+	m := New(0)
+	m.Register(NewSubsystem("func", func() error {
+		started = true
+		return nil
+	}, func() error {
+		stopped = true
+		return nil
+	}), NewSubsystem("nop", nil, nil))
+
+	require.Nil(t, m.Start())
+	require.True(t, started)
+	require.Nil(t, m.Stop())
+	require.True(t, stopped)
+}
@@ -0,0 +1,126 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package log
+
+import (
+	"hash/fnv"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+)
+
+const (
+	limitedShards   = 32
+	limitedBurst    = 20
+	limitedInterval = time.Second
+)
+
+// limiter caps the number of messages logged for a given key within every
+// interval, sharding keys so that concurrent log sites barely contend.
+type limiter struct {
+	burst    int
+	interval time.Duration
+	now      func() time.Time
+	shards   [limitedShards]limiterShard
+}
+
+type limiterShard struct {
+	mu      sync.Mutex
+	windows map[string]*limiterWindow
+}
+
+type limiterWindow struct {
+	start      time.Time
+	count      int
+	suppressed int
+}
+
+func newLimiter(burst int, interval time.Duration) *limiter {
+	lim := &limiter{burst: burst, interval: interval, now: time.Now}
+	for i := range lim.shards {
+		lim.shards[i].windows = make(map[string]*limiterWindow)
+	}
+	return lim
+}
+
+// allow reports whether a message keyed by key can be logged, along with
+// the number of messages suppressed during the previous interval whenever
+// this is the first message logged in a new one.
+func (lim *limiter) allow(key string) (ok bool, suppressed int) {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	shard := &lim.shards[h.Sum32()%limitedShards]
+
+	now := lim.now()
+	shard.mu.Lock()
+	defer shard.mu.Unlock()
+
+	w := shard.windows[key]
+	if w == nil {
+		w = &limiterWindow{start: now}
+		shard.windows[key] = w
+	}
+	if now.Sub(w.start) >= lim.interval {
+		suppressed = w.suppressed
+		*w = limiterWindow{start: now}
+	}
+	if w.count >= lim.burst {
+		w.suppressed++
+		return false, 0
+	}
+	w.count++
+	return true, suppressed
+}
+
+var defaultLimiter = newLimiter(limitedBurst, limitedInterval)
+
+// LimitedLogger logs messages at a capped rate.
+type LimitedLogger struct {
+	key string
+	lim *limiter
+}
+
+// Limited returns a logger emitting at most a few messages per second for key,
+// intended for log sites hit once per stanza or stream. Suppressed messages
+// get summarized along with the first message logged once allowed again.
+//
+// key is expected to identify a log site, not a stream or entity.
+func Limited(key string) LimitedLogger {
+	return LimitedLogger{key: key, lim: defaultLimiter}
+}
+
+// Debugf logs a rate limited 'debug' message.
+func (ll LimitedLogger) Debugf(format string, args ...interface{}) {
+	if inst := instance(); inst != nil && inst.level <= config.DebugLevel {
+		ll.writeLog(inst, getCallerInfo(), format, config.DebugLevel, args...)
+	}
+}
+
+// Infof logs a rate limited 'info' message.
+func (ll LimitedLogger) Infof(format string, args ...interface{}) {
+	if inst := instance(); inst != nil && inst.level <= config.InfoLevel {
+		ll.writeLog(inst, getCallerInfo(), format, config.InfoLevel, args...)
+	}
+}
+
+// Warnf logs a rate limited 'warning' message.
+func (ll LimitedLogger) Warnf(format string, args ...interface{}) {
+	if inst := instance(); inst != nil && inst.level <= config.WarningLevel {
+		ll.writeLog(inst, getCallerInfo(), format, config.WarningLevel, args...)
+	}
+}
+
+func (ll LimitedLogger) writeLog(inst *Logger, ci callerInfo, format string, level config.LogLevel, args ...interface{}) {
+	ok, suppressed := ll.lim.allow(ll.key)
+	if !ok {
+		return
+	}
+	if suppressed > 0 {
+		inst.writeLog(ci.filename, ci.line, "%s: suppressed %d similar messages", level, true, ll.key, suppressed)
+	}
+	inst.writeLog(ci.filename, ci.line, format, level, true, args...)
+}
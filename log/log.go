@@ -38,7 +38,7 @@ type Logger struct {
 	errWriter io.Writer
 	f         *os.File
 	recCh     chan record
-	closeCh   chan bool
+	closeCh   chan chan bool
 }
 
 func newLogger(cfg *config.Logger, outWriter io.Writer, errWriter io.Writer) (*Logger, error) {
@@ -59,7 +59,7 @@ func newLogger(cfg *config.Logger, outWriter io.Writer, errWriter io.Writer) (*L
 		l.f = f
 	}
 	l.recCh = make(chan record, logChanBufferSize)
-	l.closeCh = make(chan bool)
+	l.closeCh = make(chan chan bool)
 	go l.loop()
 	return l, nil
 }
@@ -84,14 +84,16 @@ func instance() *Logger {
 	return inst
 }
 
-// Shutdown shuts down log sub system.
-// This method should be used only for testing purposes.
+// Shutdown shuts down log sub system,
+// flushing any pending log record.
 func Shutdown() {
 	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
 		instMu.Lock()
 		defer instMu.Unlock()
 
-		inst.closeCh <- true
+		ch := make(chan bool)
+		inst.closeCh <- ch
+		<-ch // wait until flushed...
 		inst = nil
 	}
 }
@@ -186,36 +188,50 @@ func (l *Logger) loop() {
 	for {
 		select {
 		case rec := <-l.recCh:
-			t := time.Now()
-			tm := t.Format("2006-01-02 15:04:05")
+			l.writeRecord(&rec)
 
-			glyph := logLevelGlyph(rec.level)
-			abbr := logLevelAbbreviation(rec.level)
-			line := fmt.Sprintf("%s %s [%s] %s:%d - %s\n", tm, glyph, abbr, rec.file, rec.line, rec.log)
-
-			if l.f != nil {
-				l.f.WriteString(line)
-			}
-			switch rec.level {
-			case config.DebugLevel, config.WarningLevel, config.InfoLevel:
-				fmt.Fprintf(l.outWriter, line)
-			case config.ErrorLevel:
-				fmt.Fprintf(l.errWriter, line)
-			case config.FatalLevel:
-				fmt.Fprintf(l.errWriter, line)
-				exitHandler()
+		case ch := <-l.closeCh:
+			// flush pending records before closing
+			for pending := true; pending; {
+				select {
+				case rec := <-l.recCh:
+					l.writeRecord(&rec)
+				default:
+					pending = false
+				}
 			}
-			close(rec.continueCh)
-
-		case <-l.closeCh:
 			if l.f != nil {
 				l.f.Close()
 			}
+			close(ch)
 			return
 		}
 	}
 }
 
+func (l *Logger) writeRecord(rec *record) {
+	t := time.Now()
+	tm := t.Format("2006-01-02 15:04:05")
+
+	glyph := logLevelGlyph(rec.level)
+	abbr := logLevelAbbreviation(rec.level)
+	line := fmt.Sprintf("%s %s [%s] %s:%d - %s\n", tm, glyph, abbr, rec.file, rec.line, rec.log)
+
+	if l.f != nil {
+		l.f.WriteString(line)
+	}
+	switch rec.level {
+	case config.DebugLevel, config.WarningLevel, config.InfoLevel:
+		fmt.Fprintf(l.outWriter, line)
+	case config.ErrorLevel:
+		fmt.Fprintf(l.errWriter, line)
+	case config.FatalLevel:
+		fmt.Fprintf(l.errWriter, line)
+		exitHandler()
+	}
+	close(rec.continueCh)
+}
+
 func getCallerInfo() callerInfo {
 	_, file, ln, ok := runtime.Caller(2)
 	if !ok {
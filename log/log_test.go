@@ -200,3 +200,89 @@ func TestLogFile(t *testing.T) {
 	}()
 	<-continueCh
 }
+
+func TestLogFlushOnShutdown(t *testing.T) {
+	logPath := "../testdata/log_flush.log"
+
+	Initialize(&config.Logger{Level: config.DebugLevel, LogPath: logPath})
+	defer os.Remove(logPath)
+
+	instance().outWriter = ioutil.Discard
+	instance().errWriter = ioutil.Discard
+
+	for i := 0; i < 100; i++ {
+		Infof("pending log!")
+	}
+	Errorf("last log!")
+	Shutdown()
+
+	b, _ := ioutil.ReadFile(logPath)
+	l := string(b)
+	require.Equal(t, 100, strings.Count(l, "pending log!"))
+	require.True(t, strings.Contains(l, "last log!"))
+}
+
+func TestLimiter(t *testing.T) {
+	lim := newLimiter(2, time.Second)
+	now := time.Now()
+	lim.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		ok, suppressed := lim.allow("ping")
+		require.True(t, ok)
+		require.Equal(t, 0, suppressed)
+	}
+	for i := 0; i < 3; i++ {
+		ok, _ := lim.allow("ping")
+		require.False(t, ok)
+	}
+	// keys are limited independently
+	ok, _ := lim.allow("stanza")
+	require.True(t, ok)
+
+	// next interval reports suppressed messages once
+	now = now.Add(time.Second)
+	ok, suppressed := lim.allow("ping")
+	require.True(t, ok)
+	require.Equal(t, 3, suppressed)
+	ok, suppressed = lim.allow("ping")
+	require.True(t, ok)
+	require.Equal(t, 0, suppressed)
+}
+
+func TestLimitedLog(t *testing.T) {
+	Initialize(&config.Logger{Level: config.InfoLevel})
+	defer Shutdown()
+
+	lw := newTestLogWriter()
+	instance().outWriter = lw
+
+	lim := newLimiter(1, time.Second)
+	now := time.Now()
+	lim.now = func() time.Time { return now }
+	ll := LimitedLogger{key: "ping", lim: lim}
+
+	fetchLog := func() string {
+		select {
+		case l := <-lw.C:
+			return l
+		case <-time.After(time.Millisecond * 200):
+			require.Fail(t, "log fetch timeout")
+		}
+		return ""
+	}
+	ll.Infof("ping 1")
+	require.True(t, strings.Contains(fetchLog(), "ping 1"))
+
+	ll.Infof("ping 2")
+	ll.Infof("ping 3")
+	ll.Debugf("filtered by level")
+
+	now = now.Add(time.Second)
+	ll.Infof("ping 4")
+	l := fetchLog()
+	require.True(t, strings.Contains(l, "[INF]"))
+	require.True(t, strings.Contains(l, "ping: suppressed 2 similar messages"))
+	require.True(t, strings.Contains(l, "log_test:"))
+	require.True(t, strings.Contains(fetchLog(), "ping 4"))
+}
@@ -8,16 +8,29 @@ package main
 import (
 	"flag"
 	"fmt"
+	"net/http"
 	"os"
+	"os/signal"
 	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 
-	"github.com/ortuman/jackal/stream/c2s"
-
+	"github.com/go-redis/redis"
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/denylist"
+	"github.com/ortuman/jackal/featureflags"
+	"github.com/ortuman/jackal/lifecycle"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/rostersync"
 	"github.com/ortuman/jackal/server"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/faulty"
+	"github.com/ortuman/jackal/storage/negcache"
+	"github.com/ortuman/jackal/storage/rediscache"
+	"github.com/ortuman/jackal/storage/timed"
+	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/version"
 )
 
@@ -30,8 +43,12 @@ var logoStr = []string{
 	`   \______|    \/     \/     \/     \/      `,
 }
 
+const subsystemStopTimeout = time.Second * 10
+
 const usageStr = `
 Usage: jackal [options]
+       jackal import [options] <file>...
+       jackal rotate-key [options]
 
 Server Options:
     -c, --config <file>    Configuration file path
@@ -41,6 +58,14 @@ Common Options:
 `
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "import" {
+		runImport(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "rotate-key" {
+		runRotateKey(os.Args[2:])
+		return
+	}
 	var configFile string
 	var showVersion bool
 	var showUsage bool
@@ -82,25 +107,161 @@ func main() {
 		return
 	}
 
-	// initialize subsystems
-	log.Initialize(&cfg.Logger)
+	// initialize subsystems in dependency order
+	var metricsSrv *http.Server
+	lc := lifecycle.New(subsystemStopTimeout)
+	lc.Register(
+		lifecycle.NewSubsystem("log", func() error {
+			log.Initialize(&cfg.Logger)
+			return nil
+		}, func() error {
+			log.Shutdown()
+			return nil
+		}),
+		lifecycle.NewSubsystem("storage", func() error {
+			storage.Initialize(&cfg.Storage)
+
+			// cache encrypted payloads, so that they're never kept in clear by Redis
+			if err := decorateRedisCache(&cfg.Storage); err != nil {
+				return err
+			}
+			if err := decorateEncryptedStorage(&cfg.Storage); err != nil {
+				return err
+			}
+
+			// fault injection stays inert until enabled through debug port
+			storage.Decorate(func(s storage.Storage) storage.Storage {
+				fs := faulty.New(s)
+				http.Handle("/debug/storage/faults", fs)
+				return fs
+			})
 
-	storage.Initialize(&cfg.Storage)
+			if nc := cfg.Storage.NegativeCache; nc != nil {
+				storage.Decorate(func(s storage.Storage) storage.Storage {
+					return negcache.New(s, nc.Size, time.Duration(nc.TTL)*time.Second)
+				})
+			}
+			storage.Decorate(func(s storage.Storage) storage.Storage {
+				return timed.New(s, stats.Default())
+			})
+			return nil
+		}, func() error {
+			storage.Shutdown()
+			return nil
+		}),
+		lifecycle.NewSubsystem("c2s", func() error {
+			c2s.Initialize(&cfg.C2S)
+			return nil
+		}, func() error {
+			c2s.Shutdown()
+			return nil
+		}),
+		lifecycle.NewSubsystem("feature_flags", func() error {
+			featureflags.Initialize(&cfg.FeatureFlags)
+			return nil
+		}, func() error {
+			featureflags.Shutdown()
+			return nil
+		}),
+		lifecycle.NewSubsystem("roster_sync", func() error {
+			rostersync.Initialize(&cfg.RosterSync)
+			return nil
+		}, func() error {
+			rostersync.Shutdown()
+			return nil
+		}),
+		lifecycle.NewSubsystem("metrics", func() error {
+			if cfg.Metrics.Port == 0 {
+				return nil
+			}
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", stats.PrometheusHandler(stats.Default()))
+			metricsSrv = &http.Server{
+				Addr:    fmt.Sprintf("%s:%d", cfg.Metrics.BindAddress, cfg.Metrics.Port),
+				Handler: mux,
+			}
+			go func() {
+				if err := metricsSrv.ListenAndServe(); err != http.ErrServerClosed {
+					log.Errorf("metrics: %v", err)
+				}
+			}()
+			return nil
+		}, func() error {
+			if metricsSrv == nil {
+				return nil
+			}
+			return metricsSrv.Close()
+		}),
+		lifecycle.NewSubsystem("servers", func() error {
+			// start serving...
+			for i := range logoStr {
+				log.Infof("%s", logoStr[i])
+			}
+			log.Infof("")
+			log.Infof("jackal %v\n", version.ApplicationVersion)
 
-	c2s.Initialize(&cfg.C2S)
+			go server.Initialize(cfg.Servers, cfg.Debug.Port)
+			return nil
+		}, func() error {
+			server.Shutdown()
+			return nil
+		}),
+	)
+	if err := lc.Start(); err != nil {
+		fmt.Fprintf(os.Stderr, "jackal: %v\n", err)
+		return
+	}
 
 	// create PID file
 	if err := createPIDFile(cfg.PIDFile); err != nil {
 		log.Warnf("%v", err)
 	}
-	// start serving...
-	for i := range logoStr {
-		log.Infof("%s", logoStr[i])
+
+	// wait until termination signal...
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	sig := <-sigCh
+	for sig == syscall.SIGHUP {
+		log.Infof("received %v signal... reloading configuration", sig)
+		denylist.ReloadAll()
+
+		var reloaded config.Config
+		if err := config.FromFile(configFile, &reloaded); err != nil {
+			log.Errorf("couldn't reload configuration: %v", err)
+		} else {
+			server.Reload(reloaded.Servers)
+		}
+		sig = <-sigCh
 	}
-	log.Infof("")
-	log.Infof("jackal %v\n", version.ApplicationVersion)
 
-	server.Initialize(cfg.Servers, cfg.Debug.Port)
+	log.Infof("received %v signal... shutting down", sig)
+	if err := lc.Stop(); err != nil {
+		fmt.Fprintf(os.Stderr, "jackal: %v\n", err)
+	}
+}
+
+func decorateRedisCache(cfg *config.Storage) error {
+	if cfg.Redis == nil || cfg.Redis.Mode != config.RedisCache {
+		return nil
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Redis.Address,
+		Password: cfg.Redis.Password,
+		DB:       cfg.Redis.Database,
+	})
+	if err := client.Ping().Err(); err != nil {
+		client.Close()
+		return err
+	}
+	ttls := rediscache.TTLs{
+		User:   time.Duration(cfg.Redis.TTL.User) * time.Second,
+		Roster: time.Duration(cfg.Redis.TTL.Roster) * time.Second,
+		VCard:  time.Duration(cfg.Redis.TTL.VCard) * time.Second,
+	}
+	storage.Decorate(func(s storage.Storage) storage.Storage {
+		return rediscache.New(s, client, cfg.Tenant, ttls)
+	})
+	return nil
 }
 
 func createPIDFile(pidFile string) error {
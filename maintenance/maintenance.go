@@ -0,0 +1,137 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package maintenance implements the server maintenance mode, during which
+// new logins and registrations are refused while already established
+// sessions keep working.
+package maintenance
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+)
+
+// DefaultReason is the reason reported when maintenance mode
+// has been enabled without specifying any.
+const DefaultReason = "Service under maintenance"
+
+// Status represents current maintenance mode status.
+type Status struct {
+	Enabled bool       `json:"enabled"`
+	Reason  string     `json:"reason,omitempty"`
+	Until   *time.Time `json:"until,omitempty"`
+}
+
+var (
+	mu     sync.RWMutex
+	status Status
+)
+
+// Enable enables maintenance mode, reporting reason to refused clients.
+// Maintenance mode is automatically disabled once until is reached,
+// or kept indefinitely if zero.
+func Enable(reason string, until time.Time) {
+	if len(reason) == 0 {
+		reason = DefaultReason
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	status = Status{Enabled: true, Reason: reason}
+	if !until.IsZero() {
+		status.Until = &until
+		log.Infof("maintenance mode enabled until %s: %s", until.Format(time.RFC3339), reason)
+	} else {
+		log.Infof("maintenance mode enabled: %s", reason)
+	}
+}
+
+// Disable disables maintenance mode.
+func Disable() {
+	mu.Lock()
+	defer mu.Unlock()
+	if status.Enabled {
+		status = Status{}
+		log.Infof("maintenance mode disabled")
+	}
+}
+
+// Current returns current maintenance mode status.
+func Current() Status {
+	mu.RLock()
+	st := status
+	mu.RUnlock()
+	if st.Enabled && st.Until != nil && !time.Now().Before(*st.Until) {
+		mu.Lock()
+		if status.Until == st.Until {
+			status = Status{}
+			log.Infof("maintenance mode expired")
+		}
+		mu.Unlock()
+		return Status{}
+	}
+	return st
+}
+
+// Active returns whether or not maintenance mode is enabled,
+// along with the reason to be reported to refused clients.
+func Active() (bool, string) {
+	st := Current()
+	return st.Enabled, st.Reason
+}
+
+type enableRequest struct {
+	Reason   string     `json:"reason"`
+	Until    *time.Time `json:"until"`
+	Duration string     `json:"duration"`
+}
+
+// ServeHTTP serves maintenance mode admin API.
+//
+// GET returns current status, PUT enables maintenance mode from a
+// {"reason": string, "until": RFC 3339 time} or {"reason": string,
+// "duration": string} body and DELETE disables it.
+func ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		st := Current()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&st)
+
+	case http.MethodPut:
+		var req enableRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var until time.Time
+		switch {
+		case req.Until != nil && len(req.Duration) > 0:
+			http.Error(w, "until and duration are mutually exclusive", http.StatusBadRequest)
+			return
+		case req.Until != nil:
+			until = *req.Until
+		case len(req.Duration) > 0:
+			d, err := time.ParseDuration(req.Duration)
+			if err != nil || d <= 0 {
+				http.Error(w, "invalid duration", http.StatusBadRequest)
+				return
+			}
+			until = time.Now().Add(d)
+		}
+		Enable(req.Reason, until)
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		Disable()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,97 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package maintenance
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMaintenance_Toggle(t *testing.T) {
+	defer Disable()
+
+	active, _ := Active()
+	require.False(t, active)
+
+	Enable("", time.Time{})
+	active, reason := Active()
+	require.True(t, active)
+	require.Equal(t, DefaultReason, reason)
+
+	Enable("Storage migration", time.Time{})
+	_, reason = Active()
+	require.Equal(t, "Storage migration", reason)
+
+	Disable()
+	active, _ = Active()
+	require.False(t, active)
+}
+
+func TestMaintenance_Expiration(t *testing.T) {
+	defer Disable()
+
+	Enable("Storage migration", time.Now().Add(time.Millisecond*50))
+	active, _ := Active()
+	require.True(t, active)
+	require.NotNil(t, Current().Until)
+
+	time.Sleep(time.Millisecond * 60)
+	active, _ = Active()
+	require.False(t, active)
+	require.Equal(t, Status{}, Current())
+}
+
+func TestMaintenance_ServeHTTP(t *testing.T) {
+	defer Disable()
+
+	srv := httptest.NewServer(http.HandlerFunc(ServeHTTP))
+	defer srv.Close()
+
+	do := func(method, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+	resp := do(http.MethodPut, `{"duration": "soon"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(http.MethodPut, `{"duration": "1h", "until": "2018-08-01T10:00:00Z"}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPut, `{"reason": "Storage migration", "duration": "1h"}`)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+
+	var st Status
+	resp = do(http.MethodGet, "")
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&st))
+	resp.Body.Close()
+	require.True(t, st.Enabled)
+	require.Equal(t, "Storage migration", st.Reason)
+	require.NotNil(t, st.Until)
+	require.True(t, st.Until.After(time.Now().Add(time.Minute*59)))
+
+	// past end time
+	resp = do(http.MethodPut, `{"reason": "Storage migration", "until": "2018-08-01T10:00:00Z"}`)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	active, _ := Active()
+	require.False(t, active)
+
+	resp = do(http.MethodPut, `{}`)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	active, _ = Active()
+	require.True(t, active)
+
+	resp = do(http.MethodDelete, "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	active, _ = Active()
+	require.False(t, active)
+}
@@ -0,0 +1,121 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import "sync"
+
+// actor sequentially runs module tasks on its own goroutine.
+//
+// Once done, pending and later submitted tasks are discarded, and done doesn't
+// return until the running task (if any) has completed, so that no module task
+// reaches the stream afterwards. done is idempotent and safe to call concurrently
+// with task submission.
+type actor struct {
+	taskCh   chan func()
+	doneCh   chan struct{}
+	exitCh   chan struct{}
+	doneOnce sync.Once
+}
+
+// newActor returns a running actor. onExit, if not nil, is invoked
+// by the actor goroutine right before exiting.
+func newActor(onExit func()) *actor {
+	a := &actor{
+		taskCh: make(chan func(), moduleMailboxSize),
+		doneCh: make(chan struct{}),
+		exitCh: make(chan struct{}),
+	}
+	go a.loop(onExit)
+	return a
+}
+
+// run submits a task, discarding it if the actor is done.
+func (a *actor) run(f func()) {
+	select {
+	case <-a.doneCh:
+		return
+	default:
+	}
+	select {
+	case a.taskCh <- f:
+	case <-a.doneCh:
+	}
+}
+
+// runAndWait submits a task and waits for its completion.
+// It returns false if the task has been discarded.
+func (a *actor) runAndWait(f func()) bool {
+	continueCh := make(chan struct{})
+	a.run(func() {
+		f()
+		close(continueCh)
+	})
+	select {
+	case <-continueCh:
+		return true
+	case <-a.exitCh:
+		return false
+	}
+}
+
+// done stops the actor, waiting until its goroutine has exited.
+func (a *actor) done() {
+	a.doneOnce.Do(func() { close(a.doneCh) })
+	<-a.exitCh
+}
+
+func (a *actor) loop(onExit func()) {
+	defer close(a.exitCh)
+	for {
+		select {
+		case <-a.doneCh:
+			if onExit != nil {
+				onExit()
+			}
+			return
+		default:
+		}
+		select {
+		case f := <-a.taskCh:
+			f()
+		case <-a.doneCh:
+		}
+	}
+}
+
+// doneGuard tracks in-flight synchronous module handlers.
+//
+// Handlers run concurrently with each other, while done waits for
+// in-flight ones to complete, rejecting any later.
+type doneGuard struct {
+	mu     sync.RWMutex
+	isDone bool
+}
+
+// enter returns false if guard is done. Otherwise the caller
+// must call leave once the handler has completed.
+func (g *doneGuard) enter() bool {
+	g.mu.RLock()
+	if g.isDone {
+		g.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (g *doneGuard) leave() {
+	g.mu.RUnlock()
+}
+
+// done marks the guard as done, waiting for in-flight handlers.
+// It returns true only the first time it's called.
+func (g *doneGuard) done() bool {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	first := !g.isDone
+	g.isDone = true
+	return first
+}
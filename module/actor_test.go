@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestActor(t *testing.T) {
+	var exited int32
+	a := newActor(func() { atomic.AddInt32(&exited, 1) })
+
+	var ran int32
+	require.True(t, a.runAndWait(func() { atomic.AddInt32(&ran, 1) }))
+	require.Equal(t, int32(1), atomic.LoadInt32(&ran))
+
+	a.done()
+	a.done() // idempotent
+	require.Equal(t, int32(1), atomic.LoadInt32(&exited))
+
+	// tasks submitted once done are discarded
+	a.run(func() { atomic.AddInt32(&ran, 1) })
+	require.False(t, a.runAndWait(func() { atomic.AddInt32(&ran, 1) }))
+	require.Equal(t, int32(1), atomic.LoadInt32(&ran))
+}
+
+func TestDoneGuard(t *testing.T) {
+	var g doneGuard
+	require.True(t, g.enter())
+
+	doneCh := make(chan bool)
+	go func() { doneCh <- g.done() }()
+
+	// done waits for in-flight handlers
+	select {
+	case <-doneCh:
+		require.Fail(t, "done returned with an in-flight handler")
+	case <-time.After(time.Millisecond * 50):
+	}
+	g.leave()
+	require.True(t, <-doneCh)
+
+	require.False(t, g.enter())
+	require.False(t, g.done())
+}
+
+func TestModules_ConcurrentDone(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewRoster(strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewOffline(&config.ModOffline{QueueSize: 16}, strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewFooter(&config.ModFooter{}, strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewForwarding(strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewSpam(&config.ModSpam{}, strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewStats(strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewTracking(&config.ModTracking{}, strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewXEPDiscoInfo(strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewXEPPrivateStorage(strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewXEPVCard(strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module {
+		return NewXEPRegister(&config.ModRegistration{AllowRegistration: true}, testHasher, strm)
+	})
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewXEPVersion(&config.ModVersion{}, strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewXEPVacation(&config.ModVacation{}, strm) })
+	testConcurrentDone(t, func(strm c2s.Stream) Module { return NewXEPPing(&config.ModPing{}, strm) })
+}
+
+// doneStream is a mocked stream counting elements sent once its module is done.
+type doneStream struct {
+	*c2s.MockStream
+	done int32
+	late int32
+}
+
+func (s *doneStream) SendElement(element xml.Element) {
+	if atomic.LoadInt32(&s.done) == 1 {
+		atomic.AddInt32(&s.late, 1)
+	}
+}
+
+// testConcurrentDone hammers a module with IQs addressed to its associated
+// namespaces while concurrently calling Done, checking that Done is idempotent
+// and that nothing reaches the stream once it has returned.
+func testConcurrentDone(t *testing.T, newModule func(strm c2s.Stream) Module) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	strm := &doneStream{MockStream: c2s.NewMockStream(uuid.New(), j)}
+	strm.SetAuthenticated(true)
+
+	mod := newModule(strm)
+	iqHandler, _ := mod.(IQHandler)
+
+	var iqs []*xml.IQ
+	if iqHandler != nil {
+		for _, ns := range mod.AssociatedNamespaces() {
+			for _, name := range []string{"query", "ping", "vCard"} {
+				iq := xml.NewIQType(uuid.New(), xml.GetType)
+				iq.SetFromJID(j)
+				iq.SetToJID(j.ToBareJID())
+				iq.AppendElement(xml.NewElementNamespace(name, ns))
+				if iqHandler.MatchesIQ(iq) {
+					iqs = append(iqs, iq)
+				}
+			}
+		}
+	}
+	stopCh := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stopCh:
+					return
+				default:
+				}
+				for _, iq := range iqs {
+					iqHandler.ProcessIQ(iq)
+				}
+			}
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+
+	var doneWg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		doneWg.Add(1)
+		go func() {
+			defer doneWg.Done()
+			mod.Done()
+		}()
+	}
+	doneWg.Wait()
+	atomic.StoreInt32(&strm.done, 1)
+
+	time.Sleep(time.Millisecond * 10)
+	close(stopCh)
+	wg.Wait()
+
+	mod.Done()
+	require.Equal(t, int32(0), atomic.LoadInt32(&strm.late), "%T sent elements after done", mod)
+}
@@ -0,0 +1,122 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"sort"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// Chain represents an ordered set of stream modules.
+type Chain struct {
+	modules []Module
+	enabled func(flag string) bool
+}
+
+// NewChain returns a module chain sorted by priority.
+// Modules sharing the same priority keep their relative order.
+func NewChain(modules ...Module) *Chain {
+	c := &Chain{modules: append([]Module{}, modules...)}
+	sort.SliceStable(c.modules, func(i, j int) bool {
+		return modulePriority(c.modules[i]) < modulePriority(c.modules[j])
+	})
+	return c
+}
+
+// SetFeatureFlags sets the function used to evaluate whether or not
+// a FeatureFlagged module is enabled. Flags are evaluated on every use,
+// so that modules can be enabled or disabled during stream lifetime.
+func (c *Chain) SetFeatureFlags(enabled func(flag string) bool) {
+	c.enabled = enabled
+}
+
+// Modules returns chain modules in processing order.
+func (c *Chain) Modules() []Module {
+	return c.modules
+}
+
+// MatchingIQHandler returns the first IQ handler
+// matching iq, or nil if none of them does.
+func (c *Chain) MatchingIQHandler(iq *xml.IQ) IQHandler {
+	for _, m := range c.modules {
+		if h, ok := m.(IQHandler); ok && c.Enabled(m) && h.MatchesIQ(iq) {
+			return h
+		}
+	}
+	return nil
+}
+
+// InterceptMessage passes message through every message interceptor
+// until one of them consumes it, returning whether or not it was consumed.
+func (c *Chain) InterceptMessage(message *xml.Message) bool {
+	for _, m := range c.modules {
+		if i, ok := m.(MessageInterceptor); ok && c.Enabled(m) && i.InterceptMessage(message) {
+			return true
+		}
+	}
+	return false
+}
+
+// InterceptPresence passes presence through every presence interceptor
+// until one of them consumes it, returning whether or not it was consumed.
+func (c *Chain) InterceptPresence(presence *xml.Presence) bool {
+	for _, m := range c.modules {
+		if i, ok := m.(PresenceInterceptor); ok && c.Enabled(m) && i.InterceptPresence(presence) {
+			return true
+		}
+	}
+	return false
+}
+
+// StreamFeatures returns the stream features offered by chain modules.
+func (c *Chain) StreamFeatures() []xml.Element {
+	var features []xml.Element
+	for _, m := range c.modules {
+		if p, ok := m.(StreamFeatureProvider); ok && c.Enabled(m) {
+			features = append(features, p.StreamFeatures()...)
+		}
+	}
+	return features
+}
+
+// DiscoFeatures returns the disco info features supported by chain modules.
+func (c *Chain) DiscoFeatures() []string {
+	var features []string
+	for _, m := range c.modules {
+		if !c.Enabled(m) {
+			continue
+		}
+		if p, ok := m.(DiscoProvider); ok {
+			features = append(features, p.DiscoFeatures()...)
+		} else {
+			features = append(features, m.AssociatedNamespaces()...)
+		}
+	}
+	return features
+}
+
+// Done signals stream termination to every chain module.
+func (c *Chain) Done() {
+	for _, m := range c.modules {
+		m.Done()
+	}
+}
+
+// Enabled returns whether or not m is currently enabled according to its feature flag.
+func (c *Chain) Enabled(m Module) bool {
+	if f, ok := m.(FeatureFlagged); ok && c.enabled != nil {
+		return c.enabled(f.FeatureFlag())
+	}
+	return true
+}
+
+func modulePriority(m Module) int {
+	if p, ok := m.(Prioritized); ok {
+		return p.Priority()
+	}
+	return DefaultPriority
+}
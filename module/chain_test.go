@@ -0,0 +1,182 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type fakeModule struct {
+	name     string
+	priority int
+	consume  bool
+	calls    *[]string
+}
+
+func (m *fakeModule) AssociatedNamespaces() []string { return []string{"urn:fake:" + m.name} }
+func (m *fakeModule) Done()                          { m.fire("done") }
+func (m *fakeModule) Priority() int                  { return m.priority }
+func (m *fakeModule) MatchesIQ(iq *xml.IQ) bool      { return iq.FindElement(m.name) != nil }
+func (m *fakeModule) ProcessIQ(iq *xml.IQ)           { m.fire("iq") }
+
+func (m *fakeModule) InterceptMessage(message *xml.Message) bool {
+	m.fire("message")
+	return m.consume
+}
+
+func (m *fakeModule) InterceptPresence(presence *xml.Presence) bool {
+	m.fire("presence")
+	return m.consume
+}
+
+func (m *fakeModule) StreamFeatures() []xml.Element {
+	m.fire("features")
+	return []xml.Element{xml.NewElementName(m.name)}
+}
+
+func (m *fakeModule) DiscoFeatures() []string {
+	m.fire("disco")
+	return []string{"urn:fake:disco:" + m.name}
+}
+
+func (m *fakeModule) fire(hook string) {
+	*m.calls = append(*m.calls, m.name+":"+hook)
+}
+
+// v1Module implements the bare module interface.
+type v1Module struct{ done bool }
+
+func (m *v1Module) AssociatedNamespaces() []string { return []string{"urn:fake:v1"} }
+func (m *v1Module) Done()                          { m.done = true }
+
+func TestChain_Ordering(t *testing.T) {
+	var calls []string
+	a := &fakeModule{name: "a", priority: LowPriority, calls: &calls}
+	b := &fakeModule{name: "b", priority: DefaultPriority, calls: &calls}
+	c := &fakeModule{name: "c", priority: DefaultPriority, calls: &calls}
+	d := &fakeModule{name: "d", priority: HighPriority, calls: &calls}
+	v1 := &v1Module{}
+
+	ch := NewChain(a, b, v1, c, d)
+	require.Equal(t, []Module{d, b, v1, c, a}, ch.Modules())
+}
+
+func TestChain_Hooks(t *testing.T) {
+	var calls []string
+	a := &fakeModule{name: "a", priority: LowPriority, calls: &calls}
+	b := &fakeModule{name: "b", calls: &calls}
+	v1 := &v1Module{}
+	ch := NewChain(a, v1, b)
+
+	// IQ handlers
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementName("a"))
+	h := ch.MatchingIQHandler(iq)
+	require.Equal(t, a, h)
+	h.ProcessIQ(iq)
+	require.Equal(t, []string{"a:iq"}, calls)
+
+	iq = xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementName("z"))
+	require.Nil(t, ch.MatchingIQHandler(iq))
+
+	// interceptors
+	calls = nil
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	require.False(t, ch.InterceptMessage(xml.NewMessageType(uuid.New(), xml.ChatType)))
+	require.False(t, ch.InterceptPresence(xml.NewPresence(j, j, xml.AvailableType)))
+	require.Equal(t, []string{"b:message", "a:message", "b:presence", "a:presence"}, calls)
+
+	calls = nil
+	b.consume = true
+	require.True(t, ch.InterceptMessage(xml.NewMessageType(uuid.New(), xml.ChatType)))
+	require.True(t, ch.InterceptPresence(xml.NewPresence(j, j, xml.AvailableType)))
+	require.Equal(t, []string{"b:message", "b:presence"}, calls)
+
+	// stream features
+	calls = nil
+	features := ch.StreamFeatures()
+	require.Equal(t, 2, len(features))
+	require.Equal(t, "b", features[0].Name())
+	require.Equal(t, "a", features[1].Name())
+	require.Equal(t, []string{"b:features", "a:features"}, calls)
+
+	// disco features (v1 modules advertise their associated namespaces)
+	calls = nil
+	require.Equal(t, []string{"urn:fake:v1", "urn:fake:disco:b", "urn:fake:disco:a"}, ch.DiscoFeatures())
+	require.Equal(t, []string{"b:disco", "a:disco"}, calls)
+
+	// termination
+	calls = nil
+	ch.Done()
+	require.Equal(t, []string{"b:done", "a:done"}, calls)
+	require.True(t, v1.done)
+}
+
+// flaggedModule is a fake module gated by a feature flag.
+type flaggedModule struct{ fakeModule }
+
+func (m *flaggedModule) FeatureFlag() string { return "flag:" + m.name }
+
+func TestChain_FeatureFlags(t *testing.T) {
+	var calls []string
+	a := &fakeModule{name: "a", calls: &calls}
+	b := &flaggedModule{fakeModule{name: "b", consume: true, calls: &calls}}
+	ch := NewChain(a, b)
+
+	// flags are ignored until an evaluator is set
+	require.True(t, ch.Enabled(b))
+
+	enabled := false
+	ch.SetFeatureFlags(func(flag string) bool {
+		require.Equal(t, "flag:b", flag)
+		return enabled
+	})
+	require.True(t, ch.Enabled(a))
+	require.False(t, ch.Enabled(b))
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementName("b"))
+	require.Nil(t, ch.MatchingIQHandler(iq))
+	require.False(t, ch.InterceptMessage(xml.NewMessageType(uuid.New(), xml.ChatType)))
+	require.Equal(t, 1, len(ch.StreamFeatures()))
+	require.Equal(t, []string{"urn:fake:disco:a"}, ch.DiscoFeatures())
+	require.Equal(t, []string{"a:message", "a:features", "a:disco"}, calls)
+
+	// flags are evaluated on every use
+	enabled = true
+	require.Equal(t, b, ch.MatchingIQHandler(iq))
+	require.True(t, ch.InterceptMessage(xml.NewMessageType(uuid.New(), xml.ChatType)))
+	require.Equal(t, 2, len(ch.StreamFeatures()))
+	require.Equal(t, []string{"urn:fake:disco:a", "urn:fake:disco:b"}, ch.DiscoFeatures())
+}
+
+func TestChain_ReferenceModules(t *testing.T) {
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream("abcd", j)
+
+	ping := NewXEPPing(&config.ModPing{}, stm)
+	reg := NewXEPRegister(&config.ModRegistration{AllowRegistration: true, RequireSecured: true}, testHasher, stm)
+	ch := NewChain(reg, ping)
+	require.Equal(t, []Module{ping, reg}, ch.Modules())
+	require.Equal(t, []string{pingNamespace, registerNamespace}, ch.DiscoFeatures())
+
+	// register feature is offered over secured streams only
+	require.Equal(t, 0, len(ch.StreamFeatures()))
+	stm.SetSecured(true)
+	features := ch.StreamFeatures()
+	require.Equal(t, 1, len(features))
+	require.Equal(t, registerFeatureNamespace, features[0].Namespace())
+
+	stm.SetAuthenticated(true)
+	require.Equal(t, 0, len(ch.StreamFeatures()))
+}
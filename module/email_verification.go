@@ -0,0 +1,96 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+)
+
+// emailVerificationNamespace is used to confirm the email address
+// provided on registration by means of an emailed token.
+const emailVerificationNamespace = "urn:jackal:email-verification:0"
+
+const defaultEmailVerificationTokenTTL = 86400 // 1 day
+
+type emailVerificationToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// EmailVerification keeps track of issued email verification tokens,
+// shared across all registration modules.
+type EmailVerification struct {
+	mu     sync.Mutex
+	tokens map[string]emailVerificationToken
+	now    func() time.Time
+}
+
+// NewEmailVerification returns an empty email verification tracker.
+func NewEmailVerification() *EmailVerification {
+	return &EmailVerification{
+		tokens: make(map[string]emailVerificationToken),
+		now:    time.Now,
+	}
+}
+
+// emailVerification is the email verification tracker shared by every stream registration module.
+var emailVerification = NewEmailVerification()
+
+// Issue generates a new username verification token, invalidating any previous one.
+func (v *EmailVerification) Issue(cfg *config.EmailVerification, username string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ttl := cfg.TokenTTL
+	if ttl == 0 {
+		ttl = defaultEmailVerificationTokenTTL
+	}
+	token := hex.EncodeToString(b)
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+	v.tokens[username] = emailVerificationToken{
+		token:     token,
+		expiresAt: v.now().Add(time.Second * time.Duration(ttl)),
+	}
+	return token, nil
+}
+
+// Consume returns whether or not token is a valid username verification token.
+// Tokens can only be consumed once.
+func (v *EmailVerification) Consume(username, token string) bool {
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.tokens[username]
+	if !ok {
+		return false
+	}
+	if !v.now().Before(t.expiresAt) {
+		delete(v.tokens, username)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(t.token), []byte(strings.TrimSpace(token))) != 1 {
+		return false
+	}
+	delete(v.tokens, username)
+	return true
+}
+
+// isValidEmail returns whether or not addr is a bare email address.
+func isValidEmail(addr string) bool {
+	a, err := mail.ParseAddress(addr)
+	return err == nil && a.Address == addr && len(a.Name) == 0
+}
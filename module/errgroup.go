@@ -0,0 +1,43 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import "sync"
+
+// errGroup runs a collection of tasks concurrently, bounding
+// the number of in-flight goroutines to a fixed limit.
+type errGroup struct {
+	wg      sync.WaitGroup
+	sem     chan struct{}
+	errOnce sync.Once
+	err     error
+}
+
+func newErrGroup(limit int) *errGroup {
+	return &errGroup{sem: make(chan struct{}, limit)}
+}
+
+// Go runs f in a new goroutine as soon as a concurrency slot is available.
+func (g *errGroup) Go(f func() error) {
+	g.wg.Add(1)
+	g.sem <- struct{}{}
+	go func() {
+		defer func() {
+			<-g.sem
+			g.wg.Done()
+		}()
+		if err := f(); err != nil {
+			g.errOnce.Do(func() { g.err = err })
+		}
+	}()
+}
+
+// Wait blocks until every task has finished, returning
+// the first non-nil error (if any).
+func (g *errGroup) Wait() error {
+	g.wg.Wait()
+	return g.err
+}
@@ -0,0 +1,100 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const footerNamespace = "urn:jackal:footer:0"
+
+const footerSeparator = "\n\n"
+
+// ModFooter represents a message footer server stream module.
+// Messages with a body sent from a configured virtual host get the
+// footer text appended to every body whenever they cross any of its
+// boundaries, being marked so that the footer is never appended twice.
+type ModFooter struct {
+	footer *config.MessageFooter
+	strm   c2s.Stream
+}
+
+// NewFooter returns a message footer interceptor module.
+func NewFooter(config *config.ModFooter, strm c2s.Stream) *ModFooter {
+	f := &ModFooter{strm: strm}
+	for i := 0; i < len(config.Footers); i++ {
+		if config.Footers[i].Domain == strm.Domain() {
+			f.footer = &config.Footers[i]
+			break
+		}
+	}
+	return f
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with footer module.
+func (f *ModFooter) AssociatedNamespaces() []string {
+	return []string{footerNamespace}
+}
+
+// DiscoFeatures returns the disco info features supported
+// by footer module, none since it's transparent to clients.
+func (f *ModFooter) DiscoFeatures() []string {
+	return nil
+}
+
+// Priority returns footer module priority,
+// letting any other interceptor consume messages first.
+func (f *ModFooter) Priority() int {
+	return LowPriority
+}
+
+// Done signals stream termination.
+func (f *ModFooter) Done() {
+}
+
+// InterceptMessage appends configured footer to message bodies,
+// never consuming the message.
+func (f *ModFooter) InterceptMessage(message *xml.Message) bool {
+	if f.footer == nil || len(f.footer.Text) == 0 || !message.IsMessageWithBody() {
+		return false
+	}
+	if message.FindElementNamespace("footer", footerNamespace) != nil || !f.crossesBoundary(message.ToJID()) {
+		return false
+	}
+	elements := message.Elements()
+	message.ClearElements()
+	for _, elem := range elements {
+		if elem.Name() == "body" {
+			body := xml.NewElementFromElement(elem)
+			body.SetText(elem.Text() + footerSeparator + f.footer.Text)
+			elem = body
+		}
+		message.AppendElement(elem)
+	}
+	message.AppendElement(xml.NewElementNamespace("footer", footerNamespace))
+	return false
+}
+
+// StripFooterMarker removes any footer mark carried by a client submitted
+// message, so that clients can't prevent the footer from being appended.
+func StripFooterMarker(message *xml.Message) {
+	message.RemoveElementsNamespace("footer", footerNamespace)
+}
+
+func (f *ModFooter) crossesBoundary(to *xml.JID) bool {
+	for _, domain := range f.footer.Domains {
+		if domain == to.Domain() {
+			return true
+		}
+	}
+	if c2s.Instance().IsLocalDomain(to.Domain()) {
+		return f.footer.Local
+	}
+	return f.footer.Remote
+}
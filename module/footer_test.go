@@ -0,0 +1,162 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFooter_MultiLanguage(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im", "acme.org"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "example.net", "garden", true)
+
+	f := NewFooter(tUtilFooterConfig(), c2s.NewMockStream("abcd", j1))
+	defer f.Done()
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	msg.AppendElement(tUtilFooterBody("Hi", ""))
+	msg.AppendElement(tUtilFooterBody("Hola", "es"))
+	msg.AppendElement(xml.NewElementNamespace("active", "http://jabber.org/protocol/chatstates"))
+
+	require.False(t, f.InterceptMessage(msg))
+
+	bodies := msg.FindElements("body")
+	require.Equal(t, 2, len(bodies))
+	require.Equal(t, "Hi\n\nConfidential", bodies[0].Text())
+	require.Equal(t, "Hola\n\nConfidential", bodies[1].Text())
+	require.Equal(t, "es", bodies[1].Language())
+	require.NotNil(t, msg.FindElementNamespace("active", "http://jabber.org/protocol/chatstates"))
+	require.NotNil(t, msg.FindElementNamespace("footer", footerNamespace))
+
+	// never appended twice (e.g. retries)
+	require.False(t, f.InterceptMessage(msg))
+	require.Equal(t, "Hi\n\nConfidential", msg.FindElement("body").Text())
+	require.Equal(t, 1, len(msg.FindElementsNamespace("footer", footerNamespace)))
+}
+
+func TestFooter_Boundaries(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im", "acme.org"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("wile", "acme.org", "desert", true)
+	j4, _ := xml.NewJID("juliet", "acme.org", "garden", true)
+
+	f := NewFooter(tUtilFooterConfig(), c2s.NewMockStream("abcd", j1))
+
+	// local delivery disabled...
+	msg := tUtilFooterMessage(j1, j2)
+	f.InterceptMessage(msg)
+	require.Equal(t, "Hi", msg.FindElement("body").Text())
+
+	// configured recipient domain...
+	msg = tUtilFooterMessage(j1, j3)
+	f.InterceptMessage(msg)
+	require.Equal(t, "Hi\n\nConfidential", msg.FindElement("body").Text())
+
+	// bodyless message...
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j3)
+	f.InterceptMessage(msg)
+	require.Nil(t, msg.FindElementNamespace("footer", footerNamespace))
+
+	// vhost without footer...
+	f = NewFooter(tUtilFooterConfig(), c2s.NewMockStream("efgh", j4))
+	msg = tUtilFooterMessage(j4, j3)
+	f.InterceptMessage(msg)
+	require.Equal(t, "Hi", msg.FindElement("body").Text())
+}
+
+func TestFooter_Carbons(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "example.net", "garden", true)
+
+	f := NewFooter(tUtilFooterConfig(), c2s.NewMockStream("abcd", j1))
+
+	msg := tUtilFooterMessage(j1, j2)
+	f.InterceptMessage(msg)
+
+	// carbon copy wrapping an already footed message is left untouched
+	forwarded := xml.NewElementNamespace("forwarded", "urn:xmpp:forward:0")
+	forwarded.AppendElement(msg)
+	sent := xml.NewElementNamespace("sent", "urn:xmpp:carbons:2")
+	sent.AppendElement(forwarded)
+
+	carbon := xml.NewMessageType(uuid.New(), xml.ChatType)
+	carbon.SetFromJID(j1.ToBareJID())
+	carbon.SetToJID(j1)
+	carbon.AppendElement(sent)
+
+	f.InterceptMessage(carbon)
+	require.Nil(t, carbon.FindElementNamespace("footer", footerNamespace))
+
+	body := carbon.FindElement("sent").FindElement("forwarded").FindElement("message").FindElement("body")
+	require.Equal(t, "Hi\n\nConfidential", body.Text())
+}
+
+func TestFooter_ClientMarker(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "example.net", "garden", true)
+
+	f := NewFooter(tUtilFooterConfig(), c2s.NewMockStream("abcd", j1))
+
+	// client supplied marks don't prevent footer from being appended
+	msg := tUtilFooterMessage(j1, j2)
+	msg.AppendElement(xml.NewElementNamespace("footer", footerNamespace))
+	StripFooterMarker(msg)
+	require.Nil(t, msg.FindElementNamespace("footer", footerNamespace))
+
+	f.InterceptMessage(msg)
+	require.Equal(t, "Hi\n\nConfidential", msg.FindElement("body").Text())
+	require.Equal(t, 1, len(msg.FindElementsNamespace("footer", footerNamespace)))
+}
+
+func tUtilFooterConfig() *config.ModFooter {
+	return &config.ModFooter{
+		Footers: []config.MessageFooter{{
+			Domain:  "jackal.im",
+			Text:    "Confidential",
+			Remote:  true,
+			Domains: []string{"acme.org"},
+		}},
+	}
+}
+
+func tUtilFooterMessage(from, to *xml.JID) *xml.Message {
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	msg.AppendElement(tUtilFooterBody("Hi", ""))
+	return msg
+}
+
+func tUtilFooterBody(text, lang string) xml.Element {
+	body := xml.NewElementName("body")
+	body.SetText(text)
+	if len(lang) > 0 {
+		body.SetLanguage(lang)
+	}
+	return body
+}
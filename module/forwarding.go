@@ -0,0 +1,220 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"errors"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/ortuman/jackal/xmpputil/timefmt"
+	"github.com/pborman/uuid"
+)
+
+const forwardingNamespace = "urn:jackal:forwarding:0"
+
+const forwardNamespace = "urn:xmpp:forward:0"
+
+const delayNamespace = "urn:xmpp:delay"
+
+// forwardingFeatureFlag is the feature flag gating message forwarding module.
+const forwardingFeatureFlag = "forwarding"
+
+// ForwardingMode represents the way messages received
+// while unavailable are forwarded.
+type ForwardingMode string
+
+const (
+	// ForwardOnly forwards messages without storing them offline.
+	ForwardOnly ForwardingMode = "forward"
+
+	// CopyAndStore forwards a copy of every message, storing it offline as well.
+	CopyAndStore ForwardingMode = "copy"
+)
+
+var (
+	errForwardingTargetRequired = errors.New("forwarding target is required")
+	errForwardingInvalidMode    = errors.New("forwarding mode must be either 'forward' or 'copy'")
+	errForwardingInvalidTarget  = errors.New("forwarding target must be a local account other than its owner")
+)
+
+type forwardingRule struct {
+	target *xml.JID
+	mode   ForwardingMode
+}
+
+// ModForwarding represents a message forwarding server stream module.
+//
+// Users set a rule (persisted as private XML) forwarding every message received while
+// having no available resources to another account, wrapped as described in
+// XEP-0297: Stanza Forwarding (https://xmpp.org/extensions/xep-0297.html).
+type ModForwarding struct {
+	strm  c2s.Stream
+	now   func() time.Time
+	actor *actor
+}
+
+// NewForwarding returns a message forwarding server stream module.
+func NewForwarding(strm c2s.Stream) *ModForwarding {
+	m := &ModForwarding{
+		strm:  strm,
+		now:   time.Now,
+		actor: newActor(nil),
+	}
+	return m
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with message forwarding module.
+func (m *ModForwarding) AssociatedNamespaces() []string {
+	return []string{forwardingNamespace}
+}
+
+// FeatureFlag returns message forwarding module feature flag.
+func (m *ModForwarding) FeatureFlag() string {
+	return forwardingFeatureFlag
+}
+
+// Done signals stream termination.
+func (m *ModForwarding) Done() {
+	m.actor.done()
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the message forwarding module.
+func (m *ModForwarding) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("query", forwardingNamespace) != nil
+}
+
+// ProcessIQ processes a message forwarding IQ taking according actions
+// over the associated stream.
+func (m *ModForwarding) ProcessIQ(iq *xml.IQ) {
+	m.actor.run(func() {
+		q := iq.FindElementNamespace("query", forwardingNamespace)
+		toJid := iq.ToJID()
+		validTo := toJid.IsServer() || toJid.Node() == m.strm.Username()
+		if !validTo {
+			m.strm.SendElement(iq.ForbiddenError())
+			return
+		}
+		if iq.IsGet() {
+			m.getRule(iq)
+		} else if iq.IsSet() {
+			m.setRule(iq, q)
+		} else {
+			m.strm.SendElement(iq.BadRequestError())
+		}
+	})
+}
+
+// ForwardOffline returns the forwarded copy to be routed for a message sent by
+// the stream user to a local recipient having no available resources, if any,
+// along with whether or not the original message should be stored offline.
+func (m *ModForwarding) ForwardOffline(message *xml.Message) (forwarded *xml.Message, store bool) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	// never forward a message forwarded by a rule, avoiding loops between them
+	if message.FindElementNamespace("forwarded", forwardingNamespace) != nil {
+		return nil, true
+	}
+	toJid := message.ToJID()
+	elems, err := storage.Instance().FetchPrivateXML(ctx, forwardingNamespace, toJid.Node())
+	if err != nil {
+		log.Error(err)
+		return nil, true
+	}
+	if len(elems) == 0 {
+		return nil, true // no forwarding rule
+	}
+	rule, err := m.ruleFromElements(toJid.Node(), elems)
+	if err != nil {
+		log.Error(err)
+		return nil, true
+	}
+	fwd := xml.NewElementNamespace("forwarded", forwardNamespace)
+	delay := xml.NewElementNamespace("delay", delayNamespace)
+	delay.SetAttribute("from", toJid.Domain())
+	delay.SetAttribute("stamp", timefmt.Format(m.now()))
+	fwd.AppendElement(delay)
+	fwd.AppendElement(message)
+
+	forwarded = xml.NewMessageType(uuid.New(), xml.NormalType)
+	forwarded.SetFromJID(toJid.ToBareJID())
+	forwarded.SetToJID(rule.target)
+	forwarded.AppendElement(fwd)
+	forwarded.AppendElement(xml.NewElementNamespace("forwarded", forwardingNamespace))
+
+	log.Infof("forwarding offline message... id: %s (%s -> %s)", message.ID(), toJid.Node(), rule.target)
+	return forwarded, rule.mode == CopyAndStore
+}
+
+func (m *ModForwarding) getRule(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	elems, err := storage.Instance().FetchPrivateXML(ctx, forwardingNamespace, m.strm.Username())
+	if err != nil {
+		log.Error(err)
+		m.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	result := iq.ResultIQ()
+	q := xml.NewElementNamespace("query", forwardingNamespace)
+	q.AppendElements(elems)
+	result.AppendElement(q)
+	m.strm.SendElement(result)
+}
+
+func (m *ModForwarding) setRule(iq *xml.IQ, q xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if q.ElementsCount() > 0 {
+		if _, err := m.ruleFromElements(m.strm.Username(), q.Elements()); err != nil {
+			m.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		log.Infof("setting forwarding rule... (%s/%s)", m.strm.Username(), m.strm.Resource())
+	} else {
+		log.Infof("removing forwarding rule... (%s/%s)", m.strm.Username(), m.strm.Resource())
+	}
+	if err := storage.Instance().InsertOrUpdatePrivateXML(ctx, q.Elements(), forwardingNamespace, m.strm.Username()); err != nil {
+		log.Error(err)
+		m.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	m.strm.SendElement(iq.ResultIQ())
+}
+
+func (m *ModForwarding) ruleFromElements(owner string, elems []xml.Element) (*forwardingRule, error) {
+	rule := &forwardingRule{mode: ForwardOnly}
+	for _, elem := range elems {
+		switch elem.Name() {
+		case "target":
+			target, err := xml.NewJIDString(elem.Text(), false)
+			if err != nil {
+				return nil, err
+			}
+			rule.target = target.ToBareJID()
+		case "mode":
+			rule.mode = ForwardingMode(elem.Text())
+		}
+	}
+	if rule.target == nil {
+		return nil, errForwardingTargetRequired
+	}
+	if rule.mode != ForwardOnly && rule.mode != CopyAndStore {
+		return nil, errForwardingInvalidMode
+	}
+	if !c2s.Instance().IsLocalDomain(rule.target.Domain()) || rule.target.Node() == owner || len(rule.target.Node()) == 0 {
+		return nil, errForwardingInvalidTarget
+	}
+	return rule, nil
+}
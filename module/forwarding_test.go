@@ -0,0 +1,206 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestForwarding_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := NewForwarding(nil)
+	defer x.Done()
+
+	require.Equal(t, []string{forwardingNamespace}, x.AssociatedNamespaces())
+	require.Equal(t, "forwarding", x.FeatureFlag())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("query", forwardingNamespace))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestForwarding_SetAndGetRule(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+
+	x := NewForwarding(stm)
+	defer x.Done()
+
+	// forbidden...
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	iq := tUtilForwardingIQ(xml.GetType, nil)
+	iq.SetToJID(j2.ToBareJID())
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+
+	// target is required...
+	x.ProcessIQ(tUtilForwardingIQ(xml.SetType, map[string]string{"mode": "copy"}))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// invalid mode...
+	x.ProcessIQ(tUtilForwardingIQ(xml.SetType, map[string]string{"target": "noelia@jackal.im", "mode": "bounce"}))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// remote, server and self targets...
+	for _, target := range []string{"noelia@example.org", "jackal.im", "ortuman@jackal.im/yard"} {
+		x.ProcessIQ(tUtilForwardingIQ(xml.SetType, map[string]string{"target": target}))
+		elem = stm.FetchElement()
+		require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+	}
+
+	x.ProcessIQ(tUtilForwardingIQ(xml.SetType, map[string]string{"target": "noelia@jackal.im", "mode": "copy"}))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	x.ProcessIQ(tUtilForwardingIQ(xml.GetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q := elem.FindElementNamespace("query", forwardingNamespace)
+	require.NotNil(t, q)
+	require.Equal(t, "noelia@jackal.im", q.FindElement("target").Text())
+	require.Equal(t, "copy", q.FindElement("mode").Text())
+
+	// remove rule...
+	x.ProcessIQ(tUtilForwardingIQ(xml.SetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	x.ProcessIQ(tUtilForwardingIQ(xml.GetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, 0, elem.FindElementNamespace("query", forwardingNamespace).ElementsCount())
+
+	// storage failure...
+	storage.ActivateMockedError()
+	x.ProcessIQ(tUtilForwardingIQ(xml.GetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+	storage.DeactivateMockedError()
+}
+
+func TestForwarding_ForwardOffline(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "", true)
+	stm := c2s.NewMockStream("abcd", j1)
+
+	now := time.Date(2018, 4, 10, 12, 0, 0, 0, time.UTC)
+
+	x := NewForwarding(stm)
+	x.now = func() time.Time { return now }
+	defer x.Done()
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+	msg.AppendElement(body)
+
+	// no rule...
+	fwd, store := x.ForwardOffline(msg)
+	require.Nil(t, fwd)
+	require.True(t, store)
+
+	// forward only...
+	storage.Instance().InsertOrUpdatePrivateXML(context.Background(), tUtilForwardingElements(map[string]string{
+		"target": "romeo@jackal.im",
+		"mode":   "forward",
+	}), forwardingNamespace, "noelia")
+
+	fwd, store = x.ForwardOffline(msg)
+	require.NotNil(t, fwd)
+	require.False(t, store)
+	require.Equal(t, "noelia@jackal.im", fwd.From())
+	require.Equal(t, "romeo@jackal.im", fwd.To())
+	forwarded := fwd.FindElementNamespace("forwarded", forwardNamespace)
+	require.NotNil(t, forwarded)
+	delay := forwarded.FindElementNamespace("delay", delayNamespace)
+	require.NotNil(t, delay)
+	require.Equal(t, "2018-04-10T12:00:00.000Z", delay.Attribute("stamp"))
+	inner := forwarded.FindElement("message")
+	require.NotNil(t, inner)
+	require.Equal(t, msg.ID(), inner.ID())
+	require.Equal(t, "Hi!", inner.FindElement("body").Text())
+
+	// copy and store...
+	storage.Instance().InsertOrUpdatePrivateXML(context.Background(), tUtilForwardingElements(map[string]string{
+		"target": "romeo@jackal.im",
+		"mode":   "copy",
+	}), forwardingNamespace, "noelia")
+
+	fwd, store = x.ForwardOffline(msg)
+	require.NotNil(t, fwd)
+	require.True(t, store)
+	require.Equal(t, "romeo@jackal.im", fwd.To())
+
+	// never forward an already forwarded message...
+	storage.Instance().InsertOrUpdatePrivateXML(context.Background(), tUtilForwardingElements(map[string]string{
+		"target": "noelia@jackal.im",
+		"mode":   "forward",
+	}), forwardingNamespace, "romeo")
+
+	fwd2, store := x.ForwardOffline(fwd)
+	require.Nil(t, fwd2)
+	require.True(t, store)
+
+	// storage failure falls back to offline storage...
+	storage.ActivateMockedError()
+	fwd, store = x.ForwardOffline(msg)
+	require.Nil(t, fwd)
+	require.True(t, store)
+	storage.DeactivateMockedError()
+}
+
+func tUtilForwardingIQ(typ string, fields map[string]string) *xml.IQ {
+	iq := xml.NewIQType(uuid.New(), typ)
+	iq.SetFromJID(&xml.JID{})
+	j, _ := xml.NewJID("ortuman", "jackal.im", "", true)
+	iq.SetToJID(j)
+	q := xml.NewElementNamespace("query", forwardingNamespace)
+	q.AppendElements(tUtilForwardingElements(fields))
+	iq.AppendElement(q)
+	return iq
+}
+
+func tUtilForwardingElements(fields map[string]string) []xml.Element {
+	var elems []xml.Element
+	for _, name := range []string{"target", "mode"} {
+		if text, ok := fields[name]; ok {
+			e := xml.NewElementName(name)
+			e.SetText(text)
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"flag"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+// updateGolden regenerates golden files (go test ./module -run Golden -update).
+var updateGolden = flag.Bool("update", false, "update golden files")
+
+const goldenDir = "testdata/golden"
+
+// requireGolden asserts that elem serializes byte by byte
+// as the content of the named golden file.
+func requireGolden(t *testing.T, name string, elem xml.Element) {
+	path := filepath.Join(goldenDir, name+".xml")
+	serialized := elem.String() + "\n"
+	if *updateGolden {
+		require.Nil(t, ioutil.WriteFile(path, []byte(serialized), 0644))
+		return
+	}
+	b, err := ioutil.ReadFile(path)
+	require.Nil(t, err)
+	require.Equal(t, string(b), serialized)
+}
+
+func TestGolden_ServerStanzas(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("mercutio", "jackal.im", "balcony", true)
+
+	newStream := func() *c2s.MockStream {
+		stm := c2s.NewMockStream("golden", j)
+		stm.SetUsername("mercutio")
+		stm.SetDomain("jackal.im")
+		stm.SetAuthenticated(true)
+		return stm
+	}
+	newIQ := func(id, iqType string, to *xml.JID, child xml.Element) *xml.IQ {
+		iq := xml.NewIQType(id, iqType)
+		iq.SetFromJID(j)
+		iq.SetToJID(to)
+		if child != nil {
+			iq.AppendElement(child)
+		}
+		return iq
+	}
+
+	t.Run("disco_info", func(t *testing.T) {
+		stm := newStream()
+		x := NewXEPDiscoInfo(stm)
+		defer x.Done()
+
+		x.SetIdentities([]DiscoIdentity{{Category: "server", Type: "im", Name: "jackal"}})
+		x.SetFeatures([]DiscoFeature{discoItemsNamespace, discoInfoNamespace, pingNamespace})
+		x.ProcessIQ(newIQ("info_1", xml.GetType, srvJID, xml.NewElementNamespace("query", discoInfoNamespace)))
+		requireGolden(t, "disco_info", stm.FetchElement())
+	})
+
+	t.Run("disco_info_limits", func(t *testing.T) {
+		stm := newStream()
+		x := NewXEPDiscoInfo(stm)
+		defer x.Done()
+
+		cfg := &config.Server{
+			ID:           "golden",
+			Modules:      map[string]struct{}{"offline": {}},
+			LargePayload: config.LargePayload{MaxStanzaSize: 65536},
+			ModOffline:   config.ModOffline{QueueSize: 100},
+		}
+		UpdateServerLimits(cfg.ID, ServerLimitsFromConfig(cfg))
+
+		x.SetIdentities([]DiscoIdentity{{Category: "server", Type: "im", Name: "jackal"}})
+		x.SetFeatures([]DiscoFeature{discoInfoNamespace})
+		x.SetFormsFunc(func() []xml.Element {
+			return []xml.Element{CurrentServerLimits("golden").Form()}
+		})
+		x.ProcessIQ(newIQ("info_1", xml.GetType, srvJID, xml.NewElementNamespace("query", discoInfoNamespace)))
+		requireGolden(t, "disco_info_limits", stm.FetchElement())
+
+		// reloaded limits get advertised right away
+		reloaded := *cfg
+		reloaded.ModOffline.QueueSize = 500
+		reloaded.LargePayload.MaxStanzaSize = 0
+		UpdateServerLimits(reloaded.ID, ServerLimitsFromConfig(&reloaded))
+
+		x.ProcessIQ(newIQ("info_2", xml.GetType, srvJID, xml.NewElementNamespace("query", discoInfoNamespace)))
+		requireGolden(t, "disco_info_limits_reloaded", stm.FetchElement())
+	})
+
+	t.Run("disco_items", func(t *testing.T) {
+		stm := newStream()
+		x := NewXEPDiscoInfo(stm)
+		defer x.Done()
+
+		x.SetItems([]DiscoItem{{Jid: "conference.jackal.im", Name: "Chatrooms & more"}, {Jid: "jackal.im", Node: "announce"}})
+		x.ProcessIQ(newIQ("items_1", xml.GetType, srvJID, xml.NewElementNamespace("query", discoItemsNamespace)))
+		requireGolden(t, "disco_items", stm.FetchElement())
+	})
+
+	t.Run("registration_fields", func(t *testing.T) {
+		stm := newStream()
+		stm.SetAuthenticated(false)
+		x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true}, testHasher, stm)
+		defer x.Done()
+
+		x.ProcessIQ(newIQ("reg_1", xml.GetType, srvJID, xml.NewElementNamespace("query", registerNamespace)))
+		requireGolden(t, "registration_fields", stm.FetchElement())
+	})
+
+	t.Run("roster", func(t *testing.T) {
+		storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{
+			User:         "mercutio",
+			Contact:      "juliet",
+			Name:         `Juliet & "Nurse"`,
+			Subscription: subscriptionBoth,
+			Groups:       []string{"Friends", "Capulets <Verona>"},
+		})
+		storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{
+			User:         "mercutio",
+			Contact:      "benvolio",
+			Subscription: subscriptionNone,
+			Ask:          true,
+		})
+		stm := newStream()
+		r := NewRoster(stm)
+		defer r.Done()
+
+		r.ProcessIQ(newIQ("roster_1", xml.GetType, j.ToBareJID(), xml.NewElementNamespace("query", rosterNamespace)))
+		requireGolden(t, "roster", stm.FetchElement())
+	})
+
+	t.Run("vcard", func(t *testing.T) {
+		vCard := xml.NewElementNamespace("vCard", vCardNamespace)
+		fn := xml.NewElementName("FN")
+		fn.SetText("Mercutio <Kinsman of the Prince>")
+		vCard.AppendElement(fn)
+		photo := xml.NewElementName("PHOTO")
+		photoType := xml.NewElementName("TYPE")
+		photoType.SetText("image/png")
+		binVal := xml.NewElementName("BINVAL")
+		binVal.SetText("iVBORw0KGgoAAAANSUhEUgAAABAAAAAQCAYAAAAf8/9h")
+		photo.AppendElement(photoType)
+		photo.AppendElement(binVal)
+		vCard.AppendElement(photo)
+		storage.Instance().InsertOrUpdateVCard(context.Background(), vCard, "mercutio")
+
+		stm := newStream()
+		x := NewXEPVCard(stm)
+		defer x.Done()
+
+		x.ProcessIQ(newIQ("vcard_1", xml.GetType, srvJID, xml.NewElementNamespace("vCard", vCardNamespace)))
+		requireGolden(t, "vcard", stm.FetchElement())
+	})
+
+	t.Run("private_storage", func(t *testing.T) {
+		stm := newStream()
+		x := NewXEPPrivateStorage(stm)
+		defer x.Done()
+
+		q := xml.NewElementNamespace("query", privateStorageNamespace)
+		q.AppendElement(xml.NewElementNamespace("exodus", "exodus:prefs"))
+		x.ProcessIQ(newIQ("private_1", xml.GetType, srvJID, q))
+		requireGolden(t, "private_storage", stm.FetchElement())
+	})
+
+	t.Run("ping_result", func(t *testing.T) {
+		stm := newStream()
+		x := NewXEPPing(&config.ModPing{}, stm)
+		defer x.Done()
+
+		x.ProcessIQ(newIQ("ping_1", xml.GetType, j.ToBareJID(), xml.NewElementNamespace("ping", pingNamespace)))
+		requireGolden(t, "ping_result", stm.FetchElement())
+	})
+
+	t.Run("error", func(t *testing.T) {
+		stm := newStream()
+		x := NewXEPVersion(&config.ModVersion{}, stm)
+		defer x.Done()
+
+		q := xml.NewElementNamespace("query", versionNamespace)
+		q.AppendElement(xml.NewElementName("version"))
+		x.ProcessIQ(newIQ("version_1", xml.GetType, srvJID, q))
+		requireGolden(t, "error", stm.FetchElement())
+	})
+
+	t.Run("footer", func(t *testing.T) {
+		f := NewFooter(tUtilFooterConfig(), newStream())
+		defer f.Done()
+
+		to, _ := xml.NewJID("wile", "acme.org", "desert", true)
+		msg := xml.NewMessageType("message_1", xml.ChatType)
+		msg.SetFromJID(j)
+		msg.SetToJID(to)
+		msg.AppendElement(tUtilFooterBody("Hi & bye", ""))
+		f.InterceptMessage(msg)
+		requireGolden(t, "footer", msg)
+	})
+}
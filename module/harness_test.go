@@ -0,0 +1,347 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const harnessTimeout = time.Second
+
+// testHasher hashes passwords as cheaply as possible.
+var testHasher = credentials.NewHasher(&config.PasswordHashing{Algorithm: config.BCrypt, Cost: bcrypt.MinCost}, 4096)
+
+var (
+	errHarnessResourceNotFound   = errors.New("resource not found")
+	errHarnessNotAuthenticated   = errors.New("user not authenticated")
+	errHarnessNotExistingAccount = errors.New("user does not exist")
+)
+
+// stanzaMatcher reports whether or not a received stanza is the expected one.
+type stanzaMatcher func(elem xml.Element) bool
+
+// isStanza matches stanzas named name, and of type typ if not empty.
+func isStanza(name, typ string) stanzaMatcher {
+	return func(elem xml.Element) bool {
+		return elem.Name() == name && (len(typ) == 0 || elem.Type() == typ)
+	}
+}
+
+// from additionally requires stanza to be sent from jid.
+func (m stanzaMatcher) from(jid string) stanzaMatcher {
+	return func(elem xml.Element) bool {
+		return m(elem) && elem.From() == jid
+	}
+}
+
+// with additionally requires stanza to contain a name child element
+// qualified by namespace.
+func (m stanzaMatcher) with(name, namespace string) stanzaMatcher {
+	return func(elem xml.Element) bool {
+		return m(elem) && elem.FindElementNamespace(name, namespace) != nil
+	}
+}
+
+// harnessUser represents a mocked stream connected to a test harness,
+// along with its own module set.
+type harnessUser struct {
+	strm      *c2s.MockStream
+	roster    *ModRoster
+	offline   *ModOffline
+	modules   *Chain
+	available bool
+	pending   []xml.Element
+}
+
+// JID returns user stream JID.
+func (u *harnessUser) JID() *xml.JID {
+	return u.strm.JID()
+}
+
+// harness routes stanzas among a set of mocked streams the same way
+// server streams do, so that multi-user scenarios can be expressed
+// within a single test.
+type harness struct {
+	t       *testing.T
+	domain  string
+	offline config.ModOffline
+	users   []*harnessUser
+}
+
+// newHarness initializes mocked storage and c2s subsystems.
+// Returned harness must be closed once the test finishes.
+func newHarness(t *testing.T) *harness {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	return &harness{
+		t:       t,
+		domain:  "jackal.im",
+		offline: config.ModOffline{QueueSize: 16},
+	}
+}
+
+// Close disconnects every connected user and shuts down initialized subsystems.
+func (h *harness) Close() {
+	for _, u := range append([]*harnessUser(nil), h.users...) {
+		h.Disconnect(u)
+	}
+	c2s.Shutdown()
+	storage.Shutdown()
+}
+
+// Register creates username account.
+func (h *harness) Register(username string) {
+	if err := storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: username, Password: "1234"}); err != nil {
+		h.t.Fatal(err)
+	}
+}
+
+// Connect registers username account if not already present and binds a
+// new authenticated stream to the given resource, with its roster already
+// requested. Additional modules can be attached to the user stream by
+// means of mods.
+func (h *harness) Connect(username, resource string, mods ...func(strm c2s.Stream) Module) *harnessUser {
+	if exists, _ := storage.Instance().UserExists(context.Background(), username); !exists {
+		h.Register(username)
+	}
+	j, err := xml.NewJID(username, h.domain, resource, true)
+	if err != nil {
+		h.t.Fatal(err)
+	}
+	strm := c2s.NewMockStream(uuid.New(), j)
+	strm.SetAuthenticated(true)
+
+	u := &harnessUser{strm: strm}
+	u.roster = NewRoster(strm)
+	u.offline = NewOffline(&h.offline, strm)
+	modules := []Module{u.roster, u.offline}
+	for _, mod := range mods {
+		modules = append(modules, mod(strm))
+	}
+	u.modules = NewChain(modules...)
+
+	c2s.Instance().RegisterStream(strm)
+	c2s.Instance().AuthenticateStream(strm)
+	h.users = append(h.users, u)
+
+	// request roster
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", rosterNamespace))
+	h.Send(u, iq)
+	h.ExpectStanza(u, isStanza("iq", xml.ResultType).with("query", rosterNamespace), harnessTimeout)
+	strm.SetRosterRequested(true)
+	return u
+}
+
+// Disconnect unbinds user stream, finalizing all of its modules.
+func (h *harness) Disconnect(u *harnessUser) {
+	for i, usr := range h.users {
+		if usr == u {
+			h.users = append(h.users[:i], h.users[i+1:]...)
+			break
+		}
+	}
+	c2s.Instance().UnregisterStream(u.strm)
+	u.modules.Done()
+}
+
+// Send processes stanza as if it had been sent by u stream.
+func (h *harness) Send(u *harnessUser, stanza xml.Element) {
+	switch stanza := stanza.(type) {
+	case *xml.IQ:
+		stanza.SetFromJID(u.JID())
+		if stanza.ToJID() == nil {
+			stanza.SetToJID(u.JID().ToBareJID())
+		}
+		h.processIQ(u, stanza)
+	case *xml.Presence:
+		stanza.SetFromJID(u.JID())
+		if stanza.ToJID() == nil {
+			stanza.SetToJID(u.JID().ToBareJID())
+		}
+		h.processPresence(u, stanza)
+	case *xml.Message:
+		stanza.SetFromJID(u.JID())
+		h.processMessage(u, stanza)
+	default:
+		h.t.Fatalf("unexpected stanza: %s", stanza)
+	}
+}
+
+// ExpectStanza waits until a stanza satisfying matcher is delivered to u
+// stream, failing the test if none arrives within timeout.
+// Non matching stanzas are kept for subsequent expectations.
+func (h *harness) ExpectStanza(u *harnessUser, matcher stanzaMatcher, timeout time.Duration) xml.Element {
+	h.t.Helper()
+	if elem := h.matchPending(u, matcher); elem != nil {
+		return elem
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		elem := u.strm.FetchElementTimeout(time.Until(deadline))
+		if elem == nil {
+			break
+		}
+		if matcher(elem) {
+			return elem
+		}
+		u.pending = append(u.pending, elem)
+	}
+	var received []string
+	for _, elem := range u.pending {
+		received = append(received, elem.String())
+	}
+	h.t.Fatalf("%s: expected stanza not received (received: [%s])", u.JID(), strings.Join(received, ", "))
+	return nil
+}
+
+// ExpectNoStanza fails the test if a stanza satisfying matcher is
+// delivered to u stream within timeout.
+func (h *harness) ExpectNoStanza(u *harnessUser, matcher stanzaMatcher, timeout time.Duration) {
+	h.t.Helper()
+	if elem := h.matchPending(u, matcher); elem != nil {
+		h.t.Fatalf("%s: unexpected stanza received: %s", u.JID(), elem)
+	}
+	deadline := time.Now().Add(timeout)
+	for {
+		elem := u.strm.FetchElementTimeout(time.Until(deadline))
+		if elem == nil {
+			return
+		}
+		if matcher(elem) {
+			h.t.Fatalf("%s: unexpected stanza received: %s", u.JID(), elem)
+		}
+		u.pending = append(u.pending, elem)
+	}
+}
+
+func (h *harness) matchPending(u *harnessUser, matcher stanzaMatcher) xml.Element {
+	for i, elem := range u.pending {
+		if matcher(elem) {
+			u.pending = append(u.pending[:i], u.pending[i+1:]...)
+			return elem
+		}
+	}
+	return nil
+}
+
+func (h *harness) processIQ(u *harnessUser, iq *xml.IQ) {
+	if toJid := iq.ToJID(); toJid.IsFull() {
+		if h.route(iq, toJid) != nil {
+			u.strm.SendElement(iq.ServiceUnavailableError())
+		}
+		return
+	}
+	if handler := u.modules.MatchingIQHandler(iq); handler != nil {
+		handler.ProcessIQ(iq)
+		return
+	}
+	if iq.IsGet() || iq.IsSet() {
+		u.strm.SendElement(iq.ServiceUnavailableError())
+	}
+}
+
+func (h *harness) processPresence(u *harnessUser, presence *xml.Presence) {
+	if u.modules.InterceptPresence(presence) {
+		return
+	}
+	toJid := presence.ToJID()
+	if toJid.IsBare() && (toJid.Node() != u.JID().Node() || toJid.Domain() != u.JID().Domain()) {
+		u.roster.ProcessPresence(presence)
+		return
+	}
+	if toJid.IsFull() {
+		h.route(presence, toJid)
+		return
+	}
+	switch {
+	case presence.IsAvailable():
+		u.strm.SetPriority(presence.Priority())
+		u.strm.SetPresenceElements(presence.Elements())
+		if !u.available {
+			u.available = true
+			u.roster.ProcessInitialPresence(presence, nil, func() {
+				if u.strm.Priority() >= 0 {
+					u.offline.DeliverOfflineMessages()
+				}
+			})
+			return
+		}
+	case presence.IsUnavailable():
+		u.strm.SetPresenceElements(nil)
+	default:
+		return
+	}
+	u.roster.BroadcastPresence(presence)
+}
+
+func (h *harness) processMessage(u *harnessUser, message *xml.Message) {
+	if u.modules.InterceptMessage(message) {
+		return
+	}
+	switch err := h.route(message, message.ToJID()); err {
+	case nil:
+		break
+	case errHarnessNotAuthenticated:
+		if (message.IsChat() || message.IsGroupChat()) && message.IsMessageWithBody() {
+			u.strm.SendElement(message.ServiceUnavailableError())
+			return
+		}
+		u.offline.ArchiveMessage(message)
+	default:
+		u.strm.SendElement(message.ServiceUnavailableError())
+	}
+}
+
+// route delivers stanza to its recipient streams.
+func (h *harness) route(stanza xml.Element, to *xml.JID) error {
+	if to.IsFull() {
+		if strm := c2s.Instance().ResourceStream(to); strm != nil {
+			strm.SendElement(stanza)
+			return nil
+		}
+	}
+	recipients := c2s.Instance().AvailableStreams(to.Node())
+	if len(recipients) == 0 {
+		if exists, _ := storage.Instance().UserExists(context.Background(), to.Node()); exists {
+			return errHarnessNotAuthenticated
+		}
+		return errHarnessNotExistingAccount
+	}
+	if to.IsFull() {
+		if _, ok := stanza.(*xml.Message); !ok {
+			return errHarnessResourceNotFound
+		}
+	}
+	if _, ok := stanza.(*xml.Message); ok {
+		// send to highest priority stream
+		strm := recipients[0]
+		for _, recipient := range recipients[1:] {
+			if recipient.Priority() > strm.Priority() {
+				strm = recipient
+			}
+		}
+		strm.SendElement(stanza)
+		return nil
+	}
+	for _, strm := range recipients {
+		strm.SendElement(stanza)
+	}
+	return nil
+}
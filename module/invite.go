@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/ortuman/jackal/xmpputil/timefmt"
+)
+
+// inviteNamespace is used by administrators to mint
+// one-time registration invite tokens.
+const inviteNamespace = "urn:jackal:invite:0"
+
+const defaultInviteTTL = 604800 // 1 week
+
+// mintInvite issues a new registration invite token on behalf of an administrator.
+func (x *XEPRegister) mintInvite(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if !iq.IsSet() {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	if !x.strm.IsAuthenticated() || !c2s.Instance().IsAdmin(x.strm.JID()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	token, err := newInviteToken()
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	ttl := x.cfg.InviteTTL
+	if ttl == 0 {
+		ttl = defaultInviteTTL
+	}
+	invite := model.Invite{
+		Token:     token,
+		CreatedBy: x.strm.Username(),
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(ttl)).UTC(),
+	}
+	if err := storage.Instance().InsertInvite(ctx, &invite); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	log.Infof("registration invite issued by %s (expires at: %v)", invite.CreatedBy, invite.ExpiresAt)
+
+	inv := xml.NewElementNamespace("invite", inviteNamespace)
+	tokenEl := xml.NewElementName("token")
+	tokenEl.SetText(invite.Token)
+	inv.AppendElement(tokenEl)
+	expires := xml.NewElementName("expires")
+	expires.SetText(timefmt.Format(invite.ExpiresAt))
+	inv.AppendElement(expires)
+
+	result := iq.ResultIQ()
+	result.AppendElement(inv)
+	x.strm.SendElement(result)
+}
+
+func newInviteToken() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -11,13 +11,27 @@ import (
 
 const moduleMailboxSize = 16
 
+// Module priorities. Lower values run first.
+const (
+	HighPriority    = -100
+	DefaultPriority = 0
+	LowPriority     = 100
+)
+
 // Module represents an XMPP module.
+//
+// Any further module capability is discovered by type asserting
+// it against IQHandler, MessageInterceptor, PresenceInterceptor,
+// StreamFeatureProvider, DiscoProvider, Prioritized and FeatureFlagged interfaces.
 type Module interface {
 	// AssociatedNamespaces returns namespaces associated
 	// with this module.
 	AssociatedNamespaces() []string
 
 	// Done signals stream termination.
+	// It must be idempotent and safe to call concurrently with any
+	// other module method. Once it returns, nothing else is sent
+	// to the associated stream.
 	Done()
 }
 
@@ -33,3 +47,60 @@ type IQHandler interface {
 	// over the associated stream.
 	ProcessIQ(iq *xml.IQ)
 }
+
+// MessageInterceptor represents a module that inspects
+// every message sent by the stream before being routed.
+type MessageInterceptor interface {
+	Module
+
+	// InterceptMessage returns true if the message has been
+	// consumed and should not be further processed.
+	InterceptMessage(message *xml.Message) bool
+}
+
+// PresenceInterceptor represents a module that inspects
+// every presence sent by the stream before being processed.
+type PresenceInterceptor interface {
+	Module
+
+	// InterceptPresence returns true if the presence has been
+	// consumed and should not be further processed.
+	InterceptPresence(presence *xml.Presence) bool
+}
+
+// StreamFeatureProvider represents a module that
+// advertises its own stream features.
+type StreamFeatureProvider interface {
+	Module
+
+	// StreamFeatures returns the features to be offered
+	// according to the current stream state.
+	StreamFeatures() []xml.Element
+}
+
+// DiscoProvider represents a module that declares its own
+// service discovery features.
+// Modules not implementing it advertise their associated namespaces.
+type DiscoProvider interface {
+	Module
+
+	// DiscoFeatures returns the disco info features
+	// supported by this module.
+	DiscoFeatures() []string
+}
+
+// Prioritized represents a module declaring its position
+// within the module chain.
+// Modules not implementing it are assigned DefaultPriority.
+type Prioritized interface {
+	// Priority returns module priority. Lower values run first.
+	Priority() int
+}
+
+// FeatureFlagged represents a module whose availability
+// is driven by a feature flag.
+// Disabled modules are skipped by the module chain altogether.
+type FeatureFlagged interface {
+	// FeatureFlag returns the name of the flag gating this module.
+	FeatureFlag() string
+}
@@ -6,9 +6,13 @@
 package module
 
 import (
+	"time"
+
+	"github.com/ortuman/jackal/bounce"
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 )
@@ -17,21 +21,21 @@ const offlineNamespace = "msgoffline"
 
 // ModOffline represents an offline server stream module.
 type ModOffline struct {
-	cfg     *config.ModOffline
-	strm    c2s.Stream
-	actorCh chan func()
-	doneCh  chan struct{}
+	cfg       *config.ModOffline
+	strm      c2s.Stream
+	archiveFn func(message *xml.Message, err error)
+	now       func() time.Time
+	actor     *actor
 }
 
 // NewOffline returns an offline server stream module.
 func NewOffline(config *config.ModOffline, strm c2s.Stream) *ModOffline {
 	r := &ModOffline{
-		cfg:     config,
-		strm:    strm,
-		actorCh: make(chan func(), moduleMailboxSize),
-		doneCh:  make(chan struct{}),
+		cfg:   config,
+		strm:  strm,
+		now:   time.Now,
+		actor: newActor(nil),
 	}
-	go r.actorLoop()
 	return r
 }
 
@@ -43,60 +47,78 @@ func (o *ModOffline) AssociatedNamespaces() []string {
 
 // Done signals stream termination.
 func (o *ModOffline) Done() {
-	o.doneCh <- struct{}{}
+	o.actor.done()
+}
+
+// SetArchiveHandler sets a function to be invoked with the outcome of every
+// archive attempt. A nil error means the message has been stored.
+// It must be set before archiving any message.
+func (o *ModOffline) SetArchiveHandler(fn func(message *xml.Message, err error)) {
+	o.archiveFn = fn
 }
 
 // ArchiveMessage archives a new offline messages into the storage.
 func (o *ModOffline) ArchiveMessage(message *xml.Message) {
-	o.actorCh <- func() {
+	o.actor.run(func() {
 		o.archiveMessage(message)
-	}
+	})
 }
 
-// DeliverOfflineMessages delivers every archived offline messages to the peer
-// deleting them from storage.
+// ArchiveMessageAndWait archives a new offline message into the storage,
+// waiting until it's been processed. It returns false if module is done.
+func (o *ModOffline) ArchiveMessageAndWait(message *xml.Message) bool {
+	return o.actor.runAndWait(func() {
+		o.archiveMessage(message)
+	})
+}
+
+// DeliverOfflineMessages delivers every archived offline messages to the peer,
+// oldest first, deleting them from storage. Messages are stamped with their
+// receipt time as described in XEP-0203: Delayed Delivery
+// (https://xmpp.org/extensions/xep-0203.html), while those older than
+// the configured TTL are discarded.
 func (o *ModOffline) DeliverOfflineMessages() {
-	o.actorCh <- func() {
+	o.actor.run(func() {
 		o.deliverOfflineMessages()
-	}
+	})
 }
 
-func (o *ModOffline) actorLoop() {
-	for {
-		select {
-		case f := <-o.actorCh:
-			f()
-		case <-o.doneCh:
-			return
-		}
+func (o *ModOffline) archiveMessage(message *xml.Message) {
+	err := o.insertOfflineMessage(message)
+	if o.archiveFn != nil {
+		o.archiveFn(message, err)
 	}
 }
 
-func (o *ModOffline) archiveMessage(message *xml.Message) {
-	toJid := message.ToJID()
-	queueSize, err := storage.Instance().CountOfflineMessages(toJid.Node())
-	if err != nil {
-		log.Error(err)
-		return
-	}
-	if queueSize >= o.cfg.QueueSize {
-		response := message.Copy()
-		response.SetFrom(toJid.String())
-		response.SetTo(o.strm.JID().String())
-		o.strm.SendElement(response.ServiceUnavailableError())
-		return
+func (o *ModOffline) insertOfflineMessage(message *xml.Message) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	inserted := false
+	if o.cfg.QueueSize > 0 {
+		dropOldest := o.cfg.QueuePolicy == config.DropOldestOnFullQueue
+		var err error
+		inserted, err = storage.Instance().InsertCappedOfflineMessage(ctx, message, message.ToJID().Node(), o.cfg.QueueSize, dropOldest)
+		if err != nil {
+			log.Error(err)
+			return err
+		}
 	}
-	delayed := message.Copy()
-	delayed.Delay(o.strm.Domain(), "Offline Storage")
-	if err := storage.Instance().InsertOfflineMessage(delayed, toJid.Node()); err != nil {
-		log.Errorf("%v", err)
-		return
+	if !inserted {
+		if resp := bounce.Response(message, bounce.QuotaExceeded, nil); resp != nil {
+			o.strm.SendElement(resp)
+		}
+		return xml.ErrResourceConstraint
 	}
 	log.Infof("archived offline message... id: %s", message.ID())
+	return nil
 }
 
 func (o *ModOffline) deliverOfflineMessages() {
-	messages, err := storage.Instance().FetchOfflineMessages(o.strm.Username())
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	messages, err := storage.Instance().FetchOfflineMessages(ctx, o.strm.Username())
 	if err != nil {
 		log.Error(err)
 		return
@@ -104,12 +126,43 @@ func (o *ModOffline) deliverOfflineMessages() {
 	if len(messages) == 0 {
 		return
 	}
-	log.Infof("delivering offline messages... count: %d", len(messages))
-
+	expiredBefore := offlineMessagesExpiredBefore(o.now())
+	var delivered int
 	for _, m := range messages {
-		o.strm.SendElement(m)
+		if offlineMessageExpired(m, expiredBefore) {
+			continue // not purged yet
+		}
+		o.strm.SendElement(delayedOfflineMessage(m, o.strm.Domain()))
+		delivered++
 	}
-	if err := storage.Instance().DeleteOfflineMessages(o.strm.Username()); err != nil {
+	log.Infof("delivered offline messages... count: %d (%d expired)", delivered, len(messages)-delivered)
+
+	if err := storage.Instance().DeleteOfflineMessages(ctx, o.strm.Username()); err != nil {
 		log.Error(err)
 	}
 }
+
+// offlineMessagesExpiredBefore returns the receipt time up to which
+// offline messages are expired at now, or zero if they never expire.
+func offlineMessagesExpiredBefore(now time.Time) time.Time {
+	ttl := storage.OfflineMessageTTL()
+	if ttl <= 0 {
+		return time.Time{}
+	}
+	return now.Add(-ttl)
+}
+
+func offlineMessageExpired(m model.OfflineMessage, expiredBefore time.Time) bool {
+	return !expiredBefore.IsZero() && !m.ReceivedAt.After(expiredBefore)
+}
+
+// delayedOfflineMessage returns a copy of m message stamped with its receipt
+// time, unless unknown or already stamped when archived by a former version.
+func delayedOfflineMessage(m model.OfflineMessage, domain string) *xml.MutableElement {
+	delayed := xml.NewElementFromElement(m.Message)
+	if m.ReceivedAt.IsZero() || m.Message.FindElementNamespace("delay", delayNamespace) != nil {
+		return delayed
+	}
+	delayed.DelayAt(domain, "Offline Storage", m.ReceivedAt)
+	return delayed
+}
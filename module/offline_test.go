@@ -6,11 +6,14 @@
 package module
 
 import (
+	"context"
+	"strconv"
 	"testing"
 	"time"
 
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
@@ -46,7 +49,7 @@ func TestOffline_ArchiveMessage(t *testing.T) {
 	// wait for insertion...
 	time.Sleep(time.Millisecond * 250)
 
-	msgs, err := storage.Instance().FetchOfflineMessages("juliet")
+	msgs, err := storage.Instance().FetchOfflineMessages(context.Background(), "juliet")
 	require.Nil(t, err)
 	require.Equal(t, 1, len(msgs))
 
@@ -58,7 +61,9 @@ func TestOffline_ArchiveMessage(t *testing.T) {
 
 	elem := stm.FetchElement()
 	require.NotNil(t, elem)
-	require.Equal(t, xml.ErrServiceUnavailable.Error(), elem.Error().Elements()[0].Name())
+	require.Equal(t, xml.ErrResourceConstraint.Error(), elem.Error().Elements()[0].Name())
+	require.Equal(t, "wait", elem.Error().Type())
+	require.NotNil(t, elem.Error().FindElement("text"))
 
 	// deliver offline messages...
 	stm2 := c2s.NewMockStream("abcd", j2)
@@ -73,3 +78,265 @@ func TestOffline_ArchiveMessage(t *testing.T) {
 	require.NotNil(t, elem)
 	require.Equal(t, msgID, elem.ID())
 }
+
+func TestOffline_ArchiveMessageAndWait(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetDomain("jackal.im")
+
+	x := NewOffline(&config.ModOffline{QueueSize: 1}, stm)
+
+	msg := xml.NewMessageType(uuid.New(), "normal")
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	require.True(t, x.ArchiveMessageAndWait(msg))
+
+	cnt, err := storage.Instance().CountOfflineMessages(context.Background(), "juliet")
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+
+	// discarded once done...
+	x.Done()
+	require.False(t, x.ArchiveMessageAndWait(msg))
+}
+
+func TestOffline_ArchiveHandler(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetDomain("jackal.im")
+
+	x := NewOffline(&config.ModOffline{QueueSize: 1}, stm)
+	defer x.Done()
+
+	errCh := make(chan error, 1)
+	x.SetArchiveHandler(func(_ *xml.Message, err error) { errCh <- err })
+
+	msg := xml.NewMessageType(uuid.New(), "normal")
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+
+	x.ArchiveMessage(msg)
+	require.Nil(t, <-errCh)
+
+	// queue is full...
+	x.ArchiveMessage(msg)
+	require.Equal(t, xml.ErrResourceConstraint, <-errCh)
+	_ = stm.FetchElement()
+
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	x.ArchiveMessage(msg)
+	require.Equal(t, storage.ErrMockedError, <-errCh)
+}
+
+func TestOffline_QueueFull(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	// fill juliet's queue up
+	for i := 0; i < 3; i++ {
+		m := xml.NewMessageType(strconv.Itoa(i), xml.NormalType)
+		storage.Instance().InsertOfflineMessage(context.Background(), m, "juliet")
+	}
+	newMessage := func() *xml.Message {
+		msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+		msg.SetFromJID(j1)
+		msg.SetToJID(j2)
+		return msg
+	}
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetDomain("jackal.im")
+
+	// incoming messages get bounced...
+	x := NewOffline(&config.ModOffline{QueueSize: 3}, stm)
+	defer x.Done()
+
+	errCh := make(chan error, 1)
+	x.SetArchiveHandler(func(_ *xml.Message, err error) { errCh <- err })
+
+	msg := newMessage()
+	x.ArchiveMessage(msg)
+	require.Equal(t, xml.ErrResourceConstraint, <-errCh)
+
+	elem := stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Equal(t, "juliet@jackal.im/garden", elem.From())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.To())
+	require.Equal(t, xml.ErrResourceConstraint.Error(), elem.Error().Elements()[0].Name())
+
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "juliet")
+	require.Equal(t, 3, cnt)
+
+	// ...or make room by dropping the oldest ones
+	x2 := NewOffline(&config.ModOffline{QueueSize: 3, QueuePolicy: config.DropOldestOnFullQueue}, stm)
+	defer x2.Done()
+
+	x2.SetArchiveHandler(func(_ *xml.Message, err error) { errCh <- err })
+
+	msg = newMessage()
+	x2.ArchiveMessage(msg)
+	require.Nil(t, <-errCh)
+
+	msgs, err := storage.Instance().FetchOfflineMessages(context.Background(), "juliet")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(msgs))
+	require.Equal(t, "1", msgs[0].Message.ID())
+	require.Equal(t, "2", msgs[1].Message.ID())
+	require.Equal(t, msg.ID(), msgs[2].Message.ID())
+}
+
+func TestOffline_ConcurrentArchiving(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	// several streams delivering to the same user at once
+	const streams, queueSize = 8, 5
+	errCh := make(chan error, streams)
+	for i := 0; i < streams; i++ {
+		j, _ := xml.NewJID("user"+strconv.Itoa(i), "jackal.im", "balcony", true)
+		stm := c2s.NewMockStream(uuid.New(), j)
+		stm.SetDomain("jackal.im")
+
+		x := NewOffline(&config.ModOffline{QueueSize: queueSize}, stm)
+		defer x.Done()
+		x.SetArchiveHandler(func(_ *xml.Message, err error) { errCh <- err })
+
+		msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+		msg.SetFromJID(j)
+		msg.SetToJID(j2)
+		x.ArchiveMessage(msg)
+	}
+	var bounced int
+	for i := 0; i < streams; i++ {
+		if err := <-errCh; err != nil {
+			require.Equal(t, xml.ErrResourceConstraint, err)
+			bounced++
+		}
+	}
+	require.Equal(t, streams-queueSize, bounced)
+
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "juliet")
+	require.Equal(t, queueSize, cnt)
+}
+
+func TestOffline_Delivery(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+
+	h.Register("juliet")
+	romeo := h.Connect("romeo", "orchard")
+
+	j, _ := xml.NewJID("juliet", "jackal.im", "", true)
+	msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+	msg.SetToJID(j)
+	msg.AppendElement(xml.NewElementName("body"))
+	h.Send(romeo, msg)
+
+	// chat messages are not archived
+	chatMsg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	chatMsg.SetToJID(j)
+	chatMsg.AppendElement(xml.NewElementName("body"))
+	h.Send(romeo, chatMsg)
+	elem := h.ExpectStanza(romeo, isStanza("message", xml.ErrorType), harnessTimeout)
+	require.Equal(t, chatMsg.ID(), elem.ID())
+
+	// wait for insertion...
+	time.Sleep(time.Millisecond * 100)
+
+	juliet := h.Connect("juliet", "balcony")
+	h.ExpectNoStanza(juliet, isStanza("message", ""), time.Millisecond*100)
+
+	h.Send(juliet, xml.NewPresence(juliet.JID(), juliet.JID().ToBareJID(), xml.AvailableType))
+	elem = h.ExpectStanza(juliet, isStanza("message", xml.NormalType).from("romeo@jackal.im/orchard"), harnessTimeout)
+	require.Equal(t, msg.ID(), elem.ID())
+	require.NotNil(t, elem.FindElementNamespace("delay", "urn:xmpp:delay"))
+
+	cnt, err := storage.Instance().CountOfflineMessages(context.Background(), "juliet")
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+}
+
+// receivedAtStorage reports offline messages as received at fixed times.
+type receivedAtStorage struct {
+	storage.Storage
+	receivedAt []time.Time
+}
+
+func (s *receivedAtStorage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	msgs, err := s.Storage.FetchOfflineMessages(ctx, username)
+	for i := range msgs {
+		msgs[i].ReceivedAt = s.receivedAt[i]
+	}
+	return msgs, err
+}
+
+func TestOffline_DeliverOfflineMessages(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock, OfflineMessageTTL: 3600})
+	defer storage.Shutdown()
+
+	t0 := time.Date(2018, time.June, 26, 8, 0, 0, 0, time.UTC)
+	storage.Decorate(func(s storage.Storage) storage.Storage {
+		return &receivedAtStorage{
+			Storage:    s,
+			receivedAt: []time.Time{t0, t0.Add(90 * time.Minute), t0.Add(100 * time.Minute), t0.Add(110 * time.Minute)},
+		}
+	})
+	legacy := xml.NewMessageType("legacy", xml.NormalType)
+	legacy.Delay("jackal.im", "Offline Storage")
+	for _, m := range []xml.Element{
+		xml.NewMessageType("expired", xml.NormalType),
+		xml.NewMessageType("first", xml.NormalType),
+		xml.NewMessageType("second", xml.NormalType),
+		legacy,
+	} {
+		storage.Instance().InsertOfflineMessage(context.Background(), m, "juliet")
+	}
+	j, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+	stm := c2s.NewMockStream("abcd", j)
+	stm.SetDomain("jackal.im")
+
+	x := NewOffline(&config.ModOffline{QueueSize: 10}, stm)
+	defer x.Done()
+	x.now = func() time.Time { return t0.Add(2 * time.Hour) }
+
+	x.DeliverOfflineMessages()
+
+	// expired messages are discarded, while the rest keep their order
+	for _, expected := range []struct{ id, stamp string }{
+		{"first", "2018-06-26T09:30:00.000Z"},
+		{"second", "2018-06-26T09:40:00.000Z"},
+	} {
+		elem := stm.FetchElement()
+		require.Equal(t, expected.id, elem.ID())
+		delay := elem.FindElementNamespace("delay", delayNamespace)
+		require.NotNil(t, delay)
+		require.Equal(t, "jackal.im", delay.Attribute("from"))
+		require.Equal(t, expected.stamp, delay.Attribute("stamp"))
+	}
+	// messages already stamped when archived are delivered as they are
+	elem := stm.FetchElement()
+	require.Equal(t, "legacy", elem.ID())
+	require.Equal(t, 1, len(elem.FindElementsNamespace("delay", delayNamespace)))
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*100))
+
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "juliet")
+	require.Equal(t, 0, cnt)
+}
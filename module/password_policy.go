@@ -0,0 +1,90 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/ortuman/jackal/config"
+)
+
+var errPasswordTooCommon = errors.New("password is too common")
+
+// passwordPolicyMinClasses is the number of character classes
+// a password must mix whenever mixed classes are required.
+const passwordPolicyMinClasses = 3
+
+// commonPasswords holds the most frequently used passwords, lowercased.
+var commonPasswords = map[string]struct{}{}
+
+func init() {
+	for _, p := range []string{
+		"123456", "password", "12345678", "qwerty", "123456789", "12345", "1234", "111111",
+		"1234567", "dragon", "123123", "baseball", "abc123", "football", "monkey", "letmein",
+		"696969", "shadow", "master", "666666", "qwertyuiop", "123321", "mustang", "1234567890",
+		"michael", "654321", "superman", "1qaz2wsx", "7777777", "121212", "000000", "qazwsx",
+		"123qwe", "killer", "trustno1", "jordan", "jennifer", "zxcvbnm", "asdfgh", "hunter",
+		"buster", "soccer", "harley", "batman", "andrew", "tigger", "sunshine", "iloveyou",
+		"2000", "charlie", "robert", "thomas", "hockey", "ranger", "daniel", "starwars",
+		"klaster", "112233", "george", "computer", "michelle", "jessica", "pepper", "1111",
+		"zxcvbn", "555555", "11111111", "131313", "freedom", "777777", "pass", "maggie",
+		"159753", "aaaaaa", "ginger", "princess", "joshua", "cheese", "amanda", "summer",
+		"love", "ashley", "nicole", "chelsea", "biteme", "matthew", "access", "yankees",
+		"987654321", "dallas", "austin", "thunder", "taylor", "matrix", "password1", "password123",
+		"passw0rd", "p@ssw0rd", "p@ssword", "welcome", "welcome1", "admin", "admin123", "login",
+		"qwerty123", "qwerty1", "1q2w3e4r", "1q2w3e4r5t", "q1w2e3r4", "abcd1234", "changeme", "secret",
+	} {
+		commonPasswords[p] = struct{}{}
+	}
+}
+
+// PasswordPolicy checks passwords against a configured strength policy.
+type PasswordPolicy struct {
+	cfg *config.PasswordPolicy
+}
+
+// NewPasswordPolicy returns a password policy enforcing cfg rules.
+func NewPasswordPolicy(cfg *config.PasswordPolicy) *PasswordPolicy {
+	return &PasswordPolicy{cfg: cfg}
+}
+
+// Check returns an error describing the first rule password fails to satisfy,
+// or nil if it complies with the policy.
+func (p *PasswordPolicy) Check(password string) error {
+	if p.cfg.MinLength > 0 && utf8.RuneCountInString(password) < p.cfg.MinLength {
+		return fmt.Errorf("password must be at least %d characters long", p.cfg.MinLength)
+	}
+	if p.cfg.MixedClasses && passwordClasses(password) < passwordPolicyMinClasses {
+		return fmt.Errorf("password must combine at least %d out of lowercase, uppercase, digit and symbol characters", passwordPolicyMinClasses)
+	}
+	if p.cfg.DenyCommon {
+		if _, ok := commonPasswords[strings.ToLower(password)]; ok {
+			return errPasswordTooCommon
+		}
+	}
+	return nil
+}
+
+func passwordClasses(password string) int {
+	var lower, upper, digit, symbol int
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = 1
+		case unicode.IsUpper(r):
+			upper = 1
+		case unicode.IsDigit(r):
+			digit = 1
+		default:
+			symbol = 1
+		}
+	}
+	return lower + upper + digit + symbol
+}
@@ -0,0 +1,45 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordPolicy_Check(t *testing.T) {
+	tests := []struct {
+		name     string
+		cfg      config.PasswordPolicy
+		password string
+		err      string
+	}{
+		{"no policy", config.PasswordPolicy{}, "a", ""},
+		{"too short", config.PasswordPolicy{MinLength: 8}, "s3cr3t", "password must be at least 8 characters long"},
+		{"min length", config.PasswordPolicy{MinLength: 8}, "s3cr3tss", ""},
+		{"multibyte length", config.PasswordPolicy{MinLength: 4}, "ñüéç", ""},
+		{"single class", config.PasswordPolicy{MixedClasses: true}, "montague", "password must combine at least 3 out of lowercase, uppercase, digit and symbol characters"},
+		{"two classes", config.PasswordPolicy{MixedClasses: true}, "m0ntagu3", "password must combine at least 3 out of lowercase, uppercase, digit and symbol characters"},
+		{"three classes", config.PasswordPolicy{MixedClasses: true}, "M0ntagu3", ""},
+		{"symbols", config.PasswordPolicy{MixedClasses: true}, "m0nt@gue", ""},
+		{"common", config.PasswordPolicy{DenyCommon: true}, "password", "password is too common"},
+		{"common ignoring case", config.PasswordPolicy{DenyCommon: true}, "PassW0rd", "password is too common"},
+		{"uncommon", config.PasswordPolicy{DenyCommon: true}, "wherefore art thou", ""},
+		{"length checked first", config.PasswordPolicy{MinLength: 10, MixedClasses: true, DenyCommon: true}, "1234", "password must be at least 10 characters long"},
+		{"compliant", config.PasswordPolicy{MinLength: 10, MixedClasses: true, DenyCommon: true}, "Wherefore4rt", ""},
+	}
+	for _, tt := range tests {
+		err := NewPasswordPolicy(&tt.cfg).Check(tt.password)
+		if len(tt.err) == 0 {
+			require.Nil(t, err, tt.name)
+		} else {
+			require.NotNil(t, err, tt.name)
+			require.Equal(t, tt.err, err.Error(), tt.name)
+		}
+	}
+}
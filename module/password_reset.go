@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net"
+	"net/smtp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+)
+
+const (
+	defaultPasswordResetTokenTTL      = 3600 // 1 hour
+	defaultPasswordResetMaxPerAccount = 3
+	defaultPasswordResetMaxPerIP      = 10
+	passwordResetWindow               = time.Hour
+)
+
+// MailSender represents an outgoing mail delivery mechanism.
+type MailSender interface {
+	SendMail(to, subject, body string) error
+}
+
+type smtpMailSender struct {
+	cfg *config.SMTP
+}
+
+func newSMTPMailSender(cfg *config.SMTP) MailSender {
+	return &smtpMailSender{cfg: cfg}
+}
+
+func (s *smtpMailSender) SendMail(to, subject, body string) error {
+	var auth smtp.Auth
+	if len(s.cfg.Username) > 0 {
+		host, _, err := net.SplitHostPort(s.cfg.Addr)
+		if err != nil {
+			return err
+		}
+		auth = smtp.PlainAuth("", s.cfg.Username, s.cfg.Password, host)
+	}
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", s.cfg.From, to, subject, body)
+	return smtp.SendMail(s.cfg.Addr, auth, s.cfg.From, []string{to}, []byte(msg))
+}
+
+type passwordResetToken struct {
+	token     string
+	expiresAt time.Time
+}
+
+// PasswordReset keeps track of issued password reset tokens and
+// reset requests, shared across all registration modules.
+type PasswordReset struct {
+	mu       sync.Mutex
+	tokens   map[string]passwordResetToken
+	accounts map[string][]time.Time
+	ips      map[string][]time.Time
+	now      func() time.Time
+}
+
+// NewPasswordReset returns an empty password reset tracker.
+func NewPasswordReset() *PasswordReset {
+	return &PasswordReset{
+		tokens:   make(map[string]passwordResetToken),
+		accounts: make(map[string][]time.Time),
+		ips:      make(map[string][]time.Time),
+		now:      time.Now,
+	}
+}
+
+// passwordReset is the password reset tracker shared by every stream registration module.
+var passwordReset = NewPasswordReset()
+
+// Allowed returns whether or not a new reset can be requested for username
+// account from remoteIP address, recording the request if so.
+// An empty remoteIP is not subject to per address limits.
+func (r *PasswordReset) Allowed(cfg *config.PasswordReset, username, remoteIP string) bool {
+	maxPerAccount := cfg.MaxPerAccount
+	if maxPerAccount == 0 {
+		maxPerAccount = defaultPasswordResetMaxPerAccount
+	}
+	maxPerIP := cfg.MaxPerIP
+	if maxPerIP == 0 {
+		maxPerIP = defaultPasswordResetMaxPerIP
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	if len(r.prune(r.accounts, username, now)) >= maxPerAccount {
+		return false
+	}
+	if len(remoteIP) > 0 {
+		if len(r.prune(r.ips, remoteIP, now)) >= maxPerIP {
+			return false
+		}
+		r.ips[remoteIP] = append(r.ips[remoteIP], now)
+	}
+	r.accounts[username] = append(r.accounts[username], now)
+	return true
+}
+
+// Issue generates a new username reset token, invalidating any previous one.
+func (r *PasswordReset) Issue(cfg *config.PasswordReset, username string) (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	ttl := cfg.TokenTTL
+	if ttl == 0 {
+		ttl = defaultPasswordResetTokenTTL
+	}
+	token := hex.EncodeToString(b)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.tokens[username] = passwordResetToken{
+		token:     token,
+		expiresAt: r.now().Add(time.Second * time.Duration(ttl)),
+	}
+	return token, nil
+}
+
+// Consume returns whether or not token is a valid username reset token.
+// Tokens can only be consumed once.
+func (r *PasswordReset) Consume(username, token string) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	t, ok := r.tokens[username]
+	if !ok {
+		return false
+	}
+	if !r.now().Before(t.expiresAt) {
+		delete(r.tokens, username)
+		return false
+	}
+	if subtle.ConstantTimeCompare([]byte(t.token), []byte(strings.TrimSpace(token))) != 1 {
+		return false
+	}
+	delete(r.tokens, username)
+	return true
+}
+
+// prune discards key requests older than reset window.
+func (r *PasswordReset) prune(m map[string][]time.Time, key string, now time.Time) []time.Time {
+	since := now.Add(-passwordResetWindow)
+
+	reqs := m[key]
+	i := 0
+	for i < len(reqs) && !reqs[i].After(since) {
+		i++
+	}
+	reqs = reqs[i:]
+	if len(reqs) == 0 {
+		delete(m, key)
+	} else {
+		m[key] = reqs
+	}
+	return reqs
+}
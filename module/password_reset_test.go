@@ -0,0 +1,64 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPasswordReset_Tokens(t *testing.T) {
+	r := NewPasswordReset()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	cfg := &config.PasswordReset{TokenTTL: 60}
+	token, err := r.Issue(cfg, "romeo")
+	require.Nil(t, err)
+	require.Equal(t, 32, len(token))
+
+	require.False(t, r.Consume("juliet", token))
+	require.False(t, r.Consume("romeo", "bad-token"))
+
+	// tokens are single-use
+	require.True(t, r.Consume("romeo", token))
+	require.False(t, r.Consume("romeo", token))
+
+	// a new token invalidates previous one
+	token1, _ := r.Issue(cfg, "romeo")
+	token2, _ := r.Issue(cfg, "romeo")
+	require.False(t, r.Consume("romeo", token1))
+	require.True(t, r.Consume("romeo", token2))
+
+	// expired token
+	token, _ = r.Issue(cfg, "romeo")
+	now = now.Add(time.Minute)
+	require.False(t, r.Consume("romeo", token))
+}
+
+func TestPasswordReset_Allowed(t *testing.T) {
+	r := NewPasswordReset()
+	now := time.Now()
+	r.now = func() time.Time { return now }
+
+	// per account
+	cfg := &config.PasswordReset{MaxPerAccount: 2, MaxPerIP: 2}
+	require.True(t, r.Allowed(cfg, "romeo", "198.51.100.7"))
+	require.True(t, r.Allowed(cfg, "romeo", "198.51.100.8"))
+	require.False(t, r.Allowed(cfg, "romeo", "198.51.100.9"))
+
+	// per address
+	require.True(t, r.Allowed(cfg, "juliet", "198.51.100.7"))
+	require.False(t, r.Allowed(cfg, "noelia", "198.51.100.7"))
+	require.True(t, r.Allowed(cfg, "noelia", ""))
+
+	// allowance is restored once window elapses
+	now = now.Add(passwordResetWindow + time.Second)
+	require.True(t, r.Allowed(cfg, "romeo", "198.51.100.7"))
+}
@@ -0,0 +1,58 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+	"github.com/ortuman/jackal/xmpputil/timefmt"
+	"github.com/pborman/uuid"
+)
+
+// SetNotificationRouter sets the function routing new account notifications
+// to configured recipients, storing them offline if unavailable.
+// It must be set before processing any registration.
+func (x *XEPRegister) SetNotificationRouter(fn func(message *xml.Message)) {
+	x.routeFn = fn
+}
+
+// notifyRegistration announces a newly registered account
+// to every configured notification recipient.
+func (x *XEPRegister) notifyRegistration(username string) {
+	if x.routeFn == nil || len(x.cfg.NotifyJIDs) == 0 {
+		return
+	}
+	fromJID, err := xml.NewJID("", x.strm.Domain(), "", true)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	ip := remoteIP(x.strm.RemoteAddr())
+	if len(ip) == 0 {
+		ip = "unknown"
+	}
+	text := fmt.Sprintf("New account registered: %s@%s (address: %s, time: %s)", username, fromJID.Domain(), ip, timefmt.Format(time.Now()))
+
+	for _, notifyJID := range x.cfg.NotifyJIDs {
+		toJID, err := xml.NewJIDString(notifyJID, false)
+		if err != nil {
+			log.Error(err)
+			continue
+		}
+		message := xml.NewMessageType(uuid.New(), xml.HeadlineType)
+		message.SetFromJID(fromJID)
+		message.SetToJID(toJID)
+		subject := xml.NewElementName("subject")
+		subject.SetText("New account registration")
+		body := xml.NewElementName("body")
+		body.SetText(text)
+		message.AppendElements([]xml.Element{subject, body})
+		x.routeFn(message)
+	}
+}
@@ -0,0 +1,214 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"container/list"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+)
+
+const (
+	defaultRegistrationIPWindow = 86400 // 1 day
+	defaultRegistrationWindow   = 3600  // 1 hour
+)
+
+// registrationTrackerCapacity bounds the number of tracked remote addresses,
+// least recently registering ones being evicted first.
+const registrationTrackerCapacity = 16384
+
+// RegistrationTracker keeps track of the accounts registered by every
+// stream and remote address, as well as server wide, shared across all
+// registration modules so that limits can't be bypassed by reconnecting.
+type RegistrationTracker struct {
+	mu       sync.Mutex
+	streams  map[string]int
+	ips      map[string]*list.Element
+	lru      *list.List  // most recently registering addresses first
+	recent   []time.Time // every registration within the global window
+	capacity int
+	now      func() time.Time
+}
+
+type ipRegistrations struct {
+	ip   string
+	regs []time.Time
+}
+
+// NewRegistrationTracker returns an empty registration tracker.
+func NewRegistrationTracker() *RegistrationTracker {
+	return &RegistrationTracker{
+		streams:  make(map[string]int),
+		ips:      make(map[string]*list.Element),
+		lru:      list.New(),
+		capacity: registrationTrackerCapacity,
+		now:      time.Now,
+	}
+}
+
+// registrationTracker is the tracker shared by every stream registration module.
+var registrationTracker = NewRegistrationTracker()
+
+// Allowed returns whether or not a new account can be registered from
+// streamID stream and remoteIP address according to cfg allowances.
+// An empty remoteIP is not subject to per address limits.
+// The second returned value reports whether the per address allowance was exhausted.
+func (t *RegistrationTracker) Allowed(cfg *config.ModRegistration, streamID, remoteIP string) (allowed bool, ipExhausted bool) {
+	maxPerConnection := cfg.MaxPerConnection
+	if maxPerConnection == 0 {
+		maxPerConnection = 1
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.streams[streamID] >= maxPerConnection {
+		return false, false
+	}
+	if cfg.MaxPerIP > 0 && len(remoteIP) > 0 {
+		t.expire(cfg)
+		if len(t.prune(cfg, remoteIP)) >= cfg.MaxPerIP {
+			return false, true
+		}
+	}
+	return true, false
+}
+
+// WindowAllowed returns whether or not a new account can be registered
+// according to cfg server wide allowance per time window.
+func (t *RegistrationTracker) WindowAllowed(cfg *config.ModRegistration) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneRecent(cfg)
+	return cfg.MaxPerWindow <= 0 || len(t.recent) < cfg.MaxPerWindow
+}
+
+// Registered records an account registration from streamID stream and remoteIP address.
+func (t *RegistrationTracker) Registered(streamID, remoteIP string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.streams[streamID]++
+	t.recent = append(t.recent, t.now())
+	if len(remoteIP) == 0 {
+		return
+	}
+	if el, ok := t.ips[remoteIP]; ok {
+		r := el.Value.(*ipRegistrations)
+		r.regs = append(r.regs, t.now())
+		t.lru.MoveToFront(el)
+		return
+	}
+	t.ips[remoteIP] = t.lru.PushFront(&ipRegistrations{ip: remoteIP, regs: []time.Time{t.now()}})
+	if t.lru.Len() > t.capacity {
+		t.remove(t.lru.Back())
+	}
+}
+
+// StreamRegistrations returns the number of accounts registered by streamID stream.
+func (t *RegistrationTracker) StreamRegistrations(streamID string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.streams[streamID]
+}
+
+// IPRegistrations returns the number of accounts registered
+// from remoteIP address within cfg time window.
+func (t *RegistrationTracker) IPRegistrations(cfg *config.ModRegistration, remoteIP string) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return len(t.prune(cfg, remoteIP))
+}
+
+// WindowRegistrations returns the number of accounts registered
+// server wide within cfg time window.
+func (t *RegistrationTracker) WindowRegistrations(cfg *config.ModRegistration) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.pruneRecent(cfg)
+	return len(t.recent)
+}
+
+// StreamClosed releases any state associated to streamID stream.
+// Per address registrations are kept until their time window expires.
+func (t *RegistrationTracker) StreamClosed(streamID string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.streams, streamID)
+}
+
+// prune discards remoteIP registrations older than cfg time window.
+func (t *RegistrationTracker) prune(cfg *config.ModRegistration, remoteIP string) []time.Time {
+	el, ok := t.ips[remoteIP]
+	if !ok {
+		return nil
+	}
+	since := ipWindowStart(cfg, t.now())
+
+	r := el.Value.(*ipRegistrations)
+	i := 0
+	for i < len(r.regs) && !r.regs[i].After(since) {
+		i++
+	}
+	r.regs = r.regs[i:]
+	if len(r.regs) == 0 {
+		t.remove(el)
+	}
+	return r.regs
+}
+
+// pruneRecent discards server wide registrations older than cfg time window.
+func (t *RegistrationTracker) pruneRecent(cfg *config.ModRegistration) {
+	window := cfg.Window
+	if window == 0 {
+		window = defaultRegistrationWindow
+	}
+	since := t.now().Add(-time.Second * time.Duration(window))
+
+	i := 0
+	for i < len(t.recent) && !t.recent[i].After(since) {
+		i++
+	}
+	t.recent = t.recent[i:]
+}
+
+// expire discards every address whose last registration is older than cfg time window.
+func (t *RegistrationTracker) expire(cfg *config.ModRegistration) {
+	since := ipWindowStart(cfg, t.now())
+	for el := t.lru.Back(); el != nil; el = t.lru.Back() {
+		r := el.Value.(*ipRegistrations)
+		if r.regs[len(r.regs)-1].After(since) {
+			return
+		}
+		t.remove(el)
+	}
+}
+
+func (t *RegistrationTracker) remove(el *list.Element) {
+	t.lru.Remove(el)
+	delete(t.ips, el.Value.(*ipRegistrations).ip)
+}
+
+func ipWindowStart(cfg *config.ModRegistration, now time.Time) time.Time {
+	window := cfg.IPWindow
+	if window == 0 {
+		window = defaultRegistrationIPWindow
+	}
+	return now.Add(-time.Second * time.Duration(window))
+}
+
+// remoteIP returns addr host part, or an empty string if unknown.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
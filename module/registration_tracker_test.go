@@ -0,0 +1,154 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationTracker_PerConnection(t *testing.T) {
+	tr := NewRegistrationTracker()
+
+	cfg := &config.ModRegistration{}
+	allowed, _ := tr.Allowed(cfg, "s1", "77.230.105.223")
+	require.True(t, allowed)
+	tr.Registered("s1", "77.230.105.223")
+	require.Equal(t, 1, tr.StreamRegistrations("s1"))
+
+	allowed, ipExhausted := tr.Allowed(cfg, "s1", "77.230.105.223")
+	require.False(t, allowed)
+	require.False(t, ipExhausted)
+
+	cfg.MaxPerConnection = 2
+	allowed, _ = tr.Allowed(cfg, "s1", "77.230.105.223")
+	require.True(t, allowed)
+
+	tr.StreamClosed("s1")
+	require.Equal(t, 0, tr.StreamRegistrations("s1"))
+}
+
+func TestRegistrationTracker_PerIP(t *testing.T) {
+	tr := NewRegistrationTracker()
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+
+	cfg := &config.ModRegistration{MaxPerIP: 2, IPWindow: 60}
+
+	// reconnecting doesn't reset address allowance
+	for _, id := range []string{"s1", "s2"} {
+		allowed, _ := tr.Allowed(cfg, id, "77.230.105.223")
+		require.True(t, allowed)
+		tr.Registered(id, "77.230.105.223")
+		tr.StreamClosed(id)
+	}
+	allowed, ipExhausted := tr.Allowed(cfg, "s3", "77.230.105.223")
+	require.False(t, allowed)
+	require.True(t, ipExhausted)
+	require.Equal(t, 2, tr.IPRegistrations(cfg, "77.230.105.223"))
+
+	// other addresses and unknown addresses are not affected
+	allowed, _ = tr.Allowed(cfg, "s3", "77.230.105.224")
+	require.True(t, allowed)
+	allowed, _ = tr.Allowed(cfg, "s3", "")
+	require.True(t, allowed)
+
+	// window expiration
+	now = now.Add(61 * time.Second)
+	allowed, _ = tr.Allowed(cfg, "s3", "77.230.105.223")
+	require.True(t, allowed)
+	require.Equal(t, 0, tr.IPRegistrations(cfg, "77.230.105.223"))
+}
+
+func TestRegistrationTracker_Window(t *testing.T) {
+	tr := NewRegistrationTracker()
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+
+	cfg := &config.ModRegistration{MaxPerWindow: 2, Window: 60}
+
+	// limit is shared by every stream and address
+	require.True(t, tr.WindowAllowed(cfg))
+	tr.Registered("s1", "77.230.105.223")
+	require.True(t, tr.WindowAllowed(cfg))
+	tr.Registered("s2", "77.230.105.224")
+	require.False(t, tr.WindowAllowed(cfg))
+	require.Equal(t, 2, tr.WindowRegistrations(cfg))
+
+	// window expiration
+	now = now.Add(61 * time.Second)
+	require.True(t, tr.WindowAllowed(cfg))
+	require.Equal(t, 0, tr.WindowRegistrations(cfg))
+
+	// unlimited
+	cfg.MaxPerWindow = 0
+	for i := 0; i < 5; i++ {
+		tr.Registered("s3", "")
+	}
+	require.True(t, tr.WindowAllowed(cfg))
+}
+
+func TestRegistrationTracker_WindowConcurrency(t *testing.T) {
+	tr := NewRegistrationTracker()
+	cfg := &config.ModRegistration{MaxPerWindow: 1000}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if tr.WindowAllowed(cfg) {
+					tr.Registered(fmt.Sprintf("s%d", i), "")
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, 500, tr.WindowRegistrations(cfg))
+}
+
+func TestRegistrationTracker_Bounded(t *testing.T) {
+	tr := NewRegistrationTracker()
+	tr.capacity = 2
+	now := time.Now()
+	tr.now = func() time.Time { return now }
+
+	cfg := &config.ModRegistration{MaxPerIP: 1, IPWindow: 60}
+
+	tr.Registered("s1", "77.230.105.223")
+	now = now.Add(time.Second)
+	tr.Registered("s2", "77.230.105.224")
+	now = now.Add(time.Second)
+	tr.Registered("s3", "77.230.105.223") // most recently registering again
+	now = now.Add(time.Second)
+	tr.Registered("s4", "77.230.105.225")
+
+	// least recently registering address got evicted
+	require.Equal(t, 2, tr.lru.Len())
+	require.Equal(t, 0, tr.IPRegistrations(cfg, "77.230.105.224"))
+	require.Equal(t, 2, tr.IPRegistrations(cfg, "77.230.105.223"))
+	require.Equal(t, 1, tr.IPRegistrations(cfg, "77.230.105.225"))
+
+	// expired addresses are swept away
+	now = now.Add(60 * time.Second)
+	allowed, _ := tr.Allowed(cfg, "s5", "77.230.105.226")
+	require.True(t, allowed)
+	require.Equal(t, 0, tr.lru.Len())
+	require.Equal(t, 0, len(tr.ips))
+}
+
+func TestRegistrationTracker_RemoteIP(t *testing.T) {
+	require.Equal(t, "", remoteIP(nil))
+	require.Equal(t, "77.230.105.223", remoteIP(&net.TCPAddr{IP: net.ParseIP("77.230.105.223"), Port: 5222}))
+	require.Equal(t, "::1", remoteIP(&net.TCPAddr{IP: net.ParseIP("::1"), Port: 5222}))
+}
@@ -0,0 +1,42 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"net"
+	"sync"
+)
+
+// RegistrationValidator decides whether a new account may be created,
+// returning a descriptive error whenever it gets rejected.
+type RegistrationValidator interface {
+	Validate(username, password string, from net.Addr) error
+}
+
+var (
+	validatorMu           sync.RWMutex
+	registrationValidator RegistrationValidator
+)
+
+// SetRegistrationValidator sets the validator consulted by every
+// registration module created afterwards. Nil value disables it.
+func SetRegistrationValidator(v RegistrationValidator) {
+	validatorMu.Lock()
+	registrationValidator = v
+	validatorMu.Unlock()
+}
+
+func currentRegistrationValidator() RegistrationValidator {
+	validatorMu.RLock()
+	defer validatorMu.RUnlock()
+	return registrationValidator
+}
+
+// SetValidator sets the validator consulted by this module after
+// its built-in checks, overriding the one set at construction.
+func (x *XEPRegister) SetValidator(v RegistrationValidator) {
+	x.validator = v
+}
@@ -0,0 +1,170 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	defaultRegistrationVetoTimeout  = 2000 // 2 seconds
+	defaultRegistrationVetoCacheTTL = 60   // 1 minute
+	maxRegistrationVetoReasonLength = 256
+)
+
+// RegistrationCandidate describes an account about to be registered.
+type RegistrationCandidate struct {
+	Username string `json:"username"`
+	Email    string `json:"email,omitempty"`
+	IP       string `json:"ip,omitempty"`
+	Domain   string `json:"domain"`
+	StreamID string `json:"stream_id"`
+	Secured  bool   `json:"secured"`
+}
+
+// RegistrationVerdict represents the outcome of a registration veto check.
+type RegistrationVerdict struct {
+	Allowed bool
+
+	// Reason is the descriptive text a rejection was answered with.
+	Reason string
+}
+
+type cachedRegistrationVerdict struct {
+	verdict   RegistrationVerdict
+	expiresAt time.Time
+}
+
+// RegistrationVeto asks an external endpoint for approval of registration
+// candidates, shared across all registration modules so that verdicts
+// get cached per remote address and username.
+type RegistrationVeto struct {
+	mu       sync.Mutex
+	client   *http.Client
+	verdicts map[string]cachedRegistrationVerdict
+	now      func() time.Time
+}
+
+// NewRegistrationVeto returns a registration veto with an empty verdict cache.
+func NewRegistrationVeto() *RegistrationVeto {
+	return &RegistrationVeto{
+		client:   &http.Client{},
+		verdicts: make(map[string]cachedRegistrationVerdict),
+		now:      time.Now,
+	}
+}
+
+// registrationVeto is the registration veto shared by every stream registration module.
+var registrationVeto = NewRegistrationVeto()
+
+// Check returns the verdict for c candidate according to cfg.
+// Whenever the endpoint can't be reached in time or responds unexpectedly,
+// the verdict is given by cfg fail policy and the failure is returned along.
+func (v *RegistrationVeto) Check(cfg *config.RegistrationVeto, c *RegistrationCandidate) (RegistrationVerdict, error) {
+	key := c.IP + "/" + c.Username
+
+	v.mu.Lock()
+	now := v.now()
+	for k, cv := range v.verdicts {
+		if now.After(cv.expiresAt) {
+			delete(v.verdicts, k)
+		}
+	}
+	cv, ok := v.verdicts[key]
+	v.mu.Unlock()
+	if ok {
+		return cv.verdict, nil
+	}
+	verdict, err := v.post(cfg, c)
+	if err != nil {
+		return RegistrationVerdict{Allowed: cfg.FailOpen}, err
+	}
+	cacheTTL := cfg.CacheTTL
+	if cacheTTL == 0 {
+		cacheTTL = defaultRegistrationVetoCacheTTL
+	}
+	v.mu.Lock()
+	v.verdicts[key] = cachedRegistrationVerdict{
+		verdict:   verdict,
+		expiresAt: v.now().Add(time.Second * time.Duration(cacheTTL)),
+	}
+	v.mu.Unlock()
+	return verdict, nil
+}
+
+func (v *RegistrationVeto) post(cfg *config.RegistrationVeto, c *RegistrationCandidate) (RegistrationVerdict, error) {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return RegistrationVerdict{}, err
+	}
+	timeout := cfg.Timeout
+	if timeout == 0 {
+		timeout = defaultRegistrationVetoTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*time.Duration(timeout))
+	defer cancel()
+
+	req, err := http.NewRequest(http.MethodPost, cfg.URL, bytes.NewReader(b))
+	if err != nil {
+		return RegistrationVerdict{}, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := v.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return RegistrationVerdict{}, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode >= 200 && resp.StatusCode <= 299:
+		return RegistrationVerdict{Allowed: true}, nil
+	case resp.StatusCode == http.StatusForbidden:
+		reason, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxRegistrationVetoReasonLength))
+		if err != nil {
+			return RegistrationVerdict{}, err
+		}
+		return RegistrationVerdict{Reason: strings.TrimSpace(string(reason))}, nil
+	}
+	return RegistrationVerdict{}, fmt.Errorf("registration: veto endpoint responded with status code %d", resp.StatusCode)
+}
+
+// notAcceptableError returns an error copy of stanza attaching
+// 'not-acceptable' error sub element along with a descriptive text.
+func notAcceptableError(stanza xml.Element, text string) xml.Element {
+	return stanzaErrorWithText(stanza, xml.ErrNotAcceptable.(*xml.StanzaError), text)
+}
+
+// badRequestError returns an error copy of stanza attaching
+// 'bad-request' error sub element along with a descriptive text.
+func badRequestError(stanza xml.Element, text string) xml.Element {
+	return stanzaErrorWithText(stanza, xml.ErrBadRequest.(*xml.StanzaError), text)
+}
+
+func stanzaErrorWithText(stanza xml.Element, stanzaErr *xml.StanzaError, text string) xml.Element {
+	errEl := xml.NewElementFromElement(stanzaErr.Element())
+	if len(text) > 0 {
+		textEl := xml.NewElementNamespace("text", "urn:ietf:params:xml:ns:xmpp-stanzas")
+		textEl.SetLanguage("en")
+		textEl.SetText(text)
+		errEl.AppendElement(textEl)
+	}
+	resp := xml.NewElementFromElement(stanza)
+	resp.SetType(xml.ErrorType)
+	resp.AppendElement(errEl)
+	return resp
+}
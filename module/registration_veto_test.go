@@ -0,0 +1,118 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistrationVeto_Allow(t *testing.T) {
+	var candidate RegistrationCandidate
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&candidate)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer srv.Close()
+
+	v := NewRegistrationVeto()
+	verdict, err := v.Check(&config.RegistrationVeto{URL: srv.URL}, &RegistrationCandidate{
+		Username: "romeo",
+		Email:    "romeo@example.org",
+		IP:       "198.51.100.7",
+		Domain:   "jackal.im",
+	})
+	require.Nil(t, err)
+	require.True(t, verdict.Allowed)
+	require.Equal(t, "romeo", candidate.Username)
+	require.Equal(t, "romeo@example.org", candidate.Email)
+	require.Equal(t, "198.51.100.7", candidate.IP)
+	require.Equal(t, "jackal.im", candidate.Domain)
+}
+
+func TestRegistrationVeto_Deny(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("Too many accounts from your network\n"))
+	}))
+	defer srv.Close()
+
+	v := NewRegistrationVeto()
+	verdict, err := v.Check(&config.RegistrationVeto{URL: srv.URL}, &RegistrationCandidate{Username: "romeo"})
+	require.Nil(t, err)
+	require.False(t, verdict.Allowed)
+	require.Equal(t, "Too many accounts from your network", verdict.Reason)
+}
+
+func TestRegistrationVeto_Timeout(t *testing.T) {
+	releaseCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-releaseCh
+	}))
+	defer srv.Close()
+	defer close(releaseCh)
+
+	v := NewRegistrationVeto()
+
+	// fail closed
+	verdict, err := v.Check(&config.RegistrationVeto{URL: srv.URL, Timeout: 50}, &RegistrationCandidate{Username: "romeo"})
+	require.NotNil(t, err)
+	require.False(t, verdict.Allowed)
+
+	// fail open
+	verdict, err = v.Check(&config.RegistrationVeto{URL: srv.URL, Timeout: 50, FailOpen: true}, &RegistrationCandidate{Username: "romeo"})
+	require.NotNil(t, err)
+	require.True(t, verdict.Allowed)
+
+	// unexpected status codes follow fail policy as well
+	srv2 := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer srv2.Close()
+
+	verdict, err = v.Check(&config.RegistrationVeto{URL: srv2.URL}, &RegistrationCandidate{Username: "romeo"})
+	require.NotNil(t, err)
+	require.False(t, verdict.Allowed)
+}
+
+func TestRegistrationVeto_Cache(t *testing.T) {
+	var requests int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer srv.Close()
+
+	now := time.Now()
+	v := NewRegistrationVeto()
+	v.now = func() time.Time { return now }
+
+	cfg := &config.RegistrationVeto{URL: srv.URL, CacheTTL: 10}
+	c := &RegistrationCandidate{Username: "romeo", IP: "198.51.100.7"}
+	for i := 0; i < 3; i++ {
+		verdict, err := v.Check(cfg, c)
+		require.Nil(t, err)
+		require.False(t, verdict.Allowed)
+	}
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+
+	// verdicts are cached per address and username
+	v.Check(cfg, &RegistrationCandidate{Username: "juliet", IP: "198.51.100.7"})
+	v.Check(cfg, &RegistrationCandidate{Username: "romeo", IP: "198.51.100.8"})
+	require.Equal(t, int32(3), atomic.LoadInt32(&requests))
+
+	// expired verdict
+	now = now.Add(time.Second * 11)
+	v.Check(cfg, c)
+	require.Equal(t, int32(4), atomic.LoadInt32(&requests))
+}
@@ -8,9 +8,13 @@ package module
 import (
 	"errors"
 	"fmt"
+	"sort"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/rostersync"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -20,6 +24,16 @@ import (
 
 const rosterNamespace = "jabber:iq:roster"
 
+const rosterVersioningNamespace = "urn:xmpp:features:rosterver"
+
+// initialPresenceConcurrency represents the maximum number of storage fetches
+// issued concurrently while processing an initial presence.
+const initialPresenceConcurrency = 4
+
+// probeAnswerTTL represents the time a presence probe answer is reused
+// for subsequent probes to the same contact.
+const probeAnswerTTL = time.Second * 5
+
 const (
 	subscriptionNone   = "none"
 	subscriptionFrom   = "from"
@@ -80,8 +94,25 @@ func (r *roster) deleteItem(ri *model.RosterItem) {
 type rosterMap struct {
 	mu    sync.RWMutex
 	cache map[string]*roster
+
+	loadMu  sync.Mutex
+	loads   map[string]*rosterLoad // in flight, keyed by username
+	queued  []*rosterLoad
+	loading bool
+}
+
+// rosterLoad represents a pending roster load, completed
+// along with every other one queued meanwhile.
+type rosterLoad struct {
+	username string
+	done     chan struct{}
+	err      error
 }
 
+// loadRoster caches username roster. Rosters requested concurrently,
+// as happens whenever many users reconnect at once, are fetched in batches
+// by a single storage query. The first caller doesn't wait for any batch
+// to fill up, so that no latency is added to uncontended loads.
 func (rm *rosterMap) loadRoster(username string) error {
 	rm.mu.RLock()
 	r := rm.cache[username]
@@ -89,14 +120,58 @@ func (rm *rosterMap) loadRoster(username string) error {
 	if r != nil {
 		return nil
 	}
-	items, err := storage.Instance().FetchRosterItems(username)
-	if err != nil {
-		return err
+	rm.loadMu.Lock()
+	l := rm.loads[username]
+	if l == nil {
+		l = &rosterLoad{username: username, done: make(chan struct{})}
+		rm.loads[username] = l
+		rm.queued = append(rm.queued, l)
+		if !rm.loading {
+			rm.loading = true
+			rm.loadMu.Unlock()
+			rm.loadQueued()
+			return l.err
+		}
 	}
-	rm.mu.Lock()
-	rm.cache[username] = &roster{items: items}
-	rm.mu.Unlock()
-	return nil
+	rm.loadMu.Unlock()
+	<-l.done
+	return l.err
+}
+
+// loadQueued loads every queued roster at once, handing over
+// to a new goroutine whenever more loads got queued meanwhile.
+func (rm *rosterMap) loadQueued() {
+	rm.loadMu.Lock()
+	loads := rm.queued
+	rm.queued = nil
+	rm.loadMu.Unlock()
+
+	users := make([]string, len(loads))
+	for i, l := range loads {
+		users[i] = l.username
+	}
+	ctx, cancel := storage.QueryContext()
+	items, err := storage.Instance().FetchRosterItemsOfUsers(ctx, users)
+	cancel()
+	if err == nil {
+		rm.mu.Lock()
+		for _, user := range users {
+			rm.cache[user] = &roster{items: items[user]}
+		}
+		rm.mu.Unlock()
+	}
+	rm.loadMu.Lock()
+	for _, l := range loads {
+		l.err = err
+		delete(rm.loads, l.username)
+		close(l.done)
+	}
+	if len(rm.queued) > 0 {
+		go rm.loadQueued()
+	} else {
+		rm.loading = false
+	}
+	rm.loadMu.Unlock()
 }
 
 func (rm *rosterMap) fetchRosterItems(username string) ([]model.RosterItem, error) {
@@ -106,7 +181,9 @@ func (rm *rosterMap) fetchRosterItems(username string) ([]model.RosterItem, erro
 	if r != nil {
 		return r.fetchItems(), nil
 	}
-	return storage.Instance().FetchRosterItems(username)
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+	return storage.Instance().FetchRosterItems(ctx, username)
 }
 
 func (rm *rosterMap) fetchRosterItem(username, contact string) (*model.RosterItem, error) {
@@ -116,27 +193,80 @@ func (rm *rosterMap) fetchRosterItem(username, contact string) (*model.RosterIte
 	if r != nil {
 		return r.fetchItem(contact), nil
 	}
-	return storage.Instance().FetchRosterItem(username, contact)
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+	return storage.Instance().FetchRosterItem(ctx, username, contact)
 }
 
+// insertOrUpdateRosterItem stores ri, setting
+// the roster version assigned to the modification.
 func (rm *rosterMap) insertOrUpdateRosterItem(ri *model.RosterItem) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().InsertOrUpdateRosterItem(ctx, ri); err != nil {
+		return err
+	}
+	rm.cacheRosterItem(ri)
+	return nil
+}
+
+// approveSubscription stores contactRi, deleting the subscription request
+// user sent to contact within the same transaction, so that a request
+// can't vanish without its approval taking place.
+func (rm *rosterMap) approveSubscription(user, contact string, contactRi *model.RosterItem) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	err := storage.Instance().InTransaction(ctx, func(tx storage.Storage) error {
+		if err := tx.DeleteRosterNotification(ctx, user, contact); err != nil {
+			return err
+		}
+		return tx.InsertOrUpdateRosterItem(ctx, contactRi)
+	})
+	if err != nil {
+		return err
+	}
+	rm.cacheRosterItem(contactRi)
+	return nil
+}
+
+// deleteRosterItem deletes ri along with any pending subscription
+// request from its contact, setting the roster version right after
+// the deletion took place.
+func (rm *rosterMap) deleteRosterItem(ri *model.RosterItem) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	rm.mu.RLock()
 	r := rm.cache[ri.User]
 	rm.mu.RUnlock()
 	if r != nil {
-		r.insertOrUpdateItem(ri)
+		r.deleteItem(ri)
 	}
-	return storage.Instance().InsertOrUpdateRosterItem(ri)
+	return storage.Instance().InTransaction(ctx, func(tx storage.Storage) error {
+		if err := tx.DeleteRosterNotification(ctx, ri.User, ri.Contact); err != nil {
+			return err
+		}
+		if err := tx.DeleteRosterItem(ctx, ri.User, ri.Contact); err != nil {
+			return err
+		}
+		rv, err := tx.FetchRosterVersion(ctx, ri.User)
+		if err != nil {
+			return err
+		}
+		ri.Ver = rv.Ver
+		return nil
+	})
 }
 
-func (rm *rosterMap) deleteRosterItem(ri *model.RosterItem) error {
+func (rm *rosterMap) cacheRosterItem(ri *model.RosterItem) {
 	rm.mu.RLock()
 	r := rm.cache[ri.User]
 	rm.mu.RUnlock()
 	if r != nil {
-		r.deleteItem(ri)
+		r.insertOrUpdateItem(ri)
 	}
-	return storage.Instance().DeleteRosterItem(ri.User, ri.Contact)
 }
 
 func (rm *rosterMap) unloadRoster(username string) {
@@ -147,31 +277,37 @@ func (rm *rosterMap) unloadRoster(username string) {
 
 var rosterTable = rosterMap{
 	cache: map[string]*roster{},
+	loads: map[string]*rosterLoad{},
 }
 
 var defaultRosterErrHandler = func(err error) {
 	log.Error(err)
 }
 
+type probeAnswer struct {
+	presences []*xml.Presence
+	expiresAt time.Time
+}
+
 // ModRoster represents a roster server stream module.
 type ModRoster struct {
-	stm        c2s.Stream
-	lock       sync.RWMutex
-	requested  bool
-	actorCh    chan func()
-	doneCh     chan chan bool
-	errHandler func(error)
+	stm             c2s.Stream
+	lock            sync.RWMutex
+	requested       bool
+	probes          map[xml.JIDKey]*probeAnswer
+	actor           *actor
+	errHandler      func(error)
+	presenceFilters []func(presence *xml.Presence, to *xml.JID) bool
 }
 
 // NewRoster returns a roster server stream module.
 func NewRoster(stm c2s.Stream) *ModRoster {
 	r := &ModRoster{
 		stm:        stm,
-		actorCh:    make(chan func(), moduleMailboxSize),
-		doneCh:     make(chan chan bool),
+		probes:     make(map[xml.JIDKey]*probeAnswer),
 		errHandler: defaultRosterErrHandler,
 	}
-	go r.actorLoop()
+	r.actor = newActor(func() { rosterTable.unloadRoster(r.stm.Username()) })
 	return r
 }
 
@@ -183,9 +319,16 @@ func (r *ModRoster) AssociatedNamespaces() []string {
 
 // Done signals stream termination.
 func (r *ModRoster) Done() {
-	ch := make(chan bool)
-	r.doneCh <- ch
-	<-ch // wait until closed...
+	r.actor.done()
+}
+
+// StreamFeatures returns roster versioning stream feature,
+// offered once the stream has been authenticated.
+func (r *ModRoster) StreamFeatures() []xml.Element {
+	if !r.stm.IsAuthenticated() {
+		return nil
+	}
+	return []xml.Element{xml.NewElementNamespace("ver", rosterVersioningNamespace)}
 }
 
 // MatchesIQ returns whether or not an IQ should be
@@ -197,16 +340,26 @@ func (r *ModRoster) MatchesIQ(iq *xml.IQ) bool {
 // ProcessIQ processes a roster IQ taking according actions
 // over the associated stream.
 func (r *ModRoster) ProcessIQ(iq *xml.IQ) {
-	r.actorCh <- func() {
+	r.actor.run(func() {
 		q := iq.FindElementNamespace("query", rosterNamespace)
 		if iq.IsGet() {
 			r.sendRoster(iq, q)
 		} else if iq.IsSet() {
-			r.updateRoster(iq, q)
+			if !c2s.Instance().GuardSession(r.stm, func() { r.updateRoster(iq, q) }) {
+				r.stm.SendElement(iq.NotAuthorizedError())
+			}
 		} else {
 			r.stm.SendElement(iq.BadRequestError())
 		}
-	}
+	})
+}
+
+// AddPresenceFilter adds a function deciding whether or not a presence
+// can be routed to to, the full JID of a recipient stream. Presences are
+// routed only if every filter allows them. Filters must be added before
+// processing any presence, every presence being routed by default.
+func (r *ModRoster) AddPresenceFilter(filter func(presence *xml.Presence, to *xml.JID) bool) {
+	r.presenceFilters = append(r.presenceFilters, filter)
 }
 
 // IsRequested returns whether or not the user roster
@@ -219,66 +372,64 @@ func (r *ModRoster) IsRequested() bool {
 
 // ProcessPresence process an incoming roster presence.
 func (r *ModRoster) ProcessPresence(presence *xml.Presence) {
-	r.actorCh <- func() {
+	r.actor.run(func() {
 		if err := r.processPresence(presence); err != nil {
 			r.errHandler(err)
 		}
-	}
+	})
 }
 
 // DeliverPendingApprovalNotifications delivers any pending roster notification
 // to the associated stream.
 func (r *ModRoster) DeliverPendingApprovalNotifications() {
-	r.actorCh <- func() {
+	r.actor.run(func() {
 		if err := r.deliverPendingApprovalNotifications(); err != nil {
 			r.errHandler(err)
 		}
-	}
+	})
 }
 
 // ReceivePresences delivers all inbound roster available presences
 // to the associated module stream.
 func (r *ModRoster) ReceivePresences() {
-	r.actorCh <- func() {
+	r.actor.run(func() {
 		if err := r.receivePresences(); err != nil {
 			r.errHandler(err)
 		}
-	}
+	})
+}
+
+// ProcessInitialPresence processes user's initial available presence, delivering
+// pending approval notifications, receiving contacts presences and broadcasting
+// presence to all outbound roster contacts, in that order.
+// Storage data is fetched concurrently along with every prefetch function,
+// and onProcessed is invoked once the whole presence sequence has been sent.
+func (r *ModRoster) ProcessInitialPresence(presence *xml.Presence, prefetch []func() error, onProcessed func()) {
+	r.actor.run(func() {
+		r.processInitialPresence(presence, prefetch)
+		if onProcessed != nil {
+			onProcessed()
+		}
+	})
 }
 
 // BroadcastPresence broadcasts presence to all outbound roster contacts.
 func (r *ModRoster) BroadcastPresence(presence *xml.Presence) {
-	r.actorCh <- func() {
+	r.actor.run(func() {
 		if err := r.broadcastPresence(presence); err != nil {
 			r.errHandler(err)
 		}
-	}
+	})
 }
 
 // BroadcastPresenceAndWait broadcasts presence to all outbound
 // roster contacts in a synchronous manner.
 func (r *ModRoster) BroadcastPresenceAndWait(presence *xml.Presence) {
-	continueCh := make(chan struct{})
-	r.actorCh <- func() {
+	r.actor.runAndWait(func() {
 		if err := r.broadcastPresence(presence); err != nil {
 			r.errHandler(err)
 		}
-		close(continueCh)
-	}
-	<-continueCh
-}
-
-func (r *ModRoster) actorLoop() {
-	for {
-		select {
-		case f := <-r.actorCh:
-			f()
-		case ch := <-r.doneCh:
-			defer close(ch)
-			rosterTable.unloadRoster(r.stm.Username())
-			return
-		}
-	}
+	})
 }
 
 func (r *ModRoster) processPresence(presence *xml.Presence) error {
@@ -291,22 +442,62 @@ func (r *ModRoster) processPresence(presence *xml.Presence) error {
 		return r.processUnsubscribe(presence)
 	case xml.UnsubscribedType:
 		return r.processUnsubscribed(presence)
+	case xml.ProbeType:
+		return r.processProbe(presence)
 	}
 	return nil
 }
 
+func (r *ModRoster) processInitialPresence(presence *xml.Presence, prefetch []func() error) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	var rosterNotifications []model.RosterNotification
+
+	g := newErrGroup(initialPresenceConcurrency)
+	g.Go(func() error {
+		return rosterTable.loadRoster(r.stm.Username())
+	})
+	g.Go(func() (err error) {
+		rosterNotifications, err = storage.Instance().FetchRosterNotifications(ctx, r.stm.Username())
+		return
+	})
+	for _, f := range prefetch {
+		g.Go(f)
+	}
+	if err := g.Wait(); err != nil {
+		r.errHandler(err)
+		return
+	}
+	r.sendPendingApprovalNotifications(rosterNotifications)
+
+	if err := r.receivePresences(); err != nil {
+		r.errHandler(err)
+	}
+	if err := r.broadcastPresence(presence); err != nil {
+		r.errHandler(err)
+	}
+}
+
 func (r *ModRoster) deliverPendingApprovalNotifications() error {
-	rosterNotifications, err := storage.Instance().FetchRosterNotifications(r.stm.Username())
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	rosterNotifications, err := storage.Instance().FetchRosterNotifications(ctx, r.stm.Username())
 	if err != nil {
 		return err
 	}
+	r.sendPendingApprovalNotifications(rosterNotifications)
+	return nil
+}
+
+func (r *ModRoster) sendPendingApprovalNotifications(rosterNotifications []model.RosterNotification) {
 	for _, rosterNotification := range rosterNotifications {
 		fromJID, _ := xml.NewJID(rosterNotification.User, r.stm.Domain(), "", true)
 		p := xml.NewPresence(fromJID, r.stm.JID(), xml.SubscribeType)
 		p.AppendElements(rosterNotification.Elements)
 		r.stm.SendElement(p)
 	}
-	return nil
 }
 
 func (r *ModRoster) receivePresences() error {
@@ -339,6 +530,9 @@ func (r *ModRoster) broadcastPresence(presence *xml.Presence) error {
 }
 
 func (r *ModRoster) sendRoster(iq *xml.IQ, query xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	if query.ElementsCount() > 0 {
 		r.stm.SendElement(iq.BadRequestError())
 		return
@@ -359,17 +553,89 @@ func (r *ModRoster) sendRoster(iq *xml.IQ, query xml.Element) {
 		r.stm.SendElement(iq.InternalServerError())
 		return
 	}
+	if ver, ok := rosterVersionAttribute(query); ok {
+		rv, err := storage.Instance().FetchRosterVersion(ctx, r.stm.Username())
+		if err != nil {
+			r.errHandler(err)
+			r.stm.SendElement(iq.InternalServerError())
+			return
+		}
+		// changes can only be computed from versions whose deletions are still remembered
+		if clientVer, err := strconv.Atoi(ver); err == nil && clientVer >= rv.PrunedVer && clientVer <= rv.Ver {
+			r.stm.SendElement(result)
+			if err := r.pushRosterChanges(items, clientVer); err != nil {
+				r.errHandler(err)
+			}
+			r.setRequested()
+			return
+		}
+		q.SetAttribute("ver", strconv.Itoa(rv.Ver))
+	}
 	for _, item := range items {
 		q.AppendElement(r.elementFromRosterItem(&item))
 	}
 	result.AppendElement(q)
 	r.stm.SendElement(result)
 
+	r.setRequested()
+}
+
+// pushRosterChanges pushes to the associated stream every roster
+// item modified or deleted after afterVer version, in version order.
+func (r *ModRoster) pushRosterChanges(items []model.RosterItem, afterVer int) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	rts, err := storage.Instance().FetchRosterTombstones(ctx, r.stm.Username(), afterVer)
+	if err != nil {
+		return err
+	}
+	var changes []model.RosterItem
+	for _, item := range items {
+		if item.Ver > afterVer {
+			changes = append(changes, item)
+		}
+	}
+	for _, rt := range rts {
+		changes = append(changes, model.RosterItem{
+			User:         rt.User,
+			Contact:      rt.Contact,
+			Subscription: subscriptionRemove,
+			Ver:          rt.Ver,
+		})
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Ver < changes[j].Ver })
+
+	for i := range changes {
+		query := xml.NewElementNamespace("query", rosterNamespace)
+		query.SetAttribute("ver", strconv.Itoa(changes[i].Ver))
+		query.AppendElement(r.elementFromRosterItem(&changes[i]))
+
+		pushEl := xml.NewIQType(uuid.New(), xml.SetType)
+		pushEl.SetTo(r.stm.JID().String())
+		pushEl.AppendElement(query)
+		r.stm.SendElement(pushEl)
+	}
+	return nil
+}
+
+func (r *ModRoster) setRequested() {
 	r.lock.Lock()
 	r.requested = true
 	r.lock.Unlock()
 }
 
+// rosterVersionAttribute returns roster query 'ver' attribute value,
+// reporting whether or not the client requested roster versioning.
+func rosterVersionAttribute(query xml.Element) (string, bool) {
+	for _, attr := range query.Attributes() {
+		if attr.Label == "ver" {
+			return attr.Value, true
+		}
+	}
+	return "", false
+}
+
 func (r *ModRoster) updateRoster(iq *xml.IQ, query xml.Element) {
 	items := query.FindElements("item")
 	if len(items) != 1 {
@@ -426,9 +692,6 @@ func (r *ModRoster) removeRosterItem(ri *model.RosterItem) error {
 		userRi.Subscription = subscriptionRemove
 		userRi.Ask = false
 
-		if err := r.deleteRosterNotification(userJID, contactJID); err != nil {
-			return err
-		}
 		if err := rosterTable.deleteRosterItem(userRi); err != nil {
 			return err
 		}
@@ -446,20 +709,19 @@ func (r *ModRoster) removeRosterItem(ri *model.RosterItem) error {
 			if contactRi.Subscription == subscriptionFrom || contactRi.Subscription == subscriptionBoth {
 				r.routePresencesFrom(contactJID, userJID, xml.UnavailableType)
 			}
-			switch contactRi.Subscription {
-			case subscriptionBoth:
-				contactRi.Subscription = subscriptionTo
-				if err := r.pushRosterItem(contactRi, contactJID); err != nil {
-					return err
-				}
-				fallthrough
-			default:
-				contactRi.Subscription = subscriptionNone
-				if err := r.pushRosterItem(contactRi, contactJID); err != nil {
+			contactSubscription := contactRi.Subscription
+			contactRi.Subscription = subscriptionNone
+			if err := rosterTable.insertOrUpdateRosterItem(contactRi); err != nil {
+				return err
+			}
+			if contactSubscription == subscriptionBoth {
+				intermediateRi := *contactRi
+				intermediateRi.Subscription = subscriptionTo
+				if err := r.pushRosterItem(&intermediateRi, contactJID); err != nil {
 					return err
 				}
 			}
-			if err := rosterTable.insertOrUpdateRosterItem(contactRi); err != nil {
+			if err := r.pushRosterItem(contactRi, contactJID); err != nil {
 				return err
 			}
 		}
@@ -565,9 +827,6 @@ func (r *ModRoster) processSubscribed(presence *xml.Presence) error {
 
 	log.Infof("processing 'subscribed' - user: %s (%s/%s)", userJID, r.stm.Username(), r.stm.Resource())
 
-	if err := r.deleteRosterNotification(userJID, contactJID); err != nil {
-		return err
-	}
 	contactRi, err := rosterTable.fetchRosterItem(contactJID.Node(), userJID.Node())
 	if err != nil {
 		return err
@@ -588,7 +847,7 @@ func (r *ModRoster) processSubscribed(presence *xml.Presence) error {
 			Ask:          false,
 		}
 	}
-	if err := rosterTable.insertOrUpdateRosterItem(contactRi); err != nil {
+	if err := rosterTable.approveSubscription(userJID.Node(), contactJID.Node(), contactRi); err != nil {
 		return err
 	}
 	if err := r.pushRosterItem(contactRi, contactJID); err != nil {
@@ -746,21 +1005,80 @@ func (r *ModRoster) processUnsubscribed(presence *xml.Presence) error {
 	return nil
 }
 
+// processProbe answers a presence probe with the current presence of
+// every contact resource, as long as user is subscribed to it.
+// Answers are reused for probeAnswerTTL, so that repeated probes
+// don't require walking through contact resources every time.
+func (r *ModRoster) processProbe(presence *xml.Presence) error {
+	contactJID := presence.ToJID().ToBareJID()
+	if !r.isLocalJID(contactJID) {
+		// TODO(ortuman): Implement XMPP federation
+		return nil
+	}
+	now := time.Now()
+	probeKey := contactJID.Key()
+	answer := r.probes[probeKey]
+	if answer == nil || now.After(answer.expiresAt) {
+		ri, err := rosterTable.fetchRosterItem(r.stm.Username(), contactJID.Node())
+		if err != nil {
+			return err
+		}
+		answer = &probeAnswer{expiresAt: now.Add(probeAnswerTTL)}
+		if ri != nil && (ri.Subscription == subscriptionTo || ri.Subscription == subscriptionBoth) {
+			answer.presences = r.contactPresences(contactJID)
+		}
+		for k, a := range r.probes {
+			if now.After(a.expiresAt) {
+				delete(r.probes, k)
+			}
+		}
+		r.probes[probeKey] = answer
+	}
+	for _, p := range answer.presences {
+		r.stm.SendElement(p)
+	}
+	return nil
+}
+
+func (r *ModRoster) contactPresences(contactJID *xml.JID) []*xml.Presence {
+	var presences []*xml.Presence
+	for _, contactStream := range c2s.Instance().AvailableStreams(contactJID.Node()) {
+		p := xml.NewPresence(contactStream.JID(), r.stm.JID(), xml.AvailableType)
+		p.AppendElements(contactStream.PresenceElements())
+		presences = append(presences, p)
+	}
+	if len(presences) == 0 {
+		presences = append(presences, xml.NewPresence(contactJID, r.stm.JID(), xml.UnavailableType))
+	}
+	return presences
+}
+
 func (r *ModRoster) insertOrUpdateRosterNotification(userJID *xml.JID, contactJID *xml.JID, presence *xml.Presence) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	rn := &model.RosterNotification{
 		User:     userJID.Node(),
 		Contact:  contactJID.Node(),
 		Elements: presence.Elements(),
 	}
-	return storage.Instance().InsertOrUpdateRosterNotification(rn)
+	return storage.Instance().InsertOrUpdateRosterNotification(ctx, rn)
 }
 
 func (r *ModRoster) deleteRosterNotification(userJID *xml.JID, contactJID *xml.JID) error {
-	return storage.Instance().DeleteRosterNotification(userJID.Node(), contactJID.Node())
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	return storage.Instance().DeleteRosterNotification(ctx, userJID.Node(), contactJID.Node())
 }
 
 func (r *ModRoster) pushRosterItem(ri *model.RosterItem, to *xml.JID) error {
+	rostersync.Publish(ri)
+
 	query := xml.NewElementNamespace("query", rosterNamespace)
+	if ri.Ver > 0 {
+		query.SetAttribute("ver", strconv.Itoa(ri.Ver))
+	}
 	query.AppendElement(r.elementFromRosterItem(ri))
 
 	streams := c2s.Instance().AvailableStreams(to.Node())
@@ -791,10 +1109,22 @@ func (r *ModRoster) routePresencesFrom(from *xml.JID, to *xml.JID, presenceType
 	}
 }
 
+func (r *ModRoster) allowsPresence(presence *xml.Presence, to *xml.JID) bool {
+	for _, filter := range r.presenceFilters {
+		if !filter(presence, to) {
+			return false
+		}
+	}
+	return true
+}
+
 func (r *ModRoster) routePresence(presence *xml.Presence, to *xml.JID) {
 	if c2s.Instance().IsLocalDomain(to.Domain()) {
 		toStreams := c2s.Instance().AvailableStreams(to.Node())
 		for _, toStream := range toStreams {
+			if !r.allowsPresence(presence, toStream.JID()) {
+				continue
+			}
 			p := xml.NewPresence(presence.FromJID(), toStream.JID(), presence.Type())
 			p.AppendElements(presence.Elements())
 			toStream.SendElement(p)
@@ -6,9 +6,12 @@
 package module
 
 import (
+	"context"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/rostersync"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -79,7 +82,7 @@ func TestRoster_FetchRoster(t *testing.T) {
 		Ask:          true,
 		Groups:       []string{"people", "friends"},
 	}
-	storage.Instance().InsertOrUpdateRosterItem(ri)
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), ri)
 
 	r = NewRoster(stm)
 	r.ProcessIQ(iq)
@@ -92,7 +95,7 @@ func TestRoster_FetchRoster(t *testing.T) {
 	require.True(t, r.IsRequested())
 	r.Done()
 
-	storage.ActivateMockedError()
+	storage.ActivateMockedErrorFor("FetchRosterItemsOfUsers")
 	r = NewRoster(stm)
 	r.ProcessIQ(iq)
 	elem = stm.FetchElement()
@@ -113,7 +116,7 @@ func TestRoster_DeliverPendingApprovalNotifications(t *testing.T) {
 		Contact:  "ortuman",
 		Elements: []xml.Element{xml.NewElementName("group")},
 	}
-	storage.Instance().InsertOrUpdateRosterNotification(&rn)
+	storage.Instance().InsertOrUpdateRosterNotification(context.Background(), &rn)
 
 	stm, _ := tUtilRosterInitializeRoster()
 
@@ -153,7 +156,7 @@ func TestRoster_ReceiveAndBroadcastPresence(t *testing.T) {
 		Name:         "My Juliet",
 		Subscription: subscriptionBoth,
 	}
-	storage.Instance().InsertOrUpdateRosterItem(ri)
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), ri)
 
 	r := NewRoster(stm1)
 	defer r.Done()
@@ -205,6 +208,195 @@ func TestRoster_ReceiveAndBroadcastPresence(t *testing.T) {
 	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
 }
 
+func TestRoster_Probe(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm1, stm2 := tUtilRosterInitializeRoster()
+	tUtilRosterInsertRosterItems()
+
+	r := NewRoster(stm1)
+	defer r.Done()
+
+	// not subscribed contacts are never revealed...
+	romeo, _ := xml.NewJID("romeo", "jackal.im", "", true)
+	r.ProcessPresence(xml.NewPresence(stm1.JID(), romeo, xml.ProbeType))
+
+	r.ProcessPresence(xml.NewPresence(stm1.JID(), stm2.JID().ToBareJID(), xml.ProbeType))
+	elem := stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "noelia@jackal.im/garden", elem.From())
+
+	// repeated probes are answered from cache...
+	c2s.Instance().UnregisterStream(stm2)
+	for i := 0; i < 3; i++ {
+		r.ProcessPresence(xml.NewPresence(stm1.JID(), stm2.JID().ToBareJID(), xml.ProbeType))
+		elem = stm1.FetchElement()
+		require.Equal(t, xml.AvailableType, elem.Type())
+		require.Equal(t, "noelia@jackal.im/garden", elem.From())
+	}
+
+	// ...until answer expires
+	r.actor.run(func() {
+		for _, answer := range r.probes {
+			answer.expiresAt = time.Now()
+		}
+	})
+	r.ProcessPresence(xml.NewPresence(stm1.JID(), stm2.JID().ToBareJID(), xml.ProbeType))
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "noelia@jackal.im", elem.From())
+}
+
+func TestRoster_ProcessInitialPresence(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	rn := model.RosterNotification{
+		User:     "romeo",
+		Contact:  "ortuman",
+		Elements: []xml.Element{},
+	}
+	storage.Instance().InsertOrUpdateRosterNotification(context.Background(), &rn)
+	tUtilRosterInsertRosterItems()
+
+	stm1, stm2 := tUtilRosterInitializeRoster()
+
+	r := NewRoster(stm1)
+	defer r.Done()
+
+	var prefetched bool
+	prefetch := []func() error{func() error {
+		prefetched = true
+		return nil
+	}}
+	ch := make(chan struct{})
+	presence := xml.NewPresence(stm1.JID(), stm1.JID().ToBareJID(), xml.AvailableType)
+	r.ProcessInitialPresence(presence, prefetch, func() {
+		close(ch)
+	})
+	<-ch
+	require.True(t, prefetched)
+
+	// pending notifications must precede contacts presences
+	elem := stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.SubscribeType, elem.Type())
+	require.Equal(t, "romeo@jackal.im", elem.From())
+
+	elem = stm1.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "noelia@jackal.im/garden", elem.From())
+
+	elem = stm2.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+
+	// storage failure...
+	storage.ActivateMockedError()
+	errCh := make(chan bool)
+	r.errHandler = func(error) {
+		close(errCh)
+	}
+	r.ProcessInitialPresence(presence, nil, nil)
+	<-errCh
+	storage.DeactivateMockedError()
+}
+
+func BenchmarkRoster_ProcessInitialPresence(b *testing.B) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	tUtilRosterInsertRosterItems()
+
+	stm1, stm2 := tUtilRosterInitializeRoster()
+
+	r := NewRoster(stm1)
+	defer r.Done()
+
+	storage.SetMockedLatency(time.Millisecond * 50)
+	defer storage.SetMockedLatency(0)
+
+	prefetch := []func() error{func() error {
+		_, err := storage.Instance().CountOfflineMessages(context.Background(), "ortuman")
+		return err
+	}}
+	presence := xml.NewPresence(stm1.JID(), stm1.JID().ToBareJID(), xml.AvailableType)
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ch := make(chan struct{})
+		r.ProcessInitialPresence(presence, prefetch, func() { close(ch) })
+		<-ch
+		stm1.FetchElement()
+		stm2.FetchElement()
+		rosterTable.unloadRoster("ortuman")
+	}
+}
+
+func TestRosterMap_LoadRoster(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	users := []string{"ortuman", "romeo", "juliet", "ortuman"}
+	for _, user := range users[:2] {
+		ri := &model.RosterItem{User: user, Contact: "noelia", Subscription: subscriptionBoth}
+		storage.Instance().InsertOrUpdateRosterItem(context.Background(), ri)
+	}
+	rm := rosterMap{
+		cache: map[string]*roster{},
+		loads: map[string]*rosterLoad{},
+	}
+	// concurrent loads get batched
+	storage.SetMockedLatency(time.Millisecond * 50)
+	errCh := make(chan error, len(users))
+	for _, user := range users {
+		go func(user string) { errCh <- rm.loadRoster(user) }(user)
+	}
+	for range users {
+		require.Nil(t, <-errCh)
+	}
+	storage.SetMockedLatency(0)
+	calls := storage.MockedCalls("FetchRosterItemsOfUsers")
+	require.True(t, calls >= 1 && calls <= 3)
+
+	// loaded rosters are served from cache
+	storage.ResetMockedCalls()
+	for _, user := range users[:2] {
+		items, err := rm.fetchRosterItems(user)
+		require.Nil(t, err)
+		require.Equal(t, 1, len(items))
+		require.Equal(t, "noelia", items[0].Contact)
+	}
+	items, err := rm.fetchRosterItems("juliet")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(items))
+	require.Equal(t, 3, len(rm.cache))
+	require.Equal(t, 0, storage.MockedCalls("FetchRosterItems"))
+
+	// storage failure...
+	storage.ActivateMockedErrorFor("FetchRosterItemsOfUsers")
+	defer storage.DeactivateMockedError()
+	require.Equal(t, storage.ErrMockedError, rm.loadRoster("noelia"))
+
+	rm.loadMu.Lock()
+	defer rm.loadMu.Unlock()
+	require.Equal(t, 0, len(rm.loads))
+	require.Equal(t, 0, len(rm.queued))
+}
+
 func TestRoster_Update(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
@@ -247,13 +439,54 @@ func TestRoster_Update(t *testing.T) {
 	require.Equal(t, xml.ResultType, elem.Type())
 	require.Equal(t, iqID, elem.ID())
 
-	ri, err := storage.Instance().FetchRosterItem("ortuman", "noelia")
+	ri, err := storage.Instance().FetchRosterItem(context.Background(), "ortuman", "noelia")
 	require.Nil(t, err)
 	require.NotNil(t, ri)
 	require.Equal(t, "ortuman", ri.User)
 	require.Equal(t, "noelia", ri.Contact)
 }
 
+func TestRoster_RosterSync(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	rostersync.Initialize(&config.RosterSync{Port: 9092})
+	defer rostersync.Shutdown()
+
+	w, err := rostersync.Instance().Subscribe("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(w.Snapshot.Items))
+
+	stm1, _ := tUtilRosterInitializeRoster()
+
+	r := NewRoster(stm1)
+	defer r.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	q := xml.NewElementNamespace("query", rosterNamespace)
+	item := xml.NewElementName("item")
+	item.SetAttribute("jid", "noelia@jackal.im")
+	item.SetAttribute("name", "My Juliet")
+	q.AppendElement(item)
+	iq.AppendElement(q)
+
+	r.ProcessIQ(iq)
+	e := <-w.Events()
+	require.Equal(t, rostersync.UpdateEventType, e.Type)
+	require.Equal(t, uint64(1), e.Version)
+	require.Equal(t, "noelia", e.Items[0].Contact)
+	require.Equal(t, "My Juliet", e.Items[0].Name)
+
+	item.SetAttribute("subscription", subscriptionRemove)
+	r.ProcessIQ(iq)
+	e = <-w.Events()
+	require.Equal(t, uint64(2), e.Version)
+	require.Equal(t, subscriptionRemove, e.Items[0].Subscription)
+}
+
 func TestRoster_Subscribe(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
@@ -292,7 +525,7 @@ func TestRoster_Subscribed(t *testing.T) {
 		Name:         "My Juliet",
 		Subscription: subscriptionNone,
 	}
-	storage.Instance().InsertOrUpdateRosterItem(ri)
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), ri)
 
 	// insert roster approval notification...
 	rn := &model.RosterNotification{
@@ -300,7 +533,7 @@ func TestRoster_Subscribed(t *testing.T) {
 		Contact:  "noelia",
 		Elements: []xml.Element{},
 	}
-	storage.Instance().InsertOrUpdateRosterNotification(rn)
+	storage.Instance().InsertOrUpdateRosterNotification(context.Background(), rn)
 
 	stm1, stm2 := tUtilRosterInitializeRoster()
 
@@ -333,11 +566,11 @@ func TestRoster_Subscribed(t *testing.T) {
 	iRes := qRes.FindElement("item")
 	require.Equal(t, subscriptionFrom, iRes.Attribute("subscription"))
 
-	rns, err := storage.Instance().FetchRosterNotifications("noelia")
+	rns, err := storage.Instance().FetchRosterNotifications(context.Background(), "noelia")
 	require.Nil(t, err)
 	require.Equal(t, 0, len(rns))
 
-	ri, err = storage.Instance().FetchRosterItem("ortuman", "noelia")
+	ri, err = storage.Instance().FetchRosterItem(context.Background(), "ortuman", "noelia")
 	require.Nil(t, err)
 	require.Equal(t, subscriptionTo, ri.Subscription)
 }
@@ -513,8 +746,8 @@ func tUtilRosterInsertRosterItems() {
 		Name:         "My Romeo",
 		Subscription: subscriptionBoth,
 	}
-	storage.Instance().InsertOrUpdateRosterItem(ri1)
-	storage.Instance().InsertOrUpdateRosterItem(ri2)
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), ri1)
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), ri2)
 }
 
 func tUtilRosterRequestRoster(r *ModRoster, stm *c2s.MockStream) {
@@ -553,3 +786,134 @@ func tUtilRosterInitializeRoster() (*c2s.MockStream, *c2s.MockStream) {
 
 	return stm1, stm2
 }
+
+func TestRoster_SubscriptionHandshake(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+
+	romeo := h.Connect("romeo", "orchard")
+	juliet := h.Connect("juliet", "balcony")
+	h.Send(romeo, xml.NewPresence(romeo.JID(), romeo.JID().ToBareJID(), xml.AvailableType))
+	h.Send(juliet, xml.NewPresence(juliet.JID(), juliet.JID().ToBareJID(), xml.AvailableType))
+
+	rosterPush := isStanza("iq", xml.SetType).with("query", rosterNamespace)
+	subscription := func(elem xml.Element) string {
+		return elem.FindElementNamespace("query", rosterNamespace).FindElement("item").Attribute("subscription")
+	}
+
+	// romeo requests juliet's presence...
+	h.Send(romeo, xml.NewPresence(romeo.JID(), juliet.JID().ToBareJID(), xml.SubscribeType))
+	elem := h.ExpectStanza(romeo, rosterPush, harnessTimeout)
+	require.Equal(t, subscriptionNone, subscription(elem))
+	h.ExpectStanza(juliet, isStanza("presence", xml.SubscribeType).from("romeo@jackal.im"), harnessTimeout)
+
+	// ...and juliet approves it
+	h.Send(juliet, xml.NewPresence(juliet.JID(), romeo.JID().ToBareJID(), xml.SubscribedType))
+	elem = h.ExpectStanza(juliet, rosterPush, harnessTimeout)
+	require.Equal(t, subscriptionFrom, subscription(elem))
+	elem = h.ExpectStanza(romeo, rosterPush, harnessTimeout)
+	require.Equal(t, subscriptionTo, subscription(elem))
+	h.ExpectStanza(romeo, isStanza("presence", xml.SubscribedType).from("juliet@jackal.im"), harnessTimeout)
+	h.ExpectStanza(romeo, isStanza("presence", xml.AvailableType).from("juliet@jackal.im/balcony"), harnessTimeout)
+
+	// juliet requests romeo's presence back
+	h.Send(juliet, xml.NewPresence(juliet.JID(), romeo.JID().ToBareJID(), xml.SubscribeType))
+	h.ExpectStanza(romeo, isStanza("presence", xml.SubscribeType).from("juliet@jackal.im"), harnessTimeout)
+	h.Send(romeo, xml.NewPresence(romeo.JID(), juliet.JID().ToBareJID(), xml.SubscribedType))
+	elem = h.ExpectStanza(romeo, rosterPush, harnessTimeout)
+	require.Equal(t, subscriptionBoth, subscription(elem))
+	h.ExpectStanza(juliet, isStanza("presence", xml.AvailableType).from("romeo@jackal.im/orchard"), harnessTimeout)
+
+	// presence updates are now delivered on both directions
+	h.Send(juliet, xml.NewPresence(juliet.JID(), juliet.JID().ToBareJID(), xml.UnavailableType))
+	h.ExpectStanza(romeo, isStanza("presence", xml.UnavailableType).from("juliet@jackal.im/balcony"), harnessTimeout)
+	h.Send(romeo, xml.NewPresence(romeo.JID(), romeo.JID().ToBareJID(), xml.UnavailableType))
+	h.ExpectStanza(juliet, isStanza("presence", xml.UnavailableType).from("romeo@jackal.im/orchard"), harnessTimeout)
+
+	ri, err := storage.Instance().FetchRosterItem(context.Background(), "romeo", "juliet")
+	require.Nil(t, err)
+	require.Equal(t, subscriptionBoth, ri.Subscription)
+}
+
+func TestRoster_Versioning(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+
+	romeo := h.Connect("romeo", "orchard")
+	require.Equal(t, []xml.Element{xml.NewElementNamespace("ver", rosterVersioningNamespace)}, romeo.roster.StreamFeatures())
+
+	rosterQuery := func(ver *string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.GetType)
+		q := xml.NewElementNamespace("query", rosterNamespace)
+		if ver != nil {
+			q.SetAttribute("ver", *ver)
+		}
+		iq.AppendElement(q)
+		return iq
+	}
+	updateItem := func(u *harnessUser, contact, subscription string) {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		q := xml.NewElementNamespace("query", rosterNamespace)
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", contact+"@jackal.im")
+		item.SetAttribute("subscription", subscription)
+		q.AppendElement(item)
+		iq.AppendElement(q)
+		h.Send(u, iq)
+		h.ExpectStanza(u, isStanza("iq", xml.SetType).with("query", rosterNamespace), harnessTimeout)
+		h.ExpectStanza(u, isStanza("iq", xml.ResultType), harnessTimeout)
+	}
+	updateItem(romeo, "juliet", subscriptionNone)
+	updateItem(romeo, "mercutio", subscriptionNone)
+
+	// initial versioned request
+	emptyVer := ""
+	h.Send(romeo, rosterQuery(&emptyVer))
+	elem := h.ExpectStanza(romeo, isStanza("iq", xml.ResultType).with("query", rosterNamespace), harnessTimeout)
+	q := elem.FindElementNamespace("query", rosterNamespace)
+	require.Equal(t, 2, q.ElementsCount())
+	ver := q.Attribute("ver")
+	require.Equal(t, "2", ver)
+
+	updateItem(romeo, "juliet", subscriptionNone)
+	updateItem(romeo, "mercutio", subscriptionRemove)
+
+	// changes since ver are pushed after an empty result
+	h.Send(romeo, rosterQuery(&ver))
+	elem = h.ExpectStanza(romeo, isStanza("iq", xml.ResultType), harnessTimeout)
+	require.Nil(t, elem.FindElementNamespace("query", rosterNamespace))
+
+	rosterPush := isStanza("iq", xml.SetType).with("query", rosterNamespace)
+	elem = h.ExpectStanza(romeo, rosterPush, harnessTimeout)
+	q = elem.FindElementNamespace("query", rosterNamespace)
+	require.Equal(t, "3", q.Attribute("ver"))
+	require.Equal(t, "juliet@jackal.im", q.FindElement("item").Attribute("jid"))
+
+	elem = h.ExpectStanza(romeo, rosterPush, harnessTimeout)
+	q = elem.FindElementNamespace("query", rosterNamespace)
+	require.Equal(t, "4", q.Attribute("ver"))
+	require.Equal(t, "mercutio@jackal.im", q.FindElement("item").Attribute("jid"))
+	require.Equal(t, subscriptionRemove, q.FindElement("item").Attribute("subscription"))
+
+	// up to date
+	currentVer := "4"
+	h.Send(romeo, rosterQuery(&currentVer))
+	elem = h.ExpectStanza(romeo, isStanza("iq", xml.ResultType), harnessTimeout)
+	require.Nil(t, elem.FindElementNamespace("query", rosterNamespace))
+	h.ExpectNoStanza(romeo, rosterPush, time.Millisecond*50)
+
+	// deletions no longer remembered
+	_, err := storage.Instance().PruneRosterTombstones(context.Background(), time.Now())
+	require.Nil(t, err)
+
+	h.Send(romeo, rosterQuery(&ver))
+	elem = h.ExpectStanza(romeo, isStanza("iq", xml.ResultType).with("query", rosterNamespace), harnessTimeout)
+	q = elem.FindElementNamespace("query", rosterNamespace)
+	require.Equal(t, "4", q.Attribute("ver"))
+	require.Equal(t, 1, q.ElementsCount())
+
+	// unversioned requests
+	h.Send(romeo, rosterQuery(nil))
+	elem = h.ExpectStanza(romeo, isStanza("iq", xml.ResultType).with("query", rosterNamespace), harnessTimeout)
+	require.Equal(t, "", elem.FindElementNamespace("query", rosterNamespace).Attribute("ver"))
+}
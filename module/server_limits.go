@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+)
+
+const serverLimitsFormType = "urn:xmpp:serverlimits:0"
+
+// ServerLimits represents the limits a server imposes on its
+// clients, zero values meaning the limit is not enforced.
+type ServerLimits struct {
+	MaxStanzaSize      int
+	MaxOfflineMessages int
+}
+
+// ServerLimitsFromConfig returns the limits imposed by a server configuration.
+func ServerLimitsFromConfig(cfg *config.Server) ServerLimits {
+	var l ServerLimits
+	l.MaxStanzaSize = cfg.LargePayload.MaxStanzaSize
+	if _, ok := cfg.Modules["offline"]; ok {
+		l.MaxOfflineMessages = cfg.ModOffline.QueueSize
+	}
+	return l
+}
+
+// Form returns limits as a disco info extension form (https://xmpp.org/extensions/xep-0128.html),
+// leaving out every non enforced limit.
+func (l ServerLimits) Form() xml.Element {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "result")
+	form.AppendElement(limitsFieldElement("FORM_TYPE", "hidden", serverLimitsFormType))
+	if l.MaxStanzaSize > 0 {
+		form.AppendElement(limitsFieldElement("max-stanza-size", "", strconv.Itoa(l.MaxStanzaSize)))
+	}
+	if l.MaxOfflineMessages > 0 {
+		form.AppendElement(limitsFieldElement("max-offline-messages", "", strconv.Itoa(l.MaxOfflineMessages)))
+	}
+	return form
+}
+
+func limitsFieldElement(name, typ, value string) xml.Element {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", name)
+	if len(typ) > 0 {
+		field.SetAttribute("type", typ)
+	}
+	valueEl := xml.NewElementName("value")
+	valueEl.SetText(value)
+	field.AppendElement(valueEl)
+	return field
+}
+
+// serverLimits holds the current limits of every server,
+// so that reloaded values get advertised to already connected streams.
+var serverLimits = struct {
+	mu     sync.RWMutex
+	limits map[string]ServerLimits
+}{limits: make(map[string]ServerLimits)}
+
+// UpdateServerLimits sets the limits advertised for srvID server.
+func UpdateServerLimits(srvID string, limits ServerLimits) {
+	serverLimits.mu.Lock()
+	serverLimits.limits[srvID] = limits
+	serverLimits.mu.Unlock()
+}
+
+// CurrentServerLimits returns the limits currently advertised for srvID server.
+func CurrentServerLimits(srvID string) ServerLimits {
+	serverLimits.mu.RLock()
+	defer serverLimits.mu.RUnlock()
+	return serverLimits.limits[srvID]
+}
@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerLimits_FromConfig(t *testing.T) {
+	cfg := &config.Server{
+		LargePayload: config.LargePayload{MaxStanzaSize: 1024},
+		ModOffline:   config.ModOffline{QueueSize: 10},
+	}
+	// offline module not enabled
+	require.Equal(t, ServerLimits{MaxStanzaSize: 1024}, ServerLimitsFromConfig(cfg))
+
+	cfg.Modules = map[string]struct{}{"offline": {}}
+	require.Equal(t, ServerLimits{MaxStanzaSize: 1024, MaxOfflineMessages: 10}, ServerLimitsFromConfig(cfg))
+}
+
+func TestServerLimits_Form(t *testing.T) {
+	form := ServerLimits{}.Form()
+	require.Equal(t, dataFormNamespace, form.Namespace())
+	require.Equal(t, 1, form.ElementsCount())
+	require.Equal(t, serverLimitsFormType, form.Elements()[0].Elements()[0].Text())
+
+	form = ServerLimits{MaxStanzaSize: 1024, MaxOfflineMessages: 10}.Form()
+	require.Equal(t, 3, form.ElementsCount())
+	require.Equal(t, "max-stanza-size", form.Elements()[1].Attribute("var"))
+	require.Equal(t, "1024", form.Elements()[1].Elements()[0].Text())
+	require.Equal(t, "max-offline-messages", form.Elements()[2].Attribute("var"))
+	require.Equal(t, "10", form.Elements()[2].Elements()[0].Text())
+}
+
+func TestServerLimits_Update(t *testing.T) {
+	require.Equal(t, ServerLimits{}, CurrentServerLimits("limits_test"))
+
+	UpdateServerLimits("limits_test", ServerLimits{MaxStanzaSize: 1024})
+	require.Equal(t, ServerLimits{MaxStanzaSize: 1024}, CurrentServerLimits("limits_test"))
+
+	UpdateServerLimits("limits_test", ServerLimits{MaxStanzaSize: 2048})
+	require.Equal(t, ServerLimits{MaxStanzaSize: 2048}, CurrentServerLimits("limits_test"))
+}
@@ -0,0 +1,224 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"strconv"
+	"sync"
+
+	"github.com/ortuman/jackal/bounce"
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/spam"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	spamNamespace       = "urn:jackal:spam:0"
+	quarantineNamespace = "urn:jackal:quarantine:0"
+)
+
+const defaultQuarantineSize = 100
+
+// heuristics holds the built-in scorers shared by every
+// stream spam module configured by the same settings.
+var (
+	heuristicsMu sync.Mutex
+	heuristics   = make(map[*config.SpamHeuristic]*spam.Heuristic)
+)
+
+// ModSpam represents a first contact spam filtering server stream module.
+// Messages sent to local users that didn't subscribe the sender to its
+// presence are scored, being marked, quarantined or bounced according
+// to configured thresholds. Quarantined messages can be retrieved
+// and purged by its recipient.
+type ModSpam struct {
+	cfg   *config.ModSpam
+	strm  c2s.Stream
+	actor *actor
+	guard doneGuard
+}
+
+// NewSpam returns a spam filtering module.
+func NewSpam(cfg *config.ModSpam, strm c2s.Stream) *ModSpam {
+	s := &ModSpam{
+		cfg:   cfg,
+		strm:  strm,
+		actor: newActor(nil),
+	}
+	return s
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with spam module.
+func (s *ModSpam) AssociatedNamespaces() []string {
+	return []string{quarantineNamespace}
+}
+
+// Done signals stream termination.
+func (s *ModSpam) Done() {
+	s.guard.done()
+	s.actor.done()
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the spam module.
+func (s *ModSpam) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("query", quarantineNamespace) != nil
+}
+
+// ProcessIQ processes a quarantine IQ taking according actions
+// over the associated stream.
+func (s *ModSpam) ProcessIQ(iq *xml.IQ) {
+	s.actor.run(func() {
+		toJid := iq.ToJID()
+		if !toJid.IsServer() && toJid.Node() != s.strm.Username() {
+			s.strm.SendElement(iq.ForbiddenError())
+			return
+		}
+		q := iq.FindElementNamespace("query", quarantineNamespace)
+		switch {
+		case iq.IsGet() && q.ElementsCount() == 0:
+			s.sendQuarantine(iq)
+		case iq.IsSet() && q.FindElement("purge") != nil:
+			s.purgeQuarantine(iq)
+		default:
+			s.strm.SendElement(iq.BadRequestError())
+		}
+	})
+}
+
+// InterceptMessage scores first contact messages, consuming
+// those that have been either quarantined or bounced.
+func (s *ModSpam) InterceptMessage(message *xml.Message) bool {
+	if !s.guard.enter() {
+		return false
+	}
+	defer s.guard.leave()
+
+	if !message.IsMessageWithBody() {
+		return false
+	}
+	toJid := message.ToJID()
+	if len(toJid.Node()) == 0 || toJid.Node() == s.strm.Username() || !c2s.Instance().IsLocalDomain(toJid.Domain()) {
+		return false
+	}
+	if s.isSubscribed(toJid.Node()) {
+		return false
+	}
+	score := s.scorer().Score(message, spam.SenderInfo{JID: s.strm.JID(), Recipient: toJid})
+	switch {
+	case thresholdReached(s.cfg.BounceThreshold, score):
+		log.Infof("bounced spam message... id: %s (score: %.2f)", message.ID(), score)
+		if resp := bounce.Response(message, bounce.Spam, nil); resp != nil {
+			s.strm.SendElement(resp)
+		}
+		return true
+
+	case thresholdReached(s.cfg.QuarantineThreshold, score):
+		s.actor.run(func() {
+			s.quarantine(message, score)
+		})
+		return true
+
+	case thresholdReached(s.cfg.MarkThreshold, score):
+		mark := xml.NewElementNamespace("spam", spamNamespace)
+		mark.SetAttribute("score", strconv.FormatFloat(score, 'f', 2, 64))
+		message.AppendElement(mark)
+	}
+	return false
+}
+
+// isSubscribed returns whether or not stream user is subscribed to
+// recipient presence. Messages are not filtered on storage failure.
+func (s *ModSpam) isSubscribed(recipient string) bool {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	ri, err := storage.Instance().FetchRosterItem(ctx, recipient, s.strm.Username())
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	return ri != nil && (ri.Subscription == subscriptionFrom || ri.Subscription == subscriptionBoth)
+}
+
+func (s *ModSpam) scorer() spam.Scorer {
+	if scorer := spam.Registered(); scorer != nil {
+		return scorer
+	}
+	heuristicsMu.Lock()
+	defer heuristicsMu.Unlock()
+	h := heuristics[&s.cfg.Heuristic]
+	if h == nil {
+		h = spam.NewHeuristic(&s.cfg.Heuristic)
+		heuristics[&s.cfg.Heuristic] = h
+	}
+	return h
+}
+
+func (s *ModSpam) quarantine(message *xml.Message, score float64) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	recipient := message.ToJID().Node()
+	queueSize, err := storage.Instance().CountQuarantinedMessages(ctx, recipient)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	quarantineSize := s.cfg.QuarantineSize
+	if quarantineSize == 0 {
+		quarantineSize = defaultQuarantineSize
+	}
+	if queueSize >= quarantineSize {
+		log.Infof("discarded spam message, quarantine is full... id: %s (score: %.2f)", message.ID(), score)
+		return
+	}
+	delayed := message.Copy()
+	delayed.Delay(s.strm.Domain(), "Quarantine")
+	if err := storage.Instance().InsertQuarantinedMessage(ctx, delayed, recipient); err != nil {
+		log.Error(err)
+		return
+	}
+	log.Infof("quarantined spam message... id: %s (score: %.2f)", message.ID(), score)
+}
+
+func (s *ModSpam) sendQuarantine(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	messages, err := storage.Instance().FetchQuarantinedMessages(ctx, s.strm.Username())
+	if err != nil {
+		log.Error(err)
+		s.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	q := xml.NewElementNamespace("query", quarantineNamespace)
+	q.AppendElements(messages)
+
+	result := iq.ResultIQ()
+	result.AppendElement(q)
+	s.strm.SendElement(result)
+}
+
+func (s *ModSpam) purgeQuarantine(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().DeleteQuarantinedMessages(ctx, s.strm.Username()); err != nil {
+		log.Error(err)
+		s.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	s.strm.SendElement(iq.ResultIQ())
+}
+
+func thresholdReached(threshold, score float64) bool {
+	return threshold > 0 && score >= threshold
+}
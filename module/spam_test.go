@@ -0,0 +1,152 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/spam"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedSpamScorer float64
+
+func (s fixedSpamScorer) Score(_ xml.Element, _ spam.SenderInfo) float64 { return float64(s) }
+
+func TestSpam_Quarantine(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+
+	cfg := &config.ModSpam{MarkThreshold: 1, QuarantineThreshold: 2}
+	withSpam := func(strm c2s.Stream) Module { return NewSpam(cfg, strm) }
+
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: subscriptionBoth})
+	ortuman := h.Connect("ortuman", "balcony", withSpam)
+	romeo := h.Connect("romeo", "orchard", withSpam)
+
+	const body = "Congratulations! You have been selected to win a new phone, claim it now"
+
+	// burst of near identical messages from fresh JIDs
+	var ids []string
+	for i := 0; i < 5; i++ {
+		spammer := h.Connect(fmt.Sprintf("spammer%d", i), "bot", withSpam)
+		msg := tUtilSpamChatMessage(ortuman.JID().ToBareJID(), fmt.Sprintf("%s (%d)", body, i))
+		h.Send(spammer, msg)
+		ids = append(ids, msg.ID())
+	}
+	elem := h.ExpectStanza(ortuman, isStanza("message", xml.ChatType).from("spammer0@jackal.im/bot"), harnessTimeout)
+	require.Nil(t, elem.FindElementNamespace("spam", spamNamespace))
+
+	elem = h.ExpectStanza(ortuman, isStanza("message", xml.ChatType).from("spammer1@jackal.im/bot"), harnessTimeout)
+	require.NotNil(t, elem.FindElementNamespace("spam", spamNamespace))
+	h.ExpectNoStanza(ortuman, isStanza("message", ""), time.Millisecond*100)
+
+	// contact traffic is untouched
+	msg := tUtilSpamChatMessage(ortuman.JID().ToBareJID(), body)
+	h.Send(romeo, msg)
+	elem = h.ExpectStanza(ortuman, isStanza("message", xml.ChatType).from("romeo@jackal.im/orchard"), harnessTimeout)
+	require.Nil(t, elem.FindElementNamespace("spam", spamNamespace))
+
+	// query quarantine
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", quarantineNamespace))
+	h.Send(ortuman, iq)
+	elem = h.ExpectStanza(ortuman, isStanza("iq", xml.ResultType), harnessTimeout)
+	quarantined := elem.FindElementNamespace("query", quarantineNamespace).FindElements("message")
+	require.Equal(t, 3, len(quarantined))
+	for i, m := range quarantined {
+		require.Equal(t, ids[i+2], m.ID())
+		require.NotNil(t, m.FindElementNamespace("delay", "urn:xmpp:delay"))
+	}
+
+	// purge quarantine
+	iq = xml.NewIQType(uuid.New(), xml.SetType)
+	q := xml.NewElementNamespace("query", quarantineNamespace)
+	q.AppendElement(xml.NewElementName("purge"))
+	iq.AppendElement(q)
+	h.Send(ortuman, iq)
+	h.ExpectStanza(ortuman, isStanza("iq", xml.ResultType), harnessTimeout)
+
+	cnt, err := storage.Instance().CountQuarantinedMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+}
+
+func TestSpam_RegisteredScorer(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+
+	spam.Register(fixedSpamScorer(5))
+	defer spam.Register(nil)
+
+	cfg := &config.ModSpam{QuarantineThreshold: 2, BounceThreshold: 5}
+	withSpam := func(strm c2s.Stream) Module { return NewSpam(cfg, strm) }
+
+	juliet := h.Connect("juliet", "balcony", withSpam)
+	mercutio := h.Connect("mercutio", "street", withSpam)
+
+	msg := tUtilSpamChatMessage(juliet.JID().ToBareJID(), "Hi!")
+	h.Send(mercutio, msg)
+	elem := h.ExpectStanza(mercutio, isStanza("message", xml.ErrorType), harnessTimeout)
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Equal(t, xml.ErrPolicyViolation.Error(), elem.Error().Elements()[0].Name())
+	h.ExpectNoStanza(juliet, isStanza("message", ""), time.Millisecond*100)
+
+	cnt, _ := storage.Instance().CountQuarantinedMessages(context.Background(), "juliet")
+	require.Equal(t, 0, cnt)
+}
+
+func TestSpam_QuarantineErrors(t *testing.T) {
+	h := newHarness(t)
+	defer h.Close()
+
+	cfg := &config.ModSpam{}
+	ortuman := h.Connect("ortuman", "balcony", func(strm c2s.Stream) Module { return NewSpam(cfg, strm) })
+
+	// other user quarantine
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	j, _ := xml.NewJID("romeo", "jackal.im", "", true)
+	iq.SetToJID(j)
+	iq.AppendElement(xml.NewElementNamespace("query", quarantineNamespace))
+	h.Send(ortuman, iq)
+	elem := h.ExpectStanza(ortuman, isStanza("iq", xml.ErrorType), harnessTimeout)
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+
+	// set without purge
+	iq = xml.NewIQType(uuid.New(), xml.SetType)
+	iq.AppendElement(xml.NewElementNamespace("query", quarantineNamespace))
+	h.Send(ortuman, iq)
+	elem = h.ExpectStanza(ortuman, isStanza("iq", xml.ErrorType), harnessTimeout)
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// storage error
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	iq = xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", quarantineNamespace))
+	h.Send(ortuman, iq)
+	elem = h.ExpectStanza(ortuman, isStanza("iq", xml.ErrorType), harnessTimeout)
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+}
+
+func tUtilSpamChatMessage(to *xml.JID, body string) *xml.Message {
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetToJID(to)
+	b := xml.NewElementName("body")
+	b.SetText(body)
+	msg.AppendElement(b)
+	return msg
+}
@@ -0,0 +1,184 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const statsNamespace = "http://jabber.org/protocol/stats"
+
+const dataFormNamespace = "jabber:x:data"
+
+// ModStats represents a server statistics stream module.
+// Statistics are exposed to server administrators as a
+// disco node hierarchy (XEP-0039 style) rooted at the stats namespace node.
+type ModStats struct {
+	strm  c2s.Stream
+	reg   *stats.Registry
+	guard doneGuard
+}
+
+// NewStats returns a server statistics IQ handler module.
+func NewStats(strm c2s.Stream) *ModStats {
+	return &ModStats{
+		strm: strm,
+		reg:  stats.Default(),
+	}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with statistics module.
+func (x *ModStats) AssociatedNamespaces() []string {
+	return []string{statsNamespace}
+}
+
+// Done signals stream termination.
+func (x *ModStats) Done() {
+	x.guard.done()
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the statistics module.
+func (x *ModStats) MatchesIQ(iq *xml.IQ) bool {
+	if !iq.IsGet() {
+		return false
+	}
+	q := iq.FindElement("query")
+	if q == nil || (q.Namespace() != discoInfoNamespace && q.Namespace() != discoItemsNamespace) {
+		return false
+	}
+	node := q.Attribute("node")
+	return node == statsNamespace || strings.HasPrefix(node, statsNamespace+"#")
+}
+
+// ProcessIQ processes a statistics IQ taking according actions
+// over the associated stream.
+func (x *ModStats) ProcessIQ(iq *xml.IQ) {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
+	if !iq.ToJID().IsServer() {
+		x.strm.SendElement(iq.FeatureNotImplementedError())
+		return
+	}
+	if !c2s.Instance().IsAdmin(x.strm.JID()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	q := iq.FindElement("query")
+	node := q.Attribute("node")
+	switch q.Namespace() {
+	case discoInfoNamespace:
+		if node == statsNamespace {
+			x.sendRootInfo(iq)
+		} else {
+			x.sendStatInfo(iq, node)
+		}
+	case discoItemsNamespace:
+		if node == statsNamespace {
+			x.sendStatItems(iq)
+		} else {
+			// statistic nodes are leaves
+			x.sendItems(iq, node, nil)
+		}
+	}
+}
+
+func (x *ModStats) sendRootInfo(iq *xml.IQ) {
+	result := iq.ResultIQ()
+	query := xml.NewElementNamespace("query", discoInfoNamespace)
+	query.SetAttribute("node", statsNamespace)
+	query.AppendElement(x.identityElement("branch", "Server statistics"))
+	query.AppendElement(x.featureElement(statsNamespace))
+	result.AppendElement(query)
+	x.strm.SendElement(result)
+}
+
+func (x *ModStats) sendStatInfo(iq *xml.IQ, node string) {
+	name := strings.TrimPrefix(node, statsNamespace+"#")
+	m, ok := x.reg.Sample(name)
+	if !ok {
+		x.strm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if m.Err != nil {
+		log.Error(m.Err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	result := iq.ResultIQ()
+	query := xml.NewElementNamespace("query", discoInfoNamespace)
+	query.SetAttribute("node", node)
+	query.AppendElement(x.identityElement("leaf", m.Name))
+	query.AppendElement(x.featureElement(statsNamespace))
+
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "result")
+	form.AppendElement(x.fieldElement("FORM_TYPE", "hidden", statsNamespace))
+	form.AppendElement(x.fieldElement("name", "", m.Name))
+	form.AppendElement(x.fieldElement("value", "", strconv.FormatInt(m.Value, 10)))
+	form.AppendElement(x.fieldElement("units", "", m.Units))
+	query.AppendElement(form)
+
+	result.AppendElement(query)
+	x.strm.SendElement(result)
+}
+
+func (x *ModStats) sendStatItems(iq *xml.IQ) {
+	var items []xml.Element
+	for _, name := range x.reg.Names() {
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", x.strm.Domain())
+		item.SetAttribute("node", statsNamespace+"#"+name)
+		item.SetAttribute("name", name)
+		items = append(items, item)
+	}
+	x.sendItems(iq, statsNamespace, items)
+}
+
+func (x *ModStats) sendItems(iq *xml.IQ, node string, items []xml.Element) {
+	result := iq.ResultIQ()
+	query := xml.NewElementNamespace("query", discoItemsNamespace)
+	query.SetAttribute("node", node)
+	query.AppendElements(items)
+	result.AppendElement(query)
+	x.strm.SendElement(result)
+}
+
+func (x *ModStats) identityElement(typ, name string) xml.Element {
+	identity := xml.NewElementName("identity")
+	identity.SetAttribute("category", "hierarchy")
+	identity.SetAttribute("type", typ)
+	identity.SetAttribute("name", name)
+	return identity
+}
+
+func (x *ModStats) featureElement(feature string) xml.Element {
+	featureEl := xml.NewElementName("feature")
+	featureEl.SetAttribute("var", feature)
+	return featureEl
+}
+
+func (x *ModStats) fieldElement(vr, typ, value string) xml.Element {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", vr)
+	if len(typ) > 0 {
+		field.SetAttribute("type", typ)
+	}
+	valueEl := xml.NewElementName("value")
+	valueEl.SetText(value)
+	field.AppendElement(valueEl)
+	return field
+}
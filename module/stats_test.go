@@ -0,0 +1,131 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStats_Matching(t *testing.T) {
+	j, _ := xml.NewJID("admin", "jackal.im", "balcony", true)
+	x := NewStats(c2s.NewMockStream("abcd", j))
+	require.Equal(t, []string{statsNamespace}, x.AssociatedNamespaces())
+
+	iq := tUtilStatsIQ(discoItemsNamespace, "")
+	require.False(t, x.MatchesIQ(iq))
+	iq = tUtilStatsIQ(discoItemsNamespace, "http://jabber.org/protocol/commands")
+	require.False(t, x.MatchesIQ(iq))
+	iq = tUtilStatsIQ(discoItemsNamespace, statsNamespace)
+	require.True(t, x.MatchesIQ(iq))
+	iq = tUtilStatsIQ(discoInfoNamespace, statsNamespace+"#time/uptime")
+	require.True(t, x.MatchesIQ(iq))
+	iq.SetType(xml.SetType)
+	require.False(t, x.MatchesIQ(iq))
+}
+
+func TestStats_Forbidden(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}, Admins: []string{"admin@jackal.im"}})
+	defer c2s.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+	x := NewStats(stm)
+
+	x.ProcessIQ(tUtilStatsIQ(discoItemsNamespace, statsNamespace))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilStatsIQ(discoInfoNamespace, statsNamespace+"#time/uptime"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+}
+
+func TestStats_Query(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}, Admins: []string{"admin@jackal.im"}})
+	defer c2s.Shutdown()
+
+	j, _ := xml.NewJID("admin", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+	x := NewStats(stm)
+
+	stats.Default().Counter("iq/urn:test:stats", "iqs").Add(3)
+
+	// list statistics
+	x.ProcessIQ(tUtilStatsIQ(discoItemsNamespace, statsNamespace))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q := elem.FindElementNamespace("query", discoItemsNamespace)
+	require.NotNil(t, q)
+	var nodes []string
+	for _, item := range q.FindElements("item") {
+		require.Equal(t, "jackal.im", item.Attribute("jid"))
+		nodes = append(nodes, item.Attribute("node"))
+	}
+	require.Contains(t, nodes, statsNamespace+"#time/uptime")
+	require.Contains(t, nodes, statsNamespace+"#users/online")
+	require.Contains(t, nodes, statsNamespace+"#iq/urn:test:stats")
+
+	// root node info
+	x.ProcessIQ(tUtilStatsIQ(discoInfoNamespace, statsNamespace))
+	elem = stm.FetchElement()
+	q = elem.FindElementNamespace("query", discoInfoNamespace)
+	require.Equal(t, "branch", q.FindElement("identity").Attribute("type"))
+
+	// statistic value
+	x.ProcessIQ(tUtilStatsIQ(discoInfoNamespace, statsNamespace+"#iq/urn:test:stats"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q = elem.FindElementNamespace("query", discoInfoNamespace)
+	require.Equal(t, "leaf", q.FindElement("identity").Attribute("type"))
+	form := q.FindElementNamespace("x", dataFormNamespace)
+	require.NotNil(t, form)
+	values := map[string]string{}
+	for _, field := range form.FindElements("field") {
+		values[field.Attribute("var")] = field.FindElement("value").Text()
+	}
+	require.Equal(t, statsNamespace, values["FORM_TYPE"])
+	require.Equal(t, "iq/urn:test:stats", values["name"])
+	require.Equal(t, "3", values["value"])
+	require.Equal(t, "iqs", values["units"])
+
+	// statistic nodes have no items
+	x.ProcessIQ(tUtilStatsIQ(discoItemsNamespace, statsNamespace+"#iq/urn:test:stats"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, 0, elem.FindElementNamespace("query", discoItemsNamespace).ElementsCount())
+
+	// unknown statistic
+	x.ProcessIQ(tUtilStatsIQ(discoInfoNamespace, statsNamespace+"#unknown"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	// not addressed to server
+	iq := tUtilStatsIQ(discoInfoNamespace, statsNamespace)
+	iq.SetToJID(j.ToBareJID())
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrFeatureNotImplemented.Error(), elem.Error().Elements()[0].Name())
+}
+
+func tUtilStatsIQ(namespace, node string) *xml.IQ {
+	srvJID, _ := xml.NewJID("", "jackal.im", "", true)
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetToJID(srvJID)
+	q := xml.NewElementNamespace("query", namespace)
+	if len(node) > 0 {
+		q.SetAttribute("node", node)
+	}
+	iq.AppendElement(q)
+	return iq
+}
@@ -0,0 +1,179 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const trackingNamespace = "urn:jackal:tracking:0"
+
+const trackingWebhookTimeout = time.Second * 5
+
+const (
+	// DeliveredDisposition represents a message delivered to a connected resource.
+	DeliveredDisposition = "delivered"
+
+	// StoredOfflineDisposition represents a message archived into offline storage.
+	StoredOfflineDisposition = "stored-offline"
+
+	// BouncedDisposition represents a message that couldn't be delivered nor stored.
+	BouncedDisposition = "bounced"
+)
+
+// Disposition represents the terminal disposition of a tracked message.
+type Disposition struct {
+	ID       string `json:"id"`
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Status   string `json:"status"`
+	Resource string `json:"resource,omitempty"`
+	Error    string `json:"error,omitempty"`
+}
+
+// ModTracking represents a message delivery tracking server stream module.
+// Messages sent from a trusted JID carrying a tracking element get their
+// terminal disposition reported either to a webhook or as an IQ back to the sender.
+type ModTracking struct {
+	cfg    *config.ModTracking
+	strm   c2s.Stream
+	client *http.Client
+	actor  *actor
+}
+
+// NewTracking returns a message delivery tracking server stream module.
+func NewTracking(config *config.ModTracking, strm c2s.Stream) *ModTracking {
+	t := &ModTracking{
+		cfg:    config,
+		strm:   strm,
+		client: &http.Client{Timeout: trackingWebhookTimeout},
+		actor:  newActor(nil),
+	}
+	return t
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with tracking module.
+func (t *ModTracking) AssociatedNamespaces() []string {
+	return []string{trackingNamespace}
+}
+
+// Done signals stream termination.
+func (t *ModTracking) Done() {
+	t.actor.done()
+}
+
+// IsTracked returns whether or not message disposition should be reported.
+func (t *ModTracking) IsTracked(message *xml.Message) bool {
+	if message.FindElementNamespace("track", trackingNamespace) == nil {
+		return false
+	}
+	fromJID := message.FromJID()
+	for _, trusted := range t.cfg.TrustedJIDs {
+		if trusted == fromJID.String() || trusted == fromJID.ToBareJID().String() {
+			return true
+		}
+	}
+	return false
+}
+
+// Delivered reports a tracked message as delivered to a connected resource.
+func (t *ModTracking) Delivered(message *xml.Message, resource string) {
+	t.report(message, DeliveredDisposition, resource, nil)
+}
+
+// StoredOffline reports a tracked message as archived into offline storage.
+func (t *ModTracking) StoredOffline(message *xml.Message) {
+	t.report(message, StoredOfflineDisposition, "", nil)
+}
+
+// Bounced reports a tracked message as bounced.
+// Non stanza errors are reported as 'internal-server-error'.
+func (t *ModTracking) Bounced(message *xml.Message, err error) {
+	if _, ok := err.(*xml.StanzaError); !ok {
+		err = xml.ErrInternalServerError
+	}
+	t.report(message, BouncedDisposition, "", err)
+}
+
+func (t *ModTracking) report(message *xml.Message, status, resource string, err error) {
+	if !t.IsTracked(message) {
+		return
+	}
+	d := &Disposition{
+		ID:       t.trackingID(message),
+		From:     message.From(),
+		To:       message.To(),
+		Status:   status,
+		Resource: resource,
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	t.actor.run(func() {
+		if len(t.cfg.WebhookURL) > 0 {
+			if err := t.postDisposition(d); err != nil {
+				log.Error(err)
+			}
+			return
+		}
+		t.strm.SendElement(t.dispositionIQ(d))
+	})
+}
+
+func (t *ModTracking) postDisposition(d *Disposition) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	resp, err := t.client.Post(t.cfg.WebhookURL, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("tracking: webhook responded with status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (t *ModTracking) dispositionIQ(d *Disposition) *xml.IQ {
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFrom(t.strm.Domain())
+	iq.SetTo(t.strm.JID().String())
+
+	disposition := xml.NewElementNamespace("disposition", trackingNamespace)
+	disposition.SetAttribute("id", d.ID)
+	disposition.SetAttribute("to", d.To)
+	disposition.SetAttribute("status", d.Status)
+	if len(d.Resource) > 0 {
+		disposition.SetAttribute("resource", d.Resource)
+	}
+	if len(d.Error) > 0 {
+		disposition.AppendElement(xml.NewElementNamespace(d.Error, "urn:ietf:params:xml:ns:xmpp-stanzas"))
+	}
+	iq.AppendElement(disposition)
+	return iq
+}
+
+// trackingID returns tracking element 'id' attribute,
+// falling back to message identifier.
+func (t *ModTracking) trackingID(message *xml.Message) string {
+	if id := message.FindElementNamespace("track", trackingNamespace).Attribute("id"); len(id) > 0 {
+		return id
+	}
+	return message.ID()
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTracking_IsTracked(t *testing.T) {
+	j1, _ := xml.NewJID("billing", "jackal.im", "bot", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := NewTracking(&config.ModTracking{TrustedJIDs: []string{"billing@jackal.im"}}, nil)
+	defer x.Done()
+
+	require.Equal(t, []string{trackingNamespace}, x.AssociatedNamespaces())
+
+	msg := tUtilTrackingMessage(j1, j2)
+	require.True(t, x.IsTracked(msg))
+
+	// not trusted...
+	msg.SetFromJID(j2)
+	require.False(t, x.IsTracked(msg))
+
+	// missing tracking element...
+	msg = xml.NewMessageType(uuid.New(), xml.NormalType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	require.False(t, x.IsTracked(msg))
+
+	// trusted full JID
+	x2 := NewTracking(&config.ModTracking{TrustedJIDs: []string{"billing@jackal.im/bot"}}, nil)
+	defer x2.Done()
+	require.True(t, x2.IsTracked(tUtilTrackingMessage(j1, j2)))
+}
+
+func TestTracking_ReportIQ(t *testing.T) {
+	j1, _ := xml.NewJID("billing", "jackal.im", "bot", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetDomain("jackal.im")
+
+	x := NewTracking(&config.ModTracking{TrustedJIDs: []string{"billing@jackal.im"}}, stm)
+	defer x.Done()
+
+	msg := tUtilTrackingMessage(j1, j2)
+
+	x.Delivered(msg, "balcony")
+	elem := stm.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, xml.SetType, elem.Type())
+	require.Equal(t, "jackal.im", elem.From())
+	require.Equal(t, "billing@jackal.im/bot", elem.To())
+	d := elem.FindElementNamespace("disposition", trackingNamespace)
+	require.NotNil(t, d)
+	require.Equal(t, "track-1", d.Attribute("id"))
+	require.Equal(t, DeliveredDisposition, d.Attribute("status"))
+	require.Equal(t, "balcony", d.Attribute("resource"))
+
+	x.StoredOffline(msg)
+	elem = stm.FetchElement()
+	d = elem.FindElementNamespace("disposition", trackingNamespace)
+	require.Equal(t, StoredOfflineDisposition, d.Attribute("status"))
+
+	x.Bounced(msg, xml.ErrServiceUnavailable)
+	elem = stm.FetchElement()
+	d = elem.FindElementNamespace("disposition", trackingNamespace)
+	require.Equal(t, BouncedDisposition, d.Attribute("status"))
+	require.NotNil(t, d.FindElement(xml.ErrServiceUnavailable.Error()))
+}
+
+func TestTracking_ReportWebhook(t *testing.T) {
+	dCh := make(chan Disposition, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var d Disposition
+		json.NewDecoder(r.Body).Decode(&d)
+		dCh <- d
+	}))
+	defer srv.Close()
+
+	j1, _ := xml.NewJID("billing", "jackal.im", "bot", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+
+	x := NewTracking(&config.ModTracking{
+		TrustedJIDs: []string{"billing@jackal.im"},
+		WebhookURL:  srv.URL,
+	}, stm)
+	defer x.Done()
+
+	msg := tUtilTrackingMessage(j1, j2)
+
+	// non stanza errors are reported as internal server errors
+	x.Bounced(msg, storage.ErrMockedError)
+
+	select {
+	case d := <-dCh:
+		require.Equal(t, "track-1", d.ID)
+		require.Equal(t, "billing@jackal.im/bot", d.From)
+		require.Equal(t, "ortuman@jackal.im/balcony", d.To)
+		require.Equal(t, BouncedDisposition, d.Status)
+		require.Equal(t, xml.ErrInternalServerError.Error(), d.Error)
+	case <-time.After(time.Second):
+		require.Fail(t, "webhook not called")
+	}
+}
+
+func tUtilTrackingMessage(from, to *xml.JID) *xml.Message {
+	msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	track := xml.NewElementNamespace("track", trackingNamespace)
+	track.SetAttribute("id", "track-1")
+	msg.AppendElement(track)
+	return msg
+}
@@ -0,0 +1,301 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+const offlineRetrievalNamespace = "http://jabber.org/protocol/offline"
+
+// XEPOfflineRetrieval represents a flexible offline message retrieval
+// server stream module (https://xmpp.org/extensions/xep-0013.html).
+type XEPOfflineRetrieval struct {
+	strm        c2s.Stream
+	retrievalFn func()
+	now         func() time.Time
+	actor       *actor
+}
+
+// NewXEPOfflineRetrieval returns a flexible offline message retrieval IQ handler module.
+func NewXEPOfflineRetrieval(strm c2s.Stream) *XEPOfflineRetrieval {
+	return &XEPOfflineRetrieval{
+		strm:  strm,
+		now:   time.Now,
+		actor: newActor(nil),
+	}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with flexible offline message retrieval module.
+func (x *XEPOfflineRetrieval) AssociatedNamespaces() []string {
+	return []string{offlineRetrievalNamespace}
+}
+
+// Done signals stream termination.
+func (x *XEPOfflineRetrieval) Done() {
+	x.actor.done()
+}
+
+// SetRetrievalHandler sets a function to be invoked whenever the peer
+// retrieves or manages its offline messages through this module, so that
+// they're no longer flushed on initial presence.
+// It must be set before processing any IQ.
+func (x *XEPOfflineRetrieval) SetRetrievalHandler(fn func()) {
+	x.retrievalFn = fn
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the flexible offline message retrieval module.
+func (x *XEPOfflineRetrieval) MatchesIQ(iq *xml.IQ) bool {
+	if iq.FindElementNamespace("offline", offlineRetrievalNamespace) != nil {
+		return true
+	}
+	if !iq.IsGet() {
+		return false
+	}
+	q := iq.FindElement("query")
+	if q == nil || (q.Namespace() != discoInfoNamespace && q.Namespace() != discoItemsNamespace) {
+		return false
+	}
+	return q.Attribute("node") == offlineRetrievalNamespace
+}
+
+// ProcessIQ processes a flexible offline message retrieval IQ
+// taking according actions over the associated stream.
+func (x *XEPOfflineRetrieval) ProcessIQ(iq *xml.IQ) {
+	toJid := iq.ToJID()
+	if !toJid.IsServer() && (toJid.Node() != x.strm.Username() || toJid.Domain() != x.strm.Domain()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	offline := iq.FindElementNamespace("offline", offlineRetrievalNamespace)
+	if x.retrievalFn != nil && (offline != nil || iq.FindElementNamespace("query", discoItemsNamespace) != nil) {
+		// invoked right away, so that it takes effect before
+		// any subsequent presence gets processed
+		x.retrievalFn()
+	}
+	x.actor.run(func() {
+		if offline == nil {
+			if iq.FindElementNamespace("query", discoInfoNamespace) != nil {
+				x.sendInfo(iq)
+			} else {
+				x.sendItems(iq)
+			}
+			return
+		}
+		x.processOffline(iq, offline)
+	})
+}
+
+func (x *XEPOfflineRetrieval) processOffline(iq *xml.IQ, offline xml.Element) {
+	switch {
+	case offline.FindElement("fetch") != nil && iq.IsGet():
+		x.fetch(iq)
+	case offline.FindElement("purge") != nil && iq.IsSet():
+		if !c2s.Instance().GuardSession(x.strm, func() { x.purge(iq) }) {
+			x.strm.SendElement(iq.NotAuthorizedError())
+		}
+	default:
+		items := offline.FindElements("item")
+		if len(items) == 0 {
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		var action string
+		for _, item := range items {
+			if len(item.Attribute("node")) == 0 {
+				x.strm.SendElement(iq.BadRequestError())
+				return
+			}
+			action = item.Attribute("action")
+			if (action != "view" || !iq.IsGet()) && (action != "remove" || !iq.IsSet()) {
+				x.strm.SendElement(iq.BadRequestError())
+				return
+			}
+		}
+		if action == "view" {
+			x.view(iq, items)
+		} else if !c2s.Instance().GuardSession(x.strm, func() { x.remove(iq, items) }) {
+			x.strm.SendElement(iq.NotAuthorizedError())
+		}
+	}
+}
+
+func (x *XEPOfflineRetrieval) sendInfo(iq *xml.IQ) {
+	messages, err := x.fetchOfflineMessages()
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	result := iq.ResultIQ()
+	query := xml.NewElementNamespace("query", discoInfoNamespace)
+	query.SetAttribute("node", offlineRetrievalNamespace)
+
+	identity := xml.NewElementName("identity")
+	identity.SetAttribute("category", "automation")
+	identity.SetAttribute("type", "message-list")
+	query.AppendElement(identity)
+
+	feature := xml.NewElementName("feature")
+	feature.SetAttribute("var", offlineRetrievalNamespace)
+	query.AppendElement(feature)
+
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "result")
+	form.AppendElement(x.fieldElement("FORM_TYPE", "hidden", offlineRetrievalNamespace))
+	form.AppendElement(x.fieldElement("number_of_messages", "", strconv.Itoa(len(messages))))
+	query.AppendElement(form)
+
+	result.AppendElement(query)
+	x.strm.SendElement(result)
+}
+
+func (x *XEPOfflineRetrieval) sendItems(iq *xml.IQ) {
+	messages, err := x.fetchOfflineMessages()
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	result := iq.ResultIQ()
+	query := xml.NewElementNamespace("query", discoItemsNamespace)
+	query.SetAttribute("node", offlineRetrievalNamespace)
+	for _, m := range messages {
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", x.strm.JID().ToBareJID().String())
+		item.SetAttribute("node", m.Node)
+		if from := m.Message.From(); len(from) > 0 {
+			item.SetAttribute("name", from)
+		}
+		query.AppendElement(item)
+	}
+	result.AppendElement(query)
+	x.strm.SendElement(result)
+}
+
+func (x *XEPOfflineRetrieval) view(iq *xml.IQ, items []xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	expiredBefore := offlineMessagesExpiredBefore(x.now())
+	var messages []model.OfflineMessage
+	for _, item := range items {
+		m, err := storage.Instance().FetchOfflineMessage(ctx, x.strm.Username(), item.Attribute("node"))
+		if err != nil {
+			log.Error(err)
+			x.strm.SendElement(iq.InternalServerError())
+			return
+		}
+		if m == nil || offlineMessageExpired(*m, expiredBefore) {
+			x.strm.SendElement(iq.ItemNotFoundError())
+			return
+		}
+		messages = append(messages, *m)
+	}
+	for _, m := range messages {
+		x.strm.SendElement(x.annotated(m))
+	}
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPOfflineRetrieval) remove(iq *xml.IQ, items []xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	found := true
+	for _, item := range items {
+		ok, err := storage.Instance().DeleteOfflineMessage(ctx, x.strm.Username(), item.Attribute("node"))
+		if err != nil {
+			log.Error(err)
+			x.strm.SendElement(iq.InternalServerError())
+			return
+		}
+		found = found && ok
+	}
+	if !found {
+		x.strm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPOfflineRetrieval) fetch(iq *xml.IQ) {
+	messages, err := x.fetchOfflineMessages()
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	for _, m := range messages {
+		x.strm.SendElement(x.annotated(m))
+	}
+	log.Infof("retrieved offline messages... count: %d", len(messages))
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPOfflineRetrieval) purge(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().DeleteOfflineMessages(ctx, x.strm.Username()); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+// fetchOfflineMessages returns every non expired message of user's offline queue.
+func (x *XEPOfflineRetrieval) fetchOfflineMessages() ([]model.OfflineMessage, error) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	messages, err := storage.Instance().FetchOfflineMessages(ctx, x.strm.Username())
+	if err != nil {
+		return nil, err
+	}
+	expiredBefore := offlineMessagesExpiredBefore(x.now())
+	ret := messages[:0]
+	for _, m := range messages {
+		if !offlineMessageExpired(m, expiredBefore) {
+			ret = append(ret, m)
+		}
+	}
+	return ret, nil
+}
+
+// annotated returns m message stamped with its receipt time
+// and annotated with its node identifier.
+func (x *XEPOfflineRetrieval) annotated(m model.OfflineMessage) xml.Element {
+	msg := delayedOfflineMessage(m, x.strm.Domain())
+	item := xml.NewElementName("item")
+	item.SetAttribute("node", m.Node)
+	offline := xml.NewElementNamespace("offline", offlineRetrievalNamespace)
+	offline.AppendElement(item)
+	msg.AppendElement(offline)
+	return msg
+}
+
+func (x *XEPOfflineRetrieval) fieldElement(vr, typ, value string) xml.Element {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", vr)
+	if len(typ) > 0 {
+		field.SetAttribute("type", typ)
+	}
+	valueEl := xml.NewElementName("value")
+	valueEl.SetText(value)
+	field.AppendElement(valueEl)
+	return field
+}
@@ -0,0 +1,218 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0013_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	x := NewXEPOfflineRetrieval(c2s.NewMockStream("abcd", j))
+	defer x.Done()
+
+	require.Equal(t, []string{offlineRetrievalNamespace}, x.AssociatedNamespaces())
+
+	iq := tUtilOfflineRetrievalDiscoIQ(discoInfoNamespace, "")
+	require.False(t, x.MatchesIQ(iq))
+	iq = tUtilOfflineRetrievalDiscoIQ(discoInfoNamespace, offlineRetrievalNamespace)
+	require.True(t, x.MatchesIQ(iq))
+	iq = tUtilOfflineRetrievalDiscoIQ(discoItemsNamespace, offlineRetrievalNamespace)
+	require.True(t, x.MatchesIQ(iq))
+	iq.SetType(xml.SetType)
+	require.False(t, x.MatchesIQ(iq))
+
+	iq = tUtilOfflineRetrievalIQ(xml.SetType, xml.NewElementName("purge"))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0013_Forbidden(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+	stm.SetDomain("jackal.im")
+	x := NewXEPOfflineRetrieval(stm)
+	defer x.Done()
+
+	j2, _ := xml.NewJID("juliet", "jackal.im", "", true)
+	iq := tUtilOfflineRetrievalDiscoIQ(discoItemsNamespace, offlineRetrievalNamespace)
+	iq.SetToJID(j2)
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+}
+
+func TestXEP0013_DiscoInfo(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	stm, x := tUtilOfflineRetrievalSetup(t, "a", "b")
+	defer x.Done()
+
+	x.ProcessIQ(tUtilOfflineRetrievalDiscoIQ(discoInfoNamespace, offlineRetrievalNamespace))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q := elem.FindElementNamespace("query", discoInfoNamespace)
+	require.NotNil(t, q)
+	require.Equal(t, "message-list", q.FindElement("identity").Attribute("type"))
+	require.Equal(t, offlineRetrievalNamespace, q.FindElement("feature").Attribute("var"))
+
+	fields := map[string]string{}
+	for _, field := range q.FindElementNamespace("x", dataFormNamespace).FindElements("field") {
+		fields[field.Attribute("var")] = field.FindElement("value").Text()
+	}
+	require.Equal(t, offlineRetrievalNamespace, fields["FORM_TYPE"])
+	require.Equal(t, "2", fields["number_of_messages"])
+}
+
+func TestXEP0013_ViewAndRemove(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm, x := tUtilOfflineRetrievalSetup(t, "a", "b")
+	defer x.Done()
+
+	var retrieved int
+	x.SetRetrievalHandler(func() { retrieved++ })
+
+	// header list
+	x.ProcessIQ(tUtilOfflineRetrievalDiscoIQ(discoItemsNamespace, offlineRetrievalNamespace))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	items := elem.FindElementNamespace("query", discoItemsNamespace).FindElements("item")
+	require.Equal(t, 2, len(items))
+	require.Equal(t, "ortuman@jackal.im", items[0].Attribute("jid"))
+	require.Equal(t, "juliet@jackal.im/garden", items[0].Attribute("name"))
+	require.Equal(t, 1, retrieved)
+
+	// view by node
+	node := items[1].Attribute("node")
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.GetType, tUtilOfflineRetrievalItem("view", node)))
+	elem = stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "b", elem.ID())
+	require.NotNil(t, elem.FindElementNamespace("delay", delayNamespace))
+	offline := elem.FindElementNamespace("offline", offlineRetrievalNamespace)
+	require.NotNil(t, offline)
+	require.Equal(t, node, offline.FindElement("item").Attribute("node"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	// remove by node
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.SetType, tUtilOfflineRetrievalItem("remove", node)))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	msgs, _ := storage.Instance().FetchOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "a", msgs[0].Message.ID())
+
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.GetType, tUtilOfflineRetrievalItem("view", node)))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.SetType, tUtilOfflineRetrievalItem("remove", node)))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	// actions must match IQ type
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.SetType, tUtilOfflineRetrievalItem("view", node)))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+	require.Equal(t, 6, retrieved)
+}
+
+func TestXEP0013_FetchAndPurge(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm, x := tUtilOfflineRetrievalSetup(t, "a", "b")
+	defer x.Done()
+
+	// fetching leaves messages in storage
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.GetType, xml.NewElementName("fetch")))
+	for _, id := range []string{"a", "b"} {
+		elem := stm.FetchElement()
+		require.Equal(t, id, elem.ID())
+		require.NotNil(t, elem.FindElementNamespace("offline", offlineRetrievalNamespace))
+	}
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 2, cnt)
+
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.SetType, xml.NewElementName("purge")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	cnt, _ = storage.Instance().CountOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 0, cnt)
+
+	// storage failure
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	x.ProcessIQ(tUtilOfflineRetrievalIQ(xml.GetType, xml.NewElementName("fetch")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+}
+
+func tUtilOfflineRetrievalSetup(t *testing.T, ids ...string) (*c2s.MockStream, *XEPOfflineRetrieval) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	from, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	for _, id := range ids {
+		msg := xml.NewMessageType(id, xml.NormalType)
+		msg.SetFromJID(from)
+		msg.SetToJID(j.ToBareJID())
+		require.Nil(t, storage.Instance().InsertOfflineMessage(context.Background(), msg, "ortuman"))
+	}
+	stm := c2s.NewMockStream("abcd", j)
+	stm.SetDomain("jackal.im")
+	return stm, NewXEPOfflineRetrieval(stm)
+}
+
+func tUtilOfflineRetrievalDiscoIQ(namespace, node string) *xml.IQ {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "", true)
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetToJID(j)
+	q := xml.NewElementNamespace("query", namespace)
+	if len(node) > 0 {
+		q.SetAttribute("node", node)
+	}
+	iq.AppendElement(q)
+	return iq
+}
+
+func tUtilOfflineRetrievalIQ(typ string, elems ...xml.Element) *xml.IQ {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "", true)
+	iq := xml.NewIQType(uuid.New(), typ)
+	iq.SetToJID(j)
+	offline := xml.NewElementNamespace("offline", offlineRetrievalNamespace)
+	offline.AppendElements(elems)
+	iq.AppendElement(offline)
+	return iq
+}
+
+func tUtilOfflineRetrievalItem(action, node string) xml.Element {
+	item := xml.NewElementName("item")
+	item.SetAttribute("action", action)
+	item.SetAttribute("node", node)
+	return item
+}
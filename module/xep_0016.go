@@ -0,0 +1,685 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/ortuman/jackal/bounce"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const privacyNamespace = "jabber:iq:privacy"
+
+const (
+	privacyTypeJID          = "jid"
+	privacyTypeGroup        = "group"
+	privacyTypeSubscription = "subscription"
+)
+
+const (
+	privacyActionAllow = "allow"
+	privacyActionDeny  = "deny"
+)
+
+var errPrivacyMalformedItem = errors.New("malformed privacy list item")
+
+// privacyStanza represents the kind of stanza a privacy list is evaluated against.
+type privacyStanza int
+
+const (
+	// privacyAny represents a stanza only matched by items
+	// applying to every kind of stanza.
+	privacyAny privacyStanza = iota
+	privacyMessage
+	privacyIQ
+	privacyPresenceIn
+	privacyPresenceOut
+)
+
+// privacySessions keeps track of the privacy list activated by every
+// session, keyed by username and stream identifier.
+type privacySessions struct {
+	mu     sync.RWMutex
+	active map[string]map[string]string
+}
+
+func (ps *privacySessions) activeList(username, streamID string) string {
+	ps.mu.RLock()
+	defer ps.mu.RUnlock()
+	return ps.active[username][streamID]
+}
+
+// setActiveList activates name privacy list for a session,
+// or deactivates any if name is empty.
+func (ps *privacySessions) setActiveList(username, streamID, name string) {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+	if len(name) == 0 {
+		delete(ps.active[username], streamID)
+		if len(ps.active[username]) == 0 {
+			delete(ps.active, username)
+		}
+		return
+	}
+	if ps.active[username] == nil {
+		ps.active[username] = map[string]string{}
+	}
+	ps.active[username][streamID] = name
+}
+
+var privacyActiveLists = privacySessions{
+	active: map[string]map[string]string{},
+}
+
+// XEPPrivacyLists represents a privacy lists server
+// stream module (https://xmpp.org/extensions/xep-0016.html).
+//
+// Every stanza exchanged between local users is evaluated against the
+// privacy list applying to each end: the one activated by its session,
+// if any, or else the user default list. Stanzas addressed to a bare JID
+// are evaluated against the recipient default list. Stanzas denied to the
+// stream user are answered with a not-acceptable error, while those denied
+// by their recipient are bounced as if it didn't exist. Presence is
+// silently dropped either way.
+// Nothing is denied whenever privacy lists can't be fetched from storage.
+type XEPPrivacyLists struct {
+	strm  c2s.Stream
+	actor *actor
+	guard doneGuard
+}
+
+// NewXEPPrivacyLists returns a privacy lists IQ handler module.
+func NewXEPPrivacyLists(strm c2s.Stream) *XEPPrivacyLists {
+	return &XEPPrivacyLists{
+		strm:  strm,
+		actor: newActor(nil),
+	}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with privacy lists module.
+func (x *XEPPrivacyLists) AssociatedNamespaces() []string {
+	return []string{privacyNamespace}
+}
+
+// Priority returns privacy lists module priority, so that
+// denied stanzas are rejected before any other interceptor runs.
+func (x *XEPPrivacyLists) Priority() int {
+	return HighPriority
+}
+
+// Done signals stream termination.
+func (x *XEPPrivacyLists) Done() {
+	if x.guard.done() {
+		privacyActiveLists.setActiveList(x.strm.Username(), x.strm.ID(), "")
+	}
+	x.actor.done()
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the privacy lists module.
+func (x *XEPPrivacyLists) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("query", privacyNamespace) != nil
+}
+
+// ProcessIQ processes a privacy lists IQ taking according actions
+// over the associated stream.
+func (x *XEPPrivacyLists) ProcessIQ(iq *xml.IQ) {
+	toJid := iq.ToJID()
+	if !toJid.IsServer() && (toJid.Node() != x.strm.Username() || toJid.Domain() != x.strm.Domain()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	x.actor.run(func() {
+		q := iq.FindElementNamespace("query", privacyNamespace)
+		if iq.IsGet() {
+			x.sendPrivacyLists(iq, q)
+			return
+		}
+		if !iq.IsSet() || q.ElementsCount() != 1 {
+			// a single list can be edited at once
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		var cmd func()
+		switch elem := q.Elements()[0]; elem.Name() {
+		case "active":
+			cmd = func() { x.setActiveList(iq, elem.Attribute("name")) }
+		case "default":
+			cmd = func() { x.setDefaultList(iq, elem.Attribute("name")) }
+		case "list":
+			cmd = func() { x.editList(iq, elem) }
+		default:
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		if !c2s.Instance().GuardSession(x.strm, cmd) {
+			x.strm.SendElement(iq.NotAuthorizedError())
+		}
+	})
+}
+
+// InterceptMessage consumes messages denied by either end privacy list.
+func (x *XEPPrivacyLists) InterceptMessage(message *xml.Message) bool {
+	if !x.guard.enter() {
+		return false
+	}
+	defer x.guard.leave()
+	return x.interceptStanza(message, message.ToJID(), privacyAny, privacyMessage)
+}
+
+// InterceptPresence consumes presences denied by either end privacy list.
+// Subscription state changes other than requests are let through,
+// so that rosters are kept consistent.
+func (x *XEPPrivacyLists) InterceptPresence(presence *xml.Presence) bool {
+	if !x.guard.enter() {
+		return false
+	}
+	defer x.guard.leave()
+
+	out, in, ok := privacyPresenceKinds(presence)
+	if !ok {
+		return false
+	}
+	return x.interceptStanza(presence, presence.ToJID(), out, in)
+}
+
+// InterceptIQ consumes IQs denied by either end privacy list.
+func (x *XEPPrivacyLists) InterceptIQ(iq *xml.IQ) bool {
+	if !x.guard.enter() {
+		return false
+	}
+	defer x.guard.leave()
+	return x.interceptStanza(iq, iq.ToJID(), privacyAny, privacyIQ)
+}
+
+// AllowsPresence returns whether or not a presence can be delivered
+// to to, that is, neither its sender nor its recipient privacy lists
+// deny it.
+func (x *XEPPrivacyLists) AllowsPresence(presence *xml.Presence, to *xml.JID) bool {
+	out, in, ok := privacyPresenceKinds(presence)
+	if !ok {
+		return true
+	}
+	from := presence.FromJID()
+	return privacyAllows(from, to, out) && privacyAllows(to, from, in)
+}
+
+func (x *XEPPrivacyLists) interceptStanza(stanza xml.Element, toJid *xml.JID, out, in privacyStanza) bool {
+	var reason bounce.Reason
+	switch {
+	case !privacyAllows(x.strm.JID(), toJid, out):
+		reason = bounce.PrivacyDenied
+	case !privacyAllows(toJid, x.strm.JID(), in):
+		// denied senders can't tell from a non existing recipient
+		reason = bounce.UnknownRecipient
+	default:
+		return false
+	}
+	if resp := bounce.Response(stanza, reason, nil); resp != nil {
+		x.strm.SendElement(resp)
+	}
+	return true
+}
+
+func (x *XEPPrivacyLists) sendPrivacyLists(iq *xml.IQ, q xml.Element) {
+	lists := q.FindElements("list")
+	if len(lists) > 1 {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	pls, err := x.fetchPrivacyLists()
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	query := xml.NewElementNamespace("query", privacyNamespace)
+	if len(lists) == 1 {
+		pl := findPrivacyList(pls, lists[0].Attribute("name"))
+		if pl == nil {
+			x.strm.SendElement(iq.ItemNotFoundError())
+			return
+		}
+		query.AppendElement(privacyListElement(pl))
+	} else {
+		if active := privacyActiveLists.activeList(x.strm.Username(), x.strm.ID()); len(active) > 0 {
+			activeEl := xml.NewElementName("active")
+			activeEl.SetAttribute("name", active)
+			query.AppendElement(activeEl)
+		}
+		for _, pl := range pls {
+			if !pl.Default {
+				continue
+			}
+			defaultEl := xml.NewElementName("default")
+			defaultEl.SetAttribute("name", pl.Name)
+			query.AppendElement(defaultEl)
+		}
+		for _, pl := range pls {
+			listEl := xml.NewElementName("list")
+			listEl.SetAttribute("name", pl.Name)
+			query.AppendElement(listEl)
+		}
+	}
+	result := iq.ResultIQ()
+	result.AppendElement(query)
+	x.strm.SendElement(result)
+}
+
+func (x *XEPPrivacyLists) setActiveList(iq *xml.IQ, name string) {
+	if len(name) > 0 {
+		pls, err := x.fetchPrivacyLists()
+		if err != nil {
+			log.Error(err)
+			x.strm.SendElement(iq.InternalServerError())
+			return
+		}
+		if findPrivacyList(pls, name) == nil {
+			x.strm.SendElement(iq.ItemNotFoundError())
+			return
+		}
+	}
+	privacyActiveLists.setActiveList(x.strm.Username(), x.strm.ID(), name)
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPPrivacyLists) setDefaultList(iq *xml.IQ, name string) {
+	pls, err := x.fetchPrivacyLists()
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	if len(name) > 0 && findPrivacyList(pls, name) == nil {
+		x.strm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if dl := defaultPrivacyList(pls); dl != nil && dl.Name != name && x.isDefaultListInUse() {
+		x.strm.SendElement(iq.ConflictError())
+		return
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().SetDefaultPrivacyList(ctx, x.strm.Username(), name); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPPrivacyLists) editList(iq *xml.IQ, list xml.Element) {
+	name := list.Attribute("name")
+	if len(name) == 0 {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	if list.ElementsCount() == 0 {
+		x.deleteList(iq, name)
+		return
+	}
+	items, err := x.privacyListItems(list)
+	if err != nil {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	pl := &model.PrivacyList{Username: x.strm.Username(), Name: name, Items: items}
+	if err := storage.Instance().InsertOrUpdatePrivacyList(ctx, pl); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.strm.SendElement(iq.ResultIQ())
+	x.pushPrivacyListChange(name)
+}
+
+func (x *XEPPrivacyLists) deleteList(iq *xml.IQ, name string) {
+	pls, err := x.fetchPrivacyLists()
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	pl := findPrivacyList(pls, name)
+	if pl == nil {
+		x.strm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	if x.isActiveListInUse(name) || (pl.Default && x.isDefaultListInUse()) {
+		x.strm.SendElement(iq.ConflictError())
+		return
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().DeletePrivacyList(ctx, x.strm.Username(), name); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	if privacyActiveLists.activeList(x.strm.Username(), x.strm.ID()) == name {
+		privacyActiveLists.setActiveList(x.strm.Username(), x.strm.ID(), "")
+	}
+	x.strm.SendElement(iq.ResultIQ())
+	x.pushPrivacyListChange(name)
+}
+
+func (x *XEPPrivacyLists) fetchPrivacyLists() ([]model.PrivacyList, error) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+	return storage.Instance().FetchPrivacyLists(ctx, x.strm.Username())
+}
+
+// isActiveListInUse returns whether or not any other user
+// session has activated name privacy list.
+func (x *XEPPrivacyLists) isActiveListInUse(name string) bool {
+	for _, strm := range c2s.Instance().AvailableStreams(x.strm.Username()) {
+		if strm.ID() != x.strm.ID() && privacyActiveLists.activeList(x.strm.Username(), strm.ID()) == name {
+			return true
+		}
+	}
+	return false
+}
+
+// isDefaultListInUse returns whether or not any other user session
+// is applying the default privacy list, having activated none.
+func (x *XEPPrivacyLists) isDefaultListInUse() bool {
+	for _, strm := range c2s.Instance().AvailableStreams(x.strm.Username()) {
+		if strm.ID() != x.strm.ID() && len(privacyActiveLists.activeList(x.strm.Username(), strm.ID())) == 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// privacyListItems returns the privacy list items held by a list
+// element, having their values normalized.
+func (x *XEPPrivacyLists) privacyListItems(list xml.Element) ([]model.PrivacyListItem, error) {
+	var items []model.PrivacyListItem
+	orders := map[uint]bool{}
+	for _, itemEl := range list.Elements() {
+		if itemEl.Name() != "item" {
+			return nil, errPrivacyMalformedItem
+		}
+		item, err := privacyListItemFromElement(itemEl)
+		if err != nil {
+			return nil, err
+		}
+		if orders[item.Order] {
+			return nil, errPrivacyMalformedItem
+		}
+		orders[item.Order] = true
+		items = append(items, *item)
+	}
+	return items, nil
+}
+
+// pushPrivacyListChange pushes a privacy list change to every user resource.
+func (x *XEPPrivacyLists) pushPrivacyListChange(name string) {
+	for _, strm := range c2s.Instance().AvailableStreams(x.strm.Username()) {
+		listEl := xml.NewElementName("list")
+		listEl.SetAttribute("name", name)
+		query := xml.NewElementNamespace("query", privacyNamespace)
+		query.AppendElement(listEl)
+
+		pushEl := xml.NewIQType(uuid.New(), xml.SetType)
+		pushEl.SetTo(strm.JID().String())
+		pushEl.AppendElement(query)
+		strm.SendElement(pushEl)
+	}
+}
+
+func privacyListItemFromElement(itemEl xml.Element) (*model.PrivacyListItem, error) {
+	order, err := strconv.ParseUint(itemEl.Attribute("order"), 10, 32)
+	if err != nil {
+		return nil, errPrivacyMalformedItem
+	}
+	item := &model.PrivacyListItem{
+		Type:   itemEl.Attribute("type"),
+		Value:  itemEl.Attribute("value"),
+		Action: itemEl.Attribute("action"),
+		Order:  uint(order),
+	}
+	switch item.Action {
+	case privacyActionAllow, privacyActionDeny:
+		break
+	default:
+		return nil, errPrivacyMalformedItem
+	}
+	switch item.Type {
+	case "":
+		if len(item.Value) > 0 {
+			return nil, errPrivacyMalformedItem
+		}
+	case privacyTypeJID:
+		j, err := xml.NewJIDString(item.Value, false)
+		if err != nil || len(j.Domain()) == 0 {
+			return nil, errPrivacyMalformedItem
+		}
+		item.Value = j.String()
+	case privacyTypeGroup:
+		if len(item.Value) == 0 {
+			return nil, errPrivacyMalformedItem
+		}
+	case privacyTypeSubscription:
+		switch item.Value {
+		case subscriptionNone, subscriptionTo, subscriptionFrom, subscriptionBoth:
+			break
+		default:
+			return nil, errPrivacyMalformedItem
+		}
+	default:
+		return nil, errPrivacyMalformedItem
+	}
+	for _, stanzaEl := range itemEl.Elements() {
+		switch stanzaEl.Name() {
+		case "message":
+			item.Message = true
+		case "iq":
+			item.IQ = true
+		case "presence-in":
+			item.PresenceIn = true
+		case "presence-out":
+			item.PresenceOut = true
+		default:
+			return nil, errPrivacyMalformedItem
+		}
+	}
+	return item, nil
+}
+
+func privacyListElement(pl *model.PrivacyList) xml.Element {
+	listEl := xml.NewElementName("list")
+	listEl.SetAttribute("name", pl.Name)
+	for _, item := range pl.Items {
+		itemEl := xml.NewElementName("item")
+		if len(item.Type) > 0 {
+			itemEl.SetAttribute("type", item.Type)
+			itemEl.SetAttribute("value", item.Value)
+		}
+		itemEl.SetAttribute("action", item.Action)
+		itemEl.SetAttribute("order", strconv.FormatUint(uint64(item.Order), 10))
+		if item.Message {
+			itemEl.AppendElement(xml.NewElementName("message"))
+		}
+		if item.IQ {
+			itemEl.AppendElement(xml.NewElementName("iq"))
+		}
+		if item.PresenceIn {
+			itemEl.AppendElement(xml.NewElementName("presence-in"))
+		}
+		if item.PresenceOut {
+			itemEl.AppendElement(xml.NewElementName("presence-out"))
+		}
+		listEl.AppendElement(itemEl)
+	}
+	return listEl
+}
+
+func findPrivacyList(pls []model.PrivacyList, name string) *model.PrivacyList {
+	for i := range pls {
+		if pls[i].Name == name {
+			return &pls[i]
+		}
+	}
+	return nil
+}
+
+func defaultPrivacyList(pls []model.PrivacyList) *model.PrivacyList {
+	for i := range pls {
+		if pls[i].Default {
+			return &pls[i]
+		}
+	}
+	return nil
+}
+
+// privacyPresenceKinds returns the kinds a presence is evaluated against
+// when sent and received. Subscription state changes other than requests
+// are never denied.
+func privacyPresenceKinds(presence *xml.Presence) (out, in privacyStanza, ok bool) {
+	switch presence.Type() {
+	case xml.AvailableType, xml.UnavailableType:
+		return privacyPresenceOut, privacyPresenceIn, true
+	case xml.SubscribedType, xml.UnsubscribeType, xml.UnsubscribedType:
+		return privacyAny, privacyAny, false
+	}
+	return privacyAny, privacyAny, true
+}
+
+// privacyAllows returns whether or not jid local user privacy lists allow
+// exchanging a stanza of kind with contact. Full JIDs bound to a session
+// get its active list applied, if any, and any other the default one.
+func privacyAllows(jid, contact *xml.JID, kind privacyStanza) bool {
+	if len(jid.Node()) == 0 || !c2s.Instance().IsLocalDomain(jid.Domain()) {
+		return true
+	}
+	if contact.Node() == jid.Node() && contact.Domain() == jid.Domain() {
+		return true
+	}
+	if len(contact.Node()) == 0 && c2s.Instance().IsLocalDomain(contact.Domain()) {
+		// never cut off users from their own server
+		return true
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	pls, err := storage.Instance().FetchPrivacyLists(ctx, jid.Node())
+	if err != nil {
+		log.Error(err)
+		return true
+	}
+	var pl *model.PrivacyList
+	if jid.IsFull() {
+		if strm := c2s.Instance().ResourceStream(jid); strm != nil {
+			pl = findPrivacyList(pls, privacyActiveLists.activeList(jid.Node(), strm.ID()))
+		}
+	}
+	if pl == nil {
+		pl = defaultPrivacyList(pls)
+	}
+	if pl == nil {
+		return true
+	}
+	var ri *model.RosterItem
+	if privacyListNeedsRoster(pl.Items) && len(contact.Node()) > 0 && c2s.Instance().IsLocalDomain(contact.Domain()) {
+		ri, err = rosterTable.fetchRosterItem(jid.Node(), contact.Node())
+		if err != nil {
+			log.Error(err)
+			return true
+		}
+	}
+	return privacyListAllows(pl.Items, contact, ri, kind)
+}
+
+func privacyListNeedsRoster(items []model.PrivacyListItem) bool {
+	for _, item := range items {
+		if item.Type == privacyTypeGroup || item.Type == privacyTypeSubscription {
+			return true
+		}
+	}
+	return false
+}
+
+// privacyListAllows evaluates privacy list items in order, returning
+// whether or not a stanza of kind can be exchanged with contact, ri being
+// its roster item, if any. The first item matching contact and applying
+// to kind decides, stanzas being allowed if none does.
+func privacyListAllows(items []model.PrivacyListItem, contact *xml.JID, ri *model.RosterItem, kind privacyStanza) bool {
+	for _, item := range items {
+		if !privacyItemApplies(&item, kind) || !privacyItemMatches(&item, contact, ri) {
+			continue
+		}
+		return item.Action == privacyActionAllow
+	}
+	return true
+}
+
+func privacyItemApplies(item *model.PrivacyListItem, kind privacyStanza) bool {
+	if !item.Message && !item.IQ && !item.PresenceIn && !item.PresenceOut {
+		return true
+	}
+	switch kind {
+	case privacyMessage:
+		return item.Message
+	case privacyIQ:
+		return item.IQ
+	case privacyPresenceIn:
+		return item.PresenceIn
+	case privacyPresenceOut:
+		return item.PresenceOut
+	}
+	return false
+}
+
+func privacyItemMatches(item *model.PrivacyListItem, contact *xml.JID, ri *model.RosterItem) bool {
+	switch item.Type {
+	case "":
+		return true
+	case privacyTypeJID:
+		return jidMatches(item.Value, contact)
+	case privacyTypeGroup:
+		if ri == nil {
+			return false
+		}
+		for _, group := range ri.Groups {
+			if group == item.Value {
+				return true
+			}
+		}
+		return false
+	case privacyTypeSubscription:
+		if ri == nil || len(ri.Subscription) == 0 {
+			return item.Value == subscriptionNone
+		}
+		return ri.Subscription == item.Value
+	}
+	return false
+}
+
+// jidMatches returns whether or not value matches jid as of XEP-0016
+// JID matching rules, that is, if it's either jid full JID, its bare JID,
+// its domain and resource or its domain alone.
+func jidMatches(value string, jid *xml.JID) bool {
+	switch value {
+	case jid.String(), jid.ToBareJID().String(), jid.Domain():
+		return true
+	}
+	return len(jid.Resource()) > 0 && value == jid.Domain()+"/"+jid.Resource()
+}
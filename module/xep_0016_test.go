@@ -0,0 +1,514 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0016_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := NewXEPPrivacyLists(c2s.NewMockStream(uuid.New(), j))
+	defer x.Done()
+
+	require.Equal(t, []string{privacyNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("query", privacyNamespace))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0016_InvalidIQ(t *testing.T) {
+	stm, x := tUtilPrivacySetup(t)
+	defer tUtilPrivacyTeardown(stm, x)
+
+	// not addressed to the user
+	j, _ := xml.NewJID("romeo", "jackal.im", "", true)
+	iq := tUtilPrivacyIQ(xml.GetType)
+	iq.SetToJID(j)
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+
+	// more than one list requested
+	x.ProcessIQ(tUtilPrivacyIQ(xml.GetType, tUtilPrivacyListElement("a"), tUtilPrivacyListElement("b")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// more than one element set at once
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, xml.NewElementName("active"), xml.NewElementName("default")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// unknown element
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, xml.NewElementName("foo")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// unnamed list
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("", tUtilPrivacyItemElement("", "", "deny", "1"))))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// malformed items
+	for _, itemEl := range []xml.Element{
+		tUtilPrivacyItemElement("", "", "drop", "1"),
+		tUtilPrivacyItemElement("", "", "deny", "first"),
+		tUtilPrivacyItemElement("", "romeo@jackal.im", "deny", "1"),
+		tUtilPrivacyItemElement("jid", "romeo@", "deny", "1"),
+		tUtilPrivacyItemElement("group", "", "deny", "1"),
+		tUtilPrivacyItemElement("subscription", "pending", "deny", "1"),
+		tUtilPrivacyItemElement("resource", "garden", "deny", "1"),
+		tUtilPrivacyItemElement("", "", "deny", "1", "vcard"),
+	} {
+		x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("public", itemEl)))
+		elem = stm.FetchElement()
+		require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name(), itemEl.String())
+	}
+
+	// duplicated order
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("public",
+		tUtilPrivacyItemElement("jid", "romeo@jackal.im", "deny", "1"),
+		tUtilPrivacyItemElement("", "", "allow", "1"),
+	)))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// not existing lists
+	x.ProcessIQ(tUtilPrivacyIQ(xml.GetType, tUtilPrivacyListElement("public")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("active", "public")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("default", "public")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("public")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	// storage error
+	storage.ActivateMockedError()
+	x.ProcessIQ(tUtilPrivacyIQ(xml.GetType))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+	storage.DeactivateMockedError()
+}
+
+func TestXEP0016_ManageLists(t *testing.T) {
+	stm, x := tUtilPrivacySetup(t)
+	defer tUtilPrivacyTeardown(stm, x)
+
+	// no lists
+	x.ProcessIQ(tUtilPrivacyIQ(xml.GetType))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, 0, elem.FindElementNamespace("query", privacyNamespace).ElementsCount())
+
+	// edit list
+	iq := tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("public",
+		tUtilPrivacyItemElement("jid", "Romeo@jackal.im", "deny", "2", "message", "presence-in"),
+		tUtilPrivacyItemElement("", "", "allow", "3"),
+	))
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, iq.ID(), elem.ID())
+
+	elem = stm.FetchElement()
+	require.Equal(t, xml.SetType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.To())
+	require.Equal(t, "public", elem.FindElementNamespace("query", privacyNamespace).Elements()[0].Attribute("name"))
+
+	pls, _ := storage.Instance().FetchPrivacyLists(context.Background(), "ortuman")
+	require.Equal(t, 1, len(pls))
+	require.Equal(t, []model.PrivacyListItem{
+		{Type: "jid", Value: "romeo@jackal.im", Action: "deny", Order: 2, Message: true, PresenceIn: true},
+		{Action: "allow", Order: 3},
+	}, pls[0].Items)
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("private",
+		tUtilPrivacyItemElement("subscription", "both", "allow", "1"),
+		tUtilPrivacyItemElement("", "", "deny", "2"),
+	)))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	require.Equal(t, xml.SetType, stm.FetchElement().Type())
+
+	// activate and set default
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("active", "private")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("default", "public")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.GetType))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q := elem.FindElementNamespace("query", privacyNamespace)
+	require.Equal(t, "private", q.FindElement("active").Attribute("name"))
+	require.Equal(t, "public", q.FindElement("default").Attribute("name"))
+	lists := q.FindElements("list")
+	require.Equal(t, 2, len(lists))
+	require.Equal(t, "private", lists[0].Attribute("name"))
+	require.Equal(t, "public", lists[1].Attribute("name"))
+
+	// fetch single list
+	x.ProcessIQ(tUtilPrivacyIQ(xml.GetType, tUtilPrivacyListElement("public")))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	items := elem.FindElementNamespace("query", privacyNamespace).FindElement("list").FindElements("item")
+	require.Equal(t, 2, len(items))
+	require.Equal(t, "jid", items[0].Attribute("type"))
+	require.Equal(t, "romeo@jackal.im", items[0].Attribute("value"))
+	require.Equal(t, "deny", items[0].Attribute("action"))
+	require.Equal(t, "2", items[0].Attribute("order"))
+	require.NotNil(t, items[0].FindElement("message"))
+	require.NotNil(t, items[0].FindElement("presence-in"))
+	require.Nil(t, items[0].FindElement("iq"))
+	require.Equal(t, "", items[1].Attribute("type"))
+	require.Equal(t, 0, items[1].ElementsCount())
+
+	// decline active and default lists
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, xml.NewElementName("active")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, xml.NewElementName("default")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.GetType))
+	q = stm.FetchElement().FindElementNamespace("query", privacyNamespace)
+	require.Nil(t, q.FindElement("active"))
+	require.Nil(t, q.FindElement("default"))
+
+	// delete list
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("active", "private")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("private")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	elem = stm.FetchElement()
+	require.Equal(t, xml.SetType, elem.Type())
+	require.Equal(t, "private", elem.FindElementNamespace("query", privacyNamespace).Elements()[0].Attribute("name"))
+
+	require.Equal(t, "", privacyActiveLists.activeList("ortuman", stm.ID()))
+	pls, _ = storage.Instance().FetchPrivacyLists(context.Background(), "ortuman")
+	require.Equal(t, 1, len(pls))
+	require.Equal(t, "public", pls[0].Name)
+}
+
+func TestXEP0016_Conflicts(t *testing.T) {
+	stm, x := tUtilPrivacySetup(t)
+	defer tUtilPrivacyTeardown(stm, x)
+
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+	defer c2s.Instance().UnregisterStream(stm2)
+
+	x2 := NewXEPPrivacyLists(stm2)
+	defer x2.Done()
+
+	for _, name := range []string{"public", "private"} {
+		x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement(name, tUtilPrivacyItemElement("", "", "allow", "1"))))
+		require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+		require.Equal(t, xml.SetType, stm.FetchElement().Type())
+
+		// pushed to every resource
+		elem := stm2.FetchElement()
+		require.Equal(t, xml.SetType, elem.Type())
+		require.Equal(t, "ortuman@jackal.im/garden", elem.To())
+	}
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("default", "public")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	// default list in use by the other resource
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("default", "private")))
+	require.Equal(t, xml.ErrConflict.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("public")))
+	require.Equal(t, xml.ErrConflict.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// ...not anymore
+	x2.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("active", "private")))
+	require.Equal(t, xml.ResultType, stm2.FetchElement().Type())
+
+	// active list in use by the other resource
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("private")))
+	require.Equal(t, xml.ErrConflict.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyNamedElement("default", "private")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	x.ProcessIQ(tUtilPrivacyIQ(xml.SetType, tUtilPrivacyListElement("public")))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	require.Equal(t, xml.SetType, stm.FetchElement().Type())
+	require.Equal(t, xml.SetType, stm2.FetchElement().Type())
+
+	// lists activated by terminated sessions are released
+	x2.Done()
+	require.Equal(t, "", privacyActiveLists.activeList("ortuman", stm2.ID()))
+}
+
+func TestXEP0016_Enforcement(t *testing.T) {
+	stm, x := tUtilPrivacySetup(t)
+	defer tUtilPrivacyTeardown(stm, x)
+
+	romeoJID, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	nolaJID, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	hamletJID, _ := xml.NewJID("hamlet", "denmark.lit", "castle", true)
+
+	storage.Instance().InsertOrUpdatePrivacyList(context.Background(), &model.PrivacyList{
+		Username: "ortuman",
+		Name:     "public",
+		Items:    []model.PrivacyListItem{{Type: "jid", Value: "romeo@jackal.im", Action: "deny", Order: 1}},
+	})
+	storage.Instance().SetDefaultPrivacyList(context.Background(), "ortuman", "public")
+
+	storage.Instance().InsertOrUpdatePrivacyList(context.Background(), &model.PrivacyList{
+		Username: "noelia",
+		Name:     "quiet",
+		Items: []model.PrivacyListItem{
+			{Type: "jid", Value: "ortuman@jackal.im", Action: "deny", Order: 1, Message: true, PresenceIn: true},
+		},
+	})
+	storage.Instance().SetDefaultPrivacyList(context.Background(), "noelia", "quiet")
+
+	// denied by the user list
+	msg := tUtilBlockingMessage(stm.JID(), romeoJID)
+	require.True(t, x.InterceptMessage(msg))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, "romeo@jackal.im/garden", elem.From())
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements()[0].Name())
+
+	// denied by the recipient list
+	require.True(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), nolaJID)))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrServiceUnavailable.Error(), elem.Error().Elements()[0].Name())
+
+	// only messages and presences are denied by the recipient
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(stm.JID())
+	iq.SetToJID(nolaJID)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:version"))
+	require.False(t, x.InterceptIQ(iq))
+
+	// allowed
+	require.False(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), hamletJID)))
+	require.False(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), stm.JID().ToBareJID())))
+
+	// presences are silently dropped
+	require.True(t, x.InterceptPresence(xml.NewPresence(stm.JID(), romeoJID.ToBareJID(), xml.AvailableType)))
+	require.True(t, x.InterceptPresence(xml.NewPresence(stm.JID(), romeoJID.ToBareJID(), xml.SubscribeType)))
+	require.False(t, x.InterceptPresence(xml.NewPresence(stm.JID(), romeoJID.ToBareJID(), xml.UnsubscribedType)))
+	require.True(t, x.InterceptPresence(xml.NewPresence(stm.JID(), nolaJID, xml.AvailableType)))
+	require.False(t, x.InterceptPresence(xml.NewPresence(stm.JID(), nolaJID.ToBareJID(), xml.SubscribeType)))
+	require.Nil(t, stm.FetchElementTimeout(50*time.Millisecond))
+
+	require.False(t, x.AllowsPresence(xml.NewPresence(stm.JID(), romeoJID, xml.AvailableType), romeoJID))
+	require.False(t, x.AllowsPresence(xml.NewPresence(romeoJID, stm.JID(), xml.UnavailableType), stm.JID()))
+	require.True(t, x.AllowsPresence(xml.NewPresence(romeoJID, stm.JID(), xml.UnsubscribedType), stm.JID()))
+	require.False(t, x.AllowsPresence(xml.NewPresence(stm.JID(), nolaJID, xml.AvailableType), nolaJID))
+	require.True(t, x.AllowsPresence(xml.NewPresence(nolaJID, stm.JID(), xml.AvailableType), stm.JID()))
+
+	// active list overrides the default one
+	storage.Instance().InsertOrUpdatePrivacyList(context.Background(), &model.PrivacyList{
+		Username: "ortuman",
+		Name:     "open",
+		Items:    []model.PrivacyListItem{{Action: "allow", Order: 1}},
+	})
+	privacyActiveLists.setActiveList("ortuman", stm.ID(), "open")
+	require.False(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), romeoJID)))
+
+	// ...but bare JIDs get the default one applied
+	require.False(t, privacyAllows(stm.JID().ToBareJID(), romeoJID, privacyMessage))
+	privacyActiveLists.setActiveList("ortuman", stm.ID(), "")
+
+	// fail open on storage errors
+	storage.ActivateMockedError()
+	require.False(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), romeoJID)))
+	storage.DeactivateMockedError()
+}
+
+func TestXEP0016_ListEvaluation(t *testing.T) {
+	romeoJID, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+
+	friends := &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both", Groups: []string{"friends"}}
+	pending := &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "none", Ask: true}
+	from := &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "from"}
+
+	for _, tc := range []struct {
+		name    string
+		items   []model.PrivacyListItem
+		ri      *model.RosterItem
+		kind    privacyStanza
+		allowed bool
+	}{
+		{"empty list", nil, nil, privacyMessage, true},
+		{"deny all", []model.PrivacyListItem{{Action: "deny", Order: 1}}, nil, privacyMessage, false},
+		{"allow all", []model.PrivacyListItem{{Action: "allow", Order: 1}}, nil, privacyIQ, true},
+		{
+			"first match decides",
+			[]model.PrivacyListItem{
+				{Type: "jid", Value: "romeo@jackal.im", Action: "allow", Order: 1},
+				{Action: "deny", Order: 2},
+			},
+			nil, privacyMessage, true,
+		},
+		{
+			"first match decides on deny",
+			[]model.PrivacyListItem{
+				{Type: "jid", Value: "romeo@jackal.im", Action: "deny", Order: 1},
+				{Action: "allow", Order: 2},
+			},
+			nil, privacyMessage, false,
+		},
+		{
+			"not matching jid falls through",
+			[]model.PrivacyListItem{
+				{Type: "jid", Value: "noelia@jackal.im", Action: "allow", Order: 1},
+				{Action: "deny", Order: 2},
+			},
+			nil, privacyMessage, false,
+		},
+		{"full jid", []model.PrivacyListItem{{Type: "jid", Value: "romeo@jackal.im/garden", Action: "deny", Order: 1}}, nil, privacyMessage, false},
+		{"other resource", []model.PrivacyListItem{{Type: "jid", Value: "romeo@jackal.im/balcony", Action: "deny", Order: 1}}, nil, privacyMessage, true},
+		{"domain", []model.PrivacyListItem{{Type: "jid", Value: "jackal.im", Action: "deny", Order: 1}}, nil, privacyMessage, false},
+		{"domain and resource", []model.PrivacyListItem{{Type: "jid", Value: "jackal.im/garden", Action: "deny", Order: 1}}, nil, privacyMessage, false},
+		{"other domain", []model.PrivacyListItem{{Type: "jid", Value: "montague.lit", Action: "deny", Order: 1}}, nil, privacyMessage, true},
+		{"group", []model.PrivacyListItem{{Type: "group", Value: "friends", Action: "deny", Order: 1}}, friends, privacyMessage, false},
+		{"other group", []model.PrivacyListItem{{Type: "group", Value: "family", Action: "deny", Order: 1}}, friends, privacyMessage, true},
+		{"group not in roster", []model.PrivacyListItem{{Type: "group", Value: "friends", Action: "deny", Order: 1}}, nil, privacyMessage, true},
+		{"subscription both", []model.PrivacyListItem{{Type: "subscription", Value: "both", Action: "deny", Order: 1}}, friends, privacyMessage, false},
+		{"subscription from", []model.PrivacyListItem{{Type: "subscription", Value: "from", Action: "deny", Order: 1}}, from, privacyMessage, false},
+		{"subscription mismatch", []model.PrivacyListItem{{Type: "subscription", Value: "to", Action: "deny", Order: 1}}, from, privacyMessage, true},
+		{"subscription none", []model.PrivacyListItem{{Type: "subscription", Value: "none", Action: "deny", Order: 1}}, pending, privacyMessage, false},
+		{"subscription none not in roster", []model.PrivacyListItem{{Type: "subscription", Value: "none", Action: "deny", Order: 1}}, nil, privacyMessage, false},
+		{"subscription none in roster", []model.PrivacyListItem{{Type: "subscription", Value: "none", Action: "deny", Order: 1}}, friends, privacyMessage, true},
+		{"message only", []model.PrivacyListItem{{Action: "deny", Order: 1, Message: true}}, nil, privacyMessage, false},
+		{"message only on iq", []model.PrivacyListItem{{Action: "deny", Order: 1, Message: true}}, nil, privacyIQ, true},
+		{"iq only", []model.PrivacyListItem{{Action: "deny", Order: 1, IQ: true}}, nil, privacyIQ, false},
+		{"presence in only", []model.PrivacyListItem{{Action: "deny", Order: 1, PresenceIn: true}}, nil, privacyPresenceIn, false},
+		{"presence in on presence out", []model.PrivacyListItem{{Action: "deny", Order: 1, PresenceIn: true}}, nil, privacyPresenceOut, true},
+		{"presence out only", []model.PrivacyListItem{{Action: "deny", Order: 1, PresenceOut: true}}, nil, privacyPresenceOut, false},
+		{"several stanza kinds", []model.PrivacyListItem{{Action: "deny", Order: 1, Message: true, PresenceOut: true}}, nil, privacyPresenceOut, false},
+		{"stanza kinds on any", []model.PrivacyListItem{{Action: "deny", Order: 1, Message: true, IQ: true, PresenceIn: true, PresenceOut: true}}, nil, privacyAny, true},
+		{"all kinds on any", []model.PrivacyListItem{{Action: "deny", Order: 1}}, nil, privacyAny, false},
+		{
+			"skipped kind falls through",
+			[]model.PrivacyListItem{
+				{Type: "jid", Value: "romeo@jackal.im", Action: "allow", Order: 1, IQ: true},
+				{Type: "group", Value: "friends", Action: "deny", Order: 2},
+			},
+			friends, privacyMessage, false,
+		},
+	} {
+		require.Equal(t, tc.allowed, privacyListAllows(tc.items, romeoJID, tc.ri, tc.kind), tc.name)
+	}
+}
+
+func TestXEP0016_JIDMatches(t *testing.T) {
+	j, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	bareJID := j.ToBareJID()
+
+	for _, tc := range []struct {
+		value   string
+		jid     *xml.JID
+		matches bool
+	}{
+		{"romeo@jackal.im/garden", j, true},
+		{"romeo@jackal.im", j, true},
+		{"jackal.im/garden", j, true},
+		{"jackal.im", j, true},
+		{"romeo@jackal.im/balcony", j, false},
+		{"noelia@jackal.im", j, false},
+		{"jackal.im/balcony", j, false},
+		{"montague.lit", j, false},
+		{"romeo@jackal.im", bareJID, true},
+		{"jackal.im", bareJID, true},
+		{"romeo@jackal.im/garden", bareJID, false},
+		{"jackal.im/garden", bareJID, false},
+	} {
+		require.Equal(t, tc.matches, jidMatches(tc.value, tc.jid), tc.value+" "+tc.jid.String())
+	}
+}
+
+func tUtilPrivacySetup(t *testing.T) (*c2s.MockStream, *XEPPrivacyLists) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	require.Nil(t, c2s.Instance().RegisterStream(stm))
+	require.Nil(t, c2s.Instance().AuthenticateStream(stm))
+	return stm, NewXEPPrivacyLists(stm)
+}
+
+func tUtilPrivacyTeardown(stm *c2s.MockStream, x *XEPPrivacyLists) {
+	x.Done()
+	c2s.Instance().UnregisterStream(stm)
+	c2s.Shutdown()
+	storage.Shutdown()
+}
+
+func tUtilPrivacyIQ(typ string, elems ...xml.Element) *xml.IQ {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	iq := xml.NewIQType(uuid.New(), typ)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	q := xml.NewElementNamespace("query", privacyNamespace)
+	q.AppendElements(elems)
+	iq.AppendElement(q)
+	return iq
+}
+
+func tUtilPrivacyNamedElement(name, listName string) *xml.MutableElement {
+	elem := xml.NewElementName(name)
+	elem.SetAttribute("name", listName)
+	return elem
+}
+
+func tUtilPrivacyListElement(name string, items ...xml.Element) xml.Element {
+	list := tUtilPrivacyNamedElement("list", name)
+	list.AppendElements(items)
+	return list
+}
+
+func tUtilPrivacyItemElement(typ, value, action, order string, stanzas ...string) xml.Element {
+	item := xml.NewElementName("item")
+	if len(typ) > 0 {
+		item.SetAttribute("type", typ)
+	}
+	if len(value) > 0 {
+		item.SetAttribute("value", value)
+	}
+	item.SetAttribute("action", action)
+	item.SetAttribute("order", order)
+	for _, stanza := range stanzas {
+		item.AppendElement(xml.NewElementName(stanza))
+	}
+	return item
+}
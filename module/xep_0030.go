@@ -39,7 +39,10 @@ type XEPDiscoInfo struct {
 	stm        c2s.Stream
 	identities []DiscoIdentity
 	features   []DiscoFeature
+	featuresFn func() []DiscoFeature
+	formsFn    func() []xml.Element
 	items      []DiscoItem
+	guard      doneGuard
 }
 
 // NewXEPDiscoInfo returns a disco info IQ handler module.
@@ -70,6 +73,18 @@ func (x *XEPDiscoInfo) SetFeatures(features []DiscoFeature) {
 	x.features = features
 }
 
+// SetFeaturesFunc sets a function providing disco info module's features
+// on every request, taking precedence over those set through SetFeatures.
+func (x *XEPDiscoInfo) SetFeaturesFunc(f func() []DiscoFeature) {
+	x.featuresFn = f
+}
+
+// SetFormsFunc sets a function providing the extension forms
+// (https://xmpp.org/extensions/xep-0128.html) attached to every disco info response.
+func (x *XEPDiscoInfo) SetFormsFunc(f func() []xml.Element) {
+	x.formsFn = f
+}
+
 // Items returns disco info module's items.
 func (x *XEPDiscoInfo) Items() []DiscoItem {
 	return x.items
@@ -88,6 +103,7 @@ func (x *XEPDiscoInfo) AssociatedNamespaces() []string {
 
 // Done signals stream termination.
 func (x *XEPDiscoInfo) Done() {
+	x.guard.done()
 }
 
 // MatchesIQ returns whether or not an IQ should be
@@ -103,6 +119,11 @@ func (x *XEPDiscoInfo) MatchesIQ(iq *xml.IQ) bool {
 // ProcessIQ processes a disco info IQ taking according actions
 // over the associated stream.
 func (x *XEPDiscoInfo) ProcessIQ(iq *xml.IQ) {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
 	if !iq.ToJID().IsServer() {
 		x.stm.SendElement(iq.FeatureNotImplementedError())
 		return
@@ -117,7 +138,11 @@ func (x *XEPDiscoInfo) ProcessIQ(iq *xml.IQ) {
 }
 
 func (x *XEPDiscoInfo) sendDiscoInfo(iq *xml.IQ) {
-	sort.Slice(x.features, func(i, j int) bool { return x.features[i] < x.features[j] })
+	features := x.features
+	if x.featuresFn != nil {
+		features = x.featuresFn()
+	}
+	sort.Slice(features, func(i, j int) bool { return features[i] < features[j] })
 
 	result := iq.ResultIQ()
 	query := xml.NewElementNamespace("query", discoInfoNamespace)
@@ -133,11 +158,14 @@ func (x *XEPDiscoInfo) sendDiscoInfo(iq *xml.IQ) {
 		}
 		query.AppendElement(identityEl)
 	}
-	for _, feature := range x.features {
+	for _, feature := range features {
 		featureEl := xml.NewElementName("feature")
 		featureEl.SetAttribute("var", feature)
 		query.AppendElement(featureEl)
 	}
+	if x.formsFn != nil {
+		query.AppendElements(x.formsFn())
+	}
 
 	result.AppendElement(query)
 	x.stm.SendElement(result)
@@ -140,6 +140,19 @@ func TestXEP0030_GetFeatures(t *testing.T) {
 	require.Equal(t, 3, q.ElementsCount())
 	require.Equal(t, "identity", q.Elements()[0].Name())
 	require.Equal(t, "feature", q.Elements()[1].Name())
+
+	// features provided on every request
+	var provided []DiscoFeature
+	x.SetFeaturesFunc(func() []DiscoFeature { return provided })
+	x.ProcessIQ(iq1)
+	q = stm.FetchElement().FindElementNamespace("query", discoInfoNamespace)
+	require.Equal(t, 1, q.ElementsCount())
+
+	provided = []DiscoFeature{vacationNamespace}
+	x.ProcessIQ(iq1)
+	q = stm.FetchElement().FindElementNamespace("query", discoInfoNamespace)
+	require.Equal(t, 2, q.ElementsCount())
+	require.Equal(t, vacationNamespace, q.Elements()[1].Attribute("var"))
 }
 
 func TestXEP0030_GetItems(t *testing.T) {
@@ -18,19 +18,16 @@ const privateStorageNamespace = "jabber:iq:private"
 
 // XEPPrivateStorage represents a private storage server stream module.
 type XEPPrivateStorage struct {
-	strm    c2s.Stream
-	actorCh chan func()
-	doneCh  chan struct{}
+	strm  c2s.Stream
+	actor *actor
 }
 
 // NewXEPPrivateStorage returns a private storage IQ handler module.
 func NewXEPPrivateStorage(strm c2s.Stream) *XEPPrivateStorage {
 	x := &XEPPrivateStorage{
-		strm:    strm,
-		actorCh: make(chan func(), moduleMailboxSize),
-		doneCh:  make(chan struct{}),
+		strm:  strm,
+		actor: newActor(nil),
 	}
-	go x.actorLoop()
 	return x
 }
 
@@ -42,7 +39,7 @@ func (x *XEPPrivateStorage) AssociatedNamespaces() []string {
 
 // Done signals stream termination.
 func (x *XEPPrivateStorage) Done() {
-	x.doneCh <- struct{}{}
+	x.actor.done()
 }
 
 // MatchesIQ returns whether or not an IQ should be
@@ -54,7 +51,7 @@ func (x *XEPPrivateStorage) MatchesIQ(iq *xml.IQ) bool {
 // ProcessIQ processes a private storage IQ taking according actions
 // over the associated stream.
 func (x *XEPPrivateStorage) ProcessIQ(iq *xml.IQ) {
-	x.actorCh <- func() {
+	x.actor.run(func() {
 		q := iq.FindElementNamespace("query", privateStorageNamespace)
 		toJid := iq.ToJID()
 		validTo := toJid.IsServer() || toJid.Node() == x.strm.Username()
@@ -65,26 +62,20 @@ func (x *XEPPrivateStorage) ProcessIQ(iq *xml.IQ) {
 		if iq.IsGet() {
 			x.getPrivate(iq, q)
 		} else if iq.IsSet() {
-			x.setPrivate(iq, q)
+			if !c2s.Instance().GuardSession(x.strm, func() { x.setPrivate(iq, q) }) {
+				x.strm.SendElement(iq.NotAuthorizedError())
+			}
 		} else {
 			x.strm.SendElement(iq.BadRequestError())
 			return
 		}
-	}
-}
-
-func (x *XEPPrivateStorage) actorLoop() {
-	for {
-		select {
-		case f := <-x.actorCh:
-			f()
-		case <-x.doneCh:
-			return
-		}
-	}
+	})
 }
 
 func (x *XEPPrivateStorage) getPrivate(iq *xml.IQ, q xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	if q.ElementsCount() != 1 {
 		x.strm.SendElement(iq.NotAcceptableError())
 		return
@@ -99,7 +90,7 @@ func (x *XEPPrivateStorage) getPrivate(iq *xml.IQ, q xml.Element) {
 	}
 	log.Infof("retrieving private element. ns: %s... (%s/%s)", privNS, x.strm.Username(), x.strm.Resource())
 
-	privElements, err := storage.Instance().FetchPrivateXML(privNS, x.strm.Username())
+	privElements, err := storage.Instance().FetchPrivateXML(ctx, privNS, x.strm.Username())
 	if err != nil {
 		log.Errorf("%v", err)
 		x.strm.SendElement(iq.InternalServerError())
@@ -118,6 +109,9 @@ func (x *XEPPrivateStorage) getPrivate(iq *xml.IQ, q xml.Element) {
 }
 
 func (x *XEPPrivateStorage) setPrivate(iq *xml.IQ, q xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	nsElements := map[string][]xml.Element{}
 
 	for _, privElement := range q.Elements() {
@@ -141,7 +135,7 @@ func (x *XEPPrivateStorage) setPrivate(iq *xml.IQ, q xml.Element) {
 	for ns, elements := range nsElements {
 		log.Infof("saving private element. ns: %s... (%s/%s)", ns, x.strm.Username(), x.strm.Resource())
 
-		if err := storage.Instance().InsertOrUpdatePrivateXML(elements, ns, x.strm.Username()); err != nil {
+		if err := storage.Instance().InsertOrUpdatePrivateXML(ctx, elements, ns, x.strm.Username()); err != nil {
 			log.Errorf("%v", err)
 			x.strm.SendElement(iq.InternalServerError())
 			return
@@ -34,6 +34,9 @@ func TestXEP0049_Matching(t *testing.T) {
 }
 
 func TestXEP0049_InvalidIQ(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd", j)
 	stm.SetUsername("romeo")
@@ -83,6 +86,9 @@ func TestXEP0049_InvalidIQ(t *testing.T) {
 }
 
 func TestXEP0049_SetAndGetPrivate(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	storage.Initialize(&config.Storage{Type: config.Mock})
 
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
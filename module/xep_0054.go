@@ -16,19 +16,16 @@ const vCardNamespace = "vcard-temp"
 
 // XEPVCard represents a vCard server stream module.
 type XEPVCard struct {
-	strm    c2s.Stream
-	actorCh chan func()
-	doneCh  chan struct{}
+	strm  c2s.Stream
+	actor *actor
 }
 
 // NewXEPVCard returns a vCard IQ handler module.
 func NewXEPVCard(strm c2s.Stream) *XEPVCard {
 	v := &XEPVCard{
-		strm:    strm,
-		actorCh: make(chan func(), moduleMailboxSize),
-		doneCh:  make(chan struct{}),
+		strm:  strm,
+		actor: newActor(nil),
 	}
-	go v.actorLoop()
 	return v
 }
 
@@ -40,7 +37,7 @@ func (x *XEPVCard) AssociatedNamespaces() []string {
 
 // Done signals stream termination.
 func (x *XEPVCard) Done() {
-	x.doneCh <- struct{}{}
+	x.actor.done()
 }
 
 // MatchesIQ returns whether or not an IQ should be
@@ -52,28 +49,22 @@ func (x *XEPVCard) MatchesIQ(iq *xml.IQ) bool {
 // ProcessIQ processes a vCard IQ taking according actions
 // over the associated stream.
 func (x *XEPVCard) ProcessIQ(iq *xml.IQ) {
-	x.actorCh <- func() {
+	x.actor.run(func() {
 		vCard := iq.FindElementNamespace("vCard", vCardNamespace)
 		if iq.IsGet() {
 			x.getVCard(vCard, iq)
 		} else if iq.IsSet() {
-			x.setVCard(vCard, iq)
+			if !c2s.Instance().GuardSession(x.strm, func() { x.setVCard(vCard, iq) }) {
+				x.strm.SendElement(iq.NotAuthorizedError())
+			}
 		}
-	}
-}
-
-func (x *XEPVCard) actorLoop() {
-	for {
-		select {
-		case f := <-x.actorCh:
-			f()
-		case <-x.doneCh:
-			return
-		}
-	}
+	})
 }
 
 func (x *XEPVCard) getVCard(vCard xml.Element, iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	if vCard.ElementsCount() > 0 {
 		x.strm.SendElement(iq.BadRequestError())
 		return
@@ -87,7 +78,7 @@ func (x *XEPVCard) getVCard(vCard xml.Element, iq *xml.IQ) {
 		username = toJid.Node()
 	}
 
-	resElem, err := storage.Instance().FetchVCard(username)
+	resElem, err := storage.Instance().FetchVCard(ctx, username)
 	if err != nil {
 		log.Errorf("%v", err)
 		x.strm.SendElement(iq.InternalServerError())
@@ -106,11 +97,14 @@ func (x *XEPVCard) getVCard(vCard xml.Element, iq *xml.IQ) {
 }
 
 func (x *XEPVCard) setVCard(vCard xml.Element, iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	toJid := iq.ToJID()
 	if toJid.IsServer() || (toJid.IsBare() && toJid.Node() == x.strm.Username()) {
 		log.Infof("saving vcard... (%s/%s)", x.strm.Username(), x.strm.Resource())
 
-		err := storage.Instance().InsertOrUpdateVCard(vCard, x.strm.Username())
+		err := storage.Instance().InsertOrUpdateVCard(ctx, vCard, x.strm.Username())
 		if err != nil {
 			log.Errorf("%v", err)
 			x.strm.SendElement(iq.InternalServerError())
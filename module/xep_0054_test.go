@@ -6,9 +6,12 @@
 package module
 
 import (
+	"context"
 	"testing"
 
+	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
@@ -42,6 +45,11 @@ func TestXEP0054_Matching(t *testing.T) {
 }
 
 func TestXEP0054_Set(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd", j)
 
@@ -75,6 +83,11 @@ func TestXEP0054_Set(t *testing.T) {
 }
 
 func TestXEP0054_SetError(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
 	stm := c2s.NewMockStream("abcd", j)
@@ -108,6 +121,11 @@ func TestXEP0054_SetError(t *testing.T) {
 }
 
 func TestXEP0054_Get(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
 	stm := c2s.NewMockStream("abcd", j)
@@ -150,6 +168,11 @@ func TestXEP0054_Get(t *testing.T) {
 }
 
 func TestXEP0054_GetError(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd", j)
 
@@ -189,6 +212,64 @@ func TestXEP0054_GetError(t *testing.T) {
 	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
 }
 
+func TestXEP0054_SetRacingAccountDeletion(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	stm1 := c2s.NewMockStream(uuid.New(), j1)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	for _, stm := range []*c2s.MockStream{stm1, stm2} {
+		stm.SetAuthenticated(true)
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+	}
+	x := NewXEPVCard(stm1)
+	defer x.Done()
+
+	r := NewXEPRegister(&config.ModRegistration{AllowCancel: true}, testHasher, stm2)
+	defer r.Done()
+
+	// enqueue vCard sets, and cancel registration while they're in flight
+	const setCount = moduleMailboxSize
+	for i := 0; i < setCount; i++ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetFromJID(j1)
+		iq.SetToJID(j1.ToBareJID())
+		iq.AppendElement(testVCard())
+		x.ProcessIQ(iq)
+	}
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	cancelIQ := xml.NewIQType(uuid.New(), xml.SetType)
+	cancelIQ.SetFromJID(j2)
+	cancelIQ.SetToJID(srvJid)
+	q := xml.NewElementNamespace("query", registerNamespace)
+	q.AppendElement(xml.NewElementName("remove"))
+	cancelIQ.AppendElement(q)
+	r.ProcessIQ(cancelIQ)
+
+	elem := stm2.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.False(t, c2s.Instance().IsValidSession(stm1))
+	require.NotNil(t, stm1.WaitDisconnection())
+
+	for i := 0; i < setCount; i++ {
+		elem := stm1.FetchElement()
+		if elem.Type() == xml.ErrorType {
+			require.Equal(t, xml.ErrNotAuthorized.Error(), elem.Error().Elements()[0].Name())
+		}
+	}
+	// no vCard has been written after account deletion
+	vCard, err := storage.Instance().FetchVCard(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Nil(t, vCard)
+}
+
 func testVCard() xml.Element {
 	vCard := xml.NewElementNamespace("vCard", vCardNamespace)
 	fn := xml.NewElementName("FN")
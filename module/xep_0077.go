@@ -6,29 +6,95 @@
 package module
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
+	"github.com/ortuman/jackal/denylist"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/maintenance"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
 )
 
-const registerNamespace = "jabber:iq:register"
+const (
+	registerNamespace        = "jabber:iq:register"
+	registerFeatureNamespace = "http://jabber.org/features/iq-register"
+	oobNamespace             = "jabber:x:oob"
+)
+
+var (
+	errEmptyUsername = errors.New("username is empty")
+	errUserExists    = errors.New("user already exists")
+	errInvalidInvite = errors.New("invalid invite token")
+)
+
+// maxRegistrationFieldLength is the largest accepted username or password length.
+const maxRegistrationFieldLength = 1023
+
+// accountNamespace is used by administrators to restore
+// a removed account before its grace period expires.
+const accountNamespace = "urn:jackal:account:0"
+
+// passwordResetNamespace is used by unauthenticated entities to reset
+// a forgotten password by means of an emailed token.
+const passwordResetNamespace = "urn:jackal:password-reset:0"
 
 // XEPRegister represents an in-band server stream module.
 type XEPRegister struct {
-	cfg        *config.ModRegistration
-	strm       c2s.Stream
-	registered bool
+	cfg          *config.ModRegistration
+	hasher       *credentials.Hasher
+	strm         c2s.Stream
+	tracker      *RegistrationTracker
+	reset        *PasswordReset
+	verifier     *EmailVerification
+	veto         *RegistrationVeto
+	pwdPolicy    *PasswordPolicy
+	mailer       MailSender
+	verifyMailer MailSender
+	async        func(f func())
+	routeFn      func(message *xml.Message)
+	validator    RegistrationValidator
+	denied       *denylist.List
+	blacklist    *denylist.List
+	whitelist    *denylist.List
+	guard        doneGuard
 }
 
 // NewXEPRegister returns an in-band registration IQ handler.
-func NewXEPRegister(config *config.ModRegistration, strm c2s.Stream) *XEPRegister {
-	return &XEPRegister{
-		cfg:  config,
-		strm: strm,
+func NewXEPRegister(config *config.ModRegistration, hasher *credentials.Hasher, strm c2s.Stream) *XEPRegister {
+	x := &XEPRegister{
+		cfg:          config,
+		hasher:       hasher,
+		strm:         strm,
+		tracker:      registrationTracker,
+		reset:        passwordReset,
+		verifier:     emailVerification,
+		veto:         registrationVeto,
+		pwdPolicy:    NewPasswordPolicy(&config.PasswordPolicy),
+		mailer:       newSMTPMailSender(&config.PasswordReset.SMTP),
+		verifyMailer: newSMTPMailSender(&config.EmailVerification.SMTP),
+		async:        func(f func()) { go f() },
+		validator:    currentRegistrationValidator(),
+	}
+	if len(config.DenyList) > 0 {
+		x.denied = denylist.Open(config.DenyList)
+	}
+	if len(config.Blacklist) > 0 {
+		x.blacklist = denylist.Compile(config.Blacklist)
 	}
+	if len(config.Whitelist) > 0 {
+		x.whitelist = denylist.Compile(config.Whitelist)
+	}
+	return x
 }
 
 // AssociatedNamespaces returns namespaces associated
@@ -37,38 +103,115 @@ func (x *XEPRegister) AssociatedNamespaces() []string {
 	return []string{registerNamespace}
 }
 
+// DiscoFeatures returns in-band registration disco info features.
+func (x *XEPRegister) DiscoFeatures() []string {
+	return []string{registerNamespace}
+}
+
+// StreamFeatures returns in-band registration stream feature,
+// offered before authenticating whenever registration is allowed
+// (over encrypted streams only, if required).
+func (x *XEPRegister) StreamFeatures() []xml.Element {
+	if !x.cfg.AllowRegistration || x.strm.IsAuthenticated() || x.requiresSecuring() {
+		return nil
+	}
+	return []xml.Element{xml.NewElementNamespace("register", registerFeatureNamespace)}
+}
+
 // Done signals stream termination.
 func (x *XEPRegister) Done() {
+	if x.guard.done() {
+		x.tracker.StreamClosed(x.strm.ID())
+	}
 }
 
 // MatchesIQ returns whether or not an IQ should be
 // processed by the in-band registration module.
 func (x *XEPRegister) MatchesIQ(iq *xml.IQ) bool {
-	return iq.FindElementNamespace("query", registerNamespace) != nil
+	return iq.FindElementNamespace("query", registerNamespace) != nil ||
+		iq.FindElementNamespace("restore", accountNamespace) != nil ||
+		iq.FindElementNamespace("reset", passwordResetNamespace) != nil ||
+		iq.FindElementNamespace("verify", emailVerificationNamespace) != nil ||
+		iq.FindElementNamespace("invite", inviteNamespace) != nil
 }
 
 // ProcessIQ processes an in-band registration IQ
 // taking according actions over the associated stream.
 func (x *XEPRegister) ProcessIQ(iq *xml.IQ) {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
 	if !x.isValidToJid(iq.ToJID()) {
 		x.strm.SendElement(iq.ForbiddenError())
 		return
 	}
 
+	if restore := iq.FindElementNamespace("restore", accountNamespace); restore != nil {
+		x.restoreAccount(iq, restore)
+		return
+	}
+	if reset := iq.FindElementNamespace("reset", passwordResetNamespace); reset != nil {
+		x.resetPassword(iq, reset)
+		return
+	}
+	if verify := iq.FindElementNamespace("verify", emailVerificationNamespace); verify != nil {
+		x.verifyEmail(iq, verify)
+		return
+	}
+	if iq.FindElementNamespace("invite", inviteNamespace) != nil {
+		x.mintInvite(iq)
+		return
+	}
 	q := iq.FindElementNamespace("query", registerNamespace)
 	if !x.strm.IsAuthenticated() {
+		if active, _ := maintenance.Active(); active {
+			// refuse new accounts while under maintenance
+			x.strm.SendElement(iq.ServiceUnavailableError())
+			return
+		}
 		if iq.IsGet() {
 			if !x.cfg.AllowRegistration {
+				if len(x.cfg.RedirectURL) > 0 {
+					// ...point requester entity to out of band registration...
+					result := iq.ResultIQ()
+					result.AppendElement(x.registrationRedirect())
+					x.strm.SendElement(result)
+					return
+				}
 				x.strm.SendElement(iq.NotAllowedError())
 				return
 			}
 			// ...send registration fields to requester entity...
 			x.sendRegistrationFields(iq, q)
 		} else if iq.IsSet() {
-			if !x.registered {
+			stats.Default().Counter("registration/attempts", "registrations").Inc()
+			if !x.cfg.AllowRegistration && len(x.cfg.RedirectURL) > 0 {
+				resp := xml.NewElementFromElement(iq)
+				resp.ClearElements()
+				resp.AppendElement(x.registrationRedirect())
+				x.strm.SendElement(notAcceptableError(resp, x.redirectInstructions()))
+				return
+			}
+			if x.requiresSecuring() {
+				// channel isn't safe enough to enable registration
+				x.strm.SendElement(iq.NotAuthorizedError())
+				return
+			}
+			if !x.tracker.WindowAllowed(x.cfg) {
+				log.Warnf("registration refused: %d accounts per window limit reached... id: %s", x.cfg.MaxPerWindow, x.strm.ID())
+				x.strm.SendElement(iq.ResourceConstraintError())
+				return
+			}
+			allowed, ipExhausted := x.tracker.Allowed(x.cfg, x.strm.ID(), remoteIP(x.strm.RemoteAddr()))
+			switch {
+			case allowed:
 				// ...register a new user...
 				x.registerNewUser(iq, q)
-			} else {
+			case ipExhausted:
+				x.strm.SendElement(iq.ResourceConstraintError())
+			default:
 				// return a <not-acceptable/> stanza error if an entity attempts to register a second identity
 				x.strm.SendElement(iq.NotAcceptableError())
 			}
@@ -82,13 +225,16 @@ func (x *XEPRegister) ProcessIQ(iq *xml.IQ) {
 		} else {
 			user := q.FindElement("username")
 			password := q.FindElement("password")
-			if user != nil && password != nil {
+			if isValidRegistrationField(user) && isValidRegistrationField(password) {
 				// change password
 				x.changePassword(password.Text(), user.Text(), iq)
 			} else {
 				x.strm.SendElement(iq.BadRequestError())
 			}
 		}
+	} else if iq.IsGet() {
+		// ...send current registration to already registered entity...
+		x.sendRegisteredFields(iq, q)
 	} else {
 		x.strm.SendElement(iq.BadRequestError())
 	}
@@ -101,20 +247,213 @@ func (x *XEPRegister) sendRegistrationFields(iq *xml.IQ, query xml.Element) {
 	}
 	result := iq.ResultIQ()
 	q := xml.NewElementNamespace("query", registerNamespace)
+	if x.requiresSecuring() {
+		instructions := xml.NewElementName("instructions")
+		instructions.SetText("Registration requires a secure connection: negotiate TLS before submitting these fields.")
+		q.AppendElement(instructions)
+	}
 	q.AppendElement(xml.NewElementName("username"))
 	q.AppendElement(xml.NewElementName("password"))
+	if x.cfg.RequireEmail {
+		q.AppendElement(xml.NewElementName("email"))
+	}
+	if x.cfg.TokenRequired {
+		q.AppendElement(xml.NewElementName("token"))
+	}
+	if len(x.cfg.Fields) > 0 || x.cfg.RequireEmail || x.cfg.TokenRequired {
+		q.AppendElement(x.registrationForm())
+	}
+	result.AppendElement(q)
+	x.strm.SendElement(result)
+}
+
+// sendRegisteredFields answers an authenticated entity with its current
+// registration, flagged as <registered/> (XEP-0077 §4).
+func (x *XEPRegister) sendRegisteredFields(iq *xml.IQ, query xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if query.ElementsCount() > 0 {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	user, err := storage.Instance().FetchUser(ctx, x.strm.Username())
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	if user == nil {
+		x.strm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	result := iq.ResultIQ()
+	q := xml.NewElementNamespace("query", registerNamespace)
+	q.AppendElement(xml.NewElementName("registered"))
+	username := xml.NewElementName("username")
+	username.SetText(user.Username)
+	q.AppendElement(username)
+	if x.cfg.AllowChange {
+		q.AppendElement(xml.NewElementName("password"))
+	}
+	if len(user.Email) > 0 {
+		email := xml.NewElementName("email")
+		email.SetText(user.Email)
+		q.AppendElement(email)
+	}
 	result.AppendElement(q)
 	x.strm.SendElement(result)
 }
 
+// registrationRedirect returns a query pointing to the configured
+// out of band registration page (XEP-0077 §5).
+func (x *XEPRegister) registrationRedirect() xml.Element {
+	q := xml.NewElementNamespace("query", registerNamespace)
+	instructions := xml.NewElementName("instructions")
+	instructions.SetText(x.redirectInstructions())
+	oob := xml.NewElementNamespace("x", oobNamespace)
+	url := xml.NewElementName("url")
+	url.SetText(x.cfg.RedirectURL)
+	oob.AppendElement(url)
+	q.AppendElements([]xml.Element{instructions, oob})
+	return q
+}
+
+func (x *XEPRegister) redirectInstructions() string {
+	return fmt.Sprintf("To register, visit %s", x.cfg.RedirectURL)
+}
+
+// requiresSecuring returns whether registration is refused
+// until the stream gets encrypted.
+func (x *XEPRegister) requiresSecuring() bool {
+	return x.cfg.RequireSecured && !x.strm.IsSecured()
+}
+
+// registrationForm returns a data form (XEP-0004) requesting every
+// registration field, including configured additional ones.
+func (x *XEPRegister) registrationForm() xml.Element {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "form")
+	formType := registrationFieldElement("FORM_TYPE", "hidden", "", false)
+	value := xml.NewElementName("value")
+	value.SetText(registerNamespace)
+	formType.AppendElement(value)
+	form.AppendElement(formType)
+	form.AppendElement(registrationFieldElement("username", "text-single", "Username", true))
+	form.AppendElement(registrationFieldElement("password", "text-private", "Password", true))
+	if x.cfg.RequireEmail {
+		form.AppendElement(registrationFieldElement("email", "text-single", "Email", true))
+	}
+	if x.cfg.TokenRequired {
+		form.AppendElement(registrationFieldElement("token", "text-single", "Invite token", true))
+	}
+	for _, f := range x.cfg.Fields {
+		if (f.Var == "email" && x.cfg.RequireEmail) || (f.Var == "token" && x.cfg.TokenRequired) {
+			continue
+		}
+		form.AppendElement(registrationFieldElement(f.Var, f.Type, f.Label, f.Required))
+	}
+	return form
+}
+
+func registrationFieldElement(name, typ, label string, required bool) *xml.MutableElement {
+	field := xml.NewElementName("field")
+	field.SetAttribute("var", name)
+	field.SetAttribute("type", typ)
+	if len(label) > 0 {
+		field.SetAttribute("label", label)
+	}
+	if required {
+		field.AppendElement(xml.NewElementName("required"))
+	}
+	return field
+}
+
+// registrationQuery returns the registration fields submitted either as
+// classic flat fields or by means of a data form, the latter being returned
+// as an equivalent flat query. It returns false whenever the form is invalid
+// or any configured required field is missing.
+func (x *XEPRegister) registrationQuery(query xml.Element) (xml.Element, bool) {
+	if form := query.FindElementNamespace("x", dataFormNamespace); form != nil {
+		if form.Type() != "submit" {
+			return nil, false
+		}
+		flat := xml.NewElementNamespace("query", registerNamespace)
+		for _, field := range form.FindElements("field") {
+			name := field.Attribute("var")
+			if len(name) == 0 {
+				continue
+			}
+			var text string
+			if value := field.FindElement("value"); value != nil {
+				text = value.Text()
+			}
+			if name == "FORM_TYPE" {
+				if text != registerNamespace {
+					return nil, false
+				}
+				continue
+			}
+			elem := xml.NewElementName(name)
+			elem.SetText(text)
+			flat.AppendElement(elem)
+		}
+		query = flat
+	}
+	for _, f := range x.cfg.Fields {
+		if f.Required && !isValidRegistrationField(query.FindElement(f.Var)) {
+			return nil, false
+		}
+	}
+	if x.cfg.RequireEmail {
+		email := query.FindElement("email")
+		if !isValidRegistrationField(email) || !isValidEmail(email.Text()) {
+			return nil, false
+		}
+	}
+	if x.cfg.TokenRequired && !isValidRegistrationField(query.FindElement("token")) {
+		return nil, false
+	}
+	return query, true
+}
+
 func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	query, ok := x.registrationQuery(query)
+	if !ok {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
 	userEl := query.FindElement("username")
 	passwordEl := query.FindElement("password")
-	if userEl == nil || passwordEl == nil || len(userEl.Text()) == 0 || len(passwordEl.Text()) == 0 {
+	if !isValidRegistrationField(userEl) || !isValidRegistrationField(passwordEl) {
 		x.strm.SendElement(iq.BadRequestError())
 		return
 	}
-	exists, err := storage.Instance().UserExists(userEl.Text())
+	username, err := x.prepUsername(userEl.Text())
+	if err != nil {
+		log.Infof("registration of malformed username denied: %s", userEl.Text())
+		x.strm.SendElement(badRequestError(iq, "Username is not a valid JID node"))
+		return
+	}
+	if !x.checkPassword(iq, passwordEl.Text()) {
+		return
+	}
+	if x.denied != nil && x.denied.Matches(username) {
+		log.Infof("registration of reserved username denied: %s", username)
+		x.strm.SendElement(iq.NotAllowedError())
+		return
+	}
+	if !x.isAcceptableUsername(username) {
+		log.Infof("registration of unacceptable username denied: %s", username)
+		x.strm.SendElement(iq.NotAcceptableError())
+		return
+	}
+	// taken usernames are refused before consulting veto hooks and
+	// validators, availability being checked again on insertion
+	exists, err := storage.Instance().UserExists(ctx, username)
 	if err != nil {
 		log.Errorf("%v", err)
 		x.strm.SendElement(iq.InternalServerError())
@@ -124,20 +463,157 @@ func (x *XEPRegister) registerNewUser(iq *xml.IQ, query xml.Element) {
 		x.strm.SendElement(iq.ConflictError())
 		return
 	}
-	user := model.User{
-		Username: userEl.Text(),
-		Password: passwordEl.Text(),
+	if len(x.cfg.Veto.URL) > 0 && !x.approveRegistration(iq, query, username) {
+		return
+	}
+	if x.validator != nil {
+		if err := x.validator.Validate(username, passwordEl.Text(), x.strm.RemoteAddr()); err != nil {
+			log.Infof("registration rejected by validator: %s (%v)", username, err)
+			x.strm.SendElement(notAcceptableError(iq, err.Error()))
+			return
+		}
+	}
+	user := model.User{Username: username}
+	if x.cfg.RequireEmail {
+		user.Email = query.FindElement("email").Text()
 	}
-	if err := storage.Instance().InsertOrUpdateUser(&user); err != nil {
+	var inviteToken string
+	if x.cfg.TokenRequired {
+		inviteToken = query.FindElement("token").Text()
+	}
+	switch err := x.insertNewUser(ctx, &user, passwordEl.Text(), inviteToken); err {
+	case nil:
+		break
+	case errUserExists:
+		x.strm.SendElement(iq.ConflictError())
+		return
+	case errInvalidInvite:
+		x.strm.SendElement(iq.NotAcceptableError())
+		return
+	default:
 		log.Errorf("%v", err)
 		x.strm.SendElement(iq.InternalServerError())
 		return
 	}
 	x.strm.SendElement(iq.ResultIQ())
-	x.registered = true
+	x.tracker.Registered(x.strm.ID(), remoteIP(x.strm.RemoteAddr()))
+	stats.Default().Counter("registration/successes", "registrations").Inc()
+	x.notifyRegistration(user.Username)
+
+	if user.IsPendingVerification() {
+		domain := x.strm.Domain()
+		x.async(func() { x.sendVerificationToken(user.Username, user.Email, domain) })
+	}
+}
+
+// insertNewUser stores a new account within a transaction, failing with
+// errUserExists if username is already registered, so that concurrent
+// registrations can't overwrite each other. Password only gets hashed once
+// username is known to be available. Whenever inviteToken is not empty
+// it gets redeemed along with the insertion, failing with errInvalidInvite
+// if it can't be.
+func (x *XEPRegister) insertNewUser(ctx context.Context, user *model.User, password, inviteToken string) error {
+	err := storage.Instance().InTransaction(ctx, func(tx storage.Storage) error {
+		exists, err := tx.UserExists(ctx, user.Username)
+		if err != nil {
+			return err
+		}
+		if exists {
+			return errUserExists
+		}
+		if err := x.hasher.SetPassword(user, password); err != nil {
+			return err
+		}
+		if len(inviteToken) > 0 {
+			// unknown, expired and already used tokens are all rejected
+			// alike, so as not to reveal which ones exist
+			ok, err := tx.RedeemInvite(ctx, inviteToken, time.Now())
+			if err != nil {
+				return err
+			}
+			if !ok {
+				return errInvalidInvite
+			}
+		}
+		return tx.InsertOrUpdateUser(ctx, user)
+	})
+	if err == storage.ErrConflict {
+		// a concurrent registration of the same username won
+		return errUserExists
+	}
+	return err
+}
+
+// prepUsername returns username in its canonical JID node form,
+// surrounding whitespace aside.
+func (x *XEPRegister) prepUsername(username string) (string, error) {
+	username = strings.TrimSpace(username)
+	if len(username) == 0 {
+		return "", errEmptyUsername
+	}
+	j, err := xml.NewJID(username, x.strm.Domain(), "", false)
+	if err != nil {
+		return "", err
+	}
+	return j.Node(), nil
+}
+
+// isStreamUsername reports whether username matches the stream
+// account once both are normalized.
+func (x *XEPRegister) isStreamUsername(username string) bool {
+	prepped, err := x.prepUsername(username)
+	if err != nil {
+		return false
+	}
+	strmUsername, err := x.prepUsername(x.strm.Username())
+	if err != nil {
+		return false
+	}
+	return prepped == strmUsername
+}
+
+// isAcceptableUsername reports whether username is allowed by configured
+// black and white lists, username being already in its normalized JID node form.
+func (x *XEPRegister) isAcceptableUsername(username string) bool {
+	if x.blacklist != nil && x.blacklist.Matches(username) {
+		return false
+	}
+	return x.whitelist == nil || x.whitelist.Matches(username)
+}
+
+// approveRegistration asks the veto endpoint for approval of a new account,
+// answering the requester whenever it gets rejected.
+func (x *XEPRegister) approveRegistration(iq *xml.IQ, query xml.Element, username string) bool {
+	candidate := &RegistrationCandidate{
+		Username: username,
+		IP:       remoteIP(x.strm.RemoteAddr()),
+		Domain:   x.strm.Domain(),
+		StreamID: x.strm.ID(),
+		Secured:  x.strm.IsSecured(),
+	}
+	if email := query.FindElement("email"); email != nil {
+		candidate.Email = email.Text()
+	}
+	verdict, err := x.veto.Check(&x.cfg.Veto, candidate)
+	if err != nil {
+		log.Errorf("registration veto failed for %s: %v", username, err)
+		if !verdict.Allowed {
+			x.strm.SendElement(iq.ServiceUnavailableError())
+			return false
+		}
+	}
+	if !verdict.Allowed {
+		log.Infof("registration vetoed: %s (%s)", username, verdict.Reason)
+		x.strm.SendElement(notAcceptableError(iq, verdict.Reason))
+		return false
+	}
+	return true
 }
 
 func (x *XEPRegister) cancelRegistration(iq *xml.IQ, query xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	if !x.cfg.AllowCancel {
 		x.strm.SendElement(iq.NotAllowedError())
 		return
@@ -146,11 +622,98 @@ func (x *XEPRegister) cancelRegistration(iq *xml.IQ, query xml.Element) {
 		x.strm.SendElement(iq.BadRequestError())
 		return
 	}
-	if err := storage.Instance().DeleteUser(x.strm.Username()); err != nil {
+	if x.cfg.RemovalGracePeriod > 0 {
+		x.scheduleRemoval(iq)
+		return
+	}
+	if err := storage.Instance().DeleteUser(ctx, x.strm.Username()); err != nil {
 		log.Error(err)
 		x.strm.SendElement(iq.InternalServerError())
 		return
 	}
+	strms := c2s.Instance().InvalidateSessions(x.strm.Username())
+	x.strm.SendElement(iq.ResultIQ())
+
+	for _, strm := range strms {
+		strm.Terminate(streamerror.ErrNotAuthorized, "Account removed")
+	}
+}
+
+// scheduleRemoval disables the account keeping its data until
+// grace period expires, disconnecting every associated stream.
+func (x *XEPRegister) scheduleRemoval(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	// flag the account within a transaction, so that a concurrent
+	// update can't bring back an account scheduled for removal
+	var removed *model.User
+	err := storage.Instance().InTransaction(ctx, func(tx storage.Storage) error {
+		user, err := tx.FetchUser(ctx, x.strm.Username())
+		if err != nil || user == nil {
+			return err
+		}
+		u := *user
+		u.PurgeAt = time.Now().Add(time.Second * time.Duration(x.cfg.RemovalGracePeriod))
+		removed = &u
+		return tx.InsertOrUpdateUser(ctx, removed)
+	})
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	if removed == nil {
+		x.strm.SendElement(iq.ResultIQ())
+		return
+	}
+	log.Infof("account scheduled for removal: %s (purge at: %v)", removed.Username, removed.PurgeAt)
+
+	// never invalidate from within the transaction, as it waits for
+	// guarded writes that may be waiting for the transaction themselves
+	strms := c2s.Instance().InvalidateSessions(removed.Username)
+	x.strm.SendElement(iq.ResultIQ())
+
+	for _, strm := range strms {
+		strm.Terminate(streamerror.ErrNotAuthorized, "Account removed")
+	}
+}
+
+func (x *XEPRegister) restoreAccount(iq *xml.IQ, restore xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if !iq.IsSet() {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	if !x.strm.IsAuthenticated() || !c2s.Instance().IsAdmin(x.strm.JID()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	username, err := x.prepUsername(restore.Attribute("username"))
+	if err != nil {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	user, err := storage.Instance().FetchUser(ctx, username)
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	if user == nil || !user.IsRemoved() {
+		x.strm.SendElement(iq.ItemNotFoundError())
+		return
+	}
+	restored := *user
+	restored.PurgeAt = time.Time{}
+	if err := storage.Instance().InsertOrUpdateUser(ctx, &restored); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	log.Infof("restored removed account: %s", username)
 	x.strm.SendElement(iq.ResultIQ())
 }
 
@@ -159,7 +722,7 @@ func (x *XEPRegister) changePassword(password string, username string, iq *xml.I
 		x.strm.SendElement(iq.NotAllowedError())
 		return
 	}
-	if username != x.strm.Username() {
+	if !x.isStreamUsername(username) {
 		x.strm.SendElement(iq.NotAllowedError())
 		return
 	}
@@ -168,7 +731,19 @@ func (x *XEPRegister) changePassword(password string, username string, iq *xml.I
 		x.strm.SendElement(iq.NotAuthorizedError())
 		return
 	}
-	user, err := storage.Instance().FetchUser(username)
+	if !x.checkPassword(iq, password) {
+		return
+	}
+	if !c2s.Instance().GuardSession(x.strm, func() { x.updatePassword(iq, x.strm.Username(), password) }) {
+		x.strm.SendElement(iq.NotAuthorizedError())
+	}
+}
+
+func (x *XEPRegister) updatePassword(iq *xml.IQ, username, password string) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	user, err := storage.Instance().FetchUser(ctx, username)
 	if err != nil {
 		log.Error(err)
 		x.strm.SendElement(iq.InternalServerError())
@@ -178,20 +753,267 @@ func (x *XEPRegister) changePassword(password string, username string, iq *xml.I
 		x.strm.SendElement(iq.ResultIQ())
 		return
 	}
-	if user.Password != password {
-		user.Password = password
-		if err := storage.Instance().InsertOrUpdateUser(user); err != nil {
+	if !credentials.Verify(user, password) || x.hasher.NeedsUpgrade(user) {
+		if err := x.hasher.SetPassword(user, password); err != nil {
+			log.Error(err)
+			x.strm.SendElement(iq.InternalServerError())
+			return
+		}
+		if err := storage.Instance().InsertOrUpdateUser(ctx, user); err != nil {
 			log.Error(err)
 			x.strm.SendElement(iq.InternalServerError())
 			return
 		}
+		if x.cfg.KickOnPasswordChange {
+			x.disconnectOtherSessions(username)
+		}
+	}
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+// disconnectOtherSessions terminates every other stream authenticated
+// with username credentials, keeping the requesting one. Requester may
+// be unauthenticated, as when resetting a forgotten password.
+func (x *XEPRegister) disconnectOtherSessions(username string) {
+	for _, strm := range c2s.Instance().AvailableStreams(username) {
+		if strm != x.strm {
+			strm.Terminate(streamerror.ErrNotAuthorized, "Password changed")
+		}
+	}
+}
+
+// checkPassword answers the requester with the failed rule
+// whenever password doesn't comply with the configured policy.
+func (x *XEPRegister) checkPassword(iq *xml.IQ, password string) bool {
+	if err := x.pwdPolicy.Check(password); err != nil {
+		x.strm.SendElement(notAcceptableError(iq, err.Error()))
+		return false
+	}
+	return true
+}
+
+func (x *XEPRegister) resetPassword(iq *xml.IQ, reset xml.Element) {
+	if !x.cfg.PasswordReset.Enabled {
+		x.strm.SendElement(iq.NotAllowedError())
+		return
+	}
+	if !iq.IsSet() || x.strm.IsAuthenticated() {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	userEl := reset.FindElement("username")
+	if !isValidRegistrationField(userEl) {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	username, err := x.prepUsername(userEl.Text())
+	if err != nil {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	tokenEl := reset.FindElement("token")
+	if tokenEl == nil {
+		x.requestPasswordReset(iq, username)
+		return
 	}
+	passwordEl := reset.FindElement("password")
+	if !isValidRegistrationField(passwordEl) {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	if !x.checkPassword(iq, passwordEl.Text()) {
+		return
+	}
+	if !x.reset.Consume(username, tokenEl.Text()) {
+		x.strm.SendElement(iq.NotAuthorizedError())
+		return
+	}
+	log.Infof("password reset: %s", username)
+	x.updatePassword(iq, username, passwordEl.Text())
+}
+
+func (x *XEPRegister) requestPasswordReset(iq *xml.IQ, username string) {
+	if !x.reset.Allowed(&x.cfg.PasswordReset, username, remoteIP(x.strm.RemoteAddr())) {
+		x.strm.SendElement(iq.ResourceConstraintError())
+		return
+	}
+	// answer right away, so that neither the response nor its
+	// timing reveal whether or not the account exists
 	x.strm.SendElement(iq.ResultIQ())
+	domain := x.strm.Domain()
+	x.async(func() { x.sendPasswordResetToken(username, domain) })
+}
+
+func (x *XEPRegister) sendPasswordResetToken(username, domain string) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	user, err := storage.Instance().FetchUser(ctx, username)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if user == nil || user.IsRemoved() {
+		return
+	}
+	email, err := x.passwordResetEmail(user)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(email) == 0 {
+		log.Infof("password reset requested for account with no verified email: %s", username)
+		return
+	}
+	token, err := x.reset.Issue(&x.cfg.PasswordReset, username)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	body := fmt.Sprintf("A password reset has been requested for %s@%s.\r\n\r\nReset token: %s\r\n", username, domain, token)
+	if err := x.mailer.SendMail(email, "Password reset", body); err != nil {
+		log.Error(err)
+	}
+}
+
+// verifyEmail confirms a pending account email address by means of its
+// emailed token, or mails a new one to an authenticated pending account.
+func (x *XEPRegister) verifyEmail(iq *xml.IQ, verify xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if !x.cfg.RequireEmail {
+		x.strm.SendElement(iq.NotAllowedError())
+		return
+	}
+	if !iq.IsSet() {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	username := x.strm.Username()
+	if !x.strm.IsAuthenticated() {
+		userEl := verify.FindElement("username")
+		if !isValidRegistrationField(userEl) {
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		prepped, err := x.prepUsername(userEl.Text())
+		if err != nil {
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		username = prepped
+	}
+	tokenEl := verify.FindElement("token")
+	if tokenEl == nil {
+		if !x.strm.IsAuthenticated() {
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		x.resendVerificationToken(iq)
+		return
+	}
+	if !x.verifier.Consume(username, tokenEl.Text()) {
+		x.strm.SendElement(iq.NotAuthorizedError())
+		return
+	}
+	user, err := storage.Instance().FetchUser(ctx, username)
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	if user == nil {
+		x.strm.SendElement(iq.NotAuthorizedError())
+		return
+	}
+	verified := *user
+	verified.EmailVerified = true
+	if err := storage.Instance().InsertOrUpdateUser(ctx, &verified); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	log.Infof("email verified: %s", username)
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPRegister) resendVerificationToken(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	user, err := storage.Instance().FetchUser(ctx, x.strm.Username())
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.strm.SendElement(iq.ResultIQ())
+	if user != nil && user.IsPendingVerification() {
+		domain := x.strm.Domain()
+		x.async(func() { x.sendVerificationToken(user.Username, user.Email, domain) })
+	}
+}
+
+func (x *XEPRegister) sendVerificationToken(username, email, domain string) {
+	token, err := x.verifier.Issue(&x.cfg.EmailVerification, username)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	body := fmt.Sprintf("Please confirm %s as the email address of %s@%s.\r\n\r\nVerification token: %s\r\n", email, username, domain, token)
+	if err := x.verifyMailer.SendMail(email, "Email verification", body); err != nil {
+		log.Error(err)
+	}
+}
+
+// passwordResetEmail returns the address password reset tokens are mailed to,
+// that is, user verified registration email address. Accounts with no
+// registration address fall back to their vCard one only if configured,
+// while pending ones are never mailed.
+func (x *XEPRegister) passwordResetEmail(user *model.User) (string, error) {
+	if len(user.Email) > 0 {
+		if !user.EmailVerified {
+			return "", nil
+		}
+		return user.Email, nil
+	}
+	if !x.cfg.PasswordReset.VCardFallback {
+		return "", nil
+	}
+	return accountEmail(user.Username)
+}
+
+// accountEmail returns the email address published in username vCard, if any.
+func accountEmail(username string) (string, error) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	vCard, err := storage.Instance().FetchVCard(ctx, username)
+	if err != nil || vCard == nil {
+		return "", err
+	}
+	for _, email := range vCard.FindElements("EMAIL") {
+		if userID := email.FindElement("USERID"); userID != nil && len(strings.TrimSpace(userID.Text())) > 0 {
+			return strings.TrimSpace(userID.Text()), nil
+		}
+	}
+	return "", nil
 }
 
 func (x *XEPRegister) isValidToJid(jid *xml.JID) bool {
 	if x.strm.IsAuthenticated() {
 		return jid.IsServer()
 	}
-	return jid.IsServer() || (jid.IsBare() && jid.Node() == x.strm.Username())
+	return jid.IsServer() || (jid.IsBare() && x.isStreamUsername(jid.Node()))
+}
+
+// isValidRegistrationField returns whether or not a registration
+// field element carries a non blank value within length bounds.
+func isValidRegistrationField(field xml.Element) bool {
+	if field == nil {
+		return false
+	}
+	text := field.Text()
+	return len(strings.TrimSpace(text)) > 0 && len(text) <= maxRegistrationFieldLength
 }
@@ -6,13 +6,29 @@
 package module
 
 import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
+	"github.com/ortuman/jackal/denylist"
+	"github.com/ortuman/jackal/maintenance"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
+	"github.com/ortuman/jackal/xmpputil/timefmt"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
 )
@@ -20,7 +36,7 @@ import (
 func TestXEP0077_Matching(t *testing.T) {
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 
-	x := NewXEPRegister(&config.ModRegistration{}, nil)
+	x := NewXEPRegister(&config.ModRegistration{}, testHasher, c2s.NewMockStream("abcd1234", j))
 	defer x.Done()
 
 	require.Equal(t, []string{registerNamespace}, x.AssociatedNamespaces())
@@ -38,7 +54,7 @@ func TestXEP0077_InvalidToJID(t *testing.T) {
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd1234", j)
 
-	x := NewXEPRegister(&config.ModRegistration{}, stm)
+	x := NewXEPRegister(&config.ModRegistration{}, testHasher, stm)
 	defer x.Done()
 
 	stm.SetUsername("romeo")
@@ -50,6 +66,17 @@ func TestXEP0077_InvalidToJID(t *testing.T) {
 	elem := stm.FetchElement()
 	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
 
+	// node compared once normalized
+	stm.SetUsername("Ortuman")
+	getIQ := xml.NewIQType(uuid.New(), xml.GetType)
+	getIQ.SetFromJID(j)
+	getIQ.SetToJID(j.ToBareJID())
+	getIQ.AppendElement(xml.NewElementNamespace("query", registerNamespace))
+
+	x.ProcessIQ(getIQ)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements()[0].Name())
+
 	iq2 := xml.NewIQType(uuid.New(), xml.SetType)
 	iq2.SetFromJID(j)
 	iq2.SetToJID(j.ToBareJID())
@@ -66,7 +93,7 @@ func TestXEP0077_NotAuthenticatedErrors(t *testing.T) {
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd1234", j)
 
-	x := NewXEPRegister(&config.ModRegistration{}, stm)
+	x := NewXEPRegister(&config.ModRegistration{}, testHasher, stm)
 	defer x.Done()
 
 	iq := xml.NewIQType(uuid.New(), xml.ResultType)
@@ -83,7 +110,7 @@ func TestXEP0077_NotAuthenticatedErrors(t *testing.T) {
 	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements()[0].Name())
 
 	// allow registration...
-	x = NewXEPRegister(&config.ModRegistration{AllowRegistration: true}, stm)
+	x = NewXEPRegister(&config.ModRegistration{AllowRegistration: true}, testHasher, stm)
 	defer x.Done()
 
 	q := xml.NewElementNamespace("query", registerNamespace)
@@ -96,7 +123,7 @@ func TestXEP0077_NotAuthenticatedErrors(t *testing.T) {
 
 	q.ClearElements()
 	iq.SetType(xml.SetType)
-	x.registered = true
+	x.tracker.Registered(stm.ID(), "")
 
 	x.ProcessIQ(iq)
 	elem = stm.FetchElement()
@@ -110,7 +137,7 @@ func TestXEP0077_AuthenticatedErrors(t *testing.T) {
 	stm := c2s.NewMockStream("abcd1234", j)
 	stm.SetAuthenticated(true)
 
-	x := NewXEPRegister(&config.ModRegistration{}, stm)
+	x := NewXEPRegister(&config.ModRegistration{}, testHasher, stm)
 	defer x.Done()
 
 	iq := xml.NewIQType(uuid.New(), xml.ResultType)
@@ -129,15 +156,66 @@ func TestXEP0077_AuthenticatedErrors(t *testing.T) {
 	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
 }
 
+func TestXEP0077_RegistrationRedirect(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+
+	x := NewXEPRegister(&config.ModRegistration{RedirectURL: "https://jackal.im/signup"}, testHasher, stm)
+	defer x.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetToJID(srvJid)
+	q := xml.NewElementNamespace("query", registerNamespace)
+	iq.AppendElement(q)
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q2 := elem.FindElementNamespace("query", registerNamespace)
+	require.NotNil(t, q2.FindElement("instructions"))
+	oob := q2.FindElementNamespace("x", oobNamespace)
+	require.NotNil(t, oob)
+	require.Equal(t, "https://jackal.im/signup", oob.FindElement("url").Text())
+
+	username := xml.NewElementName("username")
+	username.SetText("romeo")
+	password := xml.NewElementName("password")
+	password.SetText("1234")
+	q.AppendElements([]xml.Element{username, password})
+	iq.SetType(xml.SetType)
+
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().FindElement(xml.ErrNotAcceptable.Error()))
+	require.Contains(t, elem.Error().FindElement("text").Text(), "https://jackal.im/signup")
+	oob = elem.FindElementNamespace("query", registerNamespace).FindElementNamespace("x", oobNamespace)
+	require.NotNil(t, oob)
+	require.Equal(t, "https://jackal.im/signup", oob.FindElement("url").Text())
+
+	exists, _ := storage.Instance().UserExists(context.Background(), "romeo")
+	require.False(t, exists)
+}
+
 func TestXEP0077_RegisterUser(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
 	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
 
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd1234", j)
 
-	x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true}, stm)
+	x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true}, testHasher, stm)
 	defer x.Done()
 
+	attempts := stats.Default().Counter("registration/attempts", "registrations").Value()
+	successes := stats.Default().Counter("registration/successes", "registrations").Value()
+
 	iq := xml.NewIQType(uuid.New(), xml.GetType)
 	iq.SetFromJID(srvJid)
 	iq.SetToJID(srvJid)
@@ -162,40 +240,370 @@ func TestXEP0077_RegisterUser(t *testing.T) {
 	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
 
 	// already existing user...
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
 	username.SetText("ortuman")
 	password.SetText("5678")
 	x.ProcessIQ(iq)
 	elem = stm.FetchElement()
 	require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements()[0].Name())
 
+	// storage errors, armed for a single call each
+	storage.ActivateMockedErrorForNext("UserExists", 1)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+
+	storage.ActivateMockedErrorForNext("InsertOrUpdateUser", 1)
+	username.SetText("juliet")
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+
+	storage.ResetMockedCalls()
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, 2, storage.MockedCalls("UserExists")) // checked again within the insertion transaction
+	require.Equal(t, 1, storage.MockedCalls("InsertOrUpdateUser"))
+
+	usr, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
+	require.NotNil(t, usr)
+
+	// password never gets stored in plain text
+	usr, _ = storage.Instance().FetchUser(context.Background(), "juliet")
+	require.NotNil(t, usr)
+	require.Equal(t, "", usr.Password)
+	require.NotEqual(t, "5678", usr.PasswordHash)
+	require.NotNil(t, usr.Verifier)
+	require.True(t, credentials.Verify(usr, "5678"))
+	require.False(t, credentials.Verify(usr, "1234"))
+
+	require.Equal(t, int64(5), stats.Default().Counter("registration/attempts", "registrations").Value()-attempts)
+	require.Equal(t, int64(1), stats.Default().Counter("registration/successes", "registrations").Value()-successes)
+}
+
+func TestXEP0077_RequireSecured(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+
+	x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true, RequireSecured: true, MaxPerConnection: 2}, testHasher, stm)
+	defer x.Done()
+
+	// fields are sent over unsecured streams, noting TLS is required
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(srvJid)
+	iq.SetToJID(srvJid)
+	iq.AppendElement(xml.NewElementNamespace("query", registerNamespace))
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q := elem.FindElementNamespace("query", registerNamespace)
+	require.NotNil(t, q.FindElement("username"))
+	require.NotNil(t, q.FindElement("instructions"))
+
+	registerIQ := func(username string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetFromJID(srvJid)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElements([]xml.Element{u, p})
+		iq.AppendElement(q)
+		return iq
+	}
+	x.ProcessIQ(registerIQ("tybalt"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAuthorized.Error(), elem.Error().Elements()[0].Name())
+	usr, _ := storage.Instance().FetchUser(context.Background(), "tybalt")
+	require.Nil(t, usr)
+
+	// secured stream
+	stm.SetSecured(true)
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Nil(t, elem.FindElementNamespace("query", registerNamespace).FindElement("instructions"))
+
+	x.ProcessIQ(registerIQ("tybalt"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	// not required
+	stm.SetSecured(false)
+	x.cfg.RequireSecured = false
+	x.ProcessIQ(registerIQ("paris"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+}
+
+func TestXEP0077_RegistrationNotification(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+	stm.SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP("203.0.113.21"), Port: 41234})
+
+	cfg := config.ModRegistration{
+		AllowRegistration: true,
+		MaxPerConnection:  5,
+		NotifyJIDs:        []string{"admin@jackal.im", "ops@jackal.im"},
+	}
+	x := NewXEPRegister(&cfg, testHasher, stm)
+	defer x.Done()
+
+	var notifications []*xml.Message
+	x.SetNotificationRouter(func(message *xml.Message) {
+		notifications = append(notifications, message)
+	})
+	register := func(username string) xml.Element {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetFromJID(srvJid)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElements([]xml.Element{u, p})
+		iq.AppendElement(q)
+		x.ProcessIQ(iq)
+		return stm.FetchElement()
+	}
+	start := time.Now()
+	require.Equal(t, xml.ResultType, register("balthasar").Type())
+	require.Equal(t, 2, len(notifications))
+	require.Equal(t, "admin@jackal.im", notifications[0].To())
+	require.Equal(t, "ops@jackal.im", notifications[1].To())
+
+	n := notifications[0]
+	require.True(t, n.IsHeadline())
+	require.Equal(t, "jackal.im", n.From())
+	body := n.FindElement("body").Text()
+	require.Contains(t, body, "balthasar@jackal.im")
+	require.Contains(t, body, "203.0.113.21")
+
+	i := strings.Index(body, "time: ")
+	require.True(t, i > 0)
+	stamp, err := timefmt.Parse(strings.TrimSuffix(body[i+len("time: "):], ")"))
+	require.Nil(t, err)
+	require.False(t, stamp.Before(start.Truncate(time.Millisecond)))
+
+	// never notified on conflict...
+	notifications = nil
+	require.Equal(t, xml.ErrConflict.Error(), register("balthasar").Error().Elements()[0].Name())
+	require.Equal(t, 0, len(notifications))
+
+	// ...nor on storage errors
+	storage.ActivateMockedError()
+	require.Equal(t, xml.ErrInternalServerError.Error(), register("abram").Error().Elements()[0].Name())
+	storage.DeactivateMockedError()
+	require.Equal(t, 0, len(notifications))
+}
+
+func TestXEP0077_RegisteredFields(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+
+	cfg := config.ModRegistration{AllowRegistration: true, AllowChange: true}
+	x := NewXEPRegister(&cfg, testHasher, stm)
+	defer x.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(srvJid)
+	iq.AppendElement(xml.NewElementNamespace("query", registerNamespace))
+
+	// fresh stream
+	x.ProcessIQ(iq)
+	q := stm.FetchElement().FindElementNamespace("query", registerNamespace)
+	require.Nil(t, q.FindElement("registered"))
+	require.Equal(t, "", q.FindElement("username").Text())
+
+	// authenticated stream
+	stm.SetAuthenticated(true)
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q = elem.FindElementNamespace("query", registerNamespace)
+	require.NotNil(t, q.FindElement("registered"))
+	require.Equal(t, "ortuman", q.FindElement("username").Text())
+	require.NotNil(t, q.FindElement("password"))
+	require.Equal(t, "", q.FindElement("password").Text())
+	require.Nil(t, q.FindElement("email"))
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234", Email: "ortuman@example.com"})
+	x.ProcessIQ(iq)
+	q = stm.FetchElement().FindElementNamespace("query", registerNamespace)
+	require.Equal(t, "ortuman@example.com", q.FindElement("email").Text())
+
 	// storage error
 	storage.ActivateMockedError()
 	x.ProcessIQ(iq)
 	elem = stm.FetchElement()
 	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
-
 	storage.DeactivateMockedError()
-	username.SetText("juliet")
+
+	// not existing account
+	storage.Instance().DeleteUser(context.Background(), "ortuman")
 	x.ProcessIQ(iq)
 	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+}
+
+func TestXEP0077_RegisterUserForm(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+
+	cfg := &config.ModRegistration{
+		AllowRegistration: true,
+		MaxPerConnection:  2,
+		Fields: []config.RegistrationField{
+			{Var: "email", Label: "Email", Type: "text-single", Required: true},
+			{Var: "nick", Type: "text-single"},
+		},
+	}
+	x := NewXEPRegister(cfg, testHasher, stm)
+	defer x.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(srvJid)
+	iq.SetToJID(srvJid)
+	iq.AppendElement(xml.NewElementNamespace("query", registerNamespace))
+
+	x.ProcessIQ(iq)
+	q := stm.FetchElement().FindElementNamespace("query", registerNamespace)
+	require.NotNil(t, q.FindElement("username"))
+	require.NotNil(t, q.FindElement("password"))
+	form := q.FindElementNamespace("x", dataFormNamespace)
+	require.NotNil(t, form)
+	require.Equal(t, "form", form.Type())
+
+	fields := map[string]xml.Element{}
+	for _, field := range form.FindElements("field") {
+		fields[field.Attribute("var")] = field
+	}
+	require.Len(t, fields, 5)
+	require.Equal(t, registerNamespace, fields["FORM_TYPE"].FindElement("value").Text())
+	require.Equal(t, "text-private", fields["password"].Attribute("type"))
+	require.Equal(t, "Email", fields["email"].Attribute("label"))
+	require.NotNil(t, fields["email"].FindElement("required"))
+	require.Nil(t, fields["nick"].FindElement("required"))
+
+	// required field missing...
+	x.ProcessIQ(tUtilRegisterFormIQ(srvJid, "submit", map[string]string{"username": "juliet", "password": "1234"}))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// ...also when using flat fields
+	flat := xml.NewIQType(uuid.New(), xml.SetType)
+	flat.SetToJID(srvJid)
+	fq := xml.NewElementNamespace("query", registerNamespace)
+	for name, value := range map[string]string{"username": "juliet", "password": "1234"} {
+		e := xml.NewElementName(name)
+		e.SetText(value)
+		fq.AppendElement(e)
+	}
+	flat.AppendElement(fq)
+	x.ProcessIQ(flat)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// invalid form type...
+	values := map[string]string{"username": "juliet", "password": "1234", "email": "juliet@capulet.com"}
+	x.ProcessIQ(tUtilRegisterFormIQ(srvJid, "form", values))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	values["FORM_TYPE"] = "urn:xmpp:other"
+	x.ProcessIQ(tUtilRegisterFormIQ(srvJid, "submit", values))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	values["FORM_TYPE"] = registerNamespace
+	x.ProcessIQ(tUtilRegisterFormIQ(srvJid, "submit", values))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	usr, _ := storage.Instance().FetchUser(context.Background(), "juliet")
+	require.NotNil(t, usr)
+	require.True(t, credentials.Verify(usr, "1234"))
+
+	// flat fields including required ones
+	e := xml.NewElementName("email")
+	e.SetText("romeo@montague.net")
+	fq.AppendElement(e)
+	fq.FindElement("username").(*xml.MutableElement).SetText("romeo")
+	x.ProcessIQ(flat)
+	elem = stm.FetchElement()
 	require.Equal(t, xml.ResultType, elem.Type())
 
-	usr, _ := storage.Instance().FetchUser("ortuman")
+	usr, _ = storage.Instance().FetchUser(context.Background(), "romeo")
 	require.NotNil(t, usr)
 }
 
+func tUtilRegisterFormIQ(to *xml.JID, formType string, values map[string]string) *xml.IQ {
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetToJID(to)
+	q := xml.NewElementNamespace("query", registerNamespace)
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", formType)
+	for name, value := range values {
+		field := xml.NewElementName("field")
+		field.SetAttribute("var", name)
+		v := xml.NewElementName("value")
+		v.SetText(value)
+		field.AppendElement(v)
+		form.AppendElement(field)
+	}
+	q.AppendElement(form)
+	iq.AppendElement(q)
+	return iq
+}
+
 func TestXEP0077_CancelRegistration(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
 
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd1234", j)
 	stm.SetAuthenticated(true)
 
-	x := NewXEPRegister(&config.ModRegistration{}, stm)
+	x := NewXEPRegister(&config.ModRegistration{}, testHasher, stm)
 	defer x.Done()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "both"})
+	storage.Instance().InsertOrUpdateRosterNotification(context.Background(), &model.RosterNotification{User: "romeo", Contact: "ortuman"})
+	storage.Instance().InsertOfflineMessage(context.Background(), xml.NewMessageType(uuid.New(), xml.NormalType), "ortuman")
+	storage.Instance().InsertOrUpdateVCard(context.Background(), xml.NewElementNamespace("vCard", "vcard-temp"), "ortuman")
+	storage.Instance().InsertOrUpdatePrivateXML(context.Background(), []xml.Element{xml.NewElementNamespace("exodus", "exodus:ns")}, "exodus:ns", "ortuman")
 
 	iq := xml.NewIQType(uuid.New(), xml.SetType)
 	iq.SetFromJID(srvJid)
@@ -209,7 +617,7 @@ func TestXEP0077_CancelRegistration(t *testing.T) {
 	elem := stm.FetchElement()
 	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements()[0].Name())
 
-	x = NewXEPRegister(&config.ModRegistration{AllowCancel: true}, stm)
+	x = NewXEPRegister(&config.ModRegistration{AllowCancel: true}, testHasher, stm)
 	defer x.Done()
 
 	q.AppendElement(xml.NewElementName("remove2"))
@@ -219,32 +627,63 @@ func TestXEP0077_CancelRegistration(t *testing.T) {
 	q.ClearElements()
 	q.AppendElement(xml.NewElementName("remove"))
 
-	// storage error
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	stm2 := c2s.NewMockStream("efgh5678", j2)
+	stm2.SetAuthenticated(true)
+	c2s.Instance().RegisterStream(stm)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	// storage error keeps every session
 	storage.ActivateMockedError()
 	x.ProcessIQ(iq)
 	elem = stm.FetchElement()
 	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
 	storage.DeactivateMockedError()
+	require.True(t, c2s.Instance().IsValidSession(stm))
+	require.True(t, c2s.Instance().IsValidSession(stm2))
+	require.False(t, stm.IsDisconnected())
+	require.False(t, stm2.IsDisconnected())
 
+	// every session gets kicked, requesting one included
 	x.ProcessIQ(iq)
 	elem = stm.FetchElement()
 	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, streamerror.ErrNotAuthorized, stm.WaitDisconnection())
+	require.Equal(t, streamerror.ErrNotAuthorized, stm2.WaitDisconnection())
 
-	usr, _ := storage.Instance().FetchUser("ortuman")
+	// every user data is gone
+	usr, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
 	require.Nil(t, usr)
+	ris, _ := storage.Instance().FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 0, len(ris))
+	rns, _ := storage.Instance().FetchRosterNotifications(context.Background(), "ortuman")
+	require.Equal(t, 0, len(rns))
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 0, cnt)
+	vCard, _ := storage.Instance().FetchVCard(context.Background(), "ortuman")
+	require.Nil(t, vCard)
+	prv, _ := storage.Instance().FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
+	require.Equal(t, 0, len(prv))
 }
 
 func TestXEP0077_ChangePassword(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
 	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
 
 	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
 	stm := c2s.NewMockStream("abcd1234", j)
 	stm.SetAuthenticated(true)
 
-	x := NewXEPRegister(&config.ModRegistration{}, stm)
+	x := NewXEPRegister(&config.ModRegistration{}, testHasher, stm)
 	defer x.Done()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "ortuman", Password: "1234"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
 
 	iq := xml.NewIQType(uuid.New(), xml.SetType)
 	iq.SetFromJID(srvJid)
@@ -254,7 +693,7 @@ func TestXEP0077_ChangePassword(t *testing.T) {
 	username := xml.NewElementName("username")
 	username.SetText("juliet")
 	password := xml.NewElementName("password")
-	password.SetText("5678")
+	password.SetText("R0meo&Juliet")
 	q.AppendElement(username)
 	q.AppendElement(password)
 	iq.AppendElement(q)
@@ -263,7 +702,8 @@ func TestXEP0077_ChangePassword(t *testing.T) {
 	elem := stm.FetchElement()
 	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements()[0].Name())
 
-	x = NewXEPRegister(&config.ModRegistration{AllowChange: true}, stm)
+	policy := config.PasswordPolicy{MinLength: 8, MixedClasses: true, DenyCommon: true}
+	x = NewXEPRegister(&config.ModRegistration{AllowChange: true, PasswordPolicy: policy}, testHasher, stm)
 	defer x.Done()
 
 	x.ProcessIQ(iq)
@@ -278,6 +718,16 @@ func TestXEP0077_ChangePassword(t *testing.T) {
 	// secure channel...
 	stm.SetSecured(true)
 
+	// weak password
+	password.SetText("5678")
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements()[0].Name())
+	require.Equal(t, "password must be at least 8 characters long", elem.Error().FindElement("text").Text())
+	usr, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
+	require.True(t, credentials.Verify(usr, "1234"))
+	password.SetText("R0meo&Juliet")
+
 	// storage error
 	storage.ActivateMockedError()
 	x.ProcessIQ(iq)
@@ -289,7 +739,1235 @@ func TestXEP0077_ChangePassword(t *testing.T) {
 	elem = stm.FetchElement()
 	require.Equal(t, xml.ResultType, elem.Type())
 
-	usr, _ := storage.Instance().FetchUser("ortuman")
+	usr, _ = storage.Instance().FetchUser(context.Background(), "ortuman")
+	require.NotNil(t, usr)
+	require.Equal(t, "", usr.Password)
+	require.NotEqual(t, "R0meo&Juliet", usr.PasswordHash)
+	require.True(t, credentials.Verify(usr, "R0meo&Juliet"))
+	require.True(t, credentials.VerifyScramPassword(usr.Verifier, "R0meo&Juliet"))
+
+	// stale SCRAM verifier gets replaced
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Verifier: &model.ScramVerifier{IterationCount: 4096}})
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	usr, _ = storage.Instance().FetchUser(context.Background(), "ortuman")
+	require.Equal(t, "", usr.Password)
+	require.True(t, credentials.Verify(usr, "R0meo&Juliet"))
+	require.True(t, credentials.VerifyScramPassword(usr.Verifier, "R0meo&Juliet"))
+}
+
+func TestXEP0077_KickOnPasswordChange(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
+
+	newStream := func(jid string) *c2s.MockStream {
+		j, _ := xml.NewJIDString(jid, false)
+		stm := c2s.NewMockStream(uuid.New(), j)
+		stm.SetAuthenticated(true)
+		stm.SetSecured(true)
+		c2s.Instance().RegisterStream(stm)
+		c2s.Instance().AuthenticateStream(stm)
+		return stm
+	}
+	stm1 := newStream("ortuman@jackal.im/balcony")
+	stm2 := newStream("ortuman@jackal.im/garden")
+	stm3 := newStream("ortuman@jackal.im/orchard")
+	stm4 := newStream("romeo@jackal.im/balcony")
+
+	changePassword := func(x *XEPRegister, stm *c2s.MockStream, pwd string) {
+		srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetFromJID(stm.JID())
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		username := xml.NewElementName("username")
+		username.SetText("ortuman")
+		password := xml.NewElementName("password")
+		password.SetText(pwd)
+		q.AppendElements([]xml.Element{username, password})
+		iq.AppendElement(q)
+		x.ProcessIQ(iq)
+		require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	}
+
+	// disabled by default
+	x := NewXEPRegister(&config.ModRegistration{AllowChange: true}, testHasher, stm1)
+	defer x.Done()
+	changePassword(x, stm1, "5678")
+	require.False(t, stm2.IsDisconnected())
+
+	x = NewXEPRegister(&config.ModRegistration{AllowChange: true, KickOnPasswordChange: true}, testHasher, stm1)
+	defer x.Done()
+
+	// unchanged password keeps sessions
+	changePassword(x, stm1, "5678")
+	require.False(t, stm2.IsDisconnected())
+
+	changePassword(x, stm1, "R0meo&Juliet")
+	require.False(t, stm1.IsDisconnected())
+	require.True(t, stm2.IsDisconnected())
+	require.True(t, stm3.IsDisconnected())
+	require.Equal(t, "Password changed", stm2.TerminationText())
+	require.False(t, stm4.IsDisconnected())
+
+	// kicked streams are gone by now
+	c2s.Instance().UnregisterStream(stm2)
+	c2s.Instance().UnregisterStream(stm3)
+	stm6 := newStream("ortuman@jackal.im/garden")
+
+	// resetting a forgotten password kicks every session
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm5 := c2s.NewMockStream(uuid.New(), j)
+	stm5.SetSecured(true)
+	cfg := &config.ModRegistration{KickOnPasswordChange: true, PasswordReset: config.PasswordReset{Enabled: true}}
+	x = NewXEPRegister(cfg, testHasher, stm5)
+	x.reset = NewPasswordReset()
+	defer x.Done()
+
+	token, _ := x.reset.Issue(&cfg.PasswordReset, "ortuman")
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetToJID(srvJid)
+	r := xml.NewElementNamespace("reset", passwordResetNamespace)
+	username := xml.NewElementName("username")
+	username.SetText("ortuman")
+	tk := xml.NewElementName("token")
+	tk.SetText(token)
+	password := xml.NewElementName("password")
+	password.SetText("Jul1et&Romeo")
+	r.AppendElements([]xml.Element{username, tk, password})
+	iq.AppendElement(r)
+
+	x.ProcessIQ(iq)
+	require.Equal(t, xml.ResultType, stm5.FetchElement().Type())
+	require.True(t, stm1.IsDisconnected())
+	require.True(t, stm6.IsDisconnected())
+	require.False(t, stm4.IsDisconnected())
+}
+
+func TestXEP0077_PasswordPolicy(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream("abcd1234", j)
+
+	cfg := config.ModRegistration{
+		AllowRegistration: true,
+		PasswordPolicy:    config.PasswordPolicy{MinLength: 8, MixedClasses: true, DenyCommon: true},
+	}
+	x := NewXEPRegister(&cfg, testHasher, stm)
+	defer x.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(srvJid)
+	iq.SetToJID(srvJid)
+
+	q := xml.NewElementNamespace("query", registerNamespace)
+	username := xml.NewElementName("username")
+	username.SetText("mercutio")
+	password := xml.NewElementName("password")
+	q.AppendElement(username)
+	q.AppendElement(password)
+	iq.AppendElement(q)
+
+	for _, tt := range []struct{ password, text string }{
+		{"a", "password must be at least 8 characters long"},
+		{"queenmab", "password must combine at least 3 out of lowercase, uppercase, digit and symbol characters"},
+		{"Password1", "password is too common"},
+		{"P@ssw0rd", "password is too common"},
+	} {
+		password.SetText(tt.password)
+		x.ProcessIQ(iq)
+		elem := stm.FetchElement()
+		require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements()[0].Name(), tt.password)
+		require.Equal(t, tt.text, elem.Error().FindElement("text").Text(), tt.password)
+	}
+	usr, _ := storage.Instance().FetchUser(context.Background(), "mercutio")
+	require.Nil(t, usr)
+
+	password.SetText("Qu33n Mab")
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+}
+
+func TestXEP0077_ScheduledRemoval(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}, Admins: []string{"admin@jackal.im"}})
+	defer c2s.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	j1, _ := xml.NewJID("romeo", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	stm1 := c2s.NewMockStream("abcd1234", j1)
+	stm1.SetAuthenticated(true)
+	stm2 := c2s.NewMockStream("efgh5678", j2)
+	stm2.SetAuthenticated(true)
+	c2s.Instance().RegisterStream(stm1)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm1)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "1234"})
+
+	cfg := &config.ModRegistration{AllowRegistration: true, AllowCancel: true, RemovalGracePeriod: 3600}
+	x := NewXEPRegister(cfg, testHasher, stm1)
+	defer x.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetFromJID(j1)
+	iq.SetToJID(srvJid)
+	q := xml.NewElementNamespace("query", registerNamespace)
+	q.AppendElement(xml.NewElementName("remove"))
+	iq.AppendElement(q)
+
+	// sessions remain valid whenever account couldn't be flagged
+	storage.ActivateMockedErrorFor("InsertOrUpdateUser")
+	x.ProcessIQ(iq)
+	elem := stm1.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+	require.True(t, c2s.Instance().IsValidSession(stm1))
+	require.True(t, c2s.Instance().IsValidSession(stm2))
+	storage.DeactivateMockedError()
+
+	x.ProcessIQ(iq)
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	// every session gets kicked
+	require.Equal(t, streamerror.ErrNotAuthorized, stm1.WaitDisconnection())
+	require.Equal(t, streamerror.ErrNotAuthorized, stm2.WaitDisconnection())
+	require.Equal(t, "Account removed", stm1.TerminationText())
+
+	// account data is retained
+	usr, _ := storage.Instance().FetchUser(context.Background(), "romeo")
 	require.NotNil(t, usr)
+	require.True(t, usr.IsRemoved())
+	require.Equal(t, "1234", usr.Password)
+
+	// username remains reserved
+	stm3 := c2s.NewMockStream("ijkl9012", j1)
+	x3 := NewXEPRegister(cfg, testHasher, stm3)
+	defer x3.Done()
+
+	regIQ := xml.NewIQType(uuid.New(), xml.SetType)
+	regIQ.SetFromJID(j1)
+	regIQ.SetToJID(srvJid)
+	regQ := xml.NewElementNamespace("query", registerNamespace)
+	username := xml.NewElementName("username")
+	username.SetText("romeo")
+	password := xml.NewElementName("password")
+	password.SetText("5678")
+	regQ.AppendElement(username)
+	regQ.AppendElement(password)
+	regIQ.AppendElement(regQ)
+
+	x3.ProcessIQ(regIQ)
+	elem = stm3.FetchElement()
+	require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements()[0].Name())
+
+	// restore
+	restoreIQ := xml.NewIQType(uuid.New(), xml.SetType)
+	restoreIQ.SetToJID(srvJid)
+	restore := xml.NewElementNamespace("restore", accountNamespace)
+	restore.SetAttribute("username", "romeo")
+	restoreIQ.AppendElement(restore)
+	require.True(t, x.MatchesIQ(restoreIQ))
+
+	jUser, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stmUser := c2s.NewMockStream("user", jUser)
+	stmUser.SetAuthenticated(true)
+	xUser := NewXEPRegister(cfg, testHasher, stmUser)
+	defer xUser.Done()
+	xUser.ProcessIQ(restoreIQ)
+	elem = stmUser.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+
+	jAdmin, _ := xml.NewJID("admin", "jackal.im", "balcony", true)
+	stmAdmin := c2s.NewMockStream("admin", jAdmin)
+	stmAdmin.SetAuthenticated(true)
+	xAdmin := NewXEPRegister(cfg, testHasher, stmAdmin)
+	defer xAdmin.Done()
+
+	restore.SetAttribute("username", "ro@meo")
+	xAdmin.ProcessIQ(restoreIQ)
+	elem = stmAdmin.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// username gets normalized
+	restore.SetAttribute("username", " Romeo ")
+	xAdmin.ProcessIQ(restoreIQ)
+	elem = stmAdmin.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	usr, _ = storage.Instance().FetchUser(context.Background(), "romeo")
+	require.False(t, usr.IsRemoved())
+
+	// not removed anymore
+	xAdmin.ProcessIQ(restoreIQ)
+	elem = stmAdmin.FetchElement()
+	require.Equal(t, xml.ErrItemNotFound.Error(), elem.Error().Elements()[0].Name())
+
+	// purge after grace period expiration
+	x.ProcessIQ(iq)
+	elem = stm1.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	stm1.WaitDisconnection()
+	stm2.WaitDisconnection()
+
+	n, err := storage.PurgeRemovedUsers(time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = storage.PurgeRemovedUsers(time.Now().Add(time.Hour + time.Minute))
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	exists, _ := storage.Instance().UserExists(context.Background(), "romeo")
+	require.False(t, exists)
+}
+
+func TestXEP0077_ReconnectToRegister(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	addr := &net.TCPAddr{IP: net.ParseIP("198.51.100.7"), Port: 41234}
+
+	cfg := &config.ModRegistration{AllowRegistration: true, MaxPerIP: 2}
+
+	register := func(x *XEPRegister, stm *c2s.MockStream, username string) xml.Element {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElement(u)
+		q.AppendElement(p)
+		iq.AppendElement(q)
+		x.ProcessIQ(iq)
+		return stm.FetchElement()
+	}
+
+	// first connection
+	stm1 := c2s.NewMockStream(uuid.New(), j)
+	stm1.SetRemoteAddr(addr)
+	x1 := NewXEPRegister(cfg, testHasher, stm1)
+	require.Equal(t, xml.ResultType, register(x1, stm1, "bot1").Type())
+
+	// a second identity on the same stream is not acceptable
+	elem := register(x1, stm1, "bot2")
+	require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements()[0].Name())
+	x1.Done()
+
+	// reconnecting allows a new registration...
+	stm2 := c2s.NewMockStream(uuid.New(), j)
+	stm2.SetRemoteAddr(addr)
+	x2 := NewXEPRegister(cfg, testHasher, stm2)
+	require.Equal(t, xml.ResultType, register(x2, stm2, "bot2").Type())
+	x2.Done()
+
+	// ...until address allowance gets exhausted
+	stm3 := c2s.NewMockStream(uuid.New(), j)
+	stm3.SetRemoteAddr(addr)
+	x3 := NewXEPRegister(cfg, testHasher, stm3)
+	defer x3.Done()
+	elem = register(x3, stm3, "bot3")
+	require.Equal(t, xml.ErrResourceConstraint.Error(), elem.Error().Elements()[0].Name())
+
+	exists, _ := storage.Instance().UserExists(context.Background(), "bot3")
+	require.False(t, exists)
+	require.Equal(t, 2, x3.tracker.IPRegistrations(cfg, "198.51.100.7"))
+
+	// registration fields can still be requested
+	getIQ := xml.NewIQType(uuid.New(), xml.GetType)
+	getIQ.SetToJID(srvJid)
+	getIQ.AppendElement(xml.NewElementNamespace("query", registerNamespace))
+	x3.ProcessIQ(getIQ)
+	require.Equal(t, xml.ResultType, stm3.FetchElement().Type())
+}
+
+func TestXEP0077_InvalidFields(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	longValue := strings.Repeat("a", maxRegistrationFieldLength+1)
+	values := []string{"", " ", "\t\n ", longValue}
+
+	newIQ := func(username, password string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText(password)
+		q.AppendElement(u)
+		q.AppendElement(p)
+		iq.AppendElement(q)
+		return iq
+	}
+
+	// any storage access would be answered with an internal server error
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	// registration
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true}, testHasher, stm)
+	defer x.Done()
+
+	for _, v := range values {
+		x.ProcessIQ(newIQ(v, "1234"))
+		elem := stm.FetchElement()
+		require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+		x.ProcessIQ(newIQ("romeo", v))
+		elem = stm.FetchElement()
+		require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+	}
+	require.Equal(t, 0, x.tracker.StreamRegistrations(stm.ID()))
+
+	// password change
+	stm2 := c2s.NewMockStream(uuid.New(), j)
+	stm2.SetAuthenticated(true)
+	stm2.SetSecured(true)
+	x2 := NewXEPRegister(&config.ModRegistration{AllowChange: true}, testHasher, stm2)
+	defer x2.Done()
+
+	for _, v := range values {
+		x2.ProcessIQ(newIQ("ortuman", v))
+		elem := stm2.FetchElement()
+		require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+	}
+}
+
+func TestXEP0077_UsernameNormalization(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+
+	newIQ := func(username, password string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText(password)
+		q.AppendElement(u)
+		q.AppendElement(p)
+		iq.AppendElement(q)
+		return iq
+	}
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true, MaxPerConnection: 10}, testHasher, stm)
+	defer x.Done()
+
+	x.ProcessIQ(newIQ("Ortuman", "1234"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	exists, _ := storage.Instance().UserExists(context.Background(), "ortuman")
+	require.True(t, exists)
+	exists, _ = storage.Instance().UserExists(context.Background(), "Ortuman")
+	require.False(t, exists)
+
+	// mixed-case and whitespace-padded submissions collapse to the same account
+	for _, username := range []string{"ortuman", "ORTUMAN", " ortuman\t"} {
+		x.ProcessIQ(newIQ(username, "1234"))
+		elem := stm.FetchElement()
+		require.Equal(t, xml.ErrConflict.Error(), elem.Error().Elements()[0].Name(), username)
+	}
+
+	// not a valid JID node
+	x.ProcessIQ(newIQ("ortu man", "1234"))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+	require.NotNil(t, elem.Error().FindElement("text"))
+
+	// password change compares normalized forms
+	jUser, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm2 := c2s.NewMockStream(uuid.New(), jUser)
+	stm2.SetAuthenticated(true)
+	stm2.SetSecured(true)
+	x2 := NewXEPRegister(&config.ModRegistration{AllowChange: true}, testHasher, stm2)
+	defer x2.Done()
+
+	x2.ProcessIQ(newIQ(" Ortuman ", "5678"))
+	require.Equal(t, xml.ResultType, stm2.FetchElement().Type())
+	usr, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
+	require.True(t, credentials.Verify(usr, "5678"))
+}
+
+func TestXEP0077_DenyList(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer denylist.CloseAll()
+
+	dir, _ := ioutil.TempDir("", "denylist")
+	defer os.RemoveAll(dir)
+	p := filepath.Join(dir, "reserved.txt")
+	ioutil.WriteFile(p, []byte("admin*\nre:(web|post)master\n"), 0644)
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+
+	newIQ := func(username string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElement(u)
+		q.AppendElement(p)
+		iq.AppendElement(q)
+		return iq
+	}
+	cfg := &config.ModRegistration{AllowRegistration: true, MaxPerConnection: 10, DenyList: p}
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := NewXEPRegister(cfg, testHasher, stm)
+	defer x.Done()
+
+	for _, username := range []string{"Administrator", "webmaster"} {
+		x.ProcessIQ(newIQ(username))
+		elem := stm.FetchElement()
+		require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements()[0].Name())
+	}
+	x.ProcessIQ(newIQ("mercutio"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	// reloading the list changes the verdict
+	ioutil.WriteFile(p, []byte("mercu*\n"), 0644)
+	denylist.ReloadAll()
+
+	x.ProcessIQ(newIQ("mercury"))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrNotAllowed.Error(), elem.Error().Elements()[0].Name())
+	x.ProcessIQ(newIQ("webmaster"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+}
+
+func TestXEP0077_BlackAndWhiteLists(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+
+	register := func(x *XEPRegister, stm *c2s.MockStream, username string) xml.Element {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElement(u)
+		q.AppendElement(p)
+		iq.AppendElement(q)
+		x.ProcessIQ(iq)
+		return stm.FetchElement()
+	}
+
+	// blacklist hit
+	cfg := &config.ModRegistration{
+		AllowRegistration: true,
+		MaxPerConnection:  10,
+		Blacklist:         []string{"admin", "root", "re:post(master|mistress)", "xmpp"},
+	}
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := NewXEPRegister(cfg, testHasher, stm)
+	defer x.Done()
+
+	storage.ActivateMockedError() // storage is never reached
+	for _, username := range []string{"admin", "Admin", "ROOT", "PostMistress"} {
+		elem := register(x, stm, username)
+		require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements()[0].Name())
+	}
+	storage.DeactivateMockedError()
+	require.Equal(t, xml.ResultType, register(x, stm, "administrator").Type())
+
+	// whitelist miss
+	cfg = &config.ModRegistration{
+		AllowRegistration: true,
+		MaxPerConnection:  10,
+		Blacklist:         []string{"invited-admin"},
+		Whitelist:         []string{"invited-*"},
+	}
+	stm2 := c2s.NewMockStream(uuid.New(), j)
+	x2 := NewXEPRegister(cfg, testHasher, stm2)
+	defer x2.Done()
+
+	for _, username := range []string{"mercutio", "Invited-Admin"} {
+		elem := register(x2, stm2, username)
+		require.Equal(t, xml.ErrNotAcceptable.Error(), elem.Error().Elements()[0].Name())
+	}
+	require.Equal(t, xml.ResultType, register(x2, stm2, "Invited-Romeo").Type())
+}
+
+func TestXEP0077_Veto(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	releaseCh := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/deny":
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("Suspicious network"))
+		case "/hang":
+			<-releaseCh
+		}
+	}))
+	defer srv.Close()
+	defer close(releaseCh)
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+
+	newIQ := func(username string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElement(u)
+		q.AppendElement(p)
+		iq.AppendElement(q)
+		return iq
+	}
+	newRegister := func(veto config.RegistrationVeto) (*XEPRegister, *c2s.MockStream) {
+		stm := c2s.NewMockStream(uuid.New(), j)
+		x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true, Veto: veto}, testHasher, stm)
+		x.veto = NewRegistrationVeto()
+		return x, stm
+	}
+
+	// rejected
+	x, stm := newRegister(config.RegistrationVeto{URL: srv.URL + "/deny"})
+	defer x.Done()
+	x.ProcessIQ(newIQ("romeo"))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().FindElement(xml.ErrNotAcceptable.Error()))
+	require.Equal(t, "Suspicious network", elem.Error().FindElement("text").Text())
+	exists, _ := storage.Instance().UserExists(context.Background(), "romeo")
+	require.False(t, exists)
+
+	// timed out, fail closed
+	x2, stm2 := newRegister(config.RegistrationVeto{URL: srv.URL + "/hang", Timeout: 50})
+	defer x2.Done()
+	x2.ProcessIQ(newIQ("romeo"))
+	elem = stm2.FetchElement()
+	require.NotNil(t, elem.Error().FindElement(xml.ErrServiceUnavailable.Error()))
+	exists, _ = storage.Instance().UserExists(context.Background(), "romeo")
+	require.False(t, exists)
+
+	// timed out, fail open
+	x3, stm3 := newRegister(config.RegistrationVeto{URL: srv.URL + "/hang", Timeout: 50, FailOpen: true})
+	defer x3.Done()
+	x3.ProcessIQ(newIQ("romeo"))
+	require.Equal(t, xml.ResultType, stm3.FetchElement().Type())
+
+	// allowed
+	x4, stm4 := newRegister(config.RegistrationVeto{URL: srv.URL + "/allow"})
+	defer x4.Done()
+	x4.ProcessIQ(newIQ("juliet"))
+	require.Equal(t, xml.ResultType, stm4.FetchElement().Type())
+	exists, _ = storage.Instance().UserExists(context.Background(), "juliet")
+	require.True(t, exists)
+}
+
+type testRegistrationValidator func(username, password string, from net.Addr) error
+
+func (f testRegistrationValidator) Validate(username, password string, from net.Addr) error {
+	return f(username, password, from)
+}
+
+func TestXEP0077_Validator(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+
+	newIQ := func(username string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElement(u)
+		q.AppendElement(p)
+		iq.AppendElement(q)
+		return iq
+	}
+	var validated []string
+	validator := testRegistrationValidator(func(username, password string, from net.Addr) error {
+		validated = append(validated, username)
+		require.Equal(t, "1234", password)
+		require.Equal(t, "203.0.113.7:5222", from.String())
+		switch username {
+		case "romeo":
+			return fmt.Errorf("username reserved by policy")
+		case "mercutio":
+			// registered meanwhile by a concurrent request
+			storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "mercutio", Password: "5678"})
+		}
+		return nil
+	})
+	SetRegistrationValidator(validator)
+	defer SetRegistrationValidator(nil)
+
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP("203.0.113.7"), Port: 5222})
+	x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true, MaxPerConnection: 5}, testHasher, stm)
+	defer x.Done()
+
+	// rejected
+	x.ProcessIQ(newIQ("romeo"))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().FindElement(xml.ErrNotAcceptable.Error()))
+	require.Equal(t, "username reserved by policy", elem.Error().FindElement("text").Text())
+	exists, _ := storage.Instance().UserExists(context.Background(), "romeo")
+	require.False(t, exists)
+
+	// allowed
+	x.ProcessIQ(newIQ("juliet"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	exists, _ = storage.Instance().UserExists(context.Background(), "juliet")
+	require.True(t, exists)
+
+	// not consulted whenever built-in checks fail
+	x.ProcessIQ(newIQ("juliet"))
+	require.NotNil(t, stm.FetchElement().Error().FindElement(xml.ErrConflict.Error()))
+	require.Equal(t, []string{"romeo", "juliet"}, validated)
+
+	// accounts registered while validating are never overwritten
+	x.ProcessIQ(newIQ("mercutio"))
+	require.NotNil(t, stm.FetchElement().Error().FindElement(xml.ErrConflict.Error()))
+	usr, _ := storage.Instance().FetchUser(context.Background(), "mercutio")
 	require.Equal(t, "5678", usr.Password)
+
+	// overridden by module setter
+	x.SetValidator(nil)
+	x.ProcessIQ(newIQ("romeo"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+}
+
+func TestXEP0077_MaxPerWindow(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+
+	cfg := config.ModRegistration{AllowRegistration: true, MaxPerWindow: 2, Window: 3600}
+	tracker := NewRegistrationTracker()
+
+	register := func(username, ip string) xml.Element {
+		stm := c2s.NewMockStream(uuid.New(), j)
+		stm.SetRemoteAddr(&net.TCPAddr{IP: net.ParseIP(ip), Port: 5222})
+		x := NewXEPRegister(&cfg, testHasher, stm)
+		x.tracker = tracker
+		defer x.Done()
+
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		p := xml.NewElementName("password")
+		p.SetText("1234")
+		q.AppendElements([]xml.Element{u, p})
+		iq.AppendElement(q)
+		x.ProcessIQ(iq)
+		return stm.FetchElement()
+	}
+	// distinct streams and addresses share the same server wide allowance
+	require.Equal(t, xml.ResultType, register("romeo", "203.0.113.1").Type())
+	require.Equal(t, xml.ResultType, register("juliet", "203.0.113.2").Type())
+
+	elem := register("mercutio", "203.0.113.3")
+	require.Equal(t, xml.ErrResourceConstraint.Error(), elem.Error().Elements()[0].Name())
+	exists, _ := storage.Instance().UserExists(context.Background(), "mercutio")
+	require.False(t, exists)
+}
+
+func TestXEP0077_Maintenance(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	iq.SetToJID(srvJid)
+	q := xml.NewElementNamespace("query", registerNamespace)
+	u := xml.NewElementName("username")
+	u.SetText("benvolio")
+	p := xml.NewElementName("password")
+	p.SetText("1234")
+	q.AppendElement(u)
+	q.AppendElement(p)
+	iq.AppendElement(q)
+
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := NewXEPRegister(&config.ModRegistration{AllowRegistration: true, MaxPerConnection: 10}, testHasher, stm)
+	defer x.Done()
+
+	maintenance.Enable("Storage migration", time.Time{})
+	defer maintenance.Disable()
+
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrServiceUnavailable.Error(), elem.Error().Elements()[0].Name())
+	exists, _ := storage.Instance().UserExists(context.Background(), "benvolio")
+	require.False(t, exists)
+
+	maintenance.Disable()
+	x.ProcessIQ(iq)
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+}
+
+type fakeMailSender struct {
+	mails chan []string
+}
+
+func (m *fakeMailSender) SendMail(to, subject, body string) error {
+	m.mails <- []string{to, subject, body}
+	return nil
+}
+
+func TestXEP0077_PasswordReset(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	stm.SetSecured(true)
+
+	cfg := &config.ModRegistration{PasswordReset: config.PasswordReset{Enabled: true, MaxPerAccount: 1}}
+	mailer := &fakeMailSender{mails: make(chan []string, 1)}
+	x := NewXEPRegister(cfg, testHasher, stm)
+	x.reset = NewPasswordReset()
+	x.mailer = mailer
+	x.async = func(f func()) { f() }
+	defer x.Done()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "1234", Email: "romeo@montague.lit", EmailVerified: true})
+	vCard := xml.NewElementNamespace("vCard", vCardNamespace)
+	email := xml.NewElementName("EMAIL")
+	userID := xml.NewElementName("USERID")
+	userID.SetText("romeo@verona.lit")
+	email.AppendElement(userID)
+	vCard.AppendElement(email)
+	storage.Instance().InsertOrUpdateVCard(context.Background(), vCard, "romeo")
+
+	resetIQ := func(username, token, password string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		r := xml.NewElementNamespace("reset", passwordResetNamespace)
+		u := xml.NewElementName("username")
+		u.SetText(username)
+		r.AppendElement(u)
+		if len(token) > 0 {
+			tk := xml.NewElementName("token")
+			tk.SetText(token)
+			p := xml.NewElementName("password")
+			p.SetText(password)
+			r.AppendElement(tk)
+			r.AppendElement(p)
+		}
+		iq.AppendElement(r)
+		return iq
+	}
+	require.True(t, x.MatchesIQ(resetIQ("romeo", "", "")))
+
+	// unknown accounts get the very same answer
+	x.ProcessIQ(resetIQ("juliet", "", ""))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	x.ProcessIQ(resetIQ("romeo", "", ""))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	mail := <-mailer.mails
+	require.Equal(t, "romeo@montague.lit", mail[0])
+	token, _ := x.reset.Issue(&cfg.PasswordReset, "romeo") // mailed token gets superseded
+	require.NotContains(t, mail[2], token)
+
+	// malformed username
+	x.ProcessIQ(resetIQ("ro@meo", "", ""))
+	require.Equal(t, xml.ErrBadRequest.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// per account allowance, regardless of username case
+	x.ProcessIQ(resetIQ("Romeo", "", ""))
+	require.Equal(t, xml.ErrResourceConstraint.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// invalid token
+	x.ProcessIQ(resetIQ("romeo", "bad-token", "5678"))
+	require.Equal(t, xml.ErrNotAuthorized.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// blank password
+	x.ProcessIQ(resetIQ("romeo", token, " "))
+	require.Equal(t, xml.ErrBadRequest.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	x.ProcessIQ(resetIQ(" ROMEO ", token, "5678"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	usr, _ := storage.Instance().FetchUser(context.Background(), "romeo")
+	require.Equal(t, "", usr.Password)
+	require.True(t, credentials.Verify(usr, "5678"))
+
+	// token reuse
+	x.ProcessIQ(resetIQ("romeo", token, "9012"))
+	require.Equal(t, xml.ErrNotAuthorized.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// expired token
+	now := time.Now()
+	x.reset.now = func() time.Time { return now }
+	token, _ = x.reset.Issue(&cfg.PasswordReset, "romeo")
+	now = now.Add(time.Second * defaultPasswordResetTokenTTL)
+	x.ProcessIQ(resetIQ("romeo", token, "9012"))
+	require.Equal(t, xml.ErrNotAuthorized.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// disabled
+	cfg.PasswordReset.Enabled = false
+	x.ProcessIQ(resetIQ("romeo", "", ""))
+	require.Equal(t, xml.ErrNotAllowed.Error(), stm.FetchElement().Error().Elements()[0].Name())
+}
+
+func TestXEP0077_PasswordResetEmail(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+
+	cfg := &config.ModRegistration{}
+	x := NewXEPRegister(cfg, testHasher, stm)
+	defer x.Done()
+
+	vCard := xml.NewElementNamespace("vCard", vCardNamespace)
+	email := xml.NewElementName("EMAIL")
+	userID := xml.NewElementName("USERID")
+	userID.SetText("romeo@verona.lit")
+	email.AppendElement(userID)
+	vCard.AppendElement(email)
+	storage.Instance().InsertOrUpdateVCard(context.Background(), vCard, "romeo")
+
+	verified := &model.User{Username: "romeo", Email: "romeo@montague.lit", EmailVerified: true}
+	pending := &model.User{Username: "romeo", Email: "romeo@montague.lit"}
+	unregistered := &model.User{Username: "romeo"}
+
+	var tests = []struct {
+		user          *model.User
+		vCardFallback bool
+		email         string
+	}{
+		{verified, false, "romeo@montague.lit"},
+		{verified, true, "romeo@montague.lit"},
+		{pending, false, ""},
+		{pending, true, ""},
+		{unregistered, false, ""},
+		{unregistered, true, "romeo@verona.lit"},
+	}
+	for _, tt := range tests {
+		cfg.PasswordReset.VCardFallback = tt.vCardFallback
+		addr, err := x.passwordResetEmail(tt.user)
+		require.Nil(t, err)
+		require.Equal(t, tt.email, addr)
+	}
+}
+
+func TestXEP0077_EmailVerification(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+
+	cfg := &config.ModRegistration{AllowRegistration: true, MaxPerConnection: 10, RequireEmail: true}
+	mailer := &fakeMailSender{mails: make(chan []string, 1)}
+	x := NewXEPRegister(cfg, testHasher, stm)
+	x.verifier = NewEmailVerification()
+	x.verifyMailer = mailer
+	x.async = func(f func()) { f() }
+	defer x.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetToJID(srvJid)
+	iq.AppendElement(xml.NewElementNamespace("query", registerNamespace))
+	x.ProcessIQ(iq)
+	q := stm.FetchElement().FindElementNamespace("query", registerNamespace)
+	require.NotNil(t, q.FindElement("email"))
+	form := q.FindElementNamespace("x", dataFormNamespace)
+	require.NotNil(t, form)
+	var emailField xml.Element
+	for _, field := range form.FindElements("field") {
+		if field.Attribute("var") == "email" {
+			emailField = field
+		}
+	}
+	require.NotNil(t, emailField)
+	require.NotNil(t, emailField.FindElement("required"))
+
+	registerIQ := func(username, email string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		q := xml.NewElementNamespace("query", registerNamespace)
+		for name, value := range map[string]string{"username": username, "password": "1234", "email": email} {
+			if len(value) == 0 {
+				continue
+			}
+			e := xml.NewElementName(name)
+			e.SetText(value)
+			q.AppendElement(e)
+		}
+		iq.AppendElement(q)
+		return iq
+	}
+	verifyIQ := func(username, token string) *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		v := xml.NewElementNamespace("verify", emailVerificationNamespace)
+		if len(username) > 0 {
+			u := xml.NewElementName("username")
+			u.SetText(username)
+			v.AppendElement(u)
+		}
+		if len(token) > 0 {
+			tk := xml.NewElementName("token")
+			tk.SetText(token)
+			v.AppendElement(tk)
+		}
+		iq.AppendElement(v)
+		return iq
+	}
+
+	// email is required...
+	x.ProcessIQ(registerIQ("mercutio", ""))
+	require.Equal(t, xml.ErrBadRequest.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	x.ProcessIQ(registerIQ("mercutio", "Mercutio <mercutio@verona.lit>"))
+	require.Equal(t, xml.ErrBadRequest.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	x.ProcessIQ(registerIQ("mercutio", "mercutio@verona.lit"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	usr, _ := storage.Instance().FetchUser(context.Background(), "mercutio")
+	require.NotNil(t, usr)
+	require.Equal(t, "mercutio@verona.lit", usr.Email)
+	require.True(t, usr.IsPendingVerification())
+
+	mail := <-mailer.mails
+	require.Equal(t, "mercutio@verona.lit", mail[0])
+	idx := strings.Index(mail[2], "Verification token: ")
+	require.True(t, idx > 0)
+	token := strings.TrimSpace(mail[2][idx+len("Verification token: "):])
+
+	require.True(t, x.MatchesIQ(verifyIQ("mercutio", token)))
+
+	// invalid token
+	x.ProcessIQ(verifyIQ("mercutio", "bad-token"))
+	require.Equal(t, xml.ErrNotAuthorized.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// unauthenticated streams must name the account
+	x.ProcessIQ(verifyIQ("", token))
+	require.Equal(t, xml.ErrBadRequest.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	x.ProcessIQ(verifyIQ("mer@cutio", token))
+	require.Equal(t, xml.ErrBadRequest.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// named account gets normalized
+	x.ProcessIQ(verifyIQ("Mercutio", token))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	usr, _ = storage.Instance().FetchUser(context.Background(), "mercutio")
+	require.True(t, usr.EmailVerified)
+	require.False(t, usr.IsPendingVerification())
+
+	// token reuse
+	x.ProcessIQ(verifyIQ("mercutio", token))
+	require.Equal(t, xml.ErrNotAuthorized.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// authenticated pending accounts can request a new token
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "tybalt", Password: "1234", Email: "tybalt@capulet.lit"})
+	j2, _ := xml.NewJID("tybalt", "jackal.im", "balcony", true)
+	stm2 := c2s.NewMockStream(uuid.New(), j2)
+	stm2.SetAuthenticated(true)
+	x2 := NewXEPRegister(cfg, testHasher, stm2)
+	x2.verifier = x.verifier
+	x2.verifyMailer = mailer
+	x2.async = func(f func()) { f() }
+	defer x2.Done()
+
+	x2.ProcessIQ(verifyIQ("", ""))
+	require.Equal(t, xml.ResultType, stm2.FetchElement().Type())
+	mail = <-mailer.mails
+	require.Equal(t, "tybalt@capulet.lit", mail[0])
+	idx = strings.Index(mail[2], "Verification token: ")
+	token = strings.TrimSpace(mail[2][idx+len("Verification token: "):])
+
+	x2.ProcessIQ(verifyIQ("", token))
+	require.Equal(t, xml.ResultType, stm2.FetchElement().Type())
+	usr, _ = storage.Instance().FetchUser(context.Background(), "tybalt")
+	require.True(t, usr.EmailVerified)
+
+	// expired token
+	now := time.Now()
+	x.verifier.now = func() time.Time { return now }
+	token, _ = x.verifier.Issue(&cfg.EmailVerification, "mercutio")
+	now = now.Add(time.Second * defaultEmailVerificationTokenTTL)
+	x.ProcessIQ(verifyIQ("mercutio", token))
+	require.Equal(t, xml.ErrNotAuthorized.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// disabled
+	cfg.RequireEmail = false
+	x.ProcessIQ(verifyIQ("mercutio", token))
+	require.Equal(t, xml.ErrNotAllowed.Error(), stm.FetchElement().Error().Elements()[0].Name())
+}
+
+func TestXEP0077_InviteToken(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}, Admins: []string{"admin@jackal.im"}})
+	defer c2s.Shutdown()
+
+	srvJid, _ := xml.NewJID("", "jackal.im", "", true)
+
+	cfg := &config.ModRegistration{AllowRegistration: true, MaxPerConnection: 10, TokenRequired: true}
+
+	// only admins can mint invites...
+	mintIQ := func() *xml.IQ {
+		iq := xml.NewIQType(uuid.New(), xml.SetType)
+		iq.SetToJID(srvJid)
+		iq.AppendElement(xml.NewElementNamespace("invite", inviteNamespace))
+		return iq
+	}
+	userJid, _ := xml.NewJID("paris", "jackal.im", "balcony", true)
+	userStm := c2s.NewMockStream(uuid.New(), userJid)
+	userStm.SetAuthenticated(true)
+	ux := NewXEPRegister(cfg, testHasher, userStm)
+	defer ux.Done()
+
+	require.True(t, ux.MatchesIQ(mintIQ()))
+	ux.ProcessIQ(mintIQ())
+	require.Equal(t, xml.ErrForbidden.Error(), userStm.FetchElement().Error().Elements()[0].Name())
+
+	adminJid, _ := xml.NewJID("admin", "jackal.im", "balcony", true)
+	adminStm := c2s.NewMockStream(uuid.New(), adminJid)
+	adminStm.SetAuthenticated(true)
+	ax := NewXEPRegister(cfg, testHasher, adminStm)
+	defer ax.Done()
+
+	ax.ProcessIQ(mintIQ())
+	elem := adminStm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	inv := elem.FindElementNamespace("invite", inviteNamespace)
+	require.NotNil(t, inv)
+	token := inv.FindElement("token").Text()
+	require.NotEmpty(t, token)
+	expiresAt, err := time.Parse(time.RFC3339, inv.FindElement("expires").Text())
+	require.Nil(t, err)
+	require.True(t, expiresAt.After(time.Now().Add(time.Hour*24*6)))
+
+	// token field is requested...
+	j, _ := xml.NewJID("", "jackal.im", "", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	x := NewXEPRegister(cfg, testHasher, stm)
+	defer x.Done()
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetToJID(srvJid)
+	iq.AppendElement(xml.NewElementNamespace("query", registerNamespace))
+	x.ProcessIQ(iq)
+	q := stm.FetchElement().FindElementNamespace("query", registerNamespace)
+	require.NotNil(t, q.FindElement("token"))
+	var tokenField xml.Element
+	for _, field := range q.FindElementNamespace("x", dataFormNamespace).FindElements("field") {
+		if field.Attribute("var") == "token" {
+			tokenField = field
+		}
+	}
+	require.NotNil(t, tokenField)
+	require.NotNil(t, tokenField.FindElement("required"))
+
+	registerIQ := func(username, token string) *xml.IQ {
+		values := map[string]string{"FORM_TYPE": registerNamespace, "username": username, "password": "1234"}
+		if len(token) > 0 {
+			values["token"] = token
+		}
+		return tUtilRegisterFormIQ(srvJid, "submit", values)
+	}
+
+	// ...and required
+	x.ProcessIQ(registerIQ("balthasar", ""))
+	require.Equal(t, xml.ErrBadRequest.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// unknown and expired tokens are rejected alike
+	storage.Instance().InsertInvite(context.Background(), &model.Invite{Token: "expired", CreatedBy: "admin", ExpiresAt: time.Now().Add(-time.Second)})
+	for _, tk := range []string{"unknown", "expired"} {
+		x.ProcessIQ(registerIQ("balthasar", tk))
+		require.Equal(t, xml.ErrNotAcceptable.Error(), stm.FetchElement().Error().Elements()[0].Name())
+	}
+	ok, _ := storage.Instance().UserExists(context.Background(), "balthasar")
+	require.False(t, ok)
+
+	x.ProcessIQ(registerIQ("balthasar", token))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	ok, _ = storage.Instance().UserExists(context.Background(), "balthasar")
+	require.True(t, ok)
+
+	// tokens can be used only once
+	x.ProcessIQ(registerIQ("abram", token))
+	require.Equal(t, xml.ErrNotAcceptable.Error(), stm.FetchElement().Error().Elements()[0].Name())
+
+	// username conflicts don't consume tokens
+	ax.ProcessIQ(mintIQ())
+	token = adminStm.FetchElement().FindElementNamespace("invite", inviteNamespace).FindElement("token").Text()
+	x.ProcessIQ(registerIQ("balthasar", token))
+	require.Equal(t, xml.ErrConflict.Error(), stm.FetchElement().Error().Elements()[0].Name())
+	x.ProcessIQ(registerIQ("abram", token))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	// ...neither do failed insertions
+	ax.ProcessIQ(mintIQ())
+	token = adminStm.FetchElement().FindElementNamespace("invite", inviteNamespace).FindElement("token").Text()
+	storage.ActivateMockedErrorFor("InsertOrUpdateUser")
+	x.ProcessIQ(registerIQ("sampson", token))
+	require.Equal(t, xml.ErrInternalServerError.Error(), stm.FetchElement().Error().Elements()[0].Name())
+	storage.DeactivateMockedError()
+	x.ProcessIQ(registerIQ("sampson", token))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+
+	// storage failure
+	storage.ActivateMockedError()
+	ax.ProcessIQ(mintIQ())
+	require.Equal(t, xml.ErrInternalServerError.Error(), adminStm.FetchElement().Error().Elements()[0].Name())
+	storage.DeactivateMockedError()
 }
@@ -27,8 +27,9 @@ func init() {
 
 // XEPVersion represents a version server stream module.
 type XEPVersion struct {
-	cfg  *config.ModVersion
-	strm c2s.Stream
+	cfg   *config.ModVersion
+	strm  c2s.Stream
+	guard doneGuard
 }
 
 // NewXEPVersion returns a version IQ handler module.
@@ -48,6 +49,7 @@ func (x *XEPVersion) AssociatedNamespaces() []string {
 
 // Done signals stream termination.
 func (x *XEPVersion) Done() {
+	x.guard.done()
 }
 
 // MatchesIQ returns whether or not an IQ should be
@@ -59,6 +61,11 @@ func (x *XEPVersion) MatchesIQ(iq *xml.IQ) bool {
 // ProcessIQ processes a version IQ taking according actions
 // over the associated stream.
 func (x *XEPVersion) ProcessIQ(iq *xml.IQ) {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
 	q := iq.FindElementNamespace("query", versionNamespace)
 	if q.ElementsCount() != 0 {
 		x.strm.SendElement(iq.BadRequestError())
@@ -0,0 +1,290 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/ortuman/jackal/xmpputil/timefmt"
+	"github.com/pborman/uuid"
+)
+
+const vacationNamespace = "http://jabber.org/protocol/vacation"
+
+const shimNamespace = "http://jabber.org/protocol/shim"
+
+// vacationFeatureFlag is the feature flag gating vacation messages module.
+const vacationFeatureFlag = "vacation"
+
+const defaultVacationReplyInterval = 86400 // one day
+
+var (
+	errVacationMessageRequired = errors.New("vacation message is required")
+	errVacationInvalidPeriod   = errors.New("vacation end must be later than start")
+)
+
+type vacationReplyMap struct {
+	mu      sync.Mutex
+	replies map[string]time.Time
+}
+
+// shouldReply returns whether or not sender should be auto-replied on behalf
+// of user, registering the reply time in such case.
+func (vm *vacationReplyMap) shouldReply(username, sender string, now time.Time, interval time.Duration) bool {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	key := username + ":" + sender
+	if lastReply, ok := vm.replies[key]; ok && now.Sub(lastReply) < interval {
+		return false
+	}
+	vm.replies[key] = now
+	return true
+}
+
+func (vm *vacationReplyMap) reset(username string) {
+	vm.mu.Lock()
+	defer vm.mu.Unlock()
+	prefix := username + ":"
+	for key := range vm.replies {
+		if strings.HasPrefix(key, prefix) {
+			delete(vm.replies, key)
+		}
+	}
+}
+
+var vacationReplies = vacationReplyMap{
+	replies: map[string]time.Time{},
+}
+
+type vacation struct {
+	start   time.Time
+	end     time.Time
+	message string
+}
+
+func (v *vacation) isActive(t time.Time) bool {
+	if !v.start.IsZero() && t.Before(v.start) {
+		return false
+	}
+	if !v.end.IsZero() && t.After(v.end) {
+		return false
+	}
+	return true
+}
+
+// XEPVacation represents a vacation messages server stream module.
+type XEPVacation struct {
+	cfg   *config.ModVacation
+	strm  c2s.Stream
+	now   func() time.Time
+	actor *actor
+}
+
+// NewXEPVacation returns a vacation messages IQ handler module.
+func NewXEPVacation(config *config.ModVacation, strm c2s.Stream) *XEPVacation {
+	x := &XEPVacation{
+		cfg:   config,
+		strm:  strm,
+		now:   time.Now,
+		actor: newActor(nil),
+	}
+	return x
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with vacation messages module.
+func (x *XEPVacation) AssociatedNamespaces() []string {
+	return []string{vacationNamespace}
+}
+
+// FeatureFlag returns vacation messages module feature flag.
+func (x *XEPVacation) FeatureFlag() string {
+	return vacationFeatureFlag
+}
+
+// Done signals stream termination.
+func (x *XEPVacation) Done() {
+	x.actor.done()
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the vacation messages module.
+func (x *XEPVacation) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("query", vacationNamespace) != nil
+}
+
+// ProcessIQ processes a vacation messages IQ taking according actions
+// over the associated stream.
+func (x *XEPVacation) ProcessIQ(iq *xml.IQ) {
+	x.actor.run(func() {
+		q := iq.FindElementNamespace("query", vacationNamespace)
+		toJid := iq.ToJID()
+		validTo := toJid.IsServer() || toJid.Node() == x.strm.Username()
+		if !validTo {
+			x.strm.SendElement(iq.ForbiddenError())
+			return
+		}
+		if iq.IsGet() {
+			x.getVacation(iq)
+		} else if iq.IsSet() {
+			x.setVacation(iq, q)
+		} else {
+			x.strm.SendElement(iq.BadRequestError())
+		}
+	})
+}
+
+// ProcessMessage auto-replies a message sent by the stream user
+// whenever its local recipient has an active vacation message.
+func (x *XEPVacation) ProcessMessage(message *xml.Message) {
+	x.actor.run(func() {
+		if err := x.processMessage(message); err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+func (x *XEPVacation) getVacation(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	elems, err := storage.Instance().FetchPrivateXML(ctx, vacationNamespace, x.strm.Username())
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	result := iq.ResultIQ()
+	q := xml.NewElementNamespace("query", vacationNamespace)
+	q.AppendElements(elems)
+	result.AppendElement(q)
+	x.strm.SendElement(result)
+}
+
+func (x *XEPVacation) setVacation(iq *xml.IQ, q xml.Element) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if q.ElementsCount() > 0 {
+		if _, err := x.vacationFromElements(q.Elements()); err != nil {
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		log.Infof("setting vacation message... (%s/%s)", x.strm.Username(), x.strm.Resource())
+	} else {
+		log.Infof("removing vacation message... (%s/%s)", x.strm.Username(), x.strm.Resource())
+	}
+	if err := storage.Instance().InsertOrUpdatePrivateXML(ctx, q.Elements(), vacationNamespace, x.strm.Username()); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	// a new vacation period starts... forget previous replies
+	vacationReplies.reset(x.strm.Username())
+
+	x.strm.SendElement(iq.ResultIQ())
+}
+
+func (x *XEPVacation) processMessage(message *xml.Message) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if !(message.IsNormal() || message.IsChat()) || !message.IsMessageWithBody() || x.isAutoReply(message) {
+		return nil
+	}
+	toJid := message.ToJID()
+	if !c2s.Instance().IsLocalDomain(toJid.Domain()) || toJid.Node() == x.strm.Username() {
+		return nil
+	}
+	elems, err := storage.Instance().FetchPrivateXML(ctx, vacationNamespace, toJid.Node())
+	if err != nil {
+		return err
+	}
+	if len(elems) == 0 {
+		return nil // no vacation message
+	}
+	v, err := x.vacationFromElements(elems)
+	if err != nil {
+		return err
+	}
+	now := x.now()
+	if !v.isActive(now) {
+		return nil
+	}
+	if !vacationReplies.shouldReply(toJid.Node(), x.strm.JID().ToBareJID().String(), now, x.replyInterval()) {
+		return nil
+	}
+	reply := xml.NewMessageType(uuid.New(), message.Type())
+	reply.SetFromJID(toJid.ToBareJID())
+	reply.SetToJID(x.strm.JID())
+	body := xml.NewElementName("body")
+	body.SetText(v.message)
+	reply.AppendElement(body)
+
+	// mark as auto-replied (https://tools.ietf.org/html/rfc3834)
+	headers := xml.NewElementNamespace("headers", shimNamespace)
+	header := xml.NewElementName("header")
+	header.SetAttribute("name", "Auto-Submitted")
+	header.SetText("auto-replied")
+	headers.AppendElement(header)
+	reply.AppendElement(headers)
+
+	x.strm.SendElement(reply)
+	return nil
+}
+
+func (x *XEPVacation) isAutoReply(message *xml.Message) bool {
+	headers := message.FindElementNamespace("headers", shimNamespace)
+	if headers == nil {
+		return false
+	}
+	for _, header := range headers.FindElements("header") {
+		if header.Attribute("name") == "Auto-Submitted" && header.Text() != "no" {
+			return true
+		}
+	}
+	return false
+}
+
+func (x *XEPVacation) vacationFromElements(elems []xml.Element) (*vacation, error) {
+	v := &vacation{}
+	for _, elem := range elems {
+		var err error
+		switch elem.Name() {
+		case "start":
+			v.start, err = timefmt.Parse(elem.Text())
+		case "end":
+			v.end, err = timefmt.Parse(elem.Text())
+		case "message":
+			v.message = elem.Text()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(v.message) == 0 {
+		return nil, errVacationMessageRequired
+	}
+	if !v.start.IsZero() && !v.end.IsZero() && !v.end.After(v.start) {
+		return nil, errVacationInvalidPeriod
+	}
+	return v, nil
+}
+
+func (x *XEPVacation) replyInterval() time.Duration {
+	if x.cfg.ReplyInterval > 0 {
+		return time.Second * time.Duration(x.cfg.ReplyInterval)
+	}
+	return time.Second * defaultVacationReplyInterval
+}
@@ -0,0 +1,243 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0109_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := NewXEPVacation(&config.ModVacation{}, nil)
+	defer x.Done()
+
+	require.Equal(t, []string{vacationNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("query", vacationNamespace))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0109_SetAndGetVacation(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+
+	x := NewXEPVacation(&config.ModVacation{}, stm)
+	defer x.Done()
+
+	// forbidden...
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	iq := tUtilVacationIQ(xml.GetType, nil)
+	iq.SetToJID(j2.ToBareJID())
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+
+	// message is required...
+	x.ProcessIQ(tUtilVacationIQ(xml.SetType, map[string]string{"start": "2018-04-01T00:00:00Z"}))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// invalid period...
+	x.ProcessIQ(tUtilVacationIQ(xml.SetType, map[string]string{
+		"start":   "2018-04-15T00:00:00Z",
+		"end":     "2018-04-01T00:00:00Z",
+		"message": "Out of office",
+	}))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilVacationIQ(xml.SetType, map[string]string{
+		"start":   "2018-04-01T00:00:00Z",
+		"end":     "2018-04-15T00:00:00Z",
+		"message": "Out of office",
+	}))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	// vacation survives module instances
+	x2 := NewXEPVacation(&config.ModVacation{}, stm)
+	defer x2.Done()
+
+	x2.ProcessIQ(tUtilVacationIQ(xml.GetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	q := elem.FindElementNamespace("query", vacationNamespace)
+	require.NotNil(t, q)
+	require.Equal(t, "Out of office", q.FindElement("message").Text())
+	require.Equal(t, "2018-04-15T00:00:00Z", q.FindElement("end").Text())
+
+	// cancel vacation...
+	x2.ProcessIQ(tUtilVacationIQ(xml.SetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	x2.ProcessIQ(tUtilVacationIQ(xml.GetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, 0, elem.FindElementNamespace("query", vacationNamespace).ElementsCount())
+
+	// storage failure...
+	storage.ActivateMockedError()
+	x2.ProcessIQ(tUtilVacationIQ(xml.GetType, nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+	storage.DeactivateMockedError()
+}
+
+func TestXEP0109_AutoReply(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdatePrivateXML(context.Background(), tUtilVacationElements(map[string]string{
+		"start":   "2018-04-01T00:00:00Z",
+		"end":     "2018-04-15T00:00:00Z",
+		"message": "Out of office",
+	}), vacationNamespace, "noelia")
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	stm := c2s.NewMockStream("abcd", j1)
+
+	now := time.Date(2018, 4, 10, 12, 0, 0, 0, time.UTC)
+
+	x := NewXEPVacation(&config.ModVacation{ReplyInterval: 3600}, stm)
+	x.now = func() time.Time { return now }
+	defer x.Done()
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(j1)
+	msg.SetToJID(j2)
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+	msg.AppendElement(body)
+
+	x.ProcessMessage(msg)
+	elem := stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, xml.ChatType, elem.Type())
+	require.Equal(t, "noelia@jackal.im", elem.From())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.To())
+	require.Equal(t, "Out of office", elem.FindElement("body").Text())
+	require.NotNil(t, elem.FindElementNamespace("headers", shimNamespace))
+
+	// only once per sender and interval...
+	x.ProcessMessage(msg)
+	tUtilVacationRequireNoReply(x, stm, t)
+
+	now = now.Add(time.Hour)
+	x.ProcessMessage(msg)
+	elem = stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+
+	// outside vacation period...
+	now = now.Add(time.Hour * 24 * 30)
+	x.ProcessMessage(msg)
+	tUtilVacationRequireNoReply(x, stm, t)
+}
+
+func TestXEP0109_NoReply(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdatePrivateXML(context.Background(), tUtilVacationElements(map[string]string{
+		"message": "Out of office",
+	}), vacationNamespace, "romeo")
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	stm := c2s.NewMockStream("abcd", j1)
+
+	x := NewXEPVacation(&config.ModVacation{}, stm)
+	defer x.Done()
+
+	newMessage := func(messageType string) *xml.Message {
+		msg := xml.NewMessageType(uuid.New(), messageType)
+		msg.SetFromJID(j1)
+		msg.SetToJID(j2)
+		body := xml.NewElementName("body")
+		body.SetText("Hi!")
+		msg.AppendElement(body)
+		return msg
+	}
+	// never reply to errors...
+	x.ProcessMessage(newMessage(xml.ErrorType))
+	tUtilVacationRequireNoReply(x, stm, t)
+
+	// ...groupchat messages...
+	x.ProcessMessage(newMessage(xml.GroupChatType))
+	tUtilVacationRequireNoReply(x, stm, t)
+
+	// ...or other auto-replies
+	autoReply := newMessage(xml.NormalType)
+	headers := xml.NewElementNamespace("headers", shimNamespace)
+	header := xml.NewElementName("header")
+	header.SetAttribute("name", "Auto-Submitted")
+	header.SetText("auto-replied")
+	headers.AppendElement(header)
+	autoReply.AppendElement(headers)
+	x.ProcessMessage(autoReply)
+	tUtilVacationRequireNoReply(x, stm, t)
+
+	x.ProcessMessage(newMessage(xml.NormalType))
+	elem := stm.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "romeo@jackal.im", elem.From())
+}
+
+func tUtilVacationRequireNoReply(x *XEPVacation, stm *c2s.MockStream, t *testing.T) {
+	// module processes requests sequentially... next element must be the IQ response
+	iq := tUtilVacationIQ(xml.GetType, nil)
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iq.ID(), elem.ID())
+}
+
+func tUtilVacationIQ(iqType string, fields map[string]string) *xml.IQ {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	iq := xml.NewIQType(uuid.New(), iqType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	q := xml.NewElementNamespace("query", vacationNamespace)
+	q.AppendElements(tUtilVacationElements(fields))
+	iq.AppendElement(q)
+	return iq
+}
+
+func tUtilVacationElements(fields map[string]string) []xml.Element {
+	var elems []xml.Element
+	for _, name := range []string{"start", "end", "message"} {
+		if val, ok := fields[name]; ok {
+			e := xml.NewElementName(name)
+			e.SetText(val)
+			elems = append(elems, e)
+		}
+	}
+	return elems
+}
@@ -0,0 +1,307 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"errors"
+
+	"github.com/ortuman/jackal/bounce"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const blockingNamespace = "urn:xmpp:blocking"
+
+var errBlockingMalformedJID = errors.New("malformed block list item jid")
+
+// XEPBlockingCommand represents a blocking command server
+// stream module (https://xmpp.org/extensions/xep-0191.html).
+//
+// Stanzas exchanged between the stream user and a blocked entity are
+// rejected in both directions: those sent by the user are answered with
+// a not-acceptable error, while those sent to the user are bounced as if
+// it didn't exist. Presence is silently dropped either way.
+// Nothing is blocked whenever block lists can't be fetched from storage.
+type XEPBlockingCommand struct {
+	strm  c2s.Stream
+	actor *actor
+	guard doneGuard
+}
+
+// NewXEPBlockingCommand returns a blocking command IQ handler module.
+func NewXEPBlockingCommand(strm c2s.Stream) *XEPBlockingCommand {
+	return &XEPBlockingCommand{
+		strm:  strm,
+		actor: newActor(nil),
+	}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with blocking command module.
+func (x *XEPBlockingCommand) AssociatedNamespaces() []string {
+	return []string{blockingNamespace}
+}
+
+// Priority returns blocking command module priority, so that
+// blocked stanzas are rejected before any other interceptor runs.
+func (x *XEPBlockingCommand) Priority() int {
+	return HighPriority
+}
+
+// Done signals stream termination.
+func (x *XEPBlockingCommand) Done() {
+	x.guard.done()
+	x.actor.done()
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the blocking command module.
+func (x *XEPBlockingCommand) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("blocklist", blockingNamespace) != nil ||
+		iq.FindElementNamespace("block", blockingNamespace) != nil ||
+		iq.FindElementNamespace("unblock", blockingNamespace) != nil
+}
+
+// ProcessIQ processes a blocking command IQ taking according actions
+// over the associated stream.
+func (x *XEPBlockingCommand) ProcessIQ(iq *xml.IQ) {
+	toJid := iq.ToJID()
+	if !toJid.IsServer() && (toJid.Node() != x.strm.Username() || toJid.Domain() != x.strm.Domain()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	x.actor.run(func() {
+		if iq.IsGet() && iq.FindElementNamespace("blocklist", blockingNamespace) != nil {
+			x.sendBlockList(iq)
+			return
+		}
+		var cmd func()
+		if block := iq.FindElementNamespace("block", blockingNamespace); block != nil && iq.IsSet() {
+			cmd = func() { x.block(iq, block) }
+		} else if unblock := iq.FindElementNamespace("unblock", blockingNamespace); unblock != nil && iq.IsSet() {
+			cmd = func() { x.unblock(iq, unblock) }
+		} else {
+			x.strm.SendElement(iq.BadRequestError())
+			return
+		}
+		if !c2s.Instance().GuardSession(x.strm, cmd) {
+			x.strm.SendElement(iq.NotAuthorizedError())
+		}
+	})
+}
+
+// InterceptMessage consumes messages exchanged with a blocked entity.
+func (x *XEPBlockingCommand) InterceptMessage(message *xml.Message) bool {
+	if !x.guard.enter() {
+		return false
+	}
+	defer x.guard.leave()
+	return x.interceptStanza(message, message.ToJID())
+}
+
+// InterceptPresence consumes presences exchanged with a blocked entity.
+// Subscription state changes other than requests are let through,
+// so that rosters are kept consistent, while their delivery is
+// suppressed by AllowsPresence.
+func (x *XEPBlockingCommand) InterceptPresence(presence *xml.Presence) bool {
+	if !x.guard.enter() {
+		return false
+	}
+	defer x.guard.leave()
+
+	switch presence.Type() {
+	case xml.SubscribedType, xml.UnsubscribeType, xml.UnsubscribedType:
+		return false
+	}
+	return x.interceptStanza(presence, presence.ToJID())
+}
+
+// InterceptIQ consumes IQs exchanged with a blocked entity.
+func (x *XEPBlockingCommand) InterceptIQ(iq *xml.IQ) bool {
+	if !x.guard.enter() {
+		return false
+	}
+	defer x.guard.leave()
+	return x.interceptStanza(iq, iq.ToJID())
+}
+
+// AllowsPresence returns whether or not a presence sent by from can be
+// delivered to to, that is, neither of them has blocked the other.
+func (x *XEPBlockingCommand) AllowsPresence(from, to *xml.JID) bool {
+	return !isBlocking(from, to) && !isBlocking(to, from)
+}
+
+func (x *XEPBlockingCommand) interceptStanza(stanza xml.Element, toJid *xml.JID) bool {
+	if len(toJid.Node()) == 0 || !c2s.Instance().IsLocalDomain(toJid.Domain()) {
+		return false
+	}
+	if toJid.Node() == x.strm.Username() && toJid.Domain() == x.strm.Domain() {
+		return false
+	}
+	var reason bounce.Reason
+	switch {
+	case isBlocking(x.strm.JID(), toJid):
+		reason = bounce.BlockedRecipient
+	case isBlocking(toJid, x.strm.JID()):
+		// blocked senders can't tell from a non existing recipient
+		reason = bounce.UnknownRecipient
+	default:
+		return false
+	}
+	if resp := bounce.Response(stanza, reason, nil); resp != nil {
+		x.strm.SendElement(resp)
+	}
+	return true
+}
+
+func (x *XEPBlockingCommand) sendBlockList(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	blis, err := storage.Instance().FetchBlockListItems(ctx, x.strm.Username())
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	result := iq.ResultIQ()
+	result.AppendElement(blockListElement("blocklist", blis))
+	x.strm.SendElement(result)
+}
+
+func (x *XEPBlockingCommand) block(iq *xml.IQ, block xml.Element) {
+	blis, err := x.blockListItems(block)
+	switch {
+	case err == errBlockingMalformedJID:
+		x.strm.SendElement(iq.JidMalformedError())
+		return
+	case len(blis) == 0:
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().InsertBlockListItems(ctx, blis); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.strm.SendElement(iq.ResultIQ())
+	x.pushBlockListChange(blockListElement("block", blis))
+
+	// blocked entities must see the user going offline
+	for _, bli := range blis {
+		blockedJID, _ := xml.NewJIDString(bli.JID, true)
+		x.sendUnavailablePresences(blockedJID)
+	}
+}
+
+func (x *XEPBlockingCommand) unblock(iq *xml.IQ, unblock xml.Element) {
+	blis, err := x.blockListItems(unblock)
+	if err != nil {
+		x.strm.SendElement(iq.JidMalformedError())
+		return
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if len(blis) == 0 {
+		// unblock every blocked entity
+		blis, err = storage.Instance().FetchBlockListItems(ctx, x.strm.Username())
+		if err != nil {
+			log.Error(err)
+			x.strm.SendElement(iq.InternalServerError())
+			return
+		}
+	}
+	if err := storage.Instance().DeleteBlockListItems(ctx, blis); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	x.strm.SendElement(iq.ResultIQ())
+	x.pushBlockListChange(unblock)
+}
+
+// blockListItems returns the block list items held by a block or unblock
+// element, having their JIDs normalized.
+func (x *XEPBlockingCommand) blockListItems(elem xml.Element) ([]model.BlockListItem, error) {
+	var blis []model.BlockListItem
+	for _, item := range elem.FindElements("item") {
+		j, err := xml.NewJIDString(item.Attribute("jid"), false)
+		if err != nil || len(j.Domain()) == 0 {
+			return nil, errBlockingMalformedJID
+		}
+		blis = append(blis, model.BlockListItem{Username: x.strm.Username(), JID: j.String()})
+	}
+	return blis, nil
+}
+
+// pushBlockListChange pushes a block list change to every user resource.
+func (x *XEPBlockingCommand) pushBlockListChange(change xml.Element) {
+	for _, strm := range c2s.Instance().AvailableStreams(x.strm.Username()) {
+		pushEl := xml.NewIQType(uuid.New(), xml.SetType)
+		pushEl.SetTo(strm.JID().String())
+		pushEl.AppendElement(change)
+		strm.SendElement(pushEl)
+	}
+}
+
+// sendUnavailablePresences sends unavailable presence from
+// every user resource to a local blocked entity.
+func (x *XEPBlockingCommand) sendUnavailablePresences(blockedJID *xml.JID) {
+	if len(blockedJID.Node()) == 0 || !c2s.Instance().IsLocalDomain(blockedJID.Domain()) {
+		return
+	}
+	toStreams := c2s.Instance().StreamsMatchingJID(blockedJID)
+	for _, fromStream := range c2s.Instance().AvailableStreams(x.strm.Username()) {
+		for _, toStream := range toStreams {
+			toStream.SendElement(xml.NewPresence(fromStream.JID(), toStream.JID(), xml.UnavailableType))
+		}
+	}
+}
+
+func blockListElement(name string, blis []model.BlockListItem) xml.Element {
+	elem := xml.NewElementNamespace(name, blockingNamespace)
+	for _, bli := range blis {
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", bli.JID)
+		elem.AppendElement(item)
+	}
+	return elem
+}
+
+// isBlocking returns whether or not jid local user has blocked contact.
+func isBlocking(jid, contact *xml.JID) bool {
+	if len(jid.Node()) == 0 || !c2s.Instance().IsLocalDomain(jid.Domain()) {
+		return false
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	blis, err := storage.Instance().FetchBlockListItems(ctx, jid.Node())
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return blockListMatches(blis, contact)
+}
+
+// blockListMatches returns whether or not any block list item matches jid,
+// as of XEP-0016 JID matching rules.
+func blockListMatches(blis []model.BlockListItem, jid *xml.JID) bool {
+	for _, bli := range blis {
+		if jidMatches(bli.JID, jid) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,265 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0191_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	x := NewXEPBlockingCommand(nil)
+	defer x.Done()
+
+	require.Equal(t, []string{blockingNamespace}, x.AssociatedNamespaces())
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	require.False(t, x.MatchesIQ(iq))
+
+	iq.AppendElement(xml.NewElementNamespace("blocklist", blockingNamespace))
+	require.True(t, x.MatchesIQ(iq))
+
+	iq.ClearElements()
+	iq.AppendElement(xml.NewElementNamespace("block", blockingNamespace))
+	require.True(t, x.MatchesIQ(iq))
+
+	iq.ClearElements()
+	iq.AppendElement(xml.NewElementNamespace("unblock", blockingNamespace))
+	require.True(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0191_InvalidIQ(t *testing.T) {
+	stm, x := tUtilBlockingSetup(t)
+	defer tUtilBlockingTeardown(stm, x)
+
+	// not addressed to the user
+	j, _ := xml.NewJID("romeo", "jackal.im", "", true)
+	iq := tUtilBlockingIQ(xml.GetType, "blocklist")
+	iq.SetToJID(j)
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+
+	// get block
+	x.ProcessIQ(tUtilBlockingIQ(xml.GetType, "block"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// empty block
+	x.ProcessIQ(tUtilBlockingIQ(xml.SetType, "block"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// malformed item
+	x.ProcessIQ(tUtilBlockingIQ(xml.SetType, "block", "romeo@"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrJidMalformed.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilBlockingIQ(xml.SetType, "block", ""))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrJidMalformed.Error(), elem.Error().Elements()[0].Name())
+
+	// storage error
+	storage.ActivateMockedError()
+	x.ProcessIQ(tUtilBlockingIQ(xml.GetType, "blocklist"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+	storage.DeactivateMockedError()
+}
+
+func TestXEP0191_BlockAndUnblock(t *testing.T) {
+	stm, x := tUtilBlockingSetup(t)
+	defer tUtilBlockingTeardown(stm, x)
+
+	romeoJID, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	romeoStm := c2s.NewMockStream(uuid.New(), romeoJID)
+	c2s.Instance().RegisterStream(romeoStm)
+	c2s.Instance().AuthenticateStream(romeoStm)
+	defer c2s.Instance().UnregisterStream(romeoStm)
+
+	// empty block list
+	x.ProcessIQ(tUtilBlockingIQ(xml.GetType, "blocklist"))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, 0, elem.FindElementNamespace("blocklist", blockingNamespace).ElementsCount())
+
+	// block
+	iq := tUtilBlockingIQ(xml.SetType, "block", "romeo@jackal.im", "noelia@jackal.im")
+	x.ProcessIQ(iq)
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, iq.ID(), elem.ID())
+
+	elem = stm.FetchElement()
+	require.Equal(t, xml.SetType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.To())
+	require.Equal(t, 2, elem.FindElementNamespace("block", blockingNamespace).ElementsCount())
+
+	// blocked contact sees the user going offline
+	elem = romeoStm.FetchElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "ortuman@jackal.im/balcony", elem.From())
+
+	// block twice
+	x.ProcessIQ(tUtilBlockingIQ(xml.SetType, "block", "romeo@jackal.im"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	require.Equal(t, xml.SetType, stm.FetchElement().Type())
+	romeoStm.FetchElement()
+
+	x.ProcessIQ(tUtilBlockingIQ(xml.GetType, "blocklist"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, 2, elem.FindElementNamespace("blocklist", blockingNamespace).ElementsCount())
+
+	// unblock
+	x.ProcessIQ(tUtilBlockingIQ(xml.SetType, "unblock", "romeo@jackal.im"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	elem = stm.FetchElement()
+	require.Equal(t, xml.SetType, elem.Type())
+	require.Equal(t, 1, elem.FindElementNamespace("unblock", blockingNamespace).ElementsCount())
+
+	blis, _ := storage.Instance().FetchBlockListItems(context.Background(), "ortuman")
+	require.Equal(t, []model.BlockListItem{{Username: "ortuman", JID: "noelia@jackal.im"}}, blis)
+
+	// unblock all
+	x.ProcessIQ(tUtilBlockingIQ(xml.SetType, "unblock"))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+	elem = stm.FetchElement()
+	require.Equal(t, xml.SetType, elem.Type())
+	require.Equal(t, 0, elem.FindElementNamespace("unblock", blockingNamespace).ElementsCount())
+
+	blis, _ = storage.Instance().FetchBlockListItems(context.Background(), "ortuman")
+	require.Equal(t, 0, len(blis))
+}
+
+func TestXEP0191_Enforcement(t *testing.T) {
+	stm, x := tUtilBlockingSetup(t)
+	defer tUtilBlockingTeardown(stm, x)
+
+	romeoJID, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+	nolaJID, _ := xml.NewJID("noelia", "jackal.im", "garden", true)
+	hamletJID, _ := xml.NewJID("hamlet", "denmark.lit", "castle", true)
+
+	storage.Instance().InsertBlockListItems(context.Background(), []model.BlockListItem{
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+	})
+	storage.Instance().InsertBlockListItems(context.Background(), []model.BlockListItem{
+		{Username: "noelia", JID: "jackal.im"},
+	})
+
+	// user blocked the recipient
+	msg := tUtilBlockingMessage(stm.JID(), romeoJID)
+	require.True(t, x.InterceptMessage(msg))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, "romeo@jackal.im/garden", elem.From())
+	require.NotNil(t, elem.Error().FindElementNamespace("blocked", "urn:xmpp:blocking:errors"))
+
+	// recipient blocked the user
+	msg = tUtilBlockingMessage(stm.JID(), nolaJID)
+	require.True(t, x.InterceptMessage(msg))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, xml.ErrServiceUnavailable.Error(), elem.Error().Elements()[0].Name())
+
+	// not blocked
+	require.False(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), hamletJID)))
+	require.False(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), stm.JID().ToBareJID())))
+
+	// presences are silently dropped
+	require.True(t, x.InterceptPresence(xml.NewPresence(stm.JID(), romeoJID.ToBareJID(), xml.AvailableType)))
+	require.True(t, x.InterceptPresence(xml.NewPresence(stm.JID(), romeoJID.ToBareJID(), xml.SubscribeType)))
+	require.False(t, x.InterceptPresence(xml.NewPresence(stm.JID(), romeoJID.ToBareJID(), xml.UnsubscribedType)))
+	require.Nil(t, stm.FetchElementTimeout(50*time.Millisecond))
+
+	require.False(t, x.AllowsPresence(stm.JID(), romeoJID))
+	require.False(t, x.AllowsPresence(romeoJID, stm.JID()))
+	require.False(t, x.AllowsPresence(stm.JID(), nolaJID))
+	require.True(t, x.AllowsPresence(stm.JID(), hamletJID))
+
+	// fail open on storage errors
+	storage.ActivateMockedError()
+	require.False(t, x.InterceptMessage(tUtilBlockingMessage(stm.JID(), romeoJID)))
+	storage.DeactivateMockedError()
+}
+
+func TestXEP0191_BlockListMatches(t *testing.T) {
+	j, _ := xml.NewJID("romeo", "jackal.im", "garden", true)
+
+	for _, tc := range []struct {
+		jid     string
+		matches bool
+	}{
+		{"romeo@jackal.im/garden", true},
+		{"romeo@jackal.im", true},
+		{"jackal.im/garden", true},
+		{"jackal.im", true},
+		{"romeo@jackal.im/balcony", false},
+		{"noelia@jackal.im", false},
+		{"jackal.im/balcony", false},
+		{"montague.lit", false},
+	} {
+		blis := []model.BlockListItem{{Username: "ortuman", JID: tc.jid}}
+		require.Equal(t, tc.matches, blockListMatches(blis, j), tc.jid)
+	}
+}
+
+func tUtilBlockingSetup(t *testing.T) (*c2s.MockStream, *XEPBlockingCommand) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream(uuid.New(), j)
+	require.Nil(t, c2s.Instance().RegisterStream(stm))
+	require.Nil(t, c2s.Instance().AuthenticateStream(stm))
+	return stm, NewXEPBlockingCommand(stm)
+}
+
+func tUtilBlockingTeardown(stm *c2s.MockStream, x *XEPBlockingCommand) {
+	x.Done()
+	c2s.Instance().UnregisterStream(stm)
+	c2s.Shutdown()
+	storage.Shutdown()
+}
+
+func tUtilBlockingIQ(typ, name string, jids ...string) *xml.IQ {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	iq := xml.NewIQType(uuid.New(), typ)
+	iq.SetFromJID(j)
+	iq.SetToJID(j.ToBareJID())
+	elem := xml.NewElementNamespace(name, blockingNamespace)
+	for _, jid := range jids {
+		item := xml.NewElementName("item")
+		item.SetAttribute("jid", jid)
+		elem.AppendElement(item)
+	}
+	iq.AppendElement(elem)
+	return iq
+}
+
+func tUtilBlockingMessage(from, to *xml.JID) *xml.Message {
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	body := xml.NewElementName("body")
+	body.SetText("hi!")
+	msg.AppendElement(body)
+	return msg
+}
@@ -6,12 +6,13 @@
 package module
 
 import (
+	"math/rand"
 	"sync"
-	"sync/atomic"
 	"time"
 
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
@@ -20,28 +21,124 @@ import (
 
 const pingNamespace = "urn:xmpp:ping"
 
+// pingWriteTimeout is the maximum time a ping can wait to be
+// queued for writing before considering the connection dead.
+const pingWriteTimeout = time.Second * 5
+
+// defaultPingSendTimeout is the time a sent ping waits for its pong
+// whenever not configured, never exceeding the send interval.
+const defaultPingSendTimeout = 32 // 32 seconds
+
+// defaultPingMaxMissed is the number of consecutive pongs that can be
+// missed before disconnecting whenever not configured.
+const defaultPingMaxMissed = 1
+
+// defaultPingInactiveFactor is the factor send interval gets multiplied by
+// while peer is inactive, whenever inactive send interval is not configured.
+const defaultPingInactiveFactor = 4
+
+// pingRTTSmoothing is the weight given to every new round-trip
+// time sample on the rolling average.
+const pingRTTSmoothing = 0.125
+
+// PingStream represents a stream the ping module can keep alive, either
+// a c2s session or a server-to-server connection.
+type PingStream interface {
+	JID() *xml.JID
+	SendElement(element xml.Element)
+	Disconnect(err error)
+}
+
+// streamTerminator is implemented by streams able to
+// send a descriptive text along with a stream error.
+type streamTerminator interface {
+	Terminate(reason *streamerror.Error, text string)
+}
+
+// pingTimer represents a scheduled ping module function call.
+type pingTimer interface {
+	Stop() bool
+	Reset(d time.Duration) bool
+}
+
+// pingClock abstracts ping module time, so that it can be faked.
+type pingClock interface {
+	Now() time.Time
+	AfterFunc(d time.Duration, f func()) pingTimer
+}
+
+type systemPingClock struct{}
+
+func (systemPingClock) Now() time.Time { return time.Now() }
+
+func (systemPingClock) AfterFunc(d time.Duration, f func()) pingTimer {
+	return time.AfterFunc(d, f)
+}
+
+// outstandingPing represents a sent ping awaiting its pong.
+type outstandingPing struct {
+	to        *xml.JID
+	sentAt    time.Time
+	timeoutTm pingTimer
+}
+
 // XEPPing represents a ping server stream module.
 type XEPPing struct {
-	cfg  *config.ModPing
-	strm c2s.Stream
+	cfg   *config.ModPing
+	strm  PingStream
+	clock pingClock
+	rnd   *rand.Rand // guarded by 'pingMu'
 
-	pingTm *time.Timer
-	pongCh chan struct{}
+	pingMu       sync.RWMutex // guards ping state below
+	pingTm       pingTimer
+	outstanding  map[string]*outstandingPing
+	missed       int
+	suspended    bool
+	inactive     bool
+	lastActivity time.Time
+	lastRTT      time.Duration
+	avgRTT       time.Duration
 
-	pingMu sync.RWMutex // guards 'pingID'
-	pingId string
+	stats *stats.Registry
 
-	waitingPing uint32
-	pingOnce    sync.Once
+	pingOnce sync.Once
+	termOnce sync.Once
+
+	guard doneGuard
 }
 
 // NewXEPPing returns an ping IQ handler module.
-func NewXEPPing(config *config.ModPing, strm c2s.Stream) *XEPPing {
-	return &XEPPing{
-		cfg:    config,
-		strm:   strm,
-		pongCh: make(chan struct{}, 1),
+func NewXEPPing(config *config.ModPing, strm PingStream) *XEPPing {
+	x := &XEPPing{
+		cfg:         config,
+		strm:        strm,
+		clock:       systemPingClock{},
+		rnd:         rand.New(rand.NewSource(time.Now().UnixNano())),
+		outstanding: make(map[string]*outstandingPing),
+		stats:       stats.NewRegistry(),
 	}
+	x.stats.Counter("ping/sent", "pings")
+	x.stats.Counter("ping/pongs", "pongs")
+	x.stats.Counter("ping/timeouts", "pings")
+	x.stats.Counter("ping/keepalives", "keepalives")
+	x.stats.RegisterGauge("ping/rtt/last", "milliseconds", func() (int64, error) {
+		return int64(x.LastRTT() / time.Millisecond), nil
+	})
+	x.stats.RegisterGauge("ping/rtt/average", "milliseconds", func() (int64, error) {
+		return int64(x.AverageRTT() / time.Millisecond), nil
+	})
+	return x
+}
+
+// NewXEPServerPing returns a ping IQ handler module for a server-to-server
+// stream, whose JID is the remote domain, pinging it as configured
+// in s2s section.
+func NewXEPServerPing(cfg *config.ModPing, strm PingStream) *XEPPing {
+	s2sCfg := *cfg
+	s2sCfg.Send = cfg.S2S.Send
+	s2sCfg.SendInterval = cfg.S2S.SendInterval
+	s2sCfg.SendTimeout = cfg.S2S.SendTimeout
+	return NewXEPPing(&s2sCfg, strm)
 }
 
 // AssociatedNamespaces returns namespaces associated
@@ -50,8 +147,58 @@ func (x *XEPPing) AssociatedNamespaces() []string {
 	return []string{pingNamespace}
 }
 
-// Done signals stream termination.
+// DiscoFeatures returns ping disco info features.
+func (x *XEPPing) DiscoFeatures() []string {
+	return []string{pingNamespace}
+}
+
+// Priority returns ping module priority.
+// Pong replies are matched ahead of any other IQ handler.
+func (x *XEPPing) Priority() int {
+	return HighPriority
+}
+
+// Stats returns stream ping statistics, that is, pings sent,
+// pongs received, pong timeouts and round-trip times.
+func (x *XEPPing) Stats() *stats.Registry {
+	return x.stats
+}
+
+// LastRTT returns the round-trip time of the last answered ping,
+// or zero if none has been answered yet.
+func (x *XEPPing) LastRTT() time.Duration {
+	x.pingMu.RLock()
+	defer x.pingMu.RUnlock()
+	return x.lastRTT
+}
+
+// AverageRTT returns the rolling average of answered pings round-trip time.
+func (x *XEPPing) AverageRTT() time.Duration {
+	x.pingMu.RLock()
+	defer x.pingMu.RUnlock()
+	return x.avgRTT
+}
+
+// LastActivity returns the time of the last stanza received
+// from peer, or zero time if none was received yet.
+func (x *XEPPing) LastActivity() time.Time {
+	x.pingMu.RLock()
+	defer x.pingMu.RUnlock()
+	return x.lastActivity
+}
+
+// Done signals stream termination, stopping any scheduled ping.
+// No ping gets sent once it returns.
 func (x *XEPPing) Done() {
+	if !x.guard.done() {
+		return
+	}
+	x.pingMu.Lock()
+	defer x.pingMu.Unlock()
+	if x.pingTm != nil {
+		x.pingTm.Stop()
+	}
+	x.clearOutstanding()
 }
 
 // MatchesIQ returns whether or not an IQ should be
@@ -63,12 +210,16 @@ func (x *XEPPing) MatchesIQ(iq *xml.IQ) bool {
 // ProcessIQ processes a ping IQ taking according actions
 // over the associated stream.
 func (x *XEPPing) ProcessIQ(iq *xml.IQ) {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
 	if x.isPongIQ(iq) {
 		x.handlePongIQ(iq)
 		return
 	}
-	toJid := iq.ToJID()
-	if toJid.Node() != x.strm.Username() {
+	if !x.isValidToJID(iq.ToJID()) {
 		x.strm.SendElement(iq.ForbiddenError())
 		return
 	}
@@ -77,75 +228,345 @@ func (x *XEPPing) ProcessIQ(iq *xml.IQ) {
 		x.strm.SendElement(iq.BadRequestError())
 		return
 	}
-	log.Infof("received ping... id: %s", iq.ID())
+	log.Limited("ping/received").Infof("received ping... id: %s", iq.ID())
 	if iq.IsGet() {
-		log.Infof("sent pong... id: %s", iq.ID())
+		log.Limited("ping/pong_sent").Infof("sent pong... id: %s", iq.ID())
 		x.strm.SendElement(iq.ResultIQ())
 	} else {
 		x.strm.SendElement(iq.BadRequestError())
 	}
 }
 
+// isValidToJID reports whether a ping addressed to jid can be answered,
+// that is, whenever it targets a local server domain or the stream account itself.
+func (x *XEPPing) isValidToJID(jid *xml.JID) bool {
+	if len(jid.Node()) == 0 {
+		return len(jid.Resource()) == 0 && c2s.Instance().IsLocalDomain(jid.Domain())
+	}
+	account := x.strm.JID()
+	if account == nil || len(account.Node()) == 0 || jid.Domain() != account.Domain() {
+		return false
+	}
+	node, err := xml.NewJID(jid.Node(), jid.Domain(), "", false)
+	if err != nil {
+		return false
+	}
+	return node.Node() == account.Node()
+}
+
 // StartPinging starts pinging peer every 'send interval' period.
 func (x *XEPPing) StartPinging() {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
 	if x.cfg.Send {
 		x.pingOnce.Do(func() {
-			x.pingTm = time.AfterFunc(time.Second*time.Duration(x.cfg.SendInterval), x.sendPing)
+			x.pingMu.Lock()
+			x.pingTm = x.clock.AfterFunc(x.sendInterval(), x.sendPing)
+			x.pingMu.Unlock()
 		})
 	}
 }
 
-// ResetDeadline resets send ping deadline.
+// ResetDeadline pushes next ping out by a whole send interval, whether or
+// not a ping was already sent. Any received stanza proves peer liveness,
+// so missed pongs are forgiven. The interval is stretched while peer is
+// inactive, since it's not expected to send anything meanwhile.
 func (x *XEPPing) ResetDeadline() {
-	if x.cfg.Send && atomic.LoadUint32(&x.waitingPing) == 1 {
-		x.pingTm.Reset(time.Second * time.Duration(x.cfg.SendInterval))
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
+	if !x.cfg.Send {
+		return
+	}
+	x.pingMu.Lock()
+	defer x.pingMu.Unlock()
+	x.missed = 0
+	x.suspended = false
+	x.lastActivity = x.clock.Now()
+	if x.pingTm != nil {
+		x.pingTm.Reset(x.sendInterval())
+	}
+}
+
+// SetInactive sets whether or not peer declared itself inactive
+// (https://xmpp.org/extensions/xep-0352.html), rescheduling next ping
+// as of the corresponding send interval.
+func (x *XEPPing) SetInactive(inactive bool) {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
+	x.pingMu.Lock()
+	defer x.pingMu.Unlock()
+	if x.inactive == inactive {
 		return
 	}
+	x.inactive = inactive
+	if x.pingTm != nil && !x.suspended {
+		x.pingTm.Reset(x.sendInterval())
+	}
+}
+
+// SuspendPinging stops pinging peer while its connection is known to be
+// gone, discarding every outstanding ping. Pinging carries on as soon as
+// ResetDeadline gets called.
+func (x *XEPPing) SuspendPinging() {
+	if !x.guard.enter() {
+		return
+	}
+	defer x.guard.leave()
+
+	x.pingMu.Lock()
+	defer x.pingMu.Unlock()
+	x.suspended = true
+	if x.pingTm != nil {
+		x.pingTm.Stop()
+	}
+	x.clearOutstanding()
 }
 
 func (x *XEPPing) isPongIQ(iq *xml.IQ) bool {
+	if !iq.IsResult() && !iq.IsError() {
+		return false
+	}
 	x.pingMu.RLock()
 	defer x.pingMu.RUnlock()
-	return x.pingId == iq.ID() && (iq.IsResult() || iq.IsError())
+	_, ok := x.outstanding[iq.ID()]
+	return ok
 }
 
+// sendPing sends a new ping without waiting for its pong,
+// scheduling the next one right away.
 func (x *XEPPing) sendPing() {
-	atomic.StoreUint32(&x.waitingPing, 0)
-
+	if !x.guard.enter() {
+		return
+	}
+	if x.postponePing() {
+		x.guard.leave()
+		return
+	}
+	if ka, ok := x.strm.(c2s.KeepAliveSender); ok && x.cfg.Mode == config.WhitespacePing {
+		x.sendKeepAlive(ka)
+		return
+	}
+	pingID := uuid.New()
+	to := x.strm.JID()
 	x.pingMu.Lock()
-	x.pingId = uuid.New()
-	pingId := x.pingId
+	x.outstanding[pingID] = &outstandingPing{
+		to:        to,
+		sentAt:    x.clock.Now(),
+		timeoutTm: x.clock.AfterFunc(x.sendTimeout(), func() { x.pongTimeout(pingID) }),
+	}
+	x.pingTm.Reset(x.sendInterval())
 	x.pingMu.Unlock()
 
-	iq := xml.NewIQType(pingId, xml.GetType)
-	iq.SetTo(x.strm.JID().String())
+	iq := xml.NewIQType(pingID, xml.GetType)
+	iq.SetTo(to.String())
 	iq.AppendElement(xml.NewElementNamespace("ping", pingNamespace))
 
-	x.strm.SendElement(iq)
+	err := x.sendElement(iq)
+	x.guard.leave()
 
-	log.Infof("sent ping... id: %s", pingId)
+	if err != nil {
+		log.Infof("failed to send ping... id: %s: %v", pingID, err)
+		x.terminate("Ping write failed")
+		return
+	}
+	log.Limited("ping/sent").Infof("sent ping... id: %s", pingID)
+	x.count("ping/sent", "pings")
+}
 
-	x.waitForPong()
+// postponePing reschedules the due ping whenever peer sent any stanza
+// within the last send interval, so that active peers never get pinged.
+// Pings racing with a suspension are postponed as well.
+func (x *XEPPing) postponePing() bool {
+	x.pingMu.Lock()
+	defer x.pingMu.Unlock()
+	if x.suspended {
+		return true
+	}
+	if x.lastActivity.IsZero() {
+		return false
+	}
+	idle := x.clock.Now().Sub(x.lastActivity)
+	interval := x.sendInterval()
+	if idle >= interval {
+		return false
+	}
+	x.pingTm.Reset(interval - idle)
+	return true
 }
 
-func (x *XEPPing) waitForPong() {
-	t := time.NewTimer(time.Second * time.Duration(x.cfg.SendInterval))
-	select {
-	case <-x.pongCh:
+// sendKeepAlive writes a whitespace keepalive, scheduling the next one
+// right away. No reply is expected, so only write errors are accounted.
+// Must be called after entering guard, which gets left on return.
+func (x *XEPPing) sendKeepAlive(ka c2s.KeepAliveSender) {
+	x.pingMu.Lock()
+	x.pingTm.Reset(x.sendInterval())
+	x.pingMu.Unlock()
+
+	err := ka.SendKeepAlive(pingWriteTimeout)
+	x.guard.leave()
+
+	if err != nil {
+		log.Infof("failed to send keepalive: %v", err)
+		x.terminate("Keepalive write failed")
 		return
-	case <-t.C:
-		x.strm.Disconnect(streamerror.ErrConnectionTimeout)
 	}
+	x.count("ping/keepalives", "keepalives")
 }
 
-func (x *XEPPing) handlePongIQ(iq *xml.IQ) {
-	log.Infof("received pong... id: %s", iq.ID())
-
+// pongTimeout accounts pingID ping as missed, unless peer proved
+// to be alive meanwhile, disconnecting it once too many are missed.
+func (x *XEPPing) pongTimeout(pingID string) {
 	x.pingMu.Lock()
-	x.pingId = ""
+	p, ok := x.outstanding[pingID]
+	if !ok {
+		x.pingMu.Unlock()
+		return
+	}
+	if x.lastActivity.After(p.sentAt) {
+		delete(x.outstanding, pingID)
+		x.pingMu.Unlock()
+		return
+	}
+	x.missed++
+	missed := x.missed
 	x.pingMu.Unlock()
 
-	x.pongCh <- struct{}{}
-	x.pingTm.Reset(time.Second * time.Duration(x.cfg.SendInterval))
-	atomic.StoreUint32(&x.waitingPing, 1)
+	x.count("ping/timeouts", "pings")
+
+	log.Infof("missed pong... id: %s (%d/%d)", pingID, missed, x.maxMissed())
+	if missed >= x.maxMissed() {
+		x.terminate("Ping timeout")
+	}
+}
+
+// sendInterval returns the time until next ping, randomized by configured
+// jitter so that pings of concurrently started streams get spread.
+// Must be called holding pingMu lock.
+func (x *XEPPing) sendInterval() time.Duration {
+	interval := time.Second * time.Duration(x.cfg.SendInterval)
+	if x.inactive {
+		if x.cfg.InactiveSendInterval > 0 {
+			interval = time.Second * time.Duration(x.cfg.InactiveSendInterval)
+		} else {
+			interval *= defaultPingInactiveFactor
+		}
+	}
+	if x.cfg.Jitter > 0 {
+		interval += time.Duration((x.rnd.Float64()*2 - 1) * x.cfg.Jitter * float64(interval))
+	}
+	return interval
+}
+
+// sendTimeout returns the time a sent ping waits for its pong.
+func (x *XEPPing) sendTimeout() time.Duration {
+	timeout := x.cfg.SendTimeout
+	if timeout == 0 {
+		timeout = defaultPingSendTimeout
+		if x.cfg.SendInterval < timeout {
+			timeout = x.cfg.SendInterval
+		}
+	}
+	return time.Second * time.Duration(timeout)
+}
+
+// maxMissed returns the number of consecutive pongs
+// that can be missed before disconnecting.
+func (x *XEPPing) maxMissed() int {
+	if x.cfg.MaxMissed > 0 {
+		return x.cfg.MaxMissed
+	}
+	return defaultPingMaxMissed
+}
+
+// sendElement sends a ping element, failing fast whenever
+// the stream can't queue it for writing in time.
+func (x *XEPPing) sendElement(elem xml.Element) error {
+	if ts, ok := x.strm.(c2s.TimedSender); ok {
+		return ts.SendElementTimeout(elem, pingWriteTimeout)
+	}
+	x.strm.SendElement(elem)
+	return nil
+}
+
+func (x *XEPPing) terminate(text string) {
+	if !x.guard.enter() {
+		return
+	}
+	x.guard.leave()
+
+	x.termOnce.Do(func() {
+		if t, ok := x.strm.(streamTerminator); ok {
+			t.Terminate(streamerror.ErrConnectionTimeout, text)
+		} else {
+			x.strm.Disconnect(streamerror.ErrConnectionTimeout)
+		}
+	})
+}
+
+// handlePongIQ accepts a pong answering any outstanding ping,
+// late ones included, forgiving every missed pong.
+// Pongs not sent by the pinged entity are ignored.
+func (x *XEPPing) handlePongIQ(iq *xml.IQ) {
+	x.pingMu.Lock()
+	defer x.pingMu.Unlock()
+
+	p, ok := x.outstanding[iq.ID()]
+	if !ok {
+		return
+	}
+	if !x.isPongSender(iq.FromJID(), p.to) {
+		log.Debugf("ignored pong from unexpected sender... id: %s, from: %s", iq.ID(), iq.From())
+		return
+	}
+	rtt := x.clock.Now().Sub(p.sentAt)
+	log.Debugf("received pong... id: %s, rtt: %v", iq.ID(), rtt)
+
+	x.lastRTT = rtt
+	if x.avgRTT == 0 {
+		x.avgRTT = rtt
+	} else {
+		x.avgRTT += time.Duration(pingRTTSmoothing * float64(rtt-x.avgRTT))
+	}
+	x.clearOutstanding()
+	x.missed = 0
+
+	x.count("ping/pongs", "pongs")
+}
+
+// count increments name counter both on stream
+// and server statistics.
+func (x *XEPPing) count(name, units string) {
+	x.stats.Counter(name, units).Inc()
+	stats.Default().Counter(name, units).Inc()
+}
+
+// isPongSender reports whether from matches the pinged JID,
+// either bare or full as configured. Server-to-server
+// pongs come from the pinged remote domain itself.
+func (x *XEPPing) isPongSender(from, pinged *xml.JID) bool {
+	if from == nil {
+		return false
+	}
+	if x.cfg.MatchBareJID {
+		return from.ToBareJID().IsEqual(pinged.ToBareJID())
+	}
+	return from.IsEqual(pinged)
+}
+
+// clearOutstanding discards every outstanding ping.
+// Must be called holding pingMu lock.
+func (x *XEPPing) clearOutstanding() {
+	for id, p := range x.outstanding {
+		p.timeoutTm.Stop()
+		delete(x.outstanding, id)
+	}
 }
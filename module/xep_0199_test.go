@@ -6,7 +6,9 @@
 package module
 
 import (
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -73,6 +75,50 @@ func TestXEP0199_ReceivePing(t *testing.T) {
 	require.Equal(t, iqID, elem.ID())
 }
 
+func TestXEP0199_PingTargets(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	var tcs = []struct {
+		to        string
+		forbidden bool
+	}{
+		{to: "jackal.im"},
+		{to: "ortuman@jackal.im"},
+		{to: "Ortuman@jackal.im"},
+		{to: "ortuman@jackal.im/balcony"},
+		{to: "ortuman@jackal.im/garden"},
+		{to: "juliet@jackal.im", forbidden: true},
+		{to: "juliet@jackal.im/garden", forbidden: true},
+		{to: "ortuman@jackal.org", forbidden: true},
+		{to: "jackal.org", forbidden: true},
+		{to: "jackal.im/balcony", forbidden: true},
+	}
+	for _, tc := range tcs {
+		t.Run(tc.to, func(t *testing.T) {
+			stm := c2s.NewMockStream("abcd", j1)
+			x := NewXEPPing(&config.ModPing{}, stm)
+			defer x.Done()
+
+			to, _ := xml.NewJIDString(tc.to, true)
+			iq := xml.NewIQType(uuid.New(), xml.GetType)
+			iq.SetFromJID(j1)
+			iq.SetToJID(to)
+			iq.AppendElement(xml.NewElementNamespace("ping", pingNamespace))
+
+			x.ProcessIQ(iq)
+			elem := stm.FetchElement()
+			if tc.forbidden {
+				require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+			} else {
+				require.Equal(t, xml.ResultType, elem.Type())
+			}
+		})
+	}
+}
+
 func TestXEP0199_SendPing(t *testing.T) {
 	t.Parallel()
 	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
@@ -92,7 +138,9 @@ func TestXEP0199_SendPing(t *testing.T) {
 	require.NotNil(t, elem.FindElementNamespace("ping", pingNamespace))
 
 	// send pong...
-	x.ProcessIQ(xml.NewIQType(elem.ID(), xml.ResultType))
+	pong := xml.NewIQType(elem.ID(), xml.ResultType)
+	pong.SetFromJID(j1)
+	x.ProcessIQ(pong)
 	x.ResetDeadline()
 
 	// wait next ping...
@@ -128,4 +176,622 @@ func TestXEP0199_Disconnect(t *testing.T) {
 	err := stm.WaitDisconnection()
 	require.NotNil(t, err)
 	require.Equal(t, "connection-timeout", err.Error())
+	require.Equal(t, "Ping timeout", stm.TerminationText())
+}
+
+func TestXEP0199_SendTimeout(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetUsername("ortuman")
+
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 3, SendTimeout: 1}, stm)
+	defer x.Done()
+
+	x.StartPinging()
+
+	// wait next ping...
+	elem := stm.FetchElement()
+	require.NotNil(t, elem)
+	require.NotNil(t, elem.FindElementNamespace("ping", pingNamespace))
+	sentAt := time.Now()
+
+	// expect disconnection after the timeout, rather than the whole interval...
+	err := stm.WaitDisconnection()
+	require.NotNil(t, err)
+	require.Equal(t, "connection-timeout", err.Error())
+	require.True(t, time.Since(sentAt) < time.Millisecond*2500)
+}
+
+func TestXEP0199_SendPingFailure(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	stm.SetUsername("ortuman")
+	stm.SetSendError(c2s.ErrSendTimeout)
+
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 1}, stm)
+	defer x.Done()
+
+	start := time.Now()
+	x.StartPinging()
+
+	// expect disconnection right after the first ping write fails...
+	err := stm.WaitDisconnection()
+	require.NotNil(t, err)
+	require.Equal(t, "connection-timeout", err.Error())
+	require.Equal(t, "Ping write failed", stm.TerminationText())
+	require.True(t, time.Since(start) < time.Millisecond*1500)
+
+	// ...and only once
+	disconnected, _ := stm.WaitDisconnectionTimeout(time.Millisecond * 1500)
+	require.False(t, disconnected)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+}
+
+func TestXEP0199_Done(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	// done before first ping
+	stm := c2s.NewMockStream("abcd", j1)
+	clock := newFakePingClock()
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 60}, stm)
+	x.clock = clock
+
+	x.StartPinging()
+	x.Done()
+	x.ResetDeadline()
+
+	clock.Advance(time.Minute * 5)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*50))
+	require.False(t, stm.IsDisconnected())
+
+	// done while waiting for pong
+	stm = c2s.NewMockStream("abcd", j1)
+	clock = newFakePingClock()
+	x = NewXEPPing(&config.ModPing{Send: true, SendInterval: 60}, stm)
+	x.clock = clock
+
+	x.StartPinging()
+	clock.Advance(time.Minute)
+	require.NotNil(t, stm.FetchElement().FindElementNamespace("ping", pingNamespace))
+
+	x.Done()
+	clock.Advance(time.Minute * 5)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*50))
+	require.False(t, stm.IsDisconnected())
+	require.Equal(t, 0, clock.Pending())
+}
+
+func TestXEP0199_MaxMissed(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	clock := newFakePingClock()
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5, MaxMissed: 2}, stm)
+	x.clock = clock
+	defer x.Done()
+
+	x.StartPinging()
+
+	clock.Advance(time.Second * 10)
+	ping1 := stm.FetchElement()
+	require.NotNil(t, ping1.FindElementNamespace("ping", pingNamespace))
+
+	// first miss is tolerated...
+	clock.Advance(time.Second * 5)
+	require.False(t, stm.IsDisconnected())
+
+	clock.Advance(time.Second * 5)
+	ping2 := stm.FetchElement()
+	require.NotNil(t, ping2.FindElementNamespace("ping", pingNamespace))
+
+	// ...and forgiven by a late pong arriving before the second one
+	pong := xml.NewIQType(ping1.ID(), xml.ResultType)
+	pong.SetFromJID(j1)
+	require.True(t, x.MatchesIQ(pong))
+	x.ProcessIQ(pong)
+
+	clock.Advance(time.Second * 5)
+	require.False(t, stm.IsDisconnected())
+	require.False(t, x.MatchesIQ(xml.NewIQType(ping2.ID(), xml.ResultType)))
+
+	// any received stanza proves liveness as well
+	clock.Advance(time.Second * 5)
+	require.NotNil(t, stm.FetchElement())
+	clock.Advance(time.Second * 5)
+	x.ResetDeadline()
+
+	clock.Advance(time.Second * 10)
+	require.NotNil(t, stm.FetchElement())
+	clock.Advance(time.Second * 5)
+	require.False(t, stm.IsDisconnected())
+
+	// two consecutive misses
+	clock.Advance(time.Second * 5)
+	require.NotNil(t, stm.FetchElement())
+	clock.Advance(time.Second * 5)
+
+	err := stm.WaitDisconnection()
+	require.NotNil(t, err)
+	require.Equal(t, "connection-timeout", err.Error())
+	require.Equal(t, "Ping timeout", stm.TerminationText())
+}
+
+func TestXEP0199_ActivityPostponesPing(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	clock := newFakePingClock()
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5}, stm)
+	x.clock = clock
+	defer x.Done()
+
+	x.StartPinging()
+
+	// activity before the first ping...
+	clock.Advance(time.Second * 5)
+	x.ResetDeadline()
+	clock.Advance(time.Second * 5)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+
+	clock.Advance(time.Second * 5)
+	ping := stm.FetchElement()
+	require.NotNil(t, ping.FindElementNamespace("ping", pingNamespace))
+
+	// ...after a handled pong...
+	pong := xml.NewIQType(ping.ID(), xml.ResultType)
+	pong.SetFromJID(j1)
+	x.ProcessIQ(pong)
+
+	clock.Advance(time.Second * 5)
+	x.ResetDeadline()
+	clock.Advance(time.Second * 5)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+
+	clock.Advance(time.Second * 5)
+	require.NotNil(t, stm.FetchElement().FindElementNamespace("ping", pingNamespace))
+
+	// ...and while waiting for a pong
+	clock.Advance(time.Second * 2)
+	x.ResetDeadline()
+	clock.Advance(time.Second * 8)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+	require.False(t, stm.IsDisconnected())
+
+	clock.Advance(time.Second * 2)
+	require.NotNil(t, stm.FetchElement().FindElementNamespace("ping", pingNamespace))
+
+	// a due ping racing with recent activity gets postponed as well
+	clock.Advance(time.Second * 3)
+	x.ResetDeadline()
+	x.sendPing()
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+
+	clock.Advance(time.Second * 10)
+	require.NotNil(t, stm.FetchElement().FindElementNamespace("ping", pingNamespace))
+	require.False(t, stm.IsDisconnected())
+}
+
+func TestXEP0199_SuspendPinging(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	clock := newFakePingClock()
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5}, stm)
+	x.clock = clock
+	defer x.Done()
+
+	x.StartPinging()
+
+	clock.Advance(time.Second * 10)
+	require.NotNil(t, stm.FetchElement().FindElementNamespace("ping", pingNamespace))
+
+	// outstanding ping is discarded...
+	x.SuspendPinging()
+	clock.Advance(time.Minute)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+	require.False(t, stm.IsDisconnected())
+	require.Equal(t, 0, clock.Pending())
+
+	// ...as well as a due one racing with the suspension
+	x.sendPing()
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+
+	x.ResetDeadline()
+	clock.Advance(time.Second * 10)
+	require.NotNil(t, stm.FetchElement().FindElementNamespace("ping", pingNamespace))
+}
+
+func TestXEP0199_InactivePeer(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	clock := newFakePingClock()
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5}, stm)
+	x.clock = clock
+	defer x.Done()
+
+	x.StartPinging()
+
+	// inactive peers get pinged less often...
+	x.SetInactive(true)
+	clock.Advance(time.Second * 39)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+
+	clock.Advance(time.Second)
+	ping := stm.FetchElement()
+	require.NotNil(t, ping.FindElementNamespace("ping", pingNamespace))
+
+	pong := xml.NewIQType(ping.ID(), xml.ResultType)
+	pong.SetFromJID(j1)
+	x.ProcessIQ(pong)
+
+	// ...even after any activity
+	clock.Advance(time.Second * 20)
+	x.ResetDeadline()
+	clock.Advance(time.Second * 39)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+	require.False(t, stm.IsDisconnected())
+
+	// active again
+	x.SetInactive(false)
+	clock.Advance(time.Second * 9)
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+
+	clock.Advance(time.Second)
+	require.NotNil(t, stm.FetchElement().FindElementNamespace("ping", pingNamespace))
+
+	// configured inactive send interval
+	stm2 := c2s.NewMockStream("efgh", j1)
+	clock2 := newFakePingClock()
+	x2 := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5, InactiveSendInterval: 15}, stm2)
+	x2.clock = clock2
+	defer x2.Done()
+
+	x2.StartPinging()
+	x2.SetInactive(true)
+	clock2.Advance(time.Second * 14)
+	require.Nil(t, stm2.FetchElementTimeout(time.Millisecond*10))
+
+	clock2.Advance(time.Second)
+	require.NotNil(t, stm2.FetchElement().FindElementNamespace("ping", pingNamespace))
+}
+
+func TestXEP0199_WhitespaceKeepAlive(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	clock := newFakePingClock()
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10, Mode: config.WhitespacePing}, stm)
+	x.clock = clock
+	defer x.Done()
+
+	x.StartPinging()
+
+	// keepalives expect no reply...
+	clock.Advance(time.Second * 10)
+	require.Equal(t, 1, stm.KeepAlives())
+	clock.Advance(time.Minute)
+	require.Equal(t, 7, stm.KeepAlives())
+	require.Nil(t, stm.FetchElementTimeout(time.Millisecond*10))
+	require.False(t, stm.IsDisconnected())
+	require.Equal(t, int64(7), x.Stats().Counter("ping/keepalives", "keepalives").Value())
+	require.Equal(t, int64(0), x.Stats().Counter("ping/sent", "pings").Value())
+
+	// ...disconnecting on write failure
+	stm.SetSendError(c2s.ErrStreamClosed)
+	clock.Advance(time.Second * 10)
+
+	err := stm.WaitDisconnection()
+	require.NotNil(t, err)
+	require.Equal(t, "connection-timeout", err.Error())
+	require.Equal(t, "Keepalive write failed", stm.TerminationText())
+}
+
+func TestXEP0199_PongSender(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	j2, _ := xml.NewJID("ortuman", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("juliet", "jackal.im", "balcony", true)
+
+	newPinged := func(cfg *config.ModPing) (*XEPPing, *c2s.MockStream, *fakePingClock, xml.Element) {
+		stm := c2s.NewMockStream("abcd", j1)
+		clock := newFakePingClock()
+		x := NewXEPPing(cfg, stm)
+		x.clock = clock
+		x.StartPinging()
+		clock.Advance(time.Second * 10)
+		return x, stm, clock, stm.FetchElement()
+	}
+	pong := func(id string, from *xml.JID) *xml.IQ {
+		iq := xml.NewIQType(id, xml.ResultType)
+		iq.SetFromJID(from)
+		return iq
+	}
+
+	// pong from a different resource doesn't cancel the pending disconnection
+	x, stm, clock, ping := newPinged(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5})
+	defer x.Done()
+	x.ProcessIQ(pong(ping.ID(), j2))
+	x.ProcessIQ(pong(ping.ID(), j3))
+	x.ProcessIQ(xml.NewIQType(ping.ID(), xml.ResultType))
+	clock.Advance(time.Second * 5)
+	require.True(t, stm.IsDisconnected())
+
+	// bare JID matching accepts any account resource...
+	x, stm, clock, ping = newPinged(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5, MatchBareJID: true})
+	defer x.Done()
+	x.ProcessIQ(pong(ping.ID(), j2))
+	clock.Advance(time.Second * 5)
+	require.False(t, stm.IsDisconnected())
+
+	// ...but not other accounts
+	clock.Advance(time.Second * 5)
+	ping = stm.FetchElement()
+	x.ProcessIQ(pong(ping.ID(), j3))
+	clock.Advance(time.Second * 5)
+	require.True(t, stm.IsDisconnected())
+}
+
+func TestXEP0199_RTT(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+
+	stm := c2s.NewMockStream("abcd", j1)
+	clock := newFakePingClock()
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10, SendTimeout: 5}, stm)
+	x.clock = clock
+	defer x.Done()
+
+	sample := func(name string) int64 {
+		m, ok := x.Stats().Sample(name)
+		require.True(t, ok, name)
+		return m.Value
+	}
+	pong := func(id string) {
+		iq := xml.NewIQType(id, xml.ResultType)
+		iq.SetFromJID(j1)
+		x.ProcessIQ(iq)
+	}
+	require.Equal(t, time.Duration(0), x.LastRTT())
+	require.Equal(t, int64(0), sample("ping/sent"))
+
+	x.StartPinging()
+
+	clock.Advance(time.Second * 10)
+	ping := stm.FetchElement()
+	clock.Advance(time.Second * 2)
+	pong(ping.ID())
+	require.Equal(t, time.Second*2, x.LastRTT())
+	require.Equal(t, time.Second*2, x.AverageRTT())
+
+	clock.Advance(time.Second * 8)
+	ping = stm.FetchElement()
+	clock.Advance(time.Second * 4)
+	pong(ping.ID())
+	require.Equal(t, time.Second*4, x.LastRTT())
+	require.Equal(t, time.Millisecond*2250, x.AverageRTT())
+
+	require.Equal(t, int64(2), sample("ping/sent"))
+	require.Equal(t, int64(2), sample("ping/pongs"))
+	require.Equal(t, int64(0), sample("ping/timeouts"))
+	require.Equal(t, int64(4000), sample("ping/rtt/last"))
+	require.Equal(t, int64(2250), sample("ping/rtt/average"))
+
+	// unanswered ping
+	clock.Advance(time.Second * 6)
+	require.NotNil(t, stm.FetchElement())
+	clock.Advance(time.Second * 5)
+	require.True(t, stm.IsDisconnected())
+	require.Equal(t, int64(3), sample("ping/sent"))
+	require.Equal(t, int64(1), sample("ping/timeouts"))
+
+	// activity
+	x2 := NewXEPPing(&config.ModPing{Send: true, SendInterval: 10}, stm)
+	x2.clock = clock
+	defer x2.Done()
+	require.True(t, x2.LastActivity().IsZero())
+	x2.ResetDeadline()
+	require.Equal(t, clock.Now(), x2.LastActivity())
+}
+
+func TestXEP0199_Jitter(t *testing.T) {
+	t.Parallel()
+	j1, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j1)
+
+	x := NewXEPPing(&config.ModPing{Send: true, SendInterval: 100}, stm)
+	defer x.Done()
+	require.Equal(t, time.Second*100, x.sendInterval())
+
+	x = NewXEPPing(&config.ModPing{Send: true, SendInterval: 100, Jitter: 0.1}, stm)
+	defer x.Done()
+
+	var spread bool
+	for i := 0; i < 1000; i++ {
+		d := x.sendInterval()
+		require.True(t, d >= time.Second*90 && d <= time.Second*110, d)
+		if d != time.Second*100 {
+			spread = true
+		}
+	}
+	require.True(t, spread)
+}
+
+func TestXEP0199_ServerStream(t *testing.T) {
+	t.Parallel()
+	remote, _ := xml.NewJID("", "jabber.org", "", true)
+
+	stm := newMockServerStream(remote)
+	clock := newFakePingClock()
+	x := NewXEPServerPing(&config.ModPing{SendInterval: 60, S2S: config.ModPingS2S{Send: true, SendInterval: 10, SendTimeout: 5}}, stm)
+	x.clock = clock
+	defer x.Done()
+
+	x.StartPinging()
+
+	// pings are addressed to remote domain...
+	clock.Advance(time.Second * 10)
+	ping := <-stm.elemCh
+	require.NotNil(t, ping.FindElementNamespace("ping", pingNamespace))
+	require.Equal(t, "jabber.org", ping.To())
+
+	// ...answered by remote domain only
+	other, _ := xml.NewJID("", "jabber.net", "", true)
+	pong := xml.NewIQType(ping.ID(), xml.ResultType)
+	pong.SetFromJID(other)
+	x.ProcessIQ(pong)
+	require.True(t, x.MatchesIQ(pong))
+
+	pong.SetFromJID(remote)
+	x.ProcessIQ(pong)
+	require.False(t, x.MatchesIQ(pong))
+
+	// accounts are never answered for
+	to, _ := xml.NewJID("ortuman", "jabber.org", "", true)
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(remote)
+	iq.SetToJID(to)
+	iq.AppendElement(xml.NewElementNamespace("ping", pingNamespace))
+	x.ProcessIQ(iq)
+	require.Equal(t, xml.ErrForbidden.Error(), (<-stm.elemCh).Error().Elements()[0].Name())
+
+	// unanswered ping disconnects
+	clock.Advance(time.Second * 10)
+	require.NotNil(t, (<-stm.elemCh).FindElementNamespace("ping", pingNamespace))
+	clock.Advance(time.Second * 5)
+
+	err := <-stm.discCh
+	require.NotNil(t, err)
+	require.Equal(t, "connection-timeout", err.Error())
+}
+
+// mockServerStream is a minimal server-to-server stream,
+// identified by remote domain.
+type mockServerStream struct {
+	jid    *xml.JID
+	elemCh chan xml.Element
+	discCh chan error
+}
+
+func newMockServerStream(jid *xml.JID) *mockServerStream {
+	return &mockServerStream{
+		jid:    jid,
+		elemCh: make(chan xml.Element, 16),
+		discCh: make(chan error, 1),
+	}
+}
+
+func (s *mockServerStream) JID() *xml.JID                   { return s.jid }
+func (s *mockServerStream) SendElement(element xml.Element) { s.elemCh <- element }
+func (s *mockServerStream) Disconnect(err error)            { s.discCh <- err }
+
+// fakePingClock is a manually advanced ping clock.
+type fakePingClock struct {
+	mu     sync.Mutex
+	now    time.Time
+	timers []*fakePingTimer
+}
+
+type fakePingTimer struct {
+	c      *fakePingClock
+	at     time.Time
+	f      func()
+	active bool
+}
+
+func newFakePingClock() *fakePingClock {
+	return &fakePingClock{now: time.Unix(1530000000, 0)}
+}
+
+func (c *fakePingClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakePingClock) AfterFunc(d time.Duration, f func()) pingTimer {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	t := &fakePingTimer{c: c, at: c.now.Add(d), f: f, active: true}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Advance moves the clock forward, running every expired timer function.
+// Functions that schedule new timers get them fired within the same call
+// whenever they expire before the target time.
+func (c *fakePingClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	target := c.now.Add(d)
+	c.mu.Unlock()
+	for {
+		c.mu.Lock()
+		var next *fakePingTimer
+		for _, t := range c.timers {
+			if t.active && !t.at.After(target) && (next == nil || t.at.Before(next.at)) {
+				next = t
+			}
+		}
+		if next == nil {
+			c.now = target
+			c.mu.Unlock()
+			return
+		}
+		next.active = false
+		if next.at.After(c.now) {
+			c.now = next.at
+		}
+		c.mu.Unlock()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			next.f()
+		}()
+		// let timer function run until it blocks or returns
+		select {
+		case <-done:
+		case <-time.After(time.Millisecond * 50):
+		}
+	}
+}
+
+// Pending returns the number of active timers.
+func (c *fakePingClock) Pending() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var n int
+	for _, t := range c.timers {
+		if t.active {
+			n++
+		}
+	}
+	return n
+}
+
+func (t *fakePingTimer) Stop() bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := t.active
+	t.active = false
+	return wasActive
+}
+
+func (t *fakePingTimer) Reset(d time.Duration) bool {
+	t.c.mu.Lock()
+	defer t.c.mu.Unlock()
+	wasActive := t.active
+	t.at = t.c.now.Add(d)
+	t.active = true
+	return wasActive
 }
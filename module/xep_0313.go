@@ -0,0 +1,420 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/ortuman/jackal/xmpputil/timefmt"
+	"github.com/pborman/uuid"
+)
+
+const (
+	mamNamespace   = "urn:xmpp:mam:2"
+	rsmNamespace   = "http://jabber.org/protocol/rsm"
+	hintsNamespace = "urn:xmpp:hints"
+)
+
+const defaultMAMPageSize = 50
+
+// archiving preferences default modes
+const (
+	mamAlways = "always"
+	mamRoster = "roster"
+	mamNever  = "never"
+)
+
+var errMAMMalformedQuery = errors.New("malformed archive query")
+
+// XEPMessageArchive represents a message archive management
+// server stream module (https://xmpp.org/extensions/xep-0313.html).
+//
+// Messages with a body sent by the stream user are archived on behalf of
+// the user, as well as on behalf of their local recipient, according to
+// every party archiving preferences. Only the default archiving mode
+// preference is supported, always and never JID lists being ignored.
+type XEPMessageArchive struct {
+	cfg   *config.ModMAM
+	strm  c2s.Stream
+	now   func() time.Time
+	actor *actor
+}
+
+// NewXEPMessageArchive returns a message archive management IQ handler module.
+func NewXEPMessageArchive(config *config.ModMAM, strm c2s.Stream) *XEPMessageArchive {
+	return &XEPMessageArchive{
+		cfg:   config,
+		strm:  strm,
+		now:   time.Now,
+		actor: newActor(nil),
+	}
+}
+
+// AssociatedNamespaces returns namespaces associated
+// with message archive management module.
+func (x *XEPMessageArchive) AssociatedNamespaces() []string {
+	return []string{mamNamespace}
+}
+
+// Priority returns message archive management module priority,
+// so that messages are archived once every other interceptor is done.
+func (x *XEPMessageArchive) Priority() int {
+	return LowPriority
+}
+
+// Done signals stream termination.
+func (x *XEPMessageArchive) Done() {
+	x.actor.done()
+}
+
+// InterceptMessage archives every archivable message sent
+// by the stream user, never consuming it.
+func (x *XEPMessageArchive) InterceptMessage(message *xml.Message) bool {
+	if isArchivableMessage(message) {
+		x.archive(x.strm.Username(), message.ToJID(), message)
+	}
+	return false
+}
+
+// ArchiveIncoming archives a message sent by the stream user into
+// its local recipient archive, once it's been delivered or stored offline.
+func (x *XEPMessageArchive) ArchiveIncoming(message *xml.Message) {
+	toJid, fromJid := message.ToJID(), message.FromJID()
+	if len(toJid.Node()) == 0 || !isArchivableMessage(message) {
+		return
+	}
+	if toJid.Node() == fromJid.Node() && toJid.Domain() == fromJid.Domain() {
+		return // already archived as sent
+	}
+	x.archive(toJid.Node(), fromJid, message)
+}
+
+// MatchesIQ returns whether or not an IQ should be
+// processed by the message archive management module.
+func (x *XEPMessageArchive) MatchesIQ(iq *xml.IQ) bool {
+	return iq.FindElementNamespace("query", mamNamespace) != nil || iq.FindElementNamespace("prefs", mamNamespace) != nil
+}
+
+// ProcessIQ processes a message archive management IQ
+// taking according actions over the associated stream.
+func (x *XEPMessageArchive) ProcessIQ(iq *xml.IQ) {
+	toJid := iq.ToJID()
+	if !toJid.IsServer() && (toJid.Node() != x.strm.Username() || toJid.Domain() != x.strm.Domain()) {
+		x.strm.SendElement(iq.ForbiddenError())
+		return
+	}
+	x.actor.run(func() {
+		if q := iq.FindElementNamespace("query", mamNamespace); q != nil {
+			switch {
+			case iq.IsGet():
+				x.sendQueryForm(iq)
+			case iq.IsSet():
+				x.query(iq, q)
+			default:
+				x.strm.SendElement(iq.BadRequestError())
+			}
+			return
+		}
+		prefs := iq.FindElementNamespace("prefs", mamNamespace)
+		switch {
+		case iq.IsGet():
+			x.sendPrefs(iq)
+		case iq.IsSet():
+			if !c2s.Instance().GuardSession(x.strm, func() { x.setPrefs(iq, prefs) }) {
+				x.strm.SendElement(iq.NotAuthorizedError())
+			}
+		default:
+			x.strm.SendElement(iq.BadRequestError())
+		}
+	})
+}
+
+func (x *XEPMessageArchive) archive(owner string, with *xml.JID, message *xml.Message) {
+	am := &model.ArchivedMessage{
+		Username:     owner,
+		With:         with.ToBareJID().String(),
+		WithResource: with.Resource(),
+		Stamp:        x.now(),
+		Message:      xml.NewElementFromElement(message),
+	}
+	x.actor.run(func() {
+		ctx, cancel := storage.QueryContext()
+		defer cancel()
+
+		ok, err := x.isArchivingEnabled(ctx, owner, am.With)
+		if err != nil {
+			log.Error(err)
+			return
+		}
+		if !ok {
+			return
+		}
+		if err := storage.Instance().InsertArchivedMessage(ctx, am); err != nil {
+			log.Error(err)
+		}
+	})
+}
+
+// isArchivingEnabled returns whether or not messages exchanged
+// with a bare JID are archived according to owner preferences.
+func (x *XEPMessageArchive) isArchivingEnabled(ctx context.Context, owner, with string) (bool, error) {
+	mode, err := x.defaultMode(ctx, owner)
+	if err != nil {
+		return false, err
+	}
+	switch mode {
+	case mamNever:
+		return false, nil
+	case mamRoster:
+		ri, err := storage.Instance().FetchRosterItem(ctx, owner, with)
+		if err != nil {
+			return false, err
+		}
+		return ri != nil, nil
+	default:
+		return true, nil
+	}
+}
+
+func (x *XEPMessageArchive) defaultMode(ctx context.Context, owner string) (string, error) {
+	prefs, err := storage.Instance().FetchArchivePrefs(ctx, owner)
+	if err != nil {
+		return "", err
+	}
+	if prefs != nil {
+		return prefs.Default, nil
+	}
+	if len(x.cfg.Default) > 0 {
+		return x.cfg.Default, nil
+	}
+	return mamAlways, nil
+}
+
+func (x *XEPMessageArchive) sendQueryForm(iq *xml.IQ) {
+	form := xml.NewElementNamespace("x", dataFormNamespace)
+	form.SetAttribute("type", "form")
+	formType := xml.NewElementName("field")
+	formType.SetAttribute("var", "FORM_TYPE")
+	formType.SetAttribute("type", "hidden")
+	value := xml.NewElementName("value")
+	value.SetText(mamNamespace)
+	formType.AppendElement(value)
+	form.AppendElement(formType)
+	for _, f := range []struct{ vr, typ string }{{"with", "jid-single"}, {"start", "text-single"}, {"end", "text-single"}} {
+		field := xml.NewElementName("field")
+		field.SetAttribute("var", f.vr)
+		field.SetAttribute("type", f.typ)
+		form.AppendElement(field)
+	}
+	q := xml.NewElementNamespace("query", mamNamespace)
+	q.AppendElement(form)
+
+	result := iq.ResultIQ()
+	result.AppendElement(q)
+	x.strm.SendElement(result)
+}
+
+func (x *XEPMessageArchive) query(iq *xml.IQ, q xml.Element) {
+	filter, err := x.queryFilter(q)
+	if err != nil {
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	// look up one more message, telling whether or not the page is complete
+	pageSize := filter.Max
+	filter.Max++
+	messages, err := storage.Instance().FetchArchivedMessages(ctx, x.strm.Username(), filter)
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	complete := len(messages) <= pageSize
+	if !complete {
+		if filter.Last {
+			messages = messages[1:]
+		} else {
+			messages = messages[:pageSize]
+		}
+	}
+	queryID := q.Attribute("queryid")
+	for _, m := range messages {
+		x.strm.SendElement(x.resultMessage(queryID, m))
+	}
+	set := xml.NewElementNamespace("set", rsmNamespace)
+	if len(messages) > 0 {
+		first := xml.NewElementName("first")
+		first.SetText(messages[0].ID)
+		last := xml.NewElementName("last")
+		last.SetText(messages[len(messages)-1].ID)
+		set.AppendElements([]xml.Element{first, last})
+	}
+	fin := xml.NewElementNamespace("fin", mamNamespace)
+	if complete {
+		fin.SetAttribute("complete", "true")
+	}
+	fin.AppendElement(set)
+
+	result := iq.ResultIQ()
+	result.AppendElement(fin)
+	x.strm.SendElement(result)
+}
+
+// queryFilter returns the archive filter described by a query
+// data form along with its result set management paging request.
+func (x *XEPMessageArchive) queryFilter(q xml.Element) (*storage.ArchiveFilter, error) {
+	maxPageSize := x.cfg.MaxPageSize
+	if maxPageSize <= 0 {
+		maxPageSize = defaultMAMPageSize
+	}
+	filter := &storage.ArchiveFilter{Max: maxPageSize}
+
+	if form := q.FindElementNamespace("x", dataFormNamespace); form != nil {
+		for _, field := range form.FindElements("field") {
+			var value string
+			if v := field.FindElement("value"); v != nil {
+				value = v.Text()
+			}
+			switch field.Attribute("var") {
+			case "FORM_TYPE":
+				if value != mamNamespace {
+					return nil, errMAMMalformedQuery
+				}
+			case "with":
+				with, err := xml.NewJIDString(value, false)
+				if err != nil {
+					return nil, err
+				}
+				filter.With = with.ToBareJID().String()
+				filter.WithResource = with.Resource()
+			case "start", "end":
+				t, err := timefmt.Parse(value)
+				if err != nil {
+					return nil, err
+				}
+				if field.Attribute("var") == "start" {
+					filter.Start = t
+				} else {
+					filter.End = t
+				}
+			default:
+				return nil, errMAMMalformedQuery
+			}
+		}
+	}
+	if set := q.FindElementNamespace("set", rsmNamespace); set != nil {
+		if max := set.FindElement("max"); max != nil {
+			n, err := strconv.Atoi(max.Text())
+			if err != nil || n < 0 {
+				return nil, errMAMMalformedQuery
+			}
+			if n < filter.Max {
+				filter.Max = n
+			}
+		}
+		if after := set.FindElement("after"); after != nil {
+			filter.AfterID = after.Text()
+		}
+		if before := set.FindElement("before"); before != nil {
+			// an empty before element requests the last page
+			filter.BeforeID = before.Text()
+			filter.Last = true
+		}
+	}
+	return filter, nil
+}
+
+func (x *XEPMessageArchive) resultMessage(queryID string, m model.ArchivedMessage) xml.Element {
+	delay := xml.NewElementNamespace("delay", delayNamespace)
+	delay.SetAttribute("stamp", timefmt.Format(m.Stamp))
+	fwd := xml.NewElementNamespace("forwarded", forwardNamespace)
+	fwd.AppendElement(delay)
+	fwd.AppendElement(m.Message)
+
+	res := xml.NewElementNamespace("result", mamNamespace)
+	if len(queryID) > 0 {
+		res.SetAttribute("queryid", queryID)
+	}
+	res.SetAttribute("id", m.ID)
+	res.AppendElement(fwd)
+
+	msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+	msg.SetFromJID(x.strm.JID().ToBareJID())
+	msg.SetToJID(x.strm.JID())
+	msg.AppendElement(res)
+	return msg
+}
+
+func (x *XEPMessageArchive) sendPrefs(iq *xml.IQ) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	mode, err := x.defaultMode(ctx, x.strm.Username())
+	if err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	result := iq.ResultIQ()
+	result.AppendElement(x.prefsElement(mode))
+	x.strm.SendElement(result)
+}
+
+func (x *XEPMessageArchive) setPrefs(iq *xml.IQ, prefs xml.Element) {
+	mode := prefs.Attribute("default")
+	switch mode {
+	case mamAlways, mamRoster, mamNever:
+		break
+	default:
+		x.strm.SendElement(iq.BadRequestError())
+		return
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	if err := storage.Instance().InsertOrUpdateArchivePrefs(ctx, &model.ArchivePrefs{Username: x.strm.Username(), Default: mode}); err != nil {
+		log.Error(err)
+		x.strm.SendElement(iq.InternalServerError())
+		return
+	}
+	log.Infof("updated archiving preferences... (%s/%s): %s", x.strm.Username(), x.strm.Resource(), mode)
+
+	result := iq.ResultIQ()
+	result.AppendElement(x.prefsElement(mode))
+	x.strm.SendElement(result)
+}
+
+func (x *XEPMessageArchive) prefsElement(mode string) xml.Element {
+	prefs := xml.NewElementNamespace("prefs", mamNamespace)
+	prefs.SetAttribute("default", mode)
+	prefs.AppendElement(xml.NewElementName("always"))
+	prefs.AppendElement(xml.NewElementName("never"))
+	return prefs
+}
+
+// isArchivableMessage returns whether or not a message is
+// worth archiving, that is, a non group chat message with a body
+// not hinted to be kept away from permanent storage
+// (https://xmpp.org/extensions/xep-0334.html).
+func isArchivableMessage(message *xml.Message) bool {
+	if !message.IsMessageWithBody() || message.IsGroupChat() || message.IsError() {
+		return false
+	}
+	return message.FindElementNamespace("no-store", hintsNamespace) == nil &&
+		message.FindElementNamespace("no-permanent-store", hintsNamespace) == nil
+}
@@ -0,0 +1,320 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package module
+
+import (
+	"context"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestXEP0313_Matching(t *testing.T) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	x := NewXEPMessageArchive(&config.ModMAM{}, c2s.NewMockStream("abcd", j))
+	defer x.Done()
+
+	require.Equal(t, []string{mamNamespace}, x.AssociatedNamespaces())
+	require.Equal(t, LowPriority, x.Priority())
+
+	require.True(t, x.MatchesIQ(tUtilMAMQueryIQ(xml.SetType, "", nil)))
+	require.True(t, x.MatchesIQ(tUtilMAMPrefsIQ(xml.GetType, "")))
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", discoInfoNamespace))
+	require.False(t, x.MatchesIQ(iq))
+}
+
+func TestXEP0313_Archiving(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	stm, x := tUtilMAMSetup(&config.ModMAM{})
+	defer x.Done()
+
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+
+	msg := tUtilMAMMessage("a", stm.JID(), j2)
+	require.False(t, x.InterceptMessage(msg))
+	x.ArchiveIncoming(msg)
+
+	// not archivable messages
+	groupChat := tUtilMAMMessage("b", stm.JID(), j2)
+	groupChat.SetType(xml.GroupChatType)
+	noBody := xml.NewMessageType("c", xml.ChatType)
+	noBody.SetFromJID(stm.JID())
+	noBody.SetToJID(j2)
+	noStore := tUtilMAMMessage("d", stm.JID(), j2)
+	noStore.AppendElement(xml.NewElementNamespace("no-store", hintsNamespace))
+	for _, m := range []*xml.Message{groupChat, noBody, noStore} {
+		require.False(t, x.InterceptMessage(m))
+		x.ArchiveIncoming(m)
+	}
+	tUtilMAMSync(t, stm, x)
+
+	msgs, _ := storage.Instance().FetchArchivedMessages(context.Background(), "ortuman", &storage.ArchiveFilter{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "a", msgs[0].Message.ID())
+	require.Equal(t, "juliet@jackal.im", msgs[0].With)
+	require.Equal(t, "garden", msgs[0].WithResource)
+
+	msgs, _ = storage.Instance().FetchArchivedMessages(context.Background(), "juliet", &storage.ArchiveFilter{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "a", msgs[0].Message.ID())
+	require.Equal(t, "ortuman@jackal.im", msgs[0].With)
+	require.Equal(t, "balcony", msgs[0].WithResource)
+
+	// messages sent to own account are archived once
+	self := tUtilMAMMessage("e", stm.JID(), stm.JID().ToBareJID())
+	x.InterceptMessage(self)
+	x.ArchiveIncoming(self)
+	tUtilMAMSync(t, stm, x)
+
+	msgs, _ = storage.Instance().FetchArchivedMessages(context.Background(), "ortuman", &storage.ArchiveFilter{With: "ortuman@jackal.im"})
+	require.Equal(t, 1, len(msgs))
+}
+
+func TestXEP0313_Preferences(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
+
+	stm, x := tUtilMAMSetup(&config.ModMAM{Default: "roster"})
+	defer x.Done()
+
+	x.ProcessIQ(tUtilMAMPrefsIQ(xml.GetType, ""))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, "roster", elem.FindElementNamespace("prefs", mamNamespace).Attribute("default"))
+
+	// only roster contacts get archived
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("romeo", "jackal.im", "orchard", true)
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{
+		User:         "ortuman",
+		Contact:      "juliet@jackal.im",
+		Subscription: "both",
+	})
+	x.InterceptMessage(tUtilMAMMessage("a", stm.JID(), j2))
+	x.InterceptMessage(tUtilMAMMessage("b", stm.JID(), j3))
+	tUtilMAMSync(t, stm, x)
+
+	msgs, _ := storage.Instance().FetchArchivedMessages(context.Background(), "ortuman", &storage.ArchiveFilter{})
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "a", msgs[0].Message.ID())
+
+	x.ProcessIQ(tUtilMAMPrefsIQ(xml.SetType, "sometimes"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilMAMPrefsIQ(xml.SetType, "never"))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.Equal(t, "never", elem.FindElementNamespace("prefs", mamNamespace).Attribute("default"))
+
+	x.InterceptMessage(tUtilMAMMessage("c", stm.JID(), j2))
+	tUtilMAMSync(t, stm, x)
+
+	msgs, _ = storage.Instance().FetchArchivedMessages(context.Background(), "ortuman", &storage.ArchiveFilter{})
+	require.Equal(t, 1, len(msgs))
+
+	prefs, _ := storage.Instance().FetchArchivePrefs(context.Background(), "ortuman")
+	require.Equal(t, &model.ArchivePrefs{Username: "ortuman", Default: "never"}, prefs)
+}
+
+func TestXEP0313_Query(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	stm, x := tUtilMAMSetup(&config.ModMAM{MaxPageSize: 3})
+	defer x.Done()
+
+	start := time.Date(2018, time.July, 1, 12, 0, 0, 0, time.UTC)
+	x.now = func() time.Time { return start }
+
+	j2, _ := xml.NewJID("juliet", "jackal.im", "garden", true)
+	j3, _ := xml.NewJID("romeo", "jackal.im", "orchard", true)
+	for i := 0; i < 5; i++ {
+		x.InterceptMessage(tUtilMAMMessage(strconv.Itoa(i), stm.JID(), j2))
+	}
+	x.InterceptMessage(tUtilMAMMessage("5", stm.JID(), j3))
+
+	// first page is bound by configured page size
+	x.ProcessIQ(tUtilMAMQueryIQ(xml.SetType, "q1", map[string]string{"with": "juliet@jackal.im"}))
+	ids := tUtilMAMFetchResults(t, stm, "q1", 3)
+	require.Equal(t, []string{"0", "1", "2"}, ids.messages)
+	require.False(t, ids.complete)
+
+	// next page
+	iq := tUtilMAMQueryIQ(xml.SetType, "q2", map[string]string{"with": "juliet@jackal.im"})
+	tUtilMAMSetRSM(iq, "10", "after", ids.last)
+	x.ProcessIQ(iq)
+	ids2 := tUtilMAMFetchResults(t, stm, "q2", 2)
+	require.Equal(t, []string{"3", "4"}, ids2.messages)
+	require.True(t, ids2.complete)
+
+	// last page
+	iq = tUtilMAMQueryIQ(xml.SetType, "q3", nil)
+	tUtilMAMSetRSM(iq, "2", "before", "")
+	x.ProcessIQ(iq)
+	ids3 := tUtilMAMFetchResults(t, stm, "q3", 2)
+	require.Equal(t, []string{"4", "5"}, ids3.messages)
+	require.False(t, ids3.complete)
+
+	// time bounds
+	x.ProcessIQ(tUtilMAMQueryIQ(xml.SetType, "q4", map[string]string{"start": "2018-07-01T12:00:01Z"}))
+	ids4 := tUtilMAMFetchResults(t, stm, "q4", 0)
+	require.True(t, ids4.complete)
+
+	// malformed queries
+	x.ProcessIQ(tUtilMAMQueryIQ(xml.SetType, "q5", map[string]string{"start": "yesterday"}))
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	x.ProcessIQ(tUtilMAMQueryIQ(xml.SetType, "q6", map[string]string{"subject": "hi"}))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrBadRequest.Error(), elem.Error().Elements()[0].Name())
+
+	// query form
+	x.ProcessIQ(tUtilMAMQueryIQ(xml.GetType, "", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	require.NotNil(t, elem.FindElementNamespace("query", mamNamespace).FindElementNamespace("x", dataFormNamespace))
+
+	// storage failure
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	x.ProcessIQ(tUtilMAMQueryIQ(xml.SetType, "q7", nil))
+	elem = stm.FetchElement()
+	require.Equal(t, xml.ErrInternalServerError.Error(), elem.Error().Elements()[0].Name())
+}
+
+func TestXEP0313_Forbidden(t *testing.T) {
+	stm, x := tUtilMAMSetup(&config.ModMAM{})
+	defer x.Done()
+
+	j2, _ := xml.NewJID("juliet", "jackal.im", "", true)
+	iq := tUtilMAMQueryIQ(xml.SetType, "", nil)
+	iq.SetToJID(j2)
+	x.ProcessIQ(iq)
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ErrForbidden.Error(), elem.Error().Elements()[0].Name())
+}
+
+type tUtilMAMResults struct {
+	messages []string
+	last     string
+	complete bool
+}
+
+func tUtilMAMFetchResults(t *testing.T, stm *c2s.MockStream, queryID string, count int) tUtilMAMResults {
+	var ret tUtilMAMResults
+	for i := 0; i < count; i++ {
+		elem := stm.FetchElement()
+		require.Equal(t, "message", elem.Name())
+		res := elem.FindElementNamespace("result", mamNamespace)
+		require.NotNil(t, res)
+		require.Equal(t, queryID, res.Attribute("queryid"))
+		fwd := res.FindElementNamespace("forwarded", forwardNamespace)
+		require.NotNil(t, fwd.FindElementNamespace("delay", delayNamespace))
+		ret.messages = append(ret.messages, fwd.FindElement("message").ID())
+		ret.last = res.Attribute("id")
+	}
+	elem := stm.FetchElement()
+	require.Equal(t, xml.ResultType, elem.Type())
+	fin := elem.FindElementNamespace("fin", mamNamespace)
+	require.NotNil(t, fin)
+	if count > 0 {
+		require.Equal(t, ret.last, fin.FindElementNamespace("set", rsmNamespace).FindElement("last").Text())
+	}
+	ret.complete = fin.Attribute("complete") == "true"
+	return ret
+}
+
+// tUtilMAMSync waits for every pending archiving task to be done.
+func tUtilMAMSync(t *testing.T, stm *c2s.MockStream, x *XEPMessageArchive) {
+	x.ProcessIQ(tUtilMAMPrefsIQ(xml.GetType, ""))
+	require.Equal(t, xml.ResultType, stm.FetchElement().Type())
+}
+
+func tUtilMAMSetup(cfg *config.ModMAM) (*c2s.MockStream, *XEPMessageArchive) {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "balcony", true)
+	stm := c2s.NewMockStream("abcd", j)
+	stm.SetDomain("jackal.im")
+	return stm, NewXEPMessageArchive(cfg, stm)
+}
+
+func tUtilMAMMessage(id string, from, to *xml.JID) *xml.Message {
+	msg := xml.NewMessageType(id, xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	body := xml.NewElementName("body")
+	body.SetText("hi!")
+	msg.AppendElement(body)
+	return msg
+}
+
+func tUtilMAMQueryIQ(typ, queryID string, fields map[string]string) *xml.IQ {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "", true)
+	iq := xml.NewIQType(uuid.New(), typ)
+	iq.SetToJID(j)
+	q := xml.NewElementNamespace("query", mamNamespace)
+	if len(queryID) > 0 {
+		q.SetAttribute("queryid", queryID)
+	}
+	if len(fields) > 0 {
+		form := xml.NewElementNamespace("x", dataFormNamespace)
+		form.SetAttribute("type", "submit")
+		fields["FORM_TYPE"] = mamNamespace
+		for vr, value := range fields {
+			field := xml.NewElementName("field")
+			field.SetAttribute("var", vr)
+			v := xml.NewElementName("value")
+			v.SetText(value)
+			field.AppendElement(v)
+			form.AppendElement(field)
+		}
+		q.AppendElement(form)
+	}
+	iq.AppendElement(q)
+	return iq
+}
+
+func tUtilMAMSetRSM(iq *xml.IQ, max, bound, id string) {
+	set := xml.NewElementNamespace("set", rsmNamespace)
+	maxEl := xml.NewElementName("max")
+	maxEl.SetText(max)
+	boundEl := xml.NewElementName(bound)
+	boundEl.SetText(id)
+	set.AppendElements([]xml.Element{maxEl, boundEl})
+
+	q := xml.NewElementFromElement(iq.FindElementNamespace("query", mamNamespace))
+	q.AppendElement(set)
+	iq.ClearElements()
+	iq.AppendElement(q)
+}
+
+func tUtilMAMPrefsIQ(typ, mode string) *xml.IQ {
+	j, _ := xml.NewJID("ortuman", "jackal.im", "", true)
+	iq := xml.NewIQType(uuid.New(), typ)
+	iq.SetToJID(j)
+	prefs := xml.NewElementNamespace("prefs", mamNamespace)
+	if len(mode) > 0 {
+		prefs.SetAttribute("default", mode)
+	}
+	iq.AppendElement(prefs)
+	return iq
+}
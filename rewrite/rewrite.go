@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package rewrite implements operator defined stanza rewriting
+// rules applied to stanzas crossing stream boundaries.
+//
+// Rules are evaluated in order, every one of them seeing the stanza as
+// left by the previous ones, until a rule bounces the whole stanza.
+// Every rule counts its hits in the default statistics registry
+// under 'rewrite/hits/<rule name>'.
+package rewrite
+
+import (
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/xml"
+)
+
+type rule struct {
+	cfg  config.RewriteRule
+	hits *stats.Counter
+}
+
+func (r *rule) matches(stanza xml.Element, dir config.RewriteDirection, domain string) bool {
+	if r.cfg.Direction != config.RewriteBoth && r.cfg.Direction != dir {
+		return false
+	}
+	if len(r.cfg.Domain) > 0 && r.cfg.Domain != domain {
+		return false
+	}
+	if len(r.cfg.Stanza) > 0 && r.cfg.Stanza != stanza.Name() {
+		return false
+	}
+	for _, elem := range stanza.Elements() {
+		if elem.Namespace() == r.cfg.Namespace {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *rule) apply(stanza xml.Element) xml.Element {
+	elements := stanza.Elements()
+	rewritten := xml.NewElementFromElement(stanza)
+	rewritten.ClearElements()
+	for _, elem := range elements {
+		if elem.Namespace() != r.cfg.Namespace {
+			rewritten.AppendElement(elem)
+			continue
+		}
+		if r.cfg.Action == config.RewriteRename {
+			renamed := xml.NewElementFromElement(elem)
+			renamed.SetNamespace(r.cfg.RenameTo)
+			rewritten.AppendElement(renamed)
+		}
+	}
+	return rewritten
+}
+
+// Engine applies a set of rewrite rules.
+type Engine struct {
+	rules []rule
+}
+
+// New returns a rewrite engine applying rules in order.
+func New(rules []config.RewriteRule) *Engine {
+	e := &Engine{rules: make([]rule, len(rules))}
+	for i, r := range rules {
+		e.rules[i] = rule{
+			cfg:  r,
+			hits: stats.Default().Counter("rewrite/hits/"+r.Name, "stanzas"),
+		}
+	}
+	return e
+}
+
+// Apply rewrites a stanza travelling in dir direction and exchanged
+// with domain, returning the rewritten stanza. The second returned value
+// reports whether or not the stanza has to be dropped bouncing it back
+// to its sender, in which case the original stanza is returned.
+//
+// Stanzas not matched by any rule are returned untouched.
+func (e *Engine) Apply(stanza xml.Element, dir config.RewriteDirection, domain string) (xml.Element, bool) {
+	if e == nil {
+		return stanza, false
+	}
+	switch stanza.Name() {
+	case "message", "presence", "iq":
+		break
+	default:
+		return stanza, false
+	}
+	rewritten := stanza
+	for i := range e.rules {
+		r := &e.rules[i]
+		if !r.matches(rewritten, dir, domain) {
+			continue
+		}
+		r.hits.Inc()
+		if r.cfg.Action == config.RewriteBounce {
+			return stanza, true
+		}
+		rewritten = r.apply(rewritten)
+	}
+	return rewritten, false
+}
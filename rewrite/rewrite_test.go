@@ -0,0 +1,144 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package rewrite
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRewrite_Drop(t *testing.T) {
+	e := New([]config.RewriteRule{
+		{Name: "test_drop", Namespace: "urn:x", Action: config.RewriteDrop},
+	})
+	msg := tUtilRewriteMessage("urn:x", "urn:y")
+
+	rewritten, bounced := e.Apply(msg, config.RewriteOutbound, "jackal.im")
+	require.False(t, bounced)
+	require.Nil(t, rewritten.FindElementNamespace("ext", "urn:x"))
+	require.NotNil(t, rewritten.FindElementNamespace("ext", "urn:y"))
+	require.NotNil(t, rewritten.FindElement("body"))
+
+	// original stanza remains untouched
+	require.NotNil(t, msg.FindElementNamespace("ext", "urn:x"))
+	require.Equal(t, int64(1), stats.Default().Counter("rewrite/hits/test_drop", "stanzas").Value())
+}
+
+func TestRewrite_Rename(t *testing.T) {
+	e := New([]config.RewriteRule{
+		{Name: "test_rename", Namespace: "urn:x", Action: config.RewriteRename, RenameTo: "urn:z"},
+	})
+	rewritten, bounced := e.Apply(tUtilRewriteMessage("urn:x"), config.RewriteInbound, "jackal.im")
+	require.False(t, bounced)
+	require.Nil(t, rewritten.FindElementNamespace("ext", "urn:x"))
+	require.NotNil(t, rewritten.FindElementNamespace("ext", "urn:z"))
+	require.Equal(t, int64(1), stats.Default().Counter("rewrite/hits/test_rename", "stanzas").Value())
+}
+
+func TestRewrite_Bounce(t *testing.T) {
+	e := New([]config.RewriteRule{
+		{Name: "test_bounce", Namespace: "urn:x", Action: config.RewriteBounce},
+	})
+	msg := tUtilRewriteMessage("urn:x")
+	rewritten, bounced := e.Apply(msg, config.RewriteInbound, "jackal.im")
+	require.True(t, bounced)
+	require.Equal(t, msg, rewritten)
+	require.Equal(t, int64(1), stats.Default().Counter("rewrite/hits/test_bounce", "stanzas").Value())
+}
+
+func TestRewrite_Match(t *testing.T) {
+	e := New([]config.RewriteRule{{
+		Name:      "test_match",
+		Direction: config.RewriteOutbound,
+		Domain:    "legacy.org",
+		Stanza:    "message",
+		Namespace: "urn:x",
+		Action:    config.RewriteDrop,
+	}})
+	msg := tUtilRewriteMessage("urn:x")
+
+	// direction mismatch
+	rewritten, _ := e.Apply(msg, config.RewriteInbound, "legacy.org")
+	require.Equal(t, msg, rewritten)
+
+	// domain mismatch
+	rewritten, _ = e.Apply(msg, config.RewriteOutbound, "jackal.im")
+	require.Equal(t, msg, rewritten)
+
+	// stanza mismatch
+	presence := xml.NewElementName("presence")
+	presence.AppendElement(xml.NewElementNamespace("ext", "urn:x"))
+	rewritten, _ = e.Apply(presence, config.RewriteOutbound, "legacy.org")
+	require.Equal(t, presence, rewritten)
+
+	// namespace mismatch
+	other := tUtilRewriteMessage("urn:y")
+	rewritten, _ = e.Apply(other, config.RewriteOutbound, "legacy.org")
+	require.Equal(t, other, rewritten)
+
+	// non stanza elements
+	elem := xml.NewElementName("a")
+	elem.AppendElement(xml.NewElementNamespace("ext", "urn:x"))
+	rewritten, _ = e.Apply(elem, config.RewriteOutbound, "legacy.org")
+	require.Equal(t, elem, rewritten)
+
+	require.Equal(t, int64(0), stats.Default().Counter("rewrite/hits/test_match", "stanzas").Value())
+
+	rewritten, _ = e.Apply(msg, config.RewriteOutbound, "legacy.org")
+	require.Nil(t, rewritten.FindElementNamespace("ext", "urn:x"))
+	require.Equal(t, int64(1), stats.Default().Counter("rewrite/hits/test_match", "stanzas").Value())
+
+	// nil engine
+	var nilEngine *Engine
+	rewritten, bounced := nilEngine.Apply(msg, config.RewriteOutbound, "legacy.org")
+	require.False(t, bounced)
+	require.Equal(t, msg, rewritten)
+}
+
+func TestRewrite_Ordering(t *testing.T) {
+	// renamed elements are seen by subsequent rules...
+	e := New([]config.RewriteRule{
+		{Name: "test_order_rename", Namespace: "urn:x", Action: config.RewriteRename, RenameTo: "urn:y"},
+		{Name: "test_order_bounce", Namespace: "urn:y", Action: config.RewriteBounce},
+	})
+	_, bounced := e.Apply(tUtilRewriteMessage("urn:x"), config.RewriteInbound, "jackal.im")
+	require.True(t, bounced)
+
+	// ...while dropped ones are not
+	e = New([]config.RewriteRule{
+		{Name: "test_order_drop", Namespace: "urn:y", Action: config.RewriteDrop},
+		{Name: "test_order_bounce", Namespace: "urn:y", Action: config.RewriteBounce},
+	})
+	rewritten, bounced := e.Apply(tUtilRewriteMessage("urn:y"), config.RewriteInbound, "jackal.im")
+	require.False(t, bounced)
+	require.Nil(t, rewritten.FindElementNamespace("ext", "urn:y"))
+
+	// bouncing rules stop evaluation
+	e = New([]config.RewriteRule{
+		{Name: "test_order_first", Namespace: "urn:x", Action: config.RewriteBounce},
+		{Name: "test_order_second", Namespace: "urn:x", Action: config.RewriteDrop},
+	})
+	_, bounced = e.Apply(tUtilRewriteMessage("urn:x"), config.RewriteInbound, "jackal.im")
+	require.True(t, bounced)
+	require.Equal(t, int64(1), stats.Default().Counter("rewrite/hits/test_order_first", "stanzas").Value())
+	require.Equal(t, int64(0), stats.Default().Counter("rewrite/hits/test_order_second", "stanzas").Value())
+}
+
+func tUtilRewriteMessage(namespaces ...string) xml.Element {
+	msg := xml.NewElementName("message")
+	msg.SetType(xml.ChatType)
+	body := xml.NewElementName("body")
+	body.SetText("Hi!")
+	msg.AppendElement(body)
+	for _, ns := range namespaces {
+		msg.AppendElement(xml.NewElementNamespace("ext", ns))
+	}
+	return msg
+}
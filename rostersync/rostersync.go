@@ -0,0 +1,318 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package rostersync
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+)
+
+const watcherBufferSize = 64
+
+const (
+	// SnapshotEventType represents a roster snapshot event type.
+	SnapshotEventType = "snapshot"
+
+	// UpdateEventType represents a roster item update event type.
+	UpdateEventType = "update"
+)
+
+// Item represents a roster item as emitted by the roster sync API.
+type Item struct {
+	Contact      string   `json:"contact"`
+	Name         string   `json:"name,omitempty"`
+	Subscription string   `json:"subscription"`
+	Ask          bool     `json:"ask,omitempty"`
+	Groups       []string `json:"groups,omitempty"`
+}
+
+// Event represents a roster sync event.
+// An update event carrying an item with 'remove' subscription
+// notifies the item has been deleted from the roster.
+type Event struct {
+	Type     string `json:"type"`
+	Username string `json:"username"`
+	Version  uint64 `json:"version"`
+	Items    []Item `json:"items"`
+}
+
+// singleton interface
+var (
+	inst        *Hub
+	instMu      sync.RWMutex
+	initialized uint32
+)
+
+// Hub dispatches roster mutation events to every subscribed watcher.
+type Hub struct {
+	cfg      *config.RosterSync
+	srv      *http.Server
+	mu       sync.Mutex
+	versions map[string]uint64
+	watchers map[string][]*Watcher
+}
+
+// Watcher represents a roster mutations subscription.
+type Watcher struct {
+	// Snapshot represents user's roster at subscription time.
+	Snapshot Event
+
+	username string
+	ch       chan Event
+}
+
+// Events returns the channel over which every roster mutation
+// subsequent to the snapshot is delivered.
+func (w *Watcher) Events() <-chan Event {
+	return w.ch
+}
+
+// NewHub returns a new roster sync hub.
+func NewHub(cfg *config.RosterSync) *Hub {
+	return &Hub{
+		cfg:      cfg,
+		versions: make(map[string]uint64),
+		watchers: make(map[string][]*Watcher),
+	}
+}
+
+// Initialize initializes the roster sync sub system,
+// starting the HTTP listener whenever a port has been configured.
+func Initialize(cfg *config.RosterSync) {
+	if cfg.Port == 0 {
+		return
+	}
+	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		inst = NewHub(cfg)
+		inst.srv = &http.Server{
+			Addr:    fmt.Sprintf("%s:%d", cfg.BindAddress, cfg.Port),
+			Handler: inst.serveMux(),
+		}
+		go inst.listen()
+	}
+}
+
+// Instance returns global roster sync hub,
+// or nil if the sub system has not been initialized.
+func Instance() *Hub {
+	instMu.RLock()
+	defer instMu.RUnlock()
+	return inst
+}
+
+// Shutdown shuts down roster sync sub system.
+func Shutdown() {
+	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
+		instMu.Lock()
+		defer instMu.Unlock()
+
+		inst.srv.Close()
+		inst = nil
+	}
+}
+
+// Publish notifies a roster item mutation to every watcher
+// of the item's owner. It's a no-op if the sub system has not been initialized.
+func Publish(ri *model.RosterItem) {
+	if h := Instance(); h != nil {
+		h.Publish(ri)
+	}
+}
+
+// Publish notifies a roster item mutation to every watcher of the item's owner.
+func (h *Hub) Publish(ri *model.RosterItem) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.versions[ri.User]++
+	e := Event{
+		Type:     UpdateEventType,
+		Username: ri.User,
+		Version:  h.versions[ri.User],
+		Items:    []Item{itemFromRosterItem(ri)},
+	}
+	watchers := h.watchers[ri.User]
+	for i := 0; i < len(watchers); i++ {
+		select {
+		case watchers[i].ch <- e:
+		default:
+			// slow watcher... drop it
+			log.Warnf("roster sync: dropping slow watcher (%s)", ri.User)
+			close(watchers[i].ch)
+			watchers = append(watchers[:i], watchers[i+1:]...)
+			i--
+		}
+	}
+	h.setWatchers(ri.User, watchers)
+}
+
+// Subscribe registers a new watcher for username roster mutations.
+// Updates published while the snapshot is being fetched are delivered
+// as well, so consumers must apply them idempotently.
+func (h *Hub) Subscribe(username string) (*Watcher, error) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	w := &Watcher{
+		username: username,
+		ch:       make(chan Event, watcherBufferSize),
+	}
+	h.mu.Lock()
+	version := h.versions[username]
+	h.watchers[username] = append(h.watchers[username], w)
+	h.mu.Unlock()
+
+	ris, err := storage.Instance().FetchRosterItems(ctx, username)
+	if err != nil {
+		h.Unsubscribe(w)
+		return nil, err
+	}
+	w.Snapshot = Event{
+		Type:     SnapshotEventType,
+		Username: username,
+		Version:  version,
+		Items:    []Item{},
+	}
+	for i := range ris {
+		w.Snapshot.Items = append(w.Snapshot.Items, itemFromRosterItem(&ris[i]))
+	}
+	return w, nil
+}
+
+// Unsubscribe unregisters a previously subscribed watcher.
+func (h *Hub) Unsubscribe(w *Watcher) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	watchers := h.watchers[w.username]
+	for i := 0; i < len(watchers); i++ {
+		if watchers[i] == w {
+			close(w.ch)
+			h.setWatchers(w.username, append(watchers[:i], watchers[i+1:]...))
+			return
+		}
+	}
+}
+
+// ServeHTTP streams username roster events as server-sent events.
+// Request path is expected to be in the form of '/roster/{username}'.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	username := strings.TrimPrefix(r.URL.Path, "/roster/")
+	if len(username) == 0 || strings.Contains(username, "/") {
+		http.NotFound(w, r)
+		return
+	}
+	if !h.isAuthorized(r.Header.Get("Authorization"), username) {
+		http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming not supported", http.StatusInternalServerError)
+		return
+	}
+	watcher, err := h.Subscribe(username)
+	if err != nil {
+		log.Error(err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+	defer h.Unsubscribe(watcher)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+
+	writeEvent(w, &watcher.Snapshot)
+	flusher.Flush()
+	for {
+		select {
+		case e, ok := <-watcher.Events():
+			if !ok {
+				return // dropped by hub...
+			}
+			writeEvent(w, &e)
+			flusher.Flush()
+
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (h *Hub) setWatchers(username string, watchers []*Watcher) {
+	if len(watchers) == 0 {
+		delete(h.watchers, username)
+		return
+	}
+	h.watchers[username] = watchers
+}
+
+func (h *Hub) isAuthorized(authorization string, username string) bool {
+	const bearerPrefix = "Bearer "
+	if !strings.HasPrefix(authorization, bearerPrefix) {
+		return false
+	}
+	token := strings.TrimPrefix(authorization, bearerPrefix)
+	for _, tk := range h.cfg.Tokens {
+		if subtle.ConstantTimeCompare([]byte(tk.Token), []byte(token)) != 1 {
+			continue
+		}
+		for _, pattern := range tk.Usernames {
+			if ok, _ := path.Match(pattern, username); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (h *Hub) serveMux() *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.Handle("/roster/", h)
+	return mux
+}
+
+func (h *Hub) listen() {
+	log.Infof("roster sync: listening at %s", h.srv.Addr)
+	if err := h.srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Error(err)
+	}
+}
+
+func writeEvent(w io.Writer, e *Event) {
+	b, _ := json.Marshal(e)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+}
+
+func itemFromRosterItem(ri *model.RosterItem) Item {
+	return Item{
+		Contact:      ri.Contact,
+		Name:         ri.Name,
+		Subscription: ri.Subscription,
+		Ask:          ri.Ask,
+		Groups:       ri.Groups,
+	}
+}
@@ -0,0 +1,163 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package rostersync
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHub_SubscribeAndPublish(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	h := NewHub(tUtilRosterSyncConfig())
+
+	ri := &model.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "both"}
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), ri)
+
+	h.Publish(ri)
+
+	w, err := h.Subscribe("ortuman")
+	require.Nil(t, err)
+	require.Equal(t, SnapshotEventType, w.Snapshot.Type)
+	require.Equal(t, uint64(1), w.Snapshot.Version)
+	require.Equal(t, 1, len(w.Snapshot.Items))
+	require.Equal(t, "noelia", w.Snapshot.Items[0].Contact)
+
+	// other users mutations are not delivered
+	h.Publish(&model.RosterItem{User: "noelia", Contact: "ortuman", Subscription: "both"})
+
+	ri2 := &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "none", Ask: true}
+	h.Publish(ri2)
+
+	e := <-w.Events()
+	require.Equal(t, UpdateEventType, e.Type)
+	require.Equal(t, uint64(2), e.Version)
+	require.Equal(t, "romeo", e.Items[0].Contact)
+	require.True(t, e.Items[0].Ask)
+
+	h.Unsubscribe(w)
+	_, ok := <-w.Events()
+	require.False(t, ok)
+
+	// storage failure...
+	storage.ActivateMockedError()
+	_, err = h.Subscribe("ortuman")
+	require.Equal(t, storage.ErrMockedError, err)
+	storage.DeactivateMockedError()
+}
+
+func TestHub_DropSlowWatcher(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	h := NewHub(tUtilRosterSyncConfig())
+
+	w, err := h.Subscribe("ortuman")
+	require.Nil(t, err)
+
+	ri := &model.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "both"}
+	for i := 0; i < watcherBufferSize+1; i++ {
+		h.Publish(ri)
+	}
+	var cnt int
+	for range w.Events() {
+		cnt++
+	}
+	require.Equal(t, watcherBufferSize, cnt)
+	h.Unsubscribe(w) // already dropped...
+}
+
+func TestHub_Authorization(t *testing.T) {
+	h := NewHub(tUtilRosterSyncConfig())
+
+	require.True(t, h.isAuthorized("Bearer s3cr3t", "crm_bot"))
+	require.True(t, h.isAuthorized("Bearer s3cr3t", "ortuman"))
+	require.False(t, h.isAuthorized("Bearer s3cr3t", "noelia"))
+	require.False(t, h.isAuthorized("Bearer 1234", "ortuman"))
+	require.False(t, h.isAuthorized("s3cr3t", "ortuman"))
+	require.False(t, h.isAuthorized("", "ortuman"))
+}
+
+func TestHub_ServeHTTP(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	h := NewHub(tUtilRosterSyncConfig())
+	srv := httptest.NewServer(h.serveMux())
+	defer srv.Close()
+
+	// unauthorized...
+	resp, err := http.Get(srv.URL + "/roster/ortuman")
+	require.Nil(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/roster/noelia", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusUnauthorized, resp.StatusCode)
+	resp.Body.Close()
+
+	// authorized...
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "both"})
+
+	req, _ = http.NewRequest(http.MethodGet, srv.URL+"/roster/ortuman", nil)
+	req.Header.Set("Authorization", "Bearer s3cr3t")
+	resp, err = http.DefaultClient.Do(req)
+	require.Nil(t, err)
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+	defer resp.Body.Close()
+
+	rd := bufio.NewReader(resp.Body)
+	e := tUtilRosterSyncReadEvent(rd, t)
+	require.Equal(t, SnapshotEventType, e.Type)
+	require.Equal(t, 1, len(e.Items))
+
+	h.Publish(&model.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "remove"})
+
+	e = tUtilRosterSyncReadEvent(rd, t)
+	require.Equal(t, UpdateEventType, e.Type)
+	require.Equal(t, uint64(1), e.Version)
+	require.Equal(t, "remove", e.Items[0].Subscription)
+}
+
+func tUtilRosterSyncReadEvent(rd *bufio.Reader, t *testing.T) *Event {
+	eventLine, err := rd.ReadString('\n')
+	require.Nil(t, err)
+	dataLine, err := rd.ReadString('\n')
+	require.Nil(t, err)
+	_, err = rd.ReadString('\n') // blank line
+	require.Nil(t, err)
+
+	var e Event
+	require.Nil(t, json.Unmarshal([]byte(strings.TrimPrefix(dataLine, "data: ")), &e))
+	require.Equal(t, "event: "+e.Type+"\n", eventLine)
+	return &e
+}
+
+func tUtilRosterSyncConfig() *config.RosterSync {
+	return &config.RosterSync{
+		Port: 9091,
+		Tokens: []config.RosterSyncToken{{
+			Token:     "s3cr3t",
+			Usernames: []string{"crm_*", "ortuman"},
+		}},
+	}
+}
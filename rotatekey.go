@@ -0,0 +1,88 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/encrypted"
+)
+
+const rotateKeyUsageStr = `
+Usage: jackal rotate-key [options]
+
+Wraps storage encryption keyring data keys using a new master key.
+Stored payloads are not encrypted again.
+
+Rotate Key Options:
+    -c, --config <file>                 Configuration file path
+    --new-master-key-path <file>        New master key file path
+    --new-master-key-command <command>  Command printing the new master key
+`
+
+func runRotateKey(args []string) {
+	var configFile string
+	var newKeyCfg config.StorageEncryption
+
+	fs := flag.NewFlagSet("rotate-key", flag.ExitOnError)
+	fs.StringVar(&configFile, "config", "/etc/jackal/jackal.yaml", "Configuration file path.")
+	fs.StringVar(&configFile, "c", "/etc/jackal/jackal.yml", "Configuration file path.")
+	fs.StringVar(&newKeyCfg.MasterKeyFile, "new-master-key-path", "", "New master key file path.")
+	fs.StringVar(&newKeyCfg.MasterKeyCommand, "new-master-key-command", "", "Command printing the new master key.")
+	fs.Usage = func() {
+		fmt.Fprintf(os.Stdout, "%s\n", rotateKeyUsageStr)
+	}
+	fs.Parse(args)
+
+	if err := rotateKey(configFile, &newKeyCfg); err != nil {
+		fmt.Fprintf(os.Stderr, "jackal: %v\n", err)
+	}
+}
+
+func rotateKey(configFile string, newKeyCfg *config.StorageEncryption) error {
+	var cfg config.Config
+	if err := config.FromFile(configFile, &cfg); err != nil {
+		return err
+	}
+	encCfg := cfg.Storage.Encryption
+	if encCfg == nil {
+		return errors.New("storage encryption not configured")
+	}
+	masterKey, err := encrypted.LoadMasterKey(encCfg)
+	if err != nil {
+		return err
+	}
+	newMasterKey, err := encrypted.LoadMasterKey(newKeyCfg)
+	if err != nil {
+		return err
+	}
+	return encrypted.RewrapKeyRing(encCfg.KeyRingFile, masterKey, newMasterKey)
+}
+
+// decorateEncryptedStorage decorates the initialized storage encrypting
+// its payloads whenever encryption is configured.
+func decorateEncryptedStorage(cfg *config.Storage) error {
+	if cfg.Encryption == nil {
+		return nil
+	}
+	masterKey, err := encrypted.LoadMasterKey(cfg.Encryption)
+	if err != nil {
+		return err
+	}
+	kr, err := encrypted.OpenKeyRing(cfg.Encryption.KeyRingFile, masterKey)
+	if err != nil {
+		return err
+	}
+	storage.Decorate(func(s storage.Storage) storage.Storage {
+		return encrypted.New(s, kr)
+	})
+	return nil
+}
@@ -5,13 +5,22 @@
 
 package server
 
-import "github.com/ortuman/jackal/xml"
+import (
+	"strings"
+
+	"github.com/ortuman/jackal/credentials"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
 
 const saslNamespace = "urn:ietf:params:xml:ns:xmpp-sasl"
 
 type authenticator interface {
 	Mechanism() string
 	Username() string
+	User() *model.User
 	Authenticated() bool
 	UsesChannelBinding() bool
 
@@ -39,6 +48,40 @@ func (se *saslErrorString) Error() string {
 	return se.reason
 }
 
+// maxSASLUsernameLength is the largest accepted authentication identity (RFC 7622).
+const maxSASLUsernameLength = 1023
+
+// validateSASLUsername checks a decoded authentication
+// identity before being looked up in storage.
+func validateSASLUsername(username string) error {
+	if len(strings.TrimSpace(username)) == 0 {
+		return errSASLMalformedRequest
+	}
+	if len(username) > maxSASLUsernameLength {
+		return errSASLNotAuthorized
+	}
+	return nil
+}
+
+// upgradeCredentials replaces the stored credentials of a just
+// authenticated user with the ones currently derived from password,
+// returning the user as stored afterwards.
+func upgradeCredentials(hasher *credentials.Hasher, user *model.User, password string) *model.User {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	upgraded := *user
+	if err := hasher.SetPassword(&upgraded, password); err != nil {
+		log.Warnf("couldn't upgrade %s credentials: %v", user.Username, err)
+		return user
+	}
+	if err := storage.Instance().InsertOrUpdateUser(ctx, &upgraded); err != nil {
+		log.Warnf("couldn't upgrade %s credentials: %v", user.Username, err)
+		return user
+	}
+	return &upgraded
+}
+
 var (
 	errSASLIncorrectEncoding    = newSASLError("incorrect-encoding")
 	errSASLMalformedRequest     = newSASLError("malformed-request")
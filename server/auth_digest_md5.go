@@ -12,6 +12,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"strings"
+	"time"
 
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
@@ -79,6 +80,7 @@ type digestMD5Authenticator struct {
 	strm          c2s.Stream
 	state         digestMD5State
 	username      string
+	user          *model.User
 	authenticated bool
 }
 
@@ -97,6 +99,10 @@ func (d *digestMD5Authenticator) Username() string {
 	return d.username
 }
 
+func (d *digestMD5Authenticator) User() *model.User {
+	return d.user
+}
+
 func (d *digestMD5Authenticator) Authenticated() bool {
 	return d.authenticated
 }
@@ -129,6 +135,7 @@ func (d *digestMD5Authenticator) ProcessElement(elem xml.Element) error {
 func (d *digestMD5Authenticator) Reset() {
 	d.state = startDigestMD5State
 	d.username = ""
+	d.user = nil
 	d.authenticated = false
 }
 
@@ -146,6 +153,9 @@ func (d *digestMD5Authenticator) handleStart(elem xml.Element) error {
 }
 
 func (d *digestMD5Authenticator) handleChallenged(elem xml.Element) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	if elem.TextLen() == 0 {
 		return errSASLMalformedRequest
 	}
@@ -176,11 +186,16 @@ func (d *digestMD5Authenticator) handleChallenged(elem xml.Element) error {
 		return errSASLNotAuthorized
 	}
 	// validate user
-	user, err := storage.Instance().FetchUser(params.username)
+	if err := validateSASLUsername(params.username); err != nil {
+		return err
+	}
+	user, err := storage.Instance().FetchUser(ctx, params.username)
 	if err != nil {
 		return err
 	}
-	if user == nil {
+	// DIGEST-MD5 requires the plain-text password, no longer
+	// available once upgraded to a SCRAM verifier
+	if user == nil || user.IsPurgeable(time.Now()) || len(user.Password) == 0 {
 		return errSASLNotAuthorized
 	}
 	// validate response
@@ -198,6 +213,7 @@ func (d *digestMD5Authenticator) handleChallenged(elem xml.Element) error {
 	d.strm.SendElement(respElem)
 
 	d.username = user.Username
+	d.user = user
 	d.state = authenticatedDigestMD5State
 	return nil
 }
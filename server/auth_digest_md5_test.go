@@ -6,11 +6,13 @@
 package server
 
 import (
+	"context"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"testing"
 
+	"github.com/ortuman/jackal/credentials"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
@@ -135,6 +137,15 @@ func TestDigesMD5Authentication(t *testing.T) {
 	cl7.setParameter("response=" + badClientResp)
 	require.Equal(t, errSASLNotAuthorized, helper.sendClientParamsResponse(&cl7))
 
+	// password upgraded to SCRAM verifier...
+	cl8 := *clParams
+	user3 := &model.User{Username: "mariana", Verifier: credentials.NewScramVerifier("1234", 4096)}
+	storage.Instance().InsertOrUpdateUser(context.Background(), user3)
+	emptyClientResp := authr.computeResponse(&cl8, user3, true)
+	cl8.setParameter("response=" + emptyClientResp)
+	require.Equal(t, errSASLNotAuthorized, helper.sendClientParamsResponse(&cl8))
+	storage.Instance().InsertOrUpdateUser(context.Background(), user)
+
 	// storage error...
 	storage.ActivateMockedError()
 	require.Equal(t, storage.ErrMockedError, helper.sendClientParamsResponse(clParams))
@@ -8,20 +8,25 @@ package server
 import (
 	"bytes"
 	"encoding/base64"
+	"time"
 
+	"github.com/ortuman/jackal/credentials"
 	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 )
 
 type plainAuthenticator struct {
 	strm          c2s.Stream
+	hasher        *credentials.Hasher
 	username      string
+	user          *model.User
 	authenticated bool
 }
 
-func newPlainAuthenticator(strm c2s.Stream) *plainAuthenticator {
-	return &plainAuthenticator{strm: strm}
+func newPlainAuthenticator(strm c2s.Stream, hasher *credentials.Hasher) *plainAuthenticator {
+	return &plainAuthenticator{strm: strm, hasher: hasher}
 }
 
 func (p *plainAuthenticator) Mechanism() string {
@@ -32,6 +37,10 @@ func (p *plainAuthenticator) Username() string {
 	return p.username
 }
 
+func (p *plainAuthenticator) User() *model.User {
+	return p.user
+}
+
 func (p *plainAuthenticator) Authenticated() bool {
 	return p.authenticated
 }
@@ -41,6 +50,9 @@ func (p *plainAuthenticator) UsesChannelBinding() bool {
 }
 
 func (p *plainAuthenticator) ProcessElement(elem xml.Element) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	if p.authenticated {
 		return nil
 	}
@@ -57,16 +69,29 @@ func (p *plainAuthenticator) ProcessElement(elem xml.Element) error {
 	}
 	username := string(s[1])
 	password := string(s[2])
+	if err := validateSASLUsername(username); err != nil {
+		return err
+	}
+	if len(password) == 0 {
+		return errSASLNotAuthorized
+	}
 
 	// validate user and password
-	user, err := storage.Instance().FetchUser(username)
+	user, err := storage.Instance().FetchUser(ctx, username)
 	if err != nil {
 		return err
 	}
-	if user == nil || user.Password != password {
+	if user == nil || user.IsPurgeable(time.Now()) {
 		return errSASLNotAuthorized
 	}
+	if !credentials.Verify(user, password) {
+		return errSASLNotAuthorized
+	}
+	if p.hasher.NeedsUpgrade(user) {
+		user = upgradeCredentials(p.hasher, user, password)
+	}
 	p.username = username
+	p.user = user
 	p.authenticated = true
 
 	p.strm.SendElement(xml.NewElementNamespace("success", saslNamespace))
@@ -75,5 +100,6 @@ func (p *plainAuthenticator) ProcessElement(elem xml.Element) error {
 
 func (p *plainAuthenticator) Reset() {
 	p.username = ""
+	p.user = nil
 	p.authenticated = false
 }
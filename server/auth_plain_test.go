@@ -7,9 +7,14 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"encoding/base64"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
@@ -22,7 +27,7 @@ func TestAuthPlainAuthentication(t *testing.T) {
 	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
 	defer authTestTeardown()
 
-	authr := newPlainAuthenticator(testStm)
+	authr := newPlainAuthenticator(testStm, testHasher)
 	require.Equal(t, authr.Mechanism(), "PLAIN")
 	require.False(t, authr.UsesChannelBinding())
 
@@ -48,10 +53,23 @@ func TestAuthPlainAuthentication(t *testing.T) {
 	require.Equal(t, "mariana", authr.Username())
 	require.True(t, authr.Authenticated())
 
+	// plain-text password upgraded on login...
+	user, _ := storage.Instance().FetchUser(context.Background(), "mariana")
+	require.Equal(t, "", user.Password)
+	require.NotNil(t, user.Verifier)
+	require.NotEqual(t, "1234", user.PasswordHash)
+	require.True(t, credentials.Verify(user, "1234"))
+
 	// already authenticated...
 	err = authr.ProcessElement(elem)
 	require.Nil(t, err)
 
+	// valid credentials against verifier...
+	authr.Reset()
+	err = authr.ProcessElement(elem)
+	require.Nil(t, err)
+	require.True(t, authr.Authenticated())
+
 	// malformed request
 	authr.Reset()
 	elem.SetText("")
@@ -100,4 +118,130 @@ func TestAuthPlainAuthentication(t *testing.T) {
 	authr.Reset()
 	err = authr.ProcessElement(elem)
 	require.Equal(t, errSASLNotAuthorized, err)
+	// removed account
+	buf.Reset()
+	buf.WriteByte(0)
+	buf.WriteString("mariana")
+	buf.WriteByte(0)
+	buf.WriteString("1234")
+	elem.SetText(base64.StdEncoding.EncodeToString(buf.Bytes()))
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "mariana", Password: "1234", PurgeAt: time.Now()})
+
+	authr.Reset()
+	err = authr.ProcessElement(elem)
+	require.Equal(t, errSASLNotAuthorized, err)
+
+	// removed account within its grace period
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "mariana", Password: "1234", PurgeAt: time.Now().Add(time.Hour)})
+
+	authr.Reset()
+	err = authr.ProcessElement(elem)
+	require.Nil(t, err)
+	require.True(t, authr.Authenticated())
+	require.NotNil(t, authr.User())
+	require.True(t, authr.User().IsRemoved()) // left up to the stream
+
+	authr.Reset()
+	require.Nil(t, authr.User())
+}
+
+func TestAuthPlainHashedPasswords(t *testing.T) {
+	argon2id := credentials.NewHasher(&config.PasswordHashing{Algorithm: config.Argon2id, Cost: 1}, 4096)
+	hashed := &model.User{Username: "mariana"}
+	require.Nil(t, argon2id.SetPassword(hashed, "1234"))
+
+	var tcs = []struct {
+		user     *model.User
+		password string
+		err      error
+	}{
+		{hashed, "1234", nil},
+		{hashed, "12345", errSASLNotAuthorized},
+		// verifier only credentials get completed
+		{&model.User{Username: "mariana", Verifier: credentials.NewScramVerifier("1234", 4096)}, "1234", nil},
+	}
+	for _, tc := range tcs {
+		testStm := authTestSetup(tc.user)
+
+		authr := newPlainAuthenticator(testStm, testHasher)
+		elem := xml.NewElementNamespace("auth", "urn:ietf:params:xml:ns:xmpp-sasl")
+		elem.SetAttribute("mechanism", "PLAIN")
+		elem.SetText(base64.StdEncoding.EncodeToString([]byte("\x00mariana\x00" + tc.password)))
+		require.Equal(t, tc.err, authr.ProcessElement(elem))
+
+		user, _ := storage.Instance().FetchUser(context.Background(), "mariana")
+		require.Equal(t, "", user.Password)
+		if tc.err == nil {
+			require.NotEqual(t, "", user.PasswordHash)
+			require.NotNil(t, user.Verifier)
+			require.True(t, credentials.Verify(user, tc.password))
+		}
+		authTestTeardown()
+	}
+}
+
+func TestAuthPlainUpgradeFailure(t *testing.T) {
+	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
+	defer authTestTeardown()
+
+	authr := newPlainAuthenticator(testStm, testHasher)
+	elem := xml.NewElementNamespace("auth", "urn:ietf:params:xml:ns:xmpp-sasl")
+	elem.SetAttribute("mechanism", "PLAIN")
+	elem.SetText(base64.StdEncoding.EncodeToString([]byte("\x00mariana\x001234")))
+
+	// failing to store upgraded credentials doesn't prevent logging in...
+	storage.ActivateMockedErrorForNext("InsertOrUpdateUser", 1)
+	require.Nil(t, authr.ProcessElement(elem))
+	require.True(t, authr.Authenticated())
+	require.Equal(t, "1234", authr.User().Password)
+
+	user, _ := storage.Instance().FetchUser(context.Background(), "mariana")
+	require.Equal(t, "1234", user.Password)
+	require.Nil(t, user.Verifier)
+
+	// ...and they get upgraded on next one
+	authr.Reset()
+	require.Nil(t, authr.ProcessElement(elem))
+
+	user, _ = storage.Instance().FetchUser(context.Background(), "mariana")
+	require.Equal(t, "", user.Password)
+	require.NotNil(t, user.Verifier)
+	require.True(t, credentials.Verify(user, "1234"))
+}
+
+func TestAuthPlainInvalidCredentials(t *testing.T) {
+	testStm := authTestSetup(&model.User{Username: "mariana", Password: "1234"})
+	defer authTestTeardown()
+
+	// any storage access would be reported as a mocked error
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	authr := newPlainAuthenticator(testStm, testHasher)
+	elem := xml.NewElementNamespace("auth", "urn:ietf:params:xml:ns:xmpp-sasl")
+	elem.SetAttribute("mechanism", "PLAIN")
+
+	var tcs = []struct {
+		username string
+		password string
+		err      error
+	}{
+		{"", "1234", errSASLMalformedRequest},
+		{" ", "1234", errSASLMalformedRequest},
+		{"\t\n", "", errSASLMalformedRequest},
+		{"mariana", "", errSASLNotAuthorized},
+		{strings.Repeat("a", maxSASLUsernameLength+1), "1234", errSASLNotAuthorized},
+	}
+	for _, tc := range tcs {
+		buf := new(bytes.Buffer)
+		buf.WriteByte(0)
+		buf.WriteString(tc.username)
+		buf.WriteByte(0)
+		buf.WriteString(tc.password)
+		elem.SetText(base64.StdEncoding.EncodeToString(buf.Bytes()))
+
+		authr.Reset()
+		require.Equal(t, tc.err, authr.ProcessElement(elem))
+		require.False(t, authr.Authenticated())
+	}
 }
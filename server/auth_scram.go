@@ -14,8 +14,10 @@ import (
 	"fmt"
 	"hash"
 	"strings"
+	"time"
 
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
 	"github.com/ortuman/jackal/server/transport"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
@@ -23,11 +25,8 @@ import (
 	"github.com/ortuman/jackal/util"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
-	"golang.org/x/crypto/pbkdf2"
 )
 
-const iterationsCount = 4096
-
 type scramType int
 
 const (
@@ -82,20 +81,24 @@ type scramAuthenticator struct {
 	h             func() hash.Hash
 	hKeyLen       int
 	state         scramState
+	hasher        *credentials.Hasher
 	params        *scramParameters
 	user          *model.User
 	salt          []byte
+	storedKey     []byte
+	serverKey     []byte
 	srvNonce      string
 	firstMessage  string
 	authenticated bool
 }
 
-func newScram(strm c2s.Stream, tr transport.Transport, scramType scramType, usesChannelBinding bool) *scramAuthenticator {
+func newScram(strm c2s.Stream, tr transport.Transport, scramType scramType, usesChannelBinding bool, hasher *credentials.Hasher) *scramAuthenticator {
 	s := &scramAuthenticator{
 		strm:   strm,
 		tr:     tr,
 		tp:     scramType,
 		usesCb: usesChannelBinding,
+		hasher: hasher,
 		state:  startScramState,
 	}
 	if s.tp == sha1ScramType {
@@ -132,6 +135,13 @@ func (s *scramAuthenticator) Username() string {
 	return ""
 }
 
+func (s *scramAuthenticator) User() *model.User {
+	if s.authenticated {
+		return s.user
+	}
+	return nil
+}
+
 func (s *scramAuthenticator) Authenticated() bool {
 	return s.authenticated
 }
@@ -164,11 +174,16 @@ func (s *scramAuthenticator) Reset() {
 	s.params = nil
 	s.user = nil
 	s.salt = nil
+	s.storedKey = nil
+	s.serverKey = nil
 	s.srvNonce = ""
 	s.firstMessage = ""
 }
 
 func (s *scramAuthenticator) handleStart(elem xml.Element) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
 	p, err := s.getElementPayload(elem)
 	if err != nil {
 		return err
@@ -179,22 +194,43 @@ func (s *scramAuthenticator) handleStart(elem xml.Element) error {
 	username := s.params.getParameter("n")
 	cNonce := s.params.getParameter("r")
 
-	if len(username) == 0 || len(cNonce) == 0 {
+	if len(cNonce) == 0 {
 		return errSASLMalformedRequest
 	}
-	user, err := storage.Instance().FetchUser(username)
+	if err := validateSASLUsername(username); err != nil {
+		return err
+	}
+	user, err := storage.Instance().FetchUser(ctx, username)
 	if err != nil {
 		return err
 	}
-	if user == nil {
+	if user == nil || user.IsPurgeable(time.Now()) {
 		return errSASLNotAuthorized
 	}
 	s.user = user
 
+	iterations := s.hasher.ScramIterations()
+	if v := user.Verifier; v != nil {
+		s.salt = v.Salt
+		iterations = v.IterationCount
+		if s.tp == sha1ScramType {
+			s.storedKey, s.serverKey = v.StoredKeySHA1, v.ServerKeySHA1
+		} else {
+			s.storedKey, s.serverKey = v.StoredKeySHA256, v.ServerKeySHA256
+		}
+		if len(s.storedKey) == 0 || len(s.serverKey) == 0 {
+			return errSASLNotAuthorized
+		}
+	} else {
+		if len(user.Password) == 0 {
+			return errSASLNotAuthorized
+		}
+		s.salt = util.RandomBytes(32)
+		s.storedKey, s.serverKey = credentials.ScramKeys(s.h, []byte(user.Password), s.salt, iterations)
+	}
 	s.srvNonce = cNonce + "-" + uuid.New()
-	s.salt = util.RandomBytes(32)
 	sb64 := base64.StdEncoding.EncodeToString(s.salt)
-	s.firstMessage = fmt.Sprintf("r=%s,s=%s,i=%d", s.srvNonce, sb64, iterationsCount)
+	s.firstMessage = fmt.Sprintf("r=%s,s=%s,i=%d", s.srvNonce, sb64, iterations)
 
 	respElem := xml.NewElementNamespace("challenge", saslNamespace)
 	respElem.SetText(base64.StdEncoding.EncodeToString([]byte(s.firstMessage)))
@@ -213,29 +249,35 @@ func (s *scramAuthenticator) handleChallenged(elem xml.Element) error {
 	initialMessage := s.params.String()
 	clientFinalMessageBare := fmt.Sprintf("c=%s,r=%s", c, s.srvNonce)
 
-	saltedPassword := s.pbkdf2([]byte(s.user.Password))
-	clientKey := s.hmac([]byte("Client Key"), saltedPassword)
-	storedKey := s.hash(clientKey)
+	if !strings.HasPrefix(p, clientFinalMessageBare+",p=") {
+		return errSASLNotAuthorized
+	}
+	clientProof, err := base64.StdEncoding.DecodeString(p[len(clientFinalMessageBare)+3:])
+	if err != nil || len(clientProof) != s.hKeyLen {
+		return errSASLNotAuthorized
+	}
 	authMessage := initialMessage + "," + s.firstMessage + "," + clientFinalMessageBare
-	clientSignature := s.hmac([]byte(authMessage), storedKey)
+	clientSignature := s.hmac([]byte(authMessage), s.storedKey)
 
-	clientProof := make([]byte, len(clientKey))
-	for i := 0; i < len(clientKey); i++ {
-		clientProof[i] = clientKey[i] ^ clientSignature[i]
+	// recover client key from its proof and check it against the stored one
+	clientKey := make([]byte, len(clientProof))
+	for i := 0; i < len(clientProof); i++ {
+		clientKey[i] = clientProof[i] ^ clientSignature[i]
 	}
-	serverKey := s.hmac([]byte("Server Key"), saltedPassword)
-	serverSignature := s.hmac([]byte(authMessage), serverKey)
-
-	clientFinalMessage := clientFinalMessageBare + ",p=" + base64.StdEncoding.EncodeToString(clientProof)
-	if clientFinalMessage != p {
+	if !hmac.Equal(s.hash(clientKey), s.storedKey) {
 		return errSASLNotAuthorized
 	}
+	serverSignature := s.hmac([]byte(authMessage), s.serverKey)
+
 	v := "v=" + base64.StdEncoding.EncodeToString(serverSignature)
 
 	respElem := xml.NewElementNamespace("success", saslNamespace)
 	respElem.SetText(base64.StdEncoding.EncodeToString([]byte(v)))
 	s.strm.SendElement(respElem)
 
+	if s.user.Verifier == nil {
+		s.user = upgradeCredentials(s.hasher, s.user, s.user.Password)
+	}
 	s.authenticated = true
 	return nil
 }
@@ -262,11 +304,15 @@ func (s *scramAuthenticator) parseParameters(str string) error {
 
 	switch gs2BindFlag {
 	case "y":
-		if !s.usesCb {
+		// client supports channel binding but thinks server does not,
+		// which is a downgrade attack whenever -PLUS variants were offered (RFC 5802)
+		if s.usesCb || channelBindingAvailable(s.tr) {
 			return errSASLNotAuthorized
 		}
 	case "n":
-		break
+		if s.usesCb {
+			return errSASLNotAuthorized
+		}
 	default:
 		if !strings.HasPrefix(gs2BindFlag, "p=") {
 			return errSASLMalformedRequest
@@ -275,6 +321,12 @@ func (s *scramAuthenticator) parseParameters(str string) error {
 			return errSASLNotAuthorized
 		}
 		p.cbMechanism = gs2BindFlag[2:]
+
+		// transports only provide 'tls-unique' binding data, so any other
+		// type could never be verified against the client proof
+		if p.cbMechanism != "tls-unique" || !channelBindingAvailable(s.tr) {
+			return errSASLNotAuthorized
+		}
 	}
 	authzID := sp[1]
 	p.gs2Header = gs2BindFlag + "," + authzID + ","
@@ -294,22 +346,21 @@ func (s *scramAuthenticator) parseParameters(str string) error {
 	return nil
 }
 
+// channelBindingAvailable reports whether or not tr transport
+// provides 'tls-unique' channel binding data.
+func channelBindingAvailable(tr transport.Transport) bool {
+	return len(tr.ChannelBindingBytes(config.TLSUnique)) > 0
+}
+
 func (s *scramAuthenticator) getCBindInputString() string {
 	buf := new(bytes.Buffer)
 	buf.Write([]byte(s.params.gs2Header))
 	if s.usesCb {
-		switch s.params.cbMechanism {
-		case "tls-unique":
-			buf.Write(s.tr.ChannelBindingBytes(config.TLSUnique))
-		}
+		buf.Write(s.tr.ChannelBindingBytes(config.TLSUnique))
 	}
 	return base64.StdEncoding.EncodeToString(buf.Bytes())
 }
 
-func (s *scramAuthenticator) pbkdf2(b []byte) []byte {
-	return pbkdf2.Key(b, s.salt, iterationsCount, s.hKeyLen, s.h)
-}
-
 func (s *scramAuthenticator) hmac(b []byte, key []byte) []byte {
 	m := hmac.New(s.h, key)
 	m.Write(b)
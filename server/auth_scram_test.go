@@ -7,6 +7,7 @@ package server
 
 import (
 	"bytes"
+	"context"
 	"crypto/hmac"
 	"crypto/sha1"
 	"crypto/sha256"
@@ -17,7 +18,9 @@ import (
 	"strings"
 	"testing"
 
+	"github.com/ortuman/jackal/credentials"
 	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/util"
 	"github.com/ortuman/jackal/xml"
@@ -97,7 +100,7 @@ var tt = []scramAuthTestCase{
 		scramType:   sha1ScramType,
 		usesCb:      false,
 		gs2BindFlag: "n",
-		n:           "mariana",
+		n:           "unknown",
 		r:           "bb769406-eaa4-4f38-a279-2b90e596f6dd",
 		password:    "1234",
 		expectedErr: errSASLNotAuthorized,
@@ -114,10 +117,11 @@ var tt = []scramAuthTestCase{
 		expectedErr: errSASLNotAuthorized,
 	},
 	{
-		// not authorized gs2BindFlag
+		// not authorized gs2BindFlag (channel binding downgrade)
 		id:          7,
 		scramType:   sha1ScramType,
 		usesCb:      false,
+		cbBytes:     util.RandomBytes(23),
 		gs2BindFlag: "y",
 		n:           "ortuman",
 		r:           "bb769406-eaa4-4f38-a279-2b90e596f6dd",
@@ -172,6 +176,51 @@ var tt = []scramAuthTestCase{
 		password:    "1234",
 		expectedErr: errSASLMalformedRequest,
 	},
+	{
+		// client supporting channel binding over a non binding transport
+		id:          11,
+		scramType:   sha1ScramType,
+		usesCb:      false,
+		gs2BindFlag: "y",
+		n:           "ortuman",
+		r:           "bb769406-eaa4-4f38-a279-2b90e596f6dd",
+		password:    "1234",
+	},
+	{
+		// channel binding mechanism not binding
+		id:          12,
+		scramType:   sha1ScramType,
+		usesCb:      true,
+		cbBytes:     util.RandomBytes(23),
+		gs2BindFlag: "n",
+		n:           "ortuman",
+		r:           "bb769406-eaa4-4f38-a279-2b90e596f6dd",
+		password:    "1234",
+		expectedErr: errSASLNotAuthorized,
+	},
+	{
+		// unsupported channel binding type
+		id:          13,
+		scramType:   sha256ScramType,
+		usesCb:      true,
+		cbBytes:     util.RandomBytes(32),
+		gs2BindFlag: "p=tls-server-end-point",
+		n:           "ortuman",
+		r:           "d712875c-bd3b-4b41-801d-eb9c541d9884",
+		password:    "1234",
+		expectedErr: errSASLNotAuthorized,
+	},
+	{
+		// channel binding data not available
+		id:          14,
+		scramType:   sha256ScramType,
+		usesCb:      true,
+		gs2BindFlag: "p=tls-unique",
+		n:           "ortuman",
+		r:           "d712875c-bd3b-4b41-801d-eb9c541d9884",
+		password:    "1234",
+		expectedErr: errSASLNotAuthorized,
+	},
 }
 
 func TestScramMechanisms(t *testing.T) {
@@ -179,23 +228,23 @@ func TestScramMechanisms(t *testing.T) {
 	testStrm := authTestSetup(&model.User{Username: "ortuman", Password: "1234"})
 	defer authTestTeardown()
 
-	authr := newScram(testStrm, testTr, sha1ScramType, false)
+	authr := newScram(testStrm, testTr, sha1ScramType, false, testHasher)
 	require.Equal(t, authr.Mechanism(), "SCRAM-SHA-1")
 	require.False(t, authr.UsesChannelBinding())
 
-	authr2 := newScram(testStrm, testTr, sha1ScramType, true)
+	authr2 := newScram(testStrm, testTr, sha1ScramType, true, testHasher)
 	require.Equal(t, authr2.Mechanism(), "SCRAM-SHA-1-PLUS")
 	require.True(t, authr2.UsesChannelBinding())
 
-	authr3 := newScram(testStrm, testTr, sha256ScramType, false)
+	authr3 := newScram(testStrm, testTr, sha256ScramType, false, testHasher)
 	require.Equal(t, authr3.Mechanism(), "SCRAM-SHA-256")
 	require.False(t, authr3.UsesChannelBinding())
 
-	authr4 := newScram(testStrm, testTr, sha256ScramType, true)
+	authr4 := newScram(testStrm, testTr, sha256ScramType, true, testHasher)
 	require.Equal(t, authr4.Mechanism(), "SCRAM-SHA-256-PLUS")
 	require.True(t, authr4.UsesChannelBinding())
 
-	authr5 := newScram(testStrm, testTr, scramType(99), true)
+	authr5 := newScram(testStrm, testTr, scramType(99), true, testHasher)
 	require.Equal(t, authr5.Mechanism(), "")
 }
 
@@ -204,7 +253,7 @@ func TestScramBadPayload(t *testing.T) {
 	testStrm := authTestSetup(&model.User{Username: "ortuman", Password: "1234"})
 	defer authTestTeardown()
 
-	authr := newScram(testStrm, testTr, sha1ScramType, false)
+	authr := newScram(testStrm, testTr, sha1ScramType, false, testHasher)
 
 	auth := xml.NewElementNamespace("auth", "urn:ietf:params:xml:ns:xmpp-sasl")
 	auth.SetAttribute("mechanism", authr.Mechanism())
@@ -216,27 +265,107 @@ func TestScramBadPayload(t *testing.T) {
 	authr.Reset()
 	auth.SetText(".")
 	require.Equal(t, errSASLIncorrectEncoding, authr.ProcessElement(auth))
+
+	// blank username
+	authr.Reset()
+	auth.SetText(base64.StdEncoding.EncodeToString([]byte("n,,n= ,r=abcd")))
+	require.Equal(t, errSASLMalformedRequest, authr.ProcessElement(auth))
 }
 
 func TestScramSuccessTestCases(t *testing.T) {
 	for _, tc := range tt {
-		err := processScramTestCase(t, &tc)
-		if err != nil {
-			require.Equal(t, tc.expectedErr, err, fmt.Sprintf("TC identifier: %d", tc.id))
-			continue
-		}
+		err := processScramTestCase(t, &tc, &model.User{Username: "ortuman", Password: "1234"})
+		require.Equal(t, tc.expectedErr, err, fmt.Sprintf("TC identifier: %d", tc.id))
+	}
+}
+
+func TestScramVerifier(t *testing.T) {
+	for _, tc := range tt {
+		verifier := credentials.NewScramVerifier("1234", 4096)
+		err := processScramTestCase(t, &tc, &model.User{Username: "ortuman", Verifier: verifier})
+		require.Equal(t, tc.expectedErr, err, fmt.Sprintf("TC identifier: %d", tc.id))
 	}
+	// verifier lacking mechanism keys
+	tc := tt[1]
+	verifier := credentials.NewScramVerifier("1234", 4096)
+	verifier.StoredKeySHA256 = nil
+	err := processScramTestCase(t, &tc, &model.User{Username: "ortuman", Verifier: verifier})
+	require.Equal(t, errSASLNotAuthorized, err)
 }
 
-func processScramTestCase(t *testing.T, tc *scramAuthTestCase) error {
+func TestScramPasswordUpgrade(t *testing.T) {
+	tc := tt[1]
+	err := processScramTestCase(t, &tc, &model.User{Username: "ortuman", Password: "1234"}, func() {
+		user, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
+		require.NotNil(t, user.Verifier)
+		require.Equal(t, "", user.Password)
+		require.Equal(t, 4096, user.Verifier.IterationCount)
+		require.True(t, credentials.VerifyScramPassword(user.Verifier, "1234"))
+		require.False(t, credentials.VerifyScramPassword(user.Verifier, "12345"))
+		require.NotEqual(t, "", user.PasswordHash)
+		require.True(t, credentials.Verify(user, "1234"))
+	})
+	require.Nil(t, err)
+
+	// upgraded passwords can be authenticated using any mechanism
+	verifier := credentials.NewScramVerifier("1234", 4096)
+	for _, i := range []int{0, 1, 2, 3} {
+		tc := tt[i]
+		require.Nil(t, processScramTestCase(t, &tc, &model.User{Username: "ortuman", Verifier: verifier}, func() {
+			user, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
+			require.Equal(t, verifier, user.Verifier)
+		}))
+	}
+}
+
+func TestScramInvalidProof(t *testing.T) {
 	tr := transport.NewMockTransport()
-	if tc.usesCb {
+	testStrm := authTestSetup(&model.User{Username: "ortuman", Password: "1234"})
+	defer authTestTeardown()
+
+	authr := newScram(testStrm, tr, sha256ScramType, false, testHasher)
+
+	clientInitialMessage := "n=ortuman,r=6d805d99-6dc3-4e5a-9a68-653856fc5129"
+	auth := xml.NewElementNamespace("auth", saslNamespace)
+	auth.SetAttribute("mechanism", authr.Mechanism())
+	auth.SetText(base64.StdEncoding.EncodeToString([]byte("n,," + clientInitialMessage)))
+	require.Nil(t, authr.ProcessElement(auth))
+
+	challenge := testStrm.FetchElement()
+	srvInitialMessage, _ := base64.StdEncoding.DecodeString(challenge.Text())
+	resp, _ := parseScramResponse(challenge.Text())
+	salt, _ := base64.StdEncoding.DecodeString(resp["s"])
+	iterations, _ := strconv.Atoi(resp["i"])
+	cBytes := base64.StdEncoding.EncodeToString([]byte("n,,"))
+
+	res := computeScramAuthResult(sha256ScramType, clientInitialMessage, string(srvInitialMessage), resp["r"], cBytes, "1234", salt, iterations)
+
+	// tamper client proof
+	proofIdx := strings.Index(res.clientFinalMessage, ",p=") + 3
+	proof, _ := base64.StdEncoding.DecodeString(res.clientFinalMessage[proofIdx:])
+	proof[0] ^= 0xff
+	tampered := res.clientFinalMessage[:proofIdx] + base64.StdEncoding.EncodeToString(proof)
+
+	response := xml.NewElementNamespace("response", saslNamespace)
+	response.SetText(base64.StdEncoding.EncodeToString([]byte(tampered)))
+	require.Equal(t, errSASLNotAuthorized, authr.ProcessElement(response))
+	require.False(t, authr.Authenticated())
+
+	// plain-text password remains untouched
+	user, _ := storage.Instance().FetchUser(context.Background(), "ortuman")
+	require.Nil(t, user.Verifier)
+	require.Equal(t, "1234", user.Password)
+}
+
+func processScramTestCase(t *testing.T, tc *scramAuthTestCase, user *model.User, checks ...func()) error {
+	tr := transport.NewMockTransport()
+	if len(tc.cbBytes) > 0 {
 		tr.SetChannelBindingBytes(tc.cbBytes)
 	}
-	testStrm := authTestSetup(&model.User{Username: "ortuman", Password: "1234"})
+	testStrm := authTestSetup(user)
 	defer authTestTeardown()
 
-	authr := newScram(testStrm, tr, tc.scramType, tc.usesCb)
+	authr := newScram(testStrm, tr, tc.scramType, tc.usesCb, testHasher)
 
 	auth := xml.NewElementNamespace("auth", saslNamespace)
 	auth.SetAttribute("mechanism", authr.Mechanism())
@@ -293,6 +422,10 @@ func processScramTestCase(t *testing.T, tc *scramAuthTestCase) error {
 	require.Equal(t, tc.n, authr.Username())
 
 	require.Nil(t, authr.ProcessElement(auth)) // test already authenticated...
+
+	for _, check := range checks {
+		check()
+	}
 	return nil
 }
 
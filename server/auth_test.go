@@ -6,21 +6,27 @@
 package server
 
 import (
+	"context"
 	"testing"
 
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/bcrypt"
 )
 
+// testHasher hashes passwords as cheaply as possible.
+var testHasher = credentials.NewHasher(&config.PasswordHashing{Algorithm: config.BCrypt, Cost: bcrypt.MinCost}, 4096)
+
 func authTestSetup(user *model.User) *c2s.MockStream {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 
-	storage.Instance().InsertOrUpdateUser(user)
+	storage.Instance().InsertOrUpdateUser(context.Background(), user)
 
 	jid, _ := xml.NewJID("mariana", "localhost", "res", true)
 
@@ -0,0 +1,147 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+)
+
+const csiNamespace = "urn:xmpp:csi:0"
+
+const chatStatesNamespace = "http://jabber.org/protocol/chatstates"
+
+// defaultCSIMaxQueueSize is the maximum number of stanzas an inactive
+// stream can hold back whenever not configured.
+const defaultCSIMaxQueueSize = 100
+
+// clientState represents client state indication (XEP-0352) session state.
+// It's only accessed from within the stream actor.
+type clientState struct {
+	inactive bool
+	queued   []csiQueued // held back stanzas, least recently updated first
+}
+
+// csiQueued represents a low importance stanza held back
+// until client becomes active again.
+type csiQueued struct {
+	key     string
+	element xml.Element
+}
+
+// isClientStateAvailable returns whether or not client
+// state indication can be used over the stream.
+func (s *serverStream) isClientStateAvailable() bool {
+	_, ok := s.cfg.Modules["csi"]
+	return ok
+}
+
+// handleClientState processes a client state indication element,
+// returning false if elem is not one.
+func (s *serverStream) handleClientState(elem xml.Element) bool {
+	if elem.Namespace() != csiNamespace || !s.isClientStateAvailable() {
+		return false
+	}
+	switch elem.Name() {
+	case "active":
+		s.setClientActive()
+	case "inactive":
+		s.csi.inactive = true
+		if s.ping != nil {
+			s.ping.SetInactive(true)
+		}
+	default:
+		s.terminate(streamerror.ErrUnsupportedStanzaType, "")
+	}
+	return true
+}
+
+// setClientActive flushes every held back stanza,
+// writing them right away from now on.
+func (s *serverStream) setClientActive() {
+	if !s.csi.inactive {
+		return
+	}
+	s.csi.inactive = false
+	s.flushClientState()
+	if s.ping != nil {
+		s.ping.SetInactive(false)
+	}
+}
+
+// deferElement holds back a low importance stanza addressed to an inactive
+// client as of configured policy, returning false if it has to be written
+// right away. Any other stanza gets held back ones flushed ahead of it,
+// so that delivery order is preserved and it's never delayed.
+func (s *serverStream) deferElement(element xml.Element) bool {
+	if !isStanzaElement(element) {
+		return false
+	}
+	key := csiQueueKey(element)
+	if len(key) == 0 {
+		s.flushClientState()
+		return false
+	}
+	if s.cfg.ModCSI.Policy == config.DropWhileInactive {
+		stats.Default().Counter("csi/dropped", "stanzas").Inc()
+		return true
+	}
+	// only the most recent stanza is kept per sender and kind
+	for i, q := range s.csi.queued {
+		if q.key == key {
+			s.csi.queued = append(s.csi.queued[:i], s.csi.queued[i+1:]...)
+			break
+		}
+	}
+	s.csi.queued = append(s.csi.queued, csiQueued{key: key, element: element})
+	stats.Default().Counter("csi/queued", "stanzas").Inc()
+
+	maxQueueSize := s.cfg.ModCSI.MaxQueueSize
+	if maxQueueSize == 0 {
+		maxQueueSize = defaultCSIMaxQueueSize
+	}
+	if len(s.csi.queued) > maxQueueSize {
+		s.flushClientState()
+	}
+	return true
+}
+
+// flushClientState writes every held back stanza.
+func (s *serverStream) flushClientState() {
+	queued := s.csi.queued
+	s.csi.queued = nil
+	for _, q := range queued {
+		s.deliverElement(q.element)
+	}
+	if len(queued) > 0 {
+		stats.Default().Counter("csi/flushed", "stanzas").Add(int64(len(queued)))
+	}
+}
+
+// csiQueueKey returns the key a low importance stanza is held back by,
+// that is, presence updates and chat state notifications, identifying
+// its sender and kind. It returns an empty key for any other stanza.
+func csiQueueKey(element xml.Element) string {
+	switch element.Name() {
+	case "presence":
+		switch element.Type() {
+		case "", xml.AvailableType, xml.UnavailableType:
+			return "presence/" + element.From()
+		}
+	case "message":
+		if element.Type() == xml.ErrorType || element.FindElement("body") != nil || element.FindElement("subject") != nil {
+			break
+		}
+		for _, child := range element.Elements() {
+			if child.Namespace() == chatStatesNamespace {
+				return "chatstate/" + element.From()
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,262 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"context"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClientState_Features(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	// not offered unless enabled...
+	_, conn := tUtilStreamInit()
+	features := tUtilStreamMgmtAuthenticate(conn, t)
+	require.Nil(t, features.FindElementNamespace("csi", csiNamespace))
+
+	_, conn = tUtilStreamMgmtInit("abcd5678", tUtilClientStateConfig(config.QueueWhileInactive, 0))
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features = conn.ClientReadElement()
+	require.Nil(t, features.FindElementNamespace("csi", csiNamespace))
+
+	// ...and only offered once authenticated
+	tUtilStreamAuthenticate(conn, t)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features = conn.ClientReadElement()
+	require.NotNil(t, features.FindElementNamespace("csi", csiNamespace))
+}
+
+func TestClientState_Queue(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234", tUtilClientStateConfig(config.QueueWhileInactive, 0))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+
+	romeo, _ := xml.NewJID("romeo", "localhost", "orchard", true)
+	juliet, _ := xml.NewJID("juliet", "localhost", "balcony", true)
+	to, _ := xml.NewJID("user", "localhost", "balcony", true)
+
+	tUtilClientStateSetInactive(conn, t)
+
+	// only the most recent presence is kept per contact...
+	stm.SendElement(xml.NewPresence(romeo, to, xml.AvailableType))
+	stm.SendElement(xml.NewPresence(juliet, to, xml.AvailableType))
+	away := xml.NewPresence(romeo, to, xml.AvailableType)
+	away.AppendElement(tUtilClientStateShow("away"))
+	stm.SendElement(away)
+	stm.SendElement(tUtilClientStateChatState(romeo, to, "composing"))
+	stm.SendElement(tUtilClientStateChatState(romeo, to, "paused"))
+	require.Equal(t, 3, tUtilClientStateQueued(stm))
+
+	// ...and held back ones flushed ahead of any other stanza
+	msg := tUtilStreamMgmtMessage(to)
+	stm.SendElement(msg)
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, juliet.String(), elem.From())
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, romeo.String(), elem.From())
+	require.NotNil(t, elem.FindElement("show"))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.NotNil(t, elem.FindElement("paused"))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Equal(t, 0, tUtilClientStateQueued(stm))
+
+	// becoming active flushes held back stanzas
+	stm.SendElement(xml.NewPresence(juliet, to, xml.UnavailableType))
+	require.Equal(t, 1, tUtilClientStateQueued(stm))
+
+	conn.ClientWriteBytes([]byte(`<active xmlns="urn:xmpp:csi:0"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.UnavailableType, elem.Type())
+
+	stm.SendElement(xml.NewPresence(romeo, to, xml.AvailableType))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, 0, tUtilClientStateQueued(stm))
+}
+
+func TestClientState_QueueOverflow(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234", tUtilClientStateConfig(config.QueueWhileInactive, 2))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+
+	to, _ := xml.NewJID("user", "localhost", "balcony", true)
+
+	tUtilClientStateSetInactive(conn, t)
+
+	for _, username := range []string{"romeo", "juliet", "mercutio"} {
+		from, _ := xml.NewJID(username, "localhost", "garden", true)
+		stm.SendElement(xml.NewPresence(from, to, xml.AvailableType))
+	}
+	for _, username := range []string{"romeo", "juliet", "mercutio"} {
+		elem := conn.ClientReadElement()
+		require.Equal(t, "presence", elem.Name())
+		require.Equal(t, username+"@localhost/garden", elem.From())
+	}
+	require.Equal(t, 0, tUtilClientStateQueued(stm))
+}
+
+func TestClientState_Drop(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234", tUtilClientStateConfig(config.DropWhileInactive, 0))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+
+	romeo, _ := xml.NewJID("romeo", "localhost", "orchard", true)
+	to, _ := xml.NewJID("user", "localhost", "balcony", true)
+
+	tUtilClientStateSetInactive(conn, t)
+
+	stm.SendElement(xml.NewPresence(romeo, to, xml.AvailableType))
+	stm.SendElement(tUtilClientStateChatState(romeo, to, "composing"))
+	require.Equal(t, 0, tUtilClientStateQueued(stm))
+
+	msg := tUtilStreamMgmtMessage(to)
+	stm.SendElement(msg)
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msg.ID(), elem.ID())
+}
+
+func TestClientState_Unsupported(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	_, conn := tUtilStreamMgmtInit("abcd1234", tUtilClientStateConfig(config.QueueWhileInactive, 0))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+
+	conn.ClientWriteBytes([]byte(`<idle xmlns="urn:xmpp:csi:0"/>`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.FindElement(streamerror.ErrUnsupportedStanzaType.Error()))
+	conn.WaitClose()
+}
+
+func TestClientState_QueueKey(t *testing.T) {
+	from, _ := xml.NewJID("romeo", "localhost", "orchard", true)
+	to, _ := xml.NewJID("user", "localhost", "balcony", true)
+
+	probe := xml.NewPresence(from, to, xml.ProbeType)
+	available := xml.NewPresence(from, to, xml.AvailableType)
+	available.RemoveAttribute("type")
+
+	headline := xml.NewMessageType(uuid.New(), xml.HeadlineType)
+	headline.SetFromJID(from)
+	headline.SetToJID(to)
+
+	var tests = []struct {
+		element xml.Element
+		key     string
+	}{
+		{available, "presence/romeo@localhost/orchard"},
+		{xml.NewPresence(from, to, xml.UnavailableType), "presence/romeo@localhost/orchard"},
+		{xml.NewPresence(from, to, xml.SubscribeType), ""},
+		{probe, ""},
+		{tUtilClientStateChatState(from, to, "gone"), "chatstate/romeo@localhost/orchard"},
+		{tUtilStreamMgmtMessage(to), ""},
+		{headline, ""},
+		{xml.NewIQType(uuid.New(), xml.GetType), ""},
+	}
+	for _, tt := range tests {
+		require.Equal(t, tt.key, csiQueueKey(tt.element))
+	}
+}
+
+func tUtilClientStateConfig(policy config.CSIPolicy, maxQueueSize int) *config.Server {
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["csi"] = struct{}{}
+	cfg.ModCSI = config.ModCSI{Policy: policy, MaxQueueSize: maxQueueSize}
+	return cfg
+}
+
+// tUtilClientStateSetInactive flags client as inactive, pinging
+// server afterwards so that it has been processed once it returns.
+func tUtilClientStateSetInactive(conn *transport.MockConn, t *testing.T) {
+	conn.ClientWriteBytes([]byte(`<inactive xmlns="urn:xmpp:csi:0"/>`))
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="ping_1" to="localhost"><ping xmlns="urn:xmpp:ping"/></iq>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, xml.ResultType, elem.Type())
+}
+
+func tUtilClientStateQueued(stm *serverStream) int {
+	var n int
+	stm.runAndWait(func() { n = len(stm.csi.queued) })
+	return n
+}
+
+func tUtilClientStateShow(show string) xml.Element {
+	elem := xml.NewElementName("show")
+	elem.SetText(show)
+	return elem
+}
+
+func tUtilClientStateChatState(from, to *xml.JID, state string) *xml.Message {
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	msg.AppendElement(xml.NewElementNamespace(state, chatStatesNamespace))
+	return msg
+}
@@ -10,4 +10,26 @@ import "io"
 // Compressor represents a stream compression method.
 type Compressor interface {
 	io.ReadWriter
+
+	// Flush writes any pending compressed data.
+	Flush() error
+
+	// Stats returns compression traffic statistics.
+	Stats() Stats
+}
+
+// Stats represents compression traffic statistics.
+type Stats struct {
+	RawIn         int64
+	CompressedIn  int64
+	RawOut        int64
+	CompressedOut int64
+}
+
+// Ratio returns outbound compressed to raw bytes ratio.
+func (s Stats) Ratio() float64 {
+	if s.RawOut == 0 {
+		return 0
+	}
+	return float64(s.CompressedOut) / float64(s.RawOut)
 }
@@ -8,25 +8,33 @@ package compress
 import (
 	"compress/zlib"
 	"io"
+	"sync/atomic"
 
 	"github.com/ortuman/jackal/config"
 )
 
 // ZlibCompressor represents zlib stream compressor.
 type ZlibCompressor struct {
-	level int
-	w     io.Writer
-	r     io.Reader
-	zw    io.Writer
-	zr    io.Reader
+	rawIn         int64 // 64-bit aligned for atomic access
+	compressedIn  int64
+	rawOut        int64
+	compressedOut int64
+
+	level        int
+	minFlushSize int
+	pending      int
+	w            io.Writer
+	r            io.Reader
+	zw           *zlib.Writer
+	zr           io.Reader
 }
 
 // NewZlibCompressor returns a new zlib compression method.
 func NewZlibCompressor(reader io.Reader, writer io.Writer, level config.CompressionLevel) *ZlibCompressor {
-	z := &ZlibCompressor{
-		w: writer,
-		r: reader,
-	}
+	z := &ZlibCompressor{}
+	z.w = &countingWriter{w: writer, n: &z.compressedOut}
+	z.r = &countingReader{r: reader, n: &z.compressedIn}
+
 	switch level {
 	case config.DefaultCompression:
 		z.level = zlib.DefaultCompression
@@ -40,6 +48,18 @@ func NewZlibCompressor(reader io.Reader, writer io.Writer, level config.Compress
 	return z
 }
 
+// SetMinFlushSize sets the amount of written bytes below which
+// compressed data is kept buffered until explicitly flushed.
+// A zero value flushes compressed data on every write.
+func (z *ZlibCompressor) SetMinFlushSize(size int) {
+	z.minFlushSize = size
+}
+
+// Pending returns the number of written bytes not yet flushed.
+func (z *ZlibCompressor) Pending() int {
+	return z.pending
+}
+
 func (z *ZlibCompressor) Write(p []byte) (int, error) {
 	if z.zw == nil {
 		zw, err := zlib.NewWriterLevel(z.w, z.level)
@@ -48,9 +68,25 @@ func (z *ZlibCompressor) Write(p []byte) (int, error) {
 		}
 		z.zw = zw
 	}
-	zw := z.zw.(*zlib.Writer)
-	defer zw.Flush()
-	return zw.Write(p)
+	n, err := z.zw.Write(p)
+	atomic.AddInt64(&z.rawOut, int64(n))
+	z.pending += n
+	if err != nil {
+		return n, err
+	}
+	if z.pending >= z.minFlushSize {
+		return n, z.Flush()
+	}
+	return n, nil
+}
+
+// Flush writes any pending compressed data to the underlying writer.
+func (z *ZlibCompressor) Flush() error {
+	if z.zw == nil || z.pending == 0 {
+		return nil
+	}
+	z.pending = 0
+	return z.zw.Flush()
 }
 
 func (z *ZlibCompressor) Read(p []byte) (int, error) {
@@ -61,5 +97,39 @@ func (z *ZlibCompressor) Read(p []byte) (int, error) {
 		}
 		z.zr = zr
 	}
-	return z.zr.Read(p)
+	n, err := z.zr.Read(p)
+	atomic.AddInt64(&z.rawIn, int64(n))
+	return n, err
+}
+
+// Stats returns compressor traffic statistics.
+func (z *ZlibCompressor) Stats() Stats {
+	return Stats{
+		RawIn:         atomic.LoadInt64(&z.rawIn),
+		CompressedIn:  atomic.LoadInt64(&z.compressedIn),
+		RawOut:        atomic.LoadInt64(&z.rawOut),
+		CompressedOut: atomic.LoadInt64(&z.compressedOut),
+	}
+}
+
+type countingWriter struct {
+	w io.Writer
+	n *int64
+}
+
+func (cw *countingWriter) Write(p []byte) (int, error) {
+	n, err := cw.w.Write(p)
+	atomic.AddInt64(cw.n, int64(n))
+	return n, err
+}
+
+type countingReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countingReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
 }
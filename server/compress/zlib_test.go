@@ -7,6 +7,7 @@ package compress
 
 import (
 	"bytes"
+	"io"
 	"io/ioutil"
 	"testing"
 
@@ -104,3 +105,74 @@ func TestInvalidInflate(t *testing.T) {
 	_, err := ioutil.ReadAll(compressor)
 	require.NotNil(t, err)
 }
+
+func TestZlibBuffering(t *testing.T) {
+	wBuf := new(bytes.Buffer)
+	compressor := NewZlibCompressor(nil, wBuf, config.DefaultCompression)
+	compressor.SetMinFlushSize(512)
+
+	stanza := []byte(tUtilChatStateStanza)
+	var raw []byte
+	for len(raw)+len(stanza) < 512 {
+		compressor.Write(stanza)
+		raw = append(raw, stanza...)
+	}
+	// nothing but zlib header has been flushed yet
+	require.Equal(t, len(raw), compressor.Pending())
+	require.True(t, wBuf.Len() <= 2)
+
+	// explicit flush
+	require.Nil(t, compressor.Flush())
+	require.Equal(t, 0, compressor.Pending())
+	flushed := wBuf.Len()
+	require.True(t, flushed > 2)
+
+	// flushing with no pending data is a no-op
+	require.Nil(t, compressor.Flush())
+	require.Equal(t, flushed, wBuf.Len())
+
+	// reaching minimum flush size
+	compressor.Write(make([]byte, 512))
+	require.Equal(t, 0, compressor.Pending())
+	raw = append(raw, make([]byte, 512)...)
+
+	decompressor := NewZlibCompressor(bytes.NewReader(wBuf.Bytes()), nil, config.DefaultCompression)
+	b := make([]byte, len(raw))
+	_, err := io.ReadFull(decompressor, b)
+	require.Nil(t, err)
+	require.Equal(t, raw, b)
+
+	st := compressor.Stats()
+	require.Equal(t, int64(len(raw)), st.RawOut)
+	require.Equal(t, int64(wBuf.Len()), st.CompressedOut)
+	require.True(t, st.Ratio() > 0 && st.Ratio() < 1)
+
+	st = decompressor.Stats()
+	require.Equal(t, int64(len(raw)), st.RawIn)
+	require.Equal(t, int64(wBuf.Len()), st.CompressedIn)
+}
+
+const tUtilChatStateStanza = `<message to="noelia@jackal.im/garden" type="chat"><composing xmlns="http://jabber.org/protocol/chatstates"/></message>`
+
+// BenchmarkZlibChatStates measures compressing a chat-state burst flushing every stanza.
+func BenchmarkZlibChatStates(b *testing.B) {
+	benchmarkZlibChatStates(b, 0)
+}
+
+// BenchmarkZlibChatStatesBuffered measures compressing a chat-state burst coalescing stanzas.
+func BenchmarkZlibChatStatesBuffered(b *testing.B) {
+	benchmarkZlibChatStates(b, 4096)
+}
+
+func benchmarkZlibChatStates(b *testing.B, minFlushSize int) {
+	stanza := []byte(tUtilChatStateStanza)
+	compressor := NewZlibCompressor(nil, ioutil.Discard, config.DefaultCompression)
+	compressor.SetMinFlushSize(minFlushSize)
+
+	b.SetBytes(int64(len(stanza)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		compressor.Write(stanza)
+	}
+	compressor.Flush()
+}
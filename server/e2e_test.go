@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/client"
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+const e2eAddr = "localhost:5124"
+
+func TestE2E_RegisterLoginOfflineMessage(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	tUtilE2EServer(t)
+	defer Shutdown()
+
+	// register...
+	tUtilE2ERegister(t, "benvolio", "m0nt4gue")
+	tUtilE2ERegister(t, "rosaline", "c4pul3t")
+
+	// login and message an offline user...
+	benvolio, err := client.Dial(tUtilE2EConfig("benvolio", "m0nt4gue", client.MechanismScramSHA256))
+	require.Nil(t, err)
+	defer benvolio.Close()
+	require.Equal(t, "benvolio@localhost/e2e", benvolio.JID().String())
+
+	require.Nil(t, benvolio.Send(xml.NewElementName("presence")))
+
+	msg := xml.NewElementName("message")
+	msg.SetID(uuid.New())
+	msg.SetTo("rosaline@localhost")
+	body := xml.NewElementName("body")
+	body.SetText("Where is Romeo?")
+	msg.AppendElement(body)
+	require.Nil(t, benvolio.Send(msg))
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "rosaline")
+		if cnt == 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "message not stored offline")
+		time.Sleep(time.Millisecond * 20)
+	}
+
+	// offline messages are flushed on initial presence...
+	rosaline, err := client.Dial(tUtilE2EConfig("rosaline", "c4pul3t", client.MechanismPlain))
+	require.Nil(t, err)
+	defer rosaline.Close()
+
+	require.Nil(t, rosaline.Send(xml.NewElementName("presence")))
+	for {
+		elem, err := rosaline.Receive()
+		require.Nil(t, err)
+		if elem.Name() != "message" {
+			continue
+		}
+		require.Equal(t, msg.ID(), elem.ID())
+		require.Equal(t, "benvolio@localhost/e2e", elem.From())
+		require.Equal(t, "Where is Romeo?", elem.FindElement("body").Text())
+		break
+	}
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "rosaline")
+	require.Equal(t, 0, cnt)
+
+	// wrong credentials...
+	_, err = client.Dial(tUtilE2EConfig("rosaline", "r0m30", client.MechanismScramSHA1))
+	require.Equal(t, client.ErrAuthenticationFailed, err)
+}
+
+func tUtilE2EServer(t *testing.T) {
+	cfg := config.Server{
+		ID: "srv-e2e",
+		TLS: config.TLS{
+			PrivKeyFile: "../testdata/cert/test.server.key",
+			CertFile:    "../testdata/cert/test.server.crt",
+		},
+		Transport: config.Transport{
+			Type:           config.SocketTransportType,
+			Port:           5124,
+			ConnectTimeout: 5,
+			KeepAlive:      60,
+		},
+		SASL:            []string{"plain", "scram_sha_1", "scram_sha_256"},
+		ScramIterations: 4096,
+		Modules: map[string]struct{}{
+			"roster":       {},
+			"registration": {},
+			"offline":      {},
+		},
+		ModOffline:      config.ModOffline{QueueSize: 10},
+		ModRegistration: config.ModRegistration{AllowRegistration: true},
+	}
+	go Initialize([]config.Server{cfg}, 0)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		conn, err := net.Dial("tcp", e2eAddr)
+		if err == nil {
+			conn.Close()
+			return
+		}
+		require.True(t, time.Now().Before(deadline), "server not listening")
+		time.Sleep(time.Millisecond * 20)
+	}
+}
+
+func tUtilE2EConfig(username, password, mechanism string) client.Config {
+	return client.Config{
+		Addr:      e2eAddr,
+		Domain:    "localhost",
+		Username:  username,
+		Password:  password,
+		Resource:  "e2e",
+		TLS:       &tls.Config{InsecureSkipVerify: true},
+		Mechanism: mechanism,
+		Timeout:   time.Second * 5,
+	}
+}
+
+func tUtilE2ERegister(t *testing.T, username, password string) {
+	c, err := client.Connect(tUtilE2EConfig("", "", ""))
+	require.Nil(t, err)
+	defer c.Close()
+
+	iq := xml.NewIQType(uuid.New(), xml.SetType)
+	q := xml.NewElementNamespace("query", "jabber:iq:register")
+	u := xml.NewElementName("username")
+	u.SetText(username)
+	p := xml.NewElementName("password")
+	p.SetText(password)
+	q.AppendElements([]xml.Element{u, p})
+	iq.AppendElement(q)
+	require.Nil(t, c.Send(iq))
+
+	elem, err := c.Receive()
+	require.Nil(t, err)
+	require.Equal(t, iq.ID(), elem.ID())
+	require.Equal(t, xml.ResultType, elem.Type())
+}
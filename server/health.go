@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/ortuman/jackal/maintenance"
+)
+
+const (
+	healthStatusOK          = "ok"
+	healthStatusMaintenance = "maintenance"
+)
+
+var registerDebugHandlersOnce sync.Once
+
+type healthStatus struct {
+	Status      string              `json:"status"`
+	Maintenance *maintenance.Status `json:"maintenance,omitempty"`
+}
+
+// registerDebugHandlers registers health and admin handlers
+// served through the debug port.
+func registerDebugHandlers() {
+	registerDebugHandlersOnce.Do(func() {
+		http.HandleFunc("/healthz", serveHealth)
+		http.HandleFunc("/debug/maintenance", maintenance.ServeHTTP)
+	})
+}
+
+func serveHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+		return
+	}
+	hs := healthStatus{Status: healthStatusOK}
+	if st := maintenance.Current(); st.Enabled {
+		hs.Status = healthStatusMaintenance
+		hs.Maintenance = &st
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(&hs)
+}
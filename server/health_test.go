@@ -0,0 +1,44 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/maintenance"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHealth(t *testing.T) {
+	get := func() healthStatus {
+		rec := httptest.NewRecorder()
+		serveHealth(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		var hs healthStatus
+		require.Nil(t, json.NewDecoder(rec.Body).Decode(&hs))
+		return hs
+	}
+	require.Equal(t, healthStatus{Status: healthStatusOK}, get())
+
+	until := time.Now().Add(time.Hour)
+	maintenance.Enable("Storage migration", until)
+	defer maintenance.Disable()
+
+	hs := get()
+	require.Equal(t, healthStatusMaintenance, hs.Status)
+	require.NotNil(t, hs.Maintenance)
+	require.Equal(t, "Storage migration", hs.Maintenance.Reason)
+	require.True(t, until.Equal(*hs.Maintenance.Until))
+
+	rec := httptest.NewRecorder()
+	serveHealth(rec, httptest.NewRequest(http.MethodPost, "/healthz", nil))
+	require.Equal(t, http.StatusMethodNotAllowed, rec.Code)
+}
@@ -0,0 +1,238 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/faulty"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+const loadTestReadTimeout = time.Second * 10
+
+var loadTestStanzas = []string{"open", "auth", "bind", "session", "message"}
+
+func TestLoad_FaultyStorage(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	var fs *faulty.Storage
+	storage.Decorate(func(s storage.Storage) storage.Storage {
+		fs = faulty.New(s)
+		return fs
+	})
+	require.Nil(t, fs.Enable(map[string]faulty.Fault{"FetchUser": {Latency: time.Millisecond * 30}}))
+
+	r := runLoadTest(10, 2)
+	require.Equal(t, 0, r.failures)
+	require.Equal(t, 40, len(r.latencies["open"])) // opened again after authenticating
+	for _, stanza := range loadTestStanzas[1:] {
+		require.Equal(t, 20, len(r.latencies[stanza]))
+	}
+	require.True(t, r.percentile("auth", 50) >= time.Millisecond*30)
+	require.True(t, r.percentile("message", 50) < time.Millisecond*30)
+	require.Equal(t, int64(20), fs.Stats()["FetchUser"].Calls)
+
+	// login fails on storage errors
+	require.Nil(t, fs.Enable(map[string]faulty.Fault{"FetchUser": {ErrorRate: 1}}))
+	r = runLoadTest(5, 1)
+	require.Equal(t, 5, r.failures)
+	require.Equal(t, int64(5), fs.Stats()["FetchUser"].Errors)
+}
+
+func BenchmarkLoad_Healthy(b *testing.B) {
+	benchmarkLoad(b, nil)
+}
+
+func BenchmarkLoad_SlowStorage(b *testing.B) {
+	benchmarkLoad(b, map[string]faulty.Fault{
+		faulty.AnyOperation: {Latency: time.Millisecond * 50, Jitter: time.Millisecond * 450},
+	})
+}
+
+func benchmarkLoad(b *testing.B, faults map[string]faulty.Fault) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	if faults != nil {
+		storage.Decorate(func(s storage.Storage) storage.Storage {
+			fs := faulty.New(s)
+			fs.Enable(faults)
+			return fs
+		})
+	}
+	b.ResetTimer()
+	r := runLoadTest(100, b.N)
+	b.StopTimer()
+	b.Log(r)
+}
+
+// loadReport represents the stanza round trip latencies
+// observed while running a load test.
+type loadReport struct {
+	mu        sync.Mutex
+	latencies map[string][]time.Duration
+	failures  int
+}
+
+func (r *loadReport) add(stanza string, latency time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.latencies[stanza] = append(r.latencies[stanza], latency)
+}
+
+func (r *loadReport) fail() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.failures++
+}
+
+func (r *loadReport) percentile(stanza string, p int) time.Duration {
+	r.mu.Lock()
+	latencies := append([]time.Duration(nil), r.latencies[stanza]...)
+	r.mu.Unlock()
+	if len(latencies) == 0 {
+		return 0
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	return latencies[(len(latencies)-1)*p/100]
+}
+
+func (r *loadReport) String() string {
+	s := fmt.Sprintf("failures: %d", r.failures)
+	for _, stanza := range loadTestStanzas {
+		s += fmt.Sprintf("\n%-8s p50: %v, p90: %v, p99: %v", stanza,
+			r.percentile(stanza, 50), r.percentile(stanza, 90), r.percentile(stanza, 99))
+	}
+	return s
+}
+
+// runLoadTest drives sessions concurrent c2s sessions through
+// cycles login, message and logout cycles each.
+func runLoadTest(sessions, cycles int) *loadReport {
+	r := &loadReport{latencies: make(map[string][]time.Duration)}
+
+	var wg sync.WaitGroup
+	for i := 0; i < sessions; i++ {
+		username := fmt.Sprintf("load%d", i)
+		storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: username, Password: "pencil"})
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < cycles; j++ {
+				if err := runLoadSession(username, r); err != nil {
+					r.fail()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	return r
+}
+
+func runLoadSession(username string, r *loadReport) error {
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newStream(uuid.New(), tr, tUtilStreamDefaultConfig())
+	c2s.Instance().RegisterStream(stm)
+
+	err := loadSessionCycle(conn, username, r)
+	if err != nil {
+		stm.Disconnect(nil)
+	}
+	conn.WaitCloseWithTimeout(loadTestReadTimeout)
+	return err
+}
+
+func loadSessionCycle(conn *transport.MockConn, username string, r *loadReport) error {
+	jid := username + "@localhost/load"
+
+	// roundTrip writes b, returning the last of n read elements.
+	roundTrip := func(stanza string, b string, n int) (xml.Element, error) {
+		start := time.Now()
+		conn.ClientWriteBytes([]byte(b))
+		var elem xml.Element
+		for i := 0; i < n; i++ {
+			var err error
+			if elem, err = loadReadElement(conn); err != nil {
+				return nil, err
+			}
+		}
+		r.add(stanza, time.Since(start))
+		return elem, nil
+	}
+	openStream := `<?xml version="1.0"?><stream:stream xmlns:stream="http://etherx.jabber.org/streams" version="1.0" xmlns="jabber:client" to="localhost" xml:lang="en">`
+	if _, err := roundTrip("open", openStream, 2); err != nil {
+		return err
+	}
+	credentials := base64.StdEncoding.EncodeToString([]byte("\x00" + username + "\x00pencil"))
+	elem, err := roundTrip("auth", `<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">`+credentials+`</auth>`, 1)
+	if err != nil {
+		return err
+	}
+	if elem.Name() != "success" {
+		return errors.New("authentication failed")
+	}
+	if _, err := roundTrip("open", openStream, 2); err != nil {
+		return err
+	}
+	bind := `<iq type="set" id="bind_1"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><resource>load</resource></bind></iq>`
+	if elem, err = roundTrip("bind", bind, 1); err != nil {
+		return err
+	}
+	if elem.Type() != xml.ResultType {
+		return errors.New("resource binding failed")
+	}
+	session := `<iq type="set" id="session_1"><session xmlns="urn:ietf:params:xml:ns:xmpp-session"/></iq>`
+	if elem, err = roundTrip("session", session, 1); err != nil {
+		return err
+	}
+	if elem.Type() != xml.ResultType {
+		return errors.New("session start failed")
+	}
+	message := `<message type="chat" id="` + uuid.New() + `" to="` + jid + `"><body>ping</body></message>`
+	if elem, err = roundTrip("message", message, 1); err != nil {
+		return err
+	}
+	if elem.Name() != "message" {
+		return errors.New("message not delivered")
+	}
+	conn.ClientWriteBytes([]byte("</stream:stream>"))
+	return nil
+}
+
+func loadReadElement(conn *transport.MockConn) (xml.Element, error) {
+	elemCh := make(chan xml.Element, 1)
+	go func() { elemCh <- conn.ClientReadElement() }()
+	select {
+	case elem := <-elemCh:
+		return elem, nil
+	case <-time.After(loadTestReadTimeout):
+		return nil, errors.New("read timeout")
+	}
+}
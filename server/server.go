@@ -14,14 +14,22 @@ import (
 	"net/url"
 	"strconv"
 	"sync/atomic"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/module"
 	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
 )
 
+// shutdownTimeout is the maximum time to wait for connected
+// clients to be disconnected on shutdown.
+const shutdownTimeout = time.Second * 5
+
 type server struct {
 	ln         net.Listener
 	wsSrv      *http.Server
@@ -32,10 +40,11 @@ type server struct {
 }
 
 var (
-	servers     = map[string]*server{}
-	shutdownCh  = make(chan bool)
-	debugSrv    *http.Server
-	initialized uint32
+	servers        = map[string]*server{}
+	shutdownCh     = make(chan bool)
+	shutdownDoneCh = make(chan bool)
+	debugSrv       *http.Server
+	initialized    uint32
 )
 
 // Initialize spawns a connection listener for every server configuration.
@@ -43,8 +52,12 @@ func Initialize(srvConfigurations []config.Server, debugPort int) {
 	if !atomic.CompareAndSwapUint32(&initialized, 0, 1) {
 		return
 	}
+	stats.Default().RegisterGauge("compression/ratio", "percent", compressionRatio)
+	stats.Default().RegisterGauge("streams/connected", "streams", streamsConnected)
+
 	if debugPort > 0 {
 		// initialize debug service
+		registerDebugHandlers()
 		go func() {
 			debugSrv = &http.Server{Addr: fmt.Sprintf(":%d", debugPort)}
 			debugSrv.ListenAndServe()
@@ -66,20 +79,50 @@ func Initialize(srvConfigurations []config.Server, debugPort int) {
 		}
 		delete(servers, k)
 	}
+	// notify connected clients
+	terminateStreams()
+	persistRestoredSessions()
+
+	shutdownDoneCh <- true
 }
 
-// Shutdown closes every server listener.
-// This method should be used only for testing purposes.
+// Shutdown closes every server listener and terminates
+// every connected client stream.
 func Shutdown() {
 	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
 		if debugSrv != nil {
 			debugSrv.Close()
 		}
 		shutdownCh <- true
+		<-shutdownDoneCh
+	}
+}
+
+func terminateStreams() {
+	for _, strm := range c2s.Instance().Streams() {
+		strm.Terminate(streamerror.ErrSystemShutdown, "")
+	}
+	// wait until every stream gets unregistered
+	deadline := time.Now().Add(shutdownTimeout)
+	for len(c2s.Instance().Streams()) > 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond * 50)
+	}
+}
+
+// Reload applies the reloadable values of every server configuration,
+// that is, the client visible limits advertised through disco info.
+// Already running streams keep enforcing the limits they were started with.
+func Reload(srvConfigurations []config.Server) {
+	for i := 0; i < len(srvConfigurations); i++ {
+		cfg := &srvConfigurations[i]
+		module.UpdateServerLimits(cfg.ID, module.ServerLimitsFromConfig(cfg))
 	}
 }
 
 func initializeServer(srvConfig *config.Server) {
+	module.UpdateServerLimits(srvConfig.ID, module.ServerLimitsFromConfig(srvConfig))
+	restoreSessions(srvConfig)
+
 	srv := &server{cfg: srvConfig}
 	servers[srvConfig.ID] = srv
 	go srv.start()
@@ -14,12 +14,18 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/module"
+	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/stretchr/testify/require"
 )
 
 func TestSocketServer(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
 	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
 	defer Shutdown()
 
 	go func() {
@@ -59,7 +65,11 @@ func TestSocketServer(t *testing.T) {
 }
 
 func TestWebSocketServer(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
 	c2s.Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer c2s.Shutdown()
 	defer Shutdown()
 
 	go func() {
@@ -96,3 +106,16 @@ func TestWebSocketServer(t *testing.T) {
 	}
 	Initialize([]config.Server{cfg}, 0)
 }
+
+func TestServerReload(t *testing.T) {
+	cfg := config.Server{
+		ID:           "srv-reload",
+		LargePayload: config.LargePayload{MaxStanzaSize: 1024},
+	}
+	Reload([]config.Server{cfg})
+	require.Equal(t, 1024, module.CurrentServerLimits("srv-reload").MaxStanzaSize)
+
+	cfg.LargePayload.MaxStanzaSize = 2048
+	Reload([]config.Server{cfg})
+	require.Equal(t, 2048, module.CurrentServerLimits("srv-reload").MaxStanzaSize)
+}
@@ -0,0 +1,160 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"regexp"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/xml"
+)
+
+const stanzaDumpMaxSummaryLen = 512
+
+const stanzaDumpTimeFormat = "15:04:05.000"
+
+var passwordRegexp = regexp.MustCompile(`(?s)(<password[^>]*>).*?(</password>)`)
+
+const (
+	inboundDumpEntry  = "<-"
+	outboundDumpEntry = "->"
+	stateDumpEntry    = "**"
+)
+
+type stanzaDumpEntry struct {
+	t       time.Time
+	kind    string
+	summary string
+}
+
+// stanzaDump keeps track of the last stanzas exchanged over a stream,
+// to be flushed for post-mortem debugging on abnormal stream termination.
+// A nil stanzaDump is a valid disabled dump.
+type stanzaDump struct {
+	cfg     *config.StanzaDump
+	mu      sync.Mutex
+	entries []stanzaDumpEntry
+	next    int
+	full    bool
+}
+
+// newStanzaDump returns a new stanza dump, or nil if dumps are disabled.
+func newStanzaDump(cfg *config.StanzaDump) *stanzaDump {
+	if cfg.Size <= 0 {
+		return nil
+	}
+	return &stanzaDump{
+		cfg:     cfg,
+		entries: make([]stanzaDumpEntry, cfg.Size),
+	}
+}
+
+func (d *stanzaDump) inbound(elem xml.Element) {
+	if d == nil {
+		return
+	}
+	d.append(inboundDumpEntry, stanzaSummary(elem))
+}
+
+func (d *stanzaDump) outbound(elem xml.Element) {
+	if d == nil {
+		return
+	}
+	d.append(outboundDumpEntry, stanzaSummary(elem))
+}
+
+func (d *stanzaDump) state(state uint32) {
+	if d == nil {
+		return
+	}
+	d.append(stateDumpEntry, "state: "+stateString(state))
+}
+
+// flush writes dump content either to the configured file or to the log.
+func (d *stanzaDump) flush(streamID string, reason error) {
+	if d == nil {
+		return
+	}
+	buf := bytes.NewBuffer(nil)
+	fmt.Fprintf(buf, "stanza dump... (id: %s, reason: %v)\n", streamID, reason)
+
+	d.mu.Lock()
+	start, count := 0, d.next
+	if d.full {
+		start, count = d.next, len(d.entries)
+	}
+	for i := 0; i < count; i++ {
+		e := &d.entries[(start+i)%len(d.entries)]
+		fmt.Fprintf(buf, "%s %s %s\n", e.t.UTC().Format(stanzaDumpTimeFormat), e.kind, e.summary)
+	}
+	d.mu.Unlock()
+
+	if len(d.cfg.File) == 0 {
+		log.Warnf("%s", buf.String())
+		return
+	}
+	f, err := os.OpenFile(d.cfg.File, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		log.Error(err)
+	}
+}
+
+func (d *stanzaDump) append(kind, summary string) {
+	d.mu.Lock()
+	d.entries[d.next] = stanzaDumpEntry{t: time.Now(), kind: kind, summary: summary}
+	d.next++
+	if d.next == len(d.entries) {
+		d.next = 0
+		d.full = true
+	}
+	d.mu.Unlock()
+}
+
+// stanzaSummary returns a truncated representation of elem
+// with any credential redacted.
+func stanzaSummary(elem xml.Element) string {
+	var s string
+	if elem.Namespace() == saslNamespace && elem.TextLen() > 0 {
+		s = fmt.Sprintf(`<%s xmlns="%s">[redacted]</%s>`, elem.Name(), saslNamespace, elem.Name())
+	} else {
+		s = passwordRegexp.ReplaceAllString(elem.String(), "${1}[redacted]${2}")
+	}
+	if len(s) > stanzaDumpMaxSummaryLen {
+		s = s[:stanzaDumpMaxSummaryLen] + "...(truncated)"
+	}
+	return s
+}
+
+func stateString(state uint32) string {
+	switch state {
+	case connecting:
+		return "connecting"
+	case connected:
+		return "connected"
+	case authenticating:
+		return "authenticating"
+	case authenticated:
+		return "authenticated"
+	case sessionStarted:
+		return "session_started"
+	case hibernated:
+		return "hibernated"
+	case disconnected:
+		return "disconnected"
+	}
+	return ""
+}
@@ -0,0 +1,125 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStanzaDump_Disabled(t *testing.T) {
+	d := newStanzaDump(&config.StanzaDump{})
+	require.Nil(t, d)
+
+	// nil dumps must be no-ops
+	d.inbound(xml.NewElementName("message"))
+	d.outbound(xml.NewElementName("message"))
+	d.state(connected)
+	d.flush("abcd", nil)
+}
+
+func TestStanzaDump_RingBuffer(t *testing.T) {
+	dumpPath := "../testdata/stanza_dump_ring.log"
+	defer os.Remove(dumpPath)
+
+	d := newStanzaDump(&config.StanzaDump{Size: 2, File: dumpPath})
+	for _, id := range []string{"m1", "m2", "m3"} {
+		msg := xml.NewElementName("message")
+		msg.SetAttribute("id", id)
+		d.inbound(msg)
+	}
+	d.flush("abcd", errors.New("bye"))
+
+	b, _ := ioutil.ReadFile(dumpPath)
+	dump := string(b)
+	require.True(t, strings.Contains(dump, "id: abcd, reason: bye"))
+	require.False(t, strings.Contains(dump, `id="m1"`))
+	require.True(t, strings.Index(dump, `id="m2"`) < strings.Index(dump, `id="m3"`))
+}
+
+func TestStanzaDump_Summary(t *testing.T) {
+	auth := xml.NewElementNamespace("auth", saslNamespace)
+	auth.SetText("AGFsaWNlAHMzY3IzdA==")
+	require.Equal(t, `<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl">[redacted]</auth>`, stanzaSummary(auth))
+
+	iq := xml.NewElementName("iq")
+	q := xml.NewElementNamespace("query", "jabber:iq:register")
+	password := xml.NewElementName("password")
+	password.SetText("s3cr3t")
+	q.AppendElement(password)
+	iq.AppendElement(q)
+	s := stanzaSummary(iq)
+	require.False(t, strings.Contains(s, "s3cr3t"))
+	require.True(t, strings.Contains(s, "[redacted]"))
+
+	body := xml.NewElementName("body")
+	body.SetText(strings.Repeat("a", stanzaDumpMaxSummaryLen*2))
+	s = stanzaSummary(body)
+	require.True(t, strings.HasSuffix(s, "...(truncated)"))
+}
+
+func TestStream_StanzaDumpOnParseError(t *testing.T) {
+	dumpPath := "../testdata/stanza_dump.log"
+	defer os.Remove(dumpPath)
+
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.StanzaDump = config.StanzaDump{Size: 64, File: dumpPath}
+
+	conn := transport.NewMockConn()
+	stm := newStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="last_iq"><query xmlns="jabber:iq:version"/></iq>`))
+	_ = conn.ClientReadElement()
+
+	// parse error...
+	conn.ClientWriteBytes([]byte(`<message><<`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	conn.WaitClose()
+
+	b, err := ioutil.ReadFile(dumpPath)
+	require.Nil(t, err)
+	dump := string(b)
+	require.True(t, strings.Contains(dump, "reason: invalid-xml"))
+	require.True(t, strings.Contains(dump, "state: session_started"))
+	require.True(t, strings.Contains(dump, `id="last_iq"`))
+	require.True(t, strings.Contains(dump, "[redacted]"))
+	require.False(t, strings.Contains(dump, "dXNlcm5hbWU9")) // SASL response payload
+}
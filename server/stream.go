@@ -18,11 +18,18 @@ import (
 	"time"
 
 	"github.com/gorilla/websocket"
+	"github.com/ortuman/jackal/bounce"
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
+	"github.com/ortuman/jackal/featureflags"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/maintenance"
 	"github.com/ortuman/jackal/module"
+	"github.com/ortuman/jackal/rewrite"
 	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
 	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
@@ -35,6 +42,7 @@ const (
 	authenticating
 	authenticated
 	sessionStarted
+	hibernated
 	disconnected
 )
 
@@ -62,44 +70,73 @@ var (
 	errNotAuthenticated   = errors.New("user not authenticated")
 )
 
+// connectedStreams is the number of currently connected streams.
+var connectedStreams int64
+
 type serverStream struct {
-	lock             sync.RWMutex
-	cfg              *config.Server
-	connected        uint32
-	tr               transport.Transport
-	state            uint32
-	id               string
-	username         string
-	domain           string
-	resource         string
-	jid              *xml.JID
-	secured          bool
-	authenticated    bool
-	compressed       bool
-	available        bool
-	priority         int8
-	authrs           []authenticator
-	activeAuthr      authenticator
-	iqHandlers       []module.IQHandler
-	rosterOnce       sync.Once
-	roster           *module.ModRoster
-	presenceElements []xml.Element
-	register         *module.XEPRegister
-	ping             *module.XEPPing
-	offlineOnce      sync.Once
-	offline          *module.ModOffline
-	actorCh          chan func()
+	lock                sync.RWMutex
+	cfg                 *config.Server
+	connected           uint32
+	tr                  transport.Transport
+	state               uint32
+	id                  string
+	username            string
+	domain              string
+	resource            string
+	jid                 *xml.JID
+	secured             bool
+	authenticated       bool
+	compressed          bool
+	available           bool
+	presenceClosed      bool
+	pendingVerification bool
+	presenceMu          sync.Mutex // serializes availability changes along with roster broadcasts
+	priority            int8
+	hasher              *credentials.Hasher
+	authrs              []authenticator
+	activeAuthr         authenticator
+	modules             *module.Chain
+	rosterOnce          sync.Once
+	roster              *module.ModRoster
+	presenceElements    []xml.Element
+	register            *module.XEPRegister
+	ping                *module.XEPPing
+	vacation            *module.XEPVacation
+	forwarding          *module.ModForwarding
+	tracking            *module.ModTracking
+	mam                 *module.XEPMessageArchive
+	privacy             *module.XEPPrivacyLists
+	blocking            *module.XEPBlockingCommand
+	offlineOnce         sync.Once
+	offline             *module.ModOffline
+	sm                  streamMgmt
+	csi                 clientState
+	dump                *stanzaDump
+	rewrite             *rewrite.Engine
+	actorCh             chan func()
+	doneCh              chan struct{}
 }
 
 func newStream(id string, tr transport.Transport, cfg *config.Server) *serverStream {
+	// SCRAM verifiers are derived only if they're to be used
+	var scramIterations int
+	if cfg.IsScramEnabled() {
+		scramIterations = cfg.ScramIterations
+	}
 	s := &serverStream{
 		cfg:     cfg,
 		id:      id,
 		tr:      tr,
 		state:   connecting,
 		secured: cfg.Transport.Type == config.WebSocketTransportType,
+		hasher:  credentials.NewHasher(&cfg.PasswordHashing, scramIterations),
+		dump:    newStanzaDump(&cfg.StanzaDump),
+		rewrite: rewrite.New(cfg.Rewrite),
 		actorCh: make(chan func(), streamMailboxSize),
+		doneCh:  make(chan struct{}),
 	}
+	atomic.AddInt64(&connectedStreams, 1)
+
 	// assign default domain
 	s.domain = c2s.Instance().DefaultLocalDomain()
 	s.jid, _ = xml.NewJID("", s.domain, "", true)
@@ -110,11 +147,13 @@ func newStream(id string, tr transport.Transport, cfg *config.Server) *serverStr
 	// initialize XEPs
 	s.initializeXEPs()
 
+	tr.SetLargeTextPolicy(largeTextPolicy(&cfg.LargePayload))
+
 	if cfg.Transport.ConnectTimeout > 0 {
 		go s.startConnectTimeoutTimer(cfg.Transport.ConnectTimeout)
 	}
 	go s.actorLoop()
-	go s.doRead() // start reading transport...
+	go s.doRead(tr) // start reading transport...
 
 	return s
 }
@@ -152,6 +191,14 @@ func (s *serverStream) JID() *xml.JID {
 	return s.jid
 }
 
+// RemoteAddr returns stream remote peer address.
+func (s *serverStream) RemoteAddr() net.Addr {
+	s.lock.RLock()
+	tr := s.tr
+	s.lock.RUnlock()
+	return tr.RemoteAddr()
+}
+
 // Priority returns current presence priority.
 func (s *serverStream) Priority() int8 {
 	s.lock.RLock()
@@ -198,10 +245,50 @@ func (s *serverStream) PresenceElements() []xml.Element {
 	return s.presenceElements
 }
 
-// SendElement sends the given XML element.
+// SendElement sends the given XML element,
+// discarding it once the stream is disconnected.
 func (s *serverStream) SendElement(element xml.Element) {
-	s.actorCh <- func() {
+	s.post(func() {
 		s.writeElement(element)
+	})
+}
+
+// SendElementTimeout sends the given XML element, failing whenever the
+// stream is already disconnected or its mailbox doesn't drain in time.
+func (s *serverStream) SendElementTimeout(element xml.Element, timeout time.Duration) error {
+	if s.getState() == disconnected {
+		return c2s.ErrStreamClosed
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case s.actorCh <- func() { s.writeElement(element) }:
+		return nil
+	case <-t.C:
+		return c2s.ErrSendTimeout
+	}
+}
+
+// SendKeepAlive writes a single whitespace character to the remote peer,
+// failing whenever the write doesn't succeed before timeout elapses.
+func (s *serverStream) SendKeepAlive(timeout time.Duration) error {
+	if s.getState() == disconnected {
+		return c2s.ErrStreamClosed
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+
+	errCh := make(chan error, 1)
+	select {
+	case s.actorCh <- func() { errCh <- s.tr.WriteString(" ") }:
+	case <-t.C:
+		return c2s.ErrSendTimeout
+	}
+	select {
+	case err := <-errCh:
+		return err
+	case <-t.C:
+		return c2s.ErrSendTimeout
 	}
 }
 
@@ -213,58 +300,112 @@ func (s *serverStream) Disconnect(err error) {
 	}
 }
 
+// Terminate sends a stream error to the remote peer, along with
+// an optional descriptive text, and closes the stream.
+func (s *serverStream) Terminate(reason *streamerror.Error, text string) {
+	s.actorCh <- func() {
+		s.terminate(reason, text)
+	}
+}
+
 func (s *serverStream) initializeAuthenticators() {
 	for _, a := range s.cfg.SASL {
 		switch a {
 		case "plain":
-			s.authrs = append(s.authrs, newPlainAuthenticator(s))
+			s.authrs = append(s.authrs, newPlainAuthenticator(s, s.hasher))
 		case "digest_md5":
 			s.authrs = append(s.authrs, newDigestMD5(s))
 		case "scram_sha_1":
-			s.authrs = append(s.authrs, newScram(s, s.tr, sha1ScramType, false))
-			s.authrs = append(s.authrs, newScram(s, s.tr, sha1ScramType, true))
+			s.authrs = append(s.authrs, newScram(s, s.tr, sha1ScramType, false, s.hasher))
+			s.authrs = append(s.authrs, newScram(s, s.tr, sha1ScramType, true, s.hasher))
 
 		case "scram_sha_256":
-			s.authrs = append(s.authrs, newScram(s, s.tr, sha256ScramType, false))
-			s.authrs = append(s.authrs, newScram(s, s.tr, sha256ScramType, true))
+			s.authrs = append(s.authrs, newScram(s, s.tr, sha256ScramType, false, s.hasher))
+			s.authrs = append(s.authrs, newScram(s, s.tr, sha256ScramType, true, s.hasher))
 		}
 	}
 }
 
 func (s *serverStream) initializeXEPs() {
+	var modules []module.Module
+
 	// Roster (https://xmpp.org/rfcs/rfc3921.html#roster)
 	s.roster = module.NewRoster(s)
-	s.iqHandlers = append(s.iqHandlers, s.roster)
+	modules = append(modules, s.roster)
+
+	// server statistics disco node (https://xmpp.org/extensions/xep-0039.html)
+	if _, ok := s.cfg.Modules["stats"]; ok {
+		modules = append(modules, module.NewStats(s))
+	}
+
+	// XEP-0013: Flexible Offline Message Retrieval (https://xmpp.org/extensions/xep-0013.html)
+	if _, ok := s.cfg.Modules["offline_retrieval"]; ok {
+		offlineRetrieval := module.NewXEPOfflineRetrieval(s)
+		offlineRetrieval.SetRetrievalHandler(func() {
+			// client manages its offline messages on its own from now on
+			s.offlineOnce.Do(func() {})
+		})
+		modules = append(modules, offlineRetrieval)
+	}
+
+	// XEP-0016: Privacy Lists (https://xmpp.org/extensions/xep-0016.html)
+	if _, ok := s.cfg.Modules["privacy"]; ok {
+		s.privacy = module.NewXEPPrivacyLists(s)
+		s.roster.AddPresenceFilter(s.privacy.AllowsPresence)
+		modules = append(modules, s.privacy)
+	}
 
 	// XEP-0030: Service Discovery (https://xmpp.org/extensions/xep-0030.html)
 	discoInfo := module.NewXEPDiscoInfo(s)
-	s.iqHandlers = append(s.iqHandlers, discoInfo)
+	modules = append(modules, discoInfo)
 
 	// XEP-0049: Private XML Storage (https://xmpp.org/extensions/xep-0049.html)
 	if _, ok := s.cfg.Modules["private"]; ok {
-		s.iqHandlers = append(s.iqHandlers, module.NewXEPPrivateStorage(s))
+		modules = append(modules, module.NewXEPPrivateStorage(s))
 	}
 
 	// XEP-0054: vcard-temp (https://xmpp.org/extensions/xep-0054.html)
 	if _, ok := s.cfg.Modules["vcard"]; ok {
-		s.iqHandlers = append(s.iqHandlers, module.NewXEPVCard(s))
+		modules = append(modules, module.NewXEPVCard(s))
 	}
 
 	// XEP-0077: In-band registration (https://xmpp.org/extensions/xep-0077.html)
 	if _, ok := s.cfg.Modules["registration"]; ok {
-		s.register = module.NewXEPRegister(&s.cfg.ModRegistration, s)
-		s.iqHandlers = append(s.iqHandlers, s.register)
+		s.register = module.NewXEPRegister(&s.cfg.ModRegistration, s.hasher, s)
+		s.register.SetNotificationRouter(s.routeNotification)
+		modules = append(modules, s.register)
 	}
 
 	// XEP-0092: Software Version (https://xmpp.org/extensions/xep-0092.html)
 	if _, ok := s.cfg.Modules["version"]; ok {
-		s.iqHandlers = append(s.iqHandlers, module.NewXEPVersion(&s.cfg.ModVersion, s))
+		modules = append(modules, module.NewXEPVersion(&s.cfg.ModVersion, s))
+	}
+
+	// XEP-0109: Vacation Messages (https://xmpp.org/extensions/xep-0109.html)
+	if _, ok := s.cfg.Modules["vacation"]; ok {
+		s.vacation = module.NewXEPVacation(&s.cfg.ModVacation, s)
+		modules = append(modules, s.vacation)
+	}
+
+	// XEP-0191: Blocking Command (https://xmpp.org/extensions/xep-0191.html)
+	if _, ok := s.cfg.Modules["blocking"]; ok {
+		s.blocking = module.NewXEPBlockingCommand(s)
+		s.roster.AddPresenceFilter(func(presence *xml.Presence, to *xml.JID) bool {
+			return s.blocking.AllowsPresence(presence.FromJID(), to)
+		})
+		modules = append(modules, s.blocking)
+	}
+
+	// Offline message forwarding
+	if _, ok := s.cfg.Modules["forwarding"]; ok {
+		s.forwarding = module.NewForwarding(s)
+		modules = append(modules, s.forwarding)
 	}
 
 	// XEP-0199: XMPP Ping (https://xmpp.org/extensions/xep-0199.html)
 	if _, ok := s.cfg.Modules["ping"]; ok {
 		s.ping = module.NewXEPPing(&s.cfg.ModPing, s)
-		s.iqHandlers = append(s.iqHandlers, s.ping)
+		modules = append(modules, s.ping)
 	}
 
 	// register server disco info identities
@@ -275,18 +416,67 @@ func (s *serverStream) initializeXEPs() {
 	}}
 	discoInfo.SetIdentities(identities)
 
-	// register disco info features
-	var features []string
-	for _, iqHandler := range s.iqHandlers {
-		features = append(features, iqHandler.AssociatedNamespaces()...)
+	// message footer
+	if _, ok := s.cfg.Modules["footer"]; ok {
+		modules = append(modules, module.NewFooter(&s.cfg.ModFooter, s))
+	}
+
+	// first contact spam filtering
+	if _, ok := s.cfg.Modules["spam"]; ok {
+		modules = append(modules, module.NewSpam(&s.cfg.ModSpam, s))
+	}
+
+	// XEP-0313: Message Archive Management (https://xmpp.org/extensions/xep-0313.html)
+	// added after footer, so that messages are archived as they're delivered
+	if _, ok := s.cfg.Modules["mam"]; ok {
+		s.mam = module.NewXEPMessageArchive(&s.cfg.ModMAM, s)
+		modules = append(modules, s.mam)
 	}
 
 	// XEP-0160: Offline message storage (https://xmpp.org/extensions/xep-0160.html)
 	if _, ok := s.cfg.Modules["offline"]; ok {
 		s.offline = module.NewOffline(&s.cfg.ModOffline, s)
-		features = append(features, s.offline.AssociatedNamespaces()...)
+		modules = append(modules, s.offline)
+	}
+	s.modules = module.NewChain(modules...)
+	s.modules.SetFeatureFlags(func(flag string) bool {
+		return featureflags.Enabled(flag, s.Username())
+	})
+
+	// register disco info features, reflecting current user feature flags
+	discoInfo.SetFeaturesFunc(s.modules.DiscoFeatures)
+
+	// advertise server limits, as of last configuration reload
+	discoInfo.SetFormsFunc(func() []xml.Element {
+		return []xml.Element{module.CurrentServerLimits(s.cfg.ID).Form()}
+	})
+
+	// message delivery tracking
+	if _, ok := s.cfg.Modules["tracking"]; ok {
+		s.tracking = module.NewTracking(&s.cfg.ModTracking, s)
+	}
+	if s.offline != nil {
+		s.offline.SetArchiveHandler(s.offlineArchived)
+	}
+}
+
+// offlineArchived handles the outcome of storing a message offline.
+// Messages sent by the stream user are archived on behalf of their recipient
+// only once stored, as they're not archived again when delivered from the
+// offline queue, nor whenever bounced.
+func (s *serverStream) offlineArchived(message *xml.Message, err error) {
+	if err != nil {
+		if s.tracking != nil {
+			s.tracking.Bounced(message, err)
+		}
+		return
+	}
+	if fromJid := message.FromJID(); s.mam != nil && fromJid.Node() == s.Username() && fromJid.Domain() == s.Domain() {
+		s.mam.ArchiveIncoming(message)
+	}
+	if s.tracking != nil {
+		s.tracking.StoredOffline(message)
 	}
-	discoInfo.SetFeatures(features)
 }
 
 func (s *serverStream) startConnectTimeoutTimer(timeoutInSeconds int) {
@@ -301,6 +491,9 @@ func (s *serverStream) startConnectTimeoutTimer(timeoutInSeconds int) {
 }
 
 func (s *serverStream) handleElement(elem xml.Element) {
+	if s.sm.enabled && isStanzaElement(elem) {
+		s.sm.inbound++
+	}
 	switch s.getState() {
 	case connecting:
 		s.handleConnecting(elem)
@@ -323,7 +516,7 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 
 	// validate stream element
 	if err := s.validateStreamElement(elem); err != nil {
-		s.disconnectWithStreamError(err)
+		s.terminate(err, "")
 		return
 	}
 	// assign stream domain
@@ -351,10 +544,11 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 		// attach SASL mechanisms
 		shouldOfferSASL := (!isSocketTransport || (isSocketTransport && s.IsSecured()))
 
-		if shouldOfferSASL && len(s.authrs) > 0 {
+		authrs := s.offeredAuthenticators()
+		if shouldOfferSASL && len(authrs) > 0 {
 			mechanisms := xml.NewElementName("mechanisms")
 			mechanisms.SetNamespace(saslNamespace)
-			for _, athr := range s.authrs {
+			for _, athr := range authrs {
 				mechanism := xml.NewElementName("mechanism")
 				mechanism.SetText(athr.Mechanism())
 				mechanisms.AppendElement(mechanism)
@@ -362,20 +556,12 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 			features.AppendElement(mechanisms)
 		}
 
-		// allow In-band registration over encrypted stream only
-		allowRegistration := s.IsSecured()
-
-		if _, ok := s.cfg.Modules["offline"]; ok && allowRegistration {
-			registerFeature := xml.NewElementNamespace("register", "http://jabber.org/features/iq-register")
-			features.AppendElement(registerFeature)
-		}
+		features.AppendElements(s.modules.StreamFeatures())
 		s.setState(connected)
 
 	} else {
 		// attach compression feature
-		compressionAvailable := isSocketTransport && s.cfg.Compression.Level != config.NoCompression
-
-		if !s.IsCompressed() && compressionAvailable {
+		if !s.IsCompressed() && s.isCompressionAvailable() {
 			compression := xml.NewElementNamespace("compression", "http://jabber.org/features/compress")
 			method := xml.NewElementName("method")
 			method.SetText("zlib")
@@ -389,6 +575,17 @@ func (s *serverStream) handleConnecting(elem xml.Element) {
 		session := xml.NewElementNamespace("session", "urn:ietf:params:xml:ns:xmpp-session")
 		features.AppendElement(session)
 
+		// XEP-0198: Stream Management (https://xmpp.org/extensions/xep-0198.html)
+		if s.isStreamMgmtAvailable() {
+			features.AppendElement(xml.NewElementNamespace("sm", smNamespace))
+		}
+		// XEP-0352: Client State Indication (https://xmpp.org/extensions/xep-0352.html)
+		if s.isClientStateAvailable() {
+			features.AppendElement(xml.NewElementNamespace("csi", csiNamespace))
+		}
+
+		features.AppendElements(s.modules.StreamFeatures())
+
 		s.setState(authenticated)
 	}
 	s.writeElement(features)
@@ -398,14 +595,14 @@ func (s *serverStream) handleConnected(elem xml.Element) {
 	switch elem.Name() {
 	case "starttls":
 		if len(elem.Namespace()) > 0 && elem.Namespace() != tlsNamespace {
-			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+			s.terminate(streamerror.ErrInvalidNamespace, "")
 			return
 		}
 		s.proceedStartTLS()
 
 	case "auth":
 		if elem.Namespace() != saslNamespace {
-			s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+			s.terminate(streamerror.ErrInvalidNamespace, "")
 			return
 		}
 		s.startAuthentication(elem)
@@ -430,30 +627,33 @@ func (s *serverStream) handleConnected(elem xml.Element) {
 		fallthrough
 
 	case "message", "presence":
-		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		s.terminate(streamerror.ErrNotAuthorized, "")
 
 	default:
-		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+		s.terminate(streamerror.ErrUnsupportedStanzaType, "")
 	}
 }
 
 func (s *serverStream) handleAuthenticating(elem xml.Element) {
 	if elem.Namespace() != saslNamespace {
-		s.disconnectWithStreamError(streamerror.ErrInvalidNamespace)
+		s.terminate(streamerror.ErrInvalidNamespace, "")
 		return
 	}
 	authr := s.activeAuthr
 	s.continueAuthentication(elem, authr)
 	if authr.Authenticated() {
-		s.finishAuthentication(authr.Username())
+		s.finishAuthentication(authr)
 	}
 }
 
 func (s *serverStream) handleAuthenticated(elem xml.Element) {
+	if s.handleStreamMgmt(elem) {
+		return
+	}
 	switch elem.Name() {
 	case "compress":
 		if elem.Namespace() != compressProtocolNamespace {
-			s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+			s.terminate(streamerror.ErrUnsupportedStanzaType, "")
 			return
 		}
 		s.compress(elem)
@@ -473,7 +673,7 @@ func (s *serverStream) handleAuthenticated(elem xml.Element) {
 		}
 
 	default:
-		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+		s.terminate(streamerror.ErrUnsupportedStanzaType, "")
 	}
 }
 
@@ -482,22 +682,87 @@ func (s *serverStream) handleSessionStarted(elem xml.Element) {
 	if s.ping != nil {
 		s.ping.ResetDeadline()
 	}
+	if s.handleStreamMgmt(elem) || s.handleClientState(elem) {
+		return
+	}
 
 	stanza, toJID, err := s.buildStanza(elem)
 	if err != nil {
 		s.handleElementError(elem, err)
 		return
 	}
-	if s.isComponentDomain(toJID.Domain()) {
-		s.processComponentStanza(stanza)
-	} else {
-		s.processStanza(stanza)
+	if message, ok := stanza.(*xml.Message); ok {
+		module.StripFooterMarker(message)
+	}
+	stanza, toJID, err = s.rewriteInbound(stanza, toJID)
+	if err != nil {
+		s.handleElementError(elem, err)
+		return
+	}
+	if stanza == nil {
+		return
+	}
+	// process stanzas concurrently across streams, preserving per-sender ordering
+	err = c2s.Instance().Dispatch(s.JID(), func() {
+		if s.getState() == disconnected {
+			return
+		}
+		if s.isComponentDomain(toJID.Domain()) {
+			s.processComponentStanza(stanza)
+		} else {
+			s.processStanza(stanza)
+		}
+	})
+	if err != nil {
+		// never block the actor waiting for a worker, recipients may be waiting for it
+		stats.Default().Counter("stanzas/rejected", "stanzas").Inc()
+		if stanza.Type() != xml.ErrorType {
+			s.writeElement(stanza.ToError(xml.ErrResourceConstraint.(*xml.StanzaError)))
+		}
 	}
 }
 
+// rewriteInbound applies inbound rewrite rules to a client stanza,
+// returning a nil stanza whenever it has been bounced.
+func (s *serverStream) rewriteInbound(stanza xml.Element, toJID *xml.JID) (xml.Element, *xml.JID, error) {
+	rewritten, bounced := s.rewrite.Apply(stanza, config.RewriteInbound, toJID.Domain())
+	if bounced {
+		s.bounceStanza(stanza, bounce.Filtered)
+		return nil, nil, nil
+	}
+	if rewritten == stanza {
+		return stanza, toJID, nil
+	}
+	return s.buildStanza(rewritten)
+}
+
+// rewriteOutbound applies outbound rewrite rules to a stanza about to be
+// written, bouncing it back to its sender whenever a rule requires it.
+func (s *serverStream) rewriteOutbound(element xml.Element) (xml.Element, bool) {
+	domain := s.Domain()
+	if fromJID, err := xml.NewJIDString(element.From(), true); err == nil && len(element.From()) > 0 {
+		domain = fromJID.Domain()
+	}
+	rewritten, bounced := s.rewrite.Apply(element, config.RewriteOutbound, domain)
+	if !bounced {
+		return rewritten, true
+	}
+	if resp := bounce.Response(element, bounce.Filtered, &s.cfg.Bounce); resp != nil {
+		if toJID, err := xml.NewJIDString(resp.To(), true); err == nil {
+			// never route from within the actor loop, stanza may be addressed to this same stream
+			go func() {
+				if err := s.sendElement(resp, toJID); err != nil {
+					log.Error(err)
+				}
+			}()
+		}
+	}
+	return nil, false
+}
+
 func (s *serverStream) proceedStartTLS() {
 	if s.IsSecured() {
-		s.disconnectWithStreamError(streamerror.ErrNotAuthorized)
+		s.terminate(streamerror.ErrNotAuthorized, "")
 		return
 	}
 	cer, err := tls.LoadX509KeyPair(s.cfg.TLS.CertFile, s.cfg.TLS.PrivKeyFile)
@@ -524,9 +789,17 @@ func (s *serverStream) proceedStartTLS() {
 	s.restart()
 }
 
+func (s *serverStream) isCompressionAvailable() bool {
+	if s.cfg.Transport.Type != config.SocketTransportType || s.cfg.Compression.Level == config.NoCompression {
+		return false
+	}
+	// compression over TLS is discouraged (https://xmpp.org/extensions/xep-0138.html#security)
+	return !(s.cfg.Compression.DisableOverTLS && s.IsSecured())
+}
+
 func (s *serverStream) compress(elem xml.Element) {
-	if s.IsCompressed() {
-		s.disconnectWithStreamError(streamerror.ErrUnsupportedStanzaType)
+	if s.IsCompressed() || !s.isCompressionAvailable() {
+		s.terminate(streamerror.ErrUnsupportedStanzaType, "")
 		return
 	}
 	method := elem.FindElement("method")
@@ -548,22 +821,40 @@ func (s *serverStream) compress(elem xml.Element) {
 
 	s.writeElement(xml.NewElementNamespace("compressed", compressProtocolNamespace))
 
-	s.tr.EnableCompression(s.cfg.Compression.Level)
+	s.tr.EnableCompression(&s.cfg.Compression)
 
 	log.Infof("compressed stream... id: %s", s.id)
 
 	s.restart()
 }
 
+// offeredAuthenticators returns the authenticators available over the stream
+// transport, leaving out channel binding ones whenever it is not secured.
+func (s *serverStream) offeredAuthenticators() []authenticator {
+	var authrs []authenticator
+	for _, authr := range s.authrs {
+		if authr.UsesChannelBinding() && !channelBindingAvailable(s.tr) {
+			continue
+		}
+		authrs = append(authrs, authr)
+	}
+	return authrs
+}
+
 func (s *serverStream) startAuthentication(elem xml.Element) {
+	if active, reason := maintenance.Active(); active {
+		log.Infof("refused authentication under maintenance... id: %s", s.id)
+		s.failAuthentication(errSASLTemporaryAuthFailure.(saslError).Element(), reason)
+		return
+	}
 	mechanism := elem.Attribute("mechanism")
-	for _, authr := range s.authrs {
+	for _, authr := range s.offeredAuthenticators() {
 		if authr.Mechanism() == mechanism {
 			if err := s.continueAuthentication(elem, authr); err != nil {
 				return
 			}
 			if authr.Authenticated() {
-				s.finishAuthentication(authr.Username())
+				s.finishAuthentication(authr)
 			} else {
 				s.activeAuthr = authr
 				s.setState(authenticating)
@@ -581,15 +872,36 @@ func (s *serverStream) startAuthentication(elem xml.Element) {
 func (s *serverStream) continueAuthentication(elem xml.Element, authr authenticator) error {
 	err := authr.ProcessElement(elem)
 	if saslErr, ok := err.(saslError); ok {
-		s.failAuthentication(saslErr.Element())
+		s.failAuthentication(saslErr.Element(), "")
 	} else if err != nil {
 		log.Error(err)
-		s.failAuthentication(errSASLTemporaryAuthFailure.(saslError).Element())
+		s.failAuthentication(errSASLTemporaryAuthFailure.(saslError).Element(), "")
 	}
 	return err
 }
 
-func (s *serverStream) finishAuthentication(username string) {
+func (s *serverStream) finishAuthentication(authr authenticator) {
+	username := authr.Username()
+	user := authr.User()
+
+	pending := s.isPendingVerification(user)
+	if pending && s.cfg.ModRegistration.EmailVerification.BlockLogin {
+		log.Infof("refused authentication of pending account... (%s)", username)
+		s.failAuthentication(xml.NewElementName("account-disabled"), "Email address pending verification")
+		return
+	}
+	if user != nil && user.IsRemoved() {
+		if !s.cfg.ModRegistration.RestoreOnLogin {
+			log.Infof("refused authentication of removed account... (%s)", username)
+			s.failAuthentication(xml.NewElementName("account-disabled"), "Account scheduled for removal")
+			return
+		}
+		if err := s.cancelRemoval(user); err != nil {
+			log.Error(err)
+			s.failAuthentication(errSASLTemporaryAuthFailure.(saslError).Element(), "")
+			return
+		}
+	}
 	if s.activeAuthr != nil {
 		s.activeAuthr.Reset()
 		s.activeAuthr = nil
@@ -597,15 +909,46 @@ func (s *serverStream) finishAuthentication(username string) {
 	s.lock.Lock()
 	s.username = username
 	s.authenticated = true
+	s.pendingVerification = pending
 	s.jid, _ = xml.NewJID(s.username, s.domain, "", true)
 	s.lock.Unlock()
 
 	s.restart()
 }
 
-func (s *serverStream) failAuthentication(elem xml.Element) {
+// cancelRemoval restores a removed account logging back
+// in within its grace period.
+func (s *serverStream) cancelRemoval(user *model.User) error {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	restored := *user
+	restored.PurgeAt = time.Time{}
+	if err := storage.Instance().InsertOrUpdateUser(ctx, &restored); err != nil {
+		return err
+	}
+	log.Infof("cancelled account removal on login: %s", user.Username)
+	return nil
+}
+
+// isPendingVerification returns whether or not an authenticated
+// account awaits its registration email address to be verified.
+func (s *serverStream) isPendingVerification(user *model.User) bool {
+	if !s.cfg.ModRegistration.RequireEmail {
+		return false
+	}
+	return user != nil && user.IsPendingVerification()
+}
+
+func (s *serverStream) failAuthentication(elem xml.Element, text string) {
 	failure := xml.NewElementNamespace("failure", saslNamespace)
 	failure.AppendElement(elem)
+	if len(text) > 0 {
+		textElem := xml.NewElementName("text")
+		textElem.SetLanguage("en")
+		textElem.SetText(text)
+		failure.AppendElement(textElem)
+	}
 	s.writeElement(failure)
 
 	if s.activeAuthr != nil {
@@ -637,7 +980,7 @@ func (s *serverStream) bindResource(iq *xml.IQ) {
 			resource = hex.EncodeToString(h.Sum(nil))
 		case config.Replace:
 			// terminate the session of the currently connected client...
-			strm.Disconnect(streamerror.ErrResourceConstraint)
+			strm.Terminate(streamerror.ErrConflict, "Replaced by new connection")
 		default:
 			// disallow resource binding attempt...
 			s.writeElement(iq.ConflictError())
@@ -671,12 +1014,21 @@ func (s *serverStream) bindResource(iq *xml.IQ) {
 	if err := c2s.Instance().AuthenticateStream(s); err != nil {
 		log.Error(err)
 	}
+	if s.pendingVerification {
+		notice := xml.NewMessageType(uuid.New(), xml.HeadlineType)
+		notice.SetFrom(s.Domain())
+		notice.SetToJID(userJID)
+		body := xml.NewElementName("body")
+		body.SetText("Your account email address is pending verification. Please confirm it using the token mailed to you.")
+		notice.AppendElement(body)
+		s.writeElement(notice)
+	}
 }
 
 func (s *serverStream) startSession(iq *xml.IQ) {
 	if len(s.Resource()) == 0 {
 		// not binded yet...
-		s.Disconnect(streamerror.ErrNotAuthorized)
+		s.Terminate(streamerror.ErrNotAuthorized, "Resource not bound")
 		return
 	}
 	sess := iq.FindElementNamespace("session", sessionNamespace)
@@ -692,7 +1044,13 @@ func (s *serverStream) startSession(iq *xml.IQ) {
 	s.setState(sessionStarted)
 }
 
+// processStanza runs on a worker pool goroutine, thus it must never touch
+// actor owned state, writing to this same stream through SendElement.
 func (s *serverStream) processStanza(element xml.Element) {
+	stats.Default().Counter("stanzas/processed", "stanzas").Inc()
+	stats.Default().Counter("stanzas/processed/"+s.cfg.ID, "stanzas").Inc()
+	stats.Default().Counter("stanzas/received/"+element.Name(), "stanzas").Inc()
+
 	switch stanza := element.(type) {
 	case *xml.IQ:
 		s.processIQ(stanza)
@@ -712,20 +1070,30 @@ func (s *serverStream) processIQ(iq *xml.IQ) {
 		return
 	}
 
+	if s.privacy != nil && s.privacy.InterceptIQ(iq) {
+		return
+	}
+	if s.blocking != nil && s.blocking.InterceptIQ(iq) {
+		return
+	}
 	toJid := iq.ToJID()
 	if toJid.IsFull() {
-		if err := s.sendElement(iq, toJid); err == errResourceNotFound {
-			resp := iq.Copy()
-			resp.SetFrom(toJid.String())
-			resp.SetTo(s.JID().String())
-			s.SendElement(resp.ServiceUnavailableError())
+		// IQs addressed to a resource are relayed verbatim,
+		// bypassing server modules.
+		switch err := s.sendElement(iq, toJid); err {
+		case nil:
+			break
+		case errResourceNotFound, errNotAuthenticated, errNotExistingAccount:
+			s.bounceStanza(iq, bounce.UnknownRecipient)
+		default:
+			log.Error(err)
 		}
 		return
 	}
 
-	for _, handler := range s.iqHandlers {
-		if !handler.MatchesIQ(iq) {
-			continue
+	if handler := s.modules.MatchingIQHandler(iq); handler != nil {
+		if payload := iq.Elements(); len(payload) > 0 {
+			stats.Default().Counter("iq/"+payload[0].Namespace(), "iqs").Inc()
 		}
 		handler.ProcessIQ(iq)
 		return
@@ -733,7 +1101,7 @@ func (s *serverStream) processIQ(iq *xml.IQ) {
 
 	// ...IQ not handled...
 	if iq.IsGet() || iq.IsSet() {
-		s.writeElement(iq.ServiceUnavailableError())
+		s.SendElement(iq.ServiceUnavailableError())
 	}
 }
 
@@ -742,6 +1110,9 @@ func (s *serverStream) processPresence(presence *xml.Presence) {
 		// TODO(ortuman): Implement XMPP federation
 		return
 	}
+	if s.modules.InterceptPresence(presence) {
+		return
+	}
 	toJid := presence.ToJID()
 	if toJid.IsBare() && (toJid.Node() != s.Username() || toJid.Domain() != s.Domain()) {
 		if s.roster != nil {
@@ -754,8 +1125,27 @@ func (s *serverStream) processPresence(presence *xml.Presence) {
 		return
 	}
 
-	// set resource priority & availability
+	if !s.updatePresence(presence) {
+		return
+	}
+	// deliver offline messages
+	s.deliverOfflineMessages(-1)
+}
+
+// updatePresence sets resource priority and availability, enqueuing
+// the corresponding roster broadcast before any later change takes place.
+// It returns false if presence has been ignored or was the initial one.
+func (s *serverStream) updatePresence(presence *xml.Presence) bool {
+	s.presenceMu.Lock()
+	defer s.presenceMu.Unlock()
+
 	s.lock.Lock()
+	switch {
+	case s.presenceClosed, presence.IsUnavailable() && !s.available, !presence.IsAvailable() && !presence.IsUnavailable():
+		// stream is going away, never became available or not an availability change...
+		s.lock.Unlock()
+		return false
+	}
 	s.priority = presence.Priority()
 	if presence.IsAvailable() {
 		s.available = true
@@ -766,62 +1156,157 @@ func (s *serverStream) processPresence(presence *xml.Presence) {
 	}
 	s.lock.Unlock()
 
-	// deliver pending approval notifications
+	// process initial presence
+	var initialPresence bool
 	if s.roster != nil {
 		s.rosterOnce.Do(func() {
-			s.roster.DeliverPendingApprovalNotifications()
-			s.roster.ReceivePresences()
+			initialPresence = true
+			s.processInitialPresence(presence)
 		})
+		if initialPresence {
+			return false
+		}
 		s.roster.BroadcastPresence(presence)
 	}
+	return true
+}
 
-	// deliver offline messages
-	if s.offline != nil && s.Priority() >= 0 {
-		s.offlineOnce.Do(func() {
-			s.offline.DeliverOfflineMessages()
+func (s *serverStream) processInitialPresence(presence *xml.Presence) {
+	var prefetch []func() error
+
+	// count offline messages concurrently with roster fetches
+	offlineCount := -1
+	if s.offline != nil {
+		prefetch = append(prefetch, func() error {
+			ctx, cancel := storage.QueryContext()
+			defer cancel()
+
+			cnt, err := storage.Instance().CountOfflineMessages(ctx, s.Username())
+			if err != nil {
+				log.Error(err)
+				return nil // fallback to unconditional delivery
+			}
+			offlineCount = cnt
+			return nil
 		})
 	}
+	// offline messages must be delivered once presence has been processed
+	s.roster.ProcessInitialPresence(presence, prefetch, func() {
+		s.deliverOfflineMessages(offlineCount)
+	})
+}
+
+func (s *serverStream) deliverOfflineMessages(offlineCount int) {
+	if s.offline == nil || offlineCount == 0 || s.Priority() < 0 {
+		return
+	}
+	s.offlineOnce.Do(func() {
+		s.offline.DeliverOfflineMessages()
+	})
 }
 
 func (s *serverStream) processMessage(message *xml.Message) {
 	if !c2s.Instance().IsLocalDomain(message.ToJID().Domain()) {
 		// TODO(ortuman): Implement XMPP federation
+		s.bounceTrackedMessage(message, xml.ErrRemoteServerNotFound)
+		return
+	}
+	if s.modules.InterceptMessage(message) {
 		return
 	}
 	toJid := message.ToJID()
 
 sendMessage:
-	err := s.sendElement(message, toJid)
+	recipients, err := s.routeElement(message, toJid)
 	switch err {
 	case nil:
-		break
+		if s.tracking != nil {
+			s.tracking.Delivered(message, recipients[0].Resource())
+		}
+		if s.mam != nil {
+			s.mam.ArchiveIncoming(message)
+		}
+		if s.vacation != nil && s.modules.Enabled(s.vacation) {
+			s.vacation.ProcessMessage(message)
+		}
 	case errNotAuthenticated:
+		if s.vacation != nil && s.modules.Enabled(s.vacation) {
+			s.vacation.ProcessMessage(message)
+		}
+		if s.forwarding != nil && s.modules.Enabled(s.forwarding) {
+			if fwd, store := s.forwarding.ForwardOffline(message); fwd != nil {
+				s.processMessage(fwd)
+				if !store {
+					return
+				}
+			}
+		}
 		if s.offline != nil {
 			if (message.IsChat() || message.IsGroupChat()) && message.IsMessageWithBody() {
+				s.bounceTrackedMessage(message, xml.ErrServiceUnavailable)
 				return
 			}
-			s.offline.ArchiveMessage(message)
+			s.offline.ArchiveMessage(message) // disposition reported by archive handler
+		} else {
+			s.bounceTrackedMessage(message, xml.ErrServiceUnavailable)
 		}
 	case errResourceNotFound:
 		// treat the stanza as if it were addressed to <node@domain>
 		toJid = toJid.ToBareJID()
 		goto sendMessage
 	case errNotExistingAccount:
-		response := message.Copy()
-		response.SetFrom(toJid.String())
-		response.SetTo(s.JID().String())
-		s.writeElement(response.ServiceUnavailableError())
+		s.bounceStanza(message, bounce.UnknownRecipient)
+		s.bounceTrackedMessage(message, xml.ErrServiceUnavailable)
 		return
+	default:
+		log.Error(err)
+		s.bounceTrackedMessage(message, err)
+	}
+}
+
+// routeNotification delivers a server generated message to a local recipient,
+// archiving it whenever unavailable. Unlike regular messages it skips
+// interception by stream modules.
+func (s *serverStream) routeNotification(message *xml.Message) {
+	toJid := message.ToJID()
+	if !c2s.Instance().IsLocalDomain(toJid.Domain()) {
+		log.Warnf("couldn't route notification to remote recipient: %s", toJid)
+		return
+	}
+	_, err := s.routeElement(message, toJid)
+	switch err {
+	case nil:
+		break
+	case errNotAuthenticated:
+		if s.offline != nil {
+			s.offline.ArchiveMessage(message)
+		}
+	case errNotExistingAccount:
+		log.Warnf("couldn't route notification to unknown recipient: %s", toJid)
 	default:
 		log.Error(err)
 	}
 }
 
+// bounceStanza answers an undeliverable stanza back to its sender.
+func (s *serverStream) bounceStanza(stanza xml.Element, reason bounce.Reason) {
+	if resp := bounce.Response(stanza, reason, &s.cfg.Bounce); resp != nil {
+		s.SendElement(resp)
+	}
+}
+
+func (s *serverStream) bounceTrackedMessage(message *xml.Message, err error) {
+	if s.tracking != nil {
+		s.tracking.Bounced(message, err)
+	}
+}
+
 func (s *serverStream) restart() {
 	s.setState(connecting)
 }
 
 func (s *serverStream) actorLoop() {
+	defer close(s.doneCh)
 	for {
 		f := <-s.actorCh
 		f()
@@ -831,10 +1316,41 @@ func (s *serverStream) actorLoop() {
 	}
 }
 
-func (s *serverStream) doRead() {
-	if e, err := s.tr.ReadElement(); e != nil && err == nil {
+// post submits f to the stream actor, discarding it once disconnected.
+func (s *serverStream) post(f func()) {
+	select {
+	case s.actorCh <- f:
+	case <-s.doneCh:
+	}
+}
+
+// runAndWait runs f on the stream actor, waiting for its completion.
+// It returns false if stream got disconnected before running it.
+func (s *serverStream) runAndWait(f func()) bool {
+	continueCh := make(chan struct{})
+	s.post(func() {
+		f()
+		close(continueCh)
+	})
+	select {
+	case <-continueCh:
+		return true
+	case <-s.doneCh:
+		select {
+		case <-continueCh:
+			return true
+		default:
+			return false
+		}
+	}
+}
+
+// doRead reads next element from tr, as long as
+// it remains being the stream transport.
+func (s *serverStream) doRead(tr transport.Transport) {
+	if e, err := tr.ReadElement(); e != nil && err == nil {
 		s.actorCh <- func() {
-			s.readElement(e)
+			s.readElement(tr, e)
 		}
 	} else if err != nil {
 		if s.getState() == disconnected {
@@ -842,13 +1358,21 @@ func (s *serverStream) doRead() {
 		}
 
 		var discErr error
+		var connLost bool
 		switch err {
-		case nil, io.EOF, io.ErrUnexpectedEOF, xml.ErrStreamClosedByPeer:
+		case nil, xml.ErrStreamClosedByPeer:
 			break
 
+		case io.EOF, io.ErrUnexpectedEOF:
+			connLost = true
+
+		case xml.ErrStanzaTooLarge:
+			discErr = streamerror.ErrPolicyViolation
+
 		default:
 			switch e := err.(type) {
 			case net.Error:
+				connLost = true
 				if e.Timeout() {
 					discErr = streamerror.ErrConnectionTimeout
 				} else {
@@ -864,21 +1388,88 @@ func (s *serverStream) doRead() {
 			}
 		}
 		s.actorCh <- func() {
+			if tr != s.tr {
+				return // transport replaced on session resumption...
+			}
+			if connLost && s.isResumable() && s.getState() != hibernated {
+				s.hibernate()
+				return
+			}
 			s.disconnect(discErr)
 		}
 	}
 }
 
+// largeTextPolicy returns the parser large text policy for cfg.
+func largeTextPolicy(cfg *config.LargePayload) *xml.LargeTextPolicy {
+	policy := &xml.LargeTextPolicy{
+		Threshold:  cfg.Threshold,
+		Namespaces: cfg.Namespaces,
+		SpoolDir:   cfg.SpoolDir,
+	}
+	switch cfg.Policy {
+	case config.SpoolLargePayload:
+		policy.Mode = xml.SpoolLargeText
+	case config.TruncateLargePayload:
+		policy.Mode = xml.TruncateLargeText
+	}
+	if maxSize := cfg.MaxStanzaSize; maxSize > 0 {
+		policy.CheckSize = func(size int) error {
+			if size > maxSize {
+				return xml.ErrStanzaTooLarge
+			}
+			return nil
+		}
+	}
+	return policy
+}
+
 func (s *serverStream) writeElement(element xml.Element) {
-	log.Debugf("SEND: %v", element)
+	element, ok := s.rewriteOutbound(element)
+	if !ok {
+		return
+	}
+	if s.csi.inactive && s.deferElement(element) {
+		return
+	}
+	s.deliverElement(element)
+}
+
+// deliverElement writes an already rewritten element, keeping it
+// as unacknowledged whenever stream management is enabled.
+func (s *serverStream) deliverElement(element xml.Element) {
+	isStanza := isStanzaElement(element)
+	if isStanza && s.sm.enabled {
+		s.queueUnacked(element)
+	}
+	if s.getState() != hibernated {
+		s.transmitElement(element)
+	}
+	if isStanza && s.sm.enabled {
+		s.checkUnacked()
+	}
+}
+
+// transmitElement writes an already rewritten element to the stream transport.
+func (s *serverStream) transmitElement(element xml.Element) {
+	log.Limited("stream/send").Debugf("SEND: %v", element)
+	s.dump.outbound(element)
 	s.tr.WriteElement(element, true)
+
+	if isStanzaElement(element) {
+		stats.Default().Counter("stanzas/sent/"+element.Name(), "stanzas").Inc()
+	}
 }
 
-func (s *serverStream) readElement(elem xml.Element) {
-	log.Debugf("RECV: %v", elem)
+func (s *serverStream) readElement(tr transport.Transport, elem xml.Element) {
+	if tr != s.tr {
+		return // read from a replaced transport...
+	}
+	log.Limited("stream/recv").Debugf("RECV: %v", elem)
+	s.dump.inbound(elem)
 	s.handleElement(elem)
-	if s.getState() != disconnected {
-		go s.doRead()
+	if s.getState() != disconnected && tr == s.tr {
+		go s.doRead(tr)
 	}
 }
 
@@ -888,9 +1479,10 @@ func (s *serverStream) disconnect(err error) {
 		s.disconnectClosingStream(false)
 	default:
 		if strmErr, ok := err.(*streamerror.Error); ok {
-			s.disconnectWithStreamError(strmErr)
+			s.terminate(strmErr, "")
 		} else {
 			log.Error(err)
+			s.dump.flush(s.ID(), err)
 			s.disconnectClosingStream(false)
 		}
 	}
@@ -960,7 +1552,7 @@ func (s *serverStream) buildStanza(elem xml.Element) (xml.Element, *xml.JID, err
 
 func (s *serverStream) handleElementError(elem xml.Element, err error) {
 	if streamErr, ok := err.(*streamerror.Error); ok {
-		s.disconnectWithStreamError(streamErr)
+		s.terminate(streamErr, "")
 	} else if stanzaErr, ok := err.(*xml.StanzaError); ok {
 		s.writeElement(elem.ToError(stanzaErr))
 	} else {
@@ -1010,7 +1602,14 @@ func (s *serverStream) validateAddresses(elem xml.Element) (fromJID *xml.JID, to
 	if len(from) > 0 && !s.isValidFrom(from) {
 		return nil, nil, streamerror.ErrInvalidFrom
 	}
+	// stamp stanza with the stream bound JID, regardless of the one provided by the client
+	// (https://xmpp.org/rfcs/rfc6120.html#stanzas-attributes-from-c2s)
 	fromJID = s.JID()
+	if elem.Name() == "presence" && isSubscriptionPresenceType(elem.Type()) {
+		// subscription requests are stamped with the user's bare JID
+		// (https://xmpp.org/rfcs/rfc6121.html#sub-request-outbound)
+		fromJID = fromJID.ToBareJID()
+	}
 
 	// validate to JID
 	to := elem.To()
@@ -1042,27 +1641,54 @@ func (s *serverStream) isValidFrom(from string) bool {
 	return validFrom
 }
 
+func isSubscriptionPresenceType(presenceType string) bool {
+	switch presenceType {
+	case xml.SubscribeType, xml.SubscribedType, xml.UnsubscribeType, xml.UnsubscribedType:
+		return true
+	}
+	return false
+}
+
 func (s *serverStream) isComponentDomain(domain string) bool {
 	return false
 }
 
-func (s *serverStream) disconnectWithStreamError(err *streamerror.Error) {
+// terminate is the single exit point for every server-initiated
+// disconnection carrying a stream error.
+func (s *serverStream) terminate(reason *streamerror.Error, text string) {
 	if s.getState() == connecting {
 		s.openStreamElement()
 	}
-	s.writeElement(err.Element())
+	s.writeElement(reason.ElementWithText(text))
+
+	stats.Default().Counter("streams/terminated/"+reason.Error(), "streams").Inc()
+	log.Infof("terminating stream... (id: %s, reason: %s, text: %q)", s.ID(), reason, text)
+	s.dump.flush(s.ID(), reason)
+
+	// resumable sessions outlive server shutdowns
+	if reason == streamerror.ErrSystemShutdown {
+		s.persistSession()
+	}
+
 	s.disconnectClosingStream(true)
 }
 
 func (s *serverStream) disconnectClosingStream(closeStream bool) {
-	s.lock.RLock()
+	wasHibernated := s.getState() == hibernated
+	s.discardResumption()
+
+	s.presenceMu.Lock()
+	s.lock.Lock()
 	available := s.available
-	s.lock.RUnlock()
+	s.available = false
+	s.presenceClosed = true
+	s.lock.Unlock()
 
 	if available && s.roster != nil {
 		s.roster.BroadcastPresenceAndWait(xml.NewPresence(s.JID(), s.JID(), xml.UnavailableType))
 	}
-	if closeStream {
+	s.presenceMu.Unlock()
+	if closeStream && !wasHibernated {
 		switch s.cfg.Transport.Type {
 		case config.SocketTransportType:
 			s.tr.WriteString("</stream:stream>")
@@ -1070,23 +1696,59 @@ func (s *serverStream) disconnectClosingStream(closeStream bool) {
 			s.tr.WriteString(fmt.Sprintf(`<close xmlns="%s" />`, framedStreamNamespace))
 		}
 	}
-	// stop modules
-	for _, iqHandler := range s.iqHandlers {
-		iqHandler.Done()
+	if s.IsCompressed() {
+		s.reportCompressionStats()
 	}
-	if s.offline != nil {
-		s.offline.Done()
+	// unacknowledged messages are handed over before stopping offline storage
+	if s.sm.enabled {
+		s.rerouteUnacked()
+	}
+	// stop modules
+	s.modules.Done()
+	if s.tracking != nil {
+		s.tracking.Done()
 	}
 	// unregister stream
 	if err := c2s.Instance().UnregisterStream(s); err != nil {
 		log.Error(err)
 	}
+	if s.getState() != disconnected {
+		atomic.AddInt64(&connectedStreams, -1)
+	}
 	s.setState(disconnected)
-	s.tr.Close()
+	if !wasHibernated {
+		s.tr.Close()
+	}
+}
+
+// streamsConnected returns the number of currently connected streams.
+func streamsConnected() (int64, error) {
+	return atomic.LoadInt64(&connectedStreams), nil
+}
+
+// compressionRatio returns outbound compressed to raw bytes
+// percentage across every finished compressed stream.
+func compressionRatio() (int64, error) {
+	raw := stats.Default().Counter("compression/bytes_out/raw", "bytes").Value()
+	if raw == 0 {
+		return 0, nil
+	}
+	return stats.Default().Counter("compression/bytes_out/compressed", "bytes").Value() * 100 / raw, nil
+}
+
+func (s *serverStream) reportCompressionStats() {
+	cs := s.tr.CompressionStats()
+	stats.Default().Counter("compression/bytes_in/raw", "bytes").Add(cs.RawIn)
+	stats.Default().Counter("compression/bytes_in/compressed", "bytes").Add(cs.CompressedIn)
+	stats.Default().Counter("compression/bytes_out/raw", "bytes").Add(cs.RawOut)
+	stats.Default().Counter("compression/bytes_out/compressed", "bytes").Add(cs.CompressedOut)
+	log.Infof("compression stats... (id: %s, in: %d/%d, out: %d/%d, ratio: %.2f)",
+		s.ID(), cs.CompressedIn, cs.RawIn, cs.CompressedOut, cs.RawOut, cs.Ratio())
 }
 
 func (s *serverStream) setState(state uint32) {
 	atomic.StoreUint32(&s.state, state)
+	s.dump.state(state)
 }
 
 func (s *serverStream) getState() uint32 {
@@ -1104,25 +1766,35 @@ func (s *serverStream) userResourceStream(resource string) c2s.Stream {
 }
 
 func (s *serverStream) sendElement(element xml.Element, to *xml.JID) error {
+	_, err := s.routeElement(element, to)
+	return err
+}
+
+// routeElement sends element to its recipient streams,
+// returning the ones it has been delivered to.
+func (s *serverStream) routeElement(element xml.Element, to *xml.JID) ([]c2s.Stream, error) {
+	if to.IsFull() {
+		if strm := c2s.Instance().ResourceStream(to); strm != nil {
+			strm.SendElement(element)
+			return []c2s.Stream{strm}, nil
+		}
+	}
 	recipients := c2s.Instance().AvailableStreams(to.Node())
 	if len(recipients) == 0 {
-		exists, err := storage.Instance().UserExists(to.Node())
+		ctx, cancel := storage.QueryContext()
+		defer cancel()
+
+		exists, err := storage.Instance().UserExists(ctx, to.Node())
 		if err != nil {
-			return err
+			return nil, err
 		}
 		if exists {
-			return errNotAuthenticated
+			return nil, errNotAuthenticated
 		}
-		return errNotExistingAccount
+		return nil, errNotExistingAccount
 	}
 	if to.IsFull() {
-		for _, strm := range recipients {
-			if strm.Resource() == to.Resource() {
-				strm.SendElement(element)
-				return nil
-			}
-		}
-		return errResourceNotFound
+		return nil, errResourceNotFound
 	}
 	switch element.(type) {
 	case *xml.Message:
@@ -1135,12 +1807,13 @@ func (s *serverStream) sendElement(element xml.Element, to *xml.JID) error {
 			}
 		}
 		strm.SendElement(element)
+		return []c2s.Stream{strm}, nil
 
 	default:
 		// broadcast to all streams
 		for _, strm := range recipients {
 			strm.SendElement(element)
 		}
+		return recipients, nil
 	}
-	return nil
 }
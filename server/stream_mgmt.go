@@ -0,0 +1,599 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+const smNamespace = "urn:xmpp:sm:3"
+
+const stanzaErrorNamespace = "urn:ietf:params:xml:ns:xmpp-stanzas"
+
+// defaultSMMaxQueueSize is the maximum number of unacknowledged stanzas
+// a stream can hold whenever not configured.
+const defaultSMMaxQueueSize = 1000
+
+// smAckRequestThreshold is the number of unacknowledged stanzas
+// from which peer gets requested to acknowledge them.
+const smAckRequestThreshold = 5
+
+// defaultSMMaxResumable is the maximum number of resumable sessions
+// an account can hold whenever not configured.
+const defaultSMMaxResumable = 10
+
+// defaultSMMaxResumeFailures is the maximum number of failed resumption
+// attempts per remote address within smResumeFailureWindow whenever not configured.
+const defaultSMMaxResumeFailures = 10
+
+// smResumeFailureWindow is the period failed resumption attempts are counted within.
+const smResumeFailureWindow = time.Minute
+
+// resumableSession represents a registered resumable session.
+type resumableSession struct {
+	id   string
+	strm *serverStream
+}
+
+// resumableStreams holds every stream whose session can be resumed, keyed by
+// its resumption identifier digest, so that lookups take no time depending on
+// how much of a guessed identifier matches. resumableAccounts holds every
+// account resumable session digests, least recently used first.
+var (
+	resumableMu       sync.Mutex
+	resumableStreams  = make(map[[sha256.Size]byte]resumableSession)
+	resumableAccounts = make(map[string][][sha256.Size]byte)
+)
+
+// resumeFailures holds failed resumption attempts per remote address,
+// swept of expired windows at most once per window.
+var (
+	resumeFailuresMu    sync.Mutex
+	resumeFailures      = make(map[string]*resumeFailureCount)
+	resumeFailuresSwept time.Time
+)
+
+// resumeFailureCount represents failed resumption attempts
+// within the window started at 'since'.
+type resumeFailureCount struct {
+	count int
+	since time.Time
+}
+
+// streamMgmt represents stream management (XEP-0198) session state.
+// It's only accessed from within the stream actor.
+type streamMgmt struct {
+	enabled      bool
+	resumeID     string        // empty unless session can be resumed
+	inbound      uint32        // stanzas received from peer
+	acked        uint32        // stanzas acknowledged by peer
+	unacked      []xml.Element // sent stanzas awaiting acknowledgement, oldest first
+	ackRequested bool
+	resumeTm     *time.Timer
+}
+
+// isStreamMgmtAvailable returns whether or not stream
+// management can be enabled over the stream.
+func (s *serverStream) isStreamMgmtAvailable() bool {
+	_, ok := s.cfg.Modules["stream_mgmt"]
+	return ok
+}
+
+// isResumable returns whether or not stream session
+// can be resumed once its connection gets lost.
+func (s *serverStream) isResumable() bool {
+	return s.sm.enabled && len(s.sm.resumeID) > 0
+}
+
+// handleStreamMgmt processes a stream management element,
+// returning false if elem is not one.
+func (s *serverStream) handleStreamMgmt(elem xml.Element) bool {
+	if elem.Namespace() != smNamespace || !s.isStreamMgmtAvailable() {
+		return false
+	}
+	switch elem.Name() {
+	case "enable":
+		s.enableStreamMgmt(elem)
+	case "resume":
+		s.resumeSession(elem)
+	case "r":
+		if s.sm.enabled {
+			a := xml.NewElementNamespace("a", smNamespace)
+			a.SetAttribute("h", strconv.FormatUint(uint64(s.sm.inbound), 10))
+			s.writeElement(a)
+		}
+	case "a":
+		if s.sm.enabled {
+			s.handleAck(elem)
+		}
+	default:
+		s.terminate(streamerror.ErrUnsupportedStanzaType, "")
+	}
+	return true
+}
+
+func (s *serverStream) enableStreamMgmt(elem xml.Element) {
+	if s.sm.enabled || len(s.Resource()) == 0 {
+		s.writeElement(smFailedElement("unexpected-request"))
+		return
+	}
+	s.sm.enabled = true
+
+	enabled := xml.NewElementNamespace("enabled", smNamespace)
+	timeout := s.cfg.ModStreamMgmt.ResumeTimeout
+	if resume := elem.Attribute("resume"); timeout > 0 && (resume == "true" || resume == "1") {
+		s.sm.resumeID = uuid.New()
+		registerResumable(s.sm.resumeID, s)
+
+		enabled.SetAttribute("id", s.sm.resumeID)
+		enabled.SetAttribute("resume", "true")
+		enabled.SetAttribute("max", strconv.Itoa(timeout))
+	}
+	s.writeElement(enabled)
+
+	log.Infof("enabled stream management... (%s/%s, resumable: %t)", s.Username(), s.Resource(), s.isResumable())
+}
+
+func (s *serverStream) handleAck(elem xml.Element) {
+	h, err := strconv.ParseUint(elem.Attribute("h"), 10, 32)
+	if err != nil {
+		s.terminate(streamerror.ErrUndefinedCondition, "Malformed acknowledgement")
+		return
+	}
+	if !s.ackStanzas(uint32(h)) {
+		text := fmt.Sprintf("You acknowledged %d stanzas, but only %d were sent", h, s.sm.acked+uint32(len(s.sm.unacked)))
+		s.terminate(streamerror.ErrUndefinedCondition, text)
+	}
+}
+
+// ackStanzas discards every unacknowledged stanza up to h, returning
+// false whenever h acknowledges stanzas that were never sent.
+func (s *serverStream) ackStanzas(h uint32) bool {
+	n := h - s.sm.acked // counters wrap around at 2^32
+	if uint64(n) > uint64(len(s.sm.unacked)) {
+		return false
+	}
+	s.sm.unacked = s.sm.unacked[n:]
+	if len(s.sm.unacked) == 0 {
+		s.sm.unacked = nil
+	}
+	s.sm.acked = h
+	s.sm.ackRequested = false
+	return true
+}
+
+// queueUnacked keeps a sent stanza until peer acknowledges it.
+func (s *serverStream) queueUnacked(stanza xml.Element) {
+	s.sm.unacked = append(s.sm.unacked, stanza)
+}
+
+// checkUnacked requests peer to acknowledge sent stanzas, terminating
+// the stream whenever too many of them are awaiting acknowledgement.
+func (s *serverStream) checkUnacked() {
+	maxQueueSize := s.cfg.ModStreamMgmt.MaxQueueSize
+	if maxQueueSize == 0 {
+		maxQueueSize = defaultSMMaxQueueSize
+	}
+	switch n := len(s.sm.unacked); {
+	case n > maxQueueSize:
+		s.terminate(streamerror.ErrResourceConstraint, "Too many unacknowledged stanzas")
+	case n >= smAckRequestThreshold && !s.sm.ackRequested && s.getState() != hibernated:
+		s.sm.ackRequested = true
+		s.writeElement(xml.NewElementNamespace("r", smNamespace))
+	}
+}
+
+// hibernate keeps stream session alive once its connection got lost,
+// so that it can be resumed within the configured timeout. Meanwhile,
+// sent stanzas are kept as unacknowledged.
+func (s *serverStream) hibernate() {
+	if s.ping != nil {
+		s.ping.SuspendPinging()
+	}
+	s.setState(hibernated)
+	s.tr.Close()
+
+	timeout := time.Second * time.Duration(s.cfg.ModStreamMgmt.ResumeTimeout)
+	s.sm.resumeTm = time.AfterFunc(timeout, func() {
+		s.post(s.expireSession)
+	})
+	log.Infof("hibernated stream... (id: %s, timeout: %v)", s.id, timeout)
+}
+
+// evictSession prevents a session evicted from the resumable ones from
+// being resumed, disconnecting its stream whenever hibernated.
+func (s *serverStream) evictSession(id string) {
+	if id != s.sm.resumeID || isResumableRegistered(id, s) {
+		return // resumed meanwhile...
+	}
+	s.sm.resumeID = ""
+	if s.sm.resumeTm != nil {
+		s.sm.resumeTm.Stop()
+		s.sm.resumeTm = nil
+	}
+	log.Infof("evicted resumable session... (id: %s)", s.id)
+	if s.getState() == hibernated {
+		s.disconnectClosingStream(false)
+	}
+}
+
+// maxResumable returns the maximum number of resumable sessions per account.
+func (s *serverStream) maxResumable() int {
+	if n := s.cfg.ModStreamMgmt.MaxResumable; n > 0 {
+		return n
+	}
+	return defaultSMMaxResumable
+}
+
+// maxResumeFailures returns the maximum number of failed resumption
+// attempts per remote address within smResumeFailureWindow.
+func (s *serverStream) maxResumeFailures() int {
+	if n := s.cfg.ModStreamMgmt.MaxResumeFailures; n > 0 {
+		return n
+	}
+	return defaultSMMaxResumeFailures
+}
+
+// expireSession disconnects a hibernated stream
+// whose session hasn't been resumed in time.
+func (s *serverStream) expireSession() {
+	if s.getState() != hibernated {
+		return // resumed meanwhile...
+	}
+	log.Infof("session resumption timed out... (id: %s)", s.id)
+	s.disconnectClosingStream(false)
+}
+
+// discardResumption prevents stream session from being resumed.
+func (s *serverStream) discardResumption() {
+	if len(s.sm.resumeID) > 0 {
+		unregisterResumable(s.sm.resumeID, s)
+	}
+	if s.sm.resumeTm != nil {
+		s.sm.resumeTm.Stop()
+		s.sm.resumeTm = nil
+	}
+}
+
+// resumeSession hands stream transport over to the session identified by
+// 'previd', as long as it belongs to the same account and hasn't expired.
+// Stream is silently released once handed over.
+func (s *serverStream) resumeSession(elem xml.Element) {
+	if s.sm.enabled || len(s.Resource()) > 0 {
+		s.writeElement(smFailedElement("unexpected-request"))
+		return
+	}
+	h, err := strconv.ParseUint(elem.Attribute("h"), 10, 32)
+	if err != nil {
+		s.writeElement(smFailedElement("bad-request"))
+		return
+	}
+	ip := remoteIP(s.RemoteAddr())
+	if !resumeAllowed(ip, s.maxResumeFailures()) {
+		log.Infof("refused session resumption... (id: %s, address: %s)", s.id, ip)
+		s.writeElement(smFailedElement("policy-violation"))
+		return
+	}
+	previd := elem.Attribute("previd")
+	prev := claimResumable(previd, s)
+	if prev == nil {
+		// session might have been persisted on a previous shutdown
+		if rs := claimRestored(previd, s); rs != nil {
+			s.resumeRestored(rs, uint32(h))
+			return
+		}
+		recordResumeFailure(ip)
+		s.writeElement(smFailedElement("item-not-found"))
+		return
+	}
+	var resumed bool
+	tr, secured, compressed := s.tr, s.IsSecured(), s.IsCompressed()
+	if !prev.runAndWait(func() { resumed = prev.resume(tr, secured, compressed, uint32(h)) }) || !resumed {
+		s.writeElement(smFailedElement("item-not-found"))
+		return
+	}
+	s.release()
+}
+
+// resume takes over tr transport, acknowledging sent stanzas up to h and
+// resending the remaining ones. It returns false whenever h acknowledges
+// stanzas that were never sent, leaving session as it was.
+func (s *serverStream) resume(tr transport.Transport, secured, compressed bool, h uint32) bool {
+	if !s.ackStanzas(h) {
+		registerResumable(s.sm.resumeID, s)
+		return false
+	}
+	if s.sm.resumeTm != nil {
+		s.sm.resumeTm.Stop()
+		s.sm.resumeTm = nil
+	}
+	if s.getState() != hibernated {
+		// connection not noticed to be lost yet...
+		if s.IsCompressed() {
+			s.reportCompressionStats()
+		}
+		s.tr.Close()
+	}
+	s.lock.Lock()
+	s.tr = tr
+	s.secured = secured
+	s.compressed = compressed
+	s.lock.Unlock()
+
+	registerResumable(s.sm.resumeID, s)
+	s.setState(sessionStarted)
+
+	resumed := xml.NewElementNamespace("resumed", smNamespace)
+	resumed.SetAttribute("previd", s.sm.resumeID)
+	resumed.SetAttribute("h", strconv.FormatUint(uint64(s.sm.inbound), 10))
+	s.transmitElement(resumed)
+	for _, stanza := range s.sm.unacked {
+		s.transmitElement(stanza)
+	}
+	s.sm.ackRequested = false
+	s.checkUnacked()
+
+	// clients are considered active whenever a stream starts
+	s.setClientActive()
+
+	if s.ping != nil {
+		s.ping.ResetDeadline()
+	}
+	go s.doRead(tr)
+
+	log.Infof("resumed stream... (id: %s, %s/%s, resent: %d)", s.id, s.Username(), s.Resource(), len(s.sm.unacked))
+	return true
+}
+
+// release discards a stream whose transport has been handed over
+// to a resumed session, leaving its connection open.
+func (s *serverStream) release() {
+	s.modules.Done()
+	if s.tracking != nil {
+		s.tracking.Done()
+	}
+	if err := c2s.Instance().UnregisterStream(s); err != nil {
+		log.Error(err)
+	}
+	atomic.AddInt64(&connectedStreams, -1)
+	s.setState(disconnected)
+}
+
+// rerouteUnacked treats every unacknowledged message as if it was never
+// delivered, handing it to another account resource or storing it offline.
+func (s *serverStream) rerouteUnacked() {
+	unacked := s.sm.unacked
+	s.sm.enabled = false
+	s.sm.unacked = nil
+
+	for _, stanza := range unacked {
+		message := reroutableMessage(stanza)
+		if message == nil {
+			continue
+		}
+		switch strm := highestPriorityStream(s.Username(), s.ID()); {
+		case strm != nil:
+			strm.SendElement(message)
+		case s.offline != nil:
+			s.offline.ArchiveMessageAndWait(message)
+		default:
+			log.Warnf("discarded unacknowledged message... (id: %s, to: %s)", message.ID(), message.To())
+		}
+	}
+}
+
+// reroutableMessage returns the message corresponding to an unacknowledged
+// stanza, or nil if it's not one worth being delivered elsewhere.
+func reroutableMessage(stanza xml.Element) *xml.Message {
+	message := unackedMessage(stanza)
+	if message == nil || !message.IsMessageWithBody() || message.IsGroupChat() || message.Type() == xml.ErrorType {
+		return nil
+	}
+	return message
+}
+
+// highestPriorityStream returns the highest priority available
+// stream of an account other than the one identified by excludedID.
+func highestPriorityStream(username, excludedID string) c2s.Stream {
+	var strm c2s.Stream
+	for _, candidate := range c2s.Instance().AvailableStreams(username) {
+		if candidate.ID() == excludedID {
+			continue
+		}
+		if strm == nil || candidate.Priority() > strm.Priority() {
+			strm = candidate
+		}
+	}
+	return strm
+}
+
+// unackedMessage returns the message corresponding to an unacknowledged
+// stanza, or nil if it's not a valid one.
+func unackedMessage(stanza xml.Element) *xml.Message {
+	if message, ok := stanza.(*xml.Message); ok {
+		return message
+	}
+	if stanza.Name() != "message" {
+		return nil
+	}
+	fromJID, err := xml.NewJIDString(stanza.From(), true)
+	if err != nil {
+		return nil
+	}
+	toJID, err := xml.NewJIDString(stanza.To(), true)
+	if err != nil {
+		return nil
+	}
+	message, err := xml.NewMessageFromElement(stanza, fromJID, toJID)
+	if err != nil {
+		return nil
+	}
+	return message
+}
+
+func smFailedElement(condition string) xml.Element {
+	failed := xml.NewElementNamespace("failed", smNamespace)
+	failed.AppendElement(xml.NewElementNamespace(condition, stanzaErrorNamespace))
+	return failed
+}
+
+func isStanzaElement(elem xml.Element) bool {
+	switch elem.Name() {
+	case "iq", "presence", "message":
+		return true
+	}
+	return false
+}
+
+// registerResumable registers s session as resumable by id, evicting
+// the least recently used one of its account whenever exceeding its limit.
+func registerResumable(id string, s *serverStream) {
+	digest := sha256.Sum256([]byte(id))
+	account := resumableAccount(s)
+
+	resumableMu.Lock()
+	resumableStreams[digest] = resumableSession{id: id, strm: s}
+	digests := append(removeDigest(resumableAccounts[account], digest), digest)
+
+	var evicted []resumableSession
+	for len(digests) > s.maxResumable() {
+		evicted = append(evicted, resumableStreams[digests[0]])
+		delete(resumableStreams, digests[0])
+		digests = digests[1:]
+	}
+	resumableAccounts[account] = digests
+	resumableMu.Unlock()
+
+	for _, rs := range evicted {
+		strm, evictedID := rs.strm, rs.id
+		go strm.post(func() { strm.evictSession(evictedID) })
+	}
+}
+
+func unregisterResumable(id string, s *serverStream) {
+	digest := sha256.Sum256([]byte(id))
+
+	resumableMu.Lock()
+	if resumableStreams[digest].strm == s {
+		delete(resumableStreams, digest)
+		unlinkResumable(resumableAccount(s), digest)
+	}
+	resumableMu.Unlock()
+}
+
+// isResumableRegistered returns whether or not s session is registered as resumable by id.
+func isResumableRegistered(id string, s *serverStream) bool {
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	return resumableStreams[sha256.Sum256([]byte(id))].strm == s
+}
+
+// claimResumable unregisters and returns the session identified by id,
+// as long as it belongs to the same account and server than s.
+func claimResumable(id string, s *serverStream) *serverStream {
+	digest := sha256.Sum256([]byte(id))
+
+	resumableMu.Lock()
+	defer resumableMu.Unlock()
+	rs, ok := resumableStreams[digest]
+	if !ok || subtle.ConstantTimeCompare([]byte(rs.id), []byte(id)) != 1 {
+		return nil
+	}
+	prev := rs.strm
+	if prev.cfg.ID != s.cfg.ID || prev.Username() != s.Username() || prev.Domain() != s.Domain() {
+		return nil
+	}
+	delete(resumableStreams, digest)
+	unlinkResumable(resumableAccount(prev), digest)
+	return prev
+}
+
+// unlinkResumable removes digest from account resumable sessions.
+// resumableMu must be held.
+func unlinkResumable(account string, digest [sha256.Size]byte) {
+	digests := removeDigest(resumableAccounts[account], digest)
+	if len(digests) > 0 {
+		resumableAccounts[account] = digests
+	} else {
+		delete(resumableAccounts, account)
+	}
+}
+
+func removeDigest(digests [][sha256.Size]byte, digest [sha256.Size]byte) [][sha256.Size]byte {
+	for i, d := range digests {
+		if d == digest {
+			return append(digests[:i:i], digests[i+1:]...)
+		}
+	}
+	return digests
+}
+
+// resumableAccount returns the key s resumable sessions are limited by.
+func resumableAccount(s *serverStream) string {
+	return s.cfg.ID + "/" + s.Username() + "@" + s.Domain()
+}
+
+// resumeAllowed returns whether or not ip failed resumption
+// attempts are below max within current window.
+func resumeAllowed(ip string, max int) bool {
+	resumeFailuresMu.Lock()
+	defer resumeFailuresMu.Unlock()
+	fc := resumeFailures[ip]
+	return fc == nil || time.Since(fc.since) >= smResumeFailureWindow || fc.count < max
+}
+
+// recordResumeFailure accounts a failed resumption attempt from ip.
+func recordResumeFailure(ip string) {
+	stats.Default().Counter("stream_mgmt/resume_failures", "attempts").Inc()
+
+	now := time.Now()
+	resumeFailuresMu.Lock()
+	defer resumeFailuresMu.Unlock()
+	if now.Sub(resumeFailuresSwept) >= smResumeFailureWindow {
+		for addr, fc := range resumeFailures {
+			if now.Sub(fc.since) >= smResumeFailureWindow {
+				delete(resumeFailures, addr)
+			}
+		}
+		resumeFailuresSwept = now
+	}
+	fc := resumeFailures[ip]
+	if fc != nil && now.Sub(fc.since) >= smResumeFailureWindow {
+		fc = nil // window expired
+	}
+	if fc == nil {
+		fc = &resumeFailureCount{since: now}
+		resumeFailures[ip] = fc
+	}
+	fc.count++
+}
+
+// remoteIP returns addr host part, or an empty string if unknown.
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,298 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/xml"
+)
+
+// defaultSMMaxPersistedQueueSize is the maximum number of unacknowledged
+// stanzas a session can hold to be persisted on shutdown whenever not configured.
+const defaultSMMaxPersistedQueueSize = 100
+
+// restoredSession represents a session persisted on a previous shutdown,
+// which can be resumed over any stream of the same account and server.
+type restoredSession struct {
+	session  model.StreamSession
+	cfg      *config.Server
+	expireTm *time.Timer
+}
+
+// restoredSessions holds every restored session not resumed yet,
+// keyed by its resumption identifier digest.
+var (
+	restoredMu       sync.Mutex
+	restoredSessions = make(map[[sha256.Size]byte]*restoredSession)
+)
+
+// maxPersistedQueueSize returns the maximum number of unacknowledged
+// stanzas a session can hold to be persisted on shutdown.
+func (s *serverStream) maxPersistedQueueSize() int {
+	if n := s.cfg.ModStreamMgmt.MaxPersistedQueueSize; n > 0 {
+		return n
+	}
+	return defaultSMMaxPersistedQueueSize
+}
+
+// persistSession stores a resumable session on shutdown, so that it can be
+// resumed once server gets restarted. Sessions holding too many unacknowledged
+// stanzas are not persisted, these being rerouted as on any other disconnection.
+func (s *serverStream) persistSession() {
+	if !s.isResumable() || len(s.sm.unacked) > s.maxPersistedQueueSize() {
+		return
+	}
+	ss := model.StreamSession{
+		ID:        s.sm.resumeID,
+		ServerID:  s.cfg.ID,
+		Username:  s.Username(),
+		Domain:    s.Domain(),
+		Resource:  s.Resource(),
+		Inbound:   s.sm.inbound,
+		Acked:     s.sm.acked,
+		Unacked:   s.sm.unacked,
+		ExpiresAt: time.Now().Add(time.Second * time.Duration(s.cfg.ModStreamMgmt.ResumeTimeout)),
+	}
+	s.lock.RLock()
+	if s.available {
+		presence := xml.NewElementName("presence")
+		presence.AppendElements(s.presenceElements)
+		ss.Presence = presence
+	}
+	s.lock.RUnlock()
+
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+	if err := storage.Instance().InsertStreamSession(ctx, &ss); err != nil {
+		log.Error(err)
+		return // fallback to rerouting...
+	}
+	// unacknowledged stanzas are handed over to the persisted session
+	s.sm.enabled = false
+	s.sm.unacked = nil
+
+	log.Infof("persisted stream session... (id: %s, %s/%s, unacked: %d)", s.id, ss.Username, ss.Resource, len(ss.Unacked))
+}
+
+// resumeRestored resumes a restored session over this very stream, binding its
+// resource and resending the stanzas not acknowledged up to h. Restored session
+// remains resumable whenever h acknowledges stanzas that were never sent
+// or its resource is already bound to another stream.
+func (s *serverStream) resumeRestored(rs *restoredSession, h uint32) {
+	ss := &rs.session
+	if s.userResourceStream(ss.Resource) != nil {
+		restoreSession(ss, rs.cfg)
+		s.writeElement(smFailedElement("item-not-found"))
+		return
+	}
+	s.sm.acked = ss.Acked
+	s.sm.unacked = ss.Unacked
+	if !s.ackStanzas(h) {
+		s.sm.acked = 0
+		s.sm.unacked = nil
+		restoreSession(ss, rs.cfg)
+		s.writeElement(smFailedElement("item-not-found"))
+		return
+	}
+	userJID, _ := xml.NewJID(ss.Username, ss.Domain, ss.Resource, true)
+	s.lock.Lock()
+	s.resource = ss.Resource
+	s.jid = userJID
+	s.lock.Unlock()
+
+	if err := c2s.Instance().AuthenticateStream(s); err != nil {
+		log.Error(err)
+	}
+	s.sm.enabled = true
+	s.sm.resumeID = ss.ID
+	s.sm.inbound = ss.Inbound
+	registerResumable(ss.ID, s)
+	s.setState(sessionStarted)
+
+	if s.ping != nil {
+		s.ping.StartPinging()
+	}
+	resumed := xml.NewElementNamespace("resumed", smNamespace)
+	resumed.SetAttribute("previd", ss.ID)
+	resumed.SetAttribute("h", strconv.FormatUint(uint64(s.sm.inbound), 10))
+	s.transmitElement(resumed)
+	for _, stanza := range s.sm.unacked {
+		s.transmitElement(stanza)
+	}
+	s.checkUnacked()
+
+	// peer becomes available again as it was before shutdown
+	if ss.Presence != nil {
+		presence, err := xml.NewPresenceFromElement(ss.Presence, userJID, userJID.ToBareJID())
+		if err != nil {
+			log.Error(err)
+		} else {
+			err = c2s.Instance().Dispatch(userJID, func() {
+				if s.getState() == disconnected {
+					return
+				}
+				s.processPresence(presence)
+			})
+			if err != nil {
+				log.Error(err)
+			}
+		}
+	}
+	log.Infof("resumed restored stream... (id: %s, %s/%s, resent: %d)", s.id, ss.Username, ss.Resource, len(s.sm.unacked))
+}
+
+// restoreSessions loads the sessions persisted by cfg server on its last
+// shutdown, so that they can be resumed until they expire.
+func restoreSessions(cfg *config.Server) {
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	sessions, err := storage.Instance().FetchStreamSessions(ctx, cfg.ID)
+	if err != nil {
+		log.Error(err)
+		return
+	}
+	if len(sessions) == 0 {
+		return
+	}
+	if err := storage.Instance().DeleteStreamSessions(ctx, cfg.ID); err != nil {
+		log.Error(err)
+		return
+	}
+	for i := range sessions {
+		restoreSession(&sessions[i], cfg)
+	}
+	log.Infof("%s: restored %d stream sessions", cfg.ID, len(sessions))
+}
+
+// restoreSession registers ss as resumable until it expires, rerouting
+// its unacknowledged messages right away whenever it already did
+// or resumption is no longer enabled.
+func restoreSession(ss *model.StreamSession, cfg *config.Server) {
+	_, enabled := cfg.Modules["stream_mgmt"]
+	timeout := time.Until(ss.ExpiresAt)
+	if !enabled || cfg.ModStreamMgmt.ResumeTimeout == 0 || timeout <= 0 {
+		rerouteRestored(ss, cfg)
+		return
+	}
+	digest := sha256.Sum256([]byte(ss.ID))
+	rs := &restoredSession{session: *ss, cfg: cfg}
+
+	restoredMu.Lock()
+	restoredSessions[digest] = rs
+	rs.expireTm = time.AfterFunc(timeout, func() {
+		expireRestored(digest, rs)
+	})
+	restoredMu.Unlock()
+}
+
+// claimRestored unregisters and returns the restored session identified
+// by id, as long as it belongs to the same account and server than s.
+func claimRestored(id string, s *serverStream) *restoredSession {
+	digest := sha256.Sum256([]byte(id))
+
+	restoredMu.Lock()
+	defer restoredMu.Unlock()
+	rs, ok := restoredSessions[digest]
+	if !ok || subtle.ConstantTimeCompare([]byte(rs.session.ID), []byte(id)) != 1 {
+		return nil
+	}
+	if rs.cfg.ID != s.cfg.ID || rs.session.Username != s.Username() || rs.session.Domain != s.Domain() {
+		return nil
+	}
+	rs.expireTm.Stop()
+	delete(restoredSessions, digest)
+	return rs
+}
+
+// expireRestored reroutes the unacknowledged messages
+// of a restored session that hasn't been resumed in time.
+func expireRestored(digest [sha256.Size]byte, rs *restoredSession) {
+	restoredMu.Lock()
+	if restoredSessions[digest] != rs {
+		restoredMu.Unlock()
+		return // resumed meanwhile...
+	}
+	delete(restoredSessions, digest)
+	restoredMu.Unlock()
+
+	log.Infof("restored session resumption timed out... (%s/%s)", rs.session.Username, rs.session.Resource)
+	rerouteRestored(&rs.session, rs.cfg)
+}
+
+// persistRestoredSessions stores back every restored session
+// not resumed yet, so that it remains resumable after a restart.
+func persistRestoredSessions() {
+	restoredMu.Lock()
+	var sessions []*restoredSession
+	for digest, rs := range restoredSessions {
+		if !rs.expireTm.Stop() {
+			continue // being expired...
+		}
+		sessions = append(sessions, rs)
+		delete(restoredSessions, digest)
+	}
+	restoredMu.Unlock()
+
+	for _, rs := range sessions {
+		ctx, cancel := storage.QueryContext()
+		err := storage.Instance().InsertStreamSession(ctx, &rs.session)
+		cancel()
+		if err != nil {
+			log.Error(err)
+			rerouteRestored(&rs.session, rs.cfg)
+		}
+	}
+}
+
+// rerouteRestored treats every unacknowledged message of a restored session
+// as if it was never delivered, handing it to another account resource
+// or storing it offline.
+func rerouteRestored(ss *model.StreamSession, cfg *config.Server) {
+	_, offline := cfg.Modules["offline"]
+	for _, stanza := range ss.Unacked {
+		message := reroutableMessage(stanza)
+		if message == nil {
+			continue
+		}
+		if strm := highestPriorityStream(ss.Username, ""); strm != nil {
+			strm.SendElement(message)
+			continue
+		}
+		if offline && storeOfflineMessage(message, ss.Username, &cfg.ModOffline) {
+			continue
+		}
+		log.Warnf("discarded unacknowledged message... (id: %s, to: %s)", message.ID(), message.To())
+	}
+}
+
+// storeOfflineMessage stores message offline as of cfg queue
+// settings, returning false if it couldn't be stored.
+func storeOfflineMessage(message *xml.Message, username string, cfg *config.ModOffline) bool {
+	if cfg.QueueSize <= 0 {
+		return false
+	}
+	ctx, cancel := storage.QueryContext()
+	defer cancel()
+
+	dropOldest := cfg.QueuePolicy == config.DropOldestOnFullQueue
+	inserted, err := storage.Instance().InsertCappedOfflineMessage(ctx, message, username, cfg.QueueSize, dropOldest)
+	if err != nil {
+		log.Error(err)
+		return false
+	}
+	return inserted
+}
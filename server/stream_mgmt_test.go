@@ -0,0 +1,760 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package server
+
+import (
+	"context"
+	"crypto/sha256"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStreamMgmt_Features(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	// not offered unless enabled...
+	_, conn := tUtilStreamInit()
+	features := tUtilStreamMgmtAuthenticate(conn, t)
+	require.Nil(t, features.FindElementNamespace("sm", smNamespace))
+
+	_, conn = tUtilStreamMgmtInit("abcd5678", tUtilStreamMgmtConfig(60))
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features = conn.ClientReadElement()
+	require.Nil(t, features.FindElementNamespace("sm", smNamespace))
+
+	// ...and only offered once authenticated
+	tUtilStreamAuthenticate(conn, t)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features = conn.ClientReadElement()
+	require.NotNil(t, features.FindElementNamespace("sm", smNamespace))
+}
+
+func TestStreamMgmt_Enable(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234", tUtilStreamMgmtConfig(60))
+	tUtilStreamMgmtAuthenticate(conn, t)
+
+	// resource not bound yet...
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3"/>`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.NotNil(t, elem.FindElement("unexpected-request"))
+
+	tUtilStreamStartSession(conn, t)
+
+	// not resumable...
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "enabled", elem.Name())
+	require.Equal(t, smNamespace, elem.Namespace())
+	require.Equal(t, "", elem.Attribute("id"))
+	require.Equal(t, "", elem.Attribute("resume"))
+
+	// already enabled...
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.NotNil(t, elem.FindElement("unexpected-request"))
+
+	// lost connection can't be resumed
+	conn.ClientDisconnect()
+	conn.WaitClose()
+	require.Equal(t, disconnected, stm.getState())
+
+	// resumable...
+	stm, conn = tUtilStreamMgmtInit("abcd5678", tUtilStreamMgmtConfig(60))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+
+	previd := tUtilStreamMgmtEnable(conn, t)
+	require.True(t, len(previd) > 0)
+	stm.Disconnect(nil)
+	conn.WaitClose()
+
+	// resumption not configured...
+	stm, conn = tUtilStreamMgmtInit("abcd9012", tUtilStreamMgmtConfig(0))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "enabled", elem.Name())
+	require.Equal(t, "", elem.Attribute("id"))
+}
+
+func TestStreamMgmt_Acknowledgements(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234", tUtilStreamMgmtConfig(60))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	tUtilStreamMgmtEnable(conn, t)
+
+	// inbound stanzas are counted...
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="ping_1" to="localhost"><ping xmlns="urn:xmpp:ping"/></iq>`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, xml.ResultType, elem.Type())
+
+	conn.ClientWriteBytes([]byte(`<r xmlns="urn:xmpp:sm:3"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "a", elem.Name())
+	require.Equal(t, "1", elem.Attribute("h"))
+
+	// ...as well as outbound ones, requesting acknowledgement after a few of them
+	jid, _ := xml.NewJID("user", "localhost", "balcony", true)
+	for i := 1; i < smAckRequestThreshold; i++ {
+		stm.SendElement(tUtilStreamMgmtMessage(jid))
+		require.Equal(t, "message", conn.ClientReadElement().Name())
+	}
+	elem = conn.ClientReadElement()
+	require.Equal(t, "r", elem.Name())
+	require.Equal(t, smNamespace, elem.Namespace())
+	require.Equal(t, smAckRequestThreshold, tUtilStreamMgmtUnacked(stm))
+
+	conn.ClientWriteBytes([]byte(`<a xmlns="urn:xmpp:sm:3" h="3"/>`))
+	tUtilStreamMgmtRequestAck(conn, t)
+	require.Equal(t, smAckRequestThreshold-3, tUtilStreamMgmtUnacked(stm))
+
+	conn.ClientWriteBytes([]byte(`<a xmlns="urn:xmpp:sm:3" h="5"/>`))
+	tUtilStreamMgmtRequestAck(conn, t)
+	require.Equal(t, 0, tUtilStreamMgmtUnacked(stm))
+
+	// acknowledging stanzas never sent...
+	conn.ClientWriteBytes([]byte(`<a xmlns="urn:xmpp:sm:3" h="8"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.FindElement(streamerror.ErrUndefinedCondition.Error()))
+	conn.WaitClose()
+
+	require.Equal(t, disconnected, stm.getState())
+}
+
+func TestStreamMgmt_Resume(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamMgmtConfig(60)
+	stm, conn := tUtilStreamMgmtInit("abcd1234", cfg)
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	previd := tUtilStreamMgmtEnable(conn, t)
+
+	jid, _ := xml.NewJID("user", "localhost", "balcony", true)
+	msg1 := tUtilStreamMgmtMessage(jid)
+	stm.SendElement(msg1)
+	require.Equal(t, msg1.ID(), conn.ClientReadElement().ID())
+
+	// connection gets lost...
+	conn.ClientDisconnect()
+	conn.WaitClose()
+	require.Equal(t, hibernated, stm.getState())
+	require.Equal(t, stm, c2s.Instance().ResourceStream(jid))
+
+	// ...while stanzas keep being sent
+	msg2 := tUtilStreamMgmtMessage(jid)
+	stm.SendElement(msg2)
+	require.Equal(t, 2, tUtilStreamMgmtUnacked(stm))
+
+	// unknown session...
+	stm2, conn2 := tUtilStreamMgmtInit("abcd5678", cfg)
+	tUtilStreamMgmtAuthenticate(conn2, t)
+
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + uuid.New() + `" h="0"/>`))
+	elem := conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.NotNil(t, elem.FindElement("item-not-found"))
+	require.Equal(t, authenticated, stm2.getState())
+
+	// acknowledging stanzas never sent...
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="5"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.Equal(t, hibernated, stm.getState())
+
+	// resume session, acknowledging first message
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="1"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "resumed", elem.Name())
+	require.Equal(t, previd, elem.Attribute("previd"))
+	require.Equal(t, "0", elem.Attribute("h"))
+
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msg2.ID(), elem.ID())
+
+	time.Sleep(time.Millisecond * 100) // wait until streams internal state changes
+
+	require.Equal(t, sessionStarted, stm.getState())
+	require.Equal(t, disconnected, stm2.getState())
+	require.Equal(t, stm, c2s.Instance().ResourceStream(jid))
+	require.Equal(t, 1, len(c2s.Instance().Streams()))
+
+	// resumed session keeps working over the new connection
+	conn2.ClientWriteBytes([]byte(`<iq type="get" id="ping_1" to="localhost"><ping xmlns="urn:xmpp:ping"/></iq>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, "ping_1", elem.ID())
+
+	conn2.ClientWriteBytes([]byte(`<r xmlns="urn:xmpp:sm:3"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "a", elem.Name())
+	require.Equal(t, "1", elem.Attribute("h"))
+
+	// resuming from within a bound session...
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="1"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.NotNil(t, elem.FindElement("unexpected-request"))
+	require.Equal(t, sessionStarted, stm.getState())
+
+	stm.Disconnect(nil)
+	conn2.WaitClose()
+	require.Equal(t, disconnected, stm.getState())
+}
+
+func TestStreamMgmt_ResumeLiveSession(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamMgmtConfig(60)
+	stm, conn := tUtilStreamMgmtInit("abcd1234", cfg)
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	previd := tUtilStreamMgmtEnable(conn, t)
+
+	// connection loss not noticed yet...
+	stm2, conn2 := tUtilStreamMgmtInit("abcd5678", cfg)
+	tUtilStreamMgmtAuthenticate(conn2, t)
+
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="0"/>`))
+	elem := conn2.ClientReadElement()
+	require.Equal(t, "resumed", elem.Name())
+
+	// ...stale connection gets closed
+	conn.WaitClose()
+
+	time.Sleep(time.Millisecond * 100) // wait until streams internal state changes
+
+	require.Equal(t, sessionStarted, stm.getState())
+	require.Equal(t, disconnected, stm2.getState())
+}
+
+func TestStreamMgmt_ResumeTimeout(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamMgmtConfig(1)
+	stm, conn := tUtilStreamMgmtInit("abcd1234", cfg)
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	previd := tUtilStreamMgmtEnable(conn, t)
+
+	jid, _ := xml.NewJID("user", "localhost", "balcony", true)
+	stm.SendElement(tUtilStreamMgmtMessage(jid))
+	_ = conn.ClientReadElement()
+
+	conn.ClientDisconnect()
+	conn.WaitClose()
+	require.Equal(t, hibernated, stm.getState())
+
+	time.Sleep(time.Millisecond * 1500) // wait until resumption timeout expires
+
+	require.Equal(t, disconnected, stm.getState())
+	require.Nil(t, c2s.Instance().ResourceStream(jid))
+
+	// unacknowledged message has been stored offline...
+	cnt, err := storage.Instance().CountOfflineMessages(context.Background(), "user")
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+
+	// ...and session can't be resumed anymore
+	_, conn2 := tUtilStreamMgmtInit("abcd5678", cfg)
+	tUtilStreamMgmtAuthenticate(conn2, t)
+
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="1"/>`))
+	elem := conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.NotNil(t, elem.FindElement("item-not-found"))
+}
+
+func TestStreamMgmt_ClaimResumable(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	tUtilStreamMgmtResetResumable()
+	defer tUtilStreamMgmtResetResumable()
+
+	cfg := tUtilStreamMgmtConfig(60)
+	stm := tUtilStreamMgmtResumable("abcd1234", "user", cfg)
+	defer stm.Disconnect(nil)
+
+	previd := uuid.New()
+	registerResumable(previd, stm)
+
+	// wrong tokens never match, however close to the right one...
+	guess := []byte(previd)
+	guess[len(guess)-1]++
+	claimer := tUtilStreamMgmtResumable("abcd5678", "user", cfg)
+	defer claimer.Disconnect(nil)
+	require.Nil(t, claimResumable(string(guess), claimer))
+	require.Nil(t, claimResumable(previd[:len(previd)-1], claimer))
+
+	// ...nor sessions of other accounts...
+	other := tUtilStreamMgmtResumable("efgh1234", "romeo", cfg)
+	defer other.Disconnect(nil)
+	require.Nil(t, claimResumable(previd, other))
+
+	// ...or other servers
+	otherCfg := tUtilStreamMgmtConfig(60)
+	otherCfg.ID = "server-id:5678"
+	otherSrv := tUtilStreamMgmtResumable("efgh5678", "user", otherCfg)
+	defer otherSrv.Disconnect(nil)
+	require.Nil(t, claimResumable(previd, otherSrv))
+
+	require.True(t, isResumableRegistered(previd, stm))
+	require.Equal(t, stm, claimResumable(previd, claimer))
+	require.False(t, isResumableRegistered(previd, stm))
+	require.Nil(t, claimResumable(previd, claimer))
+	require.Equal(t, 0, len(resumableAccounts))
+}
+
+func TestStreamMgmt_ResumableEviction(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	tUtilStreamMgmtResetResumable()
+	defer tUtilStreamMgmtResetResumable()
+
+	cfg := tUtilStreamMgmtConfig(60)
+	cfg.ModStreamMgmt.MaxResumable = 2
+
+	var stms []*serverStream
+	var ids []string
+	for i := 0; i < 3; i++ {
+		stm := tUtilStreamMgmtResumable(uuid.New(), "user", cfg)
+		defer stm.Disconnect(nil)
+
+		id := uuid.New()
+		stm.runAndWait(func() { stm.sm.enabled, stm.sm.resumeID = true, id })
+		stms = append(stms, stm)
+		ids = append(ids, id)
+	}
+	registerResumable(ids[0], stms[0])
+	registerResumable(ids[1], stms[1])
+	registerResumable(ids[0], stms[0]) // used again, so that second one is the least recently used
+
+	// other accounts don't count
+	romeo := tUtilStreamMgmtResumable(uuid.New(), "romeo", cfg)
+	defer romeo.Disconnect(nil)
+	registerResumable(uuid.New(), romeo)
+
+	registerResumable(ids[2], stms[2])
+	require.True(t, isResumableRegistered(ids[0], stms[0]))
+	require.False(t, isResumableRegistered(ids[1], stms[1]))
+	require.True(t, isResumableRegistered(ids[2], stms[2]))
+	require.Equal(t, 2, len(resumableAccounts))
+
+	// evicted session is not resumable anymore
+	var resumable = true
+	for i := 0; i < 50 && resumable; i++ {
+		time.Sleep(time.Millisecond * 10)
+		stms[1].runAndWait(func() { resumable = stms[1].isResumable() })
+	}
+	require.False(t, resumable)
+}
+
+func TestStreamMgmt_ResumeFailures(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	tUtilStreamMgmtResetResumable()
+	tUtilStreamMgmtResetResumable()
+	defer tUtilStreamMgmtResetResumable()
+
+	cfg := tUtilStreamMgmtConfig(60)
+	cfg.ModStreamMgmt.MaxResumeFailures = 2
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234", cfg)
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	previd := tUtilStreamMgmtEnable(conn, t)
+
+	stm2, conn2 := tUtilStreamMgmtInit("abcd5678", cfg)
+	tUtilStreamMgmtAuthenticate(conn2, t)
+
+	for i := 0; i < 2; i++ {
+		conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + uuid.New() + `" h="0"/>`))
+		elem := conn2.ClientReadElement()
+		require.Equal(t, "failed", elem.Name())
+		require.NotNil(t, elem.FindElement("item-not-found"))
+	}
+	// too many failed attempts from the same address
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="0"/>`))
+	elem := conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.NotNil(t, elem.FindElement("policy-violation"))
+	require.True(t, isResumableRegistered(previd, stm))
+
+	stm2.Disconnect(nil)
+	conn2.WaitClose()
+	stm.Disconnect(nil)
+	conn.WaitClose()
+}
+
+func TestStreamMgmt_RerouteUnacked(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamMgmtInit("abcd1234", tUtilStreamMgmtConfig(60))
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	tUtilStreamMgmtEnable(conn, t)
+
+	// another account resource...
+	jid, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jid2, _ := xml.NewJID("user", "localhost", "garden", true)
+	stm2 := c2s.NewMockStream("abcd5678", jid2)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	msg := tUtilStreamMgmtMessage(jid)
+	stm.SendElement(msg)
+	_ = conn.ClientReadElement()
+
+	// unacknowledged message gets handed over once stream is closed...
+	stm.Disconnect(nil)
+	conn.WaitClose()
+
+	elem := stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msg.ID(), elem.ID())
+}
+
+func TestStreamMgmt_PersistSession(t *testing.T) {
+	tUtilStreamMgmtResetResumable()
+	defer tUtilStreamMgmtResetResumable()
+
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamMgmtConfig(60)
+	stm, conn := tUtilStreamMgmtInit("abcd1234", cfg)
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	previd := tUtilStreamMgmtEnable(conn, t)
+
+	conn.ClientWriteBytes([]byte(`<presence><status>Away for a while</status></presence>`))
+	tUtilStreamMgmtRequestAck(conn, t)
+
+	jid, _ := xml.NewJID("user", "localhost", "balcony", true)
+	msg1 := tUtilStreamMgmtMessage(jid)
+	msg2 := tUtilStreamMgmtMessage(jid)
+	stm.SendElement(msg1)
+	stm.SendElement(msg2)
+	require.Equal(t, msg1.ID(), conn.ClientReadElement().ID())
+	require.Equal(t, msg2.ID(), conn.ClientReadElement().ID())
+
+	// server shuts down...
+	stm.Terminate(streamerror.ErrSystemShutdown, "")
+	conn.WaitClose()
+	require.Equal(t, disconnected, stm.getState())
+
+	// ...keeping unacknowledged messages along with the session
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "user")
+	require.Equal(t, 0, cnt)
+	sessions, _ := storage.Instance().FetchStreamSessions(context.Background(), cfg.ID)
+	require.Equal(t, 1, len(sessions))
+	require.Equal(t, 2, len(sessions[0].Unacked))
+
+	// ...and gets restarted
+	restoreSessions(cfg)
+	sessions, _ = storage.Instance().FetchStreamSessions(context.Background(), cfg.ID)
+	require.Equal(t, 0, len(sessions))
+
+	stm2, conn2 := tUtilStreamMgmtInit("abcd5678", cfg)
+	tUtilStreamMgmtAuthenticate(conn2, t)
+
+	// acknowledging stanzas never sent...
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="5"/>`))
+	elem := conn2.ClientReadElement()
+	require.Equal(t, "failed", elem.Name())
+	require.Equal(t, authenticated, stm2.getState())
+
+	// resume session, acknowledging first message
+	conn2.ClientWriteBytes([]byte(`<resume xmlns="urn:xmpp:sm:3" previd="` + previd + `" h="1"/>`))
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "resumed", elem.Name())
+	require.Equal(t, previd, elem.Attribute("previd"))
+	require.Equal(t, "1", elem.Attribute("h"))
+
+	elem = conn2.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msg2.ID(), elem.ID())
+
+	time.Sleep(time.Millisecond * 100) // wait until presence gets processed
+
+	require.Equal(t, sessionStarted, stm2.getState())
+	require.Equal(t, stm2, c2s.Instance().ResourceStream(jid))
+	presenceElements := stm2.PresenceElements()
+	require.Equal(t, 1, len(presenceElements))
+	require.Equal(t, "Away for a while", presenceElements[0].Text())
+
+	// restored session is no longer held once resumed
+	restoredMu.Lock()
+	require.Equal(t, 0, len(restoredSessions))
+	restoredMu.Unlock()
+
+	conn2.ClientWriteBytes([]byte(`<a xmlns="urn:xmpp:sm:3" h="2"/>`))
+	tUtilStreamMgmtRequestAck(conn2, t)
+	require.Equal(t, 0, tUtilStreamMgmtUnacked(stm2))
+
+	stm2.Disconnect(nil)
+	conn2.WaitClose()
+	cnt, _ = storage.Instance().CountOfflineMessages(context.Background(), "user")
+	require.Equal(t, 0, cnt)
+}
+
+func TestStreamMgmt_PersistSessionQueueLimit(t *testing.T) {
+	tUtilStreamMgmtResetResumable()
+	defer tUtilStreamMgmtResetResumable()
+
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamMgmtConfig(60)
+	cfg.ModStreamMgmt.MaxPersistedQueueSize = 1
+	stm, conn := tUtilStreamMgmtInit("abcd1234", cfg)
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+	tUtilStreamMgmtEnable(conn, t)
+
+	jid, _ := xml.NewJID("user", "localhost", "balcony", true)
+	stm.SendElement(tUtilStreamMgmtMessage(jid))
+	stm.SendElement(tUtilStreamMgmtMessage(jid))
+	_ = conn.ClientReadElement()
+	_ = conn.ClientReadElement()
+
+	// too many unacknowledged messages to be persisted...
+	stm.Terminate(streamerror.ErrSystemShutdown, "")
+	conn.WaitClose()
+
+	sessions, _ := storage.Instance().FetchStreamSessions(context.Background(), cfg.ID)
+	require.Equal(t, 0, len(sessions))
+
+	// ...these being stored offline instead
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "user")
+	require.Equal(t, 2, cnt)
+}
+
+func TestStreamMgmt_RestoredSessionExpiry(t *testing.T) {
+	tUtilStreamMgmtResetResumable()
+	defer tUtilStreamMgmtResetResumable()
+
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamMgmtConfig(60)
+	jid, _ := xml.NewJID("user", "localhost", "balcony", true)
+	session := func(id string, expiresAt time.Time) *model.StreamSession {
+		return &model.StreamSession{
+			ID: id, ServerID: cfg.ID, Username: "user", Domain: "localhost", Resource: "balcony",
+			Unacked: []xml.Element{tUtilStreamMgmtMessage(jid)}, ExpiresAt: expiresAt,
+		}
+	}
+	// expired while server was down...
+	storage.Instance().InsertStreamSession(context.Background(), session(uuid.New(), time.Now().Add(-time.Second)))
+	// ...or expiring after restart
+	storage.Instance().InsertStreamSession(context.Background(), session(uuid.New(), time.Now().Add(time.Millisecond*250)))
+	// ...or still resumable at next shutdown
+	storage.Instance().InsertStreamSession(context.Background(), session(uuid.New(), time.Now().Add(time.Minute)))
+
+	restoreSessions(cfg)
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "user")
+	require.Equal(t, 1, cnt)
+
+	time.Sleep(time.Millisecond * 500) // wait until restored session expires
+
+	cnt, _ = storage.Instance().CountOfflineMessages(context.Background(), "user")
+	require.Equal(t, 2, cnt)
+
+	persistRestoredSessions()
+	sessions, _ := storage.Instance().FetchStreamSessions(context.Background(), cfg.ID)
+	require.Equal(t, 1, len(sessions))
+	require.Equal(t, 1, len(sessions[0].Unacked))
+
+	restoredMu.Lock()
+	require.Equal(t, 0, len(restoredSessions))
+	restoredMu.Unlock()
+}
+
+func tUtilStreamMgmtAuthenticate(conn *transport.MockConn, t *testing.T) xml.Element {
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	return conn.ClientReadElement()
+}
+
+func tUtilStreamMgmtEnable(conn *transport.MockConn, t *testing.T) string {
+	conn.ClientWriteBytes([]byte(`<enable xmlns="urn:xmpp:sm:3" resume="true"/>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "enabled", elem.Name())
+	require.Equal(t, "true", elem.Attribute("resume"))
+	return elem.Attribute("id")
+}
+
+// tUtilStreamMgmtRequestAck requests an acknowledgement, so that
+// every previously written element has been processed once it returns.
+func tUtilStreamMgmtRequestAck(conn *transport.MockConn, t *testing.T) {
+	conn.ClientWriteBytes([]byte(`<r xmlns="urn:xmpp:sm:3"/>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "a", elem.Name())
+}
+
+func tUtilStreamMgmtUnacked(stm *serverStream) int {
+	var n int
+	stm.runAndWait(func() { n = len(stm.sm.unacked) })
+	return n
+}
+
+func tUtilStreamMgmtMessage(to *xml.JID) *xml.Message {
+	from, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	body := xml.NewElementName("body")
+	body.SetText("Hi buddy!")
+	msg.AppendElement(body)
+	return msg
+}
+
+func tUtilStreamMgmtInit(id string, cfg *config.Server) (*serverStream, *transport.MockConn) {
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	stm := newStream(id, tr, cfg)
+	c2s.Instance().RegisterStream(stm)
+	return stm, conn
+}
+
+func tUtilStreamMgmtConfig(resumeTimeout int) *config.Server {
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["stream_mgmt"] = struct{}{}
+	cfg.ModStreamMgmt = config.ModStreamMgmt{ResumeTimeout: resumeTimeout}
+	return cfg
+}
+
+// tUtilStreamMgmtResumable returns a stream authenticated as username,
+// without going through any negotiation.
+func tUtilStreamMgmtResumable(id, username string, cfg *config.Server) *serverStream {
+	stm, _ := tUtilStreamMgmtInit(id, cfg)
+	stm.lock.Lock()
+	stm.username = username
+	stm.domain = "localhost"
+	stm.lock.Unlock()
+	return stm
+}
+
+func tUtilStreamMgmtResetResumable() {
+	resumableMu.Lock()
+	resumableStreams = make(map[[sha256.Size]byte]resumableSession)
+	resumableAccounts = make(map[string][][sha256.Size]byte)
+	resumableMu.Unlock()
+
+	resumeFailuresMu.Lock()
+	resumeFailures = make(map[string]*resumeFailureCount)
+	resumeFailuresMu.Unlock()
+
+	restoredMu.Lock()
+	for _, rs := range restoredSessions {
+		rs.expireTm.Stop()
+	}
+	restoredSessions = make(map[[sha256.Size]byte]*restoredSession)
+	restoredMu.Unlock()
+}
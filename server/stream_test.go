@@ -6,14 +6,22 @@
 package server
 
 import (
+	"context"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/ortuman/jackal/bounce"
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/credentials"
+	"github.com/ortuman/jackal/maintenance"
+	"github.com/ortuman/jackal/module"
 	"github.com/ortuman/jackal/server/transport"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/storage"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/stream/c2s"
+	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
@@ -39,56 +47,1025 @@ func TestStream_Disconnect(t *testing.T) {
 	require.Equal(t, disconnected, stm.getState())
 }
 
+func TestStream_StanzaTooLarge(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	conn := transport.NewMockConn()
+	tr := transport.NewSocketTransport(conn, 4096, 4096)
+	cfg := tUtilStreamDefaultConfig()
+	cfg.LargePayload.MaxStanzaSize = 1024
+	stm := newStream("abcd1234", tr, cfg)
+	c2s.Instance().RegisterStream(stm)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<iq type="set" id="v1"><vCard xmlns="vcard-temp"><DESC>` + strings.Repeat("a", 2048) + `</DESC></vCard></iq>`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.FindElement(streamerror.ErrPolicyViolation.Error()))
+	conn.WaitClose()
+
+	require.Equal(t, disconnected, stm.getState())
+}
+
 func TestStream_Features(t *testing.T) {
 	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
 	defer c2s.Shutdown()
 
-	stm, conn := tUtilStreamInit()
-	tUtilStreamOpen(conn)
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:stream", elem.Name())
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "stream:features", elem.Name())
+
+	require.Equal(t, connected, stm.getState())
+}
+
+func TestStream_TLS(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"/>`))
+
+	elem := conn.ClientReadElement()
+
+	require.Equal(t, "proceed", elem.Name())
+	require.Equal(t, "urn:ietf:params:xml:ns:xmpp-tls", elem.Namespace())
+
+	require.True(t, stm.IsSecured())
+}
+
+func TestStream_Compression(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<compress xmlns="http://jabber.org/protocol/compress">
+<method>zlib</method>
+</compress>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "compressed", elem.Name())
+	require.Equal(t, "http://jabber.org/protocol/compress", elem.Namespace())
+
+	require.True(t, stm.IsCompressed())
+}
+
+func TestStream_CompressionDisabledOverTLS(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Compression = config.Compression{Level: config.DefaultCompression, DisableOverTLS: true}
+
+	conn := transport.NewMockConn()
+	stm := newStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
+	stm.lock.Lock()
+	stm.secured = true
+	stm.lock.Unlock()
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features := conn.ClientReadElement()
+	require.Equal(t, "stream:features", features.Name())
+	require.Nil(t, features.FindElement("compression"))
+
+	conn.ClientWriteBytes([]byte(`<compress xmlns="http://jabber.org/protocol/compress">
+<method>zlib</method>
+</compress>`))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.FindElement(streamerror.ErrUnsupportedStanzaType.Error()))
+	conn.WaitClose()
+
+	require.False(t, stm.IsCompressed())
+}
+
+func TestStream_RegisterFeature(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	requireSecured := true
+	openStream := func(allowRegistration, secured bool) (xml.Element, *transport.MockConn) {
+		cfg := tUtilStreamDefaultConfig()
+		cfg.ModRegistration.AllowRegistration = allowRegistration
+		cfg.ModRegistration.RequireSecured = requireSecured
+
+		conn := transport.NewMockConn()
+		stm := newStream(uuid.New(), transport.NewSocketTransport(conn, 4096, 4096), cfg)
+		c2s.Instance().RegisterStream(stm)
+		stm.lock.Lock()
+		stm.secured = secured
+		stm.lock.Unlock()
+
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		features := conn.ClientReadElement()
+		require.Equal(t, "stream:features", features.Name())
+		return features, conn
+	}
+	// advertised over secured streams
+	features, conn := openStream(true, true)
+	register := features.FindElement("register")
+	require.NotNil(t, register)
+	require.Equal(t, "http://jabber.org/features/iq-register", register.Namespace())
+
+	// ...but not once authenticated
+	tUtilStreamAuthenticate(conn, t)
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	features = conn.ClientReadElement()
+	require.Equal(t, "stream:features", features.Name())
+	require.Nil(t, features.FindElement("register"))
+
+	// not advertised before negotiating TLS
+	features, _ = openStream(true, false)
+	require.NotNil(t, features.FindElement("starttls"))
+	require.Nil(t, features.FindElement("register"))
+
+	// not advertised when registration isn't allowed
+	features, _ = openStream(false, true)
+	require.NotNil(t, features.FindElement("mechanisms"))
+	require.Nil(t, features.FindElement("register"))
+
+	// advertised over unsecured streams unless required
+	requireSecured = false
+	features, _ = openStream(true, false)
+	require.NotNil(t, features.FindElement("register"))
+}
+
+func TestStream_RouteNotification(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "admin", Password: "pencil"})
+
+	stm, _ := tUtilStreamInit()
+
+	from, _ := xml.NewJID("", "localhost", "", true)
+	to, _ := xml.NewJID("admin", "localhost", "", true)
+	msg := xml.NewMessageType(uuid.New(), xml.HeadlineType)
+	msg.SetFromJID(from)
+	msg.SetToJID(to)
+	body := xml.NewElementName("body")
+	body.SetText("New account registered")
+	msg.AppendElement(body)
+
+	// offline recipients get it archived
+	stm.routeNotification(msg)
+
+	deadline := time.Now().Add(time.Second * 5)
+	for {
+		cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "admin")
+		if cnt == 1 {
+			break
+		}
+		require.True(t, time.Now().Before(deadline), "notification not stored offline")
+		time.Sleep(time.Millisecond * 20)
+	}
+	msgs, _ := storage.Instance().FetchOfflineMessages(context.Background(), "admin")
+	require.Equal(t, msg.ID(), msgs[0].Message.ID())
+}
+
+func TestStream_ArchiveOfflineMessages(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "noelia", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["mam"] = struct{}{}
+	cfg.ModOffline.QueueSize = 1
+
+	conn := transport.NewMockConn()
+	stm := newStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	stm.lock.Lock()
+	stm.username = "user"
+	stm.resource = "balcony"
+	stm.jid, _ = xml.NewJID("user", "localhost", "balcony", true)
+	stm.lock.Unlock()
+
+	from, _ := xml.NewJID("user", "localhost", "balcony", true)
+	to, _ := xml.NewJID("noelia", "localhost", "", true)
+	message := func() *xml.Message {
+		msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+		msg.SetFromJID(from)
+		msg.SetToJID(to)
+		body := xml.NewElementName("body")
+		body.SetText("Hi there!")
+		msg.AppendElement(body)
+		return msg
+	}
+	requireArchived := func(username string, expected int) {
+		deadline := time.Now().Add(time.Second * 5)
+		for {
+			msgs, _ := storage.Instance().FetchArchivedMessages(context.Background(), username, &storage.ArchiveFilter{})
+			if len(msgs) == expected {
+				return
+			}
+			require.True(t, time.Now().Before(deadline), "%s archive holds %d messages", username, len(msgs))
+			time.Sleep(time.Millisecond * 20)
+		}
+	}
+	// stored offline...
+	msg1 := message()
+	stm.processMessage(msg1)
+	requireArchived("user", 1)
+	requireArchived("noelia", 1)
+
+	// ...or bounced as recipient offline queue is full
+	stm.processMessage(message())
+	elem := conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, xml.ErrorType, elem.Type())
+
+	// sender archives every sent message, while recipient only stored ones
+	requireArchived("user", 2)
+	time.Sleep(time.Millisecond * 100)
+	requireArchived("noelia", 1)
+
+	// delivering offline messages doesn't archive them again
+	recipient, _ := xml.NewJID("noelia", "localhost", "garden", true)
+	stm2 := c2s.NewMockStream("abcd5678", recipient)
+	offline := module.NewOffline(&cfg.ModOffline, stm2)
+	defer offline.Done()
+	offline.DeliverOfflineMessages()
+
+	elem = stm2.FetchElement()
+	require.Equal(t, msg1.ID(), elem.ID())
+	time.Sleep(time.Millisecond * 100)
+	requireArchived("noelia", 1)
+
+	cnt, _ := storage.Instance().CountOfflineMessages(context.Background(), "noelia")
+	require.Equal(t, 0, cnt)
+}
+
+func TestStream_StartSession(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+}
+
+func TestStream_SendIQ(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+
+	// request roster...
+	iqID := uuid.New()
+	iq := xml.NewIQType(iqID, xml.GetType)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+
+	conn.ClientWriteBytes([]byte(iq.String()))
+
+	elem := conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iqID, elem.ID())
+	require.NotNil(t, elem.FindElementsNamespace("query", "jabber:iq:roster"))
+
+	require.True(t, stm.IsRosterRequested())
+}
+
+func TestStream_SendPresence(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+
+	conn.ClientWriteBytes([]byte(`
+<presence>
+<show>away</show>
+<status>away!</status>
+<priority>5</priority>
+<x xmlns="vcard-temp:x:update">
+<photo>b7d050434f5441e377dc57f72ac5239e1f493fd0</photo>
+</x>
+</presence>
+	`))
+	time.Sleep(time.Millisecond * 100) // wait until processed...
+
+	require.Equal(t, int8(5), stm.Priority())
+	x := xml.NewElementName("x")
+	x.AppendElements(stm.PresenceElements())
+	require.NotNil(t, x.FindElement("show"))
+	require.NotNil(t, x.FindElement("status"))
+	require.NotNil(t, x.FindElement("priority"))
+	require.NotNil(t, x.FindElement("x"))
+}
+
+func TestStream_SendInitialPresence(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateRosterNotification(context.Background(), &model.RosterNotification{
+		User:     "ortuman",
+		Contact:  "user",
+		Elements: []xml.Element{},
+	})
+	msgID := uuid.New()
+	storage.Instance().InsertOfflineMessage(context.Background(), xml.NewMessageType(msgID, xml.NormalType), "user")
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+
+	conn.ClientWriteBytes([]byte(`<presence/>`))
+
+	// pending approval notifications must precede offline messages
+	elem := conn.ClientReadElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.SubscribeType, elem.Type())
+	require.Equal(t, "ortuman@localhost", elem.From())
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msgID, elem.ID())
+}
+
+func TestStream_PresenceOrdering(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "pencil"})
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "romeo", Contact: "ortuman", Subscription: "both"})
+	storage.Instance().InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both"})
+
+	jContact, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	contact := c2s.NewMockStream("abcd7890", jContact)
+	c2s.Instance().RegisterStream(contact)
+	c2s.Instance().AuthenticateStream(contact)
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">AHJvbWVvAHBlbmNpbA==</auth>`))
+	elem := conn.ClientReadElement()
+	require.Equal(t, "success", elem.Name())
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	// unavailable before initial presence is a no-op...
+	conn.ClientWriteBytes([]byte(`<presence type="unavailable"/>`))
+	conn.ClientWriteBytes([]byte(`<presence/>`))
+
+	// ...so that initial presence gets processed as such
+	elem = conn.ClientReadElement()
+	require.Equal(t, "presence", elem.Name())
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "ortuman@localhost/garden", elem.From())
+
+	elem = contact.FetchElement()
+	require.Equal(t, "", elem.Type()) // available
+	require.Equal(t, "romeo@localhost/balcony", elem.From())
+
+	// repeated unavailable presences are broadcasted once
+	conn.ClientWriteBytes([]byte(`<presence type="unavailable"/>`))
+	conn.ClientWriteBytes([]byte(`<presence type="unavailable"/>`))
+	conn.ClientWriteBytes([]byte(`<presence/>`))
+
+	elem = contact.FetchElement()
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	elem = contact.FetchElement()
+	require.Equal(t, "", elem.Type()) // available
+
+	// probes are answered...
+	conn.ClientWriteBytes([]byte(`<presence type="probe" to="ortuman@localhost"/>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, xml.AvailableType, elem.Type())
+	require.Equal(t, "ortuman@localhost/garden", elem.From())
+
+	// availability is cleared along with final unavailable broadcast
+	stm.Disconnect(nil)
+	conn.WaitClose()
+
+	elem = contact.FetchElement()
+	require.Equal(t, xml.UnavailableType, elem.Type())
+	require.Equal(t, "romeo@localhost/balcony", elem.From())
+
+	stm.lock.RLock()
+	require.False(t, stm.available)
+	require.True(t, stm.presenceClosed)
+	stm.lock.RUnlock()
+
+	// presence processed after disconnection doesn't resurrect availability
+	p := xml.NewPresence(stm.JID(), stm.JID().ToBareJID(), xml.AvailableType)
+	stm.processPresence(p)
+
+	stm.lock.RLock()
+	require.False(t, stm.available)
+	stm.lock.RUnlock()
+}
+
+func TestStream_DispatchQueueFull(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	// a single worker, so that every stanza is mapped to the same queue
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}, Workers: 1, WorkerQueueSize: 1})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
+
+	// saturate recipient mailbox while its actor is busy...
+	blockCh := make(chan struct{})
+	stm.post(func() { <-blockCh })
+
+	startedCh := make(chan struct{})
+	sentCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	defer close(releaseCh)
+
+	require.Nil(t, c2s.Instance().Dispatch(stm.JID(), func() {
+		close(startedCh)
+		for i := 0; i < streamMailboxSize+1; i++ {
+			stm.SendElement(tUtilStreamMgmtMessage(stm.JID()))
+		}
+		close(sentCh)
+		<-releaseCh
+	}))
+	<-startedCh
+
+	// ...and fill worker queue
+	require.Nil(t, c2s.Instance().Dispatch(stm.JID(), func() {}))
+	require.Equal(t, c2s.ErrWorkerQueueFull, c2s.Instance().Dispatch(stm.JID(), func() {}))
+
+	// recipient stanzas are rejected rather than blocking its actor
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="ping_1" to="localhost"><ping xmlns="urn:xmpp:ping"/></iq>`))
+	close(blockCh)
+
+	readCh := make(chan xml.Element)
+	go func() {
+		for i := 0; i < streamMailboxSize+2; i++ {
+			readCh <- conn.ClientReadElement()
+		}
+	}()
+	var messages int
+	var iq xml.Element
+	for i := 0; i < streamMailboxSize+2; i++ {
+		select {
+		case elem := <-readCh:
+			if elem.Name() == "message" {
+				messages++
+			} else {
+				iq = elem
+			}
+		case <-time.After(time.Second * 5):
+			require.Fail(t, "stream deadlocked")
+		}
+	}
+	require.Equal(t, streamMailboxSize+1, messages)
+	require.NotNil(t, iq)
+	require.Equal(t, "ping_1", iq.ID())
+	require.Equal(t, xml.ErrorType, iq.Type())
+	require.NotNil(t, iq.Error().FindElement("resource-constraint"))
+
+	select {
+	case <-sentCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "worker blocked on recipient mailbox")
+	}
+
+	// sending through a disconnected stream never blocks
+	stm.Disconnect(nil)
+	conn.WaitClose()
+
+	doneCh := make(chan struct{})
+	go func() {
+		for i := 0; i < streamMailboxSize+1; i++ {
+			stm.SendElement(tUtilStreamMgmtMessage(stm.JID()))
+		}
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "send blocked on a disconnected stream")
+	}
+}
+
+func TestStream_Maintenance(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	defer maintenance.Disable()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "juliet", Password: "pencil"})
+
+	authenticate := func(conn *transport.MockConn) xml.Element {
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">AGp1bGlldABwZW5jaWw=</auth>`))
+		return conn.ClientReadElement()
+	}
+	stm, conn := tUtilStreamInit()
+	require.Equal(t, "success", authenticate(conn).Name())
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	maintenance.Enable("Scheduled storage migration", time.Now().Add(time.Hour))
+
+	// new logins are refused...
+	conn2 := transport.NewMockConn()
+	stm2 := newStream("abcd5678", transport.NewSocketTransport(conn2, 4096, 4096), tUtilStreamDefaultConfig())
+	c2s.Instance().RegisterStream(stm2)
+
+	elem := authenticate(conn2)
+	require.Equal(t, "failure", elem.Name())
+	require.NotNil(t, elem.FindElement("temporary-auth-failure"))
+	require.Equal(t, "Scheduled storage migration", elem.FindElement("text").Text())
+	require.Equal(t, connected, stm2.getState())
+
+	// ...while established sessions keep exchanging stanzas
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetToJID(stm.JID())
+	body := xml.NewElementName("body")
+	body.SetText("Still here?")
+	msg.AppendElement(body)
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, "Still here?", elem.FindElement("body").Text())
+
+	maintenance.Disable()
+	conn2.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">AGp1bGlldABwZW5jaWw=</auth>`))
+	require.Equal(t, "success", conn2.ClientReadElement().Name())
+
+	stm2.Disconnect(nil)
+	conn2.WaitClose()
+	stm.Disconnect(nil)
+	conn.WaitClose()
+}
+
+func TestStream_PendingEmailVerification(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "juliet", Password: "pencil", Email: "juliet@capulet.lit"})
+
+	newPendingStream := func(id string, blockLogin bool) (*serverStream, *transport.MockConn) {
+		cfg := tUtilStreamDefaultConfig()
+		cfg.ModRegistration.RequireEmail = true
+		cfg.ModRegistration.EmailVerification.BlockLogin = blockLogin
+
+		conn := transport.NewMockConn()
+		stm := newStream(id, transport.NewSocketTransport(conn, 4096, 4096), cfg)
+		c2s.Instance().RegisterStream(stm)
+
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">AGp1bGlldABwZW5jaWw=</auth>`))
+		return stm, conn
+	}
+
+	// pending accounts can be refused to log in...
+	stm, conn := newPendingStream("abcd1234", true)
+	elem := conn.ClientReadElement()
+	require.Equal(t, "failure", elem.Name())
+	require.NotNil(t, elem.FindElement("account-disabled"))
+	require.Equal(t, connected, stm.getState())
+	stm.Disconnect(nil)
+	conn.WaitClose()
+
+	// ...or pointed to verification once bound
+	stm, conn = newPendingStream("abcd5678", false)
+	require.Equal(t, "success", conn.ClientReadElement().Name())
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<iq type="set" id="bind_1"><bind xmlns="urn:ietf:params:xml:ns:xmpp-bind"><resource>balcony</resource></bind></iq>`))
+	elem = conn.ClientReadElement()
+	require.Equal(t, "iq", elem.Name())
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, xml.HeadlineType, elem.Type())
+	require.Equal(t, "localhost", elem.From())
+	require.Equal(t, "juliet@localhost/balcony", elem.To())
+	require.NotNil(t, elem.FindElement("body"))
+
+	stm.Disconnect(nil)
+	conn.WaitClose()
+}
+
+func TestStream_CancelRemovalOnLogin(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "juliet", Password: "pencil", PurgeAt: time.Now().Add(time.Hour)})
+
+	newRemovedStream := func(id string, restoreOnLogin bool) (*serverStream, *transport.MockConn) {
+		cfg := tUtilStreamDefaultConfig()
+		cfg.ModRegistration.RestoreOnLogin = restoreOnLogin
+
+		conn := transport.NewMockConn()
+		stm := newStream(id, transport.NewSocketTransport(conn, 4096, 4096), cfg)
+		c2s.Instance().RegisterStream(stm)
+
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">AGp1bGlldABwZW5jaWw=</auth>`))
+		return stm, conn
+	}
+
+	// removed accounts are refused to log in...
+	stm, conn := newRemovedStream("abcd1234", false)
+	elem := conn.ClientReadElement()
+	require.Equal(t, "failure", elem.Name())
+	require.NotNil(t, elem.FindElement("account-disabled"))
+	require.Equal(t, connected, stm.getState())
+	stm.Disconnect(nil)
+	conn.WaitClose()
+
+	usr, _ := storage.Instance().FetchUser(context.Background(), "juliet")
+	require.NotNil(t, usr)
+	require.True(t, usr.IsRemoved())
+
+	// ...unless configured to be restored
+	stm, conn = newRemovedStream("abcd5678", true)
+	require.Equal(t, "success", conn.ClientReadElement().Name())
+
+	usr, _ = storage.Instance().FetchUser(context.Background(), "juliet")
+	require.NotNil(t, usr)
+	require.False(t, usr.IsRemoved())
+	require.True(t, credentials.Verify(usr, "pencil")) // upgraded credentials kept
+
+	stm.Disconnect(nil)
+	conn.WaitClose()
+}
+
+func TestStream_BounceUnknownRecipient(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "tybalt", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	conn.ClientWriteBytes([]byte(`<auth xmlns="urn:ietf:params:xml:ns:xmpp-sasl" mechanism="PLAIN">AHR5YmFsdABwZW5jaWw=</auth>`))
+	require.Equal(t, "success", conn.ClientReadElement().Name())
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("tybalt", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ghost", "localhost", "", true)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	body := xml.NewElementName("body")
+	body.SetText("Anybody there?")
+	msg.AppendElement(body)
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	// unknown recipient bounces are byte by byte identical to masked blocked ones
+	blocked := bounce.Response(msg, bounce.Blocked, &config.Bounce{FakeBlockedErrors: true})
+	require.Equal(t, blocked.String(), string(conn.ClientReadBytes()))
+
+	stm.Disconnect(nil)
+	conn.WaitClose()
+}
+
+func TestStream_SendMessage(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamAuthenticate(conn, t)
+
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	require.Equal(t, sessionStarted, stm.getState())
+
+	// define a second stream...
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	msgID := uuid.New()
+	msg := xml.NewMessageType(msgID, xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	body := xml.NewElementName("body")
+	body.SetText("Hi buddy!")
+	msg.AppendElement(body)
+
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	// to full jid...
+	elem := stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msgID, elem.ID())
+
+	// to bare jid...
+	msg.SetToJID(jTo.ToBareJID())
+	conn.ClientWriteBytes([]byte(msg.String()))
+	elem = stm2.FetchElement()
+	require.Equal(t, "message", elem.Name())
+	require.Equal(t, msgID, elem.ID())
+}
+
+func TestStream_FooterMarker(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
 
-	elem := conn.ClientReadElement()
-	require.Equal(t, "stream:stream", elem.Name())
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["footer"] = struct{}{}
+	cfg.ModFooter = config.ModFooter{
+		Footers: []config.MessageFooter{{Domain: "localhost", Text: "Confidential", Local: true}},
+	}
+	_, conn := tUtilStreamMgmtInit("abcd1234", cfg)
+	tUtilStreamMgmtAuthenticate(conn, t)
+	tUtilStreamStartSession(conn, t)
 
-	elem = conn.ClientReadElement()
-	require.Equal(t, "stream:features", elem.Name())
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
 
-	require.Equal(t, connected, stm.getState())
+	// footer gets appended even if client marks message as already footed
+	conn.ClientWriteBytes([]byte(`<message type="chat" id="msg_1" to="ortuman@localhost/garden"><body>Hi buddy!</body><footer xmlns="urn:jackal:footer:0"/></message>`))
+
+	elem := stm2.FetchElement()
+	require.Equal(t, "msg_1", elem.ID())
+	require.Equal(t, "Hi buddy!\n\nConfidential", elem.FindElement("body").Text())
 }
 
-func TestStream_TLS(t *testing.T) {
+func TestStream_BlockedMessage(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
 
 	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
 	defer c2s.Shutdown()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["blocking"] = struct{}{}
+	conn := transport.NewMockConn()
+	stm := newStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
 
-	stm, conn := tUtilStreamInit()
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
 
-	conn.ClientWriteBytes([]byte(`<starttls xmlns="urn:ietf:params:xml:ns:xmpp-tls"/>`))
+	tUtilStreamAuthenticate(conn, t)
 
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	body := xml.NewElementName("body")
+	body.SetText("Hi buddy!")
+	msg.AppendElement(body)
+
+	// sender blocked the recipient...
+	storage.Instance().InsertBlockListItems(context.Background(), []model.BlockListItem{{Username: "user", JID: "ortuman@localhost"}})
+
+	conn.ClientWriteBytes([]byte(msg.String()))
 	elem := conn.ClientReadElement()
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().FindElementNamespace("blocked", "urn:xmpp:blocking:errors"))
+	require.Nil(t, stm2.FetchElementTimeout(100*time.Millisecond))
 
-	require.Equal(t, "proceed", elem.Name())
-	require.Equal(t, "urn:ietf:params:xml:ns:xmpp-tls", elem.Namespace())
+	// recipient blocked the sender...
+	storage.Instance().DeleteBlockListItems(context.Background(), []model.BlockListItem{{Username: "user", JID: "ortuman@localhost"}})
+	storage.Instance().InsertBlockListItems(context.Background(), []model.BlockListItem{{Username: "ortuman", JID: "user@localhost"}})
 
-	require.True(t, stm.IsSecured())
+	conn.ClientWriteBytes([]byte(msg.String()))
+	elem = conn.ClientReadElement()
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().FindElement("service-unavailable"))
+	require.Nil(t, stm2.FetchElementTimeout(100*time.Millisecond))
+
+	stm.Disconnect(nil)
+	conn.WaitClose()
 }
 
-func TestStream_Compression(t *testing.T) {
+func TestStream_PrivacyDeniedIQ(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
 
 	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
 	defer c2s.Shutdown()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["privacy"] = struct{}{}
+	conn := transport.NewMockConn()
+	stm := newStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
 
-	stm, conn := tUtilStreamInit()
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
@@ -99,27 +1076,66 @@ func TestStream_Compression(t *testing.T) {
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
 
-	conn.ClientWriteBytes([]byte(`<compress xmlns="http://jabber.org/protocol/compress">
-<method>zlib</method>
-</compress>`))
+	tUtilStreamStartSession(conn, t)
+
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	iq := xml.NewIQType(uuid.New(), xml.GetType)
+	iq.SetFromJID(jFrom)
+	iq.SetToJID(jTo)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:version"))
 
+	// recipient default list denies IQs from the sender...
+	storage.Instance().InsertOrUpdatePrivacyList(context.Background(), &model.PrivacyList{
+		Username: "ortuman",
+		Name:     "public",
+		Items:    []model.PrivacyListItem{{Type: "jid", Value: "user@localhost", Action: "deny", Order: 1, IQ: true}},
+	})
+	storage.Instance().SetDefaultPrivacyList(context.Background(), "ortuman", "public")
+
+	conn.ClientWriteBytes([]byte(iq.String()))
 	elem := conn.ClientReadElement()
-	require.Equal(t, "compressed", elem.Name())
-	require.Equal(t, "http://jabber.org/protocol/compress", elem.Namespace())
+	require.Equal(t, iq.ID(), elem.ID())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().FindElement("service-unavailable"))
+	require.Nil(t, stm2.FetchElementTimeout(100*time.Millisecond))
 
-	require.True(t, stm.IsCompressed())
+	// ...until declined
+	storage.Instance().SetDefaultPrivacyList(context.Background(), "ortuman", "")
+
+	conn.ClientWriteBytes([]byte(iq.String()))
+	elem = stm2.FetchElement()
+	require.Equal(t, "iq", elem.Name())
+	require.Equal(t, iq.ID(), elem.ID())
+
+	stm.Disconnect(nil)
+	conn.WaitClose()
 }
 
-func TestStream_StartSession(t *testing.T) {
+func TestStream_Rewrite(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
 
 	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
 	defer c2s.Shutdown()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Rewrite = []config.RewriteRule{
+		{Name: "stream_in_drop", Direction: config.RewriteInbound, Namespace: "urn:x", Action: config.RewriteDrop},
+		{Name: "stream_in_bounce", Direction: config.RewriteInbound, Namespace: "urn:reject", Action: config.RewriteBounce},
+		{Name: "stream_out_rename", Direction: config.RewriteOutbound, Namespace: "urn:legacy", Action: config.RewriteRename, RenameTo: "urn:y"},
+	}
+	conn := transport.NewMockConn()
+	stm := newStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
 
-	stm, conn := tUtilStreamInit()
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
@@ -132,17 +1148,60 @@ func TestStream_StartSession(t *testing.T) {
 
 	tUtilStreamStartSession(conn, t)
 
-	require.Equal(t, sessionStarted, stm.getState())
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	// inbound child element dropped...
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	msg.AppendElement(xml.NewElementNamespace("ext", "urn:x"))
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	elem := stm2.FetchElement()
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Nil(t, elem.FindElementNamespace("ext", "urn:x"))
+
+	// inbound stanza bounced...
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(jFrom)
+	msg.SetToJID(jTo)
+	msg.AppendElement(xml.NewElementNamespace("ext", "urn:reject"))
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.NotNil(t, elem.Error().FindElement("policy-violation"))
+
+	// outbound child element renamed...
+	msg = xml.NewMessageType(uuid.New(), xml.ChatType)
+	msg.SetFromJID(jTo)
+	msg.SetToJID(jFrom)
+	msg.AppendElement(xml.NewElementNamespace("ext", "urn:legacy"))
+	stm.SendElement(msg)
+
+	elem = conn.ClientReadElement()
+	require.Equal(t, msg.ID(), elem.ID())
+	require.Nil(t, elem.FindElementNamespace("ext", "urn:legacy"))
+	require.NotNil(t, elem.FindElementNamespace("ext", "urn:y"))
+
+	stm.Disconnect(nil)
+	conn.WaitClose()
 }
 
-func TestStream_SendIQ(t *testing.T) {
+func TestStream_SendIQToFullJID(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
 
 	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
 	defer c2s.Shutdown()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
 
 	stm, conn := tUtilStreamInit()
 	tUtilStreamOpen(conn)
@@ -159,29 +1218,47 @@ func TestStream_SendIQ(t *testing.T) {
 
 	require.Equal(t, sessionStarted, stm.getState())
 
-	// request roster...
+	// define a second stream...
+	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
+
+	// version query is relayed verbatim instead of being answered by the server...
 	iqID := uuid.New()
 	iq := xml.NewIQType(iqID, xml.GetType)
-	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:roster"))
+	iq.SetFromJID(jFrom)
+	iq.SetToJID(jTo)
+	iq.AppendElement(xml.NewElementNamespace("query", "jabber:iq:version"))
 
 	conn.ClientWriteBytes([]byte(iq.String()))
 
-	elem := conn.ClientReadElement()
+	elem := stm2.FetchElement()
+	require.Equal(t, iq.String(), elem.String())
+
+	// resource gone...
+	c2s.Instance().UnregisterStream(stm2)
+
+	conn.ClientWriteBytes([]byte(iq.String()))
+
+	elem = conn.ClientReadElement()
 	require.Equal(t, "iq", elem.Name())
 	require.Equal(t, iqID, elem.ID())
-	require.NotNil(t, elem.FindElementsNamespace("query", "jabber:iq:roster"))
-
-	require.True(t, stm.IsRosterRequested())
+	require.Equal(t, xml.ErrorType, elem.Type())
+	require.Equal(t, jTo.String(), elem.From())
+	require.NotNil(t, elem.Error().FindElement("service-unavailable"))
 }
 
-func TestStream_SendPresence(t *testing.T) {
+func TestStream_ValidateFrom(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
 
 	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
 	defer c2s.Shutdown()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
 
 	stm, conn := tUtilStreamInit()
 	tUtilStreamOpen(conn)
@@ -198,37 +1275,83 @@ func TestStream_SendPresence(t *testing.T) {
 
 	require.Equal(t, sessionStarted, stm.getState())
 
-	conn.ClientWriteBytes([]byte(`
-<presence>
-<show>away</show>
-<status>away!</status>
-<priority>5</priority>
-<x xmlns="vcard-temp:x:update">
-<photo>b7d050434f5441e377dc57f72ac5239e1f493fd0</photo>
-</x>
-</presence>
-	`))
-	time.Sleep(time.Millisecond * 100) // wait until processed...
+	// missing and bare from addresses are stamped with the bound full JID
+	elem := xml.NewElementName("presence")
+	fromJID, _, err := stm.validateAddresses(elem)
+	require.Nil(t, err)
+	require.Equal(t, "user@localhost/balcony", fromJID.String())
+
+	elem.SetFrom("user@localhost")
+	fromJID, _, err = stm.validateAddresses(elem)
+	require.Nil(t, err)
+	require.Equal(t, "user@localhost/balcony", fromJID.String())
+
+	// subscription requests are stamped with the bare JID
+	elem.SetType(xml.SubscribeType)
+	fromJID, _, err = stm.validateAddresses(elem)
+	require.Nil(t, err)
+	require.Equal(t, "user@localhost", fromJID.String())
+
+	elem.SetFrom("user@localhost/balcony")
+	elem.SetType(xml.UnsubscribedType)
+	fromJID, _, err = stm.validateAddresses(elem)
+	require.Nil(t, err)
+	require.Equal(t, "user@localhost", fromJID.String())
+
+	// spoofed from addresses are rejected
+	elem.SetFrom("user@localhost/garden")
+	_, _, err = stm.validateAddresses(elem)
+	require.Equal(t, streamerror.ErrInvalidFrom, err)
+
+	elem.SetFrom("ortuman@localhost")
+	_, _, err = stm.validateAddresses(elem)
+	require.Equal(t, streamerror.ErrInvalidFrom, err)
+
+	elem.SetFrom("user@jackal.im/balcony")
+	_, _, err = stm.validateAddresses(elem)
+	require.Equal(t, streamerror.ErrInvalidFrom, err)
+
+	// routed stanzas carry the stamped address
+	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
+	stm2 := c2s.NewMockStream("abcd7890", jTo)
+	c2s.Instance().RegisterStream(stm2)
+	c2s.Instance().AuthenticateStream(stm2)
 
-	require.Equal(t, int8(5), stm.Priority())
-	x := xml.NewElementName("x")
-	x.AppendElements(stm.PresenceElements())
-	require.NotNil(t, x.FindElement("show"))
-	require.NotNil(t, x.FindElement("status"))
-	require.NotNil(t, x.FindElement("priority"))
-	require.NotNil(t, x.FindElement("x"))
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="iq_1" to="ortuman@localhost/garden"><query xmlns="jabber:iq:version"/></iq>`))
+	elem2 := stm2.FetchElement()
+	require.Equal(t, "iq", elem2.Name())
+	require.Equal(t, "user@localhost/balcony", elem2.From())
+
+	conn.ClientWriteBytes([]byte(`<iq type="get" id="iq_2" from="user@localhost" to="ortuman@localhost/garden"><query xmlns="jabber:iq:version"/></iq>`))
+	elem2 = stm2.FetchElement()
+	require.Equal(t, "iq", elem2.Name())
+	require.Equal(t, "user@localhost/balcony", elem2.From())
+
+	// spoofing another user terminates the stream
+	conn.ClientWriteBytes([]byte(`<message type="chat" id="msg_1" from="noelia@localhost/yard" to="ortuman@localhost/garden"><body>Hi!</body></message>`))
+	elem2 = conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem2.Name())
+	require.NotNil(t, elem2.FindElement("invalid-from"))
 }
 
-func TestStream_SendMessage(t *testing.T) {
+func TestStream_TrackMessage(t *testing.T) {
 	storage.Initialize(&config.Storage{Type: config.Mock})
 	defer storage.Shutdown()
 
 	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
 	defer c2s.Shutdown()
 
-	storage.Instance().InsertOrUpdateUser(&model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "user", Password: "pencil"})
+	storage.Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "noelia", Password: "1234"})
+
+	cfg := tUtilStreamDefaultConfig()
+	cfg.Modules["tracking"] = struct{}{}
+	cfg.ModTracking = config.ModTracking{TrustedJIDs: []string{"user@localhost"}}
+
+	conn := transport.NewMockConn()
+	stm := newStream("abcd1234", transport.NewSocketTransport(conn, 4096, 4096), cfg)
+	c2s.Instance().RegisterStream(stm)
 
-	stm, conn := tUtilStreamInit()
 	tUtilStreamOpen(conn)
 	_ = conn.ClientReadElement() // read stream opening...
 	_ = conn.ClientReadElement() // read stream features...
@@ -243,7 +1366,6 @@ func TestStream_SendMessage(t *testing.T) {
 
 	require.Equal(t, sessionStarted, stm.getState())
 
-	// define a second stream...
 	jFrom, _ := xml.NewJID("user", "localhost", "balcony", true)
 	jTo, _ := xml.NewJID("ortuman", "localhost", "garden", true)
 
@@ -251,27 +1373,105 @@ func TestStream_SendMessage(t *testing.T) {
 	c2s.Instance().RegisterStream(stm2)
 	c2s.Instance().AuthenticateStream(stm2)
 
-	msgID := uuid.New()
-	msg := xml.NewMessageType(msgID, xml.ChatType)
-	msg.SetFromJID(jFrom)
-	msg.SetToJID(jTo)
-	body := xml.NewElementName("body")
-	body.SetText("Hi buddy!")
-	msg.AppendElement(body)
+	trackedMessage := func(to string) *xml.Message {
+		toJID, _ := xml.NewJIDString(to, true)
+		msg := xml.NewMessageType(uuid.New(), xml.NormalType)
+		msg.SetFromJID(jFrom)
+		msg.SetToJID(toJID)
+		body := xml.NewElementName("body")
+		body.SetText("Your invoice is ready")
+		msg.AppendElement(body)
+		msg.AppendElement(xml.NewElementNamespace("track", "urn:jackal:tracking:0"))
+		return msg
+	}
+	readDisposition := func(msgID string) xml.Element {
+		elem := conn.ClientReadElement()
+		require.Equal(t, "iq", elem.Name())
+		d := elem.FindElementNamespace("disposition", "urn:jackal:tracking:0")
+		require.NotNil(t, d)
+		require.Equal(t, msgID, d.Attribute("id"))
+		return d
+	}
 
+	// delivered...
+	msg := trackedMessage("ortuman@localhost")
 	conn.ClientWriteBytes([]byte(msg.String()))
+	require.Equal(t, msg.ID(), stm2.FetchElement().ID())
 
-	// to full jid...
-	elem := stm2.FetchElement()
-	require.Equal(t, "message", elem.Name())
-	require.Equal(t, msgID, elem.ID())
+	d := readDisposition(msg.ID())
+	require.Equal(t, "delivered", d.Attribute("status"))
+	require.Equal(t, "garden", d.Attribute("resource"))
 
-	// to bare jid...
-	msg.SetToJID(jTo.ToBareJID())
+	// stored offline...
+	msg = trackedMessage("noelia@localhost")
 	conn.ClientWriteBytes([]byte(msg.String()))
-	elem = stm2.FetchElement()
+
+	d = readDisposition(msg.ID())
+	require.Equal(t, "stored-offline", d.Attribute("status"))
+
+	// bounced...
+	msg = trackedMessage("romeo@localhost")
+	conn.ClientWriteBytes([]byte(msg.String()))
+
+	elem := conn.ClientReadElement()
 	require.Equal(t, "message", elem.Name())
-	require.Equal(t, msgID, elem.ID())
+	require.Equal(t, xml.ErrorType, elem.Type())
+
+	d = readDisposition(msg.ID())
+	require.Equal(t, "bounced", d.Attribute("status"))
+	require.NotNil(t, d.FindElement(xml.ErrServiceUnavailable.Error()))
+}
+
+func TestStream_Terminate(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	var tcs = []struct {
+		reason *streamerror.Error
+		text   string
+		output string
+	}{
+		{streamerror.ErrConnectionTimeout, "Ping timeout", `<stream:error><connection-timeout xmlns="urn:ietf:params:xml:ns:xmpp-streams"/><text xmlns="urn:ietf:params:xml:ns:xmpp-streams">Ping timeout</text></stream:error>`},
+		{streamerror.ErrConflict, "Replaced by new connection", `<stream:error><conflict xmlns="urn:ietf:params:xml:ns:xmpp-streams"/><text xmlns="urn:ietf:params:xml:ns:xmpp-streams">Replaced by new connection</text></stream:error>`},
+		{streamerror.ErrSystemShutdown, "", `<stream:error><system-shutdown xmlns="urn:ietf:params:xml:ns:xmpp-streams"/></stream:error>`},
+		{streamerror.ErrNotAuthorized, "Account removed", `<stream:error><not-authorized xmlns="urn:ietf:params:xml:ns:xmpp-streams"/><text xmlns="urn:ietf:params:xml:ns:xmpp-streams">Account removed</text></stream:error>`},
+	}
+	for _, tc := range tcs {
+		counter := stats.Default().Counter("streams/terminated/"+tc.reason.Error(), "streams")
+		terminated := counter.Value()
+
+		stm, conn := tUtilStreamInit()
+		tUtilStreamOpen(conn)
+		_ = conn.ClientReadElement() // read stream opening...
+		_ = conn.ClientReadElement() // read stream features...
+
+		stm.Terminate(tc.reason, tc.text)
+		require.Equal(t, tc.output, string(conn.ClientReadBytes()))
+		require.Equal(t, "</stream:stream>", string(conn.ClientReadBytes()))
+		conn.WaitClose()
+
+		require.Equal(t, disconnected, stm.getState())
+		require.Equal(t, terminated+1, counter.Value())
+	}
+}
+
+func TestStream_ShutdownTermination(t *testing.T) {
+	c2s.Initialize(&config.C2S{Domains: []string{"localhost"}})
+	defer c2s.Shutdown()
+
+	stm, conn := tUtilStreamInit()
+	tUtilStreamOpen(conn)
+	_ = conn.ClientReadElement() // read stream opening...
+	_ = conn.ClientReadElement() // read stream features...
+
+	terminateStreams()
+	elem := conn.ClientReadElement()
+	require.Equal(t, "stream:error", elem.Name())
+	require.NotNil(t, elem.FindElement(streamerror.ErrSystemShutdown.Error()))
+	conn.WaitClose()
+
+	require.Equal(t, disconnected, stm.getState())
+	require.Equal(t, 0, len(c2s.Instance().Streams()))
 }
 
 func tUtilStreamOpen(conn *transport.MockConn) {
@@ -362,3 +1562,25 @@ func tUtilStreamDefaultConfig() *config.Server {
 		ModPing:         config.ModPing{SendInterval: 5, Send: true},
 	}
 }
+
+func TestStream_ChannelBindingMechanisms(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	tr := transport.NewMockTransport()
+	stm := &serverStream{cfg: tUtilStreamDefaultConfig(), tr: tr}
+	stm.initializeAuthenticators()
+
+	mechanisms := func() []string {
+		var ret []string
+		for _, authr := range stm.offeredAuthenticators() {
+			ret = append(ret, authr.Mechanism())
+		}
+		return ret
+	}
+	// transport not providing channel binding data
+	require.Equal(t, []string{"PLAIN", "DIGEST-MD5", "SCRAM-SHA-1", "SCRAM-SHA-256"}, mechanisms())
+
+	tr.SetChannelBindingBytes([]byte("tls-unique"))
+	require.Equal(t, []string{"PLAIN", "DIGEST-MD5", "SCRAM-SHA-1", "SCRAM-SHA-1-PLUS", "SCRAM-SHA-256", "SCRAM-SHA-256-PLUS"}, mechanisms())
+}
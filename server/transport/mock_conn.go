@@ -84,6 +84,12 @@ func (mc *MockConn) ClientWriteElement(elem xml.Element) {
 	mc.ClientWriteBytes(buf.Bytes())
 }
 
+// ClientDisconnect simulates a lost connection, so that
+// pending and later read operations fail.
+func (mc *MockConn) ClientDisconnect() {
+	mc.srvPipe.w.CloseWithError(io.EOF)
+}
+
 // ClientReadBytes retrieves previous write operation written bytes.
 func (mc *MockConn) ClientReadBytes() []byte {
 	return <-mc.readCh
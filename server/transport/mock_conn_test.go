@@ -7,6 +7,7 @@ package transport
 
 import (
 	"bytes"
+	"io"
 	"testing"
 	"time"
 
@@ -32,6 +33,10 @@ func TestMockConn(t *testing.T) {
 	require.Equal(t, mockConnNetwork, mc.RemoteAddr().Network())
 	require.Equal(t, mockConnRemoteAddr, mc.RemoteAddr().String())
 
+	mc.ClientDisconnect()
+	_, err := mc.Read(bt2)
+	require.Equal(t, io.EOF, err)
+
 	mc.Close()
 	require.True(t, mc.IsClosed())
 
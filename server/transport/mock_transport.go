@@ -9,9 +9,11 @@ import (
 	"bufio"
 	"bytes"
 	"crypto/tls"
+	"net"
 	"sync"
 
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/server/compress"
 	"github.com/ortuman/jackal/xml"
 )
 
@@ -47,6 +49,13 @@ func (mt *MockTransport) ReadElement() (xml.Element, error) {
 	return mt.parser.ParseElement()
 }
 
+// SetLargeTextPolicy sets the policy applied to oversized text of read elements.
+func (mt *MockTransport) SetLargeTextPolicy(policy *xml.LargeTextPolicy) {
+	mt.mu.Lock()
+	defer mt.mu.Unlock()
+	mt.parser.SetLargeTextPolicy(policy)
+}
+
 // SetReadBytes sets transport next read operation result.
 func (mt *MockTransport) SetReadBytes(p []byte) {
 	mt.mu.Lock()
@@ -111,12 +120,17 @@ func (mt *MockTransport) IsSecured() bool {
 }
 
 // EnableCompression marks a mocked transport as compressed.
-func (mt *MockTransport) EnableCompression(level config.CompressionLevel) {
+func (mt *MockTransport) EnableCompression(cfg *config.Compression) {
 	mt.mu.Lock()
 	mt.compressed = true
 	mt.mu.Unlock()
 }
 
+// CompressionStats returns mocked transport compression statistics.
+func (mt *MockTransport) CompressionStats() compress.Stats {
+	return compress.Stats{}
+}
+
 // IsCompressed returns whether or not the mocked transport
 // has been previously compressed.
 func (mt *MockTransport) IsCompressed() bool {
@@ -138,3 +152,11 @@ func (mt *MockTransport) SetChannelBindingBytes(cBindingBytes []byte) {
 	mt.cBindingBytes = cBindingBytes
 	mt.mu.Unlock()
 }
+
+// RemoteAddr returns mocked transport remote address.
+func (mt *MockTransport) RemoteAddr() net.Addr {
+	return &mockConnAddress{
+		network: mockConnNetwork,
+		str:     mockConnRemoteAddr,
+	}
+}
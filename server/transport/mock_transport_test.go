@@ -37,7 +37,7 @@ func TestMockTransport(t *testing.T) {
 	tr.StartTLS(&tls.Config{})
 	require.True(t, tr.IsSecured())
 
-	tr.EnableCompression(config.BestCompression)
+	tr.EnableCompression(&config.Compression{Level: config.BestCompression})
 	require.True(t, tr.IsCompressed())
 
 	tr.Close()
@@ -11,6 +11,7 @@ import (
 	"io"
 	"net"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/ortuman/jackal/config"
@@ -19,6 +20,7 @@ import (
 )
 
 type socketTransport struct {
+	mu                 sync.Mutex // guards writes
 	conn               net.Conn
 	w                  io.Writer
 	r                  io.Reader
@@ -26,7 +28,11 @@ type socketTransport struct {
 	bw                 *bufio.Writer
 	readTimeout        int
 	compressionEnabled bool
+	compressor         *compress.ZlibCompressor
+	flushWindow        time.Duration
+	flushTm            *time.Timer
 	parser             *xml.Parser
+	textPolicy         *xml.LargeTextPolicy
 }
 
 // NewSocketTransport creates a socket class stream transport.
@@ -49,40 +55,102 @@ func (s *socketTransport) ReadElement() (xml.Element, error) {
 }
 
 func (s *socketTransport) WriteString(str string) error {
-	defer s.bw.Flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.flush()
 	_, err := io.Copy(s.w, strings.NewReader(str))
 	return err
 }
 
 func (s *socketTransport) WriteElement(elem xml.Element, includeClosing bool) error {
-	defer s.bw.Flush()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	defer s.flush()
 	elem.ToXML(s.w, includeClosing)
 	return nil
 }
 
 func (s *socketTransport) Close() error {
+	s.mu.Lock()
+	if s.flushTm != nil {
+		s.flushTm.Stop()
+		s.flushTm = nil
+	}
+	if s.compressor != nil {
+		s.compressor.Flush()
+	}
+	s.bw.Flush()
+	s.mu.Unlock()
 	return s.conn.Close()
 }
 
+func (s *socketTransport) SetLargeTextPolicy(policy *xml.LargeTextPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.textPolicy = policy
+	s.parser.SetLargeTextPolicy(policy)
+}
+
 func (s *socketTransport) StartTLS(cfg *tls.Config) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if _, ok := s.conn.(*tls.Conn); !ok {
 		s.conn = tls.Server(s.conn, cfg)
 		s.bw.Reset(s.conn)
 		s.br.Reset(s.conn)
 		s.parser = xml.NewParserTransportType(s.r, config.SocketTransportType)
+		s.parser.SetLargeTextPolicy(s.textPolicy)
 	}
 }
 
-func (s *socketTransport) EnableCompression(level config.CompressionLevel) {
+func (s *socketTransport) EnableCompression(cfg *config.Compression) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	if !s.compressionEnabled {
-		zwr := compress.NewZlibCompressor(s.br, s.bw, level)
+		zwr := compress.NewZlibCompressor(s.br, s.bw, cfg.Level)
+		zwr.SetMinFlushSize(cfg.MinFlushSize)
+		s.compressor = zwr
+		s.flushWindow = time.Millisecond * time.Duration(cfg.FlushWindow)
 		s.w = zwr
 		s.r = zwr
 		s.parser = xml.NewParserTransportType(s.r, config.SocketTransportType)
+		s.parser.SetLargeTextPolicy(s.textPolicy)
 		s.compressionEnabled = true
 	}
 }
 
+func (s *socketTransport) CompressionStats() compress.Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.compressor == nil {
+		return compress.Stats{}
+	}
+	return s.compressor.Stats()
+}
+
+// flush writes buffered data to the underlying connection.
+// Compressed data below minimum flush size is kept buffered
+// until flush window expires.
+func (s *socketTransport) flush() {
+	if s.compressor != nil && s.compressor.Pending() > 0 && s.flushTm == nil {
+		s.flushTm = time.AfterFunc(s.flushWindow, func() {
+			s.mu.Lock()
+			defer s.mu.Unlock()
+			if s.flushTm == nil {
+				return // already closed
+			}
+			s.flushTm = nil
+			s.compressor.Flush()
+			s.bw.Flush()
+		})
+	}
+	s.bw.Flush()
+}
+
+func (s *socketTransport) RemoteAddr() net.Addr {
+	return s.conn.RemoteAddr()
+}
+
 func (s *socketTransport) ChannelBindingBytes(mechanism config.ChannelBindingMechanism) []byte {
 	if tlsConn, ok := s.conn.(*tls.Conn); ok {
 		switch mechanism {
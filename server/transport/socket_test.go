@@ -7,7 +7,9 @@ package transport
 
 import (
 	"bytes"
+	"compress/zlib"
 	"crypto/tls"
+	"io"
 	"testing"
 
 	"github.com/ortuman/jackal/config"
@@ -31,7 +33,7 @@ func TestSocket(t *testing.T) {
 	require.NotNil(t, el3)
 	require.Equal(t, el2.String(), el3.String())
 
-	st.EnableCompression(config.BestCompression)
+	st.EnableCompression(&config.Compression{Level: config.BestCompression})
 	require.True(t, st2.compressionEnabled)
 
 	st.StartTLS(&tls.Config{})
@@ -44,3 +46,31 @@ func TestSocket(t *testing.T) {
 	st.Close()
 	require.True(t, mc.IsClosed())
 }
+
+func TestSocketCompressionBuffering(t *testing.T) {
+	mc := NewMockConn()
+	st := NewSocketTransport(mc, 4096, 120)
+	st.EnableCompression(&config.Compression{Level: config.DefaultCompression, MinFlushSize: 4096, FlushWindow: 50})
+
+	el := xml.NewElementNamespace("composing", "http://jabber.org/protocol/chatstates")
+	st.WriteElement(el, true)
+	st.WriteElement(el, true)
+
+	b := mc.ClientReadBytes() // zlib header...
+
+	// both elements get flushed at once after flush window
+	b = append(b, mc.ClientReadBytes()...)
+	zr, err := zlib.NewReader(bytes.NewReader(b))
+	require.Nil(t, err)
+	out := make([]byte, 2*len(el.String()))
+	_, err = io.ReadFull(zr, out)
+	require.Nil(t, err)
+	require.Equal(t, el.String()+el.String(), string(out))
+
+	cs := st.CompressionStats()
+	require.Equal(t, int64(len(out)), cs.RawOut)
+	require.Equal(t, int64(len(b)), cs.CompressedOut)
+
+	st.Close()
+	require.True(t, mc.IsClosed())
+}
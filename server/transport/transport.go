@@ -8,8 +8,10 @@ package transport
 import (
 	"crypto/tls"
 	"io"
+	"net"
 
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/server/compress"
 	"github.com/ortuman/jackal/xml"
 )
 
@@ -27,14 +29,24 @@ type Transport interface {
 	// serializing it to it's XML representation.
 	WriteElement(elem xml.Element, includeClosing bool) error
 
+	// SetLargeTextPolicy sets the policy applied to
+	// oversized text of subsequently read elements.
+	SetLargeTextPolicy(*xml.LargeTextPolicy)
+
 	// StartTLS secures the transport using SSL/TLS
 	StartTLS(*tls.Config)
 
 	// EnableCompression activates a compression
 	// mechanism on the transport.
-	EnableCompression(config.CompressionLevel)
+	EnableCompression(*config.Compression)
+
+	// CompressionStats returns transport compression traffic statistics.
+	CompressionStats() compress.Stats
 
 	// ChannelBindingBytes returns current transport
 	// channel binding bytes.
 	ChannelBindingBytes(config.ChannelBindingMechanism) []byte
+
+	// RemoteAddr returns transport remote peer address.
+	RemoteAddr() net.Addr
 }
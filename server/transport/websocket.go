@@ -14,6 +14,7 @@ import (
 
 	"github.com/gorilla/websocket"
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/server/compress"
 	"github.com/ortuman/jackal/xml"
 )
 
@@ -29,6 +30,7 @@ type WebSocketConn interface {
 type websocketTransport struct {
 	conn        WebSocketConn
 	readTimeout int
+	textPolicy  *xml.LargeTextPolicy
 }
 
 // NewSocketTransport creates a socket class stream transport.
@@ -44,9 +46,14 @@ func (wst *websocketTransport) ReadElement() (xml.Element, error) {
 		return nil, err
 	}
 	p := xml.NewParserTransportType(r, config.WebSocketTransportType)
+	p.SetLargeTextPolicy(wst.textPolicy)
 	return p.ParseElement()
 }
 
+func (wst *websocketTransport) SetLargeTextPolicy(policy *xml.LargeTextPolicy) {
+	wst.textPolicy = policy
+}
+
 func (wst *websocketTransport) WriteString(str string) error {
 	w, err := wst.conn.NextWriter(websocket.TextMessage)
 	if err != nil {
@@ -74,7 +81,15 @@ func (wst *websocketTransport) Close() error {
 func (wst *websocketTransport) StartTLS(cfg *tls.Config) {
 }
 
-func (wst *websocketTransport) EnableCompression(level config.CompressionLevel) {
+func (wst *websocketTransport) EnableCompression(cfg *config.Compression) {
+}
+
+func (wst *websocketTransport) CompressionStats() compress.Stats {
+	return compress.Stats{}
+}
+
+func (wst *websocketTransport) RemoteAddr() net.Addr {
+	return wst.conn.UnderlyingConn().RemoteAddr()
 }
 
 func (wst *websocketTransport) ChannelBindingBytes(mechanism config.ChannelBindingMechanism) []byte {
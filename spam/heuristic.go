@@ -0,0 +1,129 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package spam
+
+import (
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+)
+
+const (
+	defaultURLWeight           = 1.0
+	defaultRateWindow          = 60 // 1 minute
+	defaultRateLimit           = 30
+	defaultRateWeight          = 0.1
+	defaultRecentMessages      = 256
+	defaultSimilarityThreshold = 0.8
+	defaultSimilarityWeight    = 1.0
+)
+
+var urlRegexp = regexp.MustCompile(`(?i)\b(?:https?://|www\.)\S+`)
+
+// Heuristic represents the built-in spam scorer. Message score is
+// accumulated from the number of URLs contained in its body, the rate
+// at which messages are being sent from the sender domain and the
+// number of recent messages whose body is nearly identical to its own.
+type Heuristic struct {
+	cfg config.SpamHeuristic
+	now func() time.Time
+
+	mu          sync.Mutex
+	domainTimes map[string][]time.Time
+	recent      []signature
+	next        int
+}
+
+// NewHeuristic returns a heuristic scorer configured by cfg.
+func NewHeuristic(cfg *config.SpamHeuristic) *Heuristic {
+	h := &Heuristic{
+		cfg:         *cfg,
+		now:         time.Now,
+		domainTimes: make(map[string][]time.Time),
+	}
+	if h.cfg.URLWeight == 0 {
+		h.cfg.URLWeight = defaultURLWeight
+	}
+	if h.cfg.RateWindow == 0 {
+		h.cfg.RateWindow = defaultRateWindow
+	}
+	if h.cfg.RateLimit == 0 {
+		h.cfg.RateLimit = defaultRateLimit
+	}
+	if h.cfg.RateWeight == 0 {
+		h.cfg.RateWeight = defaultRateWeight
+	}
+	if h.cfg.RecentMessages == 0 {
+		h.cfg.RecentMessages = defaultRecentMessages
+	}
+	if h.cfg.SimilarityThreshold == 0 {
+		h.cfg.SimilarityThreshold = defaultSimilarityThreshold
+	}
+	if h.cfg.SimilarityWeight == 0 {
+		h.cfg.SimilarityWeight = defaultSimilarityWeight
+	}
+	return h
+}
+
+// Score satisfies Scorer interface.
+func (h *Heuristic) Score(stanza xml.Element, sender SenderInfo) float64 {
+	var bodies []string
+	for _, body := range stanza.FindElements("body") {
+		bodies = append(bodies, body.Text())
+	}
+	text := strings.Join(bodies, "\n")
+
+	score := h.cfg.URLWeight * float64(len(urlRegexp.FindAllStringIndex(text, -1)))
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if n := h.registerDomainMessage(sender.JID.Domain()); n > h.cfg.RateLimit {
+		score += h.cfg.RateWeight * float64(n-h.cfg.RateLimit)
+	}
+	if sig, ok := minhash(text); ok {
+		similar := 0
+		for i := range h.recent {
+			if h.recent[i].similarity(&sig) >= h.cfg.SimilarityThreshold {
+				similar++
+			}
+		}
+		score += h.cfg.SimilarityWeight * float64(similar)
+		h.registerSignature(sig)
+	}
+	return score
+}
+
+// registerDomainMessage records a message sent from domain, returning
+// the number of them sent within the configured rate window.
+func (h *Heuristic) registerDomainMessage(domain string) int {
+	now := h.now()
+	windowStart := now.Add(-time.Duration(h.cfg.RateWindow) * time.Second)
+
+	times := h.domainTimes[domain]
+	i := 0
+	for i < len(times) && !times[i].After(windowStart) {
+		i++
+	}
+	times = append(times[i:], now)
+	h.domainTimes[domain] = times
+	return len(times)
+}
+
+// registerSignature keeps sig among the recent ones,
+// replacing the oldest one if no room is left.
+func (h *Heuristic) registerSignature(sig signature) {
+	if len(h.recent) < h.cfg.RecentMessages {
+		h.recent = append(h.recent, sig)
+		return
+	}
+	h.recent[h.next] = sig
+	h.next = (h.next + 1) % len(h.recent)
+}
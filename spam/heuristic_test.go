@@ -0,0 +1,71 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package spam
+
+import (
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeuristic_URLs(t *testing.T) {
+	h := NewHeuristic(&config.SpamHeuristic{URLWeight: 0.5})
+
+	require.Equal(t, 0.0, h.Score(tUtilSpamMessage("Hi there!"), tUtilSpamSender("romeo")))
+	require.Equal(t, 1.0, h.Score(tUtilSpamMessage("visit https://jackal.im and www.example.org"), tUtilSpamSender("romeo")))
+}
+
+func TestHeuristic_DomainRate(t *testing.T) {
+	now := time.Now()
+	h := NewHeuristic(&config.SpamHeuristic{RateWindow: 60, RateLimit: 2, RateWeight: 1})
+	h.now = func() time.Time { return now }
+
+	bodies := []string{"one", "two", "three", "four"}
+	var scores []float64
+	for i, body := range bodies {
+		scores = append(scores, h.Score(tUtilSpamMessage(body), tUtilSpamSender(uuid.New())))
+		now = now.Add(time.Second * time.Duration(i))
+	}
+	require.Equal(t, []float64{0, 0, 1, 2}, scores)
+
+	// other domains are not affected
+	other, _ := xml.NewJID("romeo", "example.org", "balcony", true)
+	require.Equal(t, 0.0, h.Score(tUtilSpamMessage("five"), SenderInfo{JID: other}))
+
+	// window elapsed
+	now = now.Add(time.Minute)
+	require.Equal(t, 0.0, h.Score(tUtilSpamMessage("six"), tUtilSpamSender(uuid.New())))
+}
+
+func TestHeuristic_Similarity(t *testing.T) {
+	h := NewHeuristic(&config.SpamHeuristic{RecentMessages: 2})
+
+	const body = "Cheap pills, best prices in town. Reply to this message to get yours today!"
+	require.Equal(t, 0.0, h.Score(tUtilSpamMessage(body), tUtilSpamSender("romeo")))
+	require.Equal(t, 1.0, h.Score(tUtilSpamMessage(body+"!"), tUtilSpamSender("juliet")))
+	require.Equal(t, 0.0, h.Score(tUtilSpamMessage("Wherefore art thou Romeo?"), tUtilSpamSender("juliet")))
+
+	// oldest signature has been replaced
+	require.Equal(t, 1.0, h.Score(tUtilSpamMessage(body), tUtilSpamSender("mercutio")))
+}
+
+func tUtilSpamMessage(body string) *xml.Message {
+	msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+	b := xml.NewElementName("body")
+	b.SetText(body)
+	msg.AppendElement(b)
+	return msg
+}
+
+func tUtilSpamSender(username string) SenderInfo {
+	from, _ := xml.NewJID(username, "jackal.im", "balcony", true)
+	to, _ := xml.NewJID("ortuman", "jackal.im", "", true)
+	return SenderInfo{JID: from, Recipient: to}
+}
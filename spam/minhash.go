@@ -0,0 +1,78 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package spam
+
+import (
+	"hash/fnv"
+	"math"
+	"math/rand"
+	"strings"
+)
+
+const (
+	signatureSize = 64
+	shingleSize   = 4
+)
+
+// signature represents a text MinHash signature, used to estimate
+// the Jaccard similarity between the shingle sets of two texts.
+type signature [signatureSize]uint32
+
+var minhashSeeds [signatureSize][2]uint32
+
+func init() {
+	// seeds must be stable so that signatures are comparable
+	r := rand.New(rand.NewSource(1))
+	for i := range minhashSeeds {
+		minhashSeeds[i][0] = r.Uint32() | 1
+		minhashSeeds[i][1] = r.Uint32()
+	}
+}
+
+// minhash returns text signature, computed over its lowercased
+// character shingles. A false value is returned for blank texts.
+func minhash(text string) (signature, bool) {
+	var sig signature
+
+	runes := []rune(strings.Join(strings.Fields(strings.ToLower(text)), " "))
+	if len(runes) == 0 {
+		return sig, false
+	}
+	for i := range sig {
+		sig[i] = math.MaxUint32
+	}
+	shingles := len(runes) - shingleSize + 1
+	if shingles < 1 {
+		shingles = 1
+	}
+	for i := 0; i < shingles; i++ {
+		end := i + shingleSize
+		if end > len(runes) {
+			end = len(runes)
+		}
+		h := fnv.New32a()
+		h.Write([]byte(string(runes[i:end])))
+		x := h.Sum32()
+
+		for j := range sig {
+			if v := minhashSeeds[j][0]*x + minhashSeeds[j][1]; v < sig[j] {
+				sig[j] = v
+			}
+		}
+	}
+	return sig, true
+}
+
+// similarity returns the estimated Jaccard similarity between s and o.
+func (s *signature) similarity(o *signature) float64 {
+	eq := 0
+	for i := range s {
+		if s[i] == o[i] {
+			eq++
+		}
+	}
+	return float64(eq) / signatureSize
+}
@@ -0,0 +1,32 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package spam
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestMinHash(t *testing.T) {
+	_, ok := minhash("  \n ")
+	require.False(t, ok)
+
+	s1, ok := minhash("Win a brand new car, just click the link below")
+	require.True(t, ok)
+	s2, _ := minhash("WIN a brand new  car, just click the link below!")
+	s3, _ := minhash("But soft, what light through yonder window breaks?")
+
+	require.Equal(t, 1.0, s1.similarity(&s1))
+	require.True(t, s1.similarity(&s2) >= defaultSimilarityThreshold)
+	require.True(t, s1.similarity(&s3) < 0.2)
+
+	// shorter than a shingle
+	s4, ok := minhash("hi")
+	require.True(t, ok)
+	s5, _ := minhash("Hi")
+	require.Equal(t, s4, s5)
+}
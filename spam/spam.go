@@ -0,0 +1,52 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package spam implements scoring of first contact messages,
+// those sent by users not subscribed to its recipient presence.
+//
+// A built-in heuristic scorer is provided, though any other
+// implementation can be plugged in by means of Register.
+package spam
+
+import (
+	"sync"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// SenderInfo describes the sender of a scored stanza.
+type SenderInfo struct {
+	// JID is the sender full JID.
+	JID *xml.JID
+
+	// Recipient is the JID stanza is addressed to.
+	Recipient *xml.JID
+}
+
+// Scorer represents a spam scoring strategy.
+// Higher scores denote a higher probability of stanza being spam.
+type Scorer interface {
+	Score(stanza xml.Element, sender SenderInfo) float64
+}
+
+var (
+	registeredMu sync.RWMutex
+	registered   Scorer
+)
+
+// Register sets the scorer used by every spam filtering module in
+// place of the built-in heuristic. Passing nil restores the heuristic.
+func Register(s Scorer) {
+	registeredMu.Lock()
+	registered = s
+	registeredMu.Unlock()
+}
+
+// Registered returns the scorer set by means of Register, or nil if none.
+func Registered() Scorer {
+	registeredMu.RLock()
+	defer registeredMu.RUnlock()
+	return registered
+}
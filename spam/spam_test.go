@@ -0,0 +1,27 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package spam
+
+import (
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedScorer float64
+
+func (s fixedScorer) Score(_ xml.Element, _ SenderInfo) float64 { return float64(s) }
+
+func TestRegister(t *testing.T) {
+	require.Nil(t, Registered())
+
+	Register(fixedScorer(1))
+	require.Equal(t, fixedScorer(1), Registered())
+
+	Register(nil)
+	require.Nil(t, Registered())
+}
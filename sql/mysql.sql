@@ -4,60 +4,195 @@
  */
 
 CREATE TABLE IF NOT EXISTS users (
-    username VARCHAR(256) PRIMARY KEY,
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
     password TEXT NOT NULL,
+    password_hash VARCHAR(255) CHARACTER SET ascii NOT NULL DEFAULT '',
+    scram_verifier VARCHAR(512) CHARACTER SET ascii NOT NULL DEFAULT '',
+    purge_at BIGINT NOT NULL DEFAULT 0,
+    email VARCHAR(255) NOT NULL DEFAULT '',
+    email_verified BOOL NOT NULL DEFAULT FALSE,
     updated_at DATETIME NOT NULL,
-    created_at DATETIME NOT NULL
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, username)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
 CREATE TABLE roster_items (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
     user VARCHAR(256) NOT NULL,
     contact VARCHAR(256) NOT NULL,
     name TEXT NOT NULL,
     subscription TEXT NOT NULL,
     groups TEXT NOT NULL,
     ask BOOL NOT NULL,
+    ver INT NOT NULL DEFAULT 0,
     updated_at DATETIME NOT NULL,
     created_at DATETIME NOT NULL,
-    PRIMARY KEY (user, contact)
+    PRIMARY KEY (tenant, user, contact)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
-CREATE INDEX i_roster_items_user ON roster_items(user);
-CREATE INDEX i_roster_items_contact_domain ON roster_items(contact);
+CREATE INDEX i_roster_items_user ON roster_items(tenant, user);
+CREATE INDEX i_roster_items_contact_domain ON roster_items(tenant, contact);
+
+CREATE TABLE IF NOT EXISTS roster_versions (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
+    ver INT NOT NULL DEFAULT 0,
+    pruned_ver INT NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, username)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS roster_tombstones (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    user VARCHAR(256) NOT NULL,
+    contact VARCHAR(256) NOT NULL,
+    ver INT NOT NULL,
+    deleted_at BIGINT NOT NULL,
+    PRIMARY KEY (tenant, user, contact)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE INDEX i_roster_tombstones_deleted_at ON roster_tombstones(tenant, deleted_at);
 
 CREATE TABLE roster_notifications (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
     user VARCHAR(256) NOT NULL,
     contact VARCHAR(256) NOT NULL,
     elements TEXT NOT NULL,
     updated_at DATETIME NOT NULL,
     created_at DATETIME NOT NULL,
-    PRIMARY KEY (user, contact)
+    PRIMARY KEY (tenant, user, contact)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
-CREATE INDEX i_approval_notifications_jid ON roster_notifications(contact);
+CREATE INDEX i_approval_notifications_jid ON roster_notifications(tenant, contact);
 
 CREATE TABLE IF NOT EXISTS private_storage (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
     username VARCHAR(256) NOT NULL,
-    namespace VARCHAR(512) NOT NULL,
+    namespace VARCHAR(504) NOT NULL,
     data MEDIUMTEXT NOT NULL,
     updated_at DATETIME NOT NULL,
     created_at DATETIME NOT NULL,
-    PRIMARY KEY (username, namespace)
+    PRIMARY KEY (tenant, username, namespace)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
-CREATE INDEX i_private_storage_username ON private_storage(username);
+CREATE INDEX i_private_storage_username ON private_storage(tenant, username);
 
 CREATE TABLE IF NOT EXISTS vcards (
-    username VARCHAR(256) PRIMARY KEY,
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
     vcard MEDIUMTEXT NOT NULL,
     updated_at DATETIME NOT NULL,
-    created_at DATETIME NOT NULL
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, username)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
 CREATE TABLE IF NOT EXISTS offline_messages (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    received_at BIGINT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (id)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE INDEX i_offline_messages_username ON offline_messages(tenant, username);
+CREATE INDEX i_offline_messages_received_at ON offline_messages(tenant, received_at);
+
+CREATE TABLE IF NOT EXISTS quarantined_messages (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
     username VARCHAR(256) NOT NULL,
     data MEDIUMTEXT NOT NULL,
     created_at DATETIME NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
 
-CREATE INDEX i_offline_messages_username ON offline_messages(username);
+CREATE INDEX i_quarantined_messages_username ON quarantined_messages(tenant, username);
+
+CREATE TABLE IF NOT EXISTS archived_messages (
+    id BIGINT NOT NULL AUTO_INCREMENT,
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
+    with_jid VARCHAR(256) NOT NULL,
+    with_resource VARCHAR(256) NOT NULL,
+    stamp BIGINT NOT NULL,
+    data MEDIUMTEXT NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (id)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE INDEX i_archived_messages_username ON archived_messages(tenant, username, stamp);
+CREATE INDEX i_archived_messages_with_jid ON archived_messages(tenant, username, with_jid);
+
+CREATE TABLE IF NOT EXISTS archive_prefs (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
+    default_mode VARCHAR(16) CHARACTER SET ascii NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, username)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS block_list_items (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
+    jid VARCHAR(512) NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, username, jid)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS privacy_lists (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
+    name VARCHAR(256) NOT NULL,
+    is_default TINYINT(1) NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, username, name)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS privacy_list_items (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    username VARCHAR(256) NOT NULL,
+    list_name VARCHAR(256) NOT NULL,
+    ord INT UNSIGNED NOT NULL,
+    type VARCHAR(16) CHARACTER SET ascii NOT NULL,
+    value VARCHAR(512) NOT NULL,
+    action VARCHAR(8) CHARACTER SET ascii NOT NULL,
+    message TINYINT(1) NOT NULL,
+    iq TINYINT(1) NOT NULL,
+    presence_in TINYINT(1) NOT NULL,
+    presence_out TINYINT(1) NOT NULL,
+    PRIMARY KEY (tenant, username, list_name, ord)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS feature_flags (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    name VARCHAR(256) NOT NULL,
+    username VARCHAR(256) NOT NULL,
+    enabled TINYINT(1) NOT NULL,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, username, name)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS invites (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    token VARCHAR(64) CHARACTER SET ascii NOT NULL,
+    created_by VARCHAR(256) NOT NULL,
+    expires_at DATETIME NOT NULL,
+    used TINYINT(1) NOT NULL DEFAULT 0,
+    updated_at DATETIME NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, token)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
+
+CREATE TABLE IF NOT EXISTS stream_sessions (
+    tenant VARCHAR(32) CHARACTER SET ascii NOT NULL DEFAULT '',
+    server_id VARCHAR(256) NOT NULL,
+    id VARCHAR(64) CHARACTER SET ascii NOT NULL,
+    data MEDIUMBLOB NOT NULL,
+    created_at DATETIME NOT NULL,
+    PRIMARY KEY (tenant, server_id, id)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_unicode_ci;
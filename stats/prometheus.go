@@ -0,0 +1,70 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stats
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+)
+
+// prometheusNamespace prefixes every exported metric name.
+const prometheusNamespace = "jackal"
+
+// WritePrometheus writes every r statistic using Prometheus text
+// exposition format. Gauges failing to be sampled are left out.
+func WritePrometheus(w io.Writer, r *Registry) error {
+	bw := bufio.NewWriter(w)
+	for _, m := range r.Samples() {
+		if m.Err != nil {
+			continue
+		}
+		name := prometheusName(m)
+		typ := "gauge"
+		if m.Kind == CounterKind {
+			typ = "counter"
+		}
+		fmt.Fprintf(bw, "# HELP %s %s (%s)\n", name, m.Name, m.Units)
+		fmt.Fprintf(bw, "# TYPE %s %s\n", name, typ)
+		fmt.Fprintf(bw, "%s %d\n", name, m.Value)
+	}
+	return bw.Flush()
+}
+
+// PrometheusHandler returns an HTTP handler serving r
+// statistics in Prometheus text exposition format.
+func PrometheusHandler(r *Registry) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodGet {
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		WritePrometheus(w, r)
+	})
+}
+
+// prometheusName maps a statistic name to a valid Prometheus metric name,
+// that is, replacing every character other than ASCII letters and digits.
+func prometheusName(m Metric) string {
+	var b strings.Builder
+	b.WriteString(prometheusNamespace)
+	b.WriteByte('_')
+	for _, r := range m.Name {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9':
+			b.WriteRune(r)
+		default:
+			b.WriteByte('_')
+		}
+	}
+	if m.Kind == CounterKind {
+		b.WriteString("_total")
+	}
+	return b.String()
+}
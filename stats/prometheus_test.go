@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stats
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWritePrometheus(t *testing.T) {
+	r := NewRegistry()
+	r.Counter("iq/jabber:iq:version", "iqs").Add(3)
+	r.RegisterGauge("users/online", "users", func() (int64, error) { return 7, nil })
+	r.RegisterGauge("users/broken", "users", func() (int64, error) { return 0, errors.New("gauge error") })
+
+	srv := httptest.NewServer(PrometheusHandler(r))
+	defer srv.Close()
+
+	scrape := func() string {
+		resp, err := http.Get(srv.URL)
+		require.Nil(t, err)
+		defer resp.Body.Close()
+		require.Equal(t, http.StatusOK, resp.StatusCode)
+		require.Equal(t, "text/plain; version=0.0.4", resp.Header.Get("Content-Type"))
+		b, _ := ioutil.ReadAll(resp.Body)
+		return string(b)
+	}
+	require.Equal(t, `# HELP jackal_iq_jabber_iq_version_total iq/jabber:iq:version (iqs)
+# TYPE jackal_iq_jabber_iq_version_total counter
+jackal_iq_jabber_iq_version_total 3
+# HELP jackal_users_online users/online (users)
+# TYPE jackal_users_online gauge
+jackal_users_online 7
+`, scrape())
+
+	r.Counter("iq/jabber:iq:version", "iqs").Inc()
+	require.Contains(t, scrape(), "jackal_iq_jabber_iq_version_total 4\n")
+
+	resp, err := http.Post(srv.URL, "text/plain", nil)
+	require.Nil(t, err)
+	resp.Body.Close()
+	require.Equal(t, http.StatusMethodNotAllowed, resp.StatusCode)
+}
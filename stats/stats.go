@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stats
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Kind represents the way a statistic value evolves.
+type Kind int
+
+const (
+	// CounterKind identifies monotonically increasing statistics.
+	CounterKind Kind = iota
+
+	// GaugeKind identifies statistics whose value can go up and down.
+	GaugeKind
+)
+
+// Metric represents a named statistic sample.
+type Metric struct {
+	Name  string
+	Units string
+	Kind  Kind
+	Value int64
+	Err   error
+}
+
+// Counter represents a monotonically increasing statistic.
+type Counter struct {
+	units string
+	val   int64
+}
+
+// Inc increments counter value by one.
+func (c *Counter) Inc() {
+	atomic.AddInt64(&c.val, 1)
+}
+
+// Add increments counter value by delta.
+func (c *Counter) Add(delta int64) {
+	atomic.AddInt64(&c.val, delta)
+}
+
+// Value returns current counter value.
+func (c *Counter) Value() int64 {
+	return atomic.LoadInt64(&c.val)
+}
+
+type gauge struct {
+	units string
+	fn    func() (int64, error)
+}
+
+// Registry holds every statistic exposed by the server, so that all
+// reporting interfaces (XMPP, HTTP...) share the very same values.
+type Registry struct {
+	mu       sync.RWMutex
+	counters map[string]*Counter
+	gauges   map[string]*gauge
+}
+
+// NewRegistry returns a new empty statistics registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		counters: make(map[string]*Counter),
+		gauges:   make(map[string]*gauge),
+	}
+}
+
+// Counter returns the counter registered under name,
+// registering a new one in case it does not exist yet.
+func (r *Registry) Counter(name, units string) *Counter {
+	r.mu.RLock()
+	c := r.counters[name]
+	r.mu.RUnlock()
+	if c != nil {
+		return c
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if c = r.counters[name]; c == nil {
+		c = &Counter{units: units}
+		r.counters[name] = c
+	}
+	return c
+}
+
+// RegisterGauge registers a statistic whose value is computed
+// by fn every time it's sampled, replacing any previous registration.
+func (r *Registry) RegisterGauge(name, units string, fn func() (int64, error)) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.gauges[name] = &gauge{units: units, fn: fn}
+}
+
+// Names returns every registered statistic name in lexicographical order.
+func (r *Registry) Names() []string {
+	r.mu.RLock()
+	names := make([]string, 0, len(r.counters)+len(r.gauges))
+	for name := range r.counters {
+		names = append(names, name)
+	}
+	for name := range r.gauges {
+		names = append(names, name)
+	}
+	r.mu.RUnlock()
+	sort.Strings(names)
+	return names
+}
+
+// Sample returns name statistic current value.
+// The second returned value reports whether or not the statistic exists.
+func (r *Registry) Sample(name string) (Metric, bool) {
+	r.mu.RLock()
+	c := r.counters[name]
+	g := r.gauges[name]
+	r.mu.RUnlock()
+
+	switch {
+	case c != nil:
+		return Metric{Name: name, Units: c.units, Kind: CounterKind, Value: c.Value()}, true
+	case g != nil:
+		v, err := g.fn()
+		return Metric{Name: name, Units: g.units, Kind: GaugeKind, Value: v, Err: err}, true
+	}
+	return Metric{}, false
+}
+
+// Samples returns every registered statistic current value.
+func (r *Registry) Samples() []Metric {
+	var metrics []Metric
+	for _, name := range r.Names() {
+		if m, ok := r.Sample(name); ok {
+			metrics = append(metrics, m)
+		}
+	}
+	return metrics
+}
+
+var (
+	defaultRegistry = NewRegistry()
+	startTime       = time.Now()
+)
+
+func init() {
+	defaultRegistry.RegisterGauge("time/uptime", "seconds", func() (int64, error) {
+		return int64(time.Since(startTime) / time.Second), nil
+	})
+}
+
+// Default returns the server statistics registry.
+func Default() *Registry {
+	return defaultRegistry
+}
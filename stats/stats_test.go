@@ -0,0 +1,57 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package stats
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegistry_Counter(t *testing.T) {
+	r := NewRegistry()
+
+	c := r.Counter("stanzas/processed", "stanzas")
+	c.Inc()
+	c.Add(2)
+	require.Equal(t, c, r.Counter("stanzas/processed", "stanzas"))
+
+	m, ok := r.Sample("stanzas/processed")
+	require.True(t, ok)
+	require.Equal(t, int64(3), m.Value)
+	require.Equal(t, "stanzas", m.Units)
+
+	_, ok = r.Sample("stanzas/unknown")
+	require.False(t, ok)
+}
+
+func TestRegistry_Gauge(t *testing.T) {
+	r := NewRegistry()
+
+	errGauge := errors.New("gauge error")
+	r.RegisterGauge("users/total", "users", func() (int64, error) { return 10, nil })
+	r.RegisterGauge("users/online", "users", func() (int64, error) { return 0, errGauge })
+	r.Counter("iq/jabber:iq:version", "iqs").Inc()
+
+	require.Equal(t, []string{"iq/jabber:iq:version", "users/online", "users/total"}, r.Names())
+
+	samples := r.Samples()
+	require.Equal(t, 3, len(samples))
+	require.Equal(t, errGauge, samples[1].Err)
+	require.Equal(t, int64(10), samples[2].Value)
+
+	// replace registration
+	r.RegisterGauge("users/total", "users", func() (int64, error) { return 20, nil })
+	m, _ := r.Sample("users/total")
+	require.Equal(t, int64(20), m.Value)
+}
+
+func TestDefaultRegistry(t *testing.T) {
+	m, ok := Default().Sample("time/uptime")
+	require.True(t, ok)
+	require.Equal(t, "seconds", m.Units)
+}
@@ -0,0 +1,103 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"strconv"
+
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// selectArchivedMessagesStmt returns the statement looking up the
+// messages of user's archive matching filter, along with its arguments.
+// It reports false whenever filter identifiers are malformed.
+func selectArchivedMessagesStmt(tenant, username string, filter *ArchiveFilter) (string, []interface{}, bool) {
+	stmt := `SELECT id, with_jid, with_resource, stamp, data FROM archived_messages WHERE tenant = ? AND username = ?`
+	args := []interface{}{tenant, username}
+	if len(filter.With) > 0 {
+		stmt += ` AND with_jid = ?`
+		args = append(args, filter.With)
+		if len(filter.WithResource) > 0 {
+			stmt += ` AND with_resource = ?`
+			args = append(args, filter.WithResource)
+		}
+	}
+	if !filter.Start.IsZero() {
+		stmt += ` AND stamp >= ?`
+		args = append(args, filter.Start.Unix())
+	}
+	if !filter.End.IsZero() {
+		stmt += ` AND stamp <= ?`
+		args = append(args, filter.End.Unix())
+	}
+	for _, bound := range []struct{ id, op string }{{filter.AfterID, ">"}, {filter.BeforeID, "<"}} {
+		if len(bound.id) == 0 {
+			continue
+		}
+		id, err := strconv.ParseInt(bound.id, 10, 64)
+		if err != nil {
+			return "", nil, false
+		}
+		stmt += ` AND id ` + bound.op + ` ?`
+		args = append(args, id)
+	}
+	if filter.Last {
+		stmt += ` ORDER BY id DESC`
+	} else {
+		stmt += ` ORDER BY id`
+	}
+	if filter.Max > 0 {
+		stmt += ` LIMIT ?`
+		args = append(args, filter.Max)
+	}
+	return stmt, args, true
+}
+
+// filterArchivedMessages returns the messages matching filter out of msgs,
+// which are expected to be sorted by insertion order. seq returns the
+// insertion sequence of a message identifier, if well-formed.
+func filterArchivedMessages(msgs []model.ArchivedMessage, filter *ArchiveFilter, seq func(id string) (uint64, bool)) []model.ArchivedMessage {
+	var after, before uint64
+	var ok bool
+	if len(filter.AfterID) > 0 {
+		if after, ok = seq(filter.AfterID); !ok {
+			return nil
+		}
+	}
+	if len(filter.BeforeID) > 0 {
+		if before, ok = seq(filter.BeforeID); !ok {
+			return nil
+		}
+	}
+	var ret []model.ArchivedMessage
+	for _, m := range msgs {
+		if len(filter.With) > 0 && (m.With != filter.With || (len(filter.WithResource) > 0 && m.WithResource != filter.WithResource)) {
+			continue
+		}
+		if (!filter.Start.IsZero() && m.Stamp.Before(filter.Start)) || (!filter.End.IsZero() && m.Stamp.After(filter.End)) {
+			continue
+		}
+		id, _ := seq(m.ID)
+		if (len(filter.AfterID) > 0 && id <= after) || (len(filter.BeforeID) > 0 && id >= before) {
+			continue
+		}
+		ret = append(ret, m)
+	}
+	if filter.Max > 0 && len(ret) > filter.Max {
+		if filter.Last {
+			ret = ret[len(ret)-filter.Max:]
+		} else {
+			ret = ret[:filter.Max]
+		}
+	}
+	return ret
+}
+
+func reverseArchivedMessages(msgs []model.ArchivedMessage) {
+	for i, j := 0, len(msgs)-1; i < j; i, j = i+1, j-1 {
+		msgs[i], msgs[j] = msgs[j], msgs[i]
+	}
+}
@@ -7,8 +7,13 @@ package storage
 
 import (
 	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
+	"strconv"
 	"time"
 
 	"github.com/dgraph-io/badger"
@@ -18,13 +23,20 @@ import (
 	"github.com/ortuman/jackal/xml"
 )
 
+const usageScanBatchSize = 1024
+
 type badgerDB struct {
 	db     *badger.DB
+	txn    *badger.Txn // set on handles bound to a transaction
+	prefix string      // tenant key prefix, immutable
 	doneCh chan chan bool
 }
 
-func newBadgerDB(cfg *config.BadgerDb) *badgerDB {
-	b := &badgerDB{doneCh: make(chan chan bool)}
+func newBadgerDB(cfg *config.BadgerDb, tenant string) *badgerDB {
+	if len(tenant) > 0 && !config.IsValidTenant(tenant) {
+		log.Fatalf("storage: invalid tenant: %s", tenant)
+	}
+	b := &badgerDB{prefix: badgerTenantPrefix(tenant), doneCh: make(chan chan bool)}
 	if err := os.MkdirAll(filepath.Dir(cfg.DataDir), os.ModePerm); err != nil {
 		log.Fatalf("%v", err)
 	}
@@ -46,25 +58,59 @@ func (b *badgerDB) Shutdown() {
 	<-ch
 }
 
-func (b *badgerDB) InsertOrUpdateUser(user *model.User) error {
+func (b *badgerDB) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
 	buf := pool.Get()
 	defer pool.Put(buf)
 
-	return b.db.Update(func(tx *badger.Txn) error {
+	return b.update(func(tx *badger.Txn) error {
 		user.ToBytes(buf)
 		return tx.Set(b.userKey(user.Username), buf.Bytes())
 	})
 }
 
-func (b *badgerDB) DeleteUser(username string) error {
-	return b.db.Update(func(tx *badger.Txn) error {
-		return tx.Delete(b.userKey(username))
+func (b *badgerDB) DeleteUser(ctx context.Context, username string) error {
+	prefixes := [][]byte{
+		b.offlineMessagesPrefix(username),
+		b.quarantinedMessagesPrefix(username),
+		b.key("rosterItems:" + username + ":"),
+		b.key("rosterTombstones:" + username + ":"),
+		b.key("rosterNotifications:" + username + ":"),
+		b.key("privateElements:" + username + ":"),
+		b.key("featureFlags:" + username + ":"),
+		b.key("blockListItems:" + username + ":"),
+		b.key("privacyLists:" + username + ":"),
+		b.archivedMessagesPrefix(username),
+	}
+	return b.update(func(tx *badger.Txn) error {
+		keys := [][]byte{
+			b.userKey(username),
+			b.vCardKey(username),
+			b.rosterVersionKey(username),
+			b.offlineSeqKey(username),
+			b.quarantinedSeqKey(username),
+			b.archiveSeqKey(username),
+			b.archivePrefsKey(username),
+		}
+		for _, prefix := range prefixes {
+			keys = append(keys, b.txKeys(tx, prefix, nil)...)
+		}
+		// roster notifications sent by user are keyed by their contact
+		suffix := []byte(":" + username)
+		keys = append(keys, b.txKeys(tx, b.key("rosterNotifications:"), func(k []byte) bool {
+			return bytes.HasSuffix(k, suffix)
+		})...)
+		for _, k := range keys {
+			if err := tx.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
 	})
 }
 
-func (b *badgerDB) FetchUser(username string) (*model.User, error) {
+func (b *badgerDB) FetchUser(ctx context.Context, username string) (*model.User, error) {
 	var usr model.User
-	if err := b.db.View(func(tx *badger.Txn) error {
+	if err := b.view(func(tx *badger.Txn) error {
 		val, err := b.getVal(b.userKey(username), tx)
 		if err != nil {
 			return err
@@ -79,9 +125,9 @@ func (b *badgerDB) FetchUser(username string) (*model.User, error) {
 	return &usr, nil
 }
 
-func (b *badgerDB) UserExists(username string) (bool, error) {
+func (b *badgerDB) UserExists(ctx context.Context, username string) (bool, error) {
 	var exists bool
-	if err := b.db.View(func(tx *badger.Txn) error {
+	if err := b.view(func(tx *badger.Txn) error {
 		val, err := b.getVal(b.userKey(username), tx)
 		if err != nil {
 			return err
@@ -94,75 +140,240 @@ func (b *badgerDB) UserExists(username string) (bool, error) {
 	return exists, nil
 }
 
-func (b *badgerDB) InsertOrUpdateRosterItem(ri *model.RosterItem) error {
+func (b *badgerDB) CountUsers(ctx context.Context) (int, error) {
+	cnt := 0
+	err := b.forEachKey(b.key("users:"), func(_ []byte) error {
+		cnt++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+func (b *badgerDB) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	var usernames []string
+	err := b.forEachKeyAndValue(b.key("users:"), func(_, val []byte) error {
+		var usr model.User
+		usr.FromBytes(bytes.NewReader(val))
+		if usr.IsPurgeable(before) {
+			usernames = append(usernames, usr.Username)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usernames, nil
+}
+
+func (b *badgerDB) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
 	buf := pool.Get()
 	defer pool.Put(buf)
 
-	return b.db.Update(func(tx *badger.Txn) error {
-		ri.ToBytes(buf)
-		return tx.Set(b.rosterItemKey(ri.User, ri.Contact), buf.Bytes())
+	var ver int
+	err := b.update(func(tx *badger.Txn) (err error) {
+		ver, err = b.incRosterVersion(tx, ri.User)
+		if err != nil {
+			return err
+		}
+		// updated items keep their original position
+		seq := uint64(ver)
+		val, err := b.getVal(b.rosterItemKey(ri.User, ri.Contact), tx)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			seq, _ = decodeRosterItemSeq(val)
+		}
+		item := *ri
+		item.Ver = ver
+		encodeRosterItemSeq(buf, seq, &item)
+		if err := tx.Set(b.rosterItemKey(ri.User, ri.Contact), buf.Bytes()); err != nil {
+			return err
+		}
+		return tx.Delete(b.rosterTombstoneKey(ri.User, ri.Contact))
 	})
+	if err != nil {
+		return err
+	}
+	ri.Ver = ver
+	return nil
 }
 
-func (b *badgerDB) DeleteRosterItem(user, contact string) error {
-	return b.db.Update(func(tx *badger.Txn) error {
-		return tx.Delete(b.rosterItemKey(user, contact))
+func (b *badgerDB) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return b.update(func(tx *badger.Txn) error {
+		val, err := b.getVal(b.rosterItemKey(user, contact), tx)
+		if err != nil || val == nil {
+			return err
+		}
+		if err := tx.Delete(b.rosterItemKey(user, contact)); err != nil {
+			return err
+		}
+		ver, err := b.incRosterVersion(tx, user)
+		if err != nil {
+			return err
+		}
+		rt := model.RosterTombstone{User: user, Contact: contact, Ver: ver, DeletedAt: time.Now()}
+		rt.ToBytes(buf)
+		return tx.Set(b.rosterTombstoneKey(user, contact), buf.Bytes())
 	})
 }
 
-func (b *badgerDB) FetchRosterItems(user string) ([]model.RosterItem, error) {
+func (b *badgerDB) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
 	var ris []model.RosterItem
+	var seqs []uint64
 
-	prefix := []byte("rosterItems:" + user)
+	prefix := b.key("rosterItems:" + user + ":")
 	err := b.forEachKeyAndValue(prefix, func(k, val []byte) error {
-		var ri model.RosterItem
-		ri.FromBytes(bytes.NewReader(val))
-		ris = append(ris, ri)
+		seq, ri := decodeRosterItemSeq(val)
+		ris = append(ris, *ri)
+		seqs = append(seqs, seq)
 		return nil
 	})
 	if err != nil {
 		return nil, err
 	}
+	// return items in insertion order
+	sort.Sort(&rosterItemsBySeq{ris: ris, seqs: seqs})
 	return ris, nil
 }
 
-func (b *badgerDB) FetchRosterItem(user, contact string) (*model.RosterItem, error) {
-	var ri model.RosterItem
-	if err := b.db.View(func(tx *badger.Txn) error {
+// FetchRosterItemsOfUsers satisfies Storage interface.
+func (b *badgerDB) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	ret := make(map[string][]model.RosterItem, len(users))
+	for _, user := range users {
+		ris, err := b.FetchRosterItems(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		if len(ris) > 0 {
+			ret[user] = ris
+		}
+	}
+	return ret, nil
+}
+
+func (b *badgerDB) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
+	ri := &model.RosterItem{}
+	if err := b.view(func(tx *badger.Txn) error {
 		val, err := b.getVal(b.rosterItemKey(user, contact), tx)
 		if err != nil {
 			return err
 		}
 		if val != nil {
-			ri.FromBytes(bytes.NewReader(val))
+			_, ri = decodeRosterItemSeq(val)
 		}
 		return nil
 	}); err != nil {
 		return nil, err
 	}
-	return &ri, nil
+	return ri, nil
 }
 
-func (b *badgerDB) InsertOrUpdateRosterNotification(rn *model.RosterNotification) error {
+func (b *badgerDB) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	var rv model.RosterVersion
+	err := b.view(func(tx *badger.Txn) error {
+		val, err := b.getVal(b.rosterVersionKey(user), tx)
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			rv.FromBytes(bytes.NewReader(val))
+		}
+		return nil
+	})
+	return rv, err
+}
+
+func (b *badgerDB) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
+	var rts []model.RosterTombstone
+
+	prefix := b.key("rosterTombstones:" + user + ":")
+	err := b.forEachKeyAndValue(prefix, func(k, val []byte) error {
+		var rt model.RosterTombstone
+		rt.FromBytes(bytes.NewReader(val))
+		if rt.Ver > afterVer {
+			rts = append(rts, rt)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rts, func(i, j int) bool { return rts[i].Ver < rts[j].Ver })
+	return rts, nil
+}
+
+func (b *badgerDB) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	var pruned []model.RosterTombstone
+	err := b.forEachKeyAndValue(b.key("rosterTombstones:"), func(k, val []byte) error {
+		var rt model.RosterTombstone
+		rt.FromBytes(bytes.NewReader(val))
+		if !rt.DeletedAt.After(before) {
+			pruned = append(pruned, rt)
+		}
+		return nil
+	})
+	if err != nil || len(pruned) == 0 {
+		return 0, err
+	}
+	prunedVers := make(map[string]int)
+	for _, rt := range pruned {
+		if rt.Ver > prunedVers[rt.User] {
+			prunedVers[rt.User] = rt.Ver
+		}
+	}
+	err = b.update(func(tx *badger.Txn) error {
+		for user, prunedVer := range prunedVers {
+			rv, err := b.fetchRosterVersion(tx, user)
+			if err != nil {
+				return err
+			}
+			if prunedVer > rv.PrunedVer {
+				rv.PrunedVer = prunedVer
+			}
+			if err := b.setRosterVersion(tx, user, rv); err != nil {
+				return err
+			}
+		}
+		for _, rt := range pruned {
+			if err := tx.Delete(b.rosterTombstoneKey(rt.User, rt.Contact)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(pruned), nil
+}
+
+func (b *badgerDB) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
 	buf := pool.Get()
 	defer pool.Put(buf)
 
-	return b.db.Update(func(tx *badger.Txn) error {
+	return b.update(func(tx *badger.Txn) error {
 		rn.ToBytes(buf)
 		return tx.Set(b.rosterNotificationKey(rn.User, rn.Contact), buf.Bytes())
 	})
 }
 
-func (b *badgerDB) DeleteRosterNotification(user, contact string) error {
-	return b.db.Update(func(tx *badger.Txn) error {
+func (b *badgerDB) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	return b.update(func(tx *badger.Txn) error {
 		return tx.Delete(b.rosterNotificationKey(user, contact))
 	})
 }
 
-func (b *badgerDB) FetchRosterNotifications(contact string) ([]model.RosterNotification, error) {
+func (b *badgerDB) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
 	var rns []model.RosterNotification
 
-	prefix := []byte("rosterNotifications:" + contact)
+	prefix := b.key("rosterNotifications:" + contact + ":")
 	err := b.forEachKeyAndValue(prefix, func(k, val []byte) error {
 		var rn model.RosterNotification
 		rn.FromBytes(bytes.NewReader(val))
@@ -175,19 +386,19 @@ func (b *badgerDB) FetchRosterNotifications(contact string) ([]model.RosterNotif
 	return rns, nil
 }
 
-func (b *badgerDB) InsertOrUpdateVCard(vCard xml.Element, username string) error {
+func (b *badgerDB) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
 	buf := pool.Get()
 	defer pool.Put(buf)
 
-	return b.db.Update(func(tx *badger.Txn) error {
+	return b.update(func(tx *badger.Txn) error {
 		vCard.ToBytes(buf)
 		return tx.Set(b.vCardKey(username), buf.Bytes())
 	})
 }
 
-func (b *badgerDB) FetchVCard(username string) (xml.Element, error) {
+func (b *badgerDB) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
 	var vCard xml.Element
-	if err := b.db.View(func(tx *badger.Txn) error {
+	if err := b.view(func(tx *badger.Txn) error {
 		val, err := b.getVal(b.vCardKey(username), tx)
 		if err != nil {
 			return err
@@ -204,11 +415,11 @@ func (b *badgerDB) FetchVCard(username string) (xml.Element, error) {
 	return vCard, nil
 }
 
-func (b *badgerDB) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error {
+func (b *badgerDB) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
 	buf := pool.Get()
 	defer pool.Put(buf)
 
-	return b.db.Update(func(tx *badger.Txn) error {
+	return b.update(func(tx *badger.Txn) error {
 		root := xml.NewElementName("r")
 		root.AppendElements(privateXML)
 		root.ToBytes(buf)
@@ -216,9 +427,9 @@ func (b *badgerDB) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace
 	})
 }
 
-func (b *badgerDB) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
+func (b *badgerDB) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
 	var privateXML []xml.Element
-	if err := b.db.View(func(tx *badger.Txn) error {
+	if err := b.view(func(tx *badger.Txn) error {
 		val, err := b.getVal(b.privateStorageKey(username, namespace), tx)
 		if err != nil {
 			return err
@@ -235,19 +446,92 @@ func (b *badgerDB) FetchPrivateXML(namespace string, username string) ([]xml.Ele
 	return privateXML, nil
 }
 
-func (b *badgerDB) InsertOfflineMessage(message xml.Element, username string) error {
+func (b *badgerDB) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
 	buf := pool.Get()
 	defer pool.Put(buf)
 
-	return b.db.Update(func(tx *badger.Txn) error {
-		message.ToBytes(buf)
-		return tx.Set(b.offlineMessageKey(username, message.ID()), buf.Bytes())
+	return b.update(func(tx *badger.Txn) error {
+		seq, err := b.nextSeq(tx, b.offlineSeqKey(username))
+		if err != nil {
+			return err
+		}
+		om := model.OfflineMessage{Message: message, ReceivedAt: time.Now()}
+		om.ToBytes(buf)
+		return tx.Set(b.offlineMessageKey(username, seq), buf.Bytes())
+	})
+}
+
+// InsertOfflineMessages satisfies Storage interface.
+func (b *badgerDB) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	receivedAt := time.Now()
+	return b.update(func(tx *badger.Txn) error {
+		for _, message := range messages {
+			seq, err := b.nextSeq(tx, b.offlineSeqKey(username))
+			if err != nil {
+				return err
+			}
+			// values must not be reused until tx is committed
+			buf := new(bytes.Buffer)
+			om := model.OfflineMessage{Message: message, ReceivedAt: receivedAt}
+			om.ToBytes(buf)
+			if err := tx.Set(b.offlineMessageKey(username, seq), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// InsertCappedOfflineMessage satisfies Storage interface.
+// Concurrent insertions conflict on the queue sequence, so that
+// all of them but one fail with badger.ErrConflict.
+func (b *badgerDB) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	var inserted bool
+	err := b.update(func(tx *badger.Txn) error {
+		var keys [][]byte
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		it := tx.NewIterator(opts)
+		prefix := b.offlineMessagesPrefix(username)
+		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+			keys = append(keys, append([]byte(nil), it.Item().Key()...))
+		}
+		it.Close()
+
+		if len(keys) >= capacity {
+			if !dropOldest {
+				return nil
+			}
+			// keys iterate in insertion order
+			for _, key := range keys[:len(keys)-capacity+1] {
+				if err := tx.Delete(key); err != nil {
+					return err
+				}
+			}
+		}
+		seq, err := b.nextSeq(tx, b.offlineSeqKey(username))
+		if err != nil {
+			return err
+		}
+		buf := new(bytes.Buffer)
+		om := model.OfflineMessage{Message: message, ReceivedAt: time.Now()}
+		om.ToBytes(buf)
+		if err := tx.Set(b.offlineMessageKey(username, seq), buf.Bytes()); err != nil {
+			return err
+		}
+		inserted = true
+		return nil
 	})
+	if err != nil {
+		return false, err
+	}
+	return inserted, nil
 }
 
-func (b *badgerDB) CountOfflineMessages(username string) (int, error) {
+func (b *badgerDB) CountOfflineMessages(ctx context.Context, username string) (int, error) {
 	cnt := 0
-	prefix := []byte("offlineMessages:" + username)
+	prefix := b.offlineMessagesPrefix(username)
 	err := b.forEachKey(prefix, func(key []byte) error {
 		cnt++
 		return nil
@@ -258,11 +542,145 @@ func (b *badgerDB) CountOfflineMessages(username string) (int, error) {
 	return cnt, nil
 }
 
-func (b *badgerDB) FetchOfflineMessages(username string) ([]xml.Element, error) {
-	var msgs []xml.Element
+func (b *badgerDB) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	var msgs []model.OfflineMessage
+
+	prefix := b.offlineMessagesPrefix(username)
+	err := b.forEachKeyAndValue(prefix, func(key, val []byte) error {
+		var om model.OfflineMessage
+		om.FromBytes(bytes.NewReader(val))
+		om.Node = string(key[len(prefix):])
+		msgs = append(msgs, om)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return msgs, nil
+}
+
+func (b *badgerDB) DeleteOfflineMessages(ctx context.Context, username string) error {
+	var msgKeys [][]byte
+	prefix := b.offlineMessagesPrefix(username)
+	err := b.forEachKey(prefix, func(key []byte) error {
+		msgKeys = append(msgKeys, key)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return b.update(func(txn *badger.Txn) error {
+		for _, key := range msgKeys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// FetchOfflineMessage satisfies Storage interface.
+// Message nodes are their hex encoded insertion sequences.
+func (b *badgerDB) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	key, ok := b.offlineMessageNodeKey(username, node)
+	if !ok {
+		return nil, nil
+	}
+	var om *model.OfflineMessage
+	err := b.view(func(tx *badger.Txn) error {
+		val, err := b.getVal(key, tx)
+		if err != nil || val == nil {
+			return err
+		}
+		om = &model.OfflineMessage{}
+		om.FromBytes(bytes.NewReader(val))
+		om.Node = node
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return om, nil
+}
 
-	prefix := []byte("offlineMessages:" + username)
-	err := b.forEachKeyAndValue(prefix, func(_, val []byte) error {
+// DeleteOfflineMessage satisfies Storage interface.
+func (b *badgerDB) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	key, ok := b.offlineMessageNodeKey(username, node)
+	if !ok {
+		return false, nil
+	}
+	var deleted bool
+	err := b.update(func(tx *badger.Txn) error {
+		val, err := b.getVal(key, tx)
+		if err != nil || val == nil {
+			return err
+		}
+		deleted = true
+		return tx.Delete(key)
+	})
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+// DeleteExpiredOfflineMessages satisfies Storage interface.
+func (b *badgerDB) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	var msgKeys [][]byte
+	err := b.forEachKeyAndValue(b.key("offlineMessages:"), func(key, val []byte) error {
+		var om model.OfflineMessage
+		om.FromBytes(bytes.NewReader(val))
+		if !om.ReceivedAt.After(before) {
+			msgKeys = append(msgKeys, append([]byte(nil), key...))
+		}
+		return nil
+	})
+	if err != nil || len(msgKeys) == 0 {
+		return 0, err
+	}
+	err = b.update(func(txn *badger.Txn) error {
+		for _, key := range msgKeys {
+			if err := txn.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return len(msgKeys), nil
+}
+
+func (b *badgerDB) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return b.update(func(tx *badger.Txn) error {
+		seq, err := b.nextSeq(tx, b.quarantinedSeqKey(username))
+		if err != nil {
+			return err
+		}
+		message.ToBytes(buf)
+		return tx.Set(b.quarantinedMessageKey(username, seq), buf.Bytes())
+	})
+}
+
+func (b *badgerDB) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	cnt := 0
+	err := b.forEachKey(b.quarantinedMessagesPrefix(username), func(key []byte) error {
+		cnt++
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+	return cnt, nil
+}
+
+func (b *badgerDB) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	var msgs []xml.Element
+	err := b.forEachKeyAndValue(b.quarantinedMessagesPrefix(username), func(_, val []byte) error {
 		var msg xml.MutableElement
 		msg.FromBytes(bytes.NewReader(val))
 		msgs = append(msgs, &msg)
@@ -274,17 +692,16 @@ func (b *badgerDB) FetchOfflineMessages(username string) ([]xml.Element, error)
 	return msgs, nil
 }
 
-func (b *badgerDB) DeleteOfflineMessages(username string) error {
+func (b *badgerDB) DeleteQuarantinedMessages(ctx context.Context, username string) error {
 	var msgKeys [][]byte
-	prefix := []byte("offlineMessages:" + username)
-	err := b.forEachKey(prefix, func(key []byte) error {
+	err := b.forEachKey(b.quarantinedMessagesPrefix(username), func(key []byte) error {
 		msgKeys = append(msgKeys, key)
 		return nil
 	})
 	if err != nil {
 		return err
 	}
-	return b.db.Update(func(txn *badger.Txn) error {
+	return b.update(func(txn *badger.Txn) error {
 		for _, key := range msgKeys {
 			if err := txn.Delete(key); err != nil {
 				return err
@@ -294,6 +711,420 @@ func (b *badgerDB) DeleteOfflineMessages(username string) error {
 	})
 }
 
+// InsertArchivedMessage satisfies Storage interface.
+// Message identifiers are their hex encoded insertion sequences.
+func (b *badgerDB) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return b.update(func(tx *badger.Txn) error {
+		seq, err := b.nextSeq(tx, b.archiveSeqKey(message.Username))
+		if err != nil {
+			return err
+		}
+		message.ID = fmt.Sprintf("%016x", seq)
+		message.ToBytes(buf)
+		return tx.Set(b.archivedMessageKey(message.Username, seq), buf.Bytes())
+	})
+}
+
+func (b *badgerDB) FetchArchivedMessages(ctx context.Context, username string, filter *ArchiveFilter) ([]model.ArchivedMessage, error) {
+	var msgs []model.ArchivedMessage
+	err := b.forEachKeyAndValue(b.archivedMessagesPrefix(username), func(k, val []byte) error {
+		var am model.ArchivedMessage
+		am.FromBytes(bytes.NewReader(val))
+		msgs = append(msgs, am)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return filterArchivedMessages(msgs, filter, archivedMessageSeq), nil
+}
+
+func (b *badgerDB) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return b.update(func(tx *badger.Txn) error {
+		prefs.ToBytes(buf)
+		return tx.Set(b.archivePrefsKey(prefs.Username), buf.Bytes())
+	})
+}
+
+func (b *badgerDB) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	var prefs *model.ArchivePrefs
+	err := b.view(func(tx *badger.Txn) error {
+		val, err := b.getVal(b.archivePrefsKey(username), tx)
+		if err != nil || val == nil {
+			return err
+		}
+		prefs = &model.ArchivePrefs{}
+		prefs.FromBytes(bytes.NewReader(val))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return prefs, nil
+}
+
+func (b *badgerDB) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	return b.update(func(tx *badger.Txn) error {
+		for _, item := range items {
+			// values must not be reused until tx is committed
+			buf := new(bytes.Buffer)
+			item.ToBytes(buf)
+			if err := tx.Set(b.blockListItemKey(item.Username, item.JID), buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerDB) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	return b.update(func(tx *badger.Txn) error {
+		for _, item := range items {
+			if err := tx.Delete(b.blockListItemKey(item.Username, item.JID)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerDB) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	var blis []model.BlockListItem
+
+	prefix := b.key("blockListItems:" + username + ":")
+	err := b.forEachKeyAndValue(prefix, func(k, val []byte) error {
+		var bli model.BlockListItem
+		bli.FromBytes(bytes.NewReader(val))
+		blis = append(blis, bli)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return blis, nil
+}
+
+func (b *badgerDB) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	return b.update(func(tx *badger.Txn) error {
+		key := b.privacyListKey(list.Username, list.Name)
+		val, err := b.getVal(key, tx)
+		if err != nil {
+			return err
+		}
+		pl := model.PrivacyList{Username: list.Username, Name: list.Name, Items: sortedPrivacyListItems(list.Items)}
+		if val != nil {
+			var prev model.PrivacyList
+			prev.FromBytes(bytes.NewReader(val))
+			pl.Default = prev.Default
+		}
+		buf := new(bytes.Buffer)
+		pl.ToBytes(buf)
+		return tx.Set(key, buf.Bytes())
+	})
+}
+
+func (b *badgerDB) DeletePrivacyList(ctx context.Context, username, name string) error {
+	return b.update(func(tx *badger.Txn) error {
+		return tx.Delete(b.privacyListKey(username, name))
+	})
+}
+
+func (b *badgerDB) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	var pls []model.PrivacyList
+
+	prefix := b.key("privacyLists:" + username + ":")
+	err := b.forEachKeyAndValue(prefix, func(k, val []byte) error {
+		var pl model.PrivacyList
+		pl.FromBytes(bytes.NewReader(val))
+		pls = append(pls, pl)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pls, nil
+}
+
+func (b *badgerDB) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	return b.update(func(tx *badger.Txn) error {
+		for _, key := range b.txKeys(tx, b.key("privacyLists:"+username+":"), nil) {
+			val, err := b.getVal(key, tx)
+			if err != nil {
+				return err
+			}
+			var pl model.PrivacyList
+			pl.FromBytes(bytes.NewReader(val))
+			if pl.Default == (pl.Name == name) {
+				continue
+			}
+			pl.Default = !pl.Default
+
+			// values must not be reused until tx is committed
+			buf := new(bytes.Buffer)
+			pl.ToBytes(buf)
+			if err := tx.Set(key, buf.Bytes()); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerDB) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return b.update(func(tx *badger.Txn) error {
+		ff.ToBytes(buf)
+		return tx.Set(b.featureFlagKey(ff.Username, ff.Name), buf.Bytes())
+	})
+}
+
+func (b *badgerDB) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	return b.update(func(tx *badger.Txn) error {
+		return tx.Delete(b.featureFlagKey(username, name))
+	})
+}
+
+func (b *badgerDB) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	var ffs []model.FeatureFlag
+
+	prefix := b.key("featureFlags:" + username + ":")
+	err := b.forEachKeyAndValue(prefix, func(k, val []byte) error {
+		var ff model.FeatureFlag
+		ff.FromBytes(bytes.NewReader(val))
+		ffs = append(ffs, ff)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return ffs, nil
+}
+
+func (b *badgerDB) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return b.update(func(tx *badger.Txn) error {
+		invite.ToBytes(buf)
+		return tx.Set(b.inviteKey(invite.Token), buf.Bytes())
+	})
+}
+
+func (b *badgerDB) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	var redeemed bool
+	err := b.update(func(tx *badger.Txn) error {
+		redeemed = false
+		val, err := b.getVal(b.inviteKey(token), tx)
+		if err != nil || val == nil {
+			return err
+		}
+		var inv model.Invite
+		inv.FromBytes(bytes.NewReader(val))
+		if inv.Used || !now.Before(inv.ExpiresAt) {
+			return nil
+		}
+		inv.Used = true
+
+		// value must remain untouched until transaction is committed
+		buf := new(bytes.Buffer)
+		inv.ToBytes(buf)
+		if err := tx.Set(b.inviteKey(token), buf.Bytes()); err != nil {
+			return err
+		}
+		redeemed = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return redeemed, nil
+}
+
+func (b *badgerDB) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	return b.update(func(tx *badger.Txn) error {
+		session.ToBytes(buf)
+		return tx.Set(b.streamSessionKey(session.ServerID, session.ID), buf.Bytes())
+	})
+}
+
+func (b *badgerDB) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	var sessions []model.StreamSession
+	err := b.forEachKeyAndValue(b.streamSessionsPrefix(serverID), func(k, val []byte) error {
+		var session model.StreamSession
+		session.FromBytes(bytes.NewReader(val))
+		sessions = append(sessions, session)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return sessions, nil
+}
+
+func (b *badgerDB) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	return b.update(func(tx *badger.Txn) error {
+		for _, key := range b.txKeys(tx, b.streamSessionsPrefix(serverID), nil) {
+			if err := tx.Delete(key); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (b *badgerDB) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	entities := []struct {
+		name   string
+		prefix string
+	}{
+		{"archive_prefs", "archivePrefs:"},
+		{"archived_messages", "archivedMessages:"},
+		{"block_list_items", "blockListItems:"},
+		{"feature_flags", "featureFlags:"},
+		{"invites", "invites:"},
+		{"offline_messages", "offlineMessages:"},
+		{"privacy_lists", "privacyLists:"},
+		{"private_storage", "privateElements:"},
+		{"quarantined_messages", "quarantinedMessages:"},
+		{"roster_items", "rosterItems:"},
+		{"roster_notifications", "rosterNotifications:"},
+		{"roster_tombstones", "rosterTombstones:"},
+		{"roster_versions", "rosterVersions:"},
+		{"stream_sessions", "streamSessions:"},
+		{"users", "users:"},
+		{"vcards", "vCards:"},
+	}
+	var usage []model.EntityUsage
+	for _, e := range entities {
+		u := model.EntityUsage{Entity: e.name}
+		err := b.scanKeys(b.key(e.prefix), func(item *badger.Item) {
+			u.Rows++
+			u.Bytes += item.EstimatedSize()
+		})
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+// incRosterVersion increments user roster version within tx, returning the new one.
+// InTransaction satisfies Storage interface.
+func (b *badgerDB) InTransaction(ctx context.Context, f func(tx Storage) error) error {
+	return b.update(func(txn *badger.Txn) error {
+		return f(&badgerDB{db: b.db, txn: txn, prefix: b.prefix})
+	})
+}
+
+// update runs f within a read-write transaction, joining
+// the one bound to b, if any.
+func (b *badgerDB) update(f func(txn *badger.Txn) error) error {
+	if b.txn != nil {
+		return f(b.txn)
+	}
+	return b.db.Update(f)
+}
+
+// view runs f within a read-only transaction, or within
+// the read-write one bound to b, if any.
+func (b *badgerDB) view(f func(txn *badger.Txn) error) error {
+	if b.txn != nil {
+		return f(b.txn)
+	}
+	return b.db.View(f)
+}
+
+func (b *badgerDB) incRosterVersion(tx *badger.Txn, user string) (int, error) {
+	rv, err := b.fetchRosterVersion(tx, user)
+	if err != nil {
+		return 0, err
+	}
+	rv.Ver++
+	if err := b.setRosterVersion(tx, user, rv); err != nil {
+		return 0, err
+	}
+	return rv.Ver, nil
+}
+
+func (b *badgerDB) fetchRosterVersion(tx *badger.Txn, user string) (model.RosterVersion, error) {
+	var rv model.RosterVersion
+	val, err := b.getVal(b.rosterVersionKey(user), tx)
+	if err != nil {
+		return rv, err
+	}
+	if val != nil {
+		rv.FromBytes(bytes.NewReader(val))
+	}
+	return rv, nil
+}
+
+func (b *badgerDB) setRosterVersion(tx *badger.Txn, user string, rv model.RosterVersion) error {
+	// value must remain untouched until transaction is committed
+	buf := new(bytes.Buffer)
+	rv.ToBytes(buf)
+	return tx.Set(b.rosterVersionKey(user), buf.Bytes())
+}
+
+// nextSeq increments the sequence stored under key within tx, returning the new value.
+func (b *badgerDB) nextSeq(tx *badger.Txn, key []byte) (uint64, error) {
+	var seq uint64
+	val, err := b.getVal(key, tx)
+	if err != nil {
+		return 0, err
+	}
+	if len(val) == 8 {
+		seq = binary.BigEndian.Uint64(val)
+	}
+	seq++
+
+	// value must remain untouched until transaction is committed
+	newVal := make([]byte, 8)
+	binary.BigEndian.PutUint64(newVal, seq)
+	if err := tx.Set(key, newVal); err != nil {
+		return 0, err
+	}
+	return seq, nil
+}
+
+// encodeRosterItemSeq writes ri into buf preceded by its insertion sequence.
+func encodeRosterItemSeq(buf *bytes.Buffer, seq uint64, ri *model.RosterItem) {
+	var b [8]byte
+	binary.BigEndian.PutUint64(b[:], seq)
+	buf.Write(b[:])
+	ri.ToBytes(buf)
+}
+
+func decodeRosterItemSeq(val []byte) (uint64, *model.RosterItem) {
+	var ri model.RosterItem
+	ri.FromBytes(bytes.NewReader(val[8:]))
+	return binary.BigEndian.Uint64(val[:8]), &ri
+}
+
+// rosterItemsBySeq sorts roster items by their insertion sequence.
+type rosterItemsBySeq struct {
+	ris  []model.RosterItem
+	seqs []uint64
+}
+
+func (s *rosterItemsBySeq) Len() int           { return len(s.ris) }
+func (s *rosterItemsBySeq) Less(i, j int) bool { return s.seqs[i] < s.seqs[j] }
+func (s *rosterItemsBySeq) Swap(i, j int) {
+	s.ris[i], s.ris[j] = s.ris[j], s.ris[i]
+	s.seqs[i], s.seqs[j] = s.seqs[j], s.seqs[i]
+}
+
 func (b *badgerDB) loop() {
 	tc := time.NewTicker(time.Minute)
 	defer tc.Stop()
@@ -310,32 +1141,164 @@ func (b *badgerDB) loop() {
 	}
 }
 
+// badgerTenantPrefix returns the prefix of every key stored on behalf of tenant.
+// Tenant identifiers can't contain '/', so that no prefix is a prefix of another one.
+func badgerTenantPrefix(tenant string) string {
+	if len(tenant) == 0 {
+		return ""
+	}
+	return "tenants:" + tenant + "/"
+}
+
+// key returns k qualified by handle tenant.
+func (b *badgerDB) key(k string) []byte {
+	return []byte(b.prefix + k)
+}
+
 func (b *badgerDB) userKey(username string) []byte {
-	return []byte("users:" + username)
+	return b.key("users:" + username)
 }
 
 func (b *badgerDB) vCardKey(username string) []byte {
-	return []byte("vCards:" + username)
+	return b.key("vCards:" + username)
 }
 
 func (b *badgerDB) privateStorageKey(username, namespace string) []byte {
-	return []byte("privateElements:" + username + ":" + namespace)
+	return b.key("privateElements:" + username + ":" + namespace)
 }
 
 func (b *badgerDB) rosterItemKey(user, contact string) []byte {
-	return []byte("rosterItems:" + user + ":" + contact)
+	return b.key("rosterItems:" + user + ":" + contact)
+}
+
+func (b *badgerDB) rosterVersionKey(user string) []byte {
+	return b.key("rosterVersions:" + user)
+}
+
+func (b *badgerDB) rosterTombstoneKey(user, contact string) []byte {
+	return b.key("rosterTombstones:" + user + ":" + contact)
 }
 
 func (b *badgerDB) rosterNotificationKey(user, contact string) []byte {
-	return []byte("rosterNotifications:" + contact + ":" + user)
+	return b.key("rosterNotifications:" + contact + ":" + user)
+}
+
+func (b *badgerDB) offlineMessagesPrefix(username string) []byte {
+	return b.key("offlineMessages:" + username + ":")
+}
+
+// offlineMessageKey returns the key of a user offline message, formatting
+// seq in fixed width so that keys iterate in insertion order.
+func (b *badgerDB) offlineMessageKey(username string, seq uint64) []byte {
+	return append(b.offlineMessagesPrefix(username), fmt.Sprintf("%016x", seq)...)
+}
+
+// offlineMessageNodeKey returns the key of the user offline message
+// identified by node, as long as it's a well-formed one.
+func (b *badgerDB) offlineMessageNodeKey(username, node string) ([]byte, bool) {
+	if len(node) != 16 {
+		return nil, false
+	}
+	seq, err := strconv.ParseUint(node, 16, 64)
+	if err != nil {
+		return nil, false
+	}
+	return b.offlineMessageKey(username, seq), true
+}
+
+func (b *badgerDB) offlineSeqKey(username string) []byte {
+	return b.key("offlineSeqs:" + username)
+}
+
+func (b *badgerDB) quarantinedMessagesPrefix(username string) []byte {
+	return b.key("quarantinedMessages:" + username + ":")
+}
+
+func (b *badgerDB) quarantinedMessageKey(username string, seq uint64) []byte {
+	return append(b.quarantinedMessagesPrefix(username), fmt.Sprintf("%016x", seq)...)
+}
+
+func (b *badgerDB) quarantinedSeqKey(username string) []byte {
+	return b.key("quarantinedSeqs:" + username)
 }
 
-func (b *badgerDB) offlineMessageKey(username, identifier string) []byte {
-	return []byte("offlineMessages:" + username + ":" + identifier)
+func (b *badgerDB) archivedMessagesPrefix(username string) []byte {
+	return b.key("archivedMessages:" + username + ":")
 }
 
+func (b *badgerDB) archivedMessageKey(username string, seq uint64) []byte {
+	return append(b.archivedMessagesPrefix(username), fmt.Sprintf("%016x", seq)...)
+}
+
+// archivedMessageSeq returns the insertion sequence
+// of an archived message identifier, if well-formed.
+func archivedMessageSeq(id string) (uint64, bool) {
+	if len(id) != 16 {
+		return 0, false
+	}
+	seq, err := strconv.ParseUint(id, 16, 64)
+	if err != nil {
+		return 0, false
+	}
+	return seq, true
+}
+
+func (b *badgerDB) archiveSeqKey(username string) []byte {
+	return b.key("archiveSeqs:" + username)
+}
+
+func (b *badgerDB) archivePrefsKey(username string) []byte {
+	return b.key("archivePrefs:" + username)
+}
+
+func (b *badgerDB) blockListItemKey(username, jid string) []byte {
+	return b.key("blockListItems:" + username + ":" + jid)
+}
+
+func (b *badgerDB) privacyListKey(username, name string) []byte {
+	return b.key("privacyLists:" + username + ":" + name)
+}
+
+func (b *badgerDB) featureFlagKey(username, name string) []byte {
+	return b.key("featureFlags:" + username + ":" + name)
+}
+
+func (b *badgerDB) inviteKey(token string) []byte {
+	return b.key("invites:" + token)
+}
+
+func (b *badgerDB) streamSessionsPrefix(serverID string) []byte {
+	return b.key("streamSessions:" + serverID + ":")
+}
+
+func (b *badgerDB) streamSessionKey(serverID, id string) []byte {
+	return append(b.streamSessionsPrefix(serverID), id...)
+}
+
+// txKeys returns a copy of every key within tx matching prefix
+// and satisfying match, if not nil.
+func (b *badgerDB) txKeys(tx *badger.Txn, prefix []byte, match func(k []byte) bool) [][]byte {
+	opts := badger.DefaultIteratorOptions
+	opts.PrefetchValues = false
+	opts.AllVersions = false
+	it := tx.NewIterator(opts)
+	defer it.Close()
+
+	var keys [][]byte
+	for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
+		k := it.Item().Key()
+		if match == nil || match(k) {
+			keys = append(keys, append([]byte{}, k...))
+		}
+	}
+	return keys
+}
+
+// forEachKey calls f with every key matching prefix. Keys are copied,
+// as the iterator reuses their underlying buffers once advanced,
+// so that they can be retained beyond the iteration.
 func (b *badgerDB) forEachKey(prefix []byte, f func(k []byte) error) error {
-	return b.db.View(func(txn *badger.Txn) error {
+	return b.view(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.PrefetchValues = false
 		opts.AllVersions = false
@@ -343,7 +1306,7 @@ func (b *badgerDB) forEachKey(prefix []byte, f func(k []byte) error) error {
 		defer it.Close()
 
 		for it.Seek(prefix); it.ValidForPrefix(prefix); it.Next() {
-			if err := f(it.Item().Key()); err != nil {
+			if err := f(append([]byte(nil), it.Item().Key()...)); err != nil {
 				return err
 			}
 		}
@@ -351,8 +1314,39 @@ func (b *badgerDB) forEachKey(prefix []byte, f func(k []byte) error) error {
 	})
 }
 
+// scanKeys iterates over every key matching prefix in batches of
+// usageScanBatchSize items, each one of them within its own read
+// transaction, so that long scans don't hold back foreground operations.
+func (b *badgerDB) scanKeys(prefix []byte, f func(item *badger.Item)) error {
+	var lastKey []byte
+	for {
+		var n int
+		err := b.view(func(txn *badger.Txn) error {
+			opts := badger.DefaultIteratorOptions
+			opts.PrefetchValues = false
+			opts.AllVersions = false
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			seekKey := prefix
+			if lastKey != nil {
+				seekKey = append(lastKey, 0)
+			}
+			for it.Seek(seekKey); it.ValidForPrefix(prefix) && n < usageScanBatchSize; it.Next() {
+				f(it.Item())
+				lastKey = append(lastKey[:0], it.Item().Key()...)
+				n++
+			}
+			return nil
+		})
+		if err != nil || n < usageScanBatchSize {
+			return err
+		}
+	}
+}
+
 func (b *badgerDB) forEachKeyAndValue(prefix []byte, f func(k, v []byte) error) error {
-	return b.db.View(func(txn *badger.Txn) error {
+	return b.view(func(txn *badger.Txn) error {
 		opts := badger.DefaultIteratorOptions
 		opts.AllVersions = false
 		it := txn.NewIterator(badger.DefaultIteratorOptions)
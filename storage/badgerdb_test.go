@@ -6,8 +6,11 @@
 package storage
 
 import (
+	"context"
+	"fmt"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/storage/model"
@@ -29,22 +32,37 @@ func TestBadgerDB_User(t *testing.T) {
 
 	usr := model.User{Username: "ortuman", Password: "1234"}
 
-	err := h.db.InsertOrUpdateUser(&usr)
+	err := h.db.InsertOrUpdateUser(context.Background(), &usr)
 	require.Nil(t, err)
 
-	usr2, err := h.db.FetchUser("ortuman")
+	usr2, err := h.db.FetchUser(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, "ortuman", usr2.Username)
 	require.Equal(t, "1234", usr2.Password)
 
-	exists, err := h.db.UserExists("ortuman")
+	exists, err := h.db.UserExists(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.True(t, exists)
 
-	err = h.db.DeleteUser("ortuman")
+	cnt, err := h.db.CountUsers(context.Background())
 	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
 
-	exists, err = h.db.UserExists("ortuman")
+	usernames, err := h.db.FetchPurgeableUsers(context.Background(), time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(usernames))
+
+	usr.PurgeAt = time.Now().Add(-time.Minute)
+	err = h.db.InsertOrUpdateUser(context.Background(), &usr)
+	require.Nil(t, err)
+	usernames, err = h.db.FetchPurgeableUsers(context.Background(), time.Now())
+	require.Nil(t, err)
+	require.Equal(t, []string{"ortuman"}, usernames)
+
+	err = h.db.DeleteUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+
+	exists, err = h.db.UserExists(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.False(t, exists)
 }
@@ -60,10 +78,10 @@ func TestBadgerDB_VCard(t *testing.T) {
 	fn.SetText("Miguel Ángel Ortuño")
 	vcard.AppendElement(fn)
 
-	err := h.db.InsertOrUpdateVCard(vcard, "ortuman")
+	err := h.db.InsertOrUpdateVCard(context.Background(), vcard, "ortuman")
 	require.Nil(t, err)
 
-	vcard2, err := h.db.FetchVCard("ortuman")
+	vcard2, err := h.db.FetchVCard(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, "vCard", vcard2.Name())
 	require.Equal(t, "vcard-temp", vcard2.Namespace())
@@ -79,9 +97,9 @@ func TestBadgerDB_PrivateXML(t *testing.T) {
 	pv1 := xml.NewElementNamespace("ex1", "exodus:ns")
 	pv2 := xml.NewElementNamespace("ex2", "exodus:ns")
 
-	require.NoError(t, h.db.InsertOrUpdatePrivateXML([]xml.Element{pv1, pv2}, "exodus:ns", "ortuman"))
+	require.NoError(t, h.db.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{pv1, pv2}, "exodus:ns", "ortuman"))
 
-	prvs, err := h.db.FetchPrivateXML("exodus:ns", "ortuman")
+	prvs, err := h.db.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 2, len(prvs))
 }
@@ -102,25 +120,84 @@ func TestBadgerDB_RosterItems(t *testing.T) {
 		Contact:      "romeo",
 		Subscription: "both",
 	}
-	require.NoError(t, h.db.InsertOrUpdateRosterItem(ri1))
-	require.NoError(t, h.db.InsertOrUpdateRosterItem(ri2))
+	require.NoError(t, h.db.InsertOrUpdateRosterItem(context.Background(), ri1))
+	require.NoError(t, h.db.InsertOrUpdateRosterItem(context.Background(), ri2))
 
-	ris, err := h.db.FetchRosterItems("ortuman")
+	ris, err := h.db.FetchRosterItems(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 2, len(ris))
 
-	ri3, err := h.db.FetchRosterItem("ortuman", "juliet")
+	ri3, err := h.db.FetchRosterItem(context.Background(), "ortuman", "juliet")
 	require.Nil(t, err)
 	require.Equal(t, ri1, ri3)
 
-	require.NoError(t, h.db.DeleteRosterItem("ortuman", "juliet"))
-	require.NoError(t, h.db.DeleteRosterItem("ortuman", "romeo"))
+	require.NoError(t, h.db.DeleteRosterItem(context.Background(), "ortuman", "juliet"))
+	require.NoError(t, h.db.DeleteRosterItem(context.Background(), "ortuman", "romeo"))
 
-	ris, err = h.db.FetchRosterItems("ortuman")
+	ris, err = h.db.FetchRosterItems(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 0, len(ris))
 }
 
+func TestBadgerDB_InsertionOrder(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	contacts := []string{"romeo", "juliet", "noelia", "mercutio"}
+	for _, contact := range contacts {
+		require.NoError(t, h.db.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: contact, Subscription: "none"}))
+	}
+	// updates don't alter item position
+	require.NoError(t, h.db.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both"}))
+
+	ris, err := h.db.FetchRosterItems(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, len(contacts), len(ris))
+	for i, ri := range ris {
+		require.Equal(t, contacts[i], ri.Contact)
+	}
+	require.Equal(t, "both", ris[0].Subscription)
+
+	ids := []string{"c", "a", "b", "a"}
+	for _, id := range ids {
+		require.NoError(t, h.db.InsertOfflineMessage(context.Background(), xml.NewMessageType(id, xml.NormalType), "ortuman"))
+	}
+	msgs, err := h.db.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, len(ids), len(msgs))
+	for i, msg := range msgs {
+		require.Equal(t, ids[i], msg.Message.ID())
+	}
+}
+
+func BenchmarkBadgerDB_FetchRosterItems(b *testing.B) {
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	benchmarkFetchRosterItems(b, h.db)
+}
+
+func BenchmarkMockStorage_FetchRosterItems(b *testing.B) {
+	benchmarkFetchRosterItems(b, newMockStorage())
+}
+
+func benchmarkFetchRosterItems(b *testing.B, s Storage) {
+	for i := 0; i < 250; i++ {
+		ri := &model.RosterItem{User: "ortuman", Contact: fmt.Sprintf("contact%d", i), Subscription: "both"}
+		if err := s.InsertOrUpdateRosterItem(context.Background(), ri); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := s.FetchRosterItems(context.Background(), "ortuman"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
 func TestBadgerDB_RosterNotifications(t *testing.T) {
 	t.Parallel()
 
@@ -137,22 +214,22 @@ func TestBadgerDB_RosterNotifications(t *testing.T) {
 		Contact:  "ortuman",
 		Elements: []xml.Element{},
 	}
-	require.NoError(t, h.db.InsertOrUpdateRosterNotification(&rn1))
-	require.NoError(t, h.db.InsertOrUpdateRosterNotification(&rn2))
+	require.NoError(t, h.db.InsertOrUpdateRosterNotification(context.Background(), &rn1))
+	require.NoError(t, h.db.InsertOrUpdateRosterNotification(context.Background(), &rn2))
 
-	rns, err := h.db.FetchRosterNotifications("ortuman")
+	rns, err := h.db.FetchRosterNotifications(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 2, len(rns))
 
-	require.NoError(t, h.db.DeleteRosterNotification(rn1.User, rn1.Contact))
+	require.NoError(t, h.db.DeleteRosterNotification(context.Background(), rn1.User, rn1.Contact))
 
-	rns, err = h.db.FetchRosterNotifications("ortuman")
+	rns, err = h.db.FetchRosterNotifications(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 1, len(rns))
 
-	require.NoError(t, h.db.DeleteRosterNotification(rn2.User, rn2.Contact))
+	require.NoError(t, h.db.DeleteRosterNotification(context.Background(), rn2.User, rn2.Contact))
 
-	rns, err = h.db.FetchRosterNotifications("ortuman")
+	rns, err = h.db.FetchRosterNotifications(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 0, len(rns))
 }
@@ -173,28 +250,122 @@ func TestBadgerDB_OfflineMessages(t *testing.T) {
 	b2.SetText("what's up?!")
 	msg1.AppendElement(b1)
 
-	require.NoError(t, h.db.InsertOfflineMessage(msg1, "ortuman"))
-	require.NoError(t, h.db.InsertOfflineMessage(msg2, "ortuman"))
+	require.NoError(t, h.db.InsertOfflineMessage(context.Background(), msg1, "ortuman"))
+	require.NoError(t, h.db.InsertOfflineMessage(context.Background(), msg2, "ortuman"))
+
+	cnt, err := h.db.CountOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, cnt)
+
+	msgs, err := h.db.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msgs))
+
+	require.NoError(t, h.db.DeleteOfflineMessages(context.Background(), "ortuman"))
+	cnt, err = h.db.CountOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+}
+
+func TestBadgerDB_QuarantinedMessages(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	for i := 0; i < 2; i++ {
+		msg := xml.NewMessageType(uuid.New(), xml.ChatType)
+		require.NoError(t, h.db.InsertQuarantinedMessage(context.Background(), msg, "ortuman"))
+	}
+	require.NoError(t, h.db.InsertQuarantinedMessage(context.Background(), xml.NewMessageType(uuid.New(), xml.ChatType), "ortuman2"))
 
-	cnt, err := h.db.CountOfflineMessages("ortuman")
+	cnt, err := h.db.CountQuarantinedMessages(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 2, cnt)
 
-	msgs, err := h.db.FetchOfflineMessages("ortuman")
+	msgs, err := h.db.FetchQuarantinedMessages(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 2, len(msgs))
 
-	require.NoError(t, h.db.DeleteOfflineMessages("ortuman"))
-	cnt, err = h.db.CountOfflineMessages("ortuman")
+	require.NoError(t, h.db.DeleteQuarantinedMessages(context.Background(), "ortuman"))
+	cnt, err = h.db.CountQuarantinedMessages(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.Equal(t, 0, cnt)
+	cnt, err = h.db.CountQuarantinedMessages(context.Background(), "ortuman2")
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+}
+
+func TestBadgerDB_FeatureFlags(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	require.NoError(t, h.db.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "carbons", Username: "ortuman", Enabled: true}))
+	require.NoError(t, h.db.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "mam", Username: "ortuman"}))
+	require.NoError(t, h.db.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "carbons", Username: "ortuman2"}))
+
+	ffs, err := h.db.FetchFeatureFlags(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(ffs))
+
+	require.NoError(t, h.db.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "mam", Username: "ortuman", Enabled: true}))
+	require.NoError(t, h.db.DeleteFeatureFlag(context.Background(), "carbons", "ortuman"))
+	ffs, err = h.db.FetchFeatureFlags(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, []model.FeatureFlag{{Name: "mam", Username: "ortuman", Enabled: true}}, ffs)
+}
+
+func TestBadgerDB_Usage(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	for i := 0; i < usageScanBatchSize+10; i++ {
+		msg := xml.NewElementNamespace("message", "jabber:client")
+		msg.SetID(uuid.New())
+		require.NoError(t, h.db.InsertOfflineMessage(context.Background(), msg, "ortuman"))
+	}
+	require.NoError(t, h.db.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+
+	usage, err := h.db.Usage(context.Background())
+	require.Nil(t, err)
+
+	rows := make(map[string]int64)
+	for _, u := range usage {
+		rows[u.Entity] = u.Rows
+		if u.Rows > 0 {
+			require.True(t, u.Bytes > 0)
+		}
+	}
+	require.Equal(t, int64(usageScanBatchSize+10), rows["offline_messages"])
+	require.Equal(t, int64(1), rows["users"])
+	require.Equal(t, int64(0), rows["vcards"])
+}
+
+func TestBadgerDB_MockedStorage(t *testing.T) {
+	s := newBadgerMockStorage()
+	defer s.Shutdown()
+
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+
+	s.activateMockedError()
+	_, err := s.FetchUser(context.Background(), "ortuman")
+	require.Equal(t, ErrMockedError, err)
+
+	s.deactivateMockedError()
+	usr, err := s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.NotNil(t, usr)
 }
 
 func tUtilBadgerDBSetup() *testBadgerDBHelper {
 	h := &testBadgerDBHelper{}
 	h.dataDir = "./com.jackal.tests.badgerdb." + uuid.New()
 	cfg := config.BadgerDb{DataDir: h.dataDir}
-	h.db = newBadgerDB(&cfg)
+	h.db = newBadgerDB(&cfg, "")
 	return h
 }
 
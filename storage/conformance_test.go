@@ -0,0 +1,928 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+// Storage conformance cases, shared by every backend that can be
+// exercised without external dependencies.
+
+func TestMockStorageConformance(t *testing.T) {
+	testStorageConformance(t, func() (Storage, func()) {
+		return newMockStorage(), func() {}
+	})
+}
+
+func TestBadgerDBConformance(t *testing.T) {
+	testStorageConformance(t, func() (Storage, func()) {
+		h := tUtilBadgerDBSetup()
+		return h.db, func() { tUtilBadgerDBTeardown(h) }
+	})
+}
+
+func TestBadgerDBTenantIsolation(t *testing.T) {
+	h := tUtilBadgerDBSetup()
+	defer tUtilBadgerDBTeardown(h)
+
+	// every handle shares the same underlying store
+	a := &badgerDB{db: h.db.db, prefix: badgerTenantPrefix("tenant_a")}
+	b := &badgerDB{db: h.db.db, prefix: badgerTenantPrefix("tenant_b")}
+	testTenantIsolation(t, a, b)
+	testTenantIsolation(t, h.db, b)
+}
+
+func TestSQLiteConformance(t *testing.T) {
+	testStorageConformance(t, func() (Storage, func()) {
+		h := tUtilSQLiteSetup()
+		return h.db, func() { tUtilSQLiteTeardown(h) }
+	})
+}
+
+func TestSQLiteTenantIsolation(t *testing.T) {
+	h := tUtilSQLiteSetup()
+	defer tUtilSQLiteTeardown(h)
+
+	// every handle shares the same underlying database
+	a := &sqliteStorage{db: h.db.db, tenant: "tenant_a"}
+	b := &sqliteStorage{db: h.db.db, tenant: "tenant_b"}
+	testTenantIsolation(t, a, b)
+	testTenantIsolation(t, h.db, b)
+}
+
+func TestRedisConformance(t *testing.T) {
+	testStorageConformance(t, func() (Storage, func()) {
+		h := tUtilRedisSetup()
+		return h.db, func() { tUtilRedisTeardown(h) }
+	})
+}
+
+func TestRedisTenantIsolation(t *testing.T) {
+	h := tUtilRedisSetup()
+	defer tUtilRedisTeardown(h)
+
+	// every handle shares the same underlying client
+	a := &redisStorage{client: h.db.client, prefix: redisTenantPrefix("tenant_a")}
+	b := &redisStorage{client: h.db.client, prefix: redisTenantPrefix("tenant_b")}
+	testTenantIsolation(t, a, b)
+	testTenantIsolation(t, h.db, b)
+}
+
+func testStorageConformance(t *testing.T, setup func() (Storage, func())) {
+	t.Run("RosterVersionMonotonicity", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testRosterVersionMonotonicity(t, s)
+	})
+	t.Run("RosterTombstonePruning", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testRosterTombstonePruning(t, s)
+	})
+	t.Run("InviteRedemption", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testInviteRedemption(t, s)
+	})
+	t.Run("DeleteUserCascade", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testDeleteUserCascade(t, s)
+	})
+	t.Run("Transactions", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		if _, ok := s.(*redisStorage); ok {
+			t.Skip("redis storage can't roll back transactions")
+		}
+		testTransactions(t, s)
+	})
+	t.Run("BatchedQueries", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testBatchedQueries(t, s)
+	})
+	t.Run("CappedOfflineQueue", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testCappedOfflineQueue(t, s)
+	})
+	t.Run("OfflineMessageExpiry", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testOfflineMessageExpiry(t, s)
+	})
+	t.Run("OfflineMessageNodes", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testOfflineMessageNodes(t, s)
+	})
+	t.Run("MessageArchive", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testMessageArchive(t, s)
+	})
+	t.Run("BlockList", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testBlockList(t, s)
+	})
+	t.Run("PrivacyLists", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testPrivacyLists(t, s)
+	})
+	t.Run("StreamSessions", func(t *testing.T) {
+		s, teardown := setup()
+		defer teardown()
+		testStreamSessions(t, s)
+	})
+}
+
+func testRosterVersionMonotonicity(t *testing.T, s Storage) {
+	rv, err := s.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, model.RosterVersion{}, rv)
+
+	var lastVer int
+	requireVersionIncreased := func() {
+		rv, err := s.FetchRosterVersion(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.True(t, rv.Ver > lastVer)
+		lastVer = rv.Ver
+	}
+	ri1 := model.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "none"}
+	ri2 := model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "none"}
+
+	// add
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &ri1))
+	require.True(t, ri1.Ver > lastVer)
+	requireVersionIncreased()
+	require.Equal(t, lastVer, ri1.Ver)
+
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &ri2))
+	requireVersionIncreased()
+	require.Equal(t, lastVer, ri2.Ver)
+
+	// update
+	ri1.Subscription = "both"
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &ri1))
+	requireVersionIncreased()
+	require.Equal(t, lastVer, ri1.Ver)
+
+	ri, err := s.FetchRosterItem(context.Background(), "ortuman", "noelia")
+	require.Nil(t, err)
+	require.Equal(t, ri1.Ver, ri.Ver)
+
+	// delete
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "ortuman", "romeo"))
+	requireVersionIncreased()
+
+	rts, err := s.FetchRosterTombstones(context.Background(), "ortuman", ri2.Ver)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rts))
+	require.Equal(t, "romeo", rts[0].Contact)
+	require.Equal(t, lastVer, rts[0].Ver)
+
+	// deleting a non existing item is not a modification
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "ortuman", "mercutio"))
+	rv, _ = s.FetchRosterVersion(context.Background(), "ortuman")
+	require.Equal(t, lastVer, rv.Ver)
+
+	// re-adding a deleted item drops its tombstone
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &ri2))
+	requireVersionIncreased()
+	rts, err = s.FetchRosterTombstones(context.Background(), "ortuman", 0)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(rts))
+
+	// versions are kept per user
+	rv, err = s.FetchRosterVersion(context.Background(), "noelia")
+	require.Nil(t, err)
+	require.Equal(t, 0, rv.Ver)
+}
+
+func testRosterTombstonePruning(t *testing.T, s Storage) {
+	for _, contact := range []string{"noelia", "romeo", "juliet"} {
+		require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: contact}))
+	}
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "noelia", Contact: "ortuman"}))
+
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "ortuman", "noelia"))
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "ortuman", "romeo"))
+	rv, _ := s.FetchRosterVersion(context.Background(), "ortuman")
+	prunedVer := rv.Ver
+
+	time.Sleep(time.Millisecond * 10)
+	before := time.Now()
+	time.Sleep(time.Millisecond * 10)
+
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "ortuman", "juliet"))
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "noelia", "ortuman"))
+
+	n, err := s.PruneRosterTombstones(context.Background(), before.Add(-time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.PruneRosterTombstones(context.Background(), before)
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+
+	rts, err := s.FetchRosterTombstones(context.Background(), "ortuman", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rts))
+	require.Equal(t, "juliet", rts[0].Contact)
+
+	rv, err = s.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, prunedVer, rv.PrunedVer)
+	require.Equal(t, prunedVer+1, rv.Ver)
+
+	// unaffected users
+	rv, err = s.FetchRosterVersion(context.Background(), "noelia")
+	require.Nil(t, err)
+	require.Equal(t, 0, rv.PrunedVer)
+	rts, err = s.FetchRosterTombstones(context.Background(), "noelia", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rts))
+}
+
+func testInviteRedemption(t *testing.T, s Storage) {
+	now := time.Now()
+	require.Nil(t, s.InsertInvite(context.Background(), &model.Invite{Token: "t1", CreatedBy: "ortuman", ExpiresAt: now.Add(time.Hour)}))
+	require.Nil(t, s.InsertInvite(context.Background(), &model.Invite{Token: "t2", CreatedBy: "ortuman", ExpiresAt: now.Add(-time.Second)}))
+
+	// unknown and expired tokens
+	ok, err := s.RedeemInvite(context.Background(), "t0", now)
+	require.Nil(t, err)
+	require.False(t, ok)
+	ok, err = s.RedeemInvite(context.Background(), "t2", now)
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// tokens can only be redeemed once, even concurrently
+	var wg sync.WaitGroup
+	var redeemed int32
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if ok, err := s.RedeemInvite(context.Background(), "t1", now); err == nil && ok {
+				atomic.AddInt32(&redeemed, 1)
+			}
+		}()
+	}
+	wg.Wait()
+	require.Equal(t, int32(1), redeemed)
+
+	ok, err = s.RedeemInvite(context.Background(), "t1", now)
+	require.Nil(t, err)
+	require.False(t, ok)
+}
+
+func testDeleteUserCascade(t *testing.T, s Storage) {
+	// 'ortumanx' shares key prefix with 'ortuman' and must be left untouched
+	for _, username := range []string{"ortuman", "ortumanx"} {
+		require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: username, Password: "1234"}))
+		require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: username, Contact: "noelia", Subscription: "both"}))
+		require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: username, Contact: "romeo", Subscription: "none"}))
+		require.Nil(t, s.DeleteRosterItem(context.Background(), username, "romeo"))
+		require.Nil(t, s.InsertOrUpdateRosterNotification(context.Background(), &model.RosterNotification{User: "juliet", Contact: username}))
+		require.Nil(t, s.InsertOrUpdateRosterNotification(context.Background(), &model.RosterNotification{User: username, Contact: "mercutio"}))
+		require.Nil(t, s.InsertOrUpdateVCard(context.Background(), xml.NewElementNamespace("vCard", "vcard-temp"), username))
+		require.Nil(t, s.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{xml.NewElementNamespace("storage", "storage:bookmarks")}, "storage:bookmarks", username))
+		require.Nil(t, s.InsertOfflineMessage(context.Background(), xml.NewMessageType("m1", xml.NormalType), username))
+		require.Nil(t, s.InsertQuarantinedMessage(context.Background(), xml.NewMessageType("m2", xml.NormalType), username))
+		require.Nil(t, s.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "vacation", Username: username, Enabled: true}))
+		require.Nil(t, s.InsertBlockListItems(context.Background(), []model.BlockListItem{{Username: username, JID: "tybalt@jackal.im"}}))
+		require.Nil(t, s.InsertOrUpdatePrivacyList(context.Background(), &model.PrivacyList{
+			Username: username,
+			Name:     "invisible",
+			Items:    []model.PrivacyListItem{{Action: "deny", Order: 1, PresenceOut: true}},
+		}))
+		require.Nil(t, s.SetDefaultPrivacyList(context.Background(), username, "invisible"))
+	}
+	require.Nil(t, s.DeleteUser(context.Background(), "ortuman"))
+
+	requireUserData := func(username string, exists bool) {
+		ok, err := s.UserExists(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, exists, ok)
+
+		count := func(n int, err error) int {
+			require.Nil(t, err)
+			return n
+		}
+		expected := 0
+		if exists {
+			expected = 1
+		}
+		ris, err := s.FetchRosterItems(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, expected, len(ris))
+		rv, err := s.FetchRosterVersion(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, exists, rv.Ver > 0)
+		rts, err := s.FetchRosterTombstones(context.Background(), username, 0)
+		require.Nil(t, err)
+		require.Equal(t, expected, len(rts))
+		rns, err := s.FetchRosterNotifications(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, expected, len(rns))
+		vCard, err := s.FetchVCard(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, exists, vCard != nil)
+		prv, err := s.FetchPrivateXML(context.Background(), "storage:bookmarks", username)
+		require.Nil(t, err)
+		require.Equal(t, expected, len(prv))
+		require.Equal(t, expected, count(s.CountOfflineMessages(context.Background(), username)))
+		require.Equal(t, expected, count(s.CountQuarantinedMessages(context.Background(), username)))
+		ffs, err := s.FetchFeatureFlags(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, expected, len(ffs))
+		blis, err := s.FetchBlockListItems(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, expected, len(blis))
+		pls, err := s.FetchPrivacyLists(context.Background(), username)
+		require.Nil(t, err)
+		require.Equal(t, expected, len(pls))
+	}
+	requireUserData("ortuman", false)
+	requireUserData("ortumanx", true)
+
+	// roster notifications sent by deleted user are gone as well
+	rns, err := s.FetchRosterNotifications(context.Background(), "mercutio")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rns))
+	require.Equal(t, "ortumanx", rns[0].User)
+}
+
+func testTransactions(t *testing.T, s Storage) {
+	ctx := context.Background()
+	errRollback := errors.New("rollback")
+
+	require.Nil(t, s.InsertOrUpdateUser(ctx, &model.User{Username: "ortuman", Password: "1234"}))
+	require.Nil(t, s.InsertOrUpdateRosterNotification(ctx, &model.RosterNotification{User: "romeo", Contact: "ortuman"}))
+
+	approve := func(tx Storage) error {
+		if err := tx.DeleteRosterNotification(ctx, "romeo", "ortuman"); err != nil {
+			return err
+		}
+		if err := tx.InsertOrUpdateRosterItem(ctx, &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "from"}); err != nil {
+			return err
+		}
+		// reads within a transaction see its own writes
+		ris, err := tx.FetchRosterItems(ctx, "ortuman")
+		if err != nil {
+			return err
+		}
+		require.Equal(t, 1, len(ris))
+		return nil
+	}
+	err := s.InTransaction(ctx, func(tx Storage) error {
+		if err := approve(tx); err != nil {
+			return err
+		}
+		return errRollback
+	})
+	require.Equal(t, errRollback, err)
+
+	rns, err := s.FetchRosterNotifications(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rns))
+	ris, err := s.FetchRosterItems(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ris))
+	rv, err := s.FetchRosterVersion(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, rv.Ver)
+
+	// nested transactions join the enclosing one
+	require.Nil(t, s.InTransaction(ctx, func(tx Storage) error {
+		return tx.InTransaction(ctx, approve)
+	}))
+	rns, err = s.FetchRosterNotifications(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(rns))
+	ris, err = s.FetchRosterItems(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ris))
+	require.Equal(t, "from", ris[0].Subscription)
+}
+
+// testBatchedQueries checks that batched operations
+// yield the same results as their per-row counterparts.
+func testBatchedQueries(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	var messages []xml.Element
+	for i := 0; i < 3; i++ {
+		m := xml.NewElementName("message")
+		m.SetID(fmt.Sprintf("message-%d", i))
+		m.AppendElement(xml.NewElementName("body"))
+		messages = append(messages, m)
+	}
+	for _, m := range messages {
+		require.Nil(t, s.InsertOfflineMessage(ctx, m, "ortuman"))
+	}
+	require.Nil(t, s.InsertOfflineMessages(ctx, messages, "romeo"))
+	require.Nil(t, s.InsertOfflineMessages(ctx, nil, "juliet"))
+
+	perRow, err := s.FetchOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	batched, err := s.FetchOfflineMessages(ctx, "romeo")
+	require.Nil(t, err)
+	require.Equal(t, len(messages), len(batched))
+	for i := range perRow {
+		require.Equal(t, perRow[i].Message.String(), batched[i].Message.String())
+	}
+	cnt, err := s.CountOfflineMessages(ctx, "juliet")
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+
+	for _, contact := range []string{"romeo", "juliet", "noelia"} {
+		require.Nil(t, s.InsertOrUpdateRosterItem(ctx, &model.RosterItem{User: "ortuman", Contact: contact, Subscription: "both"}))
+	}
+	require.Nil(t, s.InsertOrUpdateRosterItem(ctx, &model.RosterItem{User: "romeo", Contact: "ortuman", Subscription: "both"}))
+
+	users := []string{"ortuman", "romeo", "juliet"}
+	riMap, err := s.FetchRosterItemsOfUsers(ctx, users)
+	require.Nil(t, err)
+	for _, user := range users {
+		ris, err := s.FetchRosterItems(ctx, user)
+		require.Nil(t, err)
+		require.Equal(t, len(ris), len(riMap[user]))
+		for i := range ris {
+			require.Equal(t, ris[i].Contact, riMap[user][i].Contact)
+			require.Equal(t, ris[i].Ver, riMap[user][i].Ver)
+		}
+	}
+	_, ok := riMap["juliet"]
+	require.False(t, ok)
+
+	riMap, err = s.FetchRosterItemsOfUsers(ctx, nil)
+	require.Nil(t, err)
+	require.Equal(t, 0, len(riMap))
+}
+
+func testCappedOfflineQueue(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	insert := func(id string, dropOldest bool) bool {
+		inserted, err := s.InsertCappedOfflineMessage(ctx, xml.NewMessageType(id, xml.NormalType), "ortuman", 3, dropOldest)
+		require.Nil(t, err)
+		return inserted
+	}
+	for _, id := range []string{"a", "b", "c"} {
+		require.True(t, insert(id, false))
+	}
+	require.False(t, insert("d", false))
+
+	require.True(t, insert("e", true))
+	require.True(t, insert("f", true))
+
+	msgs, err := s.FetchOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(msgs))
+	for i, id := range []string{"c", "e", "f"} {
+		require.Equal(t, id, msgs[i].Message.ID())
+	}
+	// queues already exceeding capacity get trimmed down
+	require.Nil(t, s.InsertOfflineMessage(ctx, xml.NewMessageType("g", xml.NormalType), "ortuman"))
+	inserted, err := s.InsertCappedOfflineMessage(ctx, xml.NewMessageType("h", xml.NormalType), "ortuman", 2, true)
+	require.Nil(t, err)
+	require.True(t, inserted)
+
+	msgs, err = s.FetchOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "g", msgs[0].Message.ID())
+	require.Equal(t, "h", msgs[1].Message.ID())
+}
+
+func testOfflineMessageExpiry(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b"} {
+		require.Nil(t, s.InsertOfflineMessage(ctx, xml.NewMessageType(id, xml.NormalType), "ortuman"))
+	}
+	require.Nil(t, s.InsertOfflineMessage(ctx, xml.NewMessageType("c", xml.NormalType), "romeo"))
+
+	msgs, err := s.FetchOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msgs))
+	for _, msg := range msgs {
+		// receipt times are kept with a one second precision
+		require.True(t, time.Since(msg.ReceivedAt) < time.Minute)
+		require.False(t, msg.ReceivedAt.After(time.Now()))
+	}
+	n, err := s.DeleteExpiredOfflineMessages(ctx, msgs[0].ReceivedAt.Add(-time.Second))
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	n, err = s.DeleteExpiredOfflineMessages(ctx, time.Now().Add(time.Second))
+	require.Nil(t, err)
+	require.Equal(t, 3, n)
+
+	cnt, err := s.CountOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+	cnt, err = s.CountOfflineMessages(ctx, "romeo")
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+
+	// queues remain usable once emptied
+	require.Nil(t, s.InsertOfflineMessage(ctx, xml.NewMessageType("d", xml.NormalType), "ortuman"))
+	msgs, err = s.FetchOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, "d", msgs[0].Message.ID())
+}
+
+func testOfflineMessageNodes(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.Nil(t, s.InsertOfflineMessage(ctx, xml.NewMessageType(id, xml.NormalType), "ortuman"))
+	}
+	require.Nil(t, s.InsertOfflineMessage(ctx, xml.NewMessageType("d", xml.NormalType), "romeo"))
+
+	msgs, err := s.FetchOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 3, len(msgs))
+	nodes := map[string]bool{}
+	for _, msg := range msgs {
+		require.NotEqual(t, "", msg.Node)
+		nodes[msg.Node] = true
+	}
+	require.Equal(t, 3, len(nodes))
+
+	msg, err := s.FetchOfflineMessage(ctx, "ortuman", msgs[1].Node)
+	require.Nil(t, err)
+	require.NotNil(t, msg)
+	require.Equal(t, "b", msg.Message.ID())
+	require.Equal(t, msgs[1].Node, msg.Node)
+
+	// nodes are scoped to their user's queue
+	msg, err = s.FetchOfflineMessage(ctx, "romeo", msgs[1].Node)
+	require.Nil(t, err)
+	require.Nil(t, msg)
+	deleted, err := s.DeleteOfflineMessage(ctx, "romeo", msgs[1].Node)
+	require.Nil(t, err)
+	require.False(t, deleted)
+
+	msg, err = s.FetchOfflineMessage(ctx, "ortuman", "unknown")
+	require.Nil(t, err)
+	require.Nil(t, msg)
+
+	deleted, err = s.DeleteOfflineMessage(ctx, "ortuman", msgs[1].Node)
+	require.Nil(t, err)
+	require.True(t, deleted)
+	deleted, err = s.DeleteOfflineMessage(ctx, "ortuman", msgs[1].Node)
+	require.Nil(t, err)
+	require.False(t, deleted)
+
+	// remaining nodes are stable
+	remaining, err := s.FetchOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(remaining))
+	require.Equal(t, msgs[0].Node, remaining[0].Node)
+	require.Equal(t, "a", remaining[0].Message.ID())
+	require.Equal(t, msgs[2].Node, remaining[1].Node)
+	require.Equal(t, "c", remaining[1].Message.ID())
+
+	for _, msg := range remaining {
+		deleted, err = s.DeleteOfflineMessage(ctx, "ortuman", msg.Node)
+		require.Nil(t, err)
+		require.True(t, deleted)
+	}
+	cnt, err := s.CountOfflineMessages(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+	cnt, err = s.CountOfflineMessages(ctx, "romeo")
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+}
+
+func testTenantIsolation(t *testing.T, a, b Storage) {
+	require.Nil(t, a.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+
+	ok, err := b.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.False(t, ok)
+	cnt, err := b.CountUsers(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 0, cnt)
+
+	// same username does not conflict across tenants
+	require.Nil(t, b.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "abcd"}))
+	usr, err := a.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, "1234", usr.Password)
+	usr, err = b.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, "abcd", usr.Password)
+
+	require.Nil(t, a.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "noelia", Subscription: "none"}))
+	ris, err := b.FetchRosterItems(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(ris))
+	rv, err := b.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, model.RosterVersion{}, rv)
+
+	vCard := xml.NewElementNamespace("vCard", "vcard-temp")
+	require.Nil(t, a.InsertOrUpdateVCard(context.Background(), vCard, "ortuman"))
+	elem, err := b.FetchVCard(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Nil(t, elem)
+
+	require.Nil(t, a.InsertOfflineMessage(context.Background(), xml.NewElementName("message"), "ortuman"))
+	n, err := b.CountOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 0, n)
+
+	// deleting a tenant user leaves the other tenants untouched
+	require.Nil(t, b.DeleteUser(context.Background(), "ortuman"))
+	ok, err = a.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.True(t, ok)
+	ris, err = a.FetchRosterItems(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(ris))
+	n, err = a.CountOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	require.Nil(t, a.DeleteUser(context.Background(), "ortuman"))
+}
+
+func testMessageArchive(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	stamp := time.Unix(1530000000, 0)
+	var ids []string
+	for i, with := range []string{"noelia@jackal.im/garden", "romeo@jackal.im/orchard", "noelia@jackal.im/balcony", "noelia@jackal.im/garden"} {
+		withJID, _ := xml.NewJIDString(with, true)
+		am := model.ArchivedMessage{
+			Username:     "ortuman",
+			With:         withJID.ToBareJID().String(),
+			WithResource: withJID.Resource(),
+			Stamp:        stamp.Add(time.Duration(i) * time.Minute),
+			Message:      xml.NewMessageType(fmt.Sprintf("m%d", i), xml.ChatType),
+		}
+		require.Nil(t, s.InsertArchivedMessage(ctx, &am))
+		require.NotEqual(t, "", am.ID)
+		ids = append(ids, am.ID)
+	}
+	require.Nil(t, s.InsertArchivedMessage(ctx, &model.ArchivedMessage{
+		Username: "romeo",
+		With:     "ortuman@jackal.im",
+		Stamp:    stamp,
+		Message:  xml.NewMessageType("r0", xml.ChatType),
+	}))
+
+	requireIDs := func(filter *ArchiveFilter, expected ...string) {
+		msgs, err := s.FetchArchivedMessages(ctx, "ortuman", filter)
+		require.Nil(t, err)
+		var msgIDs []string
+		for _, msg := range msgs {
+			msgIDs = append(msgIDs, msg.Message.ID())
+		}
+		require.Equal(t, expected, msgIDs)
+	}
+	requireIDs(&ArchiveFilter{}, "m0", "m1", "m2", "m3")
+	requireIDs(&ArchiveFilter{With: "noelia@jackal.im"}, "m0", "m2", "m3")
+	requireIDs(&ArchiveFilter{With: "noelia@jackal.im", WithResource: "garden"}, "m0", "m3")
+	requireIDs(&ArchiveFilter{Start: stamp.Add(time.Minute), End: stamp.Add(2 * time.Minute)}, "m1", "m2")
+	requireIDs(&ArchiveFilter{AfterID: ids[0], BeforeID: ids[3]}, "m1", "m2")
+	requireIDs(&ArchiveFilter{Max: 2}, "m0", "m1")
+	requireIDs(&ArchiveFilter{Max: 2, Last: true}, "m2", "m3")
+	requireIDs(&ArchiveFilter{BeforeID: ids[3], Max: 2, Last: true}, "m1", "m2")
+	requireIDs(&ArchiveFilter{AfterID: "unknown"})
+
+	msgs, err := s.FetchArchivedMessages(ctx, "ortuman", &ArchiveFilter{Max: 1})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Equal(t, ids[0], msgs[0].ID)
+	require.Equal(t, "ortuman", msgs[0].Username)
+	require.Equal(t, "noelia@jackal.im", msgs[0].With)
+	require.Equal(t, "garden", msgs[0].WithResource)
+	require.Equal(t, stamp.Unix(), msgs[0].Stamp.Unix())
+
+	// preferences
+	prefs, err := s.FetchArchivePrefs(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Nil(t, prefs)
+	require.Nil(t, s.InsertOrUpdateArchivePrefs(ctx, &model.ArchivePrefs{Username: "ortuman", Default: "roster"}))
+	require.Nil(t, s.InsertOrUpdateArchivePrefs(ctx, &model.ArchivePrefs{Username: "ortuman", Default: "never"}))
+	prefs, err = s.FetchArchivePrefs(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, &model.ArchivePrefs{Username: "ortuman", Default: "never"}, prefs)
+
+	// archive goes along with its owner
+	require.Nil(t, s.DeleteUser(ctx, "ortuman"))
+	requireIDs(&ArchiveFilter{})
+	prefs, err = s.FetchArchivePrefs(ctx, "ortuman")
+	require.Nil(t, err)
+	require.Nil(t, prefs)
+
+	msgs, err = s.FetchArchivedMessages(ctx, "romeo", &ArchiveFilter{})
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+}
+
+func testBlockList(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	requireJIDs := func(username string, expected ...string) {
+		blis, err := s.FetchBlockListItems(ctx, username)
+		require.Nil(t, err)
+		var jids []string
+		for _, bli := range blis {
+			require.Equal(t, username, bli.Username)
+			jids = append(jids, bli.JID)
+		}
+		sort.Strings(expected)
+		sort.Strings(jids)
+		require.Equal(t, expected, jids)
+	}
+	requireJIDs("ortuman")
+
+	require.Nil(t, s.InsertBlockListItems(ctx, []model.BlockListItem{
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "jabber.org"},
+		{Username: "noelia", JID: "romeo@jackal.im/balcony"},
+	}))
+	// already blocked items are ignored
+	require.Nil(t, s.InsertBlockListItems(ctx, []model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}}))
+	requireJIDs("ortuman", "romeo@jackal.im", "jabber.org")
+	requireJIDs("noelia", "romeo@jackal.im/balcony")
+
+	// as well as not blocked ones on deletion
+	require.Nil(t, s.DeleteBlockListItems(ctx, []model.BlockListItem{
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "tybalt@jackal.im"},
+	}))
+	requireJIDs("ortuman", "jabber.org")
+	requireJIDs("noelia", "romeo@jackal.im/balcony")
+
+	require.Nil(t, s.InsertBlockListItems(ctx, nil))
+	require.Nil(t, s.DeleteBlockListItems(ctx, nil))
+	requireJIDs("ortuman", "jabber.org")
+}
+
+func testPrivacyLists(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	requireLists := func(username string, expected ...model.PrivacyList) {
+		pls, err := s.FetchPrivacyLists(ctx, username)
+		require.Nil(t, err)
+		require.Equal(t, len(expected), len(pls))
+		for i := range expected {
+			require.Equal(t, expected[i], pls[i])
+		}
+	}
+	requireLists("ortuman")
+
+	public := model.PrivacyList{
+		Username: "ortuman",
+		Name:     "public",
+		Items: []model.PrivacyListItem{
+			{Type: "subscription", Value: "none", Action: "deny", Order: 20, Message: true},
+			{Type: "jid", Value: "romeo@jackal.im", Action: "allow", Order: 10},
+		},
+	}
+	invisible := model.PrivacyList{
+		Username: "ortuman",
+		Name:     "invisible",
+		Items: []model.PrivacyListItem{
+			{Type: "group", Value: "friends", Action: "allow", Order: 1, PresenceOut: true},
+			{Action: "deny", Order: 2, PresenceOut: true},
+		},
+	}
+	// default flag is ignored on insertion
+	invisible.Default = true
+	require.Nil(t, s.InsertOrUpdatePrivacyList(ctx, &public))
+	require.Nil(t, s.InsertOrUpdatePrivacyList(ctx, &invisible))
+	require.Nil(t, s.InsertOrUpdatePrivacyList(ctx, &model.PrivacyList{
+		Username: "noelia",
+		Name:     "public",
+		Items:    []model.PrivacyListItem{{Action: "allow", Order: 1}},
+	}))
+	invisible.Default = false
+
+	// items are sorted by order
+	sortedPublic := public
+	sortedPublic.Items = []model.PrivacyListItem{public.Items[1], public.Items[0]}
+	requireLists("ortuman", invisible, sortedPublic)
+
+	require.Nil(t, s.SetDefaultPrivacyList(ctx, "ortuman", "public"))
+	sortedPublic.Default = true
+	requireLists("ortuman", invisible, sortedPublic)
+
+	// default list is kept on update
+	public.Items = []model.PrivacyListItem{{Action: "deny", Order: 5, IQ: true, PresenceIn: true}}
+	require.Nil(t, s.InsertOrUpdatePrivacyList(ctx, &public))
+	public.Default = true
+	requireLists("ortuman", invisible, public)
+
+	require.Nil(t, s.SetDefaultPrivacyList(ctx, "ortuman", "invisible"))
+	invisible.Default = true
+	public.Default = false
+	requireLists("ortuman", invisible, public)
+
+	// deleting default list leaves user with no default one
+	require.Nil(t, s.DeletePrivacyList(ctx, "ortuman", "invisible"))
+	require.Nil(t, s.InsertOrUpdatePrivacyList(ctx, &invisible))
+	invisible.Default = false
+	requireLists("ortuman", invisible, public)
+
+	require.Nil(t, s.SetDefaultPrivacyList(ctx, "ortuman", "public"))
+	require.Nil(t, s.SetDefaultPrivacyList(ctx, "ortuman", ""))
+	requireLists("ortuman", invisible, public)
+
+	// not existing lists can't be the default one
+	require.Nil(t, s.SetDefaultPrivacyList(ctx, "ortuman", "private"))
+	private := model.PrivacyList{Username: "ortuman", Name: "private", Items: []model.PrivacyListItem{{Action: "deny", Order: 1}}}
+	require.Nil(t, s.InsertOrUpdatePrivacyList(ctx, &private))
+	requireLists("ortuman", invisible, private, public)
+
+	require.Nil(t, s.DeletePrivacyList(ctx, "ortuman", "public"))
+	require.Nil(t, s.DeletePrivacyList(ctx, "ortuman", "unknown"))
+	requireLists("ortuman", invisible, private)
+	requireLists("noelia", model.PrivacyList{
+		Username: "noelia",
+		Name:     "public",
+		Items:    []model.PrivacyListItem{{Action: "allow", Order: 1}},
+	})
+}
+
+func testStreamSessions(t *testing.T, s Storage) {
+	ctx := context.Background()
+
+	sessions, err := s.FetchStreamSessions(ctx, "default")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(sessions))
+
+	presence := xml.NewElementName("presence")
+	msg := xml.NewElementName("message")
+	msg.SetID("m1")
+	expiresAt := time.Unix(time.Now().Add(time.Minute).Unix(), 0)
+
+	require.Nil(t, s.InsertStreamSession(ctx, &model.StreamSession{
+		ID: "abcd", ServerID: "default", Username: "ortuman", Domain: "jackal.im", Resource: "balcony", Inbound: 2,
+	}))
+	// same identifier replaces a previously persisted session
+	require.Nil(t, s.InsertStreamSession(ctx, &model.StreamSession{
+		ID: "abcd", ServerID: "default", Username: "ortuman", Domain: "jackal.im", Resource: "balcony",
+		Inbound: 3, Acked: 1, Presence: presence, Unacked: []xml.Element{msg}, ExpiresAt: expiresAt,
+	}))
+	require.Nil(t, s.InsertStreamSession(ctx, &model.StreamSession{ID: "efgh", ServerID: "default", Username: "noelia", Domain: "jackal.im", Resource: "garden"}))
+	require.Nil(t, s.InsertStreamSession(ctx, &model.StreamSession{ID: "abcd", ServerID: "secondary", Username: "romeo", Domain: "jackal.im", Resource: "orchard"}))
+
+	sessions, err = s.FetchStreamSessions(ctx, "default")
+	require.Nil(t, err)
+	require.Equal(t, 2, len(sessions))
+	sort.Slice(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+
+	ss := sessions[0]
+	require.Equal(t, "abcd", ss.ID)
+	require.Equal(t, "default", ss.ServerID)
+	require.Equal(t, "ortuman", ss.Username)
+	require.Equal(t, "balcony", ss.Resource)
+	require.Equal(t, uint32(3), ss.Inbound)
+	require.Equal(t, uint32(1), ss.Acked)
+	require.True(t, expiresAt.Equal(ss.ExpiresAt))
+	require.NotNil(t, ss.Presence)
+	require.Equal(t, presence.String(), ss.Presence.String())
+	require.Equal(t, 1, len(ss.Unacked))
+	require.Equal(t, msg.String(), ss.Unacked[0].String())
+	require.Equal(t, "efgh", sessions[1].ID)
+	require.Nil(t, sessions[1].Presence)
+
+	// deletion is scoped to the server configuration
+	require.Nil(t, s.DeleteStreamSessions(ctx, "default"))
+	sessions, err = s.FetchStreamSessions(ctx, "default")
+	require.Nil(t, err)
+	require.Equal(t, 0, len(sessions))
+	sessions, err = s.FetchStreamSessions(ctx, "secondary")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sessions))
+	require.Equal(t, "romeo", sessions[0].Username)
+}
@@ -0,0 +1,295 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package encrypted implements a storage decorator encrypting
+// payload bearing entities at rest, that is, private XML, vCards,
+// offline, quarantined and archived messages, along with the presence
+// and unacknowledged stanzas of persisted stream sessions.
+//
+// Payloads are encrypted using AES-GCM with a data key held in a keyring,
+// persisted wrapped by a master key the storage administrator doesn't hold.
+// Every other field (usernames, JIDs, namespaces...) is stored in plain
+// text so that it remains indexable.
+package encrypted
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"strings"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+const envelopeNamespace = "urn:jackal:storage:encrypted:0"
+
+// Storage represents a payload encrypting storage decorator.
+type Storage struct {
+	storage.Storage
+	kr *KeyRing
+}
+
+// New returns a storage decorator encrypting s payloads using kr data keys.
+func New(s storage.Storage, kr *KeyRing) *Storage {
+	return &Storage{Storage: s, kr: kr}
+}
+
+// InsertOrUpdateVCard satisfies storage.Storage interface.
+func (s *Storage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	envelope, err := s.encrypt(vCard)
+	if err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdateVCard(ctx, envelope, username)
+}
+
+// FetchVCard satisfies storage.Storage interface.
+func (s *Storage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	envelope, err := s.Storage.FetchVCard(ctx, username)
+	if err != nil || envelope == nil {
+		return envelope, err
+	}
+	return s.decrypt(envelope)
+}
+
+// InsertOrUpdatePrivateXML satisfies storage.Storage interface.
+func (s *Storage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
+	envelopes, err := s.encryptAll(privateXML)
+	if err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdatePrivateXML(ctx, envelopes, namespace, username)
+}
+
+// FetchPrivateXML satisfies storage.Storage interface.
+func (s *Storage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	envelopes, err := s.Storage.FetchPrivateXML(ctx, namespace, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(envelopes)
+}
+
+// InsertOfflineMessage satisfies storage.Storage interface.
+func (s *Storage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	envelope, err := s.encrypt(message)
+	if err != nil {
+		return err
+	}
+	return s.Storage.InsertOfflineMessage(ctx, envelope, username)
+}
+
+// InsertOfflineMessages satisfies storage.Storage interface.
+func (s *Storage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	envelopes := make([]xml.Element, 0, len(messages))
+	for _, message := range messages {
+		envelope, err := s.encrypt(message)
+		if err != nil {
+			return err
+		}
+		envelopes = append(envelopes, envelope)
+	}
+	return s.Storage.InsertOfflineMessages(ctx, envelopes, username)
+}
+
+// InsertCappedOfflineMessage satisfies storage.Storage interface.
+func (s *Storage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	envelope, err := s.encrypt(message)
+	if err != nil {
+		return false, err
+	}
+	return s.Storage.InsertCappedOfflineMessage(ctx, envelope, username, capacity, dropOldest)
+}
+
+// FetchOfflineMessages satisfies storage.Storage interface.
+func (s *Storage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	msgs, err := s.Storage.FetchOfflineMessages(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		msg, err := s.decrypt(msgs[i].Message)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i].Message = msg
+	}
+	return msgs, nil
+}
+
+// FetchOfflineMessage satisfies storage.Storage interface.
+func (s *Storage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	m, err := s.Storage.FetchOfflineMessage(ctx, username, node)
+	if err != nil || m == nil {
+		return nil, err
+	}
+	msg, err := s.decrypt(m.Message)
+	if err != nil {
+		return nil, err
+	}
+	m.Message = msg
+	return m, nil
+}
+
+// InsertQuarantinedMessage satisfies storage.Storage interface.
+func (s *Storage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	envelope, err := s.encrypt(message)
+	if err != nil {
+		return err
+	}
+	return s.Storage.InsertQuarantinedMessage(ctx, envelope, username)
+}
+
+// FetchQuarantinedMessages satisfies storage.Storage interface.
+func (s *Storage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	envelopes, err := s.Storage.FetchQuarantinedMessages(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	return s.decryptAll(envelopes)
+}
+
+// InsertArchivedMessage satisfies storage.Storage interface.
+func (s *Storage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	envelope, err := s.encrypt(message.Message)
+	if err != nil {
+		return err
+	}
+	m := *message
+	m.Message = envelope
+	if err := s.Storage.InsertArchivedMessage(ctx, &m); err != nil {
+		return err
+	}
+	message.ID = m.ID
+	return nil
+}
+
+// FetchArchivedMessages satisfies storage.Storage interface.
+func (s *Storage) FetchArchivedMessages(ctx context.Context, username string, filter *storage.ArchiveFilter) ([]model.ArchivedMessage, error) {
+	msgs, err := s.Storage.FetchArchivedMessages(ctx, username, filter)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		msg, err := s.decrypt(msgs[i].Message)
+		if err != nil {
+			return nil, err
+		}
+		msgs[i].Message = msg
+	}
+	return msgs, nil
+}
+
+// InsertStreamSession satisfies storage.Storage interface.
+func (s *Storage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	ss := *session
+	if ss.Presence != nil {
+		envelope, err := s.encrypt(ss.Presence)
+		if err != nil {
+			return err
+		}
+		ss.Presence = envelope
+	}
+	unacked, err := s.encryptAll(ss.Unacked)
+	if err != nil {
+		return err
+	}
+	ss.Unacked = unacked
+	return s.Storage.InsertStreamSession(ctx, &ss)
+}
+
+// FetchStreamSessions satisfies storage.Storage interface.
+func (s *Storage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	sessions, err := s.Storage.FetchStreamSessions(ctx, serverID)
+	if err != nil {
+		return nil, err
+	}
+	for i := range sessions {
+		if sessions[i].Presence != nil {
+			presence, err := s.decrypt(sessions[i].Presence)
+			if err != nil {
+				return nil, err
+			}
+			sessions[i].Presence = presence
+		}
+		unacked, err := s.decryptAll(sessions[i].Unacked)
+		if err != nil {
+			return nil, err
+		}
+		sessions[i].Unacked = unacked
+	}
+	return sessions, nil
+}
+
+// InTransaction satisfies storage.Storage interface.
+func (s *Storage) InTransaction(ctx context.Context, f func(tx storage.Storage) error) error {
+	return s.Storage.InTransaction(ctx, func(tx storage.Storage) error {
+		// payloads must be encrypted within transactions as well
+		return f(&Storage{Storage: tx, kr: s.kr})
+	})
+}
+
+// encrypt returns an envelope element carrying elem encrypted with the active data key.
+func (s *Storage) encrypt(elem xml.Element) (xml.Element, error) {
+	ciphertext, err := seal(s.kr.keys[s.kr.active], []byte(elem.String()), []byte(s.kr.active))
+	if err != nil {
+		return nil, err
+	}
+	envelope := xml.NewElementNamespace("encrypted", envelopeNamespace)
+	envelope.SetAttribute("key", s.kr.active)
+	envelope.SetText(base64.StdEncoding.EncodeToString(ciphertext))
+	return envelope, nil
+}
+
+// decrypt returns the element carried by an envelope.
+// Elements stored before enabling encryption are returned untouched.
+func (s *Storage) decrypt(envelope xml.Element) (xml.Element, error) {
+	if envelope.Name() != "encrypted" || envelope.Namespace() != envelopeNamespace {
+		return envelope, nil
+	}
+	keyID := envelope.Attribute("key")
+	key, ok := s.kr.keys[keyID]
+	if !ok {
+		return nil, fmt.Errorf("encrypted: data key %s not found", keyID)
+	}
+	ciphertext, err := base64.StdEncoding.DecodeString(envelope.Text())
+	if err != nil {
+		return nil, err
+	}
+	plaintext, err := open(key, ciphertext, []byte(keyID))
+	if err != nil {
+		return nil, err
+	}
+	return xml.NewParser(strings.NewReader(string(plaintext))).ParseElement()
+}
+
+func (s *Storage) encryptAll(elems []xml.Element) ([]xml.Element, error) {
+	envelopes := make([]xml.Element, len(elems))
+	for i, elem := range elems {
+		envelope, err := s.encrypt(elem)
+		if err != nil {
+			return nil, err
+		}
+		envelopes[i] = envelope
+	}
+	return envelopes, nil
+}
+
+func (s *Storage) decryptAll(envelopes []xml.Element) ([]xml.Element, error) {
+	if envelopes == nil {
+		return nil, nil
+	}
+	elems := make([]xml.Element, len(envelopes))
+	for i, envelope := range envelopes {
+		elem, err := s.decrypt(envelope)
+		if err != nil {
+			return nil, err
+		}
+		elems[i] = elem
+	}
+	return elems, nil
+}
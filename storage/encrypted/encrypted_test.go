@@ -0,0 +1,174 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package encrypted
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestEncrypted_RoundTrip(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	dir, err := ioutil.TempDir("", "jackal_encrypted")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	masterKey := randomKey(t)
+	kr, err := OpenKeyRing(path, masterKey)
+	require.Nil(t, err)
+
+	underlying := storage.Instance()
+	s := New(underlying, kr)
+
+	vCard := xml.NewElementNamespace("vCard", "vcard-temp")
+	fn := xml.NewElementName("FN")
+	fn.SetText("Miguel Ángel Ortuño")
+	vCard.AppendElement(fn)
+
+	prv := xml.NewElementNamespace("exodus", "exodus:ns")
+	prv.SetText("s3cr3t bookmarks")
+
+	msg := xml.NewElementName("message")
+	msg.SetAttribute("from", "noelia@jackal.im/balcony")
+	body := xml.NewElementName("body")
+	body.SetText("hi there!")
+	msg.AppendElement(body)
+
+	require.Nil(t, s.InsertOrUpdateVCard(context.Background(), vCard, "ortuman"))
+	require.Nil(t, s.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{prv}, "exodus:ns", "ortuman"))
+	require.Nil(t, s.InsertOfflineMessage(context.Background(), msg, "ortuman"))
+	require.Nil(t, s.InsertQuarantinedMessage(context.Background(), msg, "ortuman"))
+	archived := model.ArchivedMessage{Username: "ortuman", With: "noelia@jackal.im", Message: msg}
+	require.Nil(t, s.InsertArchivedMessage(context.Background(), &archived))
+	require.NotEmpty(t, archived.ID)
+	require.Equal(t, msg, archived.Message)
+	presence := xml.NewElementName("presence")
+	status := xml.NewElementName("status")
+	status.SetText("s3cr3t status")
+	presence.AppendElement(status)
+	session := model.StreamSession{ID: "abcd", ServerID: "default", Username: "ortuman", Presence: presence, Unacked: []xml.Element{msg}}
+	require.Nil(t, s.InsertStreamSession(context.Background(), &session))
+	require.Equal(t, msg, session.Unacked[0])
+
+	// underlying storage only holds envelopes
+	stored, _ := underlying.FetchVCard(context.Background(), "ortuman")
+	requireEnvelope(t, stored, "Ortuño")
+	storedPrv, _ := underlying.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
+	require.Equal(t, 1, len(storedPrv))
+	requireEnvelope(t, storedPrv[0], "s3cr3t")
+	storedOffline, _ := underlying.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 1, len(storedOffline))
+	requireEnvelope(t, storedOffline[0].Message, "hi there!")
+	storedMsgs, _ := underlying.FetchQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, 1, len(storedMsgs))
+	requireEnvelope(t, storedMsgs[0], "hi there!")
+	storedArchived, _ := underlying.FetchArchivedMessages(context.Background(), "ortuman", &storage.ArchiveFilter{})
+	require.Equal(t, 1, len(storedArchived))
+	requireEnvelope(t, storedArchived[0].Message, "hi there!")
+	storedSessions, _ := underlying.FetchStreamSessions(context.Background(), "default")
+	require.Equal(t, 1, len(storedSessions))
+	requireEnvelope(t, storedSessions[0].Presence, "s3cr3t status")
+	require.Equal(t, 1, len(storedSessions[0].Unacked))
+	requireEnvelope(t, storedSessions[0].Unacked[0], "hi there!")
+
+	requireRoundTrip := func(s *Storage) {
+		v, err := s.FetchVCard(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, vCard.String(), v.String())
+
+		prvs, err := s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(prvs))
+		require.Equal(t, prv.String(), prvs[0].String())
+
+		offline, err := s.FetchOfflineMessages(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(offline))
+		require.Equal(t, msg.String(), offline[0].Message.String())
+		require.Equal(t, storedOffline[0].ReceivedAt, offline[0].ReceivedAt)
+
+		msgs, err := s.FetchQuarantinedMessages(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(msgs))
+		require.Equal(t, msg.String(), msgs[0].String())
+
+		archivedMsgs, err := s.FetchArchivedMessages(context.Background(), "ortuman", &storage.ArchiveFilter{With: "noelia@jackal.im"})
+		require.Nil(t, err)
+		require.Equal(t, 1, len(archivedMsgs))
+		require.Equal(t, archived.ID, archivedMsgs[0].ID)
+		require.Equal(t, msg.String(), archivedMsgs[0].Message.String())
+
+		sessions, err := s.FetchStreamSessions(context.Background(), "default")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(sessions))
+		require.Equal(t, presence.String(), sessions[0].Presence.String())
+		require.Equal(t, 1, len(sessions[0].Unacked))
+		require.Equal(t, msg.String(), sessions[0].Unacked[0].String())
+	}
+	requireRoundTrip(s)
+
+	// stored payloads remain readable after rotating master key
+	newMasterKey := randomKey(t)
+	require.Nil(t, RewrapKeyRing(path, masterKey, newMasterKey))
+	kr2, err := OpenKeyRing(path, newMasterKey)
+	require.Nil(t, err)
+	requireRoundTrip(New(underlying, kr2))
+
+	// non existing entities
+	v, err := s.FetchVCard(context.Background(), "noelia")
+	require.Nil(t, err)
+	require.Nil(t, v)
+	msgs, err := s.FetchOfflineMessages(context.Background(), "noelia")
+	require.Nil(t, err)
+	require.Nil(t, msgs)
+}
+
+func TestEncrypted_PlainTextPassthrough(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	dir, err := ioutil.TempDir("", "jackal_encrypted")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	kr, err := OpenKeyRing(filepath.Join(dir, "keyring.json"), randomKey(t))
+	require.Nil(t, err)
+
+	// stored before enabling encryption
+	vCard := xml.NewElementNamespace("vCard", "vcard-temp")
+	require.Nil(t, storage.Instance().InsertOrUpdateVCard(context.Background(), vCard, "ortuman"))
+
+	s := New(storage.Instance(), kr)
+	v, err := s.FetchVCard(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, vCard.String(), v.String())
+
+	// unknown data key
+	envelope := xml.NewElementNamespace("encrypted", envelopeNamespace)
+	envelope.SetAttribute("key", "unknown")
+	require.Nil(t, storage.Instance().InsertOrUpdateVCard(context.Background(), envelope, "ortuman"))
+	_, err = s.FetchVCard(context.Background(), "ortuman")
+	require.NotNil(t, err)
+}
+
+func requireEnvelope(t *testing.T, elem xml.Element, plaintext string) {
+	require.NotNil(t, elem)
+	require.Equal(t, "encrypted", elem.Name())
+	require.Equal(t, envelopeNamespace, elem.Namespace())
+	require.NotContains(t, elem.String(), plaintext)
+}
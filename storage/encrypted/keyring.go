@@ -0,0 +1,208 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package encrypted
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/pborman/uuid"
+)
+
+// keySize is the size in bytes of both master and data keys (AES-256).
+const keySize = 32
+
+// ErrInvalidMasterKey is returned whenever keyring data keys can't be unwrapped using the master key.
+var ErrInvalidMasterKey = errors.New("encrypted: invalid master key")
+
+// LoadMasterKey reads the master key from the source specified in cfg.
+func LoadMasterKey(cfg *config.StorageEncryption) ([]byte, error) {
+	var encoded string
+	switch {
+	case len(cfg.MasterKey) > 0:
+		encoded = cfg.MasterKey
+
+	case len(cfg.MasterKeyFile) > 0:
+		b, err := ioutil.ReadFile(cfg.MasterKeyFile)
+		if err != nil {
+			return nil, err
+		}
+		encoded = string(b)
+
+	case len(cfg.MasterKeyCommand) > 0:
+		cmd := exec.Command("sh", "-c", cfg.MasterKeyCommand)
+		stderr := new(bytes.Buffer)
+		cmd.Stderr = stderr
+		b, err := cmd.Output()
+		if err != nil {
+			return nil, fmt.Errorf("encrypted: master key command failed: %v: %s", err, strings.TrimSpace(stderr.String()))
+		}
+		encoded = string(b)
+
+	default:
+		return nil, errors.New("encrypted: master key source not specified")
+	}
+	key, err := base64.StdEncoding.DecodeString(strings.TrimSpace(encoded))
+	if err != nil {
+		return nil, fmt.Errorf("encrypted: malformed master key: %v", err)
+	}
+	if len(key) != keySize {
+		return nil, fmt.Errorf("encrypted: master key must be %d bytes long", keySize)
+	}
+	return key, nil
+}
+
+type wrappedKey struct {
+	ID         string `json:"id"`
+	WrappedKey string `json:"wrapped_key"`
+}
+
+type keyRingFile struct {
+	Active string       `json:"active"`
+	Keys   []wrappedKey `json:"keys"`
+}
+
+// KeyRing holds the data keys used to encrypt and decrypt stored payloads,
+// persisted wrapped by a master key.
+type KeyRing struct {
+	active string
+	keys   map[string][]byte
+}
+
+// OpenKeyRing reads the keyring stored at path unwrapping its data keys with masterKey.
+// If no keyring exists at path a new one holding a fresh data key is created.
+func OpenKeyRing(path string, masterKey []byte) (*KeyRing, error) {
+	f, err := readKeyRingFile(path)
+	switch {
+	case os.IsNotExist(err):
+		return createKeyRing(path, masterKey)
+	case err != nil:
+		return nil, err
+	}
+	kr := &KeyRing{active: f.Active, keys: make(map[string][]byte)}
+	for _, wk := range f.Keys {
+		wrapped, err := base64.StdEncoding.DecodeString(wk.WrappedKey)
+		if err != nil {
+			return nil, fmt.Errorf("encrypted: malformed data key %s: %v", wk.ID, err)
+		}
+		key, err := open(masterKey, wrapped, []byte(wk.ID))
+		if err != nil {
+			return nil, ErrInvalidMasterKey
+		}
+		kr.keys[wk.ID] = key
+	}
+	if _, ok := kr.keys[kr.active]; !ok {
+		return nil, fmt.Errorf("encrypted: active data key %s not found", kr.active)
+	}
+	return kr, nil
+}
+
+// RewrapKeyRing wraps again every data key of the keyring stored at path
+// using newMasterKey, so that payloads don't need to be encrypted again.
+func RewrapKeyRing(path string, masterKey, newMasterKey []byte) error {
+	kr, err := OpenKeyRing(path, masterKey)
+	if err != nil {
+		return err
+	}
+	return kr.write(path, newMasterKey)
+}
+
+func createKeyRing(path string, masterKey []byte) (*KeyRing, error) {
+	key := make([]byte, keySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	kr := &KeyRing{active: uuid.New(), keys: make(map[string][]byte)}
+	kr.keys[kr.active] = key
+	if err := kr.write(path, masterKey); err != nil {
+		return nil, err
+	}
+	return kr, nil
+}
+
+func (kr *KeyRing) write(path string, masterKey []byte) error {
+	f := keyRingFile{Active: kr.active}
+	for id, key := range kr.keys {
+		wrapped, err := seal(masterKey, key, []byte(id))
+		if err != nil {
+			return err
+		}
+		f.Keys = append(f.Keys, wrappedKey{ID: id, WrappedKey: base64.StdEncoding.EncodeToString(wrapped)})
+	}
+	sort.Slice(f.Keys, func(i, j int) bool { return f.Keys[i].ID < f.Keys[j].ID })
+	b, err := json.MarshalIndent(&f, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), os.ModePerm); err != nil {
+		return err
+	}
+	// replace keyring atomically, never leaving it half written
+	tmpPath := path + ".tmp"
+	if err := ioutil.WriteFile(tmpPath, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, path)
+}
+
+func readKeyRingFile(path string) (*keyRingFile, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var f keyRingFile
+	if err := json.Unmarshal(b, &f); err != nil {
+		return nil, fmt.Errorf("encrypted: malformed keyring %s: %v", path, err)
+	}
+	return &f, nil
+}
+
+// seal encrypts plaintext using AES-GCM, prepending the random nonce to the returned ciphertext.
+func seal(key, plaintext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plaintext)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plaintext, additionalData), nil
+}
+
+// open decrypts a ciphertext returned by seal.
+func open(key, ciphertext, additionalData []byte) ([]byte, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	if len(ciphertext) < aead.NonceSize() {
+		return nil, errors.New("encrypted: ciphertext too short")
+	}
+	nonce, sealed := ciphertext[:aead.NonceSize()], ciphertext[aead.NonceSize():]
+	return aead.Open(nil, nonce, sealed, additionalData)
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
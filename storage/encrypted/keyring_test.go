@@ -0,0 +1,108 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package encrypted
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyRing_Open(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackal_keyring")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	masterKey := randomKey(t)
+
+	kr, err := OpenKeyRing(path, masterKey)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(kr.keys))
+
+	fi, err := os.Stat(path)
+	require.Nil(t, err)
+	require.Equal(t, os.FileMode(0600), fi.Mode().Perm())
+
+	// data keys are never persisted in plain text
+	b, _ := ioutil.ReadFile(path)
+	require.NotContains(t, string(b), base64.StdEncoding.EncodeToString(kr.keys[kr.active]))
+
+	kr2, err := OpenKeyRing(path, masterKey)
+	require.Nil(t, err)
+	require.Equal(t, kr.active, kr2.active)
+	require.Equal(t, kr.keys, kr2.keys)
+
+	_, err = OpenKeyRing(path, randomKey(t))
+	require.Equal(t, ErrInvalidMasterKey, err)
+}
+
+func TestKeyRing_Rewrap(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jackal_keyring")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "keyring.json")
+	masterKey, newMasterKey := randomKey(t), randomKey(t)
+
+	kr, err := OpenKeyRing(path, masterKey)
+	require.Nil(t, err)
+
+	require.Equal(t, ErrInvalidMasterKey, RewrapKeyRing(path, newMasterKey, masterKey))
+	require.Nil(t, RewrapKeyRing(path, masterKey, newMasterKey))
+
+	_, err = OpenKeyRing(path, masterKey)
+	require.Equal(t, ErrInvalidMasterKey, err)
+
+	kr2, err := OpenKeyRing(path, newMasterKey)
+	require.Nil(t, err)
+	require.Equal(t, kr.keys, kr2.keys)
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	key := randomKey(t)
+	encoded := base64.StdEncoding.EncodeToString(key)
+
+	k, err := LoadMasterKey(&config.StorageEncryption{MasterKey: encoded})
+	require.Nil(t, err)
+	require.Equal(t, key, k)
+
+	f, err := ioutil.TempFile("", "jackal_master_key")
+	require.Nil(t, err)
+	defer os.Remove(f.Name())
+	f.WriteString(encoded + "\n")
+	f.Close()
+
+	k, err = LoadMasterKey(&config.StorageEncryption{MasterKeyFile: f.Name()})
+	require.Nil(t, err)
+	require.Equal(t, key, k)
+
+	k, err = LoadMasterKey(&config.StorageEncryption{MasterKeyCommand: "echo " + encoded})
+	require.Nil(t, err)
+	require.Equal(t, key, k)
+
+	_, err = LoadMasterKey(&config.StorageEncryption{MasterKeyCommand: "exit 1"})
+	require.NotNil(t, err)
+
+	_, err = LoadMasterKey(&config.StorageEncryption{MasterKey: "c2hvcnQ="})
+	require.NotNil(t, err)
+
+	_, err = LoadMasterKey(&config.StorageEncryption{MasterKey: "%%%"})
+	require.NotNil(t, err)
+}
+
+func randomKey(t *testing.T) []byte {
+	key := make([]byte, keySize)
+	_, err := rand.Read(key)
+	require.Nil(t, err)
+	return key
+}
@@ -0,0 +1,749 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package faulty implements a storage decorator injecting latency,
+// errors and timeouts into any storage backend, intended to evaluate
+// how the server behaves under a degraded storage.
+package faulty
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"reflect"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+// AnyOperation identifies the fault applied to every operation
+// not having its own fault configured.
+const AnyOperation = "*"
+
+var (
+	// ErrInjected is returned by operations failing due to an injected error.
+	ErrInjected = errors.New("faulty: injected error")
+
+	// ErrTimeout is returned by operations failing due to an injected timeout.
+	ErrTimeout = errors.New("faulty: injected timeout")
+)
+
+// operations contains every storage operation name.
+var operations = map[string]struct{}{}
+
+func init() {
+	tp := reflect.TypeOf((*storage.Storage)(nil)).Elem()
+	for i := 0; i < tp.NumMethod(); i++ {
+		operations[tp.Method(i).Name] = struct{}{}
+	}
+}
+
+// Fault represents the faults injected into a storage operation.
+//
+// Every call gets delayed by Latency plus a uniformly distributed
+// random duration up to Jitter, failing afterwards with ErrInjected
+// with ErrorRate probability, or with ErrTimeout after an additional
+// Timeout delay with TimeoutRate probability.
+type Fault struct {
+	Latency     time.Duration
+	Jitter      time.Duration
+	ErrorRate   float64
+	TimeoutRate float64
+	Timeout     time.Duration
+}
+
+// OperationStats represents the faults injected into a storage operation so far.
+type OperationStats struct {
+	Calls    int64         `json:"calls"`
+	Errors   int64         `json:"errors"`
+	Timeouts int64         `json:"timeouts"`
+	Delay    time.Duration `json:"delay_ns"`
+}
+
+// Storage represents a fault injecting storage decorator.
+// It behaves as the wrapped storage until faults are enabled.
+type Storage struct {
+	storage.Storage
+	enabled uint32
+	mu      sync.RWMutex
+	faults  map[string]Fault
+	stats   map[string]*OperationStats
+	parent  *Storage // set on handles bound to a transaction
+}
+
+// New returns a fault injecting decorator wrapping s.
+func New(s storage.Storage) *Storage {
+	return &Storage{
+		Storage: s,
+		stats:   make(map[string]*OperationStats),
+	}
+}
+
+// Enable starts injecting faults into storage operations,
+// resetting any previously accounted stats.
+// Faults map is keyed by operation name, as in storage.Storage
+// interface methods, or AnyOperation.
+func (s *Storage) Enable(faults map[string]Fault) error {
+	for op, f := range faults {
+		if _, ok := operations[op]; !ok && op != AnyOperation {
+			return fmt.Errorf("faulty: unknown operation: %s", op)
+		}
+		if f.Latency < 0 || f.Jitter < 0 || f.Timeout < 0 {
+			return fmt.Errorf("faulty: %s: durations must be positive", op)
+		}
+		if f.ErrorRate < 0 || f.ErrorRate > 1 || f.TimeoutRate < 0 || f.TimeoutRate > 1 {
+			return fmt.Errorf("faulty: %s: rates must be within [0, 1]", op)
+		}
+	}
+	s.mu.Lock()
+	s.faults = faults
+	s.stats = make(map[string]*OperationStats)
+	s.mu.Unlock()
+	atomic.StoreUint32(&s.enabled, 1)
+	return nil
+}
+
+// Disable stops injecting faults into storage operations.
+func (s *Storage) Disable() {
+	atomic.StoreUint32(&s.enabled, 0)
+}
+
+// IsEnabled returns whether or not faults are being injected.
+func (s *Storage) IsEnabled() bool {
+	return atomic.LoadUint32(&s.enabled) == 1
+}
+
+// Stats returns per operation injected faults stats.
+func (s *Storage) Stats() map[string]OperationStats {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	ret := make(map[string]OperationStats, len(s.stats))
+	for op, st := range s.stats {
+		ret[op] = *st
+	}
+	return ret
+}
+
+type faultJSON struct {
+	Latency     string  `json:"latency,omitempty"`
+	Jitter      string  `json:"jitter,omitempty"`
+	ErrorRate   float64 `json:"error_rate,omitempty"`
+	TimeoutRate float64 `json:"timeout_rate,omitempty"`
+	Timeout     string  `json:"timeout,omitempty"`
+}
+
+type stateJSON struct {
+	Enabled bool                      `json:"enabled"`
+	Faults  map[string]faultJSON      `json:"faults"`
+	Stats   map[string]OperationStats `json:"stats,omitempty"`
+}
+
+// ServeHTTP serves fault injection admin API.
+//
+// GET returns current faults and stats, PUT enables fault injection
+// from a {"faults": {"FetchUser": {"latency": "500ms", "error_rate": 0.1}}}
+// body and DELETE disables it.
+func (s *Storage) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		state := stateJSON{Enabled: s.IsEnabled(), Faults: make(map[string]faultJSON), Stats: s.Stats()}
+		s.mu.RLock()
+		for op, f := range s.faults {
+			state.Faults[op] = faultJSON{
+				Latency:     f.Latency.String(),
+				Jitter:      f.Jitter.String(),
+				ErrorRate:   f.ErrorRate,
+				TimeoutRate: f.TimeoutRate,
+				Timeout:     f.Timeout.String(),
+			}
+		}
+		s.mu.RUnlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(&state)
+
+	case http.MethodPut:
+		var state stateJSON
+		if err := json.NewDecoder(r.Body).Decode(&state); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		faults, err := parseFaults(state.Faults)
+		if err == nil {
+			err = s.Enable(faults)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+
+	case http.MethodDelete:
+		s.Disable()
+		w.WriteHeader(http.StatusNoContent)
+
+	default:
+		http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+	}
+}
+
+func parseFaults(faults map[string]faultJSON) (map[string]Fault, error) {
+	ret := make(map[string]Fault, len(faults))
+	for op, fj := range faults {
+		f := Fault{ErrorRate: fj.ErrorRate, TimeoutRate: fj.TimeoutRate}
+		for _, d := range []struct {
+			s string
+			d *time.Duration
+		}{{fj.Latency, &f.Latency}, {fj.Jitter, &f.Jitter}, {fj.Timeout, &f.Timeout}} {
+			if len(d.s) == 0 {
+				continue
+			}
+			v, err := time.ParseDuration(d.s)
+			if err != nil {
+				return nil, fmt.Errorf("faulty: %s: %v", op, err)
+			}
+			*d.d = v
+		}
+		ret[op] = f
+	}
+	return ret, nil
+}
+
+// inject applies op configured faults, returning the injected error, if any.
+// Injected delays are cut short as soon as ctx is done, returning its error.
+func (s *Storage) inject(ctx context.Context, op string) error {
+	if s.parent != nil {
+		return s.parent.inject(ctx, op)
+	}
+	if !s.IsEnabled() {
+		return nil
+	}
+	s.mu.RLock()
+	f, ok := s.faults[op]
+	if !ok {
+		f, ok = s.faults[AnyOperation]
+	}
+	s.mu.RUnlock()
+	if !ok {
+		return nil
+	}
+	delay := f.Latency
+	if f.Jitter > 0 {
+		delay += time.Duration(rand.Int63n(int64(f.Jitter)))
+	}
+	var err error
+	switch p := rand.Float64(); {
+	case p < f.ErrorRate:
+		err = ErrInjected
+	case p < f.ErrorRate+f.TimeoutRate:
+		delay += f.Timeout
+		err = ErrTimeout
+	}
+	s.account(op, delay, err)
+	if delay > 0 {
+		tm := time.NewTimer(delay)
+		defer tm.Stop()
+		select {
+		case <-tm.C:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+	return err
+}
+
+func (s *Storage) account(op string, delay time.Duration, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	st := s.stats[op]
+	if st == nil {
+		st = &OperationStats{}
+		s.stats[op] = st
+	}
+	st.Calls++
+	st.Delay += delay
+	switch err {
+	case ErrInjected:
+		st.Errors++
+	case ErrTimeout:
+		st.Timeouts++
+	}
+}
+
+// InsertOrUpdateUser inserts a new user entity into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	if err := s.inject(ctx, "InsertOrUpdateUser"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdateUser(ctx, user)
+}
+
+// DeleteUser deletes a user entity from storage.
+func (s *Storage) DeleteUser(ctx context.Context, username string) error {
+	if err := s.inject(ctx, "DeleteUser"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteUser(ctx, username)
+}
+
+// FetchUser retrieves from storage a user entity.
+func (s *Storage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	if err := s.inject(ctx, "FetchUser"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchUser(ctx, username)
+}
+
+// UserExists returns whether or not a user exists within storage.
+func (s *Storage) UserExists(ctx context.Context, username string) (bool, error) {
+	if err := s.inject(ctx, "UserExists"); err != nil {
+		return false, err
+	}
+	return s.Storage.UserExists(ctx, username)
+}
+
+// CountUsers returns the number of registered users.
+func (s *Storage) CountUsers(ctx context.Context) (int, error) {
+	if err := s.inject(ctx, "CountUsers"); err != nil {
+		return 0, err
+	}
+	return s.Storage.CountUsers(ctx)
+}
+
+// FetchPurgeableUsers returns the usernames of every deleted
+// account whose grace period expired before a given time.
+func (s *Storage) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	if err := s.inject(ctx, "FetchPurgeableUsers"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchPurgeableUsers(ctx, before)
+}
+
+// InsertOrUpdateRosterItem inserts a new roster item entity into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	if err := s.inject(ctx, "InsertOrUpdateRosterItem"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdateRosterItem(ctx, ri)
+}
+
+// DeleteRosterItem deletes a roster item entity from storage.
+func (s *Storage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	if err := s.inject(ctx, "DeleteRosterItem"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteRosterItem(ctx, user, contact)
+}
+
+// FetchRosterItems retrieves from storage all roster item entities
+// associated to a given user.
+func (s *Storage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
+	if err := s.inject(ctx, "FetchRosterItems"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchRosterItems(ctx, user)
+}
+
+// FetchRosterItemsOfUsers retrieves from storage all roster
+// item entities associated to every given user.
+func (s *Storage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	if err := s.inject(ctx, "FetchRosterItemsOfUsers"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchRosterItemsOfUsers(ctx, users)
+}
+
+// FetchRosterItem retrieves from storage a roster item entity.
+func (s *Storage) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
+	if err := s.inject(ctx, "FetchRosterItem"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchRosterItem(ctx, user, contact)
+}
+
+// FetchRosterVersion retrieves from storage current user roster version.
+func (s *Storage) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	if err := s.inject(ctx, "FetchRosterVersion"); err != nil {
+		return model.RosterVersion{}, err
+	}
+	return s.Storage.FetchRosterVersion(ctx, user)
+}
+
+// FetchRosterTombstones retrieves from storage every user roster
+// item deleted after afterVer version.
+func (s *Storage) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
+	if err := s.inject(ctx, "FetchRosterTombstones"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchRosterTombstones(ctx, user, afterVer)
+}
+
+// PruneRosterTombstones deletes from storage every roster item
+// tombstone created before a given time.
+func (s *Storage) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	if err := s.inject(ctx, "PruneRosterTombstones"); err != nil {
+		return 0, err
+	}
+	return s.Storage.PruneRosterTombstones(ctx, before)
+}
+
+// InsertOrUpdateRosterNotification inserts a new roster notification entity
+// into storage, or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
+	if err := s.inject(ctx, "InsertOrUpdateRosterNotification"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdateRosterNotification(ctx, rn)
+}
+
+// DeleteRosterNotification deletes a roster notification entity from storage.
+func (s *Storage) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	if err := s.inject(ctx, "DeleteRosterNotification"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteRosterNotification(ctx, user, contact)
+}
+
+// FetchRosterNotifications retrieves from storage all roster notifications
+// associated to a given user.
+func (s *Storage) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
+	if err := s.inject(ctx, "FetchRosterNotifications"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchRosterNotifications(ctx, contact)
+}
+
+// InsertOrUpdateVCard inserts a new vCard element into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	if err := s.inject(ctx, "InsertOrUpdateVCard"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdateVCard(ctx, vCard, username)
+}
+
+// FetchVCard retrieves from storage a vCard element associated
+// to a given user.
+func (s *Storage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	if err := s.inject(ctx, "FetchVCard"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchVCard(ctx, username)
+}
+
+// FetchPrivateXML retrieves from storage a private element.
+func (s *Storage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	if err := s.inject(ctx, "FetchPrivateXML"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchPrivateXML(ctx, namespace, username)
+}
+
+// InsertOrUpdatePrivateXML inserts a new private element into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
+	if err := s.inject(ctx, "InsertOrUpdatePrivateXML"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdatePrivateXML(ctx, privateXML, namespace, username)
+}
+
+// InsertOfflineMessage inserts a new message element into
+// user's offline queue.
+func (s *Storage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	if err := s.inject(ctx, "InsertOfflineMessage"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOfflineMessage(ctx, message, username)
+}
+
+// InsertOfflineMessages inserts several message elements
+// into user's offline queue.
+func (s *Storage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	if err := s.inject(ctx, "InsertOfflineMessages"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOfflineMessages(ctx, messages, username)
+}
+
+// InsertCappedOfflineMessage inserts a new message element into user's
+// offline queue, as long as it doesn't exceed a given capacity.
+func (s *Storage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	if err := s.inject(ctx, "InsertCappedOfflineMessage"); err != nil {
+		return false, err
+	}
+	return s.Storage.InsertCappedOfflineMessage(ctx, message, username, capacity, dropOldest)
+}
+
+// CountOfflineMessages returns current length of user's offline queue.
+func (s *Storage) CountOfflineMessages(ctx context.Context, username string) (int, error) {
+	if err := s.inject(ctx, "CountOfflineMessages"); err != nil {
+		return 0, err
+	}
+	return s.Storage.CountOfflineMessages(ctx, username)
+}
+
+// FetchOfflineMessages retrieves from storage current user offline queue.
+func (s *Storage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	if err := s.inject(ctx, "FetchOfflineMessages"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchOfflineMessages(ctx, username)
+}
+
+// DeleteOfflineMessages clears a user offline queue.
+func (s *Storage) DeleteOfflineMessages(ctx context.Context, username string) error {
+	if err := s.inject(ctx, "DeleteOfflineMessages"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteOfflineMessages(ctx, username)
+}
+
+// FetchOfflineMessage retrieves from storage a single message
+// of user's offline queue.
+func (s *Storage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	if err := s.inject(ctx, "FetchOfflineMessage"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchOfflineMessage(ctx, username, node)
+}
+
+// DeleteOfflineMessage deletes a single message from user's offline queue.
+func (s *Storage) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	if err := s.inject(ctx, "DeleteOfflineMessage"); err != nil {
+		return false, err
+	}
+	return s.Storage.DeleteOfflineMessage(ctx, username, node)
+}
+
+// DeleteExpiredOfflineMessages deletes every offline message
+// received no later than a given time.
+func (s *Storage) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	if err := s.inject(ctx, "DeleteExpiredOfflineMessages"); err != nil {
+		return 0, err
+	}
+	return s.Storage.DeleteExpiredOfflineMessages(ctx, before)
+}
+
+// InsertQuarantinedMessage inserts a new message element into
+// user's quarantine queue.
+func (s *Storage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	if err := s.inject(ctx, "InsertQuarantinedMessage"); err != nil {
+		return err
+	}
+	return s.Storage.InsertQuarantinedMessage(ctx, message, username)
+}
+
+// CountQuarantinedMessages returns current length of user's quarantine queue.
+func (s *Storage) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	if err := s.inject(ctx, "CountQuarantinedMessages"); err != nil {
+		return 0, err
+	}
+	return s.Storage.CountQuarantinedMessages(ctx, username)
+}
+
+// FetchQuarantinedMessages retrieves from storage current user quarantine queue.
+func (s *Storage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	if err := s.inject(ctx, "FetchQuarantinedMessages"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchQuarantinedMessages(ctx, username)
+}
+
+// DeleteQuarantinedMessages clears a user quarantine queue.
+func (s *Storage) DeleteQuarantinedMessages(ctx context.Context, username string) error {
+	if err := s.inject(ctx, "DeleteQuarantinedMessages"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteQuarantinedMessages(ctx, username)
+}
+
+// InsertArchivedMessage inserts a new message into user's archive.
+func (s *Storage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	if err := s.inject(ctx, "InsertArchivedMessage"); err != nil {
+		return err
+	}
+	return s.Storage.InsertArchivedMessage(ctx, message)
+}
+
+// FetchArchivedMessages retrieves from storage the messages
+// of user's archive matching a filter.
+func (s *Storage) FetchArchivedMessages(ctx context.Context, username string, filter *storage.ArchiveFilter) ([]model.ArchivedMessage, error) {
+	if err := s.inject(ctx, "FetchArchivedMessages"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchArchivedMessages(ctx, username, filter)
+}
+
+// InsertOrUpdateArchivePrefs inserts a new user archiving
+// preferences entity into storage, or updates it in case it's been
+// previously inserted.
+func (s *Storage) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	if err := s.inject(ctx, "InsertOrUpdateArchivePrefs"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdateArchivePrefs(ctx, prefs)
+}
+
+// FetchArchivePrefs retrieves from storage user archiving preferences.
+func (s *Storage) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	if err := s.inject(ctx, "FetchArchivePrefs"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchArchivePrefs(ctx, username)
+}
+
+// InsertBlockListItems inserts a set of items into their owners block lists.
+func (s *Storage) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if err := s.inject(ctx, "InsertBlockListItems"); err != nil {
+		return err
+	}
+	return s.Storage.InsertBlockListItems(ctx, items)
+}
+
+// DeleteBlockListItems deletes a set of items from their owners block lists.
+func (s *Storage) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if err := s.inject(ctx, "DeleteBlockListItems"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteBlockListItems(ctx, items)
+}
+
+// FetchBlockListItems retrieves from storage every item of user's block list.
+func (s *Storage) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	if err := s.inject(ctx, "FetchBlockListItems"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchBlockListItems(ctx, username)
+}
+
+// InsertOrUpdatePrivacyList inserts or updates a privacy list.
+func (s *Storage) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	if err := s.inject(ctx, "InsertOrUpdatePrivacyList"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdatePrivacyList(ctx, list)
+}
+
+// DeletePrivacyList deletes a user's privacy list.
+func (s *Storage) DeletePrivacyList(ctx context.Context, username, name string) error {
+	if err := s.inject(ctx, "DeletePrivacyList"); err != nil {
+		return err
+	}
+	return s.Storage.DeletePrivacyList(ctx, username, name)
+}
+
+// FetchPrivacyLists retrieves from storage every user's privacy list.
+func (s *Storage) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	if err := s.inject(ctx, "FetchPrivacyLists"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchPrivacyLists(ctx, username)
+}
+
+// SetDefaultPrivacyList sets user's default privacy list.
+func (s *Storage) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	if err := s.inject(ctx, "SetDefaultPrivacyList"); err != nil {
+		return err
+	}
+	return s.Storage.SetDefaultPrivacyList(ctx, username, name)
+}
+
+// InsertOrUpdateFeatureFlag inserts a new user feature flag override
+// into storage, or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	if err := s.inject(ctx, "InsertOrUpdateFeatureFlag"); err != nil {
+		return err
+	}
+	return s.Storage.InsertOrUpdateFeatureFlag(ctx, ff)
+}
+
+// DeleteFeatureFlag deletes a user feature flag override from storage.
+func (s *Storage) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	if err := s.inject(ctx, "DeleteFeatureFlag"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteFeatureFlag(ctx, name, username)
+}
+
+// FetchFeatureFlags retrieves from storage every feature flag
+// override associated to a given user.
+func (s *Storage) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	if err := s.inject(ctx, "FetchFeatureFlags"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchFeatureFlags(ctx, username)
+}
+
+// InsertInvite inserts a new registration invite into storage.
+func (s *Storage) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	if err := s.inject(ctx, "InsertInvite"); err != nil {
+		return err
+	}
+	return s.Storage.InsertInvite(ctx, invite)
+}
+
+// RedeemInvite marks a registration invite as used, returning false
+// if it doesn't exist, has expired or has already been used.
+func (s *Storage) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	if err := s.inject(ctx, "RedeemInvite"); err != nil {
+		return false, err
+	}
+	return s.Storage.RedeemInvite(ctx, token, now)
+}
+
+// InsertStreamSession stores a resumable stream management session
+// persisted on graceful shutdown.
+func (s *Storage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	if err := s.inject(ctx, "InsertStreamSession"); err != nil {
+		return err
+	}
+	return s.Storage.InsertStreamSession(ctx, session)
+}
+
+// FetchStreamSessions retrieves from storage every stream
+// session persisted by a server configuration.
+func (s *Storage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	if err := s.inject(ctx, "FetchStreamSessions"); err != nil {
+		return nil, err
+	}
+	return s.Storage.FetchStreamSessions(ctx, serverID)
+}
+
+// DeleteStreamSessions deletes from storage every stream
+// session persisted by a server configuration.
+func (s *Storage) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	if err := s.inject(ctx, "DeleteStreamSessions"); err != nil {
+		return err
+	}
+	return s.Storage.DeleteStreamSessions(ctx, serverID)
+}
+
+// Usage returns the storage space taken by every stored entity.
+func (s *Storage) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	if err := s.inject(ctx, "Usage"); err != nil {
+		return nil, err
+	}
+	return s.Storage.Usage(ctx)
+}
+
+// InTransaction runs f within a transaction, whose
+// operations are subject to the same faults.
+func (s *Storage) InTransaction(ctx context.Context, f func(tx storage.Storage) error) error {
+	if err := s.inject(ctx, "InTransaction"); err != nil {
+		return err
+	}
+	return s.Storage.InTransaction(ctx, func(tx storage.Storage) error {
+		return f(&Storage{Storage: tx, parent: s})
+	})
+}
@@ -0,0 +1,189 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package faulty
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFaulty_Inert(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	s := New(storage.Instance())
+
+	require.False(t, s.IsEnabled())
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "pencil"}))
+	usr, err := s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, "ortuman", usr.Username)
+	require.Equal(t, 0, len(s.Stats()))
+}
+
+func TestFaulty_Transaction(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	s := New(storage.Instance())
+	require.Nil(t, s.Enable(map[string]Fault{"InsertOrUpdateRosterItem": {ErrorRate: 1}}))
+
+	// operations run within a transaction are faulty as well
+	err := s.InTransaction(context.Background(), func(tx storage.Storage) error {
+		if err := tx.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "pencil"}); err != nil {
+			return err
+		}
+		return tx.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo"})
+	})
+	require.Equal(t, ErrInjected, err)
+	require.Equal(t, int64(1), s.Stats()["InsertOrUpdateRosterItem"].Errors)
+
+	exists, err := s.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestFaulty_Latency(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	s := New(storage.Instance())
+
+	require.Nil(t, s.Enable(map[string]Fault{
+		"FetchUser": {Latency: time.Millisecond * 50, Jitter: time.Millisecond * 10},
+	}))
+	start := time.Now()
+	_, err := s.FetchUser(context.Background(), "ortuman")
+	elapsed := time.Since(start)
+	require.Nil(t, err)
+	require.True(t, elapsed >= time.Millisecond*50)
+
+	// operations without fault are not delayed
+	start = time.Now()
+	_, err = s.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < time.Millisecond*50)
+
+	st := s.Stats()
+	require.Equal(t, 1, len(st))
+	require.Equal(t, int64(1), st["FetchUser"].Calls)
+	require.True(t, st["FetchUser"].Delay >= time.Millisecond*50)
+	require.True(t, st["FetchUser"].Delay < time.Millisecond*60)
+
+	s.Disable()
+	start = time.Now()
+	_, err = s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.True(t, time.Since(start) < time.Millisecond*50)
+}
+
+func TestFaulty_Errors(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	s := New(storage.Instance())
+
+	require.NotNil(t, s.Enable(map[string]Fault{"Unknown": {}}))
+	require.NotNil(t, s.Enable(map[string]Fault{"FetchUser": {ErrorRate: 2}}))
+	require.NotNil(t, s.Enable(map[string]Fault{"FetchUser": {Latency: -1}}))
+
+	require.Nil(t, s.Enable(map[string]Fault{
+		AnyOperation: {ErrorRate: 1},
+		"CountUsers": {TimeoutRate: 1, Timeout: time.Millisecond * 20},
+		"FetchVCard": {ErrorRate: 0.5},
+		"UserExists": {},
+	}))
+	require.Equal(t, ErrInjected, s.DeleteUser(context.Background(), "ortuman"))
+	_, err := s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, ErrInjected, err)
+
+	start := time.Now()
+	_, err = s.CountUsers(context.Background())
+	require.Equal(t, ErrTimeout, err)
+	require.True(t, time.Since(start) >= time.Millisecond*20)
+
+	_, err = s.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+
+	var failed int
+	for i := 0; i < 1000; i++ {
+		if _, err := s.FetchVCard(context.Background(), "ortuman"); err != nil {
+			failed++
+		}
+	}
+	require.True(t, failed > 400 && failed < 600)
+
+	st := s.Stats()
+	require.Equal(t, OperationStats{Calls: 1, Errors: 1}, st["DeleteUser"])
+	require.Equal(t, OperationStats{Calls: 1, Timeouts: 1, Delay: time.Millisecond * 20}, st["CountUsers"])
+	require.Equal(t, OperationStats{Calls: 1}, st["UserExists"])
+	require.Equal(t, int64(1000), st["FetchVCard"].Calls)
+	require.Equal(t, int64(failed), st["FetchVCard"].Errors)
+}
+
+func TestFaulty_ServeHTTP(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	s := New(storage.Instance())
+
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+
+	do := func(method, body string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL, strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		require.Nil(t, err)
+		return resp
+	}
+	resp := do(http.MethodPut, `{"faults": {"FetchUser": {"latency": "forever"}}}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+	resp = do(http.MethodPut, `{"faults": {"Unknown": {}}}`)
+	require.Equal(t, http.StatusBadRequest, resp.StatusCode)
+
+	resp = do(http.MethodPut, `{"faults": {"FetchUser": {"latency": "10ms", "error_rate": 1}}}`)
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.True(t, s.IsEnabled())
+
+	_, err := s.FetchUser(context.Background(), "ortuman")
+	require.Equal(t, ErrInjected, err)
+
+	var state stateJSON
+	resp = do(http.MethodGet, "")
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	require.Nil(t, json.NewDecoder(resp.Body).Decode(&state))
+	resp.Body.Close()
+	require.True(t, state.Enabled)
+	require.Equal(t, "10ms", state.Faults["FetchUser"].Latency)
+	require.Equal(t, float64(1), state.Faults["FetchUser"].ErrorRate)
+	require.Equal(t, OperationStats{Calls: 1, Errors: 1, Delay: time.Millisecond * 10}, state.Stats["FetchUser"])
+
+	resp = do(http.MethodDelete, "")
+	require.Equal(t, http.StatusNoContent, resp.StatusCode)
+	require.False(t, s.IsEnabled())
+}
+
+func TestFaulty_Decorate(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	var fs *Storage
+	storage.Decorate(func(s storage.Storage) storage.Storage {
+		fs = New(s)
+		return fs
+	})
+	require.True(t, storage.Instance() == storage.Storage(fs))
+}
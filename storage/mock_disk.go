@@ -0,0 +1,462 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+// mockBackendEnv names the environment variable selecting the backend
+// of mock storage type, so that every test relying on it can be run
+// against a persistent storage (e.g. JACKAL_MOCK_STORAGE=sqlite go test ./...).
+const mockBackendEnv = "JACKAL_MOCK_STORAGE"
+
+func newMockStorageFromEnv() Storage {
+	switch backend := os.Getenv(mockBackendEnv); backend {
+	case "sqlite":
+		return newSQLiteMockStorage()
+	case "badger":
+		return newBadgerMockStorage()
+	case "", "memory":
+		return newMockStorage()
+	default:
+		log.Fatalf("storage: unrecognized %s backend: %s", mockBackendEnv, backend)
+		return nil
+	}
+}
+
+// diskMockStorage represents a mocked storage backed by
+// a persistent one living within a temporary directory.
+type diskMockStorage struct {
+	*mockHooks
+	Storage
+	dir string
+}
+
+func newSQLiteMockStorage() *diskMockStorage {
+	dir := mockTempDir("sqlite")
+	s, err := openSQLiteStorage(filepath.Join(dir, "jackal.db"), "")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return &diskMockStorage{mockHooks: &mockHooks{}, Storage: s, dir: dir}
+}
+
+func newBadgerMockStorage() *diskMockStorage {
+	dir := mockTempDir("badger")
+	s := newBadgerDB(&config.BadgerDb{DataDir: filepath.Join(dir, "data")}, "")
+	return &diskMockStorage{mockHooks: &mockHooks{}, Storage: s, dir: dir}
+}
+
+func mockTempDir(backend string) string {
+	dir, err := ioutil.TempDir("", "jackal.tests."+backend+".")
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return dir
+}
+
+func (m *diskMockStorage) Shutdown() {
+	m.Storage.Shutdown()
+	os.RemoveAll(m.dir)
+}
+
+func (m *diskMockStorage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateUser"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdateUser(ctx, user)
+}
+
+func (m *diskMockStorage) DeleteUser(ctx context.Context, username string) error {
+	if err := m.mockedError(ctx, "DeleteUser"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteUser(ctx, username)
+}
+
+func (m *diskMockStorage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	if err := m.mockedError(ctx, "FetchUser"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchUser(ctx, username)
+}
+
+func (m *diskMockStorage) UserExists(ctx context.Context, username string) (bool, error) {
+	if err := m.mockedError(ctx, "UserExists"); err != nil {
+		return false, err
+	}
+	return m.Storage.UserExists(ctx, username)
+}
+
+func (m *diskMockStorage) CountUsers(ctx context.Context) (int, error) {
+	if err := m.mockedError(ctx, "CountUsers"); err != nil {
+		return 0, err
+	}
+	return m.Storage.CountUsers(ctx)
+}
+
+func (m *diskMockStorage) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	if err := m.mockedError(ctx, "FetchPurgeableUsers"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchPurgeableUsers(ctx, before)
+}
+
+func (m *diskMockStorage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateRosterItem"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdateRosterItem(ctx, ri)
+}
+
+func (m *diskMockStorage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	if err := m.mockedError(ctx, "DeleteRosterItem"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteRosterItem(ctx, user, contact)
+}
+
+func (m *diskMockStorage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
+	if err := m.mockedError(ctx, "FetchRosterItems"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchRosterItems(ctx, user)
+}
+
+func (m *diskMockStorage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	if err := m.mockedError(ctx, "FetchRosterItemsOfUsers"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchRosterItemsOfUsers(ctx, users)
+}
+
+func (m *diskMockStorage) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
+	if err := m.mockedError(ctx, "FetchRosterItem"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchRosterItem(ctx, user, contact)
+}
+
+func (m *diskMockStorage) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	if err := m.mockedError(ctx, "FetchRosterVersion"); err != nil {
+		return model.RosterVersion{}, err
+	}
+	return m.Storage.FetchRosterVersion(ctx, user)
+}
+
+func (m *diskMockStorage) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
+	if err := m.mockedError(ctx, "FetchRosterTombstones"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchRosterTombstones(ctx, user, afterVer)
+}
+
+func (m *diskMockStorage) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	if err := m.mockedError(ctx, "PruneRosterTombstones"); err != nil {
+		return 0, err
+	}
+	return m.Storage.PruneRosterTombstones(ctx, before)
+}
+
+func (m *diskMockStorage) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateRosterNotification"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdateRosterNotification(ctx, rn)
+}
+
+func (m *diskMockStorage) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	if err := m.mockedError(ctx, "DeleteRosterNotification"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteRosterNotification(ctx, user, contact)
+}
+
+func (m *diskMockStorage) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
+	if err := m.mockedError(ctx, "FetchRosterNotifications"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchRosterNotifications(ctx, contact)
+}
+
+func (m *diskMockStorage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateVCard"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdateVCard(ctx, vCard, username)
+}
+
+func (m *diskMockStorage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	if err := m.mockedError(ctx, "FetchVCard"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchVCard(ctx, username)
+}
+
+func (m *diskMockStorage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	if err := m.mockedError(ctx, "FetchPrivateXML"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchPrivateXML(ctx, namespace, username)
+}
+
+func (m *diskMockStorage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
+	if err := m.mockedError(ctx, "InsertOrUpdatePrivateXML"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdatePrivateXML(ctx, privateXML, namespace, username)
+}
+
+func (m *diskMockStorage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertOfflineMessage"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOfflineMessage(ctx, message, username)
+}
+
+func (m *diskMockStorage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertOfflineMessages"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOfflineMessages(ctx, messages, username)
+}
+
+func (m *diskMockStorage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	if err := m.mockedError(ctx, "InsertCappedOfflineMessage"); err != nil {
+		return false, err
+	}
+	return m.Storage.InsertCappedOfflineMessage(ctx, message, username, capacity, dropOldest)
+}
+
+func (m *diskMockStorage) CountOfflineMessages(ctx context.Context, username string) (int, error) {
+	if err := m.mockedError(ctx, "CountOfflineMessages"); err != nil {
+		return 0, err
+	}
+	return m.Storage.CountOfflineMessages(ctx, username)
+}
+
+func (m *diskMockStorage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	if err := m.mockedError(ctx, "FetchOfflineMessages"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchOfflineMessages(ctx, username)
+}
+
+func (m *diskMockStorage) DeleteOfflineMessages(ctx context.Context, username string) error {
+	if err := m.mockedError(ctx, "DeleteOfflineMessages"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteOfflineMessages(ctx, username)
+}
+
+func (m *diskMockStorage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	if err := m.mockedError(ctx, "FetchOfflineMessage"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchOfflineMessage(ctx, username, node)
+}
+
+func (m *diskMockStorage) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	if err := m.mockedError(ctx, "DeleteOfflineMessage"); err != nil {
+		return false, err
+	}
+	return m.Storage.DeleteOfflineMessage(ctx, username, node)
+}
+
+func (m *diskMockStorage) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	if err := m.mockedError(ctx, "DeleteExpiredOfflineMessages"); err != nil {
+		return 0, err
+	}
+	return m.Storage.DeleteExpiredOfflineMessages(ctx, before)
+}
+
+func (m *diskMockStorage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertQuarantinedMessage"); err != nil {
+		return err
+	}
+	return m.Storage.InsertQuarantinedMessage(ctx, message, username)
+}
+
+func (m *diskMockStorage) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	if err := m.mockedError(ctx, "CountQuarantinedMessages"); err != nil {
+		return 0, err
+	}
+	return m.Storage.CountQuarantinedMessages(ctx, username)
+}
+
+func (m *diskMockStorage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	if err := m.mockedError(ctx, "FetchQuarantinedMessages"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchQuarantinedMessages(ctx, username)
+}
+
+func (m *diskMockStorage) DeleteQuarantinedMessages(ctx context.Context, username string) error {
+	if err := m.mockedError(ctx, "DeleteQuarantinedMessages"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteQuarantinedMessages(ctx, username)
+}
+
+func (m *diskMockStorage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	if err := m.mockedError(ctx, "InsertArchivedMessage"); err != nil {
+		return err
+	}
+	return m.Storage.InsertArchivedMessage(ctx, message)
+}
+
+func (m *diskMockStorage) FetchArchivedMessages(ctx context.Context, username string, filter *ArchiveFilter) ([]model.ArchivedMessage, error) {
+	if err := m.mockedError(ctx, "FetchArchivedMessages"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchArchivedMessages(ctx, username, filter)
+}
+
+func (m *diskMockStorage) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateArchivePrefs"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdateArchivePrefs(ctx, prefs)
+}
+
+func (m *diskMockStorage) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	if err := m.mockedError(ctx, "FetchArchivePrefs"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchArchivePrefs(ctx, username)
+}
+
+func (m *diskMockStorage) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if err := m.mockedError(ctx, "InsertBlockListItems"); err != nil {
+		return err
+	}
+	return m.Storage.InsertBlockListItems(ctx, items)
+}
+
+func (m *diskMockStorage) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if err := m.mockedError(ctx, "DeleteBlockListItems"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteBlockListItems(ctx, items)
+}
+
+func (m *diskMockStorage) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	if err := m.mockedError(ctx, "FetchBlockListItems"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchBlockListItems(ctx, username)
+}
+
+func (m *diskMockStorage) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	if err := m.mockedError(ctx, "InsertOrUpdatePrivacyList"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdatePrivacyList(ctx, list)
+}
+
+func (m *diskMockStorage) DeletePrivacyList(ctx context.Context, username, name string) error {
+	if err := m.mockedError(ctx, "DeletePrivacyList"); err != nil {
+		return err
+	}
+	return m.Storage.DeletePrivacyList(ctx, username, name)
+}
+
+func (m *diskMockStorage) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	if err := m.mockedError(ctx, "FetchPrivacyLists"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchPrivacyLists(ctx, username)
+}
+
+func (m *diskMockStorage) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	if err := m.mockedError(ctx, "SetDefaultPrivacyList"); err != nil {
+		return err
+	}
+	return m.Storage.SetDefaultPrivacyList(ctx, username, name)
+}
+
+func (m *diskMockStorage) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateFeatureFlag"); err != nil {
+		return err
+	}
+	return m.Storage.InsertOrUpdateFeatureFlag(ctx, ff)
+}
+
+func (m *diskMockStorage) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	if err := m.mockedError(ctx, "DeleteFeatureFlag"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteFeatureFlag(ctx, name, username)
+}
+
+func (m *diskMockStorage) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	if err := m.mockedError(ctx, "FetchFeatureFlags"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchFeatureFlags(ctx, username)
+}
+
+func (m *diskMockStorage) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	if err := m.mockedError(ctx, "InsertInvite"); err != nil {
+		return err
+	}
+	return m.Storage.InsertInvite(ctx, invite)
+}
+
+func (m *diskMockStorage) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	if err := m.mockedError(ctx, "RedeemInvite"); err != nil {
+		return false, err
+	}
+	return m.Storage.RedeemInvite(ctx, token, now)
+}
+
+func (m *diskMockStorage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	if err := m.mockedError(ctx, "InsertStreamSession"); err != nil {
+		return err
+	}
+	return m.Storage.InsertStreamSession(ctx, session)
+}
+
+func (m *diskMockStorage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	if err := m.mockedError(ctx, "FetchStreamSessions"); err != nil {
+		return nil, err
+	}
+	return m.Storage.FetchStreamSessions(ctx, serverID)
+}
+
+func (m *diskMockStorage) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	if err := m.mockedError(ctx, "DeleteStreamSessions"); err != nil {
+		return err
+	}
+	return m.Storage.DeleteStreamSessions(ctx, serverID)
+}
+
+func (m *diskMockStorage) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	if err := m.mockedError(ctx, "Usage"); err != nil {
+		return nil, err
+	}
+	return m.Storage.Usage(ctx)
+}
+
+func (m *diskMockStorage) InTransaction(ctx context.Context, f func(tx Storage) error) error {
+	if err := m.mockedError(ctx, "InTransaction"); err != nil {
+		return err
+	}
+	return m.Storage.InTransaction(ctx, func(tx Storage) error {
+		// transaction bound handle shares m testing hooks
+		return f(&diskMockStorage{mockHooks: m.mockHooks, Storage: tx})
+	})
+}
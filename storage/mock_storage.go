@@ -6,19 +6,119 @@
 package storage
 
 import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
 )
 
+// mockHooks implements the testing hooks shared by mocked storages.
+// mockLatency goes first, so that it's 64-bit aligned for atomic access.
+type mockHooks struct {
+	mockLatency int64
+	mockErr     uint32
+
+	mu     sync.Mutex
+	opErrs map[string]int // remaining failures by operation, or -1 if unbounded
+	calls  map[string]int
+}
+
+func (h *mockHooks) activateMockedError() {
+	atomic.StoreUint32(&h.mockErr, 1)
+}
+
+func (h *mockHooks) activateMockedErrorFor(op string, n int) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.opErrs == nil {
+		h.opErrs = make(map[string]int)
+	}
+	h.opErrs[op] = n
+}
+
+func (h *mockHooks) deactivateMockedError() {
+	atomic.StoreUint32(&h.mockErr, 0)
+
+	h.mu.Lock()
+	h.opErrs = nil
+	h.mu.Unlock()
+}
+
+func (h *mockHooks) setMockedLatency(latency time.Duration) {
+	atomic.StoreInt64(&h.mockLatency, int64(latency))
+}
+
+func (h *mockHooks) mockedCalls(op string) int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.calls[op]
+}
+
+func (h *mockHooks) resetMockedCalls() {
+	h.mu.Lock()
+	h.calls = nil
+	h.mu.Unlock()
+}
+
+// mockedError accounts a call to op, returning the error it fails with, if any,
+// after the mocked latency elapses or ctx is done, whatever happens first.
+func (h *mockHooks) mockedError(ctx context.Context, op string) error {
+	h.mu.Lock()
+	if h.calls == nil {
+		h.calls = make(map[string]int)
+	}
+	h.calls[op]++
+	h.mu.Unlock()
+
+	if latency := atomic.LoadInt64(&h.mockLatency); latency > 0 {
+		tm := time.NewTimer(time.Duration(latency))
+		select {
+		case <-tm.C:
+		case <-ctx.Done():
+			tm.Stop()
+		}
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if atomic.LoadUint32(&h.mockErr) == 1 || h.consumeMockedError(op) {
+		return ErrMockedError
+	}
+	return nil
+}
+
+// consumeMockedError returns whether op has been armed to fail,
+// accounting the failure whenever it's bounded.
+func (h *mockHooks) consumeMockedError(op string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	n, ok := h.opErrs[op]
+	if !ok {
+		return false
+	}
+	switch {
+	case n == 1:
+		delete(h.opErrs, op)
+	case n > 1:
+		h.opErrs[op] = n - 1
+	}
+	return true
+}
+
 type mockStorage struct {
-	mockErr               uint32
+	mockHooks
 	usersMu               sync.RWMutex
 	users                 map[string]*model.User
 	rosterItemsMu         sync.RWMutex
 	rosterItems           map[string][]model.RosterItem
+	rosterVersions        map[string]model.RosterVersion
+	rosterTombstones      map[string][]model.RosterTombstone
 	rosterNotificationsMu sync.RWMutex
 	rosterNotifications   map[string][]model.RosterNotification
 	vCardsMu              sync.RWMutex
@@ -26,34 +126,54 @@ type mockStorage struct {
 	privateXMLMu          sync.RWMutex
 	privateXML            map[string][]xml.Element
 	offlineMessagesMu     sync.RWMutex
-	offlineMessages       map[string][]xml.Element
+	offlineMessages       map[string][]model.OfflineMessage
+	offlineSeq            int
+	quarantinedMessagesMu sync.RWMutex
+	quarantinedMessages   map[string][]xml.Element
+	archiveMu             sync.RWMutex
+	archivedMessages      map[string][]model.ArchivedMessage
+	archivePrefs          map[string]model.ArchivePrefs
+	archiveSeq            uint64
+	blockListMu           sync.RWMutex
+	blockListItems        map[string][]model.BlockListItem
+	privacyListsMu        sync.RWMutex
+	privacyLists          map[string][]model.PrivacyList
+	featureFlagsMu        sync.RWMutex
+	featureFlags          map[string][]model.FeatureFlag
+	invitesMu             sync.Mutex
+	invites               map[string]model.Invite
+	streamSessionsMu      sync.Mutex
+	streamSessions        map[string][]model.StreamSession
+	txMu                  sync.Mutex
 }
 
 func newMockStorage() *mockStorage {
 	return &mockStorage{
 		users:               make(map[string]*model.User),
 		rosterItems:         make(map[string][]model.RosterItem),
+		rosterVersions:      make(map[string]model.RosterVersion),
+		rosterTombstones:    make(map[string][]model.RosterTombstone),
 		rosterNotifications: make(map[string][]model.RosterNotification),
 		vCards:              make(map[string]xml.Element),
 		privateXML:          make(map[string][]xml.Element),
-		offlineMessages:     make(map[string][]xml.Element),
+		offlineMessages:     make(map[string][]model.OfflineMessage),
+		quarantinedMessages: make(map[string][]xml.Element),
+		archivedMessages:    make(map[string][]model.ArchivedMessage),
+		archivePrefs:        make(map[string]model.ArchivePrefs),
+		blockListItems:      make(map[string][]model.BlockListItem),
+		privacyLists:        make(map[string][]model.PrivacyList),
+		featureFlags:        make(map[string][]model.FeatureFlag),
+		invites:             make(map[string]model.Invite),
+		streamSessions:      make(map[string][]model.StreamSession),
 	}
 }
 
 func (m *mockStorage) Shutdown() {
 }
 
-func (m *mockStorage) activateMockedError() {
-	atomic.StoreUint32(&m.mockErr, 1)
-}
-
-func (m *mockStorage) deactivateMockedError() {
-	atomic.StoreUint32(&m.mockErr, 0)
-}
-
-func (m *mockStorage) FetchUser(username string) (*model.User, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return nil, ErrMockedError
+func (m *mockStorage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	if err := m.mockedError(ctx, "FetchUser"); err != nil {
+		return nil, err
 	}
 	m.usersMu.RLock()
 	defer m.usersMu.RUnlock()
@@ -63,9 +183,9 @@ func (m *mockStorage) FetchUser(username string) (*model.User, error) {
 	return nil, nil
 }
 
-func (m *mockStorage) InsertOrUpdateUser(user *model.User) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateUser"); err != nil {
+		return err
 	}
 	m.usersMu.Lock()
 	defer m.usersMu.Unlock()
@@ -73,37 +193,132 @@ func (m *mockStorage) InsertOrUpdateUser(user *model.User) error {
 	return nil
 }
 
-func (m *mockStorage) DeleteUser(username string) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) DeleteUser(ctx context.Context, username string) error {
+	if err := m.mockedError(ctx, "DeleteUser"); err != nil {
+		return err
+	}
+	m.offlineMessagesMu.Lock()
+	delete(m.offlineMessages, username)
+	m.offlineMessagesMu.Unlock()
+
+	m.quarantinedMessagesMu.Lock()
+	delete(m.quarantinedMessages, username)
+	m.quarantinedMessagesMu.Unlock()
+
+	m.rosterItemsMu.Lock()
+	delete(m.rosterItems, username)
+	delete(m.rosterVersions, username)
+	delete(m.rosterTombstones, username)
+	m.rosterItemsMu.Unlock()
+
+	m.rosterNotificationsMu.Lock()
+	delete(m.rosterNotifications, username)
+	for contact, rns := range m.rosterNotifications {
+		var kept []model.RosterNotification
+		for _, rn := range rns {
+			if rn.User != username {
+				kept = append(kept, rn)
+			}
+		}
+		m.rosterNotifications[contact] = kept
+	}
+	m.rosterNotificationsMu.Unlock()
+
+	m.privateXMLMu.Lock()
+	for key := range m.privateXML {
+		if strings.HasPrefix(key, username+":") {
+			delete(m.privateXML, key)
+		}
 	}
+	m.privateXMLMu.Unlock()
+
+	m.vCardsMu.Lock()
+	delete(m.vCards, username)
+	m.vCardsMu.Unlock()
+
+	m.archiveMu.Lock()
+	delete(m.archivedMessages, username)
+	delete(m.archivePrefs, username)
+	m.archiveMu.Unlock()
+
+	m.blockListMu.Lock()
+	delete(m.blockListItems, username)
+	m.blockListMu.Unlock()
+
+	m.privacyListsMu.Lock()
+	delete(m.privacyLists, username)
+	m.privacyListsMu.Unlock()
+
+	m.featureFlagsMu.Lock()
+	delete(m.featureFlags, username)
+	m.featureFlagsMu.Unlock()
+
 	m.usersMu.Lock()
 	defer m.usersMu.Unlock()
 	delete(m.users, username)
 	return nil
 }
 
-func (m *mockStorage) UserExists(username string) (bool, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return false, ErrMockedError
+func (m *mockStorage) UserExists(ctx context.Context, username string) (bool, error) {
+	if err := m.mockedError(ctx, "UserExists"); err != nil {
+		return false, err
 	}
 	m.usersMu.RLock()
 	defer m.usersMu.RUnlock()
 	return m.users[username] != nil, nil
 }
 
-func (m *mockStorage) FetchRosterItems(user string) ([]model.RosterItem, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return nil, ErrMockedError
+func (m *mockStorage) CountUsers(ctx context.Context) (int, error) {
+	if err := m.mockedError(ctx, "CountUsers"); err != nil {
+		return 0, err
+	}
+	m.usersMu.RLock()
+	defer m.usersMu.RUnlock()
+	return len(m.users), nil
+}
+
+func (m *mockStorage) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	if err := m.mockedError(ctx, "FetchPurgeableUsers"); err != nil {
+		return nil, err
+	}
+	m.usersMu.RLock()
+	defer m.usersMu.RUnlock()
+	var usernames []string
+	for _, u := range m.users {
+		if u.IsPurgeable(before) {
+			usernames = append(usernames, u.Username)
+		}
+	}
+	return usernames, nil
+}
+
+func (m *mockStorage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
+	if err := m.mockedError(ctx, "FetchRosterItems"); err != nil {
+		return nil, err
 	}
 	m.rosterItemsMu.RLock()
 	defer m.rosterItemsMu.RUnlock()
 	return m.rosterItems[user], nil
 }
 
-func (m *mockStorage) FetchRosterItem(user, contact string) (*model.RosterItem, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return nil, ErrMockedError
+func (m *mockStorage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	if err := m.mockedError(ctx, "FetchRosterItemsOfUsers"); err != nil {
+		return nil, err
+	}
+	m.rosterItemsMu.RLock()
+	defer m.rosterItemsMu.RUnlock()
+	ret := make(map[string][]model.RosterItem, len(users))
+	for _, user := range users {
+		if ris := m.rosterItems[user]; len(ris) > 0 {
+			ret[user] = ris
+		}
+	}
+	return ret, nil
+}
+
+func (m *mockStorage) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
+	if err := m.mockedError(ctx, "FetchRosterItem"); err != nil {
+		return nil, err
 	}
 	m.rosterItemsMu.RLock()
 	defer m.rosterItemsMu.RUnlock()
@@ -116,12 +331,15 @@ func (m *mockStorage) FetchRosterItem(user, contact string) (*model.RosterItem,
 	return nil, nil
 }
 
-func (m *mockStorage) InsertOrUpdateRosterItem(ri *model.RosterItem) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateRosterItem"); err != nil {
+		return err
 	}
 	m.rosterItemsMu.Lock()
 	defer m.rosterItemsMu.Unlock()
+	ri.Ver = m.incRosterVersion(ri.User)
+	m.deleteRosterTombstone(ri.User, ri.Contact)
+
 	rosterItems := m.rosterItems[ri.User]
 	if rosterItems != nil {
 		for i, rosterItem := range rosterItems {
@@ -139,9 +357,9 @@ updateRosterItems:
 	return nil
 }
 
-func (m *mockStorage) DeleteRosterItem(user, contact string) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	if err := m.mockedError(ctx, "DeleteRosterItem"); err != nil {
+		return err
 	}
 	m.rosterItemsMu.Lock()
 	defer m.rosterItemsMu.Unlock()
@@ -149,24 +367,103 @@ func (m *mockStorage) DeleteRosterItem(user, contact string) error {
 	for i, rosterItem := range rosterItems {
 		if rosterItem.Contact == contact {
 			m.rosterItems[user] = append(rosterItems[:i], rosterItems[i+1:]...)
+			m.rosterTombstones[user] = append(m.rosterTombstones[user], model.RosterTombstone{
+				User:      user,
+				Contact:   contact,
+				Ver:       m.incRosterVersion(user),
+				DeletedAt: time.Now(),
+			})
 			return nil
 		}
 	}
 	return nil
 }
 
-func (m *mockStorage) FetchRosterNotifications(contact string) ([]model.RosterNotification, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return nil, ErrMockedError
+func (m *mockStorage) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	if err := m.mockedError(ctx, "FetchRosterVersion"); err != nil {
+		return model.RosterVersion{}, err
+	}
+	m.rosterItemsMu.RLock()
+	defer m.rosterItemsMu.RUnlock()
+	return m.rosterVersions[user], nil
+}
+
+func (m *mockStorage) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
+	if err := m.mockedError(ctx, "FetchRosterTombstones"); err != nil {
+		return nil, err
+	}
+	m.rosterItemsMu.RLock()
+	defer m.rosterItemsMu.RUnlock()
+	var rts []model.RosterTombstone
+	for _, rt := range m.rosterTombstones[user] {
+		if rt.Ver > afterVer {
+			rts = append(rts, rt)
+		}
+	}
+	return rts, nil
+}
+
+func (m *mockStorage) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	if err := m.mockedError(ctx, "PruneRosterTombstones"); err != nil {
+		return 0, err
+	}
+	m.rosterItemsMu.Lock()
+	defer m.rosterItemsMu.Unlock()
+	var count int
+	for user, rts := range m.rosterTombstones {
+		var kept []model.RosterTombstone
+		rv := m.rosterVersions[user]
+		for _, rt := range rts {
+			if rt.DeletedAt.After(before) {
+				kept = append(kept, rt)
+				continue
+			}
+			if rt.Ver > rv.PrunedVer {
+				rv.PrunedVer = rt.Ver
+			}
+			count++
+		}
+		m.rosterVersions[user] = rv
+		if len(kept) > 0 {
+			m.rosterTombstones[user] = kept
+		} else {
+			delete(m.rosterTombstones, user)
+		}
+	}
+	return count, nil
+}
+
+// incRosterVersion increments user roster version, returning the new one.
+// Roster items lock must be held by the caller.
+func (m *mockStorage) incRosterVersion(user string) int {
+	rv := m.rosterVersions[user]
+	rv.Ver++
+	m.rosterVersions[user] = rv
+	return rv.Ver
+}
+
+func (m *mockStorage) deleteRosterTombstone(user, contact string) {
+	rts := m.rosterTombstones[user]
+	for i, rt := range rts {
+		if rt.Contact == contact {
+			m.rosterTombstones[user] = append(rts[:i], rts[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *mockStorage) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
+	if err := m.mockedError(ctx, "FetchRosterNotifications"); err != nil {
+		return nil, err
 	}
 	m.rosterItemsMu.RLock()
 	defer m.rosterItemsMu.RUnlock()
 	return m.rosterNotifications[contact], nil
 }
 
-func (m *mockStorage) InsertOrUpdateRosterNotification(rn *model.RosterNotification) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateRosterNotification"); err != nil {
+		return err
 	}
 	m.rosterItemsMu.Lock()
 	defer m.rosterItemsMu.Unlock()
@@ -187,9 +484,9 @@ updateRosterNotifications:
 	return nil
 }
 
-func (m *mockStorage) DeleteRosterNotification(user, contact string) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	if err := m.mockedError(ctx, "DeleteRosterNotification"); err != nil {
+		return err
 	}
 	m.rosterItemsMu.Lock()
 	defer m.rosterItemsMu.Unlock()
@@ -203,9 +500,9 @@ func (m *mockStorage) DeleteRosterNotification(user, contact string) error {
 	return nil
 }
 
-func (m *mockStorage) InsertOrUpdateVCard(vCard xml.Element, username string) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateVCard"); err != nil {
+		return err
 	}
 	m.vCardsMu.Lock()
 	defer m.vCardsMu.Unlock()
@@ -214,18 +511,18 @@ func (m *mockStorage) InsertOrUpdateVCard(vCard xml.Element, username string) er
 	return nil
 }
 
-func (m *mockStorage) FetchVCard(username string) (xml.Element, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return nil, ErrMockedError
+func (m *mockStorage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	if err := m.mockedError(ctx, "FetchVCard"); err != nil {
+		return nil, err
 	}
 	m.vCardsMu.RLock()
 	defer m.vCardsMu.RUnlock()
 	return m.vCards[username], nil
 }
 
-func (m *mockStorage) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
+	if err := m.mockedError(ctx, "InsertOrUpdatePrivateXML"); err != nil {
+		return err
 	}
 	m.privateXMLMu.Lock()
 	defer m.privateXMLMu.Unlock()
@@ -239,51 +536,821 @@ func (m *mockStorage) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespa
 	return nil
 }
 
-func (m *mockStorage) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return nil, ErrMockedError
+func (m *mockStorage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	if err := m.mockedError(ctx, "FetchPrivateXML"); err != nil {
+		return nil, err
 	}
 	m.privateXMLMu.RLock()
 	defer m.privateXMLMu.RUnlock()
 	return m.privateXML[username+":"+namespace], nil
 }
 
-func (m *mockStorage) InsertOfflineMessage(message xml.Element, username string) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertOfflineMessage"); err != nil {
+		return err
+	}
+	m.offlineMessagesMu.Lock()
+	defer m.offlineMessagesMu.Unlock()
+	m.offlineMessages[username] = append(m.offlineMessages[username], m.newOfflineMessage(message))
+	return nil
+}
+
+func (m *mockStorage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertOfflineMessages"); err != nil {
+		return err
 	}
 	m.offlineMessagesMu.Lock()
 	defer m.offlineMessagesMu.Unlock()
 	offlineMessages := m.offlineMessages[username]
-	offlineMessages = append(offlineMessages, xml.NewElementFromElement(message))
+	for _, message := range messages {
+		offlineMessages = append(offlineMessages, m.newOfflineMessage(message))
+	}
 	m.offlineMessages[username] = offlineMessages
 	return nil
 }
 
-func (m *mockStorage) CountOfflineMessages(username string) (int, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return 0, ErrMockedError
+func (m *mockStorage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	if err := m.mockedError(ctx, "InsertCappedOfflineMessage"); err != nil {
+		return false, err
+	}
+	m.offlineMessagesMu.Lock()
+	defer m.offlineMessagesMu.Unlock()
+	offlineMessages := m.offlineMessages[username]
+	if len(offlineMessages) >= capacity {
+		if !dropOldest {
+			return false, nil
+		}
+		offlineMessages = append([]model.OfflineMessage(nil), offlineMessages[len(offlineMessages)-capacity+1:]...)
+	}
+	offlineMessages = append(offlineMessages, m.newOfflineMessage(message))
+	m.offlineMessages[username] = offlineMessages
+	return true, nil
+}
+
+func (m *mockStorage) CountOfflineMessages(ctx context.Context, username string) (int, error) {
+	if err := m.mockedError(ctx, "CountOfflineMessages"); err != nil {
+		return 0, err
 	}
 	m.offlineMessagesMu.RLock()
 	defer m.offlineMessagesMu.RUnlock()
 	return len(m.offlineMessages[username]), nil
 }
 
-func (m *mockStorage) FetchOfflineMessages(username string) ([]xml.Element, error) {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return nil, ErrMockedError
+func (m *mockStorage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	if err := m.mockedError(ctx, "FetchOfflineMessages"); err != nil {
+		return nil, err
 	}
 	m.offlineMessagesMu.RLock()
 	defer m.offlineMessagesMu.RUnlock()
 	return m.offlineMessages[username], nil
 }
 
-func (m *mockStorage) DeleteOfflineMessages(username string) error {
-	if atomic.LoadUint32(&m.mockErr) == 1 {
-		return ErrMockedError
+func (m *mockStorage) DeleteOfflineMessages(ctx context.Context, username string) error {
+	if err := m.mockedError(ctx, "DeleteOfflineMessages"); err != nil {
+		return err
 	}
 	m.offlineMessagesMu.Lock()
 	defer m.offlineMessagesMu.Unlock()
 	delete(m.offlineMessages, username)
 	return nil
 }
+
+func (m *mockStorage) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	if err := m.mockedError(ctx, "DeleteExpiredOfflineMessages"); err != nil {
+		return 0, err
+	}
+	m.offlineMessagesMu.Lock()
+	defer m.offlineMessagesMu.Unlock()
+	var count int
+	for username, msgs := range m.offlineMessages {
+		var kept []model.OfflineMessage
+		for _, msg := range msgs {
+			if msg.ReceivedAt.After(before) {
+				kept = append(kept, msg)
+			}
+		}
+		count += len(msgs) - len(kept)
+		if len(kept) == 0 {
+			delete(m.offlineMessages, username)
+			continue
+		}
+		m.offlineMessages[username] = kept
+	}
+	return count, nil
+}
+
+func (m *mockStorage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	if err := m.mockedError(ctx, "FetchOfflineMessage"); err != nil {
+		return nil, err
+	}
+	m.offlineMessagesMu.RLock()
+	defer m.offlineMessagesMu.RUnlock()
+	for _, msg := range m.offlineMessages[username] {
+		if msg.Node == node {
+			return &msg, nil
+		}
+	}
+	return nil, nil
+}
+
+func (m *mockStorage) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	if err := m.mockedError(ctx, "DeleteOfflineMessage"); err != nil {
+		return false, err
+	}
+	m.offlineMessagesMu.Lock()
+	defer m.offlineMessagesMu.Unlock()
+	msgs := m.offlineMessages[username]
+	for i, msg := range msgs {
+		if msg.Node != node {
+			continue
+		}
+		msgs = append(msgs[:i:i], msgs[i+1:]...)
+		if len(msgs) == 0 {
+			delete(m.offlineMessages, username)
+		} else {
+			m.offlineMessages[username] = msgs
+		}
+		return true, nil
+	}
+	return false, nil
+}
+
+// newOfflineMessage must be called with offlineMessagesMu held.
+func (m *mockStorage) newOfflineMessage(message xml.Element) model.OfflineMessage {
+	m.offlineSeq++
+	return model.OfflineMessage{
+		Message:    xml.NewElementFromElement(message),
+		Node:       strconv.Itoa(m.offlineSeq),
+		ReceivedAt: time.Now(),
+	}
+}
+
+func (m *mockStorage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	if err := m.mockedError(ctx, "InsertQuarantinedMessage"); err != nil {
+		return err
+	}
+	m.quarantinedMessagesMu.Lock()
+	defer m.quarantinedMessagesMu.Unlock()
+	m.quarantinedMessages[username] = append(m.quarantinedMessages[username], xml.NewElementFromElement(message))
+	return nil
+}
+
+func (m *mockStorage) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	if err := m.mockedError(ctx, "CountQuarantinedMessages"); err != nil {
+		return 0, err
+	}
+	m.quarantinedMessagesMu.RLock()
+	defer m.quarantinedMessagesMu.RUnlock()
+	return len(m.quarantinedMessages[username]), nil
+}
+
+func (m *mockStorage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	if err := m.mockedError(ctx, "FetchQuarantinedMessages"); err != nil {
+		return nil, err
+	}
+	m.quarantinedMessagesMu.RLock()
+	defer m.quarantinedMessagesMu.RUnlock()
+	return m.quarantinedMessages[username], nil
+}
+
+func (m *mockStorage) DeleteQuarantinedMessages(ctx context.Context, username string) error {
+	if err := m.mockedError(ctx, "DeleteQuarantinedMessages"); err != nil {
+		return err
+	}
+	m.quarantinedMessagesMu.Lock()
+	defer m.quarantinedMessagesMu.Unlock()
+	delete(m.quarantinedMessages, username)
+	return nil
+}
+
+func (m *mockStorage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	if err := m.mockedError(ctx, "InsertArchivedMessage"); err != nil {
+		return err
+	}
+	m.archiveMu.Lock()
+	defer m.archiveMu.Unlock()
+	m.archiveSeq++
+	message.ID = strconv.FormatUint(m.archiveSeq, 10)
+	am := *message
+	am.Message = xml.NewElementFromElement(message.Message)
+	m.archivedMessages[message.Username] = append(m.archivedMessages[message.Username], am)
+	return nil
+}
+
+func (m *mockStorage) FetchArchivedMessages(ctx context.Context, username string, filter *ArchiveFilter) ([]model.ArchivedMessage, error) {
+	if err := m.mockedError(ctx, "FetchArchivedMessages"); err != nil {
+		return nil, err
+	}
+	m.archiveMu.RLock()
+	defer m.archiveMu.RUnlock()
+	return filterArchivedMessages(m.archivedMessages[username], filter, func(id string) (uint64, bool) {
+		seq, err := strconv.ParseUint(id, 10, 64)
+		return seq, err == nil
+	}), nil
+}
+
+func (m *mockStorage) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateArchivePrefs"); err != nil {
+		return err
+	}
+	m.archiveMu.Lock()
+	defer m.archiveMu.Unlock()
+	m.archivePrefs[prefs.Username] = *prefs
+	return nil
+}
+
+func (m *mockStorage) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	if err := m.mockedError(ctx, "FetchArchivePrefs"); err != nil {
+		return nil, err
+	}
+	m.archiveMu.RLock()
+	defer m.archiveMu.RUnlock()
+	if prefs, ok := m.archivePrefs[username]; ok {
+		return &prefs, nil
+	}
+	return nil, nil
+}
+
+func (m *mockStorage) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if err := m.mockedError(ctx, "InsertBlockListItems"); err != nil {
+		return err
+	}
+	m.blockListMu.Lock()
+	defer m.blockListMu.Unlock()
+	for _, item := range items {
+		if indexOfBlockListItem(m.blockListItems[item.Username], item.JID) == -1 {
+			m.blockListItems[item.Username] = append(m.blockListItems[item.Username], item)
+		}
+	}
+	return nil
+}
+
+func (m *mockStorage) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if err := m.mockedError(ctx, "DeleteBlockListItems"); err != nil {
+		return err
+	}
+	m.blockListMu.Lock()
+	defer m.blockListMu.Unlock()
+	for _, item := range items {
+		blis := m.blockListItems[item.Username]
+		if i := indexOfBlockListItem(blis, item.JID); i != -1 {
+			m.blockListItems[item.Username] = append(blis[:i], blis[i+1:]...)
+		}
+	}
+	return nil
+}
+
+func (m *mockStorage) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	if err := m.mockedError(ctx, "FetchBlockListItems"); err != nil {
+		return nil, err
+	}
+	m.blockListMu.RLock()
+	defer m.blockListMu.RUnlock()
+	return append([]model.BlockListItem(nil), m.blockListItems[username]...), nil
+}
+
+func indexOfBlockListItem(blis []model.BlockListItem, jid string) int {
+	for i := range blis {
+		if blis[i].JID == jid {
+			return i
+		}
+	}
+	return -1
+}
+
+func (m *mockStorage) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	if err := m.mockedError(ctx, "InsertOrUpdatePrivacyList"); err != nil {
+		return err
+	}
+	m.privacyListsMu.Lock()
+	defer m.privacyListsMu.Unlock()
+	pl := *list
+	pl.Items = sortedPrivacyListItems(list.Items)
+
+	pls := m.privacyLists[list.Username]
+	for i := range pls {
+		if pls[i].Name == list.Name {
+			pl.Default = pls[i].Default
+			pls[i] = pl
+			return nil
+		}
+	}
+	pl.Default = false
+	pls = append(pls, pl)
+	sort.Slice(pls, func(i, j int) bool { return pls[i].Name < pls[j].Name })
+	m.privacyLists[list.Username] = pls
+	return nil
+}
+
+func (m *mockStorage) DeletePrivacyList(ctx context.Context, username, name string) error {
+	if err := m.mockedError(ctx, "DeletePrivacyList"); err != nil {
+		return err
+	}
+	m.privacyListsMu.Lock()
+	defer m.privacyListsMu.Unlock()
+	pls := m.privacyLists[username]
+	for i := range pls {
+		if pls[i].Name == name {
+			m.privacyLists[username] = append(pls[:i], pls[i+1:]...)
+			break
+		}
+	}
+	return nil
+}
+
+func (m *mockStorage) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	if err := m.mockedError(ctx, "FetchPrivacyLists"); err != nil {
+		return nil, err
+	}
+	m.privacyListsMu.RLock()
+	defer m.privacyListsMu.RUnlock()
+	return copyPrivacyLists(m.privacyLists[username]), nil
+}
+
+func (m *mockStorage) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	if err := m.mockedError(ctx, "SetDefaultPrivacyList"); err != nil {
+		return err
+	}
+	m.privacyListsMu.Lock()
+	defer m.privacyListsMu.Unlock()
+	pls := m.privacyLists[username]
+	for i := range pls {
+		pls[i].Default = pls[i].Name == name
+	}
+	return nil
+}
+
+func copyPrivacyLists(pls []model.PrivacyList) []model.PrivacyList {
+	var ret []model.PrivacyList
+	for _, pl := range pls {
+		pl.Items = append([]model.PrivacyListItem(nil), pl.Items...)
+		ret = append(ret, pl)
+	}
+	return ret
+}
+
+func (m *mockStorage) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	if err := m.mockedError(ctx, "InsertOrUpdateFeatureFlag"); err != nil {
+		return err
+	}
+	m.featureFlagsMu.Lock()
+	defer m.featureFlagsMu.Unlock()
+	ffs := m.featureFlags[ff.Username]
+	for i := range ffs {
+		if ffs[i].Name == ff.Name {
+			ffs[i] = *ff
+			return nil
+		}
+	}
+	m.featureFlags[ff.Username] = append(ffs, *ff)
+	return nil
+}
+
+func (m *mockStorage) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	if err := m.mockedError(ctx, "DeleteFeatureFlag"); err != nil {
+		return err
+	}
+	m.featureFlagsMu.Lock()
+	defer m.featureFlagsMu.Unlock()
+	ffs := m.featureFlags[username]
+	for i := range ffs {
+		if ffs[i].Name == name {
+			m.featureFlags[username] = append(ffs[:i], ffs[i+1:]...)
+			return nil
+		}
+	}
+	return nil
+}
+
+func (m *mockStorage) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	if err := m.mockedError(ctx, "FetchFeatureFlags"); err != nil {
+		return nil, err
+	}
+	m.featureFlagsMu.RLock()
+	defer m.featureFlagsMu.RUnlock()
+	return append([]model.FeatureFlag{}, m.featureFlags[username]...), nil
+}
+
+func (m *mockStorage) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	if err := m.mockedError(ctx, "InsertInvite"); err != nil {
+		return err
+	}
+	m.invitesMu.Lock()
+	defer m.invitesMu.Unlock()
+	m.invites[invite.Token] = *invite
+	return nil
+}
+
+func (m *mockStorage) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	if err := m.mockedError(ctx, "RedeemInvite"); err != nil {
+		return false, err
+	}
+	m.invitesMu.Lock()
+	defer m.invitesMu.Unlock()
+	inv, ok := m.invites[token]
+	if !ok || inv.Used || !now.Before(inv.ExpiresAt) {
+		return false, nil
+	}
+	inv.Used = true
+	m.invites[token] = inv
+	return true, nil
+}
+
+func (m *mockStorage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	if err := m.mockedError(ctx, "InsertStreamSession"); err != nil {
+		return err
+	}
+	ss := *session
+	ss.Unacked = append([]xml.Element(nil), session.Unacked...)
+
+	m.streamSessionsMu.Lock()
+	defer m.streamSessionsMu.Unlock()
+	sessions := m.streamSessions[session.ServerID]
+	for i := range sessions {
+		if sessions[i].ID == session.ID {
+			sessions[i] = ss
+			return nil
+		}
+	}
+	m.streamSessions[session.ServerID] = append(sessions, ss)
+	return nil
+}
+
+func (m *mockStorage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	if err := m.mockedError(ctx, "FetchStreamSessions"); err != nil {
+		return nil, err
+	}
+	m.streamSessionsMu.Lock()
+	defer m.streamSessionsMu.Unlock()
+	var sessions []model.StreamSession
+	for _, ss := range m.streamSessions[serverID] {
+		ss.Unacked = append([]xml.Element(nil), ss.Unacked...)
+		sessions = append(sessions, ss)
+	}
+	return sessions, nil
+}
+
+func (m *mockStorage) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	if err := m.mockedError(ctx, "DeleteStreamSessions"); err != nil {
+		return err
+	}
+	m.streamSessionsMu.Lock()
+	defer m.streamSessionsMu.Unlock()
+	delete(m.streamSessions, serverID)
+	return nil
+}
+
+// InTransaction satisfies Storage interface.
+//
+// Transactions are serialized by a coarse lock, and rolled back restoring
+// a snapshot of every collection taken right before running f. Hence, any
+// write made meanwhile from outside the transaction is lost on rollback.
+func (m *mockStorage) InTransaction(ctx context.Context, f func(tx Storage) error) error {
+	if err := m.mockedError(ctx, "InTransaction"); err != nil {
+		return err
+	}
+	m.txMu.Lock()
+	defer m.txMu.Unlock()
+
+	snapshot := m.snapshot()
+	if err := f(&mockStorageTx{m}); err != nil {
+		m.restore(snapshot)
+		return err
+	}
+	return nil
+}
+
+// mockStorageTx represents a mocked storage handle bound to a transaction.
+type mockStorageTx struct {
+	*mockStorage
+}
+
+// InTransaction joins the enclosing transaction.
+func (tx *mockStorageTx) InTransaction(ctx context.Context, f func(tx Storage) error) error {
+	return f(tx)
+}
+
+// snapshot returns a mocked storage holding a copy of every m collection.
+func (m *mockStorage) snapshot() *mockStorage {
+	s := newMockStorage()
+
+	m.usersMu.RLock()
+	for k, v := range m.users {
+		s.users[k] = v
+	}
+	m.usersMu.RUnlock()
+
+	m.rosterItemsMu.RLock()
+	for k, v := range m.rosterItems {
+		s.rosterItems[k] = append([]model.RosterItem(nil), v...)
+	}
+	for k, v := range m.rosterVersions {
+		s.rosterVersions[k] = v
+	}
+	for k, v := range m.rosterTombstones {
+		s.rosterTombstones[k] = append([]model.RosterTombstone(nil), v...)
+	}
+	m.rosterItemsMu.RUnlock()
+
+	m.rosterNotificationsMu.RLock()
+	for k, v := range m.rosterNotifications {
+		s.rosterNotifications[k] = append([]model.RosterNotification(nil), v...)
+	}
+	m.rosterNotificationsMu.RUnlock()
+
+	m.vCardsMu.RLock()
+	for k, v := range m.vCards {
+		s.vCards[k] = v
+	}
+	m.vCardsMu.RUnlock()
+
+	m.privateXMLMu.RLock()
+	copyElements(s.privateXML, m.privateXML)
+	m.privateXMLMu.RUnlock()
+
+	m.offlineMessagesMu.RLock()
+	for k, v := range m.offlineMessages {
+		s.offlineMessages[k] = append([]model.OfflineMessage(nil), v...)
+	}
+	m.offlineMessagesMu.RUnlock()
+
+	m.quarantinedMessagesMu.RLock()
+	copyElements(s.quarantinedMessages, m.quarantinedMessages)
+	m.quarantinedMessagesMu.RUnlock()
+
+	m.archiveMu.RLock()
+	for k, v := range m.archivedMessages {
+		s.archivedMessages[k] = append([]model.ArchivedMessage(nil), v...)
+	}
+	for k, v := range m.archivePrefs {
+		s.archivePrefs[k] = v
+	}
+	m.archiveMu.RUnlock()
+
+	m.blockListMu.RLock()
+	for k, v := range m.blockListItems {
+		s.blockListItems[k] = append([]model.BlockListItem(nil), v...)
+	}
+	m.blockListMu.RUnlock()
+
+	m.privacyListsMu.RLock()
+	for k, v := range m.privacyLists {
+		s.privacyLists[k] = copyPrivacyLists(v)
+	}
+	m.privacyListsMu.RUnlock()
+
+	m.featureFlagsMu.RLock()
+	for k, v := range m.featureFlags {
+		s.featureFlags[k] = append([]model.FeatureFlag(nil), v...)
+	}
+	m.featureFlagsMu.RUnlock()
+
+	m.invitesMu.Lock()
+	for k, v := range m.invites {
+		s.invites[k] = v
+	}
+	m.invitesMu.Unlock()
+
+	m.streamSessionsMu.Lock()
+	for k, v := range m.streamSessions {
+		s.streamSessions[k] = append([]model.StreamSession(nil), v...)
+	}
+	m.streamSessionsMu.Unlock()
+	return s
+}
+
+// restore replaces every m collection with those held by s.
+func (m *mockStorage) restore(s *mockStorage) {
+	m.usersMu.Lock()
+	m.users = s.users
+	m.usersMu.Unlock()
+
+	m.rosterItemsMu.Lock()
+	m.rosterItems = s.rosterItems
+	m.rosterVersions = s.rosterVersions
+	m.rosterTombstones = s.rosterTombstones
+	m.rosterItemsMu.Unlock()
+
+	m.rosterNotificationsMu.Lock()
+	m.rosterNotifications = s.rosterNotifications
+	m.rosterNotificationsMu.Unlock()
+
+	m.vCardsMu.Lock()
+	m.vCards = s.vCards
+	m.vCardsMu.Unlock()
+
+	m.privateXMLMu.Lock()
+	m.privateXML = s.privateXML
+	m.privateXMLMu.Unlock()
+
+	m.offlineMessagesMu.Lock()
+	m.offlineMessages = s.offlineMessages
+	m.offlineMessagesMu.Unlock()
+
+	m.quarantinedMessagesMu.Lock()
+	m.quarantinedMessages = s.quarantinedMessages
+	m.quarantinedMessagesMu.Unlock()
+
+	m.archiveMu.Lock()
+	m.archivedMessages = s.archivedMessages
+	m.archivePrefs = s.archivePrefs
+	m.archiveMu.Unlock()
+
+	m.blockListMu.Lock()
+	m.blockListItems = s.blockListItems
+	m.blockListMu.Unlock()
+
+	m.privacyListsMu.Lock()
+	m.privacyLists = s.privacyLists
+	m.privacyListsMu.Unlock()
+
+	m.featureFlagsMu.Lock()
+	m.featureFlags = s.featureFlags
+	m.featureFlagsMu.Unlock()
+
+	m.invitesMu.Lock()
+	m.invites = s.invites
+	m.invitesMu.Unlock()
+
+	m.streamSessionsMu.Lock()
+	m.streamSessions = s.streamSessions
+	m.streamSessionsMu.Unlock()
+}
+
+func copyElements(dst, src map[string][]xml.Element) {
+	for k, v := range src {
+		dst[k] = append([]xml.Element(nil), v...)
+	}
+}
+
+func (m *mockStorage) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	if err := m.mockedError(ctx, "Usage"); err != nil {
+		return nil, err
+	}
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	// sizes are those of the binary representation of every entity
+	size := func(f func()) int64 {
+		buf.Reset()
+		f()
+		return int64(buf.Len())
+	}
+	elementsUsage := func(entity string, elements []xml.Element) model.EntityUsage {
+		u := model.EntityUsage{Entity: entity, Rows: int64(len(elements))}
+		for _, elem := range elements {
+			u.Bytes += size(func() { elem.ToBytes(buf) })
+		}
+		return u
+	}
+	var usage []model.EntityUsage
+
+	m.archiveMu.RLock()
+	u := model.EntityUsage{Entity: "archive_prefs"}
+	for _, prefs := range m.archivePrefs {
+		u.Rows++
+		u.Bytes += size(func() { prefs.ToBytes(buf) })
+	}
+	usage = append(usage, u)
+	u = model.EntityUsage{Entity: "archived_messages"}
+	for _, msgs := range m.archivedMessages {
+		for i := range msgs {
+			u.Rows++
+			u.Bytes += size(func() { msgs[i].ToBytes(buf) })
+		}
+	}
+	m.archiveMu.RUnlock()
+	usage = append(usage, u)
+
+	m.blockListMu.RLock()
+	u = model.EntityUsage{Entity: "block_list_items"}
+	for _, blis := range m.blockListItems {
+		for i := range blis {
+			u.Rows++
+			u.Bytes += size(func() { blis[i].ToBytes(buf) })
+		}
+	}
+	m.blockListMu.RUnlock()
+	usage = append(usage, u)
+
+	m.featureFlagsMu.RLock()
+	u = model.EntityUsage{Entity: "feature_flags"}
+	for _, ffs := range m.featureFlags {
+		for i := range ffs {
+			u.Rows++
+			u.Bytes += size(func() { ffs[i].ToBytes(buf) })
+		}
+	}
+	m.featureFlagsMu.RUnlock()
+	usage = append(usage, u)
+
+	m.invitesMu.Lock()
+	u = model.EntityUsage{Entity: "invites"}
+	for _, inv := range m.invites {
+		u.Rows++
+		u.Bytes += size(func() { inv.ToBytes(buf) })
+	}
+	m.invitesMu.Unlock()
+	usage = append(usage, u)
+
+	m.offlineMessagesMu.RLock()
+	var messages []xml.Element
+	for _, msgs := range m.offlineMessages {
+		for _, msg := range msgs {
+			messages = append(messages, msg.Message)
+		}
+	}
+	m.offlineMessagesMu.RUnlock()
+	usage = append(usage, elementsUsage("offline_messages", messages))
+
+	m.privacyListsMu.RLock()
+	u = model.EntityUsage{Entity: "privacy_lists"}
+	for _, pls := range m.privacyLists {
+		for i := range pls {
+			u.Rows++
+			u.Bytes += size(func() { pls[i].ToBytes(buf) })
+		}
+	}
+	m.privacyListsMu.RUnlock()
+	usage = append(usage, u)
+
+	m.privateXMLMu.RLock()
+	var privateElements []xml.Element
+	for _, elems := range m.privateXML {
+		privateElements = append(privateElements, elems...)
+	}
+	m.privateXMLMu.RUnlock()
+	usage = append(usage, elementsUsage("private_storage", privateElements))
+
+	m.quarantinedMessagesMu.RLock()
+	var quarantined []xml.Element
+	for _, msgs := range m.quarantinedMessages {
+		quarantined = append(quarantined, msgs...)
+	}
+	m.quarantinedMessagesMu.RUnlock()
+	usage = append(usage, elementsUsage("quarantined_messages", quarantined))
+
+	m.rosterItemsMu.RLock()
+	u = model.EntityUsage{Entity: "roster_items"}
+	for _, ris := range m.rosterItems {
+		for i := range ris {
+			u.Rows++
+			u.Bytes += size(func() { ris[i].ToBytes(buf) })
+		}
+	}
+	tombstones := model.EntityUsage{Entity: "roster_tombstones"}
+	for _, rts := range m.rosterTombstones {
+		for i := range rts {
+			tombstones.Rows++
+			tombstones.Bytes += size(func() { rts[i].ToBytes(buf) })
+		}
+	}
+	versions := model.EntityUsage{Entity: "roster_versions"}
+	for _, rv := range m.rosterVersions {
+		versions.Rows++
+		versions.Bytes += size(func() { rv.ToBytes(buf) })
+	}
+	m.rosterItemsMu.RUnlock()
+	usage = append(usage, u)
+
+	m.rosterNotificationsMu.RLock()
+	u = model.EntityUsage{Entity: "roster_notifications"}
+	for _, rns := range m.rosterNotifications {
+		for i := range rns {
+			u.Rows++
+			u.Bytes += size(func() { rns[i].ToBytes(buf) })
+		}
+	}
+	m.rosterNotificationsMu.RUnlock()
+	usage = append(usage, u, tombstones, versions)
+
+	m.streamSessionsMu.Lock()
+	u = model.EntityUsage{Entity: "stream_sessions"}
+	for _, sessions := range m.streamSessions {
+		for i := range sessions {
+			u.Rows++
+			u.Bytes += size(func() { sessions[i].ToBytes(buf) })
+		}
+	}
+	m.streamSessionsMu.Unlock()
+	usage = append(usage, u)
+
+	m.usersMu.RLock()
+	u = model.EntityUsage{Entity: "users"}
+	for _, usr := range m.users {
+		u.Rows++
+		u.Bytes += size(func() { usr.ToBytes(buf) })
+	}
+	m.usersMu.RUnlock()
+	usage = append(usage, u)
+
+	m.vCardsMu.RLock()
+	var vCards []xml.Element
+	for _, vCard := range m.vCards {
+		vCards = append(vCards, vCard)
+	}
+	m.vCardsMu.RUnlock()
+	usage = append(usage, elementsUsage("vcards", vCards))
+
+	return usage, nil
+}
@@ -6,8 +6,11 @@
 package storage
 
 import (
+	"context"
 	"testing"
+	"time"
 
+	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
@@ -18,82 +21,115 @@ func TestMockStorageInsertUser(t *testing.T) {
 	u := model.User{Username: "ortuman", Password: "1234"}
 	s := newMockStorage()
 	s.activateMockedError()
-	err := s.InsertOrUpdateUser(&u)
+	err := s.InsertOrUpdateUser(context.Background(), &u)
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	err = s.InsertOrUpdateUser(&u)
+	err = s.InsertOrUpdateUser(context.Background(), &u)
 	require.Nil(t, err)
 }
 
 func TestMockStorageUserExists(t *testing.T) {
 	s := newMockStorage()
 	s.activateMockedError()
-	ok, err := s.UserExists("ortuman")
+	ok, err := s.UserExists(context.Background(), "ortuman")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	ok, err = s.UserExists("ortuman")
+	ok, err = s.UserExists(context.Background(), "ortuman")
 	require.Nil(t, err)
 	require.False(t, ok)
 }
 
+func TestMockStorageCountUsers(t *testing.T) {
+	s := newMockStorage()
+	_ = s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
+	_ = s.InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "1234"})
+
+	s.activateMockedError()
+	_, err := s.CountUsers(context.Background())
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+	cnt, err := s.CountUsers(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 2, cnt)
+}
+
+func TestMockStorageFetchPurgeableUsers(t *testing.T) {
+	now := time.Now()
+	s := newMockStorage()
+	_ = s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
+	_ = s.InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "1234", PurgeAt: now.Add(-time.Hour)})
+	_ = s.InsertOrUpdateUser(context.Background(), &model.User{Username: "juliet", Password: "1234", PurgeAt: now.Add(time.Hour)})
+
+	s.activateMockedError()
+	_, err := s.FetchPurgeableUsers(context.Background(), now)
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+	usernames, err := s.FetchPurgeableUsers(context.Background(), now)
+	require.Nil(t, err)
+	require.Equal(t, []string{"romeo"}, usernames)
+}
+
 func TestMockStorageFetchUser(t *testing.T) {
 	u := model.User{Username: "ortuman", Password: "1234"}
 	s := newMockStorage()
-	_ = s.InsertOrUpdateUser(&u)
+	_ = s.InsertOrUpdateUser(context.Background(), &u)
 
 	s.activateMockedError()
-	_, err := s.FetchUser("ortuman")
+	_, err := s.FetchUser(context.Background(), "ortuman")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	usr, _ := s.FetchUser("romeo")
+	usr, _ := s.FetchUser(context.Background(), "romeo")
 	require.Nil(t, usr)
-	usr, _ = s.FetchUser("ortuman")
+	usr, _ = s.FetchUser(context.Background(), "ortuman")
 	require.NotNil(t, usr)
 }
 
 func TestMockStorageDeleteUser(t *testing.T) {
 	u := model.User{Username: "ortuman", Password: "1234"}
 	s := newMockStorage()
-	_ = s.InsertOrUpdateUser(&u)
+	_ = s.InsertOrUpdateUser(context.Background(), &u)
+	_ = s.InsertOrUpdateVCard(context.Background(), xml.NewElementNamespace("vCard", "vcard-temp"), "ortuman")
 
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.DeleteUser("ortuman"))
+	require.Equal(t, ErrMockedError, s.DeleteUser(context.Background(), "ortuman"))
 	s.deactivateMockedError()
-	require.Nil(t, s.DeleteUser("ortuman"))
+	require.Nil(t, s.DeleteUser(context.Background(), "ortuman"))
 
-	usr, _ := s.FetchUser("ortuman")
+	usr, _ := s.FetchUser(context.Background(), "ortuman")
 	require.Nil(t, usr)
+	vCard, _ := s.FetchVCard(context.Background(), "ortuman")
+	require.Nil(t, vCard)
 }
 
 func TestMockStorageInsertRosterItem(t *testing.T) {
 	g := []string{"general", "friends"}
-	ri := model.RosterItem{"user", "contact", "a name", "both", false, g}
+	ri := model.RosterItem{User: "user", Contact: "contact", Name: "a name", Subscription: "both", Groups: g}
 
 	s := newMockStorage()
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.InsertOrUpdateRosterItem(&ri))
+	require.Equal(t, ErrMockedError, s.InsertOrUpdateRosterItem(context.Background(), &ri))
 	s.deactivateMockedError()
-	require.Nil(t, s.InsertOrUpdateRosterItem(&ri))
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &ri))
 	ri.Subscription = "to"
-	require.Nil(t, s.InsertOrUpdateRosterItem(&ri))
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &ri))
 }
 
 func TestMockStorageFetchRosterItem(t *testing.T) {
 	g := []string{"general", "friends"}
-	ri := model.RosterItem{"user", "contact", "a name", "both", false, g}
+	ri := model.RosterItem{User: "user", Contact: "contact", Name: "a name", Subscription: "both", Groups: g}
 
 	s := newMockStorage()
-	s.InsertOrUpdateRosterItem(&ri)
+	s.InsertOrUpdateRosterItem(context.Background(), &ri)
 
 	s.activateMockedError()
-	_, err := s.FetchRosterItem("user", "contact")
+	_, err := s.FetchRosterItem(context.Background(), "user", "contact")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
 
-	ri3, _ := s.FetchRosterItem("user", "contact2")
+	ri3, _ := s.FetchRosterItem(context.Background(), "user", "contact2")
 	require.Nil(t, ri3)
 
-	ri4, _ := s.FetchRosterItem("user", "contact")
+	ri4, _ := s.FetchRosterItem(context.Background(), "user", "contact")
 	require.NotNil(t, ri4)
 	require.Equal(t, "user", ri4.User)
 	require.Equal(t, "contact", ri4.Contact)
@@ -101,34 +137,34 @@ func TestMockStorageFetchRosterItem(t *testing.T) {
 
 func TestMockStorageFetchRosterItems(t *testing.T) {
 	g := []string{"general", "friends"}
-	ri := model.RosterItem{"user", "contact", "a name", "both", false, g}
-	ri2 := model.RosterItem{"user", "contact2", "a name 2", "both", false, g}
+	ri := model.RosterItem{User: "user", Contact: "contact", Name: "a name", Subscription: "both", Groups: g}
+	ri2 := model.RosterItem{User: "user", Contact: "contact2", Name: "a name 2", Subscription: "both", Groups: g}
 
 	s := newMockStorage()
-	s.InsertOrUpdateRosterItem(&ri)
-	s.InsertOrUpdateRosterItem(&ri2)
+	s.InsertOrUpdateRosterItem(context.Background(), &ri)
+	s.InsertOrUpdateRosterItem(context.Background(), &ri2)
 
 	s.activateMockedError()
-	_, err := s.FetchRosterItems("user")
+	_, err := s.FetchRosterItems(context.Background(), "user")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	ris, _ := s.FetchRosterItems("user")
+	ris, _ := s.FetchRosterItems(context.Background(), "user")
 	require.Equal(t, 2, len(ris))
 }
 
 func TestMockStorageDeleteRosterItem(t *testing.T) {
 	g := []string{"general", "friends"}
-	ri := model.RosterItem{"user", "contact", "a name", "both", false, g}
+	ri := model.RosterItem{User: "user", Contact: "contact", Name: "a name", Subscription: "both", Groups: g}
 	s := newMockStorage()
-	s.InsertOrUpdateRosterItem(&ri)
+	s.InsertOrUpdateRosterItem(context.Background(), &ri)
 
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.DeleteRosterItem("user", "contact"))
+	require.Equal(t, ErrMockedError, s.DeleteRosterItem(context.Background(), "user", "contact"))
 	s.deactivateMockedError()
-	require.Nil(t, s.DeleteRosterItem("user", "contact"))
-	require.Nil(t, s.DeleteRosterItem("user2", "contact")) // delete not existing roster item...
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "user", "contact"))
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "user2", "contact")) // delete not existing roster item...
 
-	ri2, _ := s.FetchRosterItem("user", "contact")
+	ri2, _ := s.FetchRosterItem(context.Background(), "user", "contact")
 	require.Nil(t, ri2)
 }
 
@@ -140,9 +176,9 @@ func TestMockStorageInsertRosterNotification(t *testing.T) {
 	}
 	s := newMockStorage()
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.InsertOrUpdateRosterNotification(&rn))
+	require.Equal(t, ErrMockedError, s.InsertOrUpdateRosterNotification(context.Background(), &rn))
 	s.deactivateMockedError()
-	require.Nil(t, s.InsertOrUpdateRosterNotification(&rn))
+	require.Nil(t, s.InsertOrUpdateRosterNotification(context.Background(), &rn))
 }
 
 func TestMockStorageFetchRosterNotifications(t *testing.T) {
@@ -157,17 +193,17 @@ func TestMockStorageFetchRosterNotifications(t *testing.T) {
 		[]xml.Element{xml.NewElementName("priority")},
 	}
 	s := newMockStorage()
-	s.InsertOrUpdateRosterNotification(&rn1)
-	s.InsertOrUpdateRosterNotification(&rn2)
+	s.InsertOrUpdateRosterNotification(context.Background(), &rn1)
+	s.InsertOrUpdateRosterNotification(context.Background(), &rn2)
 
 	rn2.Elements = []xml.Element{xml.NewElementName("status")}
-	s.InsertOrUpdateRosterNotification(&rn2)
+	s.InsertOrUpdateRosterNotification(context.Background(), &rn2)
 
 	s.activateMockedError()
-	_, err := s.FetchRosterNotifications("romeo")
+	_, err := s.FetchRosterNotifications(context.Background(), "romeo")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	rns, err := s.FetchRosterNotifications("romeo")
+	rns, err := s.FetchRosterNotifications(context.Background(), "romeo")
 	require.Nil(t, err)
 	require.Equal(t, 2, len(rns))
 	require.Equal(t, "ortuman", rns[0].User)
@@ -181,18 +217,18 @@ func TestMockStorageDeleteRosterNotification(t *testing.T) {
 		[]xml.Element{xml.NewElementName("priority")},
 	}
 	s := newMockStorage()
-	s.InsertOrUpdateRosterNotification(&rn1)
+	s.InsertOrUpdateRosterNotification(context.Background(), &rn1)
 
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.DeleteRosterNotification("ortuman", "romeo"))
+	require.Equal(t, ErrMockedError, s.DeleteRosterNotification(context.Background(), "ortuman", "romeo"))
 	s.deactivateMockedError()
-	require.Nil(t, s.DeleteRosterNotification("ortuman", "romeo"))
+	require.Nil(t, s.DeleteRosterNotification(context.Background(), "ortuman", "romeo"))
 
-	rns, err := s.FetchRosterNotifications("romeo")
+	rns, err := s.FetchRosterNotifications(context.Background(), "romeo")
 	require.Nil(t, err)
 	require.Equal(t, 0, len(rns))
 	// delete not existing roster notification...
-	require.Nil(t, s.DeleteRosterNotification("ortuman2", "romeo"))
+	require.Nil(t, s.DeleteRosterNotification(context.Background(), "ortuman2", "romeo"))
 }
 
 func TestMockStorageInsertVCard(t *testing.T) {
@@ -203,9 +239,9 @@ func TestMockStorageInsertVCard(t *testing.T) {
 
 	s := newMockStorage()
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.InsertOrUpdateVCard(vCard, "ortuman"))
+	require.Equal(t, ErrMockedError, s.InsertOrUpdateVCard(context.Background(), vCard, "ortuman"))
 	s.deactivateMockedError()
-	require.Nil(t, s.InsertOrUpdateVCard(vCard, "ortuman"))
+	require.Nil(t, s.InsertOrUpdateVCard(context.Background(), vCard, "ortuman"))
 }
 
 func TestMockStorageFetchVCard(t *testing.T) {
@@ -215,13 +251,13 @@ func TestMockStorageFetchVCard(t *testing.T) {
 	vCard.AppendElement(fn)
 
 	s := newMockStorage()
-	s.InsertOrUpdateVCard(vCard, "ortuman")
+	s.InsertOrUpdateVCard(context.Background(), vCard, "ortuman")
 
 	s.activateMockedError()
-	_, err := s.FetchVCard("ortuman")
+	_, err := s.FetchVCard(context.Background(), "ortuman")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	elem, _ := s.FetchVCard("ortuman")
+	elem, _ := s.FetchVCard(context.Background(), "ortuman")
 	require.NotNil(t, elem)
 }
 
@@ -230,10 +266,10 @@ func TestMockStorageInsertPrivateXML(t *testing.T) {
 
 	s := newMockStorage()
 	s.activateMockedError()
-	err := s.InsertOrUpdatePrivateXML([]xml.Element{private}, "exodus:ns", "ortuman")
+	err := s.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{private}, "exodus:ns", "ortuman")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	err = s.InsertOrUpdatePrivateXML([]xml.Element{private}, "exodus:ns", "ortuman")
+	err = s.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{private}, "exodus:ns", "ortuman")
 	require.Nil(t, err)
 }
 
@@ -241,13 +277,13 @@ func TestMockStorageFetchPrivateXML(t *testing.T) {
 	private := xml.NewElementNamespace("exodus", "exodus:ns")
 
 	s := newMockStorage()
-	s.InsertOrUpdatePrivateXML([]xml.Element{private}, "exodus:ns", "ortuman")
+	s.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{private}, "exodus:ns", "ortuman")
 
 	s.activateMockedError()
-	_, err := s.FetchPrivateXML("exodus:ns", "ortuman")
+	_, err := s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	elems, _ := s.FetchPrivateXML("exodus:ns", "ortuman")
+	elems, _ := s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Equal(t, 1, len(elems))
 }
 
@@ -260,9 +296,9 @@ func TestMockStorageInsertOfflineMessage(t *testing.T) {
 
 	s := newMockStorage()
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.InsertOfflineMessage(m, "ortuman"))
+	require.Equal(t, ErrMockedError, s.InsertOfflineMessage(context.Background(), m, "ortuman"))
 	s.deactivateMockedError()
-	require.Nil(t, s.InsertOfflineMessage(m, "ortuman"))
+	require.Nil(t, s.InsertOfflineMessage(context.Background(), m, "ortuman"))
 }
 
 func TestMockStorageCountOfflineMessages(t *testing.T) {
@@ -273,13 +309,13 @@ func TestMockStorageCountOfflineMessages(t *testing.T) {
 	m, _ := xml.NewMessageFromElement(message, j, j)
 
 	s := newMockStorage()
-	s.InsertOfflineMessage(m, "ortuman")
+	s.InsertOfflineMessage(context.Background(), m, "ortuman")
 
 	s.activateMockedError()
-	_, err := s.CountOfflineMessages("ortuman")
+	_, err := s.CountOfflineMessages(context.Background(), "ortuman")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	cnt, _ := s.CountOfflineMessages("ortuman")
+	cnt, _ := s.CountOfflineMessages(context.Background(), "ortuman")
 	require.Equal(t, 1, cnt)
 }
 
@@ -291,13 +327,13 @@ func TestMockStorageFetchOfflineMessages(t *testing.T) {
 	m, _ := xml.NewMessageFromElement(message, j, j)
 
 	s := newMockStorage()
-	s.InsertOfflineMessage(m, "ortuman")
+	s.InsertOfflineMessage(context.Background(), m, "ortuman")
 
 	s.activateMockedError()
-	_, err := s.FetchOfflineMessages("ortuman")
+	_, err := s.FetchOfflineMessages(context.Background(), "ortuman")
 	require.Equal(t, ErrMockedError, err)
 	s.deactivateMockedError()
-	elems, _ := s.FetchOfflineMessages("ortuman")
+	elems, _ := s.FetchOfflineMessages(context.Background(), "ortuman")
 	require.Equal(t, 1, len(elems))
 }
 
@@ -309,13 +345,296 @@ func TestMockStorageDeleteOfflineMessages(t *testing.T) {
 	m, _ := xml.NewMessageFromElement(message, j, j)
 
 	s := newMockStorage()
-	s.InsertOfflineMessage(m, "ortuman")
+	s.InsertOfflineMessage(context.Background(), m, "ortuman")
 
 	s.activateMockedError()
-	require.Equal(t, ErrMockedError, s.DeleteOfflineMessages("ortuman"))
+	require.Equal(t, ErrMockedError, s.DeleteOfflineMessages(context.Background(), "ortuman"))
 	s.deactivateMockedError()
-	require.Nil(t, s.DeleteOfflineMessages("ortuman"))
+	require.Nil(t, s.DeleteOfflineMessages(context.Background(), "ortuman"))
 
-	elems, _ := s.FetchOfflineMessages("ortuman")
+	elems, _ := s.FetchOfflineMessages(context.Background(), "ortuman")
 	require.Equal(t, 0, len(elems))
 }
+
+func TestMockStorageFeatureFlags(t *testing.T) {
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "carbons", Username: "ortuman"}))
+	require.Equal(t, ErrMockedError, s.DeleteFeatureFlag(context.Background(), "carbons", "ortuman"))
+	_, err := s.FetchFeatureFlags(context.Background(), "ortuman")
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	require.Nil(t, s.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "carbons", Username: "ortuman"}))
+	require.Nil(t, s.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "carbons", Username: "ortuman", Enabled: true}))
+	require.Nil(t, s.InsertOrUpdateFeatureFlag(context.Background(), &model.FeatureFlag{Name: "mam", Username: "ortuman"}))
+
+	ffs, _ := s.FetchFeatureFlags(context.Background(), "ortuman")
+	require.Equal(t, 2, len(ffs))
+	require.True(t, ffs[0].Enabled)
+
+	require.Nil(t, s.DeleteFeatureFlag(context.Background(), "carbons", "ortuman"))
+	ffs, _ = s.FetchFeatureFlags(context.Background(), "ortuman")
+	require.Equal(t, []model.FeatureFlag{{Name: "mam", Username: "ortuman"}}, ffs)
+}
+
+func TestMockStorageBlockList(t *testing.T) {
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertBlockListItems(context.Background(), []model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}}))
+	require.Equal(t, ErrMockedError, s.DeleteBlockListItems(context.Background(), []model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}}))
+	_, err := s.FetchBlockListItems(context.Background(), "ortuman")
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	require.Nil(t, s.InsertBlockListItems(context.Background(), []model.BlockListItem{
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "jabber.org"},
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+	}))
+	blis, _ := s.FetchBlockListItems(context.Background(), "ortuman")
+	require.Equal(t, 2, len(blis))
+
+	require.Nil(t, s.DeleteBlockListItems(context.Background(), []model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}}))
+	blis, _ = s.FetchBlockListItems(context.Background(), "ortuman")
+	require.Equal(t, []model.BlockListItem{{Username: "ortuman", JID: "jabber.org"}}, blis)
+}
+
+func TestMockStoragePrivacyLists(t *testing.T) {
+	pl := model.PrivacyList{
+		Username: "ortuman",
+		Name:     "invisible",
+		Items:    []model.PrivacyListItem{{Action: "deny", Order: 1, PresenceOut: true}},
+	}
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertOrUpdatePrivacyList(context.Background(), &pl))
+	require.Equal(t, ErrMockedError, s.DeletePrivacyList(context.Background(), "ortuman", "invisible"))
+	require.Equal(t, ErrMockedError, s.SetDefaultPrivacyList(context.Background(), "ortuman", "invisible"))
+	_, err := s.FetchPrivacyLists(context.Background(), "ortuman")
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	require.Nil(t, s.InsertOrUpdatePrivacyList(context.Background(), &pl))
+	require.Nil(t, s.SetDefaultPrivacyList(context.Background(), "ortuman", "invisible"))
+	pls, _ := s.FetchPrivacyLists(context.Background(), "ortuman")
+	require.Equal(t, 1, len(pls))
+	require.True(t, pls[0].Default)
+
+	// fetched lists don't share items with stored ones
+	pls[0].Items[0].Action = "allow"
+	pls, _ = s.FetchPrivacyLists(context.Background(), "ortuman")
+	require.Equal(t, "deny", pls[0].Items[0].Action)
+
+	require.Nil(t, s.DeletePrivacyList(context.Background(), "ortuman", "invisible"))
+	pls, _ = s.FetchPrivacyLists(context.Background(), "ortuman")
+	require.Equal(t, 0, len(pls))
+}
+
+func TestMockStorageInvites(t *testing.T) {
+	now := time.Now()
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertInvite(context.Background(), &model.Invite{Token: "abcd", ExpiresAt: now.Add(time.Hour)}))
+	_, err := s.RedeemInvite(context.Background(), "abcd", now)
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	require.Nil(t, s.InsertInvite(context.Background(), &model.Invite{Token: "abcd", CreatedBy: "ortuman", ExpiresAt: now.Add(time.Hour)}))
+	ok, err := s.RedeemInvite(context.Background(), "abcd", now)
+	require.Nil(t, err)
+	require.True(t, ok)
+	ok, _ = s.RedeemInvite(context.Background(), "abcd", now)
+	require.False(t, ok)
+}
+
+func TestMockStorageStreamSessions(t *testing.T) {
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertStreamSession(context.Background(), &model.StreamSession{ID: "abcd", ServerID: "default"}))
+	_, err := s.FetchStreamSessions(context.Background(), "default")
+	require.Equal(t, ErrMockedError, err)
+	require.Equal(t, ErrMockedError, s.DeleteStreamSessions(context.Background(), "default"))
+	s.deactivateMockedError()
+
+	unacked := []xml.Element{xml.NewElementName("message")}
+	require.Nil(t, s.InsertStreamSession(context.Background(), &model.StreamSession{ID: "abcd", ServerID: "default", Unacked: unacked}))
+	sessions, err := s.FetchStreamSessions(context.Background(), "default")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(sessions))
+
+	// returned sessions don't alias stored ones
+	sessions[0].Unacked[0] = nil
+	sessions, _ = s.FetchStreamSessions(context.Background(), "default")
+	require.NotNil(t, sessions[0].Unacked[0])
+
+	require.Nil(t, s.DeleteStreamSessions(context.Background(), "default"))
+	sessions, _ = s.FetchStreamSessions(context.Background(), "default")
+	require.Equal(t, 0, len(sessions))
+}
+
+func TestMockStorageQuarantinedMessages(t *testing.T) {
+	m := xml.NewMessageType(uuid.New(), xml.ChatType)
+
+	s := newMockStorage()
+	s.activateMockedError()
+	require.Equal(t, ErrMockedError, s.InsertQuarantinedMessage(context.Background(), m, "ortuman"))
+	_, err := s.CountQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, ErrMockedError, err)
+	_, err = s.FetchQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, ErrMockedError, err)
+	require.Equal(t, ErrMockedError, s.DeleteQuarantinedMessages(context.Background(), "ortuman"))
+	s.deactivateMockedError()
+
+	require.Nil(t, s.InsertQuarantinedMessage(context.Background(), m, "ortuman"))
+	cnt, _ := s.CountQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, 1, cnt)
+	elems, _ := s.FetchQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, m.ID(), elems[0].ID())
+
+	require.Nil(t, s.DeleteQuarantinedMessages(context.Background(), "ortuman"))
+	elems, _ = s.FetchQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, 0, len(elems))
+}
+
+func TestMockStorageUsage(t *testing.T) {
+	s := newMockStorage()
+	s.activateMockedError()
+	_, err := s.Usage(context.Background())
+	require.Equal(t, ErrMockedError, err)
+	s.deactivateMockedError()
+
+	usr := model.User{Username: "ortuman", Password: "1234"}
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &usr))
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "noelia", Password: "4321"}))
+	msg := xml.NewElementNamespace("message", "jabber:client")
+	require.Nil(t, s.InsertOfflineMessage(context.Background(), msg, "ortuman"))
+
+	usage, err := s.Usage(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 16, len(usage))
+
+	byEntity := make(map[string]model.EntityUsage)
+	for _, u := range usage {
+		byEntity[u.Entity] = u
+	}
+	require.Equal(t, int64(2), byEntity["users"].Rows)
+	require.True(t, byEntity["users"].Bytes > 0)
+	require.Equal(t, int64(1), byEntity["offline_messages"].Rows)
+	require.True(t, byEntity["offline_messages"].Bytes > 0)
+	require.Equal(t, model.EntityUsage{Entity: "vcards"}, byEntity["vcards"])
+}
+
+func TestMockStorageContext(t *testing.T) {
+	s := newMockStorage()
+	s.setMockedLatency(time.Hour)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := s.UserExists(ctx, "ortuman")
+	require.Equal(t, context.DeadlineExceeded, err)
+	require.True(t, time.Since(start) < time.Second)
+
+	ctx, cancel = context.WithCancel(context.Background())
+	cancel()
+	require.Equal(t, context.Canceled, s.InsertOrUpdateUser(ctx, &model.User{Username: "ortuman"}))
+
+	s.setMockedLatency(0)
+	exists, err := s.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.False(t, exists)
+}
+
+func TestMockStorageMockedErrorFor(t *testing.T) {
+	Initialize(&config.Storage{Type: config.Mock})
+	defer Shutdown()
+
+	ctx := context.Background()
+	s := Instance()
+
+	// armed operations fail on every call...
+	ActivateMockedErrorFor("InsertOrUpdateUser")
+	require.Equal(t, ErrMockedError, s.InsertOrUpdateUser(ctx, &model.User{Username: "ortuman"}))
+	require.Equal(t, ErrMockedError, s.InsertOrUpdateUser(ctx, &model.User{Username: "ortuman"}))
+	_, err := s.FetchUser(ctx, "ortuman")
+	require.Nil(t, err)
+
+	DeactivateMockedError()
+	require.Nil(t, s.InsertOrUpdateUser(ctx, &model.User{Username: "ortuman"}))
+
+	// ...or only on the next ones
+	ActivateMockedErrorForNext("FetchUser", 2)
+	for i := 0; i < 2; i++ {
+		_, err = s.FetchUser(ctx, "ortuman")
+		require.Equal(t, ErrMockedError, err)
+	}
+	usr, err := s.FetchUser(ctx, "ortuman")
+	require.Nil(t, err)
+	require.NotNil(t, usr)
+
+	// global activation still applies
+	ActivateMockedError()
+	_, err = s.FetchUser(ctx, "ortuman")
+	require.Equal(t, ErrMockedError, err)
+	DeactivateMockedError()
+
+	require.Equal(t, 3, MockedCalls("InsertOrUpdateUser"))
+	require.Equal(t, 5, MockedCalls("FetchUser"))
+	ResetMockedCalls()
+	require.Equal(t, 0, MockedCalls("FetchUser"))
+}
+
+func TestQueryContext(t *testing.T) {
+	Initialize(&config.Storage{Type: config.Mock, QueryTimeout: 1})
+	defer Shutdown()
+
+	SetMockedLatency(time.Hour)
+	defer SetMockedLatency(0)
+
+	ctx, cancel := QueryContext()
+	defer cancel()
+	deadline, ok := ctx.Deadline()
+	require.True(t, ok)
+	require.True(t, time.Until(deadline) <= time.Second)
+
+	_, err := Instance().FetchUser(ctx, "ortuman")
+	require.Equal(t, context.DeadlineExceeded, err)
+}
+
+func TestMockStorageTransaction(t *testing.T) {
+	s := newMockStorage()
+	ctx := context.Background()
+
+	require.Nil(t, s.InTransaction(ctx, func(tx Storage) error {
+		if err := tx.InsertOrUpdateUser(ctx, &model.User{Username: "ortuman", Password: "1234"}); err != nil {
+			return err
+		}
+		// nested transactions join the enclosing one
+		return tx.InTransaction(ctx, func(tx Storage) error {
+			return tx.InsertOrUpdateRosterItem(ctx, &model.RosterItem{User: "ortuman", Contact: "romeo"})
+		})
+	}))
+	exists, _ := s.UserExists(ctx, "ortuman")
+	require.True(t, exists)
+
+	// a failure in the second statement rolls back the first one
+	err := s.InTransaction(ctx, func(tx Storage) error {
+		if err := tx.DeleteRosterItem(ctx, "ortuman", "romeo"); err != nil {
+			return err
+		}
+		s.activateMockedError()
+		return tx.DeleteUser(ctx, "ortuman")
+	})
+	s.deactivateMockedError()
+	require.Equal(t, ErrMockedError, err)
+
+	ris, _ := s.FetchRosterItems(ctx, "ortuman")
+	require.Equal(t, 1, len(ris))
+	rts, _ := s.FetchRosterTombstones(ctx, "ortuman", 0)
+	require.Equal(t, 0, len(rts))
+	rv, _ := s.FetchRosterVersion(ctx, "ortuman")
+	require.Equal(t, 1, rv.Ver)
+	exists, _ = s.UserExists(ctx, "ortuman")
+	require.True(t, exists)
+}
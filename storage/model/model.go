@@ -6,8 +6,14 @@
 package model
 
 import (
+	"encoding/base64"
 	"encoding/gob"
+	"errors"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/ortuman/jackal/xml"
 )
@@ -15,7 +21,46 @@ import (
 // User represents a user storage entity.
 type User struct {
 	Username string
+
+	// Password holds the plain-text account password, which is
+	// left empty once it has been upgraded to hashed credentials.
 	Password string
+
+	// PasswordHash holds the account password hash in its modular crypt
+	// format representation (bcrypt or argon2id).
+	PasswordHash string
+
+	// Verifier holds the SCRAM credentials derived from the account
+	// password. Nil value means the password is stored in plain text.
+	Verifier *ScramVerifier
+
+	// PurgeAt represents the time at which a removed account
+	// will be definitively deleted. Zero value means the account is active.
+	PurgeAt time.Time
+
+	// Email holds the address provided on registration, if any.
+	Email string
+
+	// EmailVerified tells whether or not Email has been verified.
+	EmailVerified bool
+}
+
+// IsPendingVerification returns whether or not the account
+// awaits its registration email address to be verified.
+func (u *User) IsPendingVerification() bool {
+	return len(u.Email) > 0 && !u.EmailVerified
+}
+
+// IsRemoved returns whether or not the account has been
+// removed and is awaiting to be purged.
+func (u *User) IsRemoved() bool {
+	return !u.PurgeAt.IsZero()
+}
+
+// IsPurgeable returns whether or not the account removal
+// grace period has already expired at t.
+func (u *User) IsPurgeable(t time.Time) bool {
+	return u.IsRemoved() && !u.PurgeAt.After(t)
 }
 
 // FromBytes deserializes a User entity
@@ -24,6 +69,17 @@ func (u *User) FromBytes(r io.Reader) {
 	dec := gob.NewDecoder(r)
 	dec.Decode(&u.Username)
 	dec.Decode(&u.Password)
+	dec.Decode(&u.PurgeAt)
+
+	var hasVerifier bool
+	dec.Decode(&hasVerifier)
+	if hasVerifier {
+		u.Verifier = &ScramVerifier{}
+		dec.Decode(u.Verifier)
+	}
+	dec.Decode(&u.PasswordHash)
+	dec.Decode(&u.Email)
+	dec.Decode(&u.EmailVerified)
 }
 
 // ToBytes converts a User entity
@@ -32,6 +88,62 @@ func (u *User) ToBytes(w io.Writer) {
 	enc := gob.NewEncoder(w)
 	enc.Encode(&u.Username)
 	enc.Encode(&u.Password)
+	enc.Encode(&u.PurgeAt)
+
+	hasVerifier := u.Verifier != nil
+	enc.Encode(&hasVerifier)
+	if hasVerifier {
+		enc.Encode(u.Verifier)
+	}
+	enc.Encode(&u.PasswordHash)
+	enc.Encode(&u.Email)
+	enc.Encode(&u.EmailVerified)
+}
+
+// ScramVerifier represents the SCRAM credentials of an account,
+// carrying the keys needed to authenticate it either using
+// SCRAM-SHA-1 or SCRAM-SHA-256 mechanisms.
+type ScramVerifier struct {
+	Salt            []byte
+	IterationCount  int
+	StoredKeySHA1   []byte
+	ServerKeySHA1   []byte
+	StoredKeySHA256 []byte
+	ServerKeySHA256 []byte
+}
+
+// String returns the verifier textual representation, formatted as
+// 'IterationCount,Salt,StoredKeySHA1,ServerKeySHA1,StoredKeySHA256,ServerKeySHA256'
+// where every binary value is base64 encoded.
+func (v *ScramVerifier) String() string {
+	enc := base64.StdEncoding
+	return strings.Join([]string{
+		strconv.Itoa(v.IterationCount),
+		enc.EncodeToString(v.Salt),
+		enc.EncodeToString(v.StoredKeySHA1),
+		enc.EncodeToString(v.ServerKeySHA1),
+		enc.EncodeToString(v.StoredKeySHA256),
+		enc.EncodeToString(v.ServerKeySHA256),
+	}, ",")
+}
+
+// ParseScramVerifier parses a verifier from its textual representation.
+func ParseScramVerifier(str string) (*ScramVerifier, error) {
+	sp := strings.Split(str, ",")
+	if len(sp) != 6 {
+		return nil, errors.New("model: malformed SCRAM verifier")
+	}
+	iterationCount, err := strconv.Atoi(sp[0])
+	if err != nil || iterationCount <= 0 {
+		return nil, fmt.Errorf("model: invalid SCRAM verifier iteration count: %s", sp[0])
+	}
+	v := &ScramVerifier{IterationCount: iterationCount}
+	for i, b := range []*[]byte{&v.Salt, &v.StoredKeySHA1, &v.ServerKeySHA1, &v.StoredKeySHA256, &v.ServerKeySHA256} {
+		if *b, err = base64.StdEncoding.DecodeString(sp[i+1]); err != nil {
+			return nil, err
+		}
+	}
+	return v, nil
 }
 
 // RosterItem represents a roster item storage entity.
@@ -42,6 +154,10 @@ type RosterItem struct {
 	Subscription string
 	Ask          bool
 	Groups       []string
+
+	// Ver represents the user roster version at which
+	// the item has been last modified.
+	Ver int
 }
 
 // FromBytes deserializes a RosterItem entity
@@ -54,6 +170,7 @@ func (ri *RosterItem) FromBytes(r io.Reader) {
 	dec.Decode(&ri.Subscription)
 	dec.Decode(&ri.Ask)
 	dec.Decode(&ri.Groups)
+	dec.Decode(&ri.Ver)
 }
 
 // ToBytes converts a RosterItem entity
@@ -66,6 +183,62 @@ func (ri *RosterItem) ToBytes(w io.Writer) {
 	enc.Encode(&ri.Subscription)
 	enc.Encode(&ri.Ask)
 	enc.Encode(&ri.Groups)
+	enc.Encode(&ri.Ver)
+}
+
+// RosterVersion represents a user roster version state.
+type RosterVersion struct {
+	// Ver is incremented with every roster mutation.
+	Ver int
+
+	// PrunedVer is the highest version among already pruned
+	// tombstones. Roster changes can only be computed from later versions.
+	PrunedVer int
+}
+
+// FromBytes deserializes a RosterVersion entity
+// from it's gob binary representation.
+func (rv *RosterVersion) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&rv.Ver)
+	dec.Decode(&rv.PrunedVer)
+}
+
+// ToBytes converts a RosterVersion entity
+// to it's gob binary representation.
+func (rv *RosterVersion) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&rv.Ver)
+	enc.Encode(&rv.PrunedVer)
+}
+
+// RosterTombstone represents a deleted roster item,
+// kept so that roster changes can include removals.
+type RosterTombstone struct {
+	User      string
+	Contact   string
+	Ver       int
+	DeletedAt time.Time
+}
+
+// FromBytes deserializes a RosterTombstone entity
+// from it's gob binary representation.
+func (rt *RosterTombstone) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&rt.User)
+	dec.Decode(&rt.Contact)
+	dec.Decode(&rt.Ver)
+	dec.Decode(&rt.DeletedAt)
+}
+
+// ToBytes converts a RosterTombstone entity
+// to it's gob binary representation.
+func (rt *RosterTombstone) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&rt.User)
+	enc.Encode(&rt.Contact)
+	enc.Encode(&rt.Ver)
+	enc.Encode(&rt.DeletedAt)
 }
 
 // RosterNotification represents a roster subscription
@@ -102,3 +275,324 @@ func (rn *RosterNotification) ToBytes(w io.Writer) {
 		el.ToBytes(w)
 	}
 }
+
+// FeatureFlag represents a per user feature flag override storage entity.
+type FeatureFlag struct {
+	Name     string
+	Username string
+	Enabled  bool
+}
+
+// FromBytes deserializes a FeatureFlag entity
+// from it's gob binary representation.
+func (ff *FeatureFlag) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&ff.Name)
+	dec.Decode(&ff.Username)
+	dec.Decode(&ff.Enabled)
+}
+
+// ToBytes converts a FeatureFlag entity
+// to it's gob binary representation.
+func (ff *FeatureFlag) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&ff.Name)
+	enc.Encode(&ff.Username)
+	enc.Encode(&ff.Enabled)
+}
+
+// Invite represents a one-time registration invite token storage entity.
+type Invite struct {
+	Token     string
+	CreatedBy string
+	ExpiresAt time.Time
+	Used      bool
+}
+
+// FromBytes deserializes an Invite entity
+// from it's gob binary representation.
+func (inv *Invite) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&inv.Token)
+	dec.Decode(&inv.CreatedBy)
+	dec.Decode(&inv.ExpiresAt)
+	dec.Decode(&inv.Used)
+}
+
+// ToBytes converts an Invite entity
+// to it's gob binary representation.
+func (inv *Invite) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&inv.Token)
+	enc.Encode(&inv.CreatedBy)
+	enc.Encode(&inv.ExpiresAt)
+	enc.Encode(&inv.Used)
+}
+
+// OfflineMessage represents an offline queued message storage entity.
+type OfflineMessage struct {
+	Message xml.Element
+
+	// Node stably identifies the message within its user's offline queue.
+	Node string
+
+	// ReceivedAt represents the time at which the message got queued.
+	ReceivedAt time.Time
+}
+
+// FromBytes deserializes an OfflineMessage entity
+// from it's gob binary representation.
+func (om *OfflineMessage) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&om.Node)
+	dec.Decode(&om.ReceivedAt)
+	var msg xml.MutableElement
+	msg.FromBytes(r)
+	om.Message = &msg
+}
+
+// ToBytes converts an OfflineMessage entity
+// to it's gob binary representation.
+func (om *OfflineMessage) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&om.Node)
+	enc.Encode(&om.ReceivedAt)
+	om.Message.ToBytes(w)
+}
+
+// ArchivedMessage represents a message archive storage entity.
+type ArchivedMessage struct {
+	// ID identifies the message within its owner's archive.
+	// It's assigned by the storage on insertion.
+	ID string
+
+	Username string
+
+	// With represents the bare JID of the other conversation party,
+	// while WithResource holds its resource, if any.
+	With         string
+	WithResource string
+
+	// Stamp represents the time at which the message got archived.
+	Stamp time.Time
+
+	Message xml.Element
+}
+
+// FromBytes deserializes an ArchivedMessage entity
+// from it's gob binary representation.
+func (am *ArchivedMessage) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&am.ID)
+	dec.Decode(&am.Username)
+	dec.Decode(&am.With)
+	dec.Decode(&am.WithResource)
+	dec.Decode(&am.Stamp)
+	var msg xml.MutableElement
+	msg.FromBytes(r)
+	am.Message = &msg
+}
+
+// ToBytes converts an ArchivedMessage entity
+// to it's gob binary representation.
+func (am *ArchivedMessage) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&am.ID)
+	enc.Encode(&am.Username)
+	enc.Encode(&am.With)
+	enc.Encode(&am.WithResource)
+	enc.Encode(&am.Stamp)
+	am.Message.ToBytes(w)
+}
+
+// ArchivePrefs represents a user message archive preferences storage entity.
+type ArchivePrefs struct {
+	Username string
+
+	// Default represents the archiving policy applied to messages
+	// not covered by any other rule (always, never or roster).
+	Default string
+}
+
+// FromBytes deserializes an ArchivePrefs entity
+// from it's gob binary representation.
+func (ap *ArchivePrefs) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&ap.Username)
+	dec.Decode(&ap.Default)
+}
+
+// ToBytes converts an ArchivePrefs entity
+// to it's gob binary representation.
+func (ap *ArchivePrefs) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&ap.Username)
+	enc.Encode(&ap.Default)
+}
+
+// BlockListItem represents a blocked JID storage entity.
+type BlockListItem struct {
+	Username string
+
+	// JID represents the blocked entity, being either a domain,
+	// a bare or a full JID.
+	JID string
+}
+
+// FromBytes deserializes a BlockListItem entity
+// from it's gob binary representation.
+func (bli *BlockListItem) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&bli.Username)
+	dec.Decode(&bli.JID)
+}
+
+// ToBytes converts a BlockListItem entity
+// to it's gob binary representation.
+func (bli *BlockListItem) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&bli.Username)
+	enc.Encode(&bli.JID)
+}
+
+// PrivacyList represents a privacy list storage entity.
+type PrivacyList struct {
+	Username string
+	Name     string
+
+	// Default reports whether or not the list applies to every user
+	// session having no active list.
+	Default bool
+
+	// Items are sorted by their order value.
+	Items []PrivacyListItem
+}
+
+// PrivacyListItem represents a privacy list rule.
+type PrivacyListItem struct {
+	// Type is either jid, group or subscription. Empty type
+	// items match every entity.
+	Type  string
+	Value string
+
+	// Action is either allow or deny.
+	Action string
+	Order  uint
+
+	// Stanza types the item applies to. Items not applying
+	// to any type apply to every one of them.
+	Message     bool
+	IQ          bool
+	PresenceIn  bool
+	PresenceOut bool
+}
+
+// FromBytes deserializes a PrivacyList entity
+// from it's gob binary representation.
+func (pl *PrivacyList) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&pl.Username)
+	dec.Decode(&pl.Name)
+	dec.Decode(&pl.Default)
+	dec.Decode(&pl.Items)
+}
+
+// ToBytes converts a PrivacyList entity
+// to it's gob binary representation.
+func (pl *PrivacyList) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&pl.Username)
+	enc.Encode(&pl.Name)
+	enc.Encode(&pl.Default)
+	enc.Encode(&pl.Items)
+}
+
+// StreamSession represents a resumable stream management (XEP-0198)
+// session storage entity, persisted across a graceful server restart.
+type StreamSession struct {
+	// ID represents the session resumption identifier.
+	ID string
+
+	// ServerID identifies the server configuration the session belongs to.
+	ServerID string
+
+	Username string
+	Domain   string
+	Resource string
+
+	// Inbound and Acked represent the number of stanzas received
+	// from the peer and acknowledged by it respectively.
+	Inbound uint32
+	Acked   uint32
+
+	// Presence holds the last available presence sent by the peer,
+	// or nil if it wasn't available.
+	Presence xml.Element
+
+	// Unacked holds sent stanzas awaiting acknowledgement, oldest first.
+	Unacked []xml.Element
+
+	// ExpiresAt represents the time up to which the session can be resumed.
+	ExpiresAt time.Time
+}
+
+// FromBytes deserializes a StreamSession entity
+// from it's gob binary representation.
+func (ss *StreamSession) FromBytes(r io.Reader) {
+	dec := gob.NewDecoder(r)
+	dec.Decode(&ss.ID)
+	dec.Decode(&ss.ServerID)
+	dec.Decode(&ss.Username)
+	dec.Decode(&ss.Domain)
+	dec.Decode(&ss.Resource)
+	dec.Decode(&ss.Inbound)
+	dec.Decode(&ss.Acked)
+	dec.Decode(&ss.ExpiresAt)
+
+	ss.Presence, ss.Unacked = nil, nil
+	var hasPresence bool
+	dec.Decode(&hasPresence)
+	if hasPresence {
+		var presence xml.MutableElement
+		presence.FromBytes(r)
+		ss.Presence = &presence
+	}
+	var unackedc int
+	dec.Decode(&unackedc)
+	for i := 0; i < unackedc; i++ {
+		var stanza xml.MutableElement
+		stanza.FromBytes(r)
+		ss.Unacked = append(ss.Unacked, &stanza)
+	}
+}
+
+// ToBytes converts a StreamSession entity
+// to it's gob binary representation.
+func (ss *StreamSession) ToBytes(w io.Writer) {
+	enc := gob.NewEncoder(w)
+	enc.Encode(&ss.ID)
+	enc.Encode(&ss.ServerID)
+	enc.Encode(&ss.Username)
+	enc.Encode(&ss.Domain)
+	enc.Encode(&ss.Resource)
+	enc.Encode(&ss.Inbound)
+	enc.Encode(&ss.Acked)
+	enc.Encode(&ss.ExpiresAt)
+
+	hasPresence := ss.Presence != nil
+	enc.Encode(&hasPresence)
+	if hasPresence {
+		ss.Presence.ToBytes(w)
+	}
+	enc.Encode(len(ss.Unacked))
+	for _, stanza := range ss.Unacked {
+		stanza.ToBytes(w)
+	}
+}
+
+// EntityUsage represents the storage space taken by an entity.
+type EntityUsage struct {
+	Entity string
+	Rows   int64
+	Bytes  int64
+}
@@ -8,6 +8,7 @@ package model
 import (
 	"bytes"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/xml"
 	"github.com/stretchr/testify/require"
@@ -23,6 +24,73 @@ func TestModelUser(t *testing.T) {
 	usr1.ToBytes(buf)
 	usr2.FromBytes(buf)
 	require.Equal(t, usr1, usr2)
+	require.False(t, usr2.IsRemoved())
+
+	usr1.PurgeAt = time.Unix(1530000000, 0).UTC()
+	buf.Reset()
+	usr1.ToBytes(buf)
+	usr2.FromBytes(buf)
+	require.True(t, usr1.PurgeAt.Equal(usr2.PurgeAt))
+	require.True(t, usr2.IsRemoved())
+	require.False(t, usr2.IsPurgeable(usr2.PurgeAt.Add(-time.Second)))
+	require.True(t, usr2.IsPurgeable(usr2.PurgeAt))
+	require.Nil(t, usr2.Verifier)
+
+	usr1.Password = ""
+	usr1.PasswordHash = "$2a$04$8YhhUxZSjyS2CFnmmj5nWuTXQZVkXS4oWr4dW6.LZy.uJWR0M/Eq6"
+	usr1.Verifier = &ScramVerifier{
+		Salt:            []byte("salt"),
+		IterationCount:  4096,
+		StoredKeySHA1:   []byte("stored1"),
+		ServerKeySHA1:   []byte("server1"),
+		StoredKeySHA256: []byte("stored256"),
+		ServerKeySHA256: []byte("server256"),
+	}
+	buf.Reset()
+	usr1.ToBytes(buf)
+	var usr3 User
+	usr3.FromBytes(buf)
+	require.Equal(t, usr1.Verifier, usr3.Verifier)
+	require.Equal(t, usr1.PasswordHash, usr3.PasswordHash)
+	require.Equal(t, "", usr3.Password)
+	require.False(t, usr3.IsPendingVerification())
+
+	usr1.Email = "ortuman@jackal.im"
+	buf.Reset()
+	usr1.ToBytes(buf)
+	var usr4 User
+	usr4.FromBytes(buf)
+	require.Equal(t, "ortuman@jackal.im", usr4.Email)
+	require.True(t, usr4.IsPendingVerification())
+
+	usr1.EmailVerified = true
+	buf.Reset()
+	usr1.ToBytes(buf)
+	var usr5 User
+	usr5.FromBytes(buf)
+	require.True(t, usr5.EmailVerified)
+	require.False(t, usr5.IsPendingVerification())
+}
+
+func TestModelScramVerifier(t *testing.T) {
+	v1 := &ScramVerifier{
+		Salt:            []byte("salt"),
+		IterationCount:  4096,
+		StoredKeySHA1:   []byte("stored1"),
+		ServerKeySHA1:   []byte("server1"),
+		StoredKeySHA256: []byte("stored256"),
+		ServerKeySHA256: []byte("server256"),
+	}
+	v2, err := ParseScramVerifier(v1.String())
+	require.Nil(t, err)
+	require.Equal(t, v1, v2)
+
+	_, err = ParseScramVerifier("4096,c2FsdA==")
+	require.NotNil(t, err)
+	_, err = ParseScramVerifier("abc,c2FsdA==,,,,")
+	require.NotNil(t, err)
+	_, err = ParseScramVerifier("4096,.,,,,")
+	require.NotNil(t, err)
 }
 
 func TestModelRosterItem(t *testing.T) {
@@ -34,6 +102,7 @@ func TestModelRosterItem(t *testing.T) {
 		Ask:          true,
 		Subscription: "none",
 		Groups:       []string{"friends", "family"},
+		Ver:          3,
 	}
 	buf := new(bytes.Buffer)
 	ri1.ToBytes(buf)
@@ -41,6 +110,28 @@ func TestModelRosterItem(t *testing.T) {
 	require.Equal(t, ri1, ri2)
 }
 
+func TestModelRosterVersion(t *testing.T) {
+	var rv1, rv2 RosterVersion
+
+	rv1 = RosterVersion{Ver: 12, PrunedVer: 4}
+	buf := new(bytes.Buffer)
+	rv1.ToBytes(buf)
+	rv2.FromBytes(buf)
+	require.Equal(t, rv1, rv2)
+}
+
+func TestModelRosterTombstone(t *testing.T) {
+	var rt1, rt2 RosterTombstone
+
+	rt1 = RosterTombstone{User: "ortuman", Contact: "noelia", Ver: 7, DeletedAt: time.Now()}
+	buf := new(bytes.Buffer)
+	rt1.ToBytes(buf)
+	rt2.FromBytes(buf)
+	require.Equal(t, rt1.Contact, rt2.Contact)
+	require.Equal(t, rt1.Ver, rt2.Ver)
+	require.True(t, rt1.DeletedAt.Equal(rt2.DeletedAt))
+}
+
 func TestModelRosterNotification(t *testing.T) {
 	var rn1, rn2 RosterNotification
 
@@ -54,3 +145,138 @@ func TestModelRosterNotification(t *testing.T) {
 	rn2.FromBytes(buf)
 	require.Equal(t, rn1, rn2)
 }
+
+func TestModelFeatureFlag(t *testing.T) {
+	var ff1, ff2 FeatureFlag
+
+	ff1 = FeatureFlag{Name: "carbons", Username: "ortuman", Enabled: true}
+	buf := new(bytes.Buffer)
+	ff1.ToBytes(buf)
+	ff2.FromBytes(buf)
+	require.Equal(t, ff1, ff2)
+}
+
+func TestModelInvite(t *testing.T) {
+	var inv1, inv2 Invite
+
+	inv1 = Invite{Token: "abcd", CreatedBy: "ortuman", ExpiresAt: time.Now().UTC().Truncate(time.Second), Used: true}
+	buf := new(bytes.Buffer)
+	inv1.ToBytes(buf)
+	inv2.FromBytes(buf)
+	require.Equal(t, inv1, inv2)
+}
+
+func TestModelOfflineMessage(t *testing.T) {
+	var om1, om2 OfflineMessage
+
+	msg := xml.NewMessageType("abcd", xml.ChatType)
+	msg.AppendElement(xml.NewElementName("body"))
+	om1 = OfflineMessage{Message: msg, Node: "42", ReceivedAt: time.Unix(1530000000, 0).UTC()}
+	buf := new(bytes.Buffer)
+	om1.ToBytes(buf)
+	om2.FromBytes(buf)
+	require.Equal(t, om1.Node, om2.Node)
+	require.True(t, om1.ReceivedAt.Equal(om2.ReceivedAt))
+	require.Equal(t, msg.String(), om2.Message.String())
+}
+
+func TestModelArchivedMessage(t *testing.T) {
+	var am1, am2 ArchivedMessage
+
+	msg := xml.NewMessageType("abcd", xml.ChatType)
+	msg.AppendElement(xml.NewElementName("body"))
+	am1 = ArchivedMessage{
+		ID:           "1",
+		Username:     "ortuman",
+		With:         "romeo@jackal.im",
+		WithResource: "garden",
+		Stamp:        time.Unix(1530000000, 0).UTC(),
+		Message:      msg,
+	}
+	buf := new(bytes.Buffer)
+	am1.ToBytes(buf)
+	am2.FromBytes(buf)
+	require.Equal(t, am1.ID, am2.ID)
+	require.Equal(t, am1.Username, am2.Username)
+	require.Equal(t, am1.With, am2.With)
+	require.Equal(t, am1.WithResource, am2.WithResource)
+	require.True(t, am1.Stamp.Equal(am2.Stamp))
+	require.Equal(t, msg.String(), am2.Message.String())
+}
+
+func TestModelArchivePrefs(t *testing.T) {
+	var ap1, ap2 ArchivePrefs
+	ap1 = ArchivePrefs{Username: "ortuman", Default: "roster"}
+	buf := new(bytes.Buffer)
+	ap1.ToBytes(buf)
+	ap2.FromBytes(buf)
+	require.Equal(t, ap1, ap2)
+}
+
+func TestModelBlockListItem(t *testing.T) {
+	var bli1, bli2 BlockListItem
+	bli1 = BlockListItem{Username: "ortuman", JID: "romeo@jackal.im"}
+	buf := new(bytes.Buffer)
+	bli1.ToBytes(buf)
+	bli2.FromBytes(buf)
+	require.Equal(t, bli1, bli2)
+}
+
+func TestModelPrivacyList(t *testing.T) {
+	var pl1, pl2 PrivacyList
+	pl1 = PrivacyList{
+		Username: "ortuman",
+		Name:     "invisible",
+		Default:  true,
+		Items: []PrivacyListItem{
+			{Type: "jid", Value: "romeo@jackal.im", Action: "allow", Order: 1, Message: true},
+			{Action: "deny", Order: 2, PresenceOut: true},
+		},
+	}
+	buf := new(bytes.Buffer)
+	pl1.ToBytes(buf)
+	pl2.FromBytes(buf)
+	require.Equal(t, pl1, pl2)
+}
+
+func TestModelStreamSession(t *testing.T) {
+	var ss1, ss2 StreamSession
+
+	msg := xml.NewMessageType("abcd", xml.ChatType)
+	msg.AppendElement(xml.NewElementName("body"))
+	presence := xml.NewElementName("presence")
+	ss1 = StreamSession{
+		ID:        "efgh",
+		ServerID:  "default",
+		Username:  "ortuman",
+		Domain:    "jackal.im",
+		Resource:  "balcony",
+		Inbound:   3,
+		Acked:     4294967295,
+		Presence:  presence,
+		Unacked:   []xml.Element{msg, msg},
+		ExpiresAt: time.Unix(1530000000, 0).UTC(),
+	}
+	buf := new(bytes.Buffer)
+	ss1.ToBytes(buf)
+	ss2.FromBytes(buf)
+	require.Equal(t, ss1.ID, ss2.ID)
+	require.Equal(t, ss1.ServerID, ss2.ServerID)
+	require.Equal(t, ss1.Username, ss2.Username)
+	require.Equal(t, ss1.Domain, ss2.Domain)
+	require.Equal(t, ss1.Resource, ss2.Resource)
+	require.Equal(t, ss1.Inbound, ss2.Inbound)
+	require.Equal(t, ss1.Acked, ss2.Acked)
+	require.True(t, ss1.ExpiresAt.Equal(ss2.ExpiresAt))
+	require.Equal(t, presence.String(), ss2.Presence.String())
+	require.Equal(t, 2, len(ss2.Unacked))
+	require.Equal(t, msg.String(), ss2.Unacked[1].String())
+
+	// unavailable sessions hold no presence
+	ss1.Presence, ss1.Unacked = nil, nil
+	buf.Reset()
+	ss1.ToBytes(buf)
+	ss2.FromBytes(buf)
+	require.Nil(t, ss2.Presence)
+	require.Nil(t, ss2.Unacked)
+}
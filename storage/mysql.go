@@ -6,27 +6,47 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"database/sql"
 	"fmt"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
-	_ "github.com/go-sql-driver/mysql" // SQL driver
+	"github.com/go-sql-driver/mysql"
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
 )
 
+// mySQLStorage stores every entity qualified by its handle tenant,
+// which is included in every query and table unique constraint.
 type mySQLStorage struct {
 	db     *sql.DB
+	tx     *sql.Tx // set on handles bound to a transaction
+	stmts  *mySQLStmtCache
+	tenant string // immutable
 	doneCh chan chan bool
 }
 
-func newMySQLStorage(cfg *config.MySQLDb) *mySQLStorage {
+// sqlConn is satisfied by both *sql.DB and *sql.Tx.
+type sqlConn interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func newMySQLStorage(cfg *config.MySQLDb, tenant string) *mySQLStorage {
 	var err error
+	if len(tenant) > 0 && !config.IsValidTenant(tenant) {
+		log.Fatalf("storage: invalid tenant: %s", tenant)
+	}
 	s := &mySQLStorage{
+		stmts:  newMySQLStmtCache(),
+		tenant: tenant,
 		doneCh: make(chan chan bool),
 	}
 	host := cfg.Host
@@ -50,6 +70,8 @@ func newMySQLStorage(cfg *config.MySQLDb) *mySQLStorage {
 	return s
 }
 
+// newMockMySQLStorage returns a MySQL storage backed by a mocked database.
+// Statements aren't cached, so that expectations match plain queries.
 func newMockMySQLStorage() (*mySQLStorage, sqlmock.Sqlmock) {
 	var err error
 	var sqlMock sqlmock.Sqlmock
@@ -67,22 +89,41 @@ func (s *mySQLStorage) Shutdown() {
 	<-ch
 }
 
-func (s *mySQLStorage) InsertOrUpdateUser(u *model.User) error {
+func (s *mySQLStorage) InsertOrUpdateUser(ctx context.Context, u *model.User) error {
+	var purgeAt int64
+	if u.IsRemoved() {
+		purgeAt = u.PurgeAt.Unix()
+	}
+	var verifier string
+	if u.Verifier != nil {
+		verifier = u.Verifier.String()
+	}
 	stmt := `` +
-		`INSERT INTO users (username, password, updated_at, created_at)` +
-		` VALUES(?, ?, NOW(), NOW())` +
-		` ON DUPLICATE KEY UPDATE password = ?, updated_at = NOW()`
-	_, err := s.db.Exec(stmt, u.Username, u.Password, u.Password)
+		`INSERT INTO users (tenant, username, password, password_hash, scram_verifier, purge_at, email, email_verified, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())` +
+		` ON DUPLICATE KEY UPDATE password = ?, password_hash = ?, scram_verifier = ?, purge_at = ?, email = ?, email_verified = ?, updated_at = NOW()`
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, u.Username, u.Password, u.PasswordHash, verifier, purgeAt, u.Email, u.EmailVerified,
+		u.Password, u.PasswordHash, verifier, purgeAt, u.Email, u.EmailVerified)
 	return err
 }
 
-func (s *mySQLStorage) FetchUser(username string) (*model.User, error) {
-	row := s.db.QueryRow("SELECT username, password FROM users WHERE username = ?", username)
+func (s *mySQLStorage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT username, password, password_hash, scram_verifier, purge_at, email, email_verified FROM users WHERE tenant = ? AND username = ?", s.tenant, username)
 
 	var usr model.User
-	err := row.Scan(&usr.Username, &usr.Password)
+	var verifier string
+	var purgeAt int64
+	err := row.Scan(&usr.Username, &usr.Password, &usr.PasswordHash, &verifier, &purgeAt, &usr.Email, &usr.EmailVerified)
 	switch err {
 	case nil:
+		if len(verifier) > 0 {
+			if usr.Verifier, err = model.ParseScramVerifier(verifier); err != nil {
+				return nil, err
+			}
+		}
+		if purgeAt > 0 {
+			usr.PurgeAt = time.Unix(purgeAt, 0)
+		}
 		return &usr, nil
 	case sql.ErrNoRows:
 		return nil, nil
@@ -91,17 +132,28 @@ func (s *mySQLStorage) FetchUser(username string) (*model.User, error) {
 	}
 }
 
-func (s *mySQLStorage) DeleteUser(username string) error {
+func (s *mySQLStorage) DeleteUser(ctx context.Context, username string) error {
 	stmts := []string{
-		"DELETE FROM offline_messages WHERE username = ?",
-		"DELETE FROM roster_items WHERE username = ?",
-		"DELETE FROM private_storage WHERE username = ?",
-		"DELETE FROM vcards WHERE username = ?",
-		"DELETE FROM users WHERE username = ?",
+		"DELETE FROM offline_messages WHERE tenant = ? AND username = ?",
+		"DELETE FROM quarantined_messages WHERE tenant = ? AND username = ?",
+		"DELETE FROM roster_items WHERE tenant = ? AND user = ?",
+		"DELETE FROM roster_versions WHERE tenant = ? AND username = ?",
+		"DELETE FROM roster_tombstones WHERE tenant = ? AND user = ?",
+		"DELETE FROM roster_notifications WHERE tenant = ? AND user = ?",
+		"DELETE FROM roster_notifications WHERE tenant = ? AND contact = ?",
+		"DELETE FROM private_storage WHERE tenant = ? AND username = ?",
+		"DELETE FROM vcards WHERE tenant = ? AND username = ?",
+		"DELETE FROM archived_messages WHERE tenant = ? AND username = ?",
+		"DELETE FROM archive_prefs WHERE tenant = ? AND username = ?",
+		"DELETE FROM block_list_items WHERE tenant = ? AND username = ?",
+		"DELETE FROM privacy_list_items WHERE tenant = ? AND username = ?",
+		"DELETE FROM privacy_lists WHERE tenant = ? AND username = ?",
+		"DELETE FROM feature_flags WHERE tenant = ? AND username = ?",
+		"DELETE FROM users WHERE tenant = ? AND username = ?",
 	}
-	return s.inTransaction(func(tx *sql.Tx) error {
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
 		for _, stmt := range stmts {
-			if _, err := tx.Exec(stmt, username); err != nil {
+			if _, err := tx.ExecContext(ctx, stmt, s.tenant, username); err != nil {
 				return err
 			}
 		}
@@ -109,8 +161,14 @@ func (s *mySQLStorage) DeleteUser(username string) error {
 	})
 }
 
-func (s *mySQLStorage) UserExists(username string) (bool, error) {
-	row := s.db.QueryRow("SELECT COUNT(*) FROM users WHERE username = ?", username)
+func (s *mySQLStorage) UserExists(ctx context.Context, username string) (bool, error) {
+	stmt := "SELECT COUNT(*) FROM users WHERE tenant = ? AND username = ?"
+	if s.tx != nil {
+		// lock the row (or the gap it would be inserted at), so that
+		// an insertion conditioned on its absence can't race
+		stmt += " FOR UPDATE"
+	}
+	row := s.conn().QueryRowContext(ctx, stmt, s.tenant, username)
 	var count int
 	err := row.Scan(&count)
 	switch err {
@@ -121,41 +179,100 @@ func (s *mySQLStorage) UserExists(username string) (bool, error) {
 	}
 }
 
-func (s *mySQLStorage) InsertOrUpdateRosterItem(ri *model.RosterItem) error {
-	groups := strings.Join(ri.Groups, ";")
-	params := []interface{}{
-		ri.User,
-		ri.Contact,
-		ri.Name,
-		ri.Subscription,
-		groups,
-		ri.Ask,
-		ri.Name,
-		ri.Subscription,
-		groups,
-		ri.Ask,
+func (s *mySQLStorage) CountUsers(ctx context.Context) (int, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE tenant = ?", s.tenant)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
 	}
-	stmt := `` +
-		`INSERT INTO roster_items (user, contact, name, subscription, groups, ask, updated_at, created_at)` +
-		` VALUES(?, ?, ?, ?, ?, ?, NOW(), NOW())` +
-		` ON DUPLICATE KEY UPDATE name = ?, subscription = ?, groups = ?, ask = ?, updated_at = NOW()`
-	_, err := s.db.Exec(stmt, params...)
-	return err
+	return count, nil
 }
 
-func (s *mySQLStorage) DeleteRosterItem(user, contact string) error {
-	stmt := "DELETE FROM roster_items WHERE user = ? AND contact = ?"
-	_, err := s.db.Exec(stmt, user, contact)
-	return err
+func (s *mySQLStorage) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT username FROM users WHERE tenant = ? AND purge_at > 0 AND purge_at <= ?", s.tenant, before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
 }
 
-func (s *mySQLStorage) FetchRosterItems(user string) ([]model.RosterItem, error) {
+func (s *mySQLStorage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
+		ver, err := s.incRosterVersion(ctx, tx, ri.User)
+		if err != nil {
+			return err
+		}
+		groups := strings.Join(ri.Groups, ";")
+		params := []interface{}{
+			s.tenant,
+			ri.User,
+			ri.Contact,
+			ri.Name,
+			ri.Subscription,
+			groups,
+			ri.Ask,
+			ver,
+			ri.Name,
+			ri.Subscription,
+			groups,
+			ri.Ask,
+			ver,
+		}
+		stmt := `` +
+			`INSERT INTO roster_items (tenant, user, contact, name, subscription, groups, ask, ver, updated_at, created_at)` +
+			` VALUES(?, ?, ?, ?, ?, ?, ?, ?, NOW(), NOW())` +
+			` ON DUPLICATE KEY UPDATE name = ?, subscription = ?, groups = ?, ask = ?, ver = ?, updated_at = NOW()`
+		if _, err := tx.ExecContext(ctx, stmt, params...); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM roster_tombstones WHERE tenant = ? AND user = ? AND contact = ?", s.tenant, ri.User, ri.Contact); err != nil {
+			return err
+		}
+		ri.Ver = ver
+		return nil
+	})
+}
+
+func (s *mySQLStorage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM roster_items WHERE tenant = ? AND user = ? AND contact = ?", s.tenant, user, contact)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err // nothing deleted
+		}
+		ver, err := s.incRosterVersion(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+		stmt := `` +
+			`INSERT INTO roster_tombstones (tenant, user, contact, ver, deleted_at)` +
+			` VALUES(?, ?, ?, ?, ?)` +
+			` ON DUPLICATE KEY UPDATE ver = ?, deleted_at = ?`
+		now := time.Now().UnixNano()
+		_, err = tx.ExecContext(ctx, stmt, s.tenant, user, contact, ver, now, ver, now)
+		return err
+	})
+}
+
+func (s *mySQLStorage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
 	stmt := `` +
-		`SELECT user, contact, name, subscription, groups, ask` +
-		` FROM roster_items WHERE  user = ?` +
+		`SELECT user, contact, name, subscription, groups, ask, ver` +
+		` FROM roster_items WHERE tenant = ? AND user = ?` +
 		` ORDER BY created_at DESC`
 
-	rows, err := s.db.Query(stmt, user)
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, user)
 	if err != nil {
 		return nil, err
 	}
@@ -164,11 +281,47 @@ func (s *mySQLStorage) FetchRosterItems(user string) ([]model.RosterItem, error)
 	return scanRosterItemEntities(rows)
 }
 
-func (s *mySQLStorage) FetchRosterItem(user, contact string) (*model.RosterItem, error) {
+// FetchRosterItemsOfUsers satisfies Storage interface.
+// Rosters are fetched by a single query per mySQLBatchSize users.
+func (s *mySQLStorage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	ret := make(map[string][]model.RosterItem, len(users))
+	for len(users) > 0 {
+		n := len(users)
+		if n > mySQLBatchSize {
+			n = mySQLBatchSize
+		}
+		stmt := `` +
+			`SELECT user, contact, name, subscription, groups, ask, ver` +
+			` FROM roster_items WHERE tenant = ? AND user IN (` + mySQLPlaceholders(n) + `)` +
+			` ORDER BY created_at DESC`
+
+		args := make([]interface{}, 0, n+1)
+		args = append(args, s.tenant)
+		for _, user := range users[:n] {
+			args = append(args, user)
+		}
+		rows, err := s.conn().QueryContext(ctx, stmt, args...)
+		if err != nil {
+			return nil, err
+		}
+		ris, err := scanRosterItemEntities(rows)
+		rows.Close()
+		if err != nil {
+			return nil, err
+		}
+		for _, ri := range ris {
+			ret[ri.User] = append(ret[ri.User], ri)
+		}
+		users = users[n:]
+	}
+	return ret, nil
+}
+
+func (s *mySQLStorage) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
 	stmt := `` +
-		`SELECT user, contact, name, subscription, groups, ask` +
-		` FROM roster_items WHERE user = ? AND contact = ?`
-	row := s.db.QueryRow(stmt, user, contact)
+		`SELECT user, contact, name, subscription, groups, ask, ver` +
+		` FROM roster_items WHERE tenant = ? AND user = ? AND contact = ?`
+	row := s.conn().QueryRowContext(ctx, stmt, s.tenant, user, contact)
 
 	var ri model.RosterItem
 	err := scanRosterItemEntity(&ri, row)
@@ -182,10 +335,90 @@ func (s *mySQLStorage) FetchRosterItem(user, contact string) (*model.RosterItem,
 	}
 }
 
-func (s *mySQLStorage) InsertOrUpdateRosterNotification(rn *model.RosterNotification) error {
+func (s *mySQLStorage) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT ver, pruned_ver FROM roster_versions WHERE tenant = ? AND username = ?", s.tenant, user)
+
+	var rv model.RosterVersion
+	err := row.Scan(&rv.Ver, &rv.PrunedVer)
+	switch err {
+	case nil, sql.ErrNoRows:
+		return rv, nil
+	default:
+		return model.RosterVersion{}, err
+	}
+}
+
+func (s *mySQLStorage) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
 	stmt := `` +
-		`INSERT INTO roster_notifications (user, contact, elements, updated_at, created_at)` +
-		` VALUES(?, ?, ?, NOW(), NOW())` +
+		`SELECT user, contact, ver, deleted_at` +
+		` FROM roster_tombstones WHERE tenant = ? AND user = ? AND ver > ?` +
+		` ORDER BY ver`
+
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, user, afterVer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rts []model.RosterTombstone
+	for rows.Next() {
+		var rt model.RosterTombstone
+		var deletedAt int64
+		if err := rows.Scan(&rt.User, &rt.Contact, &rt.Ver, &deletedAt); err != nil {
+			return nil, err
+		}
+		rt.DeletedAt = time.Unix(0, deletedAt)
+		rts = append(rts, rt)
+	}
+	return rts, rows.Err()
+}
+
+func (s *mySQLStorage) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	var count int64
+	err := s.inTransaction(ctx, func(tx *mySQLConn) error {
+		// keep track of pruned versions, so that no changes are computed from them
+		stmt := `` +
+			`UPDATE roster_versions rv JOIN` +
+			` (SELECT user, MAX(ver) AS ver FROM roster_tombstones WHERE tenant = ? AND deleted_at <= ? GROUP BY user) rt` +
+			` ON rv.tenant = ? AND rv.username = rt.user` +
+			` SET rv.pruned_ver = GREATEST(rv.pruned_ver, rt.ver)`
+		if _, err := tx.ExecContext(ctx, stmt, s.tenant, before.UnixNano(), s.tenant); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM roster_tombstones WHERE tenant = ? AND deleted_at <= ?", s.tenant, before.UnixNano())
+		if err != nil {
+			return err
+		}
+		count, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// incRosterVersion increments user roster version within tx, returning the new one.
+// Version row remains locked until tx finishes, so that concurrent mutations are serialized.
+func (s *mySQLStorage) incRosterVersion(ctx context.Context, tx *mySQLConn, user string) (int, error) {
+	stmt := `` +
+		`INSERT INTO roster_versions (tenant, username, ver, pruned_ver, updated_at, created_at)` +
+		` VALUES(?, ?, 1, 0, NOW(), NOW())` +
+		` ON DUPLICATE KEY UPDATE ver = ver + 1, updated_at = NOW()`
+	if _, err := tx.ExecContext(ctx, stmt, s.tenant, user); err != nil {
+		return 0, err
+	}
+	var ver int
+	if err := tx.QueryRowContext(ctx, "SELECT ver FROM roster_versions WHERE tenant = ? AND username = ?", s.tenant, user).Scan(&ver); err != nil {
+		return 0, err
+	}
+	return ver, nil
+}
+
+func (s *mySQLStorage) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
+	stmt := `` +
+		`INSERT INTO roster_notifications (tenant, user, contact, elements, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, NOW(), NOW())` +
 		` ON DUPLICATE KEY UPDATE elements = ?, updated_at = NOW()`
 
 	buf := pool.Get()
@@ -194,18 +427,18 @@ func (s *mySQLStorage) InsertOrUpdateRosterNotification(rn *model.RosterNotifica
 		buf.WriteString(elem.String())
 	}
 	elementsXML := buf.String()
-	_, err := s.db.Exec(stmt, rn.User, rn.Contact, elementsXML, elementsXML)
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, rn.User, rn.Contact, elementsXML, elementsXML)
 	return err
 }
 
-func (s *mySQLStorage) DeleteRosterNotification(user, contact string) error {
-	_, err := s.db.Exec("DELETE FROM roster_notifications WHERE user = ? AND contact = ?", user, contact)
+func (s *mySQLStorage) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM roster_notifications WHERE tenant = ? AND user = ? AND contact = ?", s.tenant, user, contact)
 	return err
 }
 
-func (s *mySQLStorage) FetchRosterNotifications(contact string) ([]model.RosterNotification, error) {
-	stmt := `SELECT user, contact, elements FROM roster_notifications WHERE contact = ? ORDER BY created_at`
-	rows, err := s.db.Query(stmt, contact)
+func (s *mySQLStorage) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
+	stmt := `SELECT user, contact, elements FROM roster_notifications WHERE tenant = ? AND contact = ? ORDER BY created_at`
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, contact)
 	if err != nil {
 		return nil, err
 	}
@@ -236,19 +469,19 @@ func (s *mySQLStorage) FetchRosterNotifications(contact string) ([]model.RosterN
 	return ret, nil
 }
 
-func (s *mySQLStorage) InsertOrUpdateVCard(vCard xml.Element, username string) error {
+func (s *mySQLStorage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
 	stmt := `` +
-		`INSERT INTO vcards (username, vcard, updated_at, created_at)` +
-		` VALUES(?, ?, NOW(), NOW())` +
+		`INSERT INTO vcards (tenant, username, vcard, updated_at, created_at)` +
+		` VALUES(?, ?, ?, NOW(), NOW())` +
 		` ON DUPLICATE KEY UPDATE vcard = ?, updated_at = NOW()`
 
 	rawXML := vCard.String()
-	_, err := s.db.Exec(stmt, username, rawXML, rawXML)
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, rawXML, rawXML)
 	return err
 }
 
-func (s *mySQLStorage) FetchVCard(username string) (xml.Element, error) {
-	row := s.db.QueryRow("SELECT vcard FROM vcards WHERE username = ?", username)
+func (s *mySQLStorage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT vcard FROM vcards WHERE tenant = ? AND username = ?", s.tenant, username)
 	var vCard string
 	err := row.Scan(&vCard)
 	switch err {
@@ -262,10 +495,10 @@ func (s *mySQLStorage) FetchVCard(username string) (xml.Element, error) {
 	}
 }
 
-func (s *mySQLStorage) InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error {
+func (s *mySQLStorage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
 	stmt := `` +
-		`INSERT INTO private_storage (username, namespace, data, updated_at, created_at)` +
-		` VALUES(?, ?, ?, NOW(), NOW())` +
+		`INSERT INTO private_storage (tenant, username, namespace, data, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, NOW(), NOW())` +
 		` ON DUPLICATE KEY UPDATE data = ?, updated_at = NOW()`
 
 	buf := pool.Get()
@@ -274,12 +507,12 @@ func (s *mySQLStorage) InsertOrUpdatePrivateXML(privateXML []xml.Element, namesp
 		elem.ToXML(buf, true)
 	}
 	rawXML := buf.String()
-	_, err := s.db.Exec(stmt, username, namespace, rawXML, rawXML)
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, namespace, rawXML, rawXML)
 	return err
 }
 
-func (s *mySQLStorage) FetchPrivateXML(namespace string, username string) ([]xml.Element, error) {
-	row := s.db.QueryRow("SELECT data FROM private_storage WHERE username = ? AND namespace = ?", username, namespace)
+func (s *mySQLStorage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT data FROM private_storage WHERE tenant = ? AND username = ? AND namespace = ?", s.tenant, username, namespace)
 	var privateXML string
 	err := row.Scan(&privateXML)
 	switch err {
@@ -304,14 +537,79 @@ func (s *mySQLStorage) FetchPrivateXML(namespace string, username string) ([]xml
 	}
 }
 
-func (s *mySQLStorage) InsertOfflineMessage(message xml.Element, username string) error {
-	stmt := `INSERT INTO offline_messages (username, data, created_at) VALUES(?, ?, NOW())`
-	_, err := s.db.Exec(stmt, username, message.String())
+func (s *mySQLStorage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	stmt := `INSERT INTO offline_messages (tenant, username, data, received_at, created_at) VALUES(?, ?, ?, UNIX_TIMESTAMP(), NOW())`
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, message.String())
+	return err
+}
+
+// InsertOfflineMessages satisfies Storage interface.
+// Messages are inserted by a single statement per mySQLBatchSize messages,
+// all of them within the same transaction.
+func (s *mySQLStorage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	if len(messages) <= mySQLBatchSize {
+		return s.insertOfflineMessages(ctx, s.conn(), messages, username)
+	}
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
+		for len(messages) > mySQLBatchSize {
+			if err := s.insertOfflineMessages(ctx, tx, messages[:mySQLBatchSize], username); err != nil {
+				return err
+			}
+			messages = messages[mySQLBatchSize:]
+		}
+		return s.insertOfflineMessages(ctx, tx, messages, username)
+	})
+}
+
+func (s *mySQLStorage) insertOfflineMessages(ctx context.Context, conn *mySQLConn, messages []xml.Element, username string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	stmt := `INSERT INTO offline_messages (tenant, username, data, received_at, created_at) VALUES ` +
+		strings.TrimSuffix(strings.Repeat("(?, ?, ?, UNIX_TIMESTAMP(), NOW()), ", len(messages)), ", ")
+
+	args := make([]interface{}, 0, len(messages)*3)
+	for _, message := range messages {
+		args = append(args, s.tenant, username, message.String())
+	}
+	_, err := conn.ExecContext(ctx, stmt, args...)
 	return err
 }
 
-func (s *mySQLStorage) CountOfflineMessages(username string) (int, error) {
-	row := s.db.QueryRow("SELECT COUNT(*) FROM offline_messages WHERE username = ? ORDER BY created_at", username)
+// InsertCappedOfflineMessage satisfies Storage interface.
+func (s *mySQLStorage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	var inserted bool
+	err := s.inTransaction(ctx, func(tx *mySQLConn) error {
+		// locking read, so that concurrent insertions into the queue get serialized
+		var count int
+		stmt := `SELECT COUNT(*) FROM offline_messages WHERE tenant = ? AND username = ? FOR UPDATE`
+		if err := tx.QueryRowContext(ctx, stmt, s.tenant, username).Scan(&count); err != nil {
+			return err
+		}
+		if count >= capacity {
+			if !dropOldest {
+				return nil
+			}
+			stmt := `DELETE FROM offline_messages WHERE tenant = ? AND username = ? ORDER BY id LIMIT ?`
+			if _, err := tx.ExecContext(ctx, stmt, s.tenant, username, count-capacity+1); err != nil {
+				return err
+			}
+		}
+		stmt = `INSERT INTO offline_messages (tenant, username, data, received_at, created_at) VALUES(?, ?, ?, UNIX_TIMESTAMP(), NOW())`
+		if _, err := tx.ExecContext(ctx, stmt, s.tenant, username, message.String()); err != nil {
+			return err
+		}
+		inserted = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return inserted, nil
+}
+
+func (s *mySQLStorage) CountOfflineMessages(ctx context.Context, username string) (int, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM offline_messages WHERE tenant = ? AND username = ?", s.tenant, username)
 	var count int
 	err := row.Scan(&count)
 	switch err {
@@ -322,8 +620,91 @@ func (s *mySQLStorage) CountOfflineMessages(username string) (int, error) {
 	}
 }
 
-func (s *mySQLStorage) FetchOfflineMessages(username string) ([]xml.Element, error) {
-	rows, err := s.db.Query("SELECT data FROM offline_messages WHERE username = ? ORDER BY created_at", username)
+func (s *mySQLStorage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	stmt := `SELECT id, data, received_at FROM offline_messages WHERE tenant = ? AND username = ? ORDER BY id`
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanOfflineMessageEntities(rows)
+}
+
+// FetchOfflineMessage satisfies Storage interface.
+// Message nodes are their row identifiers.
+func (s *mySQLStorage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	id, err := strconv.ParseInt(node, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	stmt := `SELECT id, data, received_at FROM offline_messages WHERE tenant = ? AND username = ? AND id = ?`
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, username, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs, err := scanOfflineMessageEntities(rows)
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	return &msgs[0], nil
+}
+
+// DeleteOfflineMessage satisfies Storage interface.
+func (s *mySQLStorage) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	id, err := strconv.ParseInt(node, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	stmt := `DELETE FROM offline_messages WHERE tenant = ? AND username = ? AND id = ?`
+	res, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *mySQLStorage) DeleteOfflineMessages(ctx context.Context, username string) error {
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM offline_messages WHERE tenant = ? AND username = ?", s.tenant, username)
+	return err
+}
+
+// DeleteExpiredOfflineMessages satisfies Storage interface.
+func (s *mySQLStorage) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	res, err := s.conn().ExecContext(ctx, "DELETE FROM offline_messages WHERE tenant = ? AND received_at <= ?", s.tenant, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (s *mySQLStorage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	stmt := `INSERT INTO quarantined_messages (tenant, username, data, created_at) VALUES(?, ?, ?, NOW())`
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, message.String())
+	return err
+}
+
+func (s *mySQLStorage) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM quarantined_messages WHERE tenant = ? AND username = ?", s.tenant, username)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *mySQLStorage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT data FROM quarantined_messages WHERE tenant = ? AND username = ?", s.tenant, username)
 	if err != nil {
 		return nil, err
 	}
@@ -348,11 +729,315 @@ func (s *mySQLStorage) FetchOfflineMessages(username string) ([]xml.Element, err
 	return rootEl.Elements(), nil
 }
 
-func (s *mySQLStorage) DeleteOfflineMessages(username string) error {
-	_, err := s.db.Exec("DELETE FROM offline_messages WHERE username = ?", username)
+func (s *mySQLStorage) DeleteQuarantinedMessages(ctx context.Context, username string) error {
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM quarantined_messages WHERE tenant = ? AND username = ?", s.tenant, username)
 	return err
 }
 
+// InsertArchivedMessage satisfies Storage interface.
+// Message identifiers are their row identifiers.
+func (s *mySQLStorage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	stmt := `` +
+		`INSERT INTO archived_messages (tenant, username, with_jid, with_resource, stamp, data, created_at)` +
+		` VALUES(?, ?, ?, ?, ?, ?, NOW())`
+	res, err := s.conn().ExecContext(ctx, stmt, s.tenant, message.Username, message.With, message.WithResource, message.Stamp.Unix(), message.Message.String())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	message.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+func (s *mySQLStorage) FetchArchivedMessages(ctx context.Context, username string, filter *ArchiveFilter) ([]model.ArchivedMessage, error) {
+	stmt, args, ok := selectArchivedMessagesStmt(s.tenant, username, filter)
+	if !ok {
+		return nil, nil
+	}
+	rows, err := s.conn().QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs, err := scanArchivedMessageEntities(rows, username)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Last {
+		reverseArchivedMessages(msgs)
+	}
+	return msgs, nil
+}
+
+func (s *mySQLStorage) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	stmt := `` +
+		`INSERT INTO archive_prefs (tenant, username, default_mode, updated_at, created_at)` +
+		` VALUES(?, ?, ?, NOW(), NOW())` +
+		` ON DUPLICATE KEY UPDATE default_mode = ?, updated_at = NOW()`
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, prefs.Username, prefs.Default, prefs.Default)
+	return err
+}
+
+func (s *mySQLStorage) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT username, default_mode FROM archive_prefs WHERE tenant = ? AND username = ?", s.tenant, username)
+	var prefs model.ArchivePrefs
+	err := row.Scan(&prefs.Username, &prefs.Default)
+	switch err {
+	case nil:
+		return &prefs, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *mySQLStorage) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
+		for _, item := range items {
+			_, err := tx.ExecContext(ctx, "INSERT IGNORE INTO block_list_items (tenant, username, jid, created_at) VALUES(?, ?, ?, NOW())", s.tenant, item.Username, item.JID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *mySQLStorage) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
+		for _, item := range items {
+			_, err := tx.ExecContext(ctx, "DELETE FROM block_list_items WHERE tenant = ? AND username = ? AND jid = ?", s.tenant, item.Username, item.JID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *mySQLStorage) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT username, jid FROM block_list_items WHERE tenant = ? AND username = ?", s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blis []model.BlockListItem
+	for rows.Next() {
+		var bli model.BlockListItem
+		if err := rows.Scan(&bli.Username, &bli.JID); err != nil {
+			return nil, err
+		}
+		blis = append(blis, bli)
+	}
+	return blis, rows.Err()
+}
+
+func (s *mySQLStorage) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
+		stmt := `` +
+			`INSERT INTO privacy_lists (tenant, username, name, is_default, updated_at, created_at)` +
+			` VALUES(?, ?, ?, 0, NOW(), NOW())` +
+			` ON DUPLICATE KEY UPDATE updated_at = NOW()`
+		if _, err := tx.ExecContext(ctx, stmt, s.tenant, list.Username, list.Name); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM privacy_list_items WHERE tenant = ? AND username = ? AND list_name = ?", s.tenant, list.Username, list.Name)
+		if err != nil {
+			return err
+		}
+		stmt = `` +
+			`INSERT INTO privacy_list_items (tenant, username, list_name, ord, type, value, action, message, iq, presence_in, presence_out)` +
+			` VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		for _, item := range list.Items {
+			_, err := tx.ExecContext(ctx, stmt, s.tenant, list.Username, list.Name, item.Order, item.Type, item.Value, item.Action, item.Message, item.IQ, item.PresenceIn, item.PresenceOut)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *mySQLStorage) DeletePrivacyList(ctx context.Context, username, name string) error {
+	return s.inTransaction(ctx, func(tx *mySQLConn) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM privacy_list_items WHERE tenant = ? AND username = ? AND list_name = ?", s.tenant, username, name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM privacy_lists WHERE tenant = ? AND username = ? AND name = ?", s.tenant, username, name)
+		return err
+	})
+}
+
+func (s *mySQLStorage) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT name, is_default FROM privacy_lists WHERE tenant = ? AND username = ? ORDER BY name", s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pls []model.PrivacyList
+	for rows.Next() {
+		pl := model.PrivacyList{Username: username}
+		if err := rows.Scan(&pl.Name, &pl.Default); err != nil {
+			return nil, err
+		}
+		pls = append(pls, pl)
+	}
+	if err := rows.Err(); err != nil || len(pls) == 0 {
+		return nil, err
+	}
+	stmt := `` +
+		`SELECT list_name, ord, type, value, action, message, iq, presence_in, presence_out` +
+		` FROM privacy_list_items WHERE tenant = ? AND username = ? ORDER BY list_name, ord`
+	itemRows, err := s.conn().QueryContext(ctx, stmt, s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	if err := scanPrivacyListItemEntities(pls, itemRows); err != nil {
+		return nil, err
+	}
+	return pls, itemRows.Err()
+}
+
+func (s *mySQLStorage) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	_, err := s.conn().ExecContext(ctx, "UPDATE privacy_lists SET is_default = (name = ?), updated_at = NOW() WHERE tenant = ? AND username = ?", name, s.tenant, username)
+	return err
+}
+
+func (s *mySQLStorage) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	stmt := `` +
+		`INSERT INTO feature_flags (tenant, name, username, enabled, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, NOW(), NOW())` +
+		` ON DUPLICATE KEY UPDATE enabled = ?, updated_at = NOW()`
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, ff.Name, ff.Username, ff.Enabled, ff.Enabled)
+	return err
+}
+
+func (s *mySQLStorage) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM feature_flags WHERE tenant = ? AND name = ? AND username = ?", s.tenant, name, username)
+	return err
+}
+
+func (s *mySQLStorage) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT name, username, enabled FROM feature_flags WHERE tenant = ? AND username = ?", s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ffs []model.FeatureFlag
+	for rows.Next() {
+		var ff model.FeatureFlag
+		if err := rows.Scan(&ff.Name, &ff.Username, &ff.Enabled); err != nil {
+			return nil, err
+		}
+		ffs = append(ffs, ff)
+	}
+	return ffs, rows.Err()
+}
+
+func (s *mySQLStorage) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	stmt := `` +
+		`INSERT INTO invites (tenant, token, created_by, expires_at, used, updated_at, created_at)` +
+		` VALUES(?, ?, ?, ?, ?, NOW(), NOW())`
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, invite.Token, invite.CreatedBy, invite.ExpiresAt, invite.Used)
+	return err
+}
+
+func (s *mySQLStorage) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	// single conditional update, so that a token can't be redeemed twice
+	stmt := `` +
+		`UPDATE invites SET used = 1, updated_at = NOW()` +
+		` WHERE tenant = ? AND token = ? AND used = 0 AND expires_at > ?`
+	res, err := s.conn().ExecContext(ctx, stmt, s.tenant, token, now)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// InsertStreamSession satisfies Storage interface.
+// Sessions are stored in their binary representation.
+func (s *mySQLStorage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	stmt := `` +
+		`INSERT INTO stream_sessions (tenant, server_id, id, data, created_at)` +
+		` VALUES(?, ?, ?, ?, NOW())` +
+		` ON DUPLICATE KEY UPDATE data = ?`
+
+	buf := pool.Get()
+	defer pool.Put(buf)
+	session.ToBytes(buf)
+
+	data := buf.Bytes()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, session.ServerID, session.ID, data, data)
+	return err
+}
+
+func (s *mySQLStorage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT data FROM stream_sessions WHERE tenant = ? AND server_id = ?", s.tenant, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []model.StreamSession
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var session model.StreamSession
+		session.FromBytes(bytes.NewReader(data))
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *mySQLStorage) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM stream_sessions WHERE tenant = ? AND server_id = ?", s.tenant, serverID)
+	return err
+}
+
+func (s *mySQLStorage) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	// table statistics are estimates, but cheap to retrieve
+	// and account for the rows of every tenant sharing the database
+	stmt := `` +
+		`SELECT table_name, table_rows, data_length + index_length` +
+		` FROM information_schema.tables WHERE table_schema = DATABASE()` +
+		` ORDER BY table_name`
+
+	rows, err := s.conn().QueryContext(ctx, stmt)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usage []model.EntityUsage
+	for rows.Next() {
+		var u model.EntityUsage
+		var tableRows, tableBytes sql.NullInt64
+		if err := rows.Scan(&u.Entity, &tableRows, &tableBytes); err != nil {
+			return nil, err
+		}
+		u.Rows, u.Bytes = tableRows.Int64, tableBytes.Int64
+		usage = append(usage, u)
+	}
+	return usage, rows.Err()
+}
+
 func (s *mySQLStorage) loop() {
 	tc := time.NewTicker(time.Second * 15)
 	defer tc.Stop()
@@ -364,6 +1049,7 @@ func (s *mySQLStorage) loop() {
 				log.Error(err)
 			}
 		case ch := <-s.doneCh:
+			s.stmts.close()
 			s.db.Close()
 			close(ch)
 			return
@@ -371,16 +1057,52 @@ func (s *mySQLStorage) loop() {
 	}
 }
 
-func (s *mySQLStorage) inTransaction(f func(tx *sql.Tx) error) error {
-	tx, txErr := s.db.Begin()
-	if txErr != nil {
-		return txErr
+// InTransaction satisfies Storage interface.
+func (s *mySQLStorage) InTransaction(ctx context.Context, f func(tx Storage) error) error {
+	err := s.inTransaction(ctx, func(tx *mySQLConn) error {
+		return f(&mySQLStorage{db: s.db, tx: tx.tx, stmts: s.stmts, tenant: s.tenant})
+	})
+	if isMySQLConflict(err) {
+		return ErrConflict
+	}
+	return err
+}
+
+// isMySQLConflict returns whether or not err reports a transaction
+// losing against a concurrent one. Locking reads of absent rows take gap
+// locks that don't exclude each other, so concurrent insertions
+// conditioned on their absence deadlock rather than serialize.
+func isMySQLConflict(err error) bool {
+	mysqlErr, ok := err.(*mysql.MySQLError)
+	if !ok {
+		return false
+	}
+	switch mysqlErr.Number {
+	case 1062, 1213: // ER_DUP_ENTRY, ER_LOCK_DEADLOCK
+		return true
 	}
-	err := f(tx)
+	return false
+}
+
+// conn returns a connection running queries within the
+// transaction bound to s, if any.
+func (s *mySQLStorage) conn() *mySQLConn {
+	return &mySQLConn{db: s.db, tx: s.tx, stmts: s.stmts}
+}
+
+// inTransaction runs f within a transaction, joining
+// the one bound to s, if any.
+func (s *mySQLStorage) inTransaction(ctx context.Context, f func(tx *mySQLConn) error) error {
+	if s.tx != nil {
+		return f(s.conn())
+	}
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
+		return err
+	}
+	if err := f(&mySQLConn{db: s.db, tx: tx, stmts: s.stmts}); err != nil {
 		tx.Rollback()
 		return err
 	}
-	tx.Commit()
-	return nil
+	return tx.Commit()
 }
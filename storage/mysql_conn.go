@@ -0,0 +1,139 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"strings"
+	"sync"
+)
+
+// mySQLBatchSize is the maximum number of rows inserted or looked up
+// by a single batched statement. It also bounds the number of distinct
+// batched statements kept prepared.
+const mySQLBatchSize = 100
+
+// mySQLPlaceholders returns a comma-separated list of n placeholders.
+func mySQLPlaceholders(n int) string {
+	return strings.TrimSuffix(strings.Repeat("?, ", n), ", ")
+}
+
+// mySQLStmtCache keeps every statement prepared so far, keyed by its text,
+// so that it's not prepared again on every call. database/sql transparently
+// prepares each of them once per pooled connection it runs on.
+type mySQLStmtCache struct {
+	mu    sync.RWMutex
+	stmts map[string]*sql.Stmt
+}
+
+func newMySQLStmtCache() *mySQLStmtCache {
+	return &mySQLStmtCache{stmts: make(map[string]*sql.Stmt)}
+}
+
+func (c *mySQLStmtCache) prepare(ctx context.Context, db *sql.DB, query string) (*sql.Stmt, error) {
+	c.mu.RLock()
+	stmt := c.stmts[query]
+	c.mu.RUnlock()
+	if stmt != nil {
+		return stmt, nil
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if stmt := c.stmts[query]; stmt != nil {
+		return stmt, nil
+	}
+	stmt, err := db.PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	c.stmts[query] = stmt
+	return stmt, nil
+}
+
+// len returns the number of cached statements.
+func (c *mySQLStmtCache) len() int {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	return len(c.stmts)
+}
+
+func (c *mySQLStmtCache) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for query, stmt := range c.stmts {
+		stmt.Close()
+		delete(c.stmts, query)
+	}
+}
+
+// mySQLConn runs queries through cached prepared statements, within
+// tx if set. Queries are sent as they are whenever stmts is nil.
+type mySQLConn struct {
+	db    *sql.DB
+	tx    *sql.Tx
+	stmts *mySQLStmtCache
+}
+
+func (c *mySQLConn) ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error) {
+	if c.stmts == nil {
+		return c.sqlConn().ExecContext(ctx, query, args...)
+	}
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.ExecContext(ctx, args...)
+}
+
+func (c *mySQLConn) QueryContext(ctx context.Context, query string, args ...interface{}) (*sql.Rows, error) {
+	if c.stmts == nil {
+		return c.sqlConn().QueryContext(ctx, query, args...)
+	}
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return stmt.QueryContext(ctx, args...)
+}
+
+func (c *mySQLConn) QueryRowContext(ctx context.Context, query string, args ...interface{}) rowScanner {
+	if c.stmts == nil {
+		return c.sqlConn().QueryRowContext(ctx, query, args...)
+	}
+	stmt, err := c.stmt(ctx, query)
+	if err != nil {
+		return errRowScanner{err: err}
+	}
+	return stmt.QueryRowContext(ctx, args...)
+}
+
+func (c *mySQLConn) stmt(ctx context.Context, query string) (*sql.Stmt, error) {
+	stmt, err := c.stmts.prepare(ctx, c.db, query)
+	if err != nil {
+		return nil, err
+	}
+	if c.tx != nil {
+		return c.tx.StmtContext(ctx, stmt), nil
+	}
+	return stmt, nil
+}
+
+func (c *mySQLConn) sqlConn() sqlConn {
+	if c.tx != nil {
+		return c.tx
+	}
+	return c.db
+}
+
+// errRowScanner represents a row whose query couldn't be run.
+type errRowScanner struct {
+	err error
+}
+
+func (r errRowScanner) Scan(...interface{}) error {
+	return r.err
+}
@@ -6,9 +6,13 @@
 package storage
 
 import (
+	"errors"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
 )
 
 type rowScanner interface {
@@ -22,7 +26,7 @@ type rowsScanner interface {
 
 func scanRosterItemEntity(ri *model.RosterItem, scanner rowScanner) error {
 	var groups string
-	if err := scanner.Scan(&ri.User, &ri.Contact, &ri.Name, &ri.Subscription, &groups, &ri.Ask); err != nil {
+	if err := scanner.Scan(&ri.User, &ri.Contact, &ri.Name, &ri.Subscription, &groups, &ri.Ask, &ri.Ver); err != nil {
 		return err
 	}
 	ri.Groups = strings.Split(groups, ";")
@@ -40,3 +44,98 @@ func scanRosterItemEntities(scanner rowsScanner) ([]model.RosterItem, error) {
 	}
 	return ret, nil
 }
+
+// scanOfflineMessageEntities scans rows made of message
+// identifier, data and receipt time in seconds since the Unix epoch.
+func scanOfflineMessageEntities(scanner rowsScanner) ([]model.OfflineMessage, error) {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	var ids, receivedAts []int64
+	buf.WriteString("<root>")
+	for scanner.Next() {
+		var id, receivedAt int64
+		var data string
+		if err := scanner.Scan(&id, &data, &receivedAt); err != nil {
+			return nil, err
+		}
+		buf.WriteString(data)
+		ids = append(ids, id)
+		receivedAts = append(receivedAts, receivedAt)
+	}
+	buf.WriteString("</root>")
+
+	rootEl, err := xml.NewParser(buf).ParseElement()
+	if err != nil {
+		return nil, err
+	}
+	msgs := rootEl.Elements()
+	if len(msgs) != len(ids) {
+		return nil, errors.New("storage: malformed offline message")
+	}
+	var ret []model.OfflineMessage
+	for i, msg := range msgs {
+		ret = append(ret, model.OfflineMessage{
+			Message:    msg,
+			Node:       strconv.FormatInt(ids[i], 10),
+			ReceivedAt: time.Unix(receivedAts[i], 0),
+		})
+	}
+	return ret, nil
+}
+
+// scanArchivedMessageEntities scans rows made of message identifier,
+// with JID, with resource, archiving time and data, owned by username.
+func scanArchivedMessageEntities(scanner rowsScanner, username string) ([]model.ArchivedMessage, error) {
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	var ret []model.ArchivedMessage
+	buf.WriteString("<root>")
+	for scanner.Next() {
+		var id, stamp int64
+		var data string
+		am := model.ArchivedMessage{Username: username}
+		if err := scanner.Scan(&id, &am.With, &am.WithResource, &stamp, &data); err != nil {
+			return nil, err
+		}
+		buf.WriteString(data)
+		am.ID = strconv.FormatInt(id, 10)
+		am.Stamp = time.Unix(stamp, 0)
+		ret = append(ret, am)
+	}
+	buf.WriteString("</root>")
+
+	rootEl, err := xml.NewParser(buf).ParseElement()
+	if err != nil {
+		return nil, err
+	}
+	msgs := rootEl.Elements()
+	if len(msgs) != len(ret) {
+		return nil, errors.New("storage: malformed archived message")
+	}
+	for i, msg := range msgs {
+		ret[i].Message = msg
+	}
+	return ret, nil
+}
+
+// scanPrivacyListItemEntities scans rows made of list name, item order,
+// type, value, action and stanza types, appending every item to its
+// list within pls. Items of any other list are ignored.
+func scanPrivacyListItemEntities(pls []model.PrivacyList, scanner rowsScanner) error {
+	for scanner.Next() {
+		var name string
+		var item model.PrivacyListItem
+		if err := scanner.Scan(&name, &item.Order, &item.Type, &item.Value, &item.Action, &item.Message, &item.IQ, &item.PresenceIn, &item.PresenceOut); err != nil {
+			return err
+		}
+		for i := range pls {
+			if pls[i].Name == name {
+				pls[i].Items = append(pls[i].Items, item)
+				break
+			}
+		}
+	}
+	return nil
+}
@@ -6,11 +6,16 @@
 package storage
 
 import (
+	"bytes"
+	"context"
 	"database/sql/driver"
 	"errors"
+	"fmt"
 	"testing"
+	"time"
 
 	"github.com/DATA-DOG/go-sqlmock"
+	"github.com/go-sql-driver/mysql"
 	"github.com/ortuman/jackal/bufferpool"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
@@ -27,18 +32,18 @@ func TestMySQLStorageInsertUser(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO users (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", "1234", "1234").
+		WithArgs("", "ortuman", "1234", "", "", 0, "", false, "1234", "", "", 0, "", false).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := s.InsertOrUpdateUser(&user)
+	err := s.InsertOrUpdateUser(context.Background(), &user)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO users (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", "1234", "1234").
+		WithArgs("", "ortuman", "1234", "", "", 0, "", false, "1234", "", "", 0, "", false).
 		WillReturnError(errMySQLStorage)
-	err = s.InsertOrUpdateUser(&user)
+	err = s.InsertOrUpdateUser(context.Background(), &user)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
@@ -47,56 +52,124 @@ func TestMySQLStorageDeleteUser(t *testing.T) {
 	s, mock := newMockMySQLStorage()
 	mock.ExpectBegin()
 	mock.ExpectExec("DELETE FROM offline_messages (.+)").
-		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
-	mock.ExpectExec("DELETE FROM roster_items (.+)").
-		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM quarantined_messages (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_items WHERE tenant = \\? AND user = \\?").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_versions (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_tombstones WHERE tenant = \\? AND user = \\?").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_notifications WHERE tenant = \\? AND user = \\?").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_notifications WHERE tenant = \\? AND contact = \\?").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM private_storage (.+)").
-		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM vcards (.+)").
-		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM archived_messages (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM archive_prefs (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM block_list_items (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM privacy_list_items (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM privacy_lists (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM feature_flags (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM users (.+)").
-		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectCommit()
 
-	err := s.DeleteUser("ortuman")
+	err := s.DeleteUser(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectBegin()
 	mock.ExpectExec("DELETE FROM offline_messages (.+)").
-		WithArgs("ortuman").WillReturnError(errMySQLStorage)
+		WithArgs("", "ortuman").WillReturnError(errMySQLStorage)
 	mock.ExpectRollback()
 
-	err = s.DeleteUser("ortuman")
+	err = s.DeleteUser(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
 
 func TestMySQLStorageFetchUser(t *testing.T) {
-	var userColumns = []string{"username", "password"}
+	var userColumns = []string{"username", "password", "password_hash", "scram_verifier", "purge_at", "email", "email_verified"}
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnRows(sqlmock.NewRows(userColumns))
 
-	usr, err := s.FetchUser("ortuman")
+	usr, err := s.FetchUser(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, usr)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
-		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "1234"))
-	_, err = s.FetchUser("ortuman")
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "1234", "", "", 0, "", false))
+	usr, err = s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.False(t, usr.IsRemoved())
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "1234", "", "", 1530000000, "", false))
+	usr, err = s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, int64(1530000000), usr.PurgeAt.Unix())
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "1234", "", "", 0, "ortuman@jackal.im", false))
+	usr, err = s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, "ortuman@jackal.im", usr.Email)
+	require.True(t, usr.IsPendingVerification())
+
+	verifier := &model.ScramVerifier{
+		Salt:            []byte("salt"),
+		IterationCount:  4096,
+		StoredKeySHA1:   []byte("stored1"),
+		ServerKeySHA1:   []byte("server1"),
+		StoredKeySHA256: []byte("stored256"),
+		ServerKeySHA256: []byte("server256"),
+	}
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "", "$2a$04$hash", verifier.String(), 0, "", false))
+	usr, err = s.FetchUser(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
+	require.Equal(t, verifier, usr.Verifier)
+	require.Equal(t, "$2a$04$hash", usr.PasswordHash)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
-		WithArgs("ortuman").WillReturnError(errMySQLStorage)
-	_, err = s.FetchUser("ortuman")
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(userColumns).AddRow("ortuman", "", "", "bad verifier", 0, "", false))
+	_, err = s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.NotNil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM users (.+)").
+		WithArgs("", "ortuman").WillReturnError(errMySQLStorage)
+	_, err = s.FetchUser(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
@@ -106,115 +179,450 @@ func TestMySQLStorageUserExists(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectQuery("SELECT COUNT(.+) FROM users (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnRows(sqlmock.NewRows(countColums).AddRow(1))
 
-	ok, err := s.UserExists("ortuman")
+	ok, err := s.UserExists(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.True(t, ok)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT COUNT(.+) FROM users (.+)").
-		WithArgs("romeo").
+		WithArgs("", "romeo").
+		WillReturnError(errMySQLStorage)
+	_, err = s.UserExists(context.Background(), "romeo")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+
+	// locked within transactions
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users (.+) FOR UPDATE").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(0))
+	mock.ExpectCommit()
+	err = s.InTransaction(context.Background(), func(tx Storage) error {
+		ok, err = tx.UserExists(context.Background(), "ortuman")
+		return err
+	})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	// losing against a concurrent insertion
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users (.+) FOR UPDATE").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(0))
+	mock.ExpectExec("INSERT INTO users (.+)").
+		WillReturnError(&mysql.MySQLError{Number: 1213, Message: "Deadlock found when trying to get lock"})
+	mock.ExpectRollback()
+	err = s.InTransaction(context.Background(), func(tx Storage) error {
+		if _, err := tx.UserExists(context.Background(), "ortuman"); err != nil {
+			return err
+		}
+		return tx.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman"})
+	})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, ErrConflict, err)
+}
+
+func TestMySQLStorageCountUsers(t *testing.T) {
+	countColums := []string{"count"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(3))
+
+	cnt, err := s.CountUsers(context.Background())
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 3, cnt)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users").
+		WillReturnError(errMySQLStorage)
+	_, err = s.CountUsers(context.Background())
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageTenant(t *testing.T) {
+	countColums := []string{"count"}
+
+	s, mock := newMockMySQLStorage()
+	s.tenant = "tenant_a"
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE tenant = (.+)").
+		WithArgs("tenant_a").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(1))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM users WHERE tenant = (.+) AND username = (.+)").
+		WithArgs("tenant_a", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(0))
+
+	cnt, err := s.CountUsers(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+
+	ok, err := s.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.False(t, ok)
+	require.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLStorageInsertRemovedUser(t *testing.T) {
+	user := model.User{Username: "ortuman", Password: "1234", PurgeAt: time.Unix(1530000000, 0)}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO users (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "ortuman", "1234", "", "", 1530000000, "", false, "1234", "", "", 1530000000, "", false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := s.InsertOrUpdateUser(context.Background(), &user)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+}
+
+func TestMySQLStorageFetchPurgeableUsers(t *testing.T) {
+	now := time.Unix(1530000000, 0)
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT username FROM users WHERE (.+)").
+		WithArgs("", 1530000000).
+		WillReturnRows(sqlmock.NewRows([]string{"username"}).AddRow("ortuman").AddRow("romeo"))
+
+	usernames, err := s.FetchPurgeableUsers(context.Background(), now)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []string{"ortuman", "romeo"}, usernames)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT username FROM users WHERE (.+)").
+		WithArgs("", 1530000000).
 		WillReturnError(errMySQLStorage)
-	_, err = s.UserExists("romeo")
+	_, err = s.FetchPurgeableUsers(context.Background(), now)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
 
 func TestMySQLStorageInsertRosterItem(t *testing.T) {
 	g := []string{"general", "friends"}
-	ri := model.RosterItem{"user", "contact", "a name", "both", false, g}
+	ri := model.RosterItem{User: "user", Contact: "contact", Name: "a name", Subscription: "both", Groups: g}
 
 	args := []driver.Value{
+		"",
 		ri.User,
 		ri.Contact,
 		ri.Name,
 		ri.Subscription,
 		"general;friends",
 		ri.Ask,
+		3,
 		ri.Name,
 		ri.Subscription,
 		"general;friends",
 		ri.Ask,
+		3,
 	}
 	s, mock := newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO roster_versions (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "user").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT ver FROM roster_versions (.+)").
+		WithArgs("", "user").
+		WillReturnRows(sqlmock.NewRows([]string{"ver"}).AddRow(3))
 	mock.ExpectExec("INSERT INTO roster_items (.+) ON DUPLICATE KEY UPDATE (.+)").
 		WithArgs(args...).
 		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectExec("DELETE FROM roster_tombstones (.+)").
+		WithArgs("", "user", "contact").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
 
-	err := s.InsertOrUpdateRosterItem(&ri)
+	err := s.InsertOrUpdateRosterItem(context.Background(), &ri)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
+	require.Equal(t, 3, ri.Ver)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO roster_versions (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "user").
+		WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.InsertOrUpdateRosterItem(context.Background(), &ri)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
 }
 
 func TestMySQLStorageDeleteRosterItem(t *testing.T) {
 	s, mock := newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM roster_items (.+)").
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO roster_versions (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "user").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT ver FROM roster_versions (.+)").
+		WithArgs("", "user").
+		WillReturnRows(sqlmock.NewRows([]string{"ver"}).AddRow(4))
+	mock.ExpectExec("INSERT INTO roster_tombstones (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "user", "contact", 4, sqlmock.AnyArg(), 4, sqlmock.AnyArg()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
+
+	err := s.DeleteRosterItem(context.Background(), "user", "contact")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	// not existing item
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM roster_items (.+)").
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
+
+	err = s.DeleteRosterItem(context.Background(), "user", "contact")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM roster_items (.+)").
+		WithArgs("", "user", "contact").WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.DeleteRosterItem(context.Background(), "user", "contact")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInTransaction(t *testing.T) {
+	removeItem := func(tx Storage) error {
+		if err := tx.DeleteRosterNotification(context.Background(), "user", "contact"); err != nil {
+			return err
+		}
+		return tx.DeleteRosterItem(context.Background(), "user", "contact")
+	}
+	// statements run within a single transaction, joined by nested ones
+	s, mock := newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM roster_notifications (.+)").
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM roster_items (.+)").
-		WithArgs("user", "contact").WillReturnResult(sqlmock.NewResult(0, 1))
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit()
 
-	err := s.DeleteRosterItem("user", "contact")
+	err := s.InTransaction(context.Background(), removeItem)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
+	// a failure in the second statement rolls back the first one
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM roster_notifications (.+)").
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_items (.+)").
+		WithArgs("", "user", "contact").WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.InTransaction(context.Background(), removeItem)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+
 	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM roster_notifications (.+)").
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 1))
 	mock.ExpectExec("DELETE FROM roster_items (.+)").
-		WithArgs("user", "contact").WillReturnError(errMySQLStorage)
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectCommit().WillReturnError(errMySQLStorage)
+
+	err = s.InTransaction(context.Background(), removeItem)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchRosterVersion(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT ver, pruned_ver FROM roster_versions (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"ver", "pruned_ver"}).AddRow(12, 4))
+
+	rv, err := s.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, model.RosterVersion{Ver: 12, PrunedVer: 4}, rv)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT ver, pruned_ver FROM roster_versions (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"ver", "pruned_ver"}))
+
+	rv, err = s.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, model.RosterVersion{}, rv)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT ver, pruned_ver FROM roster_versions (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageRosterTombstones(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM roster_tombstones (.+)").
+		WithArgs("", "ortuman", 3).
+		WillReturnRows(sqlmock.NewRows([]string{"user", "contact", "ver", "deleted_at"}).
+			AddRow("ortuman", "romeo", 5, 1530000000000000000))
+
+	rts, err := s.FetchRosterTombstones(context.Background(), "ortuman", 3)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rts))
+	require.Equal(t, "romeo", rts[0].Contact)
+	require.Equal(t, 5, rts[0].Ver)
+	require.Equal(t, int64(1530000000000000000), rts[0].DeletedAt.UnixNano())
+
+	before := time.Unix(1530000000, 0)
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE roster_versions (.+)").
+		WithArgs("", before.UnixNano(), "").
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM roster_tombstones (.+)").
+		WithArgs("", before.UnixNano()).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectCommit()
+
+	n, err := s.PruneRosterTombstones(context.Background(), before)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, n)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("UPDATE roster_versions (.+)").
+		WithArgs("", before.UnixNano(), "").
+		WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
 
-	err = s.DeleteRosterItem("user", "contact")
+	_, err = s.PruneRosterTombstones(context.Background(), before)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
 
 func TestMySQLStorageFetchRosterItems(t *testing.T) {
-	var riColumns = []string{"user", "contact", "name", "subscription", "groups", "ask"}
+	var riColumns = []string{"user", "contact", "name", "subscription", "groups", "ask", "ver"}
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
-		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(riColumns).AddRow("ortuman", "romeo", "Romeo", "both", "", false))
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(riColumns).AddRow("ortuman", "romeo", "Romeo", "both", "", false, 2))
 
-	rosterItems, err := s.FetchRosterItems("ortuman")
+	rosterItems, err := s.FetchRosterItems(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.Equal(t, 1, len(rosterItems))
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnError(errMySQLStorage)
 
-	_, err = s.FetchRosterItems("ortuman")
+	_, err = s.FetchRosterItems(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
-		WithArgs("ortuman", "romeo").
-		WillReturnRows(sqlmock.NewRows(riColumns).AddRow("ortuman", "romeo", "Romeo", "both", "", false))
+		WithArgs("", "ortuman", "romeo").
+		WillReturnRows(sqlmock.NewRows(riColumns).AddRow("ortuman", "romeo", "Romeo", "both", "", false, 2))
 
-	ri, err := s.FetchRosterItem("ortuman", "romeo")
+	ri, err := s.FetchRosterItem(context.Background(), "ortuman", "romeo")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
-		WithArgs("ortuman", "romeo").
+		WithArgs("", "ortuman", "romeo").
 		WillReturnRows(sqlmock.NewRows(riColumns))
 
-	ri, err = s.FetchRosterItem("ortuman", "romeo")
+	ri, err = s.FetchRosterItem(context.Background(), "ortuman", "romeo")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, ri)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
-		WithArgs("ortuman", "romeo").
+		WithArgs("", "ortuman", "romeo").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchRosterItem(context.Background(), "ortuman", "romeo")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchRosterItemsOfUsers(t *testing.T) {
+	var riColumns = []string{"user", "contact", "name", "subscription", "groups", "ask", "ver"}
+
+	// a single query fetches every roster
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM roster_items WHERE tenant = \\? AND user IN \\(\\?, \\?, \\?\\)(.+)").
+		WithArgs("", "ortuman", "romeo", "juliet").
+		WillReturnRows(sqlmock.NewRows(riColumns).
+			AddRow("ortuman", "romeo", "Romeo", "both", "", false, 2).
+			AddRow("romeo", "ortuman", "Miguel", "both", "", false, 1).
+			AddRow("ortuman", "juliet", "Juliet", "to", "", false, 1))
+
+	riMap, err := s.FetchRosterItemsOfUsers(context.Background(), []string{"ortuman", "romeo", "juliet"})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(riMap))
+	require.Equal(t, 2, len(riMap["ortuman"]))
+	require.Equal(t, "romeo", riMap["ortuman"][0].Contact)
+	require.Equal(t, "juliet", riMap["ortuman"][1].Contact)
+	require.Equal(t, 1, len(riMap["romeo"]))
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
+		WithArgs("", "ortuman").
 		WillReturnError(errMySQLStorage)
 
-	_, err = s.FetchRosterItem("ortuman", "romeo")
+	_, err = s.FetchRosterItemsOfUsers(context.Background(), []string{"ortuman"})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageStmtCache(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	s.stmts = newMySQLStmtCache()
+
+	// statements are prepared only once
+	prep := mock.ExpectPrepare("DELETE FROM offline_messages (.+)")
+	prep.ExpectExec().WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	prep.ExpectExec().WithArgs("", "romeo").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.Nil(t, s.DeleteOfflineMessages(context.Background(), "ortuman"))
+	require.Nil(t, s.DeleteOfflineMessages(context.Background(), "romeo"))
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, 1, s.stmts.len())
+
+	s, mock = newMockMySQLStorage()
+	s.stmts = newMySQLStmtCache()
+	mock.ExpectPrepare("DELETE FROM offline_messages (.+)").WillReturnError(errMySQLStorage)
+
+	err := s.DeleteOfflineMessages(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
+	require.Equal(t, 0, s.stmts.len())
 }
 
 func TestMySQLStorageInsertRosterNotification(t *testing.T) {
@@ -233,6 +641,7 @@ func TestMySQLStorageInsertRosterNotification(t *testing.T) {
 	elementsXML := buf.String()
 
 	args := []driver.Value{
+		"",
 		rn.User,
 		rn.Contact,
 		elementsXML,
@@ -243,7 +652,7 @@ func TestMySQLStorageInsertRosterNotification(t *testing.T) {
 		WithArgs(args...).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := s.InsertOrUpdateRosterNotification(&rn)
+	err := s.InsertOrUpdateRosterNotification(context.Background(), &rn)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
@@ -252,7 +661,7 @@ func TestMySQLStorageInsertRosterNotification(t *testing.T) {
 		WithArgs(args...).
 		WillReturnError(errMySQLStorage)
 
-	err = s.InsertOrUpdateRosterNotification(&rn)
+	err = s.InsertOrUpdateRosterNotification(context.Background(), &rn)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
@@ -260,17 +669,17 @@ func TestMySQLStorageInsertRosterNotification(t *testing.T) {
 func TestMySQLStorageDeleteRosterNotification(t *testing.T) {
 	s, mock := newMockMySQLStorage()
 	mock.ExpectExec("DELETE FROM roster_notifications (.+)").
-		WithArgs("user", "contact").WillReturnResult(sqlmock.NewResult(0, 1))
+		WithArgs("", "user", "contact").WillReturnResult(sqlmock.NewResult(0, 1))
 
-	err := s.DeleteRosterNotification("user", "contact")
+	err := s.DeleteRosterNotification(context.Background(), "user", "contact")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectExec("DELETE FROM roster_notifications (.+)").
-		WithArgs("user", "contact").WillReturnError(errMySQLStorage)
+		WithArgs("", "user", "contact").WillReturnError(errMySQLStorage)
 
-	err = s.DeleteRosterNotification("user", "contact")
+	err = s.DeleteRosterNotification(context.Background(), "user", "contact")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
@@ -280,39 +689,39 @@ func TestMySQLStorageFetchRosterNotifications(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_notifications (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnRows(sqlmock.NewRows(rnColumns).AddRow("romeo", "contact", "<priority>8</priority>"))
 
-	rosterNotifications, err := s.FetchRosterNotifications("ortuman")
+	rosterNotifications, err := s.FetchRosterNotifications(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.Equal(t, 1, len(rosterNotifications))
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_notifications (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnRows(sqlmock.NewRows(rnColumns))
 
-	rosterNotifications, err = s.FetchRosterNotifications("ortuman")
+	rosterNotifications, err = s.FetchRosterNotifications(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.Equal(t, 0, len(rosterNotifications))
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_notifications (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnError(errMySQLStorage)
 
-	_, err = s.FetchRosterNotifications("ortuman")
+	_, err = s.FetchRosterNotifications(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM roster_notifications (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnRows(sqlmock.NewRows(rnColumns).AddRow("romeo", "contact", "<priority>8"))
 
-	_, err = s.FetchRosterNotifications("ortuman")
+	_, err = s.FetchRosterNotifications(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.NotNil(t, err)
 }
@@ -323,20 +732,20 @@ func TestMySQLStorageInsertVCard(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO vcards (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", rawXML, rawXML).
+		WithArgs("", "ortuman", rawXML, rawXML).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := s.InsertOrUpdateVCard(vCard, "ortuman")
+	err := s.InsertOrUpdateVCard(context.Background(), vCard, "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.NotNil(t, vCard)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO vcards (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", rawXML, rawXML).
+		WithArgs("", "ortuman", rawXML, rawXML).
 		WillReturnError(errMySQLStorage)
 
-	err = s.InsertOrUpdateVCard(vCard, "ortuman")
+	err = s.InsertOrUpdateVCard(context.Background(), vCard, "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
@@ -346,30 +755,30 @@ func TestMySQLStorageFetchVCard(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM vcards (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnRows(sqlmock.NewRows(vCardColumns).AddRow("<vCard><FN>Miguel Ángel</FN></vCard>"))
 
-	vCard, err := s.FetchVCard("ortuman")
+	vCard, err := s.FetchVCard(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.NotNil(t, vCard)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM vcards (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnRows(sqlmock.NewRows(vCardColumns))
 
-	vCard, err = s.FetchVCard("ortuman")
+	vCard, err = s.FetchVCard(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.Nil(t, vCard)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM vcards (.+)").
-		WithArgs("ortuman").
+		WithArgs("", "ortuman").
 		WillReturnError(errMySQLStorage)
 
-	vCard, _ = s.FetchVCard("ortuman")
+	vCard, _ = s.FetchVCard(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, vCard)
 }
@@ -380,19 +789,19 @@ func TestMySQLStorageInsertPrivateXML(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO private_storage (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", "exodus:ns", rawXML, rawXML).
+		WithArgs("", "ortuman", "exodus:ns", rawXML, rawXML).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := s.InsertOrUpdatePrivateXML([]xml.Element{private}, "exodus:ns", "ortuman")
+	err := s.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{private}, "exodus:ns", "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO private_storage (.+) ON DUPLICATE KEY UPDATE (.+)").
-		WithArgs("ortuman", "exodus:ns", rawXML, rawXML).
+		WithArgs("", "ortuman", "exodus:ns", rawXML, rawXML).
 		WillReturnError(errMySQLStorage)
 
-	err = s.InsertOrUpdatePrivateXML([]xml.Element{private}, "exodus:ns", "ortuman")
+	err = s.InsertOrUpdatePrivateXML(context.Background(), []xml.Element{private}, "exodus:ns", "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 }
@@ -402,50 +811,50 @@ func TestMySQLStorageFetchPrivateXML(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM private_storage (.+)").
-		WithArgs("ortuman", "exodus:ns").
+		WithArgs("", "ortuman", "exodus:ns").
 		WillReturnRows(sqlmock.NewRows(privateColumns).AddRow("<exodus xmlns='exodus:ns'><stuff/></exodus>"))
 
-	elems, err := s.FetchPrivateXML("exodus:ns", "ortuman")
+	elems, err := s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.Equal(t, 1, len(elems))
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM private_storage (.+)").
-		WithArgs("ortuman", "exodus:ns").
+		WithArgs("", "ortuman", "exodus:ns").
 		WillReturnRows(sqlmock.NewRows(privateColumns).AddRow("<exodus xmlns='exodus:ns'><stuff/>"))
 
-	elems, err = s.FetchPrivateXML("exodus:ns", "ortuman")
+	elems, err = s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.NotNil(t, err)
 	require.Equal(t, 0, len(elems))
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM private_storage (.+)").
-		WithArgs("ortuman", "exodus:ns").
+		WithArgs("", "ortuman", "exodus:ns").
 		WillReturnRows(sqlmock.NewRows(privateColumns).AddRow(""))
 
-	elems, err = s.FetchPrivateXML("exodus:ns", "ortuman")
+	elems, err = s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.Equal(t, 0, len(elems))
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM private_storage (.+)").
-		WithArgs("ortuman", "exodus:ns").
+		WithArgs("", "ortuman", "exodus:ns").
 		WillReturnRows(sqlmock.NewRows(privateColumns))
 
-	elems, err = s.FetchPrivateXML("exodus:ns", "ortuman")
+	elems, err = s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 	require.Equal(t, 0, len(elems))
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectQuery("SELECT (.+) FROM private_storage (.+)").
-		WithArgs("ortuman", "exodus:ns").
+		WithArgs("", "ortuman", "exodus:ns").
 		WillReturnError(errMySQLStorage)
 
-	elems, err = s.FetchPrivateXML("exodus:ns", "ortuman")
+	elems, err = s.FetchPrivateXML(context.Background(), "exodus:ns", "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
 	require.Equal(t, 0, len(elems))
@@ -461,108 +870,1016 @@ func TestMySQLStorageInsertOfflineMessages(t *testing.T) {
 
 	s, mock := newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO offline_messages (.+)").
-		WithArgs("ortuman", messageXML).
+		WithArgs("", "ortuman", messageXML).
 		WillReturnResult(sqlmock.NewResult(1, 1))
 
-	err := s.InsertOfflineMessage(m, "ortuman")
+	err := s.InsertOfflineMessage(context.Background(), m, "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Nil(t, err)
 
 	s, mock = newMockMySQLStorage()
 	mock.ExpectExec("INSERT INTO offline_messages (.+)").
-		WithArgs("ortuman", messageXML).
+		WithArgs("", "ortuman", messageXML).
 		WillReturnError(errMySQLStorage)
 
-	err = s.InsertOfflineMessage(m, "ortuman")
+	err = s.InsertOfflineMessage(context.Background(), m, "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.NotNil(t, err)
 }
 
-func TestMySQLStorageCountOfflineMessages(t *testing.T) {
-	countColums := []string{"count"}
+func TestMySQLStorageInsertOfflineMessagesBatch(t *testing.T) {
+	messages, args := tUtilMySQLOfflineMessages(3)
 
+	// a single statement inserts every message
 	s, mock := newMockMySQLStorage()
-	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+)").
-		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(countColums).AddRow(1))
+	mock.ExpectExec("INSERT INTO offline_messages (.+)").
+		WithArgs(args...).
+		WillReturnResult(sqlmock.NewResult(3, 3))
 
-	cnt, _ := s.CountOfflineMessages("ortuman")
+	err := s.InsertOfflineMessages(context.Background(), messages, "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
-	require.Equal(t, 1, cnt)
+	require.Nil(t, err)
 
 	s, mock = newMockMySQLStorage()
-	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+)").
-		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(countColums))
+	mock.ExpectExec("INSERT INTO offline_messages (.+)").
+		WithArgs(args...).
+		WillReturnError(errMySQLStorage)
 
-	cnt, _ = s.CountOfflineMessages("ortuman")
+	err = s.InsertOfflineMessages(context.Background(), messages, "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
-	require.Equal(t, 0, cnt)
+	require.Equal(t, errMySQLStorage, err)
+
+	// larger batches get split within a single transaction
+	messages, args = tUtilMySQLOfflineMessages(mySQLBatchSize + 1)
 
 	s, mock = newMockMySQLStorage()
-	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+)").
-		WithArgs("ortuman").
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO offline_messages (.+)").
+		WithArgs(args[:mySQLBatchSize*3]...).
+		WillReturnResult(sqlmock.NewResult(mySQLBatchSize, mySQLBatchSize))
+	mock.ExpectExec("INSERT INTO offline_messages (.+)").
+		WithArgs(args[mySQLBatchSize*3:]...).
 		WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
 
-	_, err := s.CountOfflineMessages("ortuman")
+	err = s.InsertOfflineMessages(context.Background(), messages, "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
+
+	// nothing to insert
+	s, mock = newMockMySQLStorage()
+	err = s.InsertOfflineMessages(context.Background(), nil, "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
 }
 
-func TestMySQLStorageFetchOfflineMessages(t *testing.T) {
-	var offlineMessagesColumns = []string{"data"}
+func TestMySQLStorageInsertCappedOfflineMessage(t *testing.T) {
+	message := xml.NewMessageType(uuid.New(), xml.NormalType)
+	countColums := []string{"count"}
 
+	// queue isn't full
 	s, mock := newMockMySQLStorage()
-	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
-		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns).AddRow("<message id='abc'><body>Hi!</body></message>"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+) FOR UPDATE").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(2))
+	mock.ExpectExec("INSERT INTO offline_messages (.+)").
+		WithArgs("", "ortuman", message.String()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	msgs, _ := s.FetchOfflineMessages("ortuman")
+	inserted, err := s.InsertCappedOfflineMessage(context.Background(), message, "ortuman", 3, false)
 	require.Nil(t, mock.ExpectationsWereMet())
-	require.Equal(t, 1, len(msgs))
+	require.Nil(t, err)
+	require.True(t, inserted)
 
+	// queue is full
 	s, mock = newMockMySQLStorage()
-	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
-		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+) FOR UPDATE").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(3))
+	mock.ExpectCommit()
 
-	msgs, _ = s.FetchOfflineMessages("ortuman")
+	inserted, err = s.InsertCappedOfflineMessage(context.Background(), message, "ortuman", 3, false)
 	require.Nil(t, mock.ExpectationsWereMet())
-	require.Equal(t, 0, len(msgs))
+	require.Nil(t, err)
+	require.False(t, inserted)
 
+	// ...dropping the oldest messages
 	s, mock = newMockMySQLStorage()
-	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
-		WithArgs("ortuman").
-		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns).AddRow("<message id='abc'><body>Hi!"))
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+) FOR UPDATE").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(4))
+	mock.ExpectExec("DELETE FROM offline_messages (.+) ORDER BY id LIMIT (.+)").
+		WithArgs("", "ortuman", 2).
+		WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO offline_messages (.+)").
+		WithArgs("", "ortuman", message.String()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectCommit()
 
-	_, err := s.FetchOfflineMessages("ortuman")
+	inserted, err = s.InsertCappedOfflineMessage(context.Background(), message, "ortuman", 3, true)
 	require.Nil(t, mock.ExpectationsWereMet())
-	require.NotNil(t, err)
+	require.Nil(t, err)
+	require.True(t, inserted)
 
 	s, mock = newMockMySQLStorage()
-	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
-		WithArgs("ortuman").
+	mock.ExpectBegin()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+) FOR UPDATE").
+		WithArgs("", "ortuman").
 		WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
 
-	_, err = s.FetchOfflineMessages("ortuman")
+	inserted, err = s.InsertCappedOfflineMessage(context.Background(), message, "ortuman", 3, false)
 	require.Nil(t, mock.ExpectationsWereMet())
 	require.Equal(t, errMySQLStorage, err)
+	require.False(t, inserted)
 }
 
-func TestMySQLStorageDeleteOfflineMessages(t *testing.T) {
+func TestMySQLStorageCountOfflineMessages(t *testing.T) {
+	countColums := []string{"count"}
+
 	s, mock := newMockMySQLStorage()
-	mock.ExpectExec("DELETE FROM offline_messages (.+)").
-		WithArgs("ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums).AddRow(1))
 
-	err := s.DeleteOfflineMessages("ortuman")
+	cnt, _ := s.CountOfflineMessages(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
-	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
 
 	s, mock = newMockMySQLStorage()
-	mock.ExpectExec("DELETE FROM offline_messages (.+)").
-		WithArgs("ortuman").WillReturnError(errMySQLStorage)
+	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(countColums))
 
-	err = s.DeleteOfflineMessages("ortuman")
+	cnt, _ = s.CountOfflineMessages(context.Background(), "ortuman")
 	require.Nil(t, mock.ExpectationsWereMet())
-	require.Equal(t, errMySQLStorage, err)
+	require.Equal(t, 0, cnt)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT COUNT(.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err := s.CountOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchOfflineMessages(t *testing.T) {
+	var offlineMessagesColumns = []string{"id", "data", "received_at"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns).
+			AddRow(1, "<message id='abc'><body>Hi!</body></message>", 1530000000).
+			AddRow(2, "<message id='def'><body>Bye!</body></message>", 1530000060))
+
+	msgs, _ := s.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "abc", msgs[0].Message.ID())
+	require.Equal(t, "1", msgs[0].Node)
+	require.Equal(t, int64(1530000000), msgs[0].ReceivedAt.Unix())
+	require.Equal(t, "def", msgs[1].Message.ID())
+	require.Equal(t, "2", msgs[1].Node)
+	require.Equal(t, int64(1530000060), msgs[1].ReceivedAt.Unix())
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns))
+
+	msgs, _ = s.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, 0, len(msgs))
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns).AddRow(1, "<message id='abc'><body>Hi!", 1530000000))
+
+	_, err := s.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.NotNil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchOfflineMessage(t *testing.T) {
+	var offlineMessagesColumns = []string{"id", "data", "received_at"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman", int64(2)).
+		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns).
+			AddRow(2, "<message id='def'><body>Bye!</body></message>", 1530000060))
+
+	msg, err := s.FetchOfflineMessage(context.Background(), "ortuman", "2")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.NotNil(t, msg)
+	require.Equal(t, "def", msg.Message.ID())
+	require.Equal(t, "2", msg.Node)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman", int64(3)).
+		WillReturnRows(sqlmock.NewRows(offlineMessagesColumns))
+
+	msg, err = s.FetchOfflineMessage(context.Background(), "ortuman", "3")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Nil(t, msg)
+
+	// not a row identifier
+	s, mock = newMockMySQLStorage()
+	msg, err = s.FetchOfflineMessage(context.Background(), "ortuman", "abc")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Nil(t, msg)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM offline_messages (.+)").
+		WithArgs("", "ortuman", int64(2)).
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchOfflineMessage(context.Background(), "ortuman", "2")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeleteOfflineMessage(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages (.+) AND id = (.+)").
+		WithArgs("", "ortuman", int64(2)).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	deleted, err := s.DeleteOfflineMessage(context.Background(), "ortuman", "2")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.True(t, deleted)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages (.+) AND id = (.+)").
+		WithArgs("", "ortuman", int64(3)).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	deleted, err = s.DeleteOfflineMessage(context.Background(), "ortuman", "3")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.False(t, deleted)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages (.+) AND id = (.+)").
+		WithArgs("", "ortuman", int64(2)).WillReturnError(errMySQLStorage)
+
+	_, err = s.DeleteOfflineMessage(context.Background(), "ortuman", "2")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeleteOfflineMessages(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := s.DeleteOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages (.+)").
+		WithArgs("", "ortuman").WillReturnError(errMySQLStorage)
+
+	err = s.DeleteOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeleteExpiredOfflineMessages(t *testing.T) {
+	before := time.Unix(1530000000, 0)
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages WHERE (.+) received_at <= (.+)").
+		WithArgs("", before.Unix()).WillReturnResult(sqlmock.NewResult(0, 3))
+
+	n, err := s.DeleteExpiredOfflineMessages(context.Background(), before)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 3, n)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM offline_messages WHERE (.+) received_at <= (.+)").
+		WithArgs("", before.Unix()).WillReturnError(errMySQLStorage)
+
+	_, err = s.DeleteExpiredOfflineMessages(context.Background(), before)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageQuarantinedMessages(t *testing.T) {
+	message := xml.NewElementName("message")
+	message.SetID(uuid.New())
+	message.AppendElement(xml.NewElementName("body"))
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO quarantined_messages (.+)").
+		WithArgs("", "ortuman", message.String()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+	mock.ExpectQuery("SELECT COUNT(.+) FROM quarantined_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"count"}).AddRow(1))
+	mock.ExpectQuery("SELECT (.+) FROM quarantined_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow("<message id='abc'><body>Hi!</body></message>"))
+	mock.ExpectExec("DELETE FROM quarantined_messages (.+)").
+		WithArgs("", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	require.Nil(t, s.InsertQuarantinedMessage(context.Background(), message, "ortuman"))
+	cnt, err := s.CountQuarantinedMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+	msgs, err := s.FetchQuarantinedMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 1, len(msgs))
+	require.Nil(t, s.DeleteQuarantinedMessages(context.Background(), "ortuman"))
+	require.Nil(t, mock.ExpectationsWereMet())
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO quarantined_messages (.+)").
+		WithArgs("", "ortuman", message.String()).
+		WillReturnError(errMySQLStorage)
+	mock.ExpectQuery("SELECT COUNT(.+) FROM quarantined_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+	mock.ExpectQuery("SELECT (.+) FROM quarantined_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+	mock.ExpectExec("DELETE FROM quarantined_messages (.+)").
+		WithArgs("", "ortuman").WillReturnError(errMySQLStorage)
+
+	require.Equal(t, errMySQLStorage, s.InsertQuarantinedMessage(context.Background(), message, "ortuman"))
+	_, err = s.CountQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, errMySQLStorage, err)
+	_, err = s.FetchQuarantinedMessages(context.Background(), "ortuman")
+	require.Equal(t, errMySQLStorage, err)
+	require.Equal(t, errMySQLStorage, s.DeleteQuarantinedMessages(context.Background(), "ortuman"))
+	require.Nil(t, mock.ExpectationsWereMet())
+}
+
+func TestMySQLStorageInsertArchivedMessage(t *testing.T) {
+	msg := xml.NewMessageType("abc", xml.ChatType)
+	am := model.ArchivedMessage{
+		Username:     "ortuman",
+		With:         "noelia@jackal.im",
+		WithResource: "garden",
+		Stamp:        time.Unix(1530000000, 0),
+		Message:      msg,
+	}
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO archived_messages (.+)").
+		WithArgs("", "ortuman", "noelia@jackal.im", "garden", int64(1530000000), msg.String()).
+		WillReturnResult(sqlmock.NewResult(7, 1))
+
+	err := s.InsertArchivedMessage(context.Background(), &am)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, "7", am.ID)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO archived_messages (.+)").
+		WillReturnError(errMySQLStorage)
+
+	err = s.InsertArchivedMessage(context.Background(), &am)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchArchivedMessages(t *testing.T) {
+	var archivedMessagesColumns = []string{"id", "with_jid", "with_resource", "stamp", "data"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archived_messages (.+) AND with_jid = (.+) AND id > (.+) ORDER BY id LIMIT (.+)").
+		WithArgs("", "ortuman", "noelia@jackal.im", int64(1), 2).
+		WillReturnRows(sqlmock.NewRows(archivedMessagesColumns).
+			AddRow(2, "noelia@jackal.im", "garden", 1530000000, "<message id='abc'><body>Hi!</body></message>").
+			AddRow(3, "noelia@jackal.im", "", 1530000060, "<message id='def'><body>Bye!</body></message>"))
+
+	msgs, err := s.FetchArchivedMessages(context.Background(), "ortuman", &ArchiveFilter{With: "noelia@jackal.im", AfterID: "1", Max: 2})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "2", msgs[0].ID)
+	require.Equal(t, "ortuman", msgs[0].Username)
+	require.Equal(t, "garden", msgs[0].WithResource)
+	require.Equal(t, int64(1530000000), msgs[0].Stamp.Unix())
+	require.Equal(t, "abc", msgs[0].Message.ID())
+	require.Equal(t, "3", msgs[1].ID)
+	require.Equal(t, "def", msgs[1].Message.ID())
+
+	// last page is looked up backwards
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archived_messages (.+) AND stamp >= (.+) ORDER BY id DESC LIMIT (.+)").
+		WithArgs("", "ortuman", int64(1530000000), 2).
+		WillReturnRows(sqlmock.NewRows(archivedMessagesColumns).
+			AddRow(3, "noelia@jackal.im", "", 1530000060, "<message id='def'/>").
+			AddRow(2, "noelia@jackal.im", "", 1530000000, "<message id='abc'/>"))
+
+	msgs, err = s.FetchArchivedMessages(context.Background(), "ortuman", &ArchiveFilter{Start: time.Unix(1530000000, 0), Max: 2, Last: true})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 2, len(msgs))
+	require.Equal(t, "2", msgs[0].ID)
+	require.Equal(t, "3", msgs[1].ID)
+
+	// not a row identifier
+	s, mock = newMockMySQLStorage()
+	msgs, err = s.FetchArchivedMessages(context.Background(), "ortuman", &ArchiveFilter{BeforeID: "abc"})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Nil(t, msgs)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archived_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(archivedMessagesColumns).AddRow(1, "noelia@jackal.im", "", 1530000000, "<message id='abc'><body>Hi!"))
+
+	_, err = s.FetchArchivedMessages(context.Background(), "ortuman", &ArchiveFilter{})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.NotNil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archived_messages (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchArchivedMessages(context.Background(), "ortuman", &ArchiveFilter{})
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageArchivePrefs(t *testing.T) {
+	prefs := model.ArchivePrefs{Username: "ortuman", Default: "roster"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO archive_prefs (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "ortuman", "roster", "roster").
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := s.InsertOrUpdateArchivePrefs(context.Background(), &prefs)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archive_prefs (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "default_mode"}).AddRow("ortuman", "roster"))
+
+	p, err := s.FetchArchivePrefs(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, &prefs, p)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archive_prefs (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows([]string{"username", "default_mode"}))
+
+	p, err = s.FetchArchivePrefs(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Nil(t, p)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM archive_prefs (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchArchivePrefs(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInsertBlockListItems(t *testing.T) {
+	items := []model.BlockListItem{
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "jabber.org"},
+	}
+	s, mock := newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT IGNORE INTO block_list_items (.+)").
+		WithArgs("", "ortuman", "romeo@jackal.im").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT IGNORE INTO block_list_items (.+)").
+		WithArgs("", "ortuman", "jabber.org").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := s.InsertBlockListItems(context.Background(), items)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT IGNORE INTO block_list_items (.+)").
+		WithArgs("", "ortuman", "romeo@jackal.im").WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.InsertBlockListItems(context.Background(), items)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeleteBlockListItems(t *testing.T) {
+	items := []model.BlockListItem{{Username: "ortuman", JID: "romeo@jackal.im"}}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM block_list_items (.+)").
+		WithArgs("", "ortuman", "romeo@jackal.im").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := s.DeleteBlockListItems(context.Background(), items)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM block_list_items (.+)").
+		WithArgs("", "ortuman", "romeo@jackal.im").WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.DeleteBlockListItems(context.Background(), items)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchBlockListItems(t *testing.T) {
+	var bliColumns = []string{"username", "jid"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM block_list_items (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(bliColumns).
+			AddRow("ortuman", "romeo@jackal.im").
+			AddRow("ortuman", "jabber.org"))
+
+	blis, err := s.FetchBlockListItems(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []model.BlockListItem{
+		{Username: "ortuman", JID: "romeo@jackal.im"},
+		{Username: "ortuman", JID: "jabber.org"},
+	}, blis)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM block_list_items (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchBlockListItems(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInsertPrivacyList(t *testing.T) {
+	pl := model.PrivacyList{
+		Username: "ortuman",
+		Name:     "invisible",
+		Items: []model.PrivacyListItem{
+			{Type: "jid", Value: "romeo@jackal.im", Action: "allow", Order: 1},
+			{Action: "deny", Order: 2, PresenceOut: true},
+		},
+	}
+	s, mock := newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO privacy_lists (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "ortuman", "invisible").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("DELETE FROM privacy_list_items (.+)").
+		WithArgs("", "ortuman", "invisible").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("INSERT INTO privacy_list_items (.+)").
+		WithArgs("", "ortuman", "invisible", 1, "jid", "romeo@jackal.im", "allow", false, false, false, false).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectExec("INSERT INTO privacy_list_items (.+)").
+		WithArgs("", "ortuman", "invisible", 2, "", "", "deny", false, false, false, true).
+		WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := s.InsertOrUpdatePrivacyList(context.Background(), &pl)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("INSERT INTO privacy_lists (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "ortuman", "invisible").WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.InsertOrUpdatePrivacyList(context.Background(), &pl)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeletePrivacyList(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM privacy_list_items (.+)").
+		WithArgs("", "ortuman", "invisible").WillReturnResult(sqlmock.NewResult(0, 2))
+	mock.ExpectExec("DELETE FROM privacy_lists (.+)").
+		WithArgs("", "ortuman", "invisible").WillReturnResult(sqlmock.NewResult(0, 1))
+	mock.ExpectCommit()
+
+	err := s.DeletePrivacyList(context.Background(), "ortuman", "invisible")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectBegin()
+	mock.ExpectExec("DELETE FROM privacy_list_items (.+)").
+		WithArgs("", "ortuman", "invisible").WillReturnError(errMySQLStorage)
+	mock.ExpectRollback()
+
+	err = s.DeletePrivacyList(context.Background(), "ortuman", "invisible")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchPrivacyLists(t *testing.T) {
+	var plColumns = []string{"name", "is_default"}
+	var pliColumns = []string{"list_name", "ord", "type", "value", "action", "message", "iq", "presence_in", "presence_out"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM privacy_lists (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(plColumns).
+			AddRow("invisible", true).
+			AddRow("public", false))
+	mock.ExpectQuery("SELECT (.+) FROM privacy_list_items (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(pliColumns).
+			AddRow("invisible", 1, "jid", "romeo@jackal.im", "allow", false, false, false, false).
+			AddRow("invisible", 2, "", "", "deny", false, false, false, true))
+
+	pls, err := s.FetchPrivacyLists(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []model.PrivacyList{
+		{
+			Username: "ortuman",
+			Name:     "invisible",
+			Default:  true,
+			Items: []model.PrivacyListItem{
+				{Type: "jid", Value: "romeo@jackal.im", Action: "allow", Order: 1},
+				{Action: "deny", Order: 2, PresenceOut: true},
+			},
+		},
+		{Username: "ortuman", Name: "public"},
+	}, pls)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM privacy_lists (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(plColumns))
+
+	pls, err = s.FetchPrivacyLists(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, 0, len(pls))
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM privacy_lists (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchPrivacyLists(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageSetDefaultPrivacyList(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("UPDATE privacy_lists SET (.+)").
+		WithArgs("invisible", "", "ortuman").
+		WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err := s.SetDefaultPrivacyList(context.Background(), "ortuman", "invisible")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("UPDATE privacy_lists SET (.+)").
+		WithArgs("", "", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	err = s.SetDefaultPrivacyList(context.Background(), "ortuman", "")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInsertFeatureFlag(t *testing.T) {
+	ff := model.FeatureFlag{Name: "carbons", Username: "ortuman", Enabled: true}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO feature_flags (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "carbons", "ortuman", true, true).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := s.InsertOrUpdateFeatureFlag(context.Background(), &ff)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+}
+
+func TestMySQLStorageDeleteFeatureFlag(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM feature_flags (.+)").
+		WithArgs("", "carbons", "ortuman").WillReturnResult(sqlmock.NewResult(0, 1))
+
+	err := s.DeleteFeatureFlag(context.Background(), "carbons", "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM feature_flags (.+)").
+		WithArgs("", "carbons", "ortuman").WillReturnError(errMySQLStorage)
+
+	err = s.DeleteFeatureFlag(context.Background(), "carbons", "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchFeatureFlags(t *testing.T) {
+	var ffColumns = []string{"name", "username", "enabled"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM feature_flags (.+)").
+		WithArgs("", "ortuman").
+		WillReturnRows(sqlmock.NewRows(ffColumns).
+			AddRow("carbons", "ortuman", true).
+			AddRow("mam", "ortuman", false))
+
+	ffs, err := s.FetchFeatureFlags(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []model.FeatureFlag{
+		{Name: "carbons", Username: "ortuman", Enabled: true},
+		{Name: "mam", Username: "ortuman"},
+	}, ffs)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM feature_flags (.+)").
+		WithArgs("", "ortuman").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchFeatureFlags(context.Background(), "ortuman")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInsertInvite(t *testing.T) {
+	expiresAt := time.Now().Add(time.Hour)
+	inv := model.Invite{Token: "abcd", CreatedBy: "ortuman", ExpiresAt: expiresAt}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO invites (.+)").
+		WithArgs("", "abcd", "ortuman", expiresAt, false).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := s.InsertInvite(context.Background(), &inv)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+}
+
+func TestMySQLStorageRedeemInvite(t *testing.T) {
+	now := time.Now()
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("UPDATE invites (.+)").
+		WithArgs("", "abcd", now).WillReturnResult(sqlmock.NewResult(0, 1))
+
+	ok, err := s.RedeemInvite(context.Background(), "abcd", now)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.True(t, ok)
+
+	// used, expired or non existing token
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("UPDATE invites (.+)").
+		WithArgs("", "abcd", now).WillReturnResult(sqlmock.NewResult(0, 0))
+
+	ok, err = s.RedeemInvite(context.Background(), "abcd", now)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.False(t, ok)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("UPDATE invites (.+)").
+		WithArgs("", "abcd", now).WillReturnError(errMySQLStorage)
+
+	_, err = s.RedeemInvite(context.Background(), "abcd", now)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageInsertStreamSession(t *testing.T) {
+	ss := model.StreamSession{ID: "abcd", ServerID: "default", Username: "ortuman", Domain: "jackal.im", Resource: "balcony"}
+	buf := new(bytes.Buffer)
+	ss.ToBytes(buf)
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO stream_sessions (.+) ON DUPLICATE KEY UPDATE (.+)").
+		WithArgs("", "default", "abcd", buf.Bytes(), buf.Bytes()).
+		WillReturnResult(sqlmock.NewResult(1, 1))
+
+	err := s.InsertStreamSession(context.Background(), &ss)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("INSERT INTO stream_sessions (.+)").
+		WillReturnError(errMySQLStorage)
+
+	err = s.InsertStreamSession(context.Background(), &ss)
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageFetchStreamSessions(t *testing.T) {
+	ss := model.StreamSession{ID: "abcd", ServerID: "default", Username: "ortuman", Domain: "jackal.im", Resource: "balcony", Inbound: 4}
+	buf := new(bytes.Buffer)
+	ss.ToBytes(buf)
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT data FROM stream_sessions (.+)").
+		WithArgs("", "default").
+		WillReturnRows(sqlmock.NewRows([]string{"data"}).AddRow(buf.Bytes()))
+
+	sessions, err := s.FetchStreamSessions(context.Background(), "default")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Len(t, sessions, 1)
+	require.Equal(t, "balcony", sessions[0].Resource)
+	require.Equal(t, uint32(4), sessions[0].Inbound)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT data FROM stream_sessions (.+)").
+		WithArgs("", "default").
+		WillReturnError(errMySQLStorage)
+
+	_, err = s.FetchStreamSessions(context.Background(), "default")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageDeleteStreamSessions(t *testing.T) {
+	s, mock := newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM stream_sessions (.+)").
+		WithArgs("", "default").WillReturnResult(sqlmock.NewResult(0, 2))
+
+	err := s.DeleteStreamSessions(context.Background(), "default")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectExec("DELETE FROM stream_sessions (.+)").
+		WithArgs("", "default").WillReturnError(errMySQLStorage)
+
+	err = s.DeleteStreamSessions(context.Background(), "default")
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+func TestMySQLStorageUsage(t *testing.T) {
+	usageColumns := []string{"table_name", "table_rows", "bytes"}
+
+	s, mock := newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM information_schema.tables (.+)").
+		WillReturnRows(sqlmock.NewRows(usageColumns).
+			AddRow("offline_messages", 12, 16384).
+			AddRow("users", 3, nil))
+
+	usage, err := s.Usage(context.Background())
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Nil(t, err)
+	require.Equal(t, []model.EntityUsage{
+		{Entity: "offline_messages", Rows: 12, Bytes: 16384},
+		{Entity: "users", Rows: 3},
+	}, usage)
+
+	s, mock = newMockMySQLStorage()
+	mock.ExpectQuery("SELECT (.+) FROM information_schema.tables (.+)").
+		WillReturnError(errMySQLStorage)
+	_, err = s.Usage(context.Background())
+	require.Nil(t, mock.ExpectationsWereMet())
+	require.Equal(t, errMySQLStorage, err)
+}
+
+// mySQLRoundTrip represents the latency of a MySQL round trip,
+// so that benchmarks reflect the number of them taken.
+const mySQLRoundTrip = 100 * time.Microsecond
+
+func BenchmarkMySQLStorage_InsertOfflineMessage(b *testing.B) {
+	messages, _ := tUtilMySQLOfflineMessages(50)
+	s, mock := newMockMySQLStorage()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for range messages {
+			mock.ExpectExec("INSERT INTO offline_messages (.+)").
+				WillDelayFor(mySQLRoundTrip).
+				WillReturnResult(sqlmock.NewResult(1, 1))
+		}
+		b.StartTimer()
+		for _, message := range messages {
+			if err := s.InsertOfflineMessage(context.Background(), message, "ortuman"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMySQLStorage_InsertOfflineMessages(b *testing.B) {
+	messages, _ := tUtilMySQLOfflineMessages(50)
+	s, mock := newMockMySQLStorage()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		mock.ExpectExec("INSERT INTO offline_messages (.+)").
+			WillDelayFor(mySQLRoundTrip).
+			WillReturnResult(sqlmock.NewResult(50, 50))
+		b.StartTimer()
+		if err := s.InsertOfflineMessages(context.Background(), messages, "ortuman"); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMySQLStorage_FetchRosterItems(b *testing.B) {
+	var riColumns = []string{"user", "contact", "name", "subscription", "groups", "ask", "ver"}
+
+	users := tUtilMySQLUsers(50)
+	s, mock := newMockMySQLStorage()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		for _, user := range users {
+			mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
+				WillDelayFor(mySQLRoundTrip).
+				WillReturnRows(sqlmock.NewRows(riColumns).AddRow(user, "romeo", "Romeo", "both", "", false, 1))
+		}
+		b.StartTimer()
+		for _, user := range users {
+			if _, err := s.FetchRosterItems(context.Background(), user); err != nil {
+				b.Fatal(err)
+			}
+		}
+	}
+}
+
+func BenchmarkMySQLStorage_FetchRosterItemsOfUsers(b *testing.B) {
+	var riColumns = []string{"user", "contact", "name", "subscription", "groups", "ask", "ver"}
+
+	users := tUtilMySQLUsers(50)
+	s, mock := newMockMySQLStorage()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		rows := sqlmock.NewRows(riColumns)
+		for _, user := range users {
+			rows.AddRow(user, "romeo", "Romeo", "both", "", false, 1)
+		}
+		mock.ExpectQuery("SELECT (.+) FROM roster_items (.+)").
+			WillDelayFor(mySQLRoundTrip).
+			WillReturnRows(rows)
+		b.StartTimer()
+		if _, err := s.FetchRosterItemsOfUsers(context.Background(), users); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// tUtilMySQLOfflineMessages returns n offline messages, along
+// with the arguments expected to insert them on behalf of ortuman.
+func tUtilMySQLOfflineMessages(n int) ([]xml.Element, []driver.Value) {
+	var messages []xml.Element
+	var args []driver.Value
+	for i := 0; i < n; i++ {
+		message := xml.NewElementName("message")
+		message.SetID(uuid.New())
+		message.AppendElement(xml.NewElementName("body"))
+		messages = append(messages, message)
+		args = append(args, "", "ortuman", message.String())
+	}
+	return messages, args
+}
+
+func tUtilMySQLUsers(n int) []string {
+	var users []string
+	for i := 0; i < n; i++ {
+		users = append(users, fmt.Sprintf("user%d", i))
+	}
+	return users
 }
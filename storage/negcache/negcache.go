@@ -0,0 +1,168 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package negcache implements a storage decorator remembering usernames
+// recently reported as nonexistent, so that repeated account existence checks,
+// such as those triggered by stanzas addressed to a dictionary of localparts,
+// don't reach the underlying storage.
+package negcache
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+)
+
+type entry struct {
+	username  string
+	expiresAt time.Time
+}
+
+// Storage represents a nonexistent users caching storage decorator.
+type Storage struct {
+	storage.Storage
+	size int
+	ttl  time.Duration
+	hits *stats.Counter
+	now  func() time.Time
+
+	mu      sync.Mutex
+	lru     *list.List
+	entries map[string]*list.Element
+	gen     uint64
+}
+
+// New returns a decorator wrapping s, remembering up to size
+// nonexistent usernames for ttl.
+func New(s storage.Storage, size int, ttl time.Duration) *Storage {
+	return &Storage{
+		Storage: s,
+		size:    size,
+		ttl:     ttl,
+		hits:    stats.Default().Counter("storage/negative_cache/hits", "lookups"),
+		now:     time.Now,
+		lru:     list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// UserExists satisfies storage.Storage interface.
+func (s *Storage) UserExists(ctx context.Context, username string) (bool, error) {
+	s.mu.Lock()
+	if s.isMissing(username) {
+		s.mu.Unlock()
+		s.hits.Inc()
+		return false, nil
+	}
+	gen := s.gen
+	s.mu.Unlock()
+
+	exists, err := s.Storage.UserExists(ctx, username)
+	if err != nil || exists {
+		return exists, err
+	}
+	s.mu.Lock()
+	// don't cache a miss that might have been superseded by a concurrent insertion
+	if gen == s.gen {
+		s.add(username)
+	}
+	s.mu.Unlock()
+	return false, nil
+}
+
+// InsertOrUpdateUser satisfies storage.Storage interface.
+func (s *Storage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	err := s.Storage.InsertOrUpdateUser(ctx, user)
+	s.Invalidate(user.Username)
+	return err
+}
+
+// InTransaction satisfies storage.Storage interface.
+// Transactions bypass the cache, so that it never remembers
+// a miss that could be rolled back.
+func (s *Storage) InTransaction(ctx context.Context, f func(tx storage.Storage) error) error {
+	tx := &txStorage{cache: s}
+	err := s.Storage.InTransaction(ctx, func(stx storage.Storage) error {
+		tx.Storage = stx
+		return f(tx)
+	})
+	// a miss might have been cached before the transaction committed
+	for _, username := range tx.inserted {
+		s.Invalidate(username)
+	}
+	return err
+}
+
+// Invalidate forgets username, if cached.
+func (s *Storage) Invalidate(username string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gen++
+	if el, ok := s.entries[username]; ok {
+		s.remove(el)
+	}
+}
+
+// Len returns the number of cached usernames.
+func (s *Storage) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lru.Len()
+}
+
+func (s *Storage) isMissing(username string) bool {
+	el, ok := s.entries[username]
+	if !ok {
+		return false
+	}
+	if !s.now().Before(el.Value.(*entry).expiresAt) {
+		s.remove(el)
+		return false
+	}
+	s.lru.MoveToFront(el)
+	return true
+}
+
+func (s *Storage) add(username string) {
+	expiresAt := s.now().Add(s.ttl)
+	if el, ok := s.entries[username]; ok {
+		el.Value.(*entry).expiresAt = expiresAt
+		s.lru.MoveToFront(el)
+		return
+	}
+	s.entries[username] = s.lru.PushFront(&entry{username: username, expiresAt: expiresAt})
+	for s.lru.Len() > s.size {
+		s.remove(s.lru.Back())
+	}
+}
+
+func (s *Storage) remove(el *list.Element) {
+	delete(s.entries, el.Value.(*entry).username)
+	s.lru.Remove(el)
+}
+
+// txStorage represents a storage handle bound to a transaction,
+// keeping track of the users inserted through it.
+type txStorage struct {
+	storage.Storage
+	cache    *Storage
+	inserted []string
+}
+
+func (tx *txStorage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	err := tx.Storage.InsertOrUpdateUser(ctx, user)
+	tx.cache.Invalidate(user.Username)
+	tx.inserted = append(tx.inserted, user.Username)
+	return err
+}
+
+func (tx *txStorage) InTransaction(ctx context.Context, f func(tx storage.Storage) error) error {
+	return f(tx)
+}
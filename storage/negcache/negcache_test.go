@@ -0,0 +1,127 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package negcache
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/faulty"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNegCache_BoundedLookups(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	fs := faulty.New(storage.Instance())
+	require.Nil(t, fs.Enable(map[string]faulty.Fault{"UserExists": {}}))
+
+	s := New(fs, 100, time.Minute)
+	hits := s.hits.Value()
+
+	for i := 0; i < 1000; i++ {
+		exists, err := s.UserExists(context.Background(), fmt.Sprintf("unknown%d", i%10))
+		require.Nil(t, err)
+		require.False(t, exists)
+	}
+	require.Equal(t, int64(10), fs.Stats()["UserExists"].Calls)
+	require.Equal(t, int64(990), s.hits.Value()-hits)
+	require.Equal(t, 10, s.Len())
+}
+
+func TestNegCache_Registration(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	s := New(storage.Instance(), 100, time.Minute)
+
+	exists, err := s.UserExists(context.Background(), "romeo")
+	require.Nil(t, err)
+	require.False(t, exists)
+	require.Equal(t, 1, s.Len())
+
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "pencil"}))
+	require.Equal(t, 0, s.Len())
+
+	exists, err = s.UserExists(context.Background(), "romeo")
+	require.Nil(t, err)
+	require.True(t, exists)
+	require.Equal(t, 0, s.Len())
+}
+
+func TestNegCache_Expiration(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	fs := faulty.New(storage.Instance())
+	require.Nil(t, fs.Enable(map[string]faulty.Fault{"UserExists": {}}))
+
+	now := time.Now()
+	s := New(fs, 100, time.Second*30)
+	s.now = func() time.Time { return now }
+
+	s.UserExists(context.Background(), "juliet")
+	s.UserExists(context.Background(), "juliet")
+	require.Equal(t, int64(1), fs.Stats()["UserExists"].Calls)
+
+	now = now.Add(time.Second * 30)
+	s.UserExists(context.Background(), "juliet")
+	require.Equal(t, int64(2), fs.Stats()["UserExists"].Calls)
+}
+
+func TestNegCache_Eviction(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	fs := faulty.New(storage.Instance())
+	require.Nil(t, fs.Enable(map[string]faulty.Fault{"UserExists": {}}))
+
+	s := New(fs, 2, time.Minute)
+	s.UserExists(context.Background(), "a")
+	s.UserExists(context.Background(), "b")
+	s.UserExists(context.Background(), "a") // refresh 'a'
+	s.UserExists(context.Background(), "c") // evicts 'b'
+	require.Equal(t, 2, s.Len())
+	require.Equal(t, int64(3), fs.Stats()["UserExists"].Calls)
+
+	s.UserExists(context.Background(), "a")
+	require.Equal(t, int64(3), fs.Stats()["UserExists"].Calls)
+	s.UserExists(context.Background(), "b")
+	require.Equal(t, int64(4), fs.Stats()["UserExists"].Calls)
+}
+
+func TestNegCache_Transaction(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	s := New(storage.Instance(), 100, time.Minute)
+
+	exists, _ := s.UserExists(context.Background(), "romeo")
+	require.False(t, exists)
+	require.Equal(t, 1, s.Len())
+
+	require.Nil(t, s.InTransaction(context.Background(), func(tx storage.Storage) error {
+		if err := tx.InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "pencil"}); err != nil {
+			return err
+		}
+		// transactions bypass the cache
+		exists, err := tx.UserExists(context.Background(), "juliet")
+		require.Nil(t, err)
+		require.False(t, exists)
+		return nil
+	}))
+	require.Equal(t, 0, s.Len())
+
+	exists, err := s.UserExists(context.Background(), "romeo")
+	require.Nil(t, err)
+	require.True(t, exists)
+}
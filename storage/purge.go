@@ -0,0 +1,81 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"time"
+
+	"github.com/ortuman/jackal/log"
+)
+
+const purgeInterval = time.Hour
+
+// PurgeRemovedUsers definitively deletes every removed account
+// whose grace period expired before t, returning the number of purged accounts.
+func PurgeRemovedUsers(t time.Time) (int, error) {
+	return purgeRemovedUsers(Instance(), t)
+}
+
+func purgeRemovedUsers(s Storage, t time.Time) (int, error) {
+	ctx, cancel := QueryContext()
+	usernames, err := s.FetchPurgeableUsers(ctx, t)
+	cancel()
+	if err != nil {
+		return 0, err
+	}
+	for i, username := range usernames {
+		// every deletion is bounded on its own, so that
+		// a long purge list doesn't exhaust the timeout
+		ctx, cancel := QueryContext()
+		err := s.DeleteUser(ctx, username)
+		cancel()
+		if err != nil {
+			return i, err
+		}
+		log.Infof("purged removed account: %s", username)
+	}
+	return len(usernames), nil
+}
+
+func pruneRosterTombstones(s Storage, before time.Time) (int, error) {
+	ctx, cancel := QueryContext()
+	defer cancel()
+	return s.PruneRosterTombstones(ctx, before)
+}
+
+func deleteExpiredOfflineMessages(s Storage, before time.Time) (int, error) {
+	ctx, cancel := QueryContext()
+	defer cancel()
+	return s.DeleteExpiredOfflineMessages(ctx, before)
+}
+
+func purgeLoop(s Storage, tombstoneRetention time.Duration, doneCh <-chan struct{}) {
+	tc := time.NewTicker(purgeInterval)
+	defer tc.Stop()
+	for {
+		select {
+		case <-tc.C:
+			if _, err := purgeRemovedUsers(s, time.Now()); err != nil {
+				log.Error(err)
+			}
+			if tombstoneRetention > 0 {
+				if _, err := pruneRosterTombstones(s, time.Now().Add(-tombstoneRetention)); err != nil {
+					log.Error(err)
+				}
+			}
+			if ttl := OfflineMessageTTL(); ttl > 0 {
+				n, err := deleteExpiredOfflineMessages(s, time.Now().Add(-ttl))
+				if err != nil {
+					log.Error(err)
+				} else if n > 0 {
+					log.Infof("deleted expired offline messages... count: %d", n)
+				}
+			}
+		case <-doneCh:
+			return
+		}
+	}
+}
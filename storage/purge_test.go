@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPurgeRemovedUsers(t *testing.T) {
+	Initialize(&config.Storage{Type: config.Mock})
+	defer Shutdown()
+
+	now := time.Now()
+	Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"})
+	Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "romeo", Password: "1234", PurgeAt: now.Add(-time.Hour)})
+	Instance().InsertOrUpdateUser(context.Background(), &model.User{Username: "juliet", Password: "1234", PurgeAt: now.Add(time.Hour)})
+
+	ActivateMockedError()
+	_, err := PurgeRemovedUsers(now)
+	require.Equal(t, ErrMockedError, err)
+	DeactivateMockedError()
+
+	n, err := PurgeRemovedUsers(now)
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+
+	exists, _ := Instance().UserExists(context.Background(), "romeo")
+	require.False(t, exists)
+	exists, _ = Instance().UserExists(context.Background(), "juliet")
+	require.True(t, exists)
+	exists, _ = Instance().UserExists(context.Background(), "ortuman")
+	require.True(t, exists)
+
+	// grace period expiration
+	n, err = PurgeRemovedUsers(now.Add(2 * time.Hour))
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	exists, _ = Instance().UserExists(context.Background(), "juliet")
+	require.False(t, exists)
+}
@@ -0,0 +1,1128 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+)
+
+// redisStorage keeps every entity under a key prefixed by its kind,
+// using hashes for per user collections, lists for message queues
+// and sorted sets for message archives.
+//
+// Read-modify-write operations run as optimistic transactions, so that
+// multiple servers can safely share the same Redis instance.
+type redisStorage struct {
+	client *redis.Client
+	prefix string // tenant key prefix, immutable
+}
+
+func newRedisStorage(cfg *config.RedisDb, tenant string) *redisStorage {
+	if len(tenant) > 0 && !config.IsValidTenant(tenant) {
+		log.Fatalf("storage: invalid tenant: %s", tenant)
+	}
+	client := redis.NewClient(&redis.Options{
+		Addr:     cfg.Address,
+		Password: cfg.Password,
+		DB:       cfg.Database,
+	})
+	if err := client.Ping().Err(); err != nil {
+		log.Fatalf("%v", err)
+	}
+	return &redisStorage{client: client, prefix: redisTenantPrefix(tenant)}
+}
+
+func (r *redisStorage) Shutdown() {
+	r.client.Close()
+}
+
+func (r *redisStorage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Set(r.userKey(user.Username), redisBytes(user), 0)
+		pipe.SAdd(r.key("usernames"), user.Username)
+		return nil
+	})
+	return err
+}
+
+func (r *redisStorage) DeleteUser(ctx context.Context, username string) error {
+	sendersKey := r.rosterNotificationSendersKey(username)
+	receivedKey := r.rosterNotificationsKey(username)
+	return r.watch(func(tx *redis.Tx) error {
+		// roster notifications sent by user are kept by their contacts
+		contacts, err := tx.SMembers(sendersKey).Result()
+		if err != nil {
+			return err
+		}
+		senders, err := tx.HKeys(receivedKey).Result()
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			for _, contact := range contacts {
+				pipe.HDel(r.rosterNotificationsKey(contact), username)
+			}
+			for _, sender := range senders {
+				pipe.SRem(r.rosterNotificationSendersKey(sender), username)
+			}
+			pipe.Del(
+				r.userKey(username),
+				r.vCardKey(username),
+				r.rosterVersionKey(username),
+				r.rosterItemsKey(username),
+				r.rosterTombstonesKey(username),
+				sendersKey,
+				receivedKey,
+				r.privateStorageKey(username),
+				r.offlineMessagesKey(username),
+				r.quarantinedMessagesKey(username),
+				r.featureFlagsKey(username),
+				r.blockListItemsKey(username),
+				r.privacyListsKey(username),
+				r.privacyDefaultListKey(username),
+				r.archivedMessagesKey(username),
+				r.archiveSeqKey(username),
+				r.archivePrefsKey(username),
+			)
+			pipe.SRem(r.key("usernames"), username)
+			pipe.SRem(r.key("rosterTombstoneUsers"), username)
+			pipe.SRem(r.key("offlineMessageUsers"), username)
+			return nil
+		})
+		return err
+	}, sendersKey, receivedKey)
+}
+
+func (r *redisStorage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	val, err := redisVal(r.client.Get(r.userKey(username)))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	var usr model.User
+	usr.FromBytes(bytes.NewReader(val))
+	return &usr, nil
+}
+
+func (r *redisStorage) UserExists(ctx context.Context, username string) (bool, error) {
+	n, err := r.client.Exists(r.userKey(username)).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *redisStorage) CountUsers(ctx context.Context) (int, error) {
+	n, err := r.client.SCard(r.key("usernames")).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (r *redisStorage) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	usernames, err := r.client.SMembers(r.key("usernames")).Result()
+	if err != nil {
+		return nil, err
+	}
+	var purgeable []string
+	for len(usernames) > 0 {
+		n := len(usernames)
+		if n > usageScanBatchSize {
+			n = usageScanBatchSize
+		}
+		keys := make([]string, n)
+		for i, username := range usernames[:n] {
+			keys[i] = r.userKey(username)
+		}
+		vals, err := r.client.MGet(keys...).Result()
+		if err != nil {
+			return nil, err
+		}
+		for _, val := range vals {
+			s, ok := val.(string)
+			if !ok {
+				continue // deleted meanwhile
+			}
+			var usr model.User
+			usr.FromBytes(strings.NewReader(s))
+			if usr.IsPurgeable(before) {
+				purgeable = append(purgeable, usr.Username)
+			}
+		}
+		usernames = usernames[n:]
+	}
+	return purgeable, nil
+}
+
+func (r *redisStorage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	verKey := r.rosterVersionKey(ri.User)
+	itemsKey := r.rosterItemsKey(ri.User)
+
+	var ver int
+	err := r.watch(func(tx *redis.Tx) error {
+		rv, err := r.fetchRosterVersion(tx, ri.User)
+		if err != nil {
+			return err
+		}
+		rv.Ver++
+
+		// updated items keep their original position
+		seq := uint64(rv.Ver)
+		val, err := redisVal(tx.HGet(itemsKey, ri.Contact))
+		if err != nil {
+			return err
+		}
+		if val != nil {
+			seq, _ = decodeRosterItemSeq(val)
+		}
+		item := *ri
+		item.Ver = rv.Ver
+		buf := new(bytes.Buffer)
+		encodeRosterItemSeq(buf, seq, &item)
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(verKey, redisBytes(&rv), 0)
+			pipe.HSet(itemsKey, ri.Contact, buf.Bytes())
+			pipe.HDel(r.rosterTombstonesKey(ri.User), ri.Contact)
+			return nil
+		})
+		ver = rv.Ver
+		return err
+	}, verKey, itemsKey)
+	if err != nil {
+		return err
+	}
+	ri.Ver = ver
+	return nil
+}
+
+func (r *redisStorage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	verKey := r.rosterVersionKey(user)
+	itemsKey := r.rosterItemsKey(user)
+
+	return r.watch(func(tx *redis.Tx) error {
+		exists, err := tx.HExists(itemsKey, contact).Result()
+		if err != nil || !exists {
+			return err
+		}
+		rv, err := r.fetchRosterVersion(tx, user)
+		if err != nil {
+			return err
+		}
+		rv.Ver++
+		rt := model.RosterTombstone{User: user, Contact: contact, Ver: rv.Ver, DeletedAt: time.Now()}
+
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(verKey, redisBytes(&rv), 0)
+			pipe.HDel(itemsKey, contact)
+			pipe.HSet(r.rosterTombstonesKey(user), contact, redisBytes(&rt))
+			pipe.SAdd(r.key("rosterTombstoneUsers"), user)
+			return nil
+		})
+		return err
+	}, verKey, itemsKey)
+}
+
+func (r *redisStorage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
+	vals, err := r.client.HVals(r.rosterItemsKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	return decodeRedisRosterItems(vals), nil
+}
+
+// FetchRosterItemsOfUsers satisfies Storage interface.
+// Rosters are fetched by a single pipeline.
+func (r *redisStorage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	ret := make(map[string][]model.RosterItem, len(users))
+	if len(users) == 0 {
+		return ret, nil
+	}
+	cmds := make([]*redis.StringSliceCmd, len(users))
+	if _, err := r.client.Pipelined(func(pipe redis.Pipeliner) error {
+		for i, user := range users {
+			cmds[i] = pipe.HVals(r.rosterItemsKey(user))
+		}
+		return nil
+	}); err != nil {
+		return nil, err
+	}
+	for i, cmd := range cmds {
+		if ris := decodeRedisRosterItems(cmd.Val()); len(ris) > 0 {
+			ret[users[i]] = ris
+		}
+	}
+	return ret, nil
+}
+
+func (r *redisStorage) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
+	val, err := redisVal(r.client.HGet(r.rosterItemsKey(user), contact))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	_, ri := decodeRosterItemSeq(val)
+	return ri, nil
+}
+
+func (r *redisStorage) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	return r.fetchRosterVersion(r.client, user)
+}
+
+func (r *redisStorage) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
+	vals, err := r.client.HVals(r.rosterTombstonesKey(user)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var rts []model.RosterTombstone
+	for _, val := range vals {
+		var rt model.RosterTombstone
+		rt.FromBytes(strings.NewReader(val))
+		if rt.Ver > afterVer {
+			rts = append(rts, rt)
+		}
+	}
+	sort.Slice(rts, func(i, j int) bool { return rts[i].Ver < rts[j].Ver })
+	return rts, nil
+}
+
+func (r *redisStorage) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	users, err := r.client.SMembers(r.key("rosterTombstoneUsers")).Result()
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, user := range users {
+		verKey := r.rosterVersionKey(user)
+		tombstonesKey := r.rosterTombstonesKey(user)
+
+		var n int
+		err := r.watch(func(tx *redis.Tx) error {
+			vals, err := tx.HGetAll(tombstonesKey).Result()
+			if err != nil {
+				return err
+			}
+			var pruned []string
+			prunedVer := 0
+			for contact, val := range vals {
+				var rt model.RosterTombstone
+				rt.FromBytes(strings.NewReader(val))
+				if !rt.DeletedAt.After(before) {
+					pruned = append(pruned, contact)
+					if rt.Ver > prunedVer {
+						prunedVer = rt.Ver
+					}
+				}
+			}
+			n = len(pruned)
+			if n == 0 {
+				return nil
+			}
+			rv, err := r.fetchRosterVersion(tx, user)
+			if err != nil {
+				return err
+			}
+			if prunedVer > rv.PrunedVer {
+				rv.PrunedVer = prunedVer
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.Set(verKey, redisBytes(&rv), 0)
+				pipe.HDel(tombstonesKey, pruned...)
+				if n == len(vals) {
+					pipe.SRem(r.key("rosterTombstoneUsers"), user)
+				}
+				return nil
+			})
+			return err
+		}, verKey, tombstonesKey)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+// fetchRosterVersion reads user roster version through c, either the client or a transaction.
+func (r *redisStorage) fetchRosterVersion(c interface {
+	Get(key string) *redis.StringCmd
+}, user string) (model.RosterVersion, error) {
+	var rv model.RosterVersion
+	val, err := redisVal(c.Get(r.rosterVersionKey(user)))
+	if err != nil {
+		return rv, err
+	}
+	if val != nil {
+		rv.FromBytes(bytes.NewReader(val))
+	}
+	return rv, nil
+}
+
+func (r *redisStorage) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HSet(r.rosterNotificationsKey(rn.Contact), rn.User, redisBytes(rn))
+		pipe.SAdd(r.rosterNotificationSendersKey(rn.User), rn.Contact)
+		return nil
+	})
+	return err
+}
+
+func (r *redisStorage) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.HDel(r.rosterNotificationsKey(contact), user)
+		pipe.SRem(r.rosterNotificationSendersKey(user), contact)
+		return nil
+	})
+	return err
+}
+
+func (r *redisStorage) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
+	vals, err := r.client.HVals(r.rosterNotificationsKey(contact)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var rns []model.RosterNotification
+	for _, val := range vals {
+		var rn model.RosterNotification
+		rn.FromBytes(strings.NewReader(val))
+		rns = append(rns, rn)
+	}
+	return rns, nil
+}
+
+func (r *redisStorage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	return r.client.Set(r.vCardKey(username), redisBytes(vCard), 0).Err()
+}
+
+func (r *redisStorage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	val, err := redisVal(r.client.Get(r.vCardKey(username)))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	var vCard xml.MutableElement
+	vCard.FromBytes(bytes.NewReader(val))
+	return &vCard, nil
+}
+
+func (r *redisStorage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
+	root := xml.NewElementName("r")
+	root.AppendElements(privateXML)
+	return r.client.HSet(r.privateStorageKey(username), namespace, redisBytes(root)).Err()
+}
+
+func (r *redisStorage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	val, err := redisVal(r.client.HGet(r.privateStorageKey(username), namespace))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	var root xml.MutableElement
+	root.FromBytes(bytes.NewReader(val))
+	return root.Elements(), nil
+}
+
+func (r *redisStorage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	return r.InsertOfflineMessages(ctx, []xml.Element{message}, username)
+}
+
+// InsertOfflineMessages satisfies Storage interface.
+func (r *redisStorage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	if len(messages) == 0 {
+		return nil
+	}
+	receivedAt := time.Now()
+	vals := make([]interface{}, len(messages))
+	for i, message := range messages {
+		vals[i] = redisBytes(&model.OfflineMessage{Message: message, Node: uuid.New(), ReceivedAt: receivedAt})
+	}
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.RPush(r.offlineMessagesKey(username), vals...)
+		pipe.SAdd(r.key("offlineMessageUsers"), username)
+		return nil
+	})
+	return err
+}
+
+// InsertCappedOfflineMessage satisfies Storage interface.
+func (r *redisStorage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	key := r.offlineMessagesKey(username)
+
+	var inserted bool
+	err := r.watch(func(tx *redis.Tx) error {
+		inserted = false
+		n, err := tx.LLen(key).Result()
+		if err != nil {
+			return err
+		}
+		count := int(n)
+		if count >= capacity && !dropOldest {
+			return nil
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			if count >= capacity {
+				pipe.LTrim(key, int64(count-capacity+1), -1)
+			}
+			pipe.RPush(key, redisBytes(&model.OfflineMessage{Message: message, Node: uuid.New(), ReceivedAt: time.Now()}))
+			pipe.SAdd(r.key("offlineMessageUsers"), username)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		inserted = true
+		return nil
+	}, key)
+	if err != nil {
+		return false, err
+	}
+	return inserted, nil
+}
+
+func (r *redisStorage) CountOfflineMessages(ctx context.Context, username string) (int, error) {
+	n, err := r.client.LLen(r.offlineMessagesKey(username)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (r *redisStorage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	vals, err := r.client.LRange(r.offlineMessagesKey(username), 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var msgs []model.OfflineMessage
+	for _, val := range vals {
+		var om model.OfflineMessage
+		om.FromBytes(strings.NewReader(val))
+		msgs = append(msgs, om)
+	}
+	return msgs, nil
+}
+
+// FetchOfflineMessage satisfies Storage interface.
+// Message nodes are assigned on insertion, as list indexes shift.
+func (r *redisStorage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	msgs, err := r.FetchOfflineMessages(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	for i := range msgs {
+		if msgs[i].Node == node {
+			return &msgs[i], nil
+		}
+	}
+	return nil, nil
+}
+
+// DeleteOfflineMessage satisfies Storage interface.
+func (r *redisStorage) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	key := r.offlineMessagesKey(username)
+
+	var deleted bool
+	err := r.watch(func(tx *redis.Tx) error {
+		deleted = false
+		vals, err := tx.LRange(key, 0, -1).Result()
+		if err != nil {
+			return err
+		}
+		for _, val := range vals {
+			var om model.OfflineMessage
+			om.FromBytes(strings.NewReader(val))
+			if om.Node != node {
+				continue
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				pipe.LRem(key, 1, val)
+				if len(vals) == 1 {
+					pipe.SRem(r.key("offlineMessageUsers"), username)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			deleted = true
+			return nil
+		}
+		return nil
+	}, key)
+	if err != nil {
+		return false, err
+	}
+	return deleted, nil
+}
+
+func (r *redisStorage) DeleteOfflineMessages(ctx context.Context, username string) error {
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		pipe.Del(r.offlineMessagesKey(username))
+		pipe.SRem(r.key("offlineMessageUsers"), username)
+		return nil
+	})
+	return err
+}
+
+// DeleteExpiredOfflineMessages satisfies Storage interface.
+// Queues are trimmed from their head, as messages are kept oldest first.
+func (r *redisStorage) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	users, err := r.client.SMembers(r.key("offlineMessageUsers")).Result()
+	if err != nil {
+		return 0, err
+	}
+	var total int
+	for _, username := range users {
+		key := r.offlineMessagesKey(username)
+
+		var n int
+		err := r.watch(func(tx *redis.Tx) error {
+			vals, err := tx.LRange(key, 0, -1).Result()
+			if err != nil {
+				return err
+			}
+			n = 0
+			for _, val := range vals {
+				var om model.OfflineMessage
+				om.FromBytes(strings.NewReader(val))
+				if om.ReceivedAt.After(before) {
+					break
+				}
+				n++
+			}
+			if n == 0 && len(vals) > 0 {
+				return nil
+			}
+			_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+				if n == len(vals) {
+					pipe.Del(key)
+					pipe.SRem(r.key("offlineMessageUsers"), username)
+				} else {
+					pipe.LTrim(key, int64(n), -1)
+				}
+				return nil
+			})
+			return err
+		}, key)
+		if err != nil {
+			return 0, err
+		}
+		total += n
+	}
+	return total, nil
+}
+
+func (r *redisStorage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	return r.client.RPush(r.quarantinedMessagesKey(username), redisBytes(message)).Err()
+}
+
+func (r *redisStorage) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	n, err := r.client.LLen(r.quarantinedMessagesKey(username)).Result()
+	if err != nil {
+		return 0, err
+	}
+	return int(n), nil
+}
+
+func (r *redisStorage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	return r.fetchMessages(r.quarantinedMessagesKey(username))
+}
+
+func (r *redisStorage) DeleteQuarantinedMessages(ctx context.Context, username string) error {
+	return r.client.Del(r.quarantinedMessagesKey(username)).Err()
+}
+
+func (r *redisStorage) fetchMessages(key string) ([]xml.Element, error) {
+	vals, err := r.client.LRange(key, 0, -1).Result()
+	if err != nil {
+		return nil, err
+	}
+	var msgs []xml.Element
+	for _, val := range vals {
+		var msg xml.MutableElement
+		msg.FromBytes(strings.NewReader(val))
+		msgs = append(msgs, &msg)
+	}
+	return msgs, nil
+}
+
+// InsertArchivedMessage satisfies Storage interface.
+// Archived messages are scored by their insertion sequence,
+// which also serves as their identifier.
+func (r *redisStorage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	seq, err := r.client.Incr(r.archiveSeqKey(message.Username)).Result()
+	if err != nil {
+		return err
+	}
+	message.ID = strconv.FormatInt(seq, 10)
+	return r.client.ZAdd(r.archivedMessagesKey(message.Username), redis.Z{
+		Score:  float64(seq),
+		Member: redisBytes(message),
+	}).Err()
+}
+
+func (r *redisStorage) FetchArchivedMessages(ctx context.Context, username string, filter *ArchiveFilter) ([]model.ArchivedMessage, error) {
+	rng := redis.ZRangeBy{Min: "-inf", Max: "+inf"}
+	if len(filter.AfterID) > 0 {
+		if _, ok := redisArchivedMessageSeq(filter.AfterID); !ok {
+			return nil, nil
+		}
+		rng.Min = "(" + filter.AfterID
+	}
+	if len(filter.BeforeID) > 0 {
+		if _, ok := redisArchivedMessageSeq(filter.BeforeID); !ok {
+			return nil, nil
+		}
+		rng.Max = "(" + filter.BeforeID
+	}
+	vals, err := r.client.ZRangeByScore(r.archivedMessagesKey(username), rng).Result()
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]model.ArchivedMessage, len(vals))
+	for i, val := range vals {
+		msgs[i].FromBytes(strings.NewReader(val))
+	}
+	return filterArchivedMessages(msgs, filter, redisArchivedMessageSeq), nil
+}
+
+func (r *redisStorage) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	return r.client.Set(r.archivePrefsKey(prefs.Username), redisBytes(prefs), 0).Err()
+}
+
+func (r *redisStorage) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	val, err := redisVal(r.client.Get(r.archivePrefsKey(username)))
+	if err != nil || val == nil {
+		return nil, err
+	}
+	var prefs model.ArchivePrefs
+	prefs.FromBytes(bytes.NewReader(val))
+	return &prefs, nil
+}
+
+func (r *redisStorage) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for i := range items {
+			pipe.HSet(r.blockListItemsKey(items[i].Username), items[i].JID, redisBytes(&items[i]))
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisStorage) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	if len(items) == 0 {
+		return nil
+	}
+	_, err := r.client.TxPipelined(func(pipe redis.Pipeliner) error {
+		for _, item := range items {
+			pipe.HDel(r.blockListItemsKey(item.Username), item.JID)
+		}
+		return nil
+	})
+	return err
+}
+
+func (r *redisStorage) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	vals, err := r.client.HVals(r.blockListItemsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var blis []model.BlockListItem
+	for _, val := range vals {
+		var bli model.BlockListItem
+		bli.FromBytes(strings.NewReader(val))
+		blis = append(blis, bli)
+	}
+	return blis, nil
+}
+
+func (r *redisStorage) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	// default list is kept apart, so that it's not overridden
+	pl := model.PrivacyList{Username: list.Username, Name: list.Name, Items: sortedPrivacyListItems(list.Items)}
+	return r.client.HSet(r.privacyListsKey(list.Username), list.Name, redisBytes(&pl)).Err()
+}
+
+func (r *redisStorage) DeletePrivacyList(ctx context.Context, username, name string) error {
+	listsKey := r.privacyListsKey(username)
+	defaultKey := r.privacyDefaultListKey(username)
+	return r.watch(func(tx *redis.Tx) error {
+		defaultName, err := redisVal(tx.Get(defaultKey))
+		if err != nil {
+			return err
+		}
+		_, err = tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.HDel(listsKey, name)
+			if string(defaultName) == name {
+				pipe.Del(defaultKey)
+			}
+			return nil
+		})
+		return err
+	}, defaultKey)
+}
+
+func (r *redisStorage) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	vals, err := r.client.HVals(r.privacyListsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	defaultName, err := redisVal(r.client.Get(r.privacyDefaultListKey(username)))
+	if err != nil {
+		return nil, err
+	}
+	var pls []model.PrivacyList
+	for _, val := range vals {
+		var pl model.PrivacyList
+		pl.FromBytes(strings.NewReader(val))
+		pl.Default = defaultName != nil && pl.Name == string(defaultName)
+		pls = append(pls, pl)
+	}
+	sort.Slice(pls, func(i, j int) bool { return pls[i].Name < pls[j].Name })
+	return pls, nil
+}
+
+func (r *redisStorage) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	listsKey := r.privacyListsKey(username)
+	defaultKey := r.privacyDefaultListKey(username)
+	return r.watch(func(tx *redis.Tx) error {
+		exists := false
+		if len(name) > 0 {
+			var err error
+			if exists, err = tx.HExists(listsKey, name).Result(); err != nil {
+				return err
+			}
+		}
+		_, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			if exists {
+				pipe.Set(defaultKey, name, 0)
+			} else {
+				pipe.Del(defaultKey)
+			}
+			return nil
+		})
+		return err
+	}, listsKey, defaultKey)
+}
+
+func (r *redisStorage) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	return r.client.HSet(r.featureFlagsKey(ff.Username), ff.Name, redisBytes(ff)).Err()
+}
+
+func (r *redisStorage) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	return r.client.HDel(r.featureFlagsKey(username), name).Err()
+}
+
+func (r *redisStorage) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	vals, err := r.client.HVals(r.featureFlagsKey(username)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var ffs []model.FeatureFlag
+	for _, val := range vals {
+		var ff model.FeatureFlag
+		ff.FromBytes(strings.NewReader(val))
+		ffs = append(ffs, ff)
+	}
+	return ffs, nil
+}
+
+func (r *redisStorage) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	return r.client.Set(r.inviteKey(invite.Token), redisBytes(invite), 0).Err()
+}
+
+func (r *redisStorage) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	var redeemed bool
+	key := r.inviteKey(token)
+	err := r.watch(func(tx *redis.Tx) error {
+		redeemed = false
+		val, err := redisVal(tx.Get(key))
+		if err != nil || val == nil {
+			return err
+		}
+		var inv model.Invite
+		inv.FromBytes(bytes.NewReader(val))
+		if inv.Used || !now.Before(inv.ExpiresAt) {
+			return nil
+		}
+		inv.Used = true
+		if _, err := tx.Pipelined(func(pipe redis.Pipeliner) error {
+			pipe.Set(key, redisBytes(&inv), 0)
+			return nil
+		}); err != nil {
+			return err
+		}
+		redeemed = true
+		return nil
+	}, key)
+	if err != nil {
+		return false, err
+	}
+	return redeemed, nil
+}
+
+func (r *redisStorage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	return r.client.HSet(r.streamSessionsKey(session.ServerID), session.ID, redisBytes(session)).Err()
+}
+
+func (r *redisStorage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	vals, err := r.client.HVals(r.streamSessionsKey(serverID)).Result()
+	if err != nil {
+		return nil, err
+	}
+	var sessions []model.StreamSession
+	for _, val := range vals {
+		var session model.StreamSession
+		session.FromBytes(strings.NewReader(val))
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (r *redisStorage) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	return r.client.Del(r.streamSessionsKey(serverID)).Err()
+}
+
+// Usage reports the number of stored entities. Redis doesn't
+// expose per key sizes cheaply, so that bytes are left unset.
+func (r *redisStorage) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	entities := []struct {
+		name   string
+		prefix string
+		count  func(key string) (int64, error)
+	}{
+		{"archive_prefs", "archivePrefs:", nil},
+		{"archived_messages", "archivedMessages:", r.sortedSetLen},
+		{"block_list_items", "blockListItems:", r.hashLen},
+		{"feature_flags", "featureFlags:", r.hashLen},
+		{"invites", "invites:", nil},
+		{"offline_messages", "offlineMessages:", r.listLen},
+		{"privacy_lists", "privacyLists:", r.hashLen},
+		{"private_storage", "privateElements:", r.hashLen},
+		{"quarantined_messages", "quarantinedMessages:", r.listLen},
+		{"roster_items", "rosterItems:", r.hashLen},
+		{"roster_notifications", "rosterNotifications:", r.hashLen},
+		{"roster_tombstones", "rosterTombstones:", r.hashLen},
+		{"roster_versions", "rosterVersions:", nil},
+		{"stream_sessions", "streamSessions:", r.hashLen},
+		{"users", "users:", nil},
+		{"vcards", "vCards:", nil},
+	}
+	var usage []model.EntityUsage
+	for _, e := range entities {
+		u := model.EntityUsage{Entity: e.name}
+		err := r.scanKeys(r.key(e.prefix), func(key string) error {
+			if e.count == nil {
+				u.Rows++
+				return nil
+			}
+			n, err := e.count(key)
+			u.Rows += n
+			return err
+		})
+		if err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+func (r *redisStorage) hashLen(key string) (int64, error) {
+	return r.client.HLen(key).Result()
+}
+
+func (r *redisStorage) listLen(key string) (int64, error) {
+	return r.client.LLen(key).Result()
+}
+
+func (r *redisStorage) sortedSetLen(key string) (int64, error) {
+	return r.client.ZCard(key).Result()
+}
+
+// scanKeys iterates over every key matching prefix, usageScanBatchSize
+// keys at a time, so that long scans don't block the Redis server.
+func (r *redisStorage) scanKeys(prefix string, f func(key string) error) error {
+	var cursor uint64
+	for {
+		keys, next, err := r.client.Scan(cursor, prefix+"*", usageScanBatchSize).Result()
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := f(key); err != nil {
+				return err
+			}
+		}
+		if next == 0 {
+			return nil
+		}
+		cursor = next
+	}
+}
+
+// InTransaction satisfies Storage interface.
+//
+// Redis transactions can't interleave reads with writes, so operations
+// run by f are applied as they go and can't be rolled back. Each of them
+// stays atomic on its own though.
+func (r *redisStorage) InTransaction(ctx context.Context, f func(tx Storage) error) error {
+	return f(r)
+}
+
+// watch runs f within an optimistic transaction watching keys,
+// retrying whenever any of them is modified concurrently.
+func (r *redisStorage) watch(f func(tx *redis.Tx) error, keys ...string) error {
+	for {
+		err := r.client.Watch(f, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+}
+
+// redisVal returns cmd value, or nil if the key doesn't exist.
+func redisVal(cmd *redis.StringCmd) ([]byte, error) {
+	val, err := cmd.Bytes()
+	switch err {
+	case nil:
+		return val, nil
+	case redis.Nil:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func redisBytes(e interface{ ToBytes(w io.Writer) }) []byte {
+	buf := new(bytes.Buffer)
+	e.ToBytes(buf)
+	return buf.Bytes()
+}
+
+// decodeRedisRosterItems decodes vals, returning items in insertion order.
+func decodeRedisRosterItems(vals []string) []model.RosterItem {
+	var ris []model.RosterItem
+	var seqs []uint64
+	for _, val := range vals {
+		seq, ri := decodeRosterItemSeq([]byte(val))
+		ris = append(ris, *ri)
+		seqs = append(seqs, seq)
+	}
+	sort.Sort(&rosterItemsBySeq{ris: ris, seqs: seqs})
+	return ris
+}
+
+// redisTenantPrefix returns the prefix of every key stored on behalf of tenant.
+func redisTenantPrefix(tenant string) string {
+	if len(tenant) == 0 {
+		return ""
+	}
+	return "tenants:" + tenant + "/"
+}
+
+// key returns k qualified by handle tenant.
+func (r *redisStorage) key(k string) string {
+	return r.prefix + k
+}
+
+func (r *redisStorage) userKey(username string) string {
+	return r.key("users:" + username)
+}
+
+func (r *redisStorage) vCardKey(username string) string {
+	return r.key("vCards:" + username)
+}
+
+func (r *redisStorage) privateStorageKey(username string) string {
+	return r.key("privateElements:" + username)
+}
+
+func (r *redisStorage) rosterItemsKey(user string) string {
+	return r.key("rosterItems:" + user)
+}
+
+func (r *redisStorage) rosterVersionKey(user string) string {
+	return r.key("rosterVersions:" + user)
+}
+
+func (r *redisStorage) rosterTombstonesKey(user string) string {
+	return r.key("rosterTombstones:" + user)
+}
+
+// rosterNotificationsKey returns the key of roster notifications received by contact.
+func (r *redisStorage) rosterNotificationsKey(contact string) string {
+	return r.key("rosterNotifications:" + contact)
+}
+
+// rosterNotificationSendersKey returns the key of the set of contacts
+// user sent roster notifications to.
+func (r *redisStorage) rosterNotificationSendersKey(user string) string {
+	return r.key("rosterNotificationSenders:" + user)
+}
+
+func (r *redisStorage) offlineMessagesKey(username string) string {
+	return r.key("offlineMessages:" + username)
+}
+
+func (r *redisStorage) quarantinedMessagesKey(username string) string {
+	return r.key("quarantinedMessages:" + username)
+}
+
+func (r *redisStorage) featureFlagsKey(username string) string {
+	return r.key("featureFlags:" + username)
+}
+
+func (r *redisStorage) blockListItemsKey(username string) string {
+	return r.key("blockListItems:" + username)
+}
+
+func (r *redisStorage) privacyListsKey(username string) string {
+	return r.key("privacyLists:" + username)
+}
+
+func (r *redisStorage) privacyDefaultListKey(username string) string {
+	return r.key("privacyDefaultLists:" + username)
+}
+
+func (r *redisStorage) archivedMessagesKey(username string) string {
+	return r.key("archivedMessages:" + username)
+}
+
+func (r *redisStorage) archiveSeqKey(username string) string {
+	return r.key("archiveSeqs:" + username)
+}
+
+func (r *redisStorage) archivePrefsKey(username string) string {
+	return r.key("archivePrefs:" + username)
+}
+
+// redisArchivedMessageSeq returns the insertion sequence
+// of an archived message identifier, if well-formed.
+func redisArchivedMessageSeq(id string) (uint64, bool) {
+	seq, err := strconv.ParseUint(id, 10, 64)
+	return seq, err == nil
+}
+
+func (r *redisStorage) inviteKey(token string) string {
+	return r.key("invites:" + token)
+}
+
+func (r *redisStorage) streamSessionsKey(serverID string) string {
+	return r.key("streamSessions:" + serverID)
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+type testRedisHelper struct {
+	db *redisStorage
+	mr *miniredis.Miniredis
+}
+
+func TestRedis_User(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilRedisSetup()
+	defer tUtilRedisTeardown(h)
+
+	usr := model.User{Username: "ortuman", Password: "1234"}
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &usr))
+
+	usr2, err := h.db.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, "1234", usr2.Password)
+
+	cnt, err := h.db.CountUsers(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+
+	usr.PurgeAt = time.Now().Add(-time.Minute)
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &usr))
+	usernames, err := h.db.FetchPurgeableUsers(context.Background(), time.Now())
+	require.Nil(t, err)
+	require.Equal(t, []string{"ortuman"}, usernames)
+
+	require.Nil(t, h.db.DeleteUser(context.Background(), "ortuman"))
+	usr2, err = h.db.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Nil(t, usr2)
+	cnt, _ = h.db.CountUsers(context.Background())
+	require.Equal(t, 0, cnt)
+}
+
+func TestRedis_RosterItems(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilRedisSetup()
+	defer tUtilRedisTeardown(h)
+
+	contacts := []string{"romeo", "juliet", "noelia"}
+	for _, contact := range contacts {
+		require.Nil(t, h.db.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: contact, Subscription: "none"}))
+	}
+	// updates don't alter item position
+	ri := &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both", Groups: []string{"friends"}}
+	require.Nil(t, h.db.InsertOrUpdateRosterItem(context.Background(), ri))
+	require.Equal(t, 4, ri.Ver)
+
+	ris, err := h.db.FetchRosterItems(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, len(contacts), len(ris))
+	for i, ri := range ris {
+		require.Equal(t, contacts[i], ri.Contact)
+	}
+	ri2, err := h.db.FetchRosterItem(context.Background(), "ortuman", "romeo")
+	require.Nil(t, err)
+	require.Equal(t, ri, ri2)
+
+	require.Nil(t, h.db.DeleteRosterItem(context.Background(), "ortuman", "juliet"))
+	ri2, err = h.db.FetchRosterItem(context.Background(), "ortuman", "juliet")
+	require.Nil(t, err)
+	require.Nil(t, ri2)
+
+	rts, err := h.db.FetchRosterTombstones(context.Background(), "ortuman", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rts))
+	require.Equal(t, 5, rts[0].Ver)
+
+	n, err := h.db.PruneRosterTombstones(context.Background(), time.Now())
+	require.Nil(t, err)
+	require.Equal(t, 1, n)
+	rv, err := h.db.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, model.RosterVersion{Ver: 5, PrunedVer: 5}, rv)
+}
+
+func TestRedis_OfflineMessages(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilRedisSetup()
+	defer tUtilRedisTeardown(h)
+
+	for i := 0; i < 5; i++ {
+		require.Nil(t, h.db.InsertOfflineMessage(context.Background(), xml.NewMessageType(fmt.Sprintf("msg%d", i), xml.NormalType), "ortuman"))
+	}
+	cnt, err := h.db.CountOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 5, cnt)
+
+	// insertion order
+	msgs, err := h.db.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 5, len(msgs))
+	for i, msg := range msgs {
+		require.Equal(t, fmt.Sprintf("msg%d", i), msg.Message.ID())
+	}
+	require.Nil(t, h.db.DeleteOfflineMessages(context.Background(), "ortuman"))
+	cnt, _ = h.db.CountOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 0, cnt)
+}
+
+func TestRedis_Usage(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilRedisSetup()
+	defer tUtilRedisTeardown(h)
+
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+	for i := 0; i < usageScanBatchSize+10; i++ {
+		require.Nil(t, h.db.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: fmt.Sprintf("user%d", i), Contact: "ortuman"}))
+	}
+	require.Nil(t, h.db.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "user0", Contact: "noelia"}))
+
+	usage, err := h.db.Usage(context.Background())
+	require.Nil(t, err)
+	rows := make(map[string]int64)
+	for _, u := range usage {
+		rows[u.Entity] = u.Rows
+	}
+	require.Equal(t, int64(1), rows["users"])
+	require.Equal(t, int64(usageScanBatchSize+11), rows["roster_items"])
+	require.Equal(t, int64(usageScanBatchSize+10), rows["roster_versions"])
+	require.Equal(t, int64(0), rows["offline_messages"])
+}
+
+func tUtilRedisSetup() *testRedisHelper {
+	mr, err := miniredis.Run()
+	if err != nil {
+		panic(err)
+	}
+	db := newRedisStorage(&config.RedisDb{Address: mr.Addr()}, "")
+	return &testRedisHelper{db: db, mr: mr}
+}
+
+func tUtilRedisTeardown(h *testRedisHelper) {
+	h.db.Shutdown()
+	h.mr.Close()
+}
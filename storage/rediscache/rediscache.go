@@ -0,0 +1,353 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package rediscache implements a storage decorator caching users, rosters
+// and vCards in Redis, so that the reads dominating storage load are
+// mostly served without reaching the underlying storage.
+//
+// Cached entities are evicted whenever they're updated or deleted through
+// this decorator, while TTLs bound staleness regarding writes bypassing it.
+package rediscache
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/go-redis/redis"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+// TTLs represents the time every cached entity kind is kept.
+type TTLs struct {
+	User   time.Duration
+	Roster time.Duration
+	VCard  time.Duration
+}
+
+// Storage represents a Redis read-through caching storage decorator.
+type Storage struct {
+	// gen is incremented on every eviction, so that a value read from
+	// the underlying storage isn't cached after a concurrent update.
+	// Kept first for 64-bit atomic alignment.
+	gen uint64
+
+	storage.Storage
+	client *redis.Client
+	prefix string
+	ttls   TTLs
+	hits   *stats.Counter
+	misses *stats.Counter
+}
+
+// New returns a decorator wrapping s, caching entities in client for ttls.
+// Keys are qualified by tenant, if not empty.
+func New(s storage.Storage, client *redis.Client, tenant string, ttls TTLs) *Storage {
+	prefix := "cache:"
+	if len(tenant) > 0 {
+		prefix += "tenants:" + tenant + "/"
+	}
+	return &Storage{
+		Storage: s,
+		client:  client,
+		prefix:  prefix,
+		ttls:    ttls,
+		hits:    stats.Default().Counter("storage/redis_cache/hits", "lookups"),
+		misses:  stats.Default().Counter("storage/redis_cache/misses", "lookups"),
+	}
+}
+
+// Shutdown satisfies storage.Storage interface.
+func (s *Storage) Shutdown() {
+	s.Storage.Shutdown()
+	s.client.Close()
+}
+
+// FetchUser satisfies storage.Storage interface.
+func (s *Storage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	key := s.userKey(username)
+	if val, ok := s.get(key); ok {
+		if len(val) == 0 {
+			return nil, nil
+		}
+		var usr model.User
+		usr.FromBytes(bytes.NewReader(val))
+		return &usr, nil
+	}
+	gen := atomic.LoadUint64(&s.gen)
+	usr, err := s.Storage.FetchUser(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if usr != nil {
+		usr.ToBytes(buf)
+	}
+	s.set(key, buf.Bytes(), s.ttls.User, gen)
+	return usr, nil
+}
+
+// InsertOrUpdateUser satisfies storage.Storage interface.
+func (s *Storage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	err := s.Storage.InsertOrUpdateUser(ctx, user)
+	s.evict(s.userKey(user.Username))
+	return err
+}
+
+// DeleteUser satisfies storage.Storage interface.
+func (s *Storage) DeleteUser(ctx context.Context, username string) error {
+	err := s.Storage.DeleteUser(ctx, username)
+
+	// evict everything cached on behalf of user, so that a stale
+	// roster doesn't outlive the account
+	s.evict(s.userKey(username), s.rosterKey(username), s.vCardKey(username))
+	return err
+}
+
+// FetchRosterItems satisfies storage.Storage interface.
+func (s *Storage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
+	key := s.rosterKey(user)
+	if val, ok := s.get(key); ok {
+		var ris []model.RosterItem
+		if err := gob.NewDecoder(bytes.NewReader(val)).Decode(&ris); err == nil {
+			return ris, nil
+		}
+		// unreadable value, fetch it again
+	}
+	gen := atomic.LoadUint64(&s.gen)
+	ris, err := s.Storage.FetchRosterItems(ctx, user)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if err := gob.NewEncoder(buf).Encode(ris); err != nil {
+		return ris, nil
+	}
+	s.set(key, buf.Bytes(), s.ttls.Roster, gen)
+	return ris, nil
+}
+
+// FetchRosterItemsOfUsers satisfies storage.Storage interface.
+// Cached rosters are looked up at once, fetching the missing ones
+// from the underlying storage by a single call.
+func (s *Storage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	if len(users) == 0 {
+		return map[string][]model.RosterItem{}, nil
+	}
+	keys := make([]string, len(users))
+	for i, user := range users {
+		keys[i] = s.rosterKey(user)
+	}
+	vals, err := s.client.MGet(keys...).Result()
+	if err != nil {
+		log.Limited("storage/redis_cache/get").Warnf("redis cache: %v", err)
+		vals = make([]interface{}, len(users))
+	}
+	ret := make(map[string][]model.RosterItem, len(users))
+	var missing []string
+	for i, user := range users {
+		val, ok := vals[i].(string)
+		if ok {
+			var ris []model.RosterItem
+			if err := gob.NewDecoder(strings.NewReader(val)).Decode(&ris); err == nil {
+				s.hits.Inc()
+				if len(ris) > 0 {
+					ret[user] = ris
+				}
+				continue
+			}
+		}
+		s.misses.Inc()
+		missing = append(missing, user)
+	}
+	if len(missing) == 0 {
+		return ret, nil
+	}
+	gen := atomic.LoadUint64(&s.gen)
+	fetched, err := s.Storage.FetchRosterItemsOfUsers(ctx, missing)
+	if err != nil {
+		return nil, err
+	}
+	for _, user := range missing {
+		ris := fetched[user]
+		buf := new(bytes.Buffer)
+		if err := gob.NewEncoder(buf).Encode(ris); err == nil {
+			s.set(s.rosterKey(user), buf.Bytes(), s.ttls.Roster, gen)
+		}
+		if len(ris) > 0 {
+			ret[user] = ris
+		}
+	}
+	return ret, nil
+}
+
+// InsertOrUpdateRosterItem satisfies storage.Storage interface.
+func (s *Storage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	err := s.Storage.InsertOrUpdateRosterItem(ctx, ri)
+	s.evict(s.rosterKey(ri.User))
+	return err
+}
+
+// DeleteRosterItem satisfies storage.Storage interface.
+func (s *Storage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	err := s.Storage.DeleteRosterItem(ctx, user, contact)
+	s.evict(s.rosterKey(user))
+	return err
+}
+
+// FetchVCard satisfies storage.Storage interface.
+func (s *Storage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	key := s.vCardKey(username)
+	if val, ok := s.get(key); ok {
+		if len(val) == 0 {
+			return nil, nil
+		}
+		var vCard xml.MutableElement
+		vCard.FromBytes(bytes.NewReader(val))
+		return &vCard, nil
+	}
+	gen := atomic.LoadUint64(&s.gen)
+	vCard, err := s.Storage.FetchVCard(ctx, username)
+	if err != nil {
+		return nil, err
+	}
+	buf := new(bytes.Buffer)
+	if vCard != nil {
+		vCard.ToBytes(buf)
+	}
+	s.set(key, buf.Bytes(), s.ttls.VCard, gen)
+	return vCard, nil
+}
+
+// InsertOrUpdateVCard satisfies storage.Storage interface.
+func (s *Storage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	err := s.Storage.InsertOrUpdateVCard(ctx, vCard, username)
+	s.evict(s.vCardKey(username))
+	return err
+}
+
+// InTransaction satisfies storage.Storage interface.
+// Transactions bypass the cache, so that it never holds
+// a value that could be rolled back.
+func (s *Storage) InTransaction(ctx context.Context, f func(tx storage.Storage) error) error {
+	tx := &txStorage{cache: s}
+	err := s.Storage.InTransaction(ctx, func(stx storage.Storage) error {
+		tx.Storage = stx
+		return f(tx)
+	})
+	// stale values might have been cached before the transaction committed
+	if len(tx.evicted) > 0 {
+		s.evict(tx.evicted...)
+	}
+	return err
+}
+
+// get returns the value cached under key, if any. Empty values
+// represent entities known to be missing.
+func (s *Storage) get(key string) ([]byte, bool) {
+	val, err := s.client.Get(key).Bytes()
+	switch err {
+	case nil:
+		s.hits.Inc()
+		return val, true
+	case redis.Nil:
+		break
+	default:
+		log.Limited("storage/redis_cache/get").Warnf("redis cache: %v", err)
+	}
+	s.misses.Inc()
+	return nil, false
+}
+
+// set caches val under key, unless an eviction took place
+// since gen was loaded.
+func (s *Storage) set(key string, val []byte, ttl time.Duration, gen uint64) {
+	if atomic.LoadUint64(&s.gen) != gen {
+		return
+	}
+	if err := s.client.Set(key, val, ttl).Err(); err != nil {
+		log.Limited("storage/redis_cache/set").Warnf("redis cache: %v", err)
+		return
+	}
+	// an eviction might have happened right before caching val
+	if atomic.LoadUint64(&s.gen) != gen {
+		s.client.Del(key)
+	}
+}
+
+func (s *Storage) evict(keys ...string) {
+	atomic.AddUint64(&s.gen, 1)
+	if err := s.client.Del(keys...).Err(); err != nil {
+		log.Errorf("redis cache: couldn't evict %v: %v", keys, err)
+	}
+}
+
+func (s *Storage) userKey(username string) string {
+	return s.prefix + "users:" + username
+}
+
+func (s *Storage) rosterKey(user string) string {
+	return s.prefix + "rosterItems:" + user
+}
+
+func (s *Storage) vCardKey(username string) string {
+	return s.prefix + "vCards:" + username
+}
+
+// txStorage represents a storage handle bound to a transaction,
+// keeping track of the cached entities modified through it.
+type txStorage struct {
+	storage.Storage
+	cache   *Storage
+	evicted []string
+}
+
+func (tx *txStorage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	err := tx.Storage.InsertOrUpdateUser(ctx, user)
+	tx.evict(tx.cache.userKey(user.Username))
+	return err
+}
+
+func (tx *txStorage) DeleteUser(ctx context.Context, username string) error {
+	err := tx.Storage.DeleteUser(ctx, username)
+	tx.evict(tx.cache.userKey(username), tx.cache.rosterKey(username), tx.cache.vCardKey(username))
+	return err
+}
+
+func (tx *txStorage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	err := tx.Storage.InsertOrUpdateRosterItem(ctx, ri)
+	tx.evict(tx.cache.rosterKey(ri.User))
+	return err
+}
+
+func (tx *txStorage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	err := tx.Storage.DeleteRosterItem(ctx, user, contact)
+	tx.evict(tx.cache.rosterKey(user))
+	return err
+}
+
+func (tx *txStorage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	err := tx.Storage.InsertOrUpdateVCard(ctx, vCard, username)
+	tx.evict(tx.cache.vCardKey(username))
+	return err
+}
+
+func (tx *txStorage) InTransaction(ctx context.Context, f func(tx storage.Storage) error) error {
+	return f(tx)
+}
+
+// evict evicts keys right away, remembering them
+// to be evicted again once the transaction is over.
+func (tx *txStorage) evict(keys ...string) {
+	tx.cache.evict(keys...)
+	tx.evicted = append(tx.evicted, keys...)
+}
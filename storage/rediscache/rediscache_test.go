@@ -0,0 +1,176 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package rediscache
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis"
+	"github.com/go-redis/redis"
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/faulty"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+var testTTLs = TTLs{User: time.Minute, Roster: time.Minute, VCard: time.Hour}
+
+func TestRedisCache_ReadThrough(t *testing.T) {
+	s, fs, mr := setupTest(t)
+	defer storage.Shutdown()
+	defer mr.Close()
+
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both"}))
+	require.Nil(t, s.InsertOrUpdateVCard(context.Background(), xml.NewElementNamespace("vCard", "vcard-temp"), "ortuman"))
+
+	hits := s.hits.Value()
+	for i := 0; i < 10; i++ {
+		ris, err := s.FetchRosterItems(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(ris))
+		require.Equal(t, "romeo", ris[0].Contact)
+
+		vCard, err := s.FetchVCard(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, "vCard", vCard.Name())
+
+		// missing entities are cached as well
+		usr, err := s.FetchUser(context.Background(), "romeo")
+		require.Nil(t, err)
+		require.Nil(t, usr)
+	}
+	require.Equal(t, int64(1), fs.Stats()["FetchRosterItems"].Calls)
+	require.Equal(t, int64(1), fs.Stats()["FetchVCard"].Calls)
+	require.Equal(t, int64(1), fs.Stats()["FetchUser"].Calls)
+	require.Equal(t, int64(27), s.hits.Value()-hits)
+
+	// cached entities expire after their TTL
+	mr.FastForward(testTTLs.Roster)
+	_, err := s.FetchRosterItems(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, int64(2), fs.Stats()["FetchRosterItems"].Calls)
+}
+
+func TestRedisCache_Eviction(t *testing.T) {
+	s, fs, mr := setupTest(t)
+	defer storage.Shutdown()
+	defer mr.Close()
+
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+	usr, _ := s.FetchUser(context.Background(), "ortuman")
+	require.Equal(t, "1234", usr.Password)
+
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "5678"}))
+	usr, _ = s.FetchUser(context.Background(), "ortuman")
+	require.Equal(t, "5678", usr.Password)
+
+	ris, _ := s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 0, len(ris))
+
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both"}))
+	ris, _ = s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 1, len(ris))
+
+	require.Nil(t, s.DeleteRosterItem(context.Background(), "ortuman", "romeo"))
+	ris, _ = s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 0, len(ris))
+
+	vCard, _ := s.FetchVCard(context.Background(), "ortuman")
+	require.Nil(t, vCard)
+	require.Nil(t, s.InsertOrUpdateVCard(context.Background(), xml.NewElementNamespace("vCard", "vcard-temp"), "ortuman"))
+	vCard, _ = s.FetchVCard(context.Background(), "ortuman")
+	require.NotNil(t, vCard)
+
+	require.Equal(t, int64(3), fs.Stats()["FetchRosterItems"].Calls)
+}
+
+func TestRedisCache_DeleteUser(t *testing.T) {
+	s, _, mr := setupTest(t)
+	defer storage.Shutdown()
+	defer mr.Close()
+
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both"}))
+	require.Nil(t, s.InsertOrUpdateVCard(context.Background(), xml.NewElementNamespace("vCard", "vcard-temp"), "ortuman"))
+
+	// warm up cache
+	usr, _ := s.FetchUser(context.Background(), "ortuman")
+	require.NotNil(t, usr)
+	ris, _ := s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 1, len(ris))
+	vCard, _ := s.FetchVCard(context.Background(), "ortuman")
+	require.NotNil(t, vCard)
+
+	// cancelled registration must not leave a stale roster behind
+	require.Nil(t, s.DeleteUser(context.Background(), "ortuman"))
+	require.False(t, mr.Exists(s.userKey("ortuman")))
+	require.False(t, mr.Exists(s.rosterKey("ortuman")))
+	require.False(t, mr.Exists(s.vCardKey("ortuman")))
+
+	usr, _ = s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, usr)
+	ris, _ = s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 0, len(ris))
+	vCard, _ = s.FetchVCard(context.Background(), "ortuman")
+	require.Nil(t, vCard)
+}
+
+func TestRedisCache_Transaction(t *testing.T) {
+	s, fs, mr := setupTest(t)
+	defer storage.Shutdown()
+	defer mr.Close()
+
+	ris, _ := s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 0, len(ris))
+
+	require.Nil(t, s.InTransaction(context.Background(), func(tx storage.Storage) error {
+		if err := tx.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both"}); err != nil {
+			return err
+		}
+		// transactions bypass the cache
+		ris, err := tx.FetchRosterItems(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(ris))
+		return nil
+	}))
+	require.False(t, mr.Exists(s.rosterKey("ortuman")))
+
+	ris, _ = s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, 1, len(ris))
+	require.Equal(t, int64(3), fs.Stats()["FetchRosterItems"].Calls)
+}
+
+func TestRedisCache_Unavailable(t *testing.T) {
+	s, fs, mr := setupTest(t)
+	defer storage.Shutdown()
+
+	require.Nil(t, s.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both"}))
+	mr.Close()
+
+	// reads fall back to the underlying storage
+	for i := 0; i < 2; i++ {
+		ris, err := s.FetchRosterItems(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.Equal(t, 1, len(ris))
+	}
+	require.Equal(t, int64(2), fs.Stats()["FetchRosterItems"].Calls)
+}
+
+func setupTest(t *testing.T) (*Storage, *faulty.Storage, *miniredis.Miniredis) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+
+	fs := faulty.New(storage.Instance())
+	require.Nil(t, fs.Enable(map[string]faulty.Fault{"FetchUser": {}, "FetchRosterItems": {}, "FetchVCard": {}}))
+
+	mr, err := miniredis.Run()
+	require.Nil(t, err)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	return New(fs, client, "", testTTLs), fs, mr
+}
@@ -0,0 +1,1257 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3" // SQL driver
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+// sqliteBusyTimeout is the time a connection waits for a database lock
+// held by another process before failing with SQLITE_BUSY.
+const sqliteBusyTimeout = 5000 // 5 seconds
+
+// sqliteSchema creates every table on first start.
+const sqliteSchema = `
+CREATE TABLE IF NOT EXISTS users (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    password TEXT NOT NULL,
+    password_hash TEXT NOT NULL DEFAULT '',
+    scram_verifier TEXT NOT NULL DEFAULT '',
+    purge_at INTEGER NOT NULL DEFAULT 0,
+    email TEXT NOT NULL DEFAULT '',
+    email_verified INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username)
+);
+
+CREATE TABLE IF NOT EXISTS roster_items (
+    tenant TEXT NOT NULL DEFAULT '',
+    user TEXT NOT NULL,
+    contact TEXT NOT NULL,
+    name TEXT NOT NULL,
+    subscription TEXT NOT NULL,
+    "groups" TEXT NOT NULL,
+    ask INTEGER NOT NULL,
+    ver INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, user, contact)
+);
+
+CREATE INDEX IF NOT EXISTS i_roster_items_contact ON roster_items(tenant, contact);
+
+CREATE TABLE IF NOT EXISTS roster_versions (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    ver INTEGER NOT NULL DEFAULT 0,
+    pruned_ver INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username)
+);
+
+CREATE TABLE IF NOT EXISTS roster_tombstones (
+    tenant TEXT NOT NULL DEFAULT '',
+    user TEXT NOT NULL,
+    contact TEXT NOT NULL,
+    ver INTEGER NOT NULL,
+    deleted_at INTEGER NOT NULL,
+    PRIMARY KEY (tenant, user, contact)
+);
+
+CREATE INDEX IF NOT EXISTS i_roster_tombstones_deleted_at ON roster_tombstones(tenant, deleted_at);
+
+CREATE TABLE IF NOT EXISTS roster_notifications (
+    tenant TEXT NOT NULL DEFAULT '',
+    user TEXT NOT NULL,
+    contact TEXT NOT NULL,
+    elements TEXT NOT NULL,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, user, contact)
+);
+
+CREATE INDEX IF NOT EXISTS i_roster_notifications_contact ON roster_notifications(tenant, contact);
+
+CREATE TABLE IF NOT EXISTS private_storage (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    namespace TEXT NOT NULL,
+    data TEXT NOT NULL,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username, namespace)
+);
+
+CREATE TABLE IF NOT EXISTS vcards (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    vcard TEXT NOT NULL,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username)
+);
+
+CREATE TABLE IF NOT EXISTS offline_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    data TEXT NOT NULL,
+    received_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS i_offline_messages_username ON offline_messages(tenant, username);
+CREATE INDEX IF NOT EXISTS i_offline_messages_received_at ON offline_messages(tenant, received_at);
+
+CREATE TABLE IF NOT EXISTS quarantined_messages (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    data TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS i_quarantined_messages_username ON quarantined_messages(tenant, username);
+
+CREATE TABLE IF NOT EXISTS archived_messages (
+    id INTEGER PRIMARY KEY AUTOINCREMENT,
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    with_jid TEXT NOT NULL,
+    with_resource TEXT NOT NULL,
+    stamp INTEGER NOT NULL,
+    data TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+);
+
+CREATE INDEX IF NOT EXISTS i_archived_messages_username ON archived_messages(tenant, username, stamp);
+CREATE INDEX IF NOT EXISTS i_archived_messages_with_jid ON archived_messages(tenant, username, with_jid);
+
+CREATE TABLE IF NOT EXISTS archive_prefs (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    default_mode TEXT NOT NULL,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username)
+);
+
+CREATE TABLE IF NOT EXISTS block_list_items (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    jid TEXT NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username, jid)
+);
+
+CREATE TABLE IF NOT EXISTS privacy_lists (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    name TEXT NOT NULL,
+    is_default INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username, name)
+);
+
+CREATE TABLE IF NOT EXISTS privacy_list_items (
+    tenant TEXT NOT NULL DEFAULT '',
+    username TEXT NOT NULL,
+    list_name TEXT NOT NULL,
+    ord INTEGER NOT NULL,
+    type TEXT NOT NULL,
+    value TEXT NOT NULL,
+    action TEXT NOT NULL,
+    message INTEGER NOT NULL,
+    iq INTEGER NOT NULL,
+    presence_in INTEGER NOT NULL,
+    presence_out INTEGER NOT NULL,
+    PRIMARY KEY (tenant, username, list_name, ord)
+);
+
+CREATE TABLE IF NOT EXISTS feature_flags (
+    tenant TEXT NOT NULL DEFAULT '',
+    name TEXT NOT NULL,
+    username TEXT NOT NULL,
+    enabled INTEGER NOT NULL,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, username, name)
+);
+
+CREATE TABLE IF NOT EXISTS invites (
+    tenant TEXT NOT NULL DEFAULT '',
+    token TEXT NOT NULL,
+    created_by TEXT NOT NULL,
+    expires_at INTEGER NOT NULL,
+    used INTEGER NOT NULL DEFAULT 0,
+    updated_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, token)
+);
+
+CREATE TABLE IF NOT EXISTS stream_sessions (
+    tenant TEXT NOT NULL DEFAULT '',
+    server_id TEXT NOT NULL,
+    id TEXT NOT NULL,
+    data BLOB NOT NULL,
+    created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),
+    PRIMARY KEY (tenant, server_id, id)
+);
+`
+
+// sqliteTables contains every table name, as reported by Usage.
+var sqliteTables = []string{
+	"archive_prefs",
+	"archived_messages",
+	"block_list_items",
+	"feature_flags",
+	"invites",
+	"offline_messages",
+	"privacy_list_items",
+	"privacy_lists",
+	"private_storage",
+	"quarantined_messages",
+	"roster_items",
+	"roster_notifications",
+	"roster_tombstones",
+	"roster_versions",
+	"stream_sessions",
+	"users",
+	"vcards",
+}
+
+// sqliteStorage stores every entity into a single SQLite database file,
+// qualified by its handle tenant as done by MySQL storage.
+//
+// Database runs in WAL mode, so that readers don't block on writers,
+// while writes are serialized through writeMu, since SQLite only allows
+// one writer at a time and would otherwise fail with SQLITE_BUSY.
+type sqliteStorage struct {
+	db      *sql.DB
+	tx      *sql.Tx // set on handles bound to a transaction
+	tenant  string  // immutable
+	writeMu sync.Mutex
+}
+
+func newSQLiteStorage(cfg *config.SQLiteDb, tenant string) *sqliteStorage {
+	if len(tenant) > 0 && !config.IsValidTenant(tenant) {
+		log.Fatalf("storage: invalid tenant: %s", tenant)
+	}
+	s, err := openSQLiteStorage(cfg.Path, tenant)
+	if err != nil {
+		log.Fatalf("%v", err)
+	}
+	return s
+}
+
+// openSQLiteStorage opens path database file, creating
+// it along with its schema in case it doesn't exist.
+func openSQLiteStorage(path, tenant string) (*sqliteStorage, error) {
+	dsn := fmt.Sprintf("file:%s?_journal_mode=WAL&_busy_timeout=%d", path, sqliteBusyTimeout)
+	db, err := sql.Open("sqlite3", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := db.Exec(sqliteSchema); err != nil {
+		db.Close()
+		return nil, err
+	}
+	return &sqliteStorage{db: db, tenant: tenant}, nil
+}
+
+func (s *sqliteStorage) Shutdown() {
+	s.db.Close()
+}
+
+func (s *sqliteStorage) InsertOrUpdateUser(ctx context.Context, u *model.User) error {
+	var purgeAt int64
+	if u.IsRemoved() {
+		purgeAt = u.PurgeAt.Unix()
+	}
+	var verifier string
+	if u.Verifier != nil {
+		verifier = u.Verifier.String()
+	}
+	stmt := `` +
+		`INSERT INTO users (tenant, username, password, password_hash, scram_verifier, purge_at, email, email_verified)` +
+		` VALUES(?, ?, ?, ?, ?, ?, ?, ?)` +
+		` ON CONFLICT(tenant, username) DO UPDATE SET password = excluded.password, password_hash = excluded.password_hash,` +
+		` scram_verifier = excluded.scram_verifier, purge_at = excluded.purge_at, email = excluded.email,` +
+		` email_verified = excluded.email_verified, updated_at = strftime('%s', 'now')`
+
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, u.Username, u.Password, u.PasswordHash, verifier, purgeAt, u.Email, u.EmailVerified)
+	return err
+}
+
+func (s *sqliteStorage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT username, password, password_hash, scram_verifier, purge_at, email, email_verified FROM users WHERE tenant = ? AND username = ?", s.tenant, username)
+
+	var usr model.User
+	var verifier string
+	var purgeAt int64
+	err := row.Scan(&usr.Username, &usr.Password, &usr.PasswordHash, &verifier, &purgeAt, &usr.Email, &usr.EmailVerified)
+	switch err {
+	case nil:
+		if len(verifier) > 0 {
+			if usr.Verifier, err = model.ParseScramVerifier(verifier); err != nil {
+				return nil, err
+			}
+		}
+		if purgeAt > 0 {
+			usr.PurgeAt = time.Unix(purgeAt, 0)
+		}
+		return &usr, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqliteStorage) DeleteUser(ctx context.Context, username string) error {
+	stmts := []string{
+		"DELETE FROM offline_messages WHERE tenant = ? AND username = ?",
+		"DELETE FROM quarantined_messages WHERE tenant = ? AND username = ?",
+		"DELETE FROM roster_items WHERE tenant = ? AND user = ?",
+		"DELETE FROM roster_versions WHERE tenant = ? AND username = ?",
+		"DELETE FROM roster_tombstones WHERE tenant = ? AND user = ?",
+		"DELETE FROM roster_notifications WHERE tenant = ? AND user = ?",
+		"DELETE FROM roster_notifications WHERE tenant = ? AND contact = ?",
+		"DELETE FROM private_storage WHERE tenant = ? AND username = ?",
+		"DELETE FROM vcards WHERE tenant = ? AND username = ?",
+		"DELETE FROM archived_messages WHERE tenant = ? AND username = ?",
+		"DELETE FROM archive_prefs WHERE tenant = ? AND username = ?",
+		"DELETE FROM block_list_items WHERE tenant = ? AND username = ?",
+		"DELETE FROM privacy_list_items WHERE tenant = ? AND username = ?",
+		"DELETE FROM privacy_lists WHERE tenant = ? AND username = ?",
+		"DELETE FROM feature_flags WHERE tenant = ? AND username = ?",
+		"DELETE FROM users WHERE tenant = ? AND username = ?",
+	}
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		for _, stmt := range stmts {
+			if _, err := tx.ExecContext(ctx, stmt, s.tenant, username); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) UserExists(ctx context.Context, username string) (bool, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE tenant = ? AND username = ?", s.tenant, username)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return false, err
+	}
+	return count > 0, nil
+}
+
+func (s *sqliteStorage) CountUsers(ctx context.Context) (int, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM users WHERE tenant = ?", s.tenant)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *sqliteStorage) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT username FROM users WHERE tenant = ? AND purge_at > 0 AND purge_at <= ?", s.tenant, before.Unix())
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var usernames []string
+	for rows.Next() {
+		var username string
+		if err := rows.Scan(&username); err != nil {
+			return nil, err
+		}
+		usernames = append(usernames, username)
+	}
+	return usernames, rows.Err()
+}
+
+func (s *sqliteStorage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		ver, err := s.incRosterVersion(ctx, tx, ri.User)
+		if err != nil {
+			return err
+		}
+		stmt := `` +
+			`INSERT INTO roster_items (tenant, user, contact, name, subscription, "groups", ask, ver)` +
+			` VALUES(?, ?, ?, ?, ?, ?, ?, ?)` +
+			` ON CONFLICT(tenant, user, contact) DO UPDATE SET name = excluded.name, subscription = excluded.subscription,` +
+			` "groups" = excluded."groups", ask = excluded.ask, ver = excluded.ver, updated_at = strftime('%s', 'now')`
+		groups := strings.Join(ri.Groups, ";")
+		if _, err := tx.ExecContext(ctx, stmt, s.tenant, ri.User, ri.Contact, ri.Name, ri.Subscription, groups, ri.Ask, ver); err != nil {
+			return err
+		}
+		if _, err := tx.ExecContext(ctx, "DELETE FROM roster_tombstones WHERE tenant = ? AND user = ? AND contact = ?", s.tenant, ri.User, ri.Contact); err != nil {
+			return err
+		}
+		ri.Ver = ver
+		return nil
+	})
+}
+
+func (s *sqliteStorage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		res, err := tx.ExecContext(ctx, "DELETE FROM roster_items WHERE tenant = ? AND user = ? AND contact = ?", s.tenant, user, contact)
+		if err != nil {
+			return err
+		}
+		if n, err := res.RowsAffected(); err != nil || n == 0 {
+			return err // nothing deleted
+		}
+		ver, err := s.incRosterVersion(ctx, tx, user)
+		if err != nil {
+			return err
+		}
+		stmt := `` +
+			`INSERT INTO roster_tombstones (tenant, user, contact, ver, deleted_at)` +
+			` VALUES(?, ?, ?, ?, ?)` +
+			` ON CONFLICT(tenant, user, contact) DO UPDATE SET ver = excluded.ver, deleted_at = excluded.deleted_at`
+		_, err = tx.ExecContext(ctx, stmt, s.tenant, user, contact, ver, time.Now().UnixNano())
+		return err
+	})
+}
+
+func (s *sqliteStorage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
+	stmt := `` +
+		`SELECT user, contact, name, subscription, "groups", ask, ver` +
+		` FROM roster_items WHERE tenant = ? AND user = ?` +
+		` ORDER BY rowid`
+
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, user)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanRosterItemEntities(rows)
+}
+
+// FetchRosterItemsOfUsers satisfies Storage interface.
+// Being in-process, SQLite queries involve no round trips worth batching.
+func (s *sqliteStorage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	ret := make(map[string][]model.RosterItem, len(users))
+	for _, user := range users {
+		ris, err := s.FetchRosterItems(ctx, user)
+		if err != nil {
+			return nil, err
+		}
+		if len(ris) > 0 {
+			ret[user] = ris
+		}
+	}
+	return ret, nil
+}
+
+func (s *sqliteStorage) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
+	stmt := `` +
+		`SELECT user, contact, name, subscription, "groups", ask, ver` +
+		` FROM roster_items WHERE tenant = ? AND user = ? AND contact = ?`
+	row := s.conn().QueryRowContext(ctx, stmt, s.tenant, user, contact)
+
+	var ri model.RosterItem
+	err := scanRosterItemEntity(&ri, row)
+	switch err {
+	case nil:
+		return &ri, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqliteStorage) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT ver, pruned_ver FROM roster_versions WHERE tenant = ? AND username = ?", s.tenant, user)
+
+	var rv model.RosterVersion
+	err := row.Scan(&rv.Ver, &rv.PrunedVer)
+	switch err {
+	case nil, sql.ErrNoRows:
+		return rv, nil
+	default:
+		return model.RosterVersion{}, err
+	}
+}
+
+func (s *sqliteStorage) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
+	stmt := `` +
+		`SELECT user, contact, ver, deleted_at` +
+		` FROM roster_tombstones WHERE tenant = ? AND user = ? AND ver > ?` +
+		` ORDER BY ver`
+
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, user, afterVer)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var rts []model.RosterTombstone
+	for rows.Next() {
+		var rt model.RosterTombstone
+		var deletedAt int64
+		if err := rows.Scan(&rt.User, &rt.Contact, &rt.Ver, &deletedAt); err != nil {
+			return nil, err
+		}
+		rt.DeletedAt = time.Unix(0, deletedAt)
+		rts = append(rts, rt)
+	}
+	return rts, rows.Err()
+}
+
+func (s *sqliteStorage) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	var count int64
+	err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+		// keep track of pruned versions, so that no changes are computed from them
+		stmt := `` +
+			`UPDATE roster_versions SET pruned_ver = MAX(pruned_ver,` +
+			` (SELECT MAX(rt.ver) FROM roster_tombstones rt WHERE rt.tenant = roster_versions.tenant AND rt.user = roster_versions.username AND rt.deleted_at <= ?))` +
+			` WHERE tenant = ? AND username IN (SELECT user FROM roster_tombstones WHERE tenant = ? AND deleted_at <= ?)`
+		if _, err := tx.ExecContext(ctx, stmt, before.UnixNano(), s.tenant, s.tenant, before.UnixNano()); err != nil {
+			return err
+		}
+		res, err := tx.ExecContext(ctx, "DELETE FROM roster_tombstones WHERE tenant = ? AND deleted_at <= ?", s.tenant, before.UnixNano())
+		if err != nil {
+			return err
+		}
+		count, err = res.RowsAffected()
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+// incRosterVersion increments user roster version within tx, returning the new one.
+func (s *sqliteStorage) incRosterVersion(ctx context.Context, tx *sql.Tx, user string) (int, error) {
+	stmt := `` +
+		`INSERT INTO roster_versions (tenant, username, ver, pruned_ver)` +
+		` VALUES(?, ?, 1, 0)` +
+		` ON CONFLICT(tenant, username) DO UPDATE SET ver = ver + 1, updated_at = strftime('%s', 'now')`
+	if _, err := tx.ExecContext(ctx, stmt, s.tenant, user); err != nil {
+		return 0, err
+	}
+	var ver int
+	if err := tx.QueryRowContext(ctx, "SELECT ver FROM roster_versions WHERE tenant = ? AND username = ?", s.tenant, user).Scan(&ver); err != nil {
+		return 0, err
+	}
+	return ver, nil
+}
+
+func (s *sqliteStorage) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
+	stmt := `` +
+		`INSERT INTO roster_notifications (tenant, user, contact, elements)` +
+		` VALUES(?, ?, ?, ?)` +
+		` ON CONFLICT(tenant, user, contact) DO UPDATE SET elements = excluded.elements, updated_at = strftime('%s', 'now')`
+
+	buf := pool.Get()
+	defer pool.Put(buf)
+	for _, elem := range rn.Elements {
+		buf.WriteString(elem.String())
+	}
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, rn.User, rn.Contact, buf.String())
+	return err
+}
+
+func (s *sqliteStorage) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM roster_notifications WHERE tenant = ? AND user = ? AND contact = ?", s.tenant, user, contact)
+	return err
+}
+
+func (s *sqliteStorage) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
+	stmt := `SELECT user, contact, elements FROM roster_notifications WHERE tenant = ? AND contact = ? ORDER BY rowid`
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, contact)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	var ret []model.RosterNotification
+	for rows.Next() {
+		var rn model.RosterNotification
+		var notificationXML string
+		if err := rows.Scan(&rn.User, &rn.Contact, &notificationXML); err != nil {
+			return nil, err
+		}
+		buf.Reset()
+		buf.WriteString("<root>")
+		buf.WriteString(notificationXML)
+		buf.WriteString("</root>")
+
+		parser := xml.NewParser(buf)
+		root, err := parser.ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		rn.Elements = root.Elements()
+
+		ret = append(ret, rn)
+	}
+	return ret, rows.Err()
+}
+
+func (s *sqliteStorage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	stmt := `` +
+		`INSERT INTO vcards (tenant, username, vcard)` +
+		` VALUES(?, ?, ?)` +
+		` ON CONFLICT(tenant, username) DO UPDATE SET vcard = excluded.vcard, updated_at = strftime('%s', 'now')`
+
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, vCard.String())
+	return err
+}
+
+func (s *sqliteStorage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT vcard FROM vcards WHERE tenant = ? AND username = ?", s.tenant, username)
+	var vCard string
+	err := row.Scan(&vCard)
+	switch err {
+	case nil:
+		parser := xml.NewParser(strings.NewReader(vCard))
+		return parser.ParseElement()
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqliteStorage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
+	stmt := `` +
+		`INSERT INTO private_storage (tenant, username, namespace, data)` +
+		` VALUES(?, ?, ?, ?)` +
+		` ON CONFLICT(tenant, username, namespace) DO UPDATE SET data = excluded.data, updated_at = strftime('%s', 'now')`
+
+	buf := pool.Get()
+	defer pool.Put(buf)
+	for _, elem := range privateXML {
+		elem.ToXML(buf, true)
+	}
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, namespace, buf.String())
+	return err
+}
+
+func (s *sqliteStorage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT data FROM private_storage WHERE tenant = ? AND username = ? AND namespace = ?", s.tenant, username, namespace)
+	var privateXML string
+	err := row.Scan(&privateXML)
+	switch err {
+	case nil:
+		buf := pool.Get()
+		defer pool.Put(buf)
+		buf.WriteString("<root>")
+		buf.WriteString(privateXML)
+		buf.WriteString("</root>")
+
+		parser := xml.NewParser(buf)
+		rootEl, err := parser.ParseElement()
+		if err != nil {
+			return nil, err
+		}
+		return rootEl.Elements(), nil
+
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqliteStorage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "INSERT INTO offline_messages (tenant, username, data) VALUES(?, ?, ?)", s.tenant, username, message.String())
+	return err
+}
+
+// InsertOfflineMessages satisfies Storage interface.
+func (s *sqliteStorage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		for _, message := range messages {
+			_, err := tx.ExecContext(ctx, "INSERT INTO offline_messages (tenant, username, data) VALUES(?, ?, ?)", s.tenant, username, message.String())
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// InsertCappedOfflineMessage satisfies Storage interface.
+func (s *sqliteStorage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	var inserted bool
+	err := s.inTransaction(ctx, func(tx *sql.Tx) error {
+		var count int
+		row := tx.QueryRowContext(ctx, "SELECT COUNT(*) FROM offline_messages WHERE tenant = ? AND username = ?", s.tenant, username)
+		if err := row.Scan(&count); err != nil {
+			return err
+		}
+		if count >= capacity {
+			if !dropOldest {
+				return nil
+			}
+			stmt := `` +
+				`DELETE FROM offline_messages WHERE id IN (` +
+				`SELECT id FROM offline_messages WHERE tenant = ? AND username = ? ORDER BY id LIMIT ?)`
+			if _, err := tx.ExecContext(ctx, stmt, s.tenant, username, count-capacity+1); err != nil {
+				return err
+			}
+		}
+		_, err := tx.ExecContext(ctx, "INSERT INTO offline_messages (tenant, username, data) VALUES(?, ?, ?)", s.tenant, username, message.String())
+		if err != nil {
+			return err
+		}
+		inserted = true
+		return nil
+	})
+	if err != nil {
+		return false, err
+	}
+	return inserted, nil
+}
+
+func (s *sqliteStorage) CountOfflineMessages(ctx context.Context, username string) (int, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM offline_messages WHERE tenant = ? AND username = ?", s.tenant, username)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *sqliteStorage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	stmt := `SELECT id, data, received_at FROM offline_messages WHERE tenant = ? AND username = ? ORDER BY id`
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	return scanOfflineMessageEntities(rows)
+}
+
+// FetchOfflineMessage satisfies Storage interface.
+// Message nodes are their row identifiers, which are never reused.
+func (s *sqliteStorage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	id, err := strconv.ParseInt(node, 10, 64)
+	if err != nil {
+		return nil, nil
+	}
+	stmt := `SELECT id, data, received_at FROM offline_messages WHERE tenant = ? AND username = ? AND id = ?`
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, username, id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs, err := scanOfflineMessageEntities(rows)
+	if err != nil || len(msgs) == 0 {
+		return nil, err
+	}
+	return &msgs[0], nil
+}
+
+// DeleteOfflineMessage satisfies Storage interface.
+func (s *sqliteStorage) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	id, err := strconv.ParseInt(node, 10, 64)
+	if err != nil {
+		return false, nil
+	}
+	unlock := s.lockWriter()
+	defer unlock()
+	stmt := `DELETE FROM offline_messages WHERE tenant = ? AND username = ? AND id = ?`
+	res, err := s.conn().ExecContext(ctx, stmt, s.tenant, username, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+func (s *sqliteStorage) DeleteOfflineMessages(ctx context.Context, username string) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM offline_messages WHERE tenant = ? AND username = ?", s.tenant, username)
+	return err
+}
+
+// DeleteExpiredOfflineMessages satisfies Storage interface.
+func (s *sqliteStorage) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	unlock := s.lockWriter()
+	defer unlock()
+	res, err := s.conn().ExecContext(ctx, "DELETE FROM offline_messages WHERE tenant = ? AND received_at <= ?", s.tenant, before.Unix())
+	if err != nil {
+		return 0, err
+	}
+	count, err := res.RowsAffected()
+	if err != nil {
+		return 0, err
+	}
+	return int(count), nil
+}
+
+func (s *sqliteStorage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "INSERT INTO quarantined_messages (tenant, username, data) VALUES(?, ?, ?)", s.tenant, username, message.String())
+	return err
+}
+
+func (s *sqliteStorage) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM quarantined_messages WHERE tenant = ? AND username = ?", s.tenant, username)
+	var count int
+	if err := row.Scan(&count); err != nil {
+		return 0, err
+	}
+	return count, nil
+}
+
+func (s *sqliteStorage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	return s.fetchMessages(ctx, "SELECT data FROM quarantined_messages WHERE tenant = ? AND username = ? ORDER BY rowid", username)
+}
+
+func (s *sqliteStorage) DeleteQuarantinedMessages(ctx context.Context, username string) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM quarantined_messages WHERE tenant = ? AND username = ?", s.tenant, username)
+	return err
+}
+
+// fetchMessages returns username messages selected by stmt in insertion order.
+func (s *sqliteStorage) fetchMessages(ctx context.Context, stmt string, username string) ([]xml.Element, error) {
+	rows, err := s.conn().QueryContext(ctx, stmt, s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	buf := pool.Get()
+	defer pool.Put(buf)
+
+	buf.WriteString("<root>")
+	for rows.Next() {
+		var msg string
+		if err := rows.Scan(&msg); err != nil {
+			return nil, err
+		}
+		buf.WriteString(msg)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	buf.WriteString("</root>")
+
+	parser := xml.NewParser(buf)
+	rootEl, err := parser.ParseElement()
+	if err != nil {
+		return nil, err
+	}
+	return rootEl.Elements(), nil
+}
+
+// InsertArchivedMessage satisfies Storage interface.
+// Message identifiers are their row identifiers, which are never reused.
+func (s *sqliteStorage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	stmt := `INSERT INTO archived_messages (tenant, username, with_jid, with_resource, stamp, data) VALUES(?, ?, ?, ?, ?, ?)`
+
+	unlock := s.lockWriter()
+	defer unlock()
+	res, err := s.conn().ExecContext(ctx, stmt, s.tenant, message.Username, message.With, message.WithResource, message.Stamp.Unix(), message.Message.String())
+	if err != nil {
+		return err
+	}
+	id, err := res.LastInsertId()
+	if err != nil {
+		return err
+	}
+	message.ID = strconv.FormatInt(id, 10)
+	return nil
+}
+
+func (s *sqliteStorage) FetchArchivedMessages(ctx context.Context, username string, filter *ArchiveFilter) ([]model.ArchivedMessage, error) {
+	stmt, args, ok := selectArchivedMessagesStmt(s.tenant, username, filter)
+	if !ok {
+		return nil, nil
+	}
+	rows, err := s.conn().QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	msgs, err := scanArchivedMessageEntities(rows, username)
+	if err != nil {
+		return nil, err
+	}
+	if filter.Last {
+		reverseArchivedMessages(msgs)
+	}
+	return msgs, nil
+}
+
+func (s *sqliteStorage) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	stmt := `` +
+		`INSERT INTO archive_prefs (tenant, username, default_mode)` +
+		` VALUES(?, ?, ?)` +
+		` ON CONFLICT(tenant, username) DO UPDATE SET default_mode = excluded.default_mode, updated_at = strftime('%s', 'now')`
+
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, prefs.Username, prefs.Default)
+	return err
+}
+
+func (s *sqliteStorage) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	row := s.conn().QueryRowContext(ctx, "SELECT username, default_mode FROM archive_prefs WHERE tenant = ? AND username = ?", s.tenant, username)
+	var prefs model.ArchivePrefs
+	err := row.Scan(&prefs.Username, &prefs.Default)
+	switch err {
+	case nil:
+		return &prefs, nil
+	case sql.ErrNoRows:
+		return nil, nil
+	default:
+		return nil, err
+	}
+}
+
+func (s *sqliteStorage) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		for _, item := range items {
+			_, err := tx.ExecContext(ctx, "INSERT OR IGNORE INTO block_list_items (tenant, username, jid) VALUES(?, ?, ?)", s.tenant, item.Username, item.JID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		for _, item := range items {
+			_, err := tx.ExecContext(ctx, "DELETE FROM block_list_items WHERE tenant = ? AND username = ? AND jid = ?", s.tenant, item.Username, item.JID)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT username, jid FROM block_list_items WHERE tenant = ? AND username = ?", s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var blis []model.BlockListItem
+	for rows.Next() {
+		var bli model.BlockListItem
+		if err := rows.Scan(&bli.Username, &bli.JID); err != nil {
+			return nil, err
+		}
+		blis = append(blis, bli)
+	}
+	return blis, rows.Err()
+}
+
+func (s *sqliteStorage) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		stmt := `` +
+			`INSERT INTO privacy_lists (tenant, username, name)` +
+			` VALUES(?, ?, ?)` +
+			` ON CONFLICT(tenant, username, name) DO UPDATE SET updated_at = strftime('%s', 'now')`
+		if _, err := tx.ExecContext(ctx, stmt, s.tenant, list.Username, list.Name); err != nil {
+			return err
+		}
+		_, err := tx.ExecContext(ctx, "DELETE FROM privacy_list_items WHERE tenant = ? AND username = ? AND list_name = ?", s.tenant, list.Username, list.Name)
+		if err != nil {
+			return err
+		}
+		stmt = `` +
+			`INSERT INTO privacy_list_items (tenant, username, list_name, ord, type, value, action, message, iq, presence_in, presence_out)` +
+			` VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`
+		for _, item := range list.Items {
+			_, err := tx.ExecContext(ctx, stmt, s.tenant, list.Username, list.Name, item.Order, item.Type, item.Value, item.Action, item.Message, item.IQ, item.PresenceIn, item.PresenceOut)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func (s *sqliteStorage) DeletePrivacyList(ctx context.Context, username, name string) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, "DELETE FROM privacy_list_items WHERE tenant = ? AND username = ? AND list_name = ?", s.tenant, username, name)
+		if err != nil {
+			return err
+		}
+		_, err = tx.ExecContext(ctx, "DELETE FROM privacy_lists WHERE tenant = ? AND username = ? AND name = ?", s.tenant, username, name)
+		return err
+	})
+}
+
+func (s *sqliteStorage) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT name, is_default FROM privacy_lists WHERE tenant = ? AND username = ? ORDER BY name", s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var pls []model.PrivacyList
+	for rows.Next() {
+		pl := model.PrivacyList{Username: username}
+		if err := rows.Scan(&pl.Name, &pl.Default); err != nil {
+			return nil, err
+		}
+		pls = append(pls, pl)
+	}
+	if err := rows.Err(); err != nil || len(pls) == 0 {
+		return nil, err
+	}
+	stmt := `` +
+		`SELECT list_name, ord, type, value, action, message, iq, presence_in, presence_out` +
+		` FROM privacy_list_items WHERE tenant = ? AND username = ? ORDER BY list_name, ord`
+	itemRows, err := s.conn().QueryContext(ctx, stmt, s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer itemRows.Close()
+
+	if err := scanPrivacyListItemEntities(pls, itemRows); err != nil {
+		return nil, err
+	}
+	return pls, itemRows.Err()
+}
+
+func (s *sqliteStorage) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	stmt := "UPDATE privacy_lists SET is_default = (name = ?), updated_at = strftime('%s', 'now') WHERE tenant = ? AND username = ?"
+
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, name, s.tenant, username)
+	return err
+}
+
+func (s *sqliteStorage) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	stmt := `` +
+		`INSERT INTO feature_flags (tenant, name, username, enabled)` +
+		` VALUES(?, ?, ?, ?)` +
+		` ON CONFLICT(tenant, username, name) DO UPDATE SET enabled = excluded.enabled, updated_at = strftime('%s', 'now')`
+
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, ff.Name, ff.Username, ff.Enabled)
+	return err
+}
+
+func (s *sqliteStorage) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM feature_flags WHERE tenant = ? AND name = ? AND username = ?", s.tenant, name, username)
+	return err
+}
+
+func (s *sqliteStorage) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT name, username, enabled FROM feature_flags WHERE tenant = ? AND username = ?", s.tenant, username)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ffs []model.FeatureFlag
+	for rows.Next() {
+		var ff model.FeatureFlag
+		if err := rows.Scan(&ff.Name, &ff.Username, &ff.Enabled); err != nil {
+			return nil, err
+		}
+		ffs = append(ffs, ff)
+	}
+	return ffs, rows.Err()
+}
+
+func (s *sqliteStorage) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "INSERT INTO invites (tenant, token, created_by, expires_at, used) VALUES(?, ?, ?, ?, ?)",
+		s.tenant, invite.Token, invite.CreatedBy, invite.ExpiresAt.Unix(), invite.Used)
+	return err
+}
+
+func (s *sqliteStorage) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	// single conditional update, so that a token can't be redeemed twice
+	stmt := `` +
+		`UPDATE invites SET used = 1, updated_at = strftime('%s', 'now')` +
+		` WHERE tenant = ? AND token = ? AND used = 0 AND expires_at > ?`
+
+	unlock := s.lockWriter()
+	defer unlock()
+	res, err := s.conn().ExecContext(ctx, stmt, s.tenant, token, now.Unix())
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n == 1, nil
+}
+
+// InsertStreamSession satisfies Storage interface.
+// Sessions are stored in their binary representation.
+func (s *sqliteStorage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	stmt := `` +
+		`INSERT INTO stream_sessions (tenant, server_id, id, data) VALUES(?, ?, ?, ?)` +
+		` ON CONFLICT(tenant, server_id, id) DO UPDATE SET data = excluded.data`
+
+	buf := pool.Get()
+	defer pool.Put(buf)
+	session.ToBytes(buf)
+
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, stmt, s.tenant, session.ServerID, session.ID, buf.Bytes())
+	return err
+}
+
+func (s *sqliteStorage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	rows, err := s.conn().QueryContext(ctx, "SELECT data FROM stream_sessions WHERE tenant = ? AND server_id = ?", s.tenant, serverID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var sessions []model.StreamSession
+	for rows.Next() {
+		var data []byte
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		var session model.StreamSession
+		session.FromBytes(bytes.NewReader(data))
+		sessions = append(sessions, session)
+	}
+	return sessions, rows.Err()
+}
+
+func (s *sqliteStorage) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	unlock := s.lockWriter()
+	defer unlock()
+	_, err := s.conn().ExecContext(ctx, "DELETE FROM stream_sessions WHERE tenant = ? AND server_id = ?", s.tenant, serverID)
+	return err
+}
+
+func (s *sqliteStorage) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	// table sizes are only available whenever SQLite
+	// has been built along with dbstat virtual table
+	sizes := make(map[string]int64)
+	if rows, err := s.conn().QueryContext(ctx, "SELECT name, SUM(pgsize) FROM dbstat GROUP BY name"); err == nil {
+		for rows.Next() {
+			var name string
+			var size int64
+			if err := rows.Scan(&name, &size); err == nil {
+				sizes[name] = size
+			}
+		}
+		rows.Close()
+	}
+	var usage []model.EntityUsage
+	for _, table := range sqliteTables {
+		u := model.EntityUsage{Entity: table, Bytes: sizes[table]}
+		if err := s.conn().QueryRowContext(ctx, "SELECT COUNT(*) FROM "+table).Scan(&u.Rows); err != nil {
+			return nil, err
+		}
+		usage = append(usage, u)
+	}
+	return usage, nil
+}
+
+// InTransaction satisfies Storage interface.
+func (s *sqliteStorage) InTransaction(ctx context.Context, f func(tx Storage) error) error {
+	return s.inTransaction(ctx, func(tx *sql.Tx) error {
+		return f(&sqliteStorage{db: s.db, tx: tx, tenant: s.tenant})
+	})
+}
+
+// conn returns the transaction bound to s, if any,
+// or the database connection pool otherwise.
+func (s *sqliteStorage) conn() sqlConn {
+	if s.tx != nil {
+		return s.tx
+	}
+	return s.db
+}
+
+// lockWriter acquires the writer lock, returning the function releasing it.
+// Handles bound to a transaction already hold it.
+func (s *sqliteStorage) lockWriter() func() {
+	if s.tx != nil {
+		return func() {}
+	}
+	s.writeMu.Lock()
+	return s.writeMu.Unlock
+}
+
+// inTransaction runs f within a transaction, holding the writer lock,
+// or joining the transaction bound to s, if any.
+func (s *sqliteStorage) inTransaction(ctx context.Context, f func(tx *sql.Tx) error) error {
+	if s.tx != nil {
+		return f(s.tx)
+	}
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	if err := f(tx); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
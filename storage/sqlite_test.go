@@ -0,0 +1,226 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/pborman/uuid"
+	"github.com/stretchr/testify/require"
+)
+
+type testSQLiteHelper struct {
+	db  *sqliteStorage
+	dir string
+}
+
+func TestSQLite_User(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilSQLiteSetup()
+	defer tUtilSQLiteTeardown(h)
+
+	usr := model.User{Username: "ortuman", Password: "1234", Email: "ortuman@jackal.im"}
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &usr))
+
+	usr2, err := h.db.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, "ortuman", usr2.Username)
+	require.Equal(t, "1234", usr2.Password)
+	require.Equal(t, "ortuman@jackal.im", usr2.Email)
+
+	usr.Password = "5678"
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &usr))
+	usr2, _ = h.db.FetchUser(context.Background(), "ortuman")
+	require.Equal(t, "5678", usr2.Password)
+
+	cnt, err := h.db.CountUsers(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 1, cnt)
+
+	usr.PurgeAt = time.Now().Add(-time.Minute)
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &usr))
+	usernames, err := h.db.FetchPurgeableUsers(context.Background(), time.Now())
+	require.Nil(t, err)
+	require.Equal(t, []string{"ortuman"}, usernames)
+
+	require.Nil(t, h.db.DeleteUser(context.Background(), "ortuman"))
+	exists, err := h.db.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.False(t, exists)
+
+	usr2, err = h.db.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Nil(t, usr2)
+}
+
+func TestSQLite_RosterItems(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilSQLiteSetup()
+	defer tUtilSQLiteTeardown(h)
+
+	ri1 := &model.RosterItem{User: "ortuman", Contact: "romeo", Subscription: "both", Groups: []string{"friends"}}
+	ri2 := &model.RosterItem{User: "ortuman", Contact: "juliet", Subscription: "to", Groups: []string{"friends", "family"}, Ask: true}
+	require.Nil(t, h.db.InsertOrUpdateRosterItem(context.Background(), ri1))
+	require.Nil(t, h.db.InsertOrUpdateRosterItem(context.Background(), ri2))
+
+	// insertion order
+	ris, err := h.db.FetchRosterItems(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, []model.RosterItem{*ri1, *ri2}, ris)
+
+	ri1.Name = "Romeo"
+	require.Nil(t, h.db.InsertOrUpdateRosterItem(context.Background(), ri1))
+	ri3, err := h.db.FetchRosterItem(context.Background(), "ortuman", "romeo")
+	require.Nil(t, err)
+	require.Equal(t, ri1, ri3)
+	require.Equal(t, 3, ri3.Ver)
+
+	require.Nil(t, h.db.DeleteRosterItem(context.Background(), "ortuman", "juliet"))
+	rts, err := h.db.FetchRosterTombstones(context.Background(), "ortuman", 0)
+	require.Nil(t, err)
+	require.Equal(t, 1, len(rts))
+	require.Equal(t, "juliet", rts[0].Contact)
+	require.Equal(t, 4, rts[0].Ver)
+}
+
+func TestSQLite_OfflineMessages(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilSQLiteSetup()
+	defer tUtilSQLiteTeardown(h)
+
+	for i := 0; i < 5; i++ {
+		msg := xml.NewMessageType(fmt.Sprintf("msg%d", i), xml.NormalType)
+		require.Nil(t, h.db.InsertOfflineMessage(context.Background(), msg, "ortuman"))
+	}
+	cnt, err := h.db.CountOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 5, cnt)
+
+	// insertion order
+	msgs, err := h.db.FetchOfflineMessages(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 5, len(msgs))
+	for i, msg := range msgs {
+		require.Equal(t, fmt.Sprintf("msg%d", i), msg.Message.ID())
+	}
+	require.Nil(t, h.db.DeleteOfflineMessages(context.Background(), "ortuman"))
+	cnt, _ = h.db.CountOfflineMessages(context.Background(), "ortuman")
+	require.Equal(t, 0, cnt)
+}
+
+func TestSQLite_ConcurrentWrites(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilSQLiteSetup()
+	defer tUtilSQLiteTeardown(h)
+
+	// writes from every goroutine succeed, none failing with SQLITE_BUSY
+	var wg sync.WaitGroup
+	errCh := make(chan error, 200)
+	for i := 0; i < 100; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			username := fmt.Sprintf("user%d", i)
+			errCh <- h.db.InsertOrUpdateUser(context.Background(), &model.User{Username: username, Password: "1234"})
+			errCh <- h.db.InsertOrUpdateRosterItem(context.Background(), &model.RosterItem{User: "ortuman", Contact: username, Subscription: "both"})
+		}(i)
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		require.Nil(t, err)
+	}
+	cnt, err := h.db.CountUsers(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, 100, cnt)
+
+	rv, err := h.db.FetchRosterVersion(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.Equal(t, 100, rv.Ver)
+}
+
+func TestSQLite_Reopen(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilSQLiteSetup()
+	defer tUtilSQLiteTeardown(h)
+
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+	h.db.Shutdown()
+
+	// schema creation is skipped on existing databases
+	var err error
+	h.db, err = openSQLiteStorage(filepath.Join(h.dir, "jackal.db"), "")
+	require.Nil(t, err)
+	exists, err := h.db.UserExists(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.True(t, exists)
+}
+
+func TestSQLite_Usage(t *testing.T) {
+	t.Parallel()
+
+	h := tUtilSQLiteSetup()
+	defer tUtilSQLiteTeardown(h)
+
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+	require.Nil(t, h.db.InsertOrUpdateUser(context.Background(), &model.User{Username: "juliet", Password: "1234"}))
+
+	usage, err := h.db.Usage(context.Background())
+	require.Nil(t, err)
+	require.Equal(t, len(sqliteTables), len(usage))
+	for _, u := range usage {
+		if u.Entity == "users" {
+			require.Equal(t, int64(2), u.Rows)
+		}
+	}
+}
+
+func TestSQLite_MockedStorage(t *testing.T) {
+	s := newSQLiteMockStorage()
+	defer s.Shutdown()
+
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+
+	s.activateMockedError()
+	_, err := s.FetchUser(context.Background(), "ortuman")
+	require.Equal(t, ErrMockedError, err)
+
+	s.deactivateMockedError()
+	usr, err := s.FetchUser(context.Background(), "ortuman")
+	require.Nil(t, err)
+	require.NotNil(t, usr)
+}
+
+func tUtilSQLiteSetup() *testSQLiteHelper {
+	dir, err := ioutil.TempDir("", "com.jackal.tests.sqlite."+uuid.New())
+	if err != nil {
+		panic(err)
+	}
+	db, err := openSQLiteStorage(filepath.Join(dir, "jackal.db"), "")
+	if err != nil {
+		panic(err)
+	}
+	return &testSQLiteHelper{db: db, dir: dir}
+}
+
+func tUtilSQLiteTeardown(h *testSQLiteHelper) {
+	h.db.Shutdown()
+	os.RemoveAll(h.dir)
+}
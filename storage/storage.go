@@ -6,13 +6,18 @@
 package storage
 
 import (
+	"context"
 	"errors"
+	"reflect"
+	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ortuman/jackal/bufferpool"
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/storage/model"
 	"github.com/ortuman/jackal/xml"
 )
@@ -22,40 +27,176 @@ var pool = bufferpool.New()
 // ErrMockedError represents a storage mocked error value.
 var ErrMockedError = errors.New("storage mocked error")
 
+// ErrConflict is returned by InTransaction whenever the transaction
+// has been aborted in favor of a conflicting concurrent one.
+var ErrConflict = errors.New("storage: conflicting transaction")
+
 // Storage represents an entity storage interface.
 type Storage interface {
 	Shutdown()
 
-	InsertOrUpdateUser(user *model.User) error
-	DeleteUser(username string) error
-	FetchUser(username string) (*model.User, error)
-	UserExists(username string) (bool, error)
+	InsertOrUpdateUser(ctx context.Context, user *model.User) error
+	DeleteUser(ctx context.Context, username string) error
+	FetchUser(ctx context.Context, username string) (*model.User, error)
+	UserExists(ctx context.Context, username string) (bool, error)
+	CountUsers(ctx context.Context) (int, error)
+	FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error)
+
+	InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error
+	DeleteRosterItem(ctx context.Context, user, contact string) error
+	FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error)
+	FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error)
+	FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error)
+	FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error)
+	FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error)
+	PruneRosterTombstones(ctx context.Context, before time.Time) (int, error)
+
+	InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error
+	DeleteRosterNotification(ctx context.Context, user, contact string) error
+	FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error)
+
+	InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error
+	FetchVCard(ctx context.Context, username string) (xml.Element, error)
+
+	FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error)
+	InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error
+
+	InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error
+	InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error
+
+	// InsertCappedOfflineMessage inserts message into user's offline queue unless
+	// it already holds capacity messages, in which case the oldest ones get dropped
+	// to make room whenever dropOldest is set. It reports whether message got inserted.
+	// Counting and insertion take place atomically regarding concurrent calls.
+	// capacity must be greater than zero.
+	InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error)
+
+	CountOfflineMessages(ctx context.Context, username string) (int, error)
+
+	// FetchOfflineMessages returns user's offline queue, oldest message first.
+	FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error)
+	DeleteOfflineMessages(ctx context.Context, username string) error
+
+	// FetchOfflineMessage returns the message identified by node within
+	// user's offline queue, or nil if there's no such message.
+	FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error)
+
+	// DeleteOfflineMessage deletes the message identified by node from
+	// user's offline queue, reporting whether it was there.
+	DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error)
+
+	// DeleteExpiredOfflineMessages deletes every offline message received
+	// no later than before, returning the number of deleted messages.
+	DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error)
 
-	InsertOrUpdateRosterItem(ri *model.RosterItem) error
-	DeleteRosterItem(user, contact string) error
-	FetchRosterItems(user string) ([]model.RosterItem, error)
-	FetchRosterItem(user, contact string) (*model.RosterItem, error)
+	InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error
+	CountQuarantinedMessages(ctx context.Context, username string) (int, error)
+	FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error)
+	DeleteQuarantinedMessages(ctx context.Context, username string) error
 
-	InsertOrUpdateRosterNotification(rn *model.RosterNotification) error
-	DeleteRosterNotification(user, contact string) error
-	FetchRosterNotifications(contact string) ([]model.RosterNotification, error)
+	// InsertArchivedMessage appends message to its owner's archive,
+	// setting its identifier.
+	InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error
 
-	InsertOrUpdateVCard(vCard xml.Element, username string) error
-	FetchVCard(username string) (xml.Element, error)
+	// FetchArchivedMessages returns the messages of user's archive
+	// matching filter, oldest first.
+	FetchArchivedMessages(ctx context.Context, username string, filter *ArchiveFilter) ([]model.ArchivedMessage, error)
 
-	FetchPrivateXML(namespace string, username string) ([]xml.Element, error)
-	InsertOrUpdatePrivateXML(privateXML []xml.Element, namespace string, username string) error
+	InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error
+	FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error)
 
-	InsertOfflineMessage(message xml.Element, username string) error
-	CountOfflineMessages(username string) (int, error)
-	FetchOfflineMessages(username string) ([]xml.Element, error)
-	DeleteOfflineMessages(username string) error
+	// InsertBlockListItems adds items to their owners block lists,
+	// ignoring those already blocked.
+	InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error
+	DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error
+	FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error)
+
+	// InsertOrUpdatePrivacyList stores list, replacing the items of any
+	// previously stored list with the same name. List default flag is ignored,
+	// as the default list is only changed by means of SetDefaultPrivacyList.
+	InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error
+
+	// DeletePrivacyList deletes user's name list, leaving user
+	// with no default list whenever it was the default one.
+	DeletePrivacyList(ctx context.Context, username, name string) error
+
+	// FetchPrivacyLists returns every user's privacy list sorted by name,
+	// their items sorted by order.
+	FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error)
+
+	// SetDefaultPrivacyList sets user's default privacy list, replacing
+	// the previous one. An empty name leaves user with no default list.
+	SetDefaultPrivacyList(ctx context.Context, username, name string) error
+
+	InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error
+	DeleteFeatureFlag(ctx context.Context, name, username string) error
+	FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error)
+
+	InsertInvite(ctx context.Context, invite *model.Invite) error
+	RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error)
+
+	// InsertStreamSession stores a resumable stream management session
+	// persisted on graceful shutdown, replacing any with the same identifier.
+	InsertStreamSession(ctx context.Context, session *model.StreamSession) error
+
+	// FetchStreamSessions returns every stream session persisted
+	// by the server configuration identified by serverID.
+	FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error)
+	DeleteStreamSessions(ctx context.Context, serverID string) error
+
+	Usage(ctx context.Context) ([]model.EntityUsage, error)
+
+	// InTransaction runs f against a storage handle whose operations
+	// are committed as a whole whenever f returns no error, and rolled
+	// back otherwise. Nested calls join the enclosing transaction.
+	// f must not use any other handle, as it might block on tx.
+	// ErrConflict is returned whenever a concurrent transaction wins.
+	InTransaction(ctx context.Context, f func(tx Storage) error) error
 }
 
+// ArchiveFilter represents a message archive lookup.
+// Zero valued fields don't filter anything.
+type ArchiveFilter struct {
+	// With matches messages exchanged with a bare JID, or with
+	// a full JID whenever WithResource is also set.
+	With         string
+	WithResource string
+
+	// Start and End bound message archiving times, inclusively.
+	Start time.Time
+	End   time.Time
+
+	// AfterID and BeforeID bound message identifiers, exclusively.
+	// Messages are looked up by insertion order, and no message
+	// matches a malformed identifier.
+	AfterID  string
+	BeforeID string
+
+	// Max limits the number of returned messages, which are taken
+	// from the end of the matching ones whenever Last is set.
+	Max  int
+	Last bool
+}
+
+// sortedPrivacyListItems returns a copy of items sorted by order.
+func sortedPrivacyListItems(items []model.PrivacyListItem) []model.PrivacyListItem {
+	ret := append([]model.PrivacyListItem(nil), items...)
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Order < ret[j].Order })
+	return ret
+}
+
+// defaultQueryTimeout bounds storage operations whenever
+// no query timeout has been configured.
+const defaultQueryTimeout = 10 * time.Second
+
 var (
-	inst        Storage
-	instMu      sync.RWMutex
-	initialized uint32
+	inst         Storage
+	instMu       sync.RWMutex
+	initialized  uint32
+	loopsDoneCh  chan struct{}
+	queryTimeout = int64(defaultQueryTimeout)
+
+	offlineMessageTTL int64
 )
 
 // Initialize initializes storage sub system.
@@ -66,18 +207,66 @@ func Initialize(storageConfig *config.Storage) {
 
 		switch storageConfig.Type {
 		case config.BadgerDB:
-			inst = newBadgerDB(storageConfig.BadgerDB)
+			inst = newBadgerDB(storageConfig.BadgerDB, storageConfig.Tenant)
 		case config.MySQL:
-			inst = newMySQLStorage(storageConfig.MySQL)
+			inst = newMySQLStorage(storageConfig.MySQL, storageConfig.Tenant)
+		case config.SQLite:
+			inst = newSQLiteStorage(storageConfig.SQLite, storageConfig.Tenant)
+		case config.Redis:
+			inst = newRedisStorage(storageConfig.Redis, storageConfig.Tenant)
 		case config.Mock:
-			inst = newMockStorage()
+			inst = newMockStorageFromEnv()
 		default:
 			// should not be reached
 			break
 		}
+		timeout := defaultQueryTimeout
+		if storageConfig.QueryTimeout > 0 {
+			timeout = time.Duration(storageConfig.QueryTimeout) * time.Second
+		}
+		atomic.StoreInt64(&queryTimeout, int64(timeout))
+		atomic.StoreInt64(&offlineMessageTTL, int64(time.Duration(storageConfig.OfflineMessageTTL)*time.Second))
+
+		stats.Default().RegisterGauge("users/registered", "users", registeredUsers)
+
+		loopsDoneCh = make(chan struct{})
+		tombstoneRetention := time.Duration(storageConfig.RosterTombstoneRetention) * time.Second
+		go purgeLoop(inst, tombstoneRetention, loopsDoneCh)
+		if storageConfig.Usage.Interval > 0 {
+			interval := time.Duration(storageConfig.Usage.Interval) * time.Second
+			us := newUsageSampler(stats.Default(), storageConfig.Usage.GrowthThreshold)
+			go usageLoop(inst, us, interval, loopsDoneCh)
+		}
 	}
 }
 
+// registeredUsers returns the number of accounts stored
+// in the current storage sub system.
+func registeredUsers() (int64, error) {
+	ctx, cancel := QueryContext()
+	defer cancel()
+
+	instMu.RLock()
+	defer instMu.RUnlock()
+	if inst == nil {
+		return 0, nil
+	}
+	count, err := inst.CountUsers(ctx)
+	return int64(count), err
+}
+
+// QueryContext returns a context bounded by the configured query timeout,
+// so that a stalled storage can't block its caller indefinitely.
+func QueryContext() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(context.Background(), time.Duration(atomic.LoadInt64(&queryTimeout)))
+}
+
+// OfflineMessageTTL returns the time offline messages are kept
+// before being discarded undelivered. Zero value means forever.
+func OfflineMessageTTL() time.Duration {
+	return time.Duration(atomic.LoadInt64(&offlineMessageTTL))
+}
+
 // Instance returns global storage sub system.
 func Instance() Storage {
 	instMu.RLock()
@@ -89,18 +278,39 @@ func Instance() Storage {
 	return inst
 }
 
+// Decorate replaces global storage instance with the one
+// returned by fn, which is expected to wrap the current one.
+func Decorate(fn func(Storage) Storage) {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	if inst != nil {
+		inst = fn(inst)
+	}
+}
+
 // Shutdown shuts down storage sub system.
-// This method should be used only for testing purposes.
 func Shutdown() {
 	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
 		instMu.Lock()
 		defer instMu.Unlock()
 
+		close(loopsDoneCh)
 		inst.Shutdown()
 		inst = nil
 	}
 }
 
+// mockable is implemented by mocked storages.
+type mockable interface {
+	activateMockedError()
+	activateMockedErrorFor(op string, n int)
+	deactivateMockedError()
+	setMockedLatency(latency time.Duration)
+	mockedCalls(op string) int
+	resetMockedCalls()
+}
+
 // ActivateMockedError forces the return of ErrMockedError from current storage manager.
 // This method should only be used for testing purposes.
 func ActivateMockedError() {
@@ -108,19 +318,89 @@ func ActivateMockedError() {
 	defer instMu.Unlock()
 
 	switch inst := inst.(type) {
-	case *mockStorage:
+	case mockable:
 		inst.activateMockedError()
 	}
 }
 
-// DeactivateMockedError disables mocked storage error from a previous activation.
+// ActivateMockedErrorFor forces the return of ErrMockedError from every call
+// to op, as named in Storage interface, made to current storage manager.
+// This method should only be used for testing purposes.
+func ActivateMockedErrorFor(op string) {
+	activateMockedErrorFor(op, -1)
+}
+
+// ActivateMockedErrorForNext forces the return of ErrMockedError from
+// the next n calls to op, as named in Storage interface, made to current
+// storage manager.
+// This method should only be used for testing purposes.
+func ActivateMockedErrorForNext(op string, n int) {
+	if n > 0 {
+		activateMockedErrorFor(op, n)
+	}
+}
+
+func activateMockedErrorFor(op string, n int) {
+	if _, ok := reflect.TypeOf((*Storage)(nil)).Elem().MethodByName(op); !ok {
+		log.Fatalf("storage: unknown mocked operation: %s", op)
+	}
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	switch inst := inst.(type) {
+	case mockable:
+		inst.activateMockedErrorFor(op, n)
+	}
+}
+
+// DeactivateMockedError disables mocked storage error from a previous activation,
+// including the ones armed for specific operations.
 // This method should only be used for testing purposes.
 func DeactivateMockedError() {
 	instMu.Lock()
 	defer instMu.Unlock()
 
 	switch inst := inst.(type) {
-	case *mockStorage:
+	case mockable:
 		inst.deactivateMockedError()
 	}
 }
+
+// SetMockedLatency delays every call to the mocked storage by the given duration.
+// This method should only be used for testing purposes.
+func SetMockedLatency(latency time.Duration) {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	switch inst := inst.(type) {
+	case mockable:
+		inst.setMockedLatency(latency)
+	}
+}
+
+// MockedCalls returns the number of calls to op, as named in Storage
+// interface, made to current storage manager since its initialization
+// or the last ResetMockedCalls call.
+// This method should only be used for testing purposes.
+func MockedCalls(op string) int {
+	instMu.RLock()
+	defer instMu.RUnlock()
+
+	switch inst := inst.(type) {
+	case mockable:
+		return inst.mockedCalls(op)
+	}
+	return 0
+}
+
+// ResetMockedCalls resets the number of calls accounted by MockedCalls.
+// This method should only be used for testing purposes.
+func ResetMockedCalls() {
+	instMu.Lock()
+	defer instMu.Unlock()
+
+	switch inst := inst.(type) {
+	case mockable:
+		inst.resetMockedCalls()
+	}
+}
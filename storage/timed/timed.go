@@ -0,0 +1,396 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package timed implements a storage decorator accounting every
+// operation calls and latency into server statistics.
+package timed
+
+import (
+	"context"
+	"time"
+
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+)
+
+// Storage represents a latency accounting storage decorator.
+type Storage struct {
+	storage.Storage
+	reg *stats.Registry
+}
+
+// New returns a decorator wrapping s, accounting operations into reg.
+func New(s storage.Storage, reg *stats.Registry) *Storage {
+	return &Storage{Storage: s, reg: reg}
+}
+
+// observe accounts an op call started at start, both
+// as number of calls and accumulated latency.
+func (s *Storage) observe(op string, start time.Time) {
+	s.reg.Counter("storage/calls/"+op, "calls").Inc()
+	s.reg.Counter("storage/latency/"+op, "microseconds").Add(int64(time.Since(start) / time.Microsecond))
+}
+
+// InsertOrUpdateUser inserts a new user entity into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateUser(ctx context.Context, user *model.User) error {
+	defer s.observe("InsertOrUpdateUser", time.Now())
+	return s.Storage.InsertOrUpdateUser(ctx, user)
+}
+
+// DeleteUser deletes a user entity from storage.
+func (s *Storage) DeleteUser(ctx context.Context, username string) error {
+	defer s.observe("DeleteUser", time.Now())
+	return s.Storage.DeleteUser(ctx, username)
+}
+
+// FetchUser retrieves from storage a user entity.
+func (s *Storage) FetchUser(ctx context.Context, username string) (*model.User, error) {
+	defer s.observe("FetchUser", time.Now())
+	return s.Storage.FetchUser(ctx, username)
+}
+
+// UserExists returns whether or not a user exists within storage.
+func (s *Storage) UserExists(ctx context.Context, username string) (bool, error) {
+	defer s.observe("UserExists", time.Now())
+	return s.Storage.UserExists(ctx, username)
+}
+
+// CountUsers returns the number of registered users.
+func (s *Storage) CountUsers(ctx context.Context) (int, error) {
+	defer s.observe("CountUsers", time.Now())
+	return s.Storage.CountUsers(ctx)
+}
+
+// FetchPurgeableUsers returns the usernames of every deleted
+// account whose grace period expired before a given time.
+func (s *Storage) FetchPurgeableUsers(ctx context.Context, before time.Time) ([]string, error) {
+	defer s.observe("FetchPurgeableUsers", time.Now())
+	return s.Storage.FetchPurgeableUsers(ctx, before)
+}
+
+// InsertOrUpdateRosterItem inserts a new roster item entity into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateRosterItem(ctx context.Context, ri *model.RosterItem) error {
+	defer s.observe("InsertOrUpdateRosterItem", time.Now())
+	return s.Storage.InsertOrUpdateRosterItem(ctx, ri)
+}
+
+// DeleteRosterItem deletes a roster item entity from storage.
+func (s *Storage) DeleteRosterItem(ctx context.Context, user, contact string) error {
+	defer s.observe("DeleteRosterItem", time.Now())
+	return s.Storage.DeleteRosterItem(ctx, user, contact)
+}
+
+// FetchRosterItems retrieves from storage all roster item entities
+// associated to a given user.
+func (s *Storage) FetchRosterItems(ctx context.Context, user string) ([]model.RosterItem, error) {
+	defer s.observe("FetchRosterItems", time.Now())
+	return s.Storage.FetchRosterItems(ctx, user)
+}
+
+// FetchRosterItemsOfUsers retrieves from storage all roster
+// item entities associated to every given user.
+func (s *Storage) FetchRosterItemsOfUsers(ctx context.Context, users []string) (map[string][]model.RosterItem, error) {
+	defer s.observe("FetchRosterItemsOfUsers", time.Now())
+	return s.Storage.FetchRosterItemsOfUsers(ctx, users)
+}
+
+// FetchRosterItem retrieves from storage a roster item entity.
+func (s *Storage) FetchRosterItem(ctx context.Context, user, contact string) (*model.RosterItem, error) {
+	defer s.observe("FetchRosterItem", time.Now())
+	return s.Storage.FetchRosterItem(ctx, user, contact)
+}
+
+// FetchRosterVersion retrieves from storage current user roster version.
+func (s *Storage) FetchRosterVersion(ctx context.Context, user string) (model.RosterVersion, error) {
+	defer s.observe("FetchRosterVersion", time.Now())
+	return s.Storage.FetchRosterVersion(ctx, user)
+}
+
+// FetchRosterTombstones retrieves from storage every user roster
+// item deleted after afterVer version.
+func (s *Storage) FetchRosterTombstones(ctx context.Context, user string, afterVer int) ([]model.RosterTombstone, error) {
+	defer s.observe("FetchRosterTombstones", time.Now())
+	return s.Storage.FetchRosterTombstones(ctx, user, afterVer)
+}
+
+// PruneRosterTombstones deletes from storage every roster item
+// tombstone created before a given time.
+func (s *Storage) PruneRosterTombstones(ctx context.Context, before time.Time) (int, error) {
+	defer s.observe("PruneRosterTombstones", time.Now())
+	return s.Storage.PruneRosterTombstones(ctx, before)
+}
+
+// InsertOrUpdateRosterNotification inserts a new roster notification entity
+// into storage, or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateRosterNotification(ctx context.Context, rn *model.RosterNotification) error {
+	defer s.observe("InsertOrUpdateRosterNotification", time.Now())
+	return s.Storage.InsertOrUpdateRosterNotification(ctx, rn)
+}
+
+// DeleteRosterNotification deletes a roster notification entity from storage.
+func (s *Storage) DeleteRosterNotification(ctx context.Context, user, contact string) error {
+	defer s.observe("DeleteRosterNotification", time.Now())
+	return s.Storage.DeleteRosterNotification(ctx, user, contact)
+}
+
+// FetchRosterNotifications retrieves from storage all roster notifications
+// associated to a given user.
+func (s *Storage) FetchRosterNotifications(ctx context.Context, contact string) ([]model.RosterNotification, error) {
+	defer s.observe("FetchRosterNotifications", time.Now())
+	return s.Storage.FetchRosterNotifications(ctx, contact)
+}
+
+// InsertOrUpdateVCard inserts a new vCard element into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateVCard(ctx context.Context, vCard xml.Element, username string) error {
+	defer s.observe("InsertOrUpdateVCard", time.Now())
+	return s.Storage.InsertOrUpdateVCard(ctx, vCard, username)
+}
+
+// FetchVCard retrieves from storage a vCard element associated
+// to a given user.
+func (s *Storage) FetchVCard(ctx context.Context, username string) (xml.Element, error) {
+	defer s.observe("FetchVCard", time.Now())
+	return s.Storage.FetchVCard(ctx, username)
+}
+
+// FetchPrivateXML retrieves from storage a private element.
+func (s *Storage) FetchPrivateXML(ctx context.Context, namespace string, username string) ([]xml.Element, error) {
+	defer s.observe("FetchPrivateXML", time.Now())
+	return s.Storage.FetchPrivateXML(ctx, namespace, username)
+}
+
+// InsertOrUpdatePrivateXML inserts a new private element into storage,
+// or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdatePrivateXML(ctx context.Context, privateXML []xml.Element, namespace string, username string) error {
+	defer s.observe("InsertOrUpdatePrivateXML", time.Now())
+	return s.Storage.InsertOrUpdatePrivateXML(ctx, privateXML, namespace, username)
+}
+
+// InsertOfflineMessage inserts a new message element into
+// user's offline queue.
+func (s *Storage) InsertOfflineMessage(ctx context.Context, message xml.Element, username string) error {
+	defer s.observe("InsertOfflineMessage", time.Now())
+	return s.Storage.InsertOfflineMessage(ctx, message, username)
+}
+
+// InsertOfflineMessages inserts several message elements
+// into user's offline queue.
+func (s *Storage) InsertOfflineMessages(ctx context.Context, messages []xml.Element, username string) error {
+	defer s.observe("InsertOfflineMessages", time.Now())
+	return s.Storage.InsertOfflineMessages(ctx, messages, username)
+}
+
+// InsertCappedOfflineMessage inserts a new message element into user's
+// offline queue, as long as it doesn't exceed a given capacity.
+func (s *Storage) InsertCappedOfflineMessage(ctx context.Context, message xml.Element, username string, capacity int, dropOldest bool) (bool, error) {
+	defer s.observe("InsertCappedOfflineMessage", time.Now())
+	return s.Storage.InsertCappedOfflineMessage(ctx, message, username, capacity, dropOldest)
+}
+
+// CountOfflineMessages returns current length of user's offline queue.
+func (s *Storage) CountOfflineMessages(ctx context.Context, username string) (int, error) {
+	defer s.observe("CountOfflineMessages", time.Now())
+	return s.Storage.CountOfflineMessages(ctx, username)
+}
+
+// FetchOfflineMessages retrieves from storage current user offline queue.
+func (s *Storage) FetchOfflineMessages(ctx context.Context, username string) ([]model.OfflineMessage, error) {
+	defer s.observe("FetchOfflineMessages", time.Now())
+	return s.Storage.FetchOfflineMessages(ctx, username)
+}
+
+// DeleteOfflineMessages clears a user offline queue.
+func (s *Storage) DeleteOfflineMessages(ctx context.Context, username string) error {
+	defer s.observe("DeleteOfflineMessages", time.Now())
+	return s.Storage.DeleteOfflineMessages(ctx, username)
+}
+
+// FetchOfflineMessage retrieves from storage a single message
+// of user's offline queue.
+func (s *Storage) FetchOfflineMessage(ctx context.Context, username, node string) (*model.OfflineMessage, error) {
+	defer s.observe("FetchOfflineMessage", time.Now())
+	return s.Storage.FetchOfflineMessage(ctx, username, node)
+}
+
+// DeleteOfflineMessage deletes a single message from user's offline queue.
+func (s *Storage) DeleteOfflineMessage(ctx context.Context, username, node string) (bool, error) {
+	defer s.observe("DeleteOfflineMessage", time.Now())
+	return s.Storage.DeleteOfflineMessage(ctx, username, node)
+}
+
+// DeleteExpiredOfflineMessages deletes every offline message
+// received no later than a given time.
+func (s *Storage) DeleteExpiredOfflineMessages(ctx context.Context, before time.Time) (int, error) {
+	defer s.observe("DeleteExpiredOfflineMessages", time.Now())
+	return s.Storage.DeleteExpiredOfflineMessages(ctx, before)
+}
+
+// InsertQuarantinedMessage inserts a new message element into
+// user's quarantine queue.
+func (s *Storage) InsertQuarantinedMessage(ctx context.Context, message xml.Element, username string) error {
+	defer s.observe("InsertQuarantinedMessage", time.Now())
+	return s.Storage.InsertQuarantinedMessage(ctx, message, username)
+}
+
+// CountQuarantinedMessages returns current length of user's quarantine queue.
+func (s *Storage) CountQuarantinedMessages(ctx context.Context, username string) (int, error) {
+	defer s.observe("CountQuarantinedMessages", time.Now())
+	return s.Storage.CountQuarantinedMessages(ctx, username)
+}
+
+// FetchQuarantinedMessages retrieves from storage current user quarantine queue.
+func (s *Storage) FetchQuarantinedMessages(ctx context.Context, username string) ([]xml.Element, error) {
+	defer s.observe("FetchQuarantinedMessages", time.Now())
+	return s.Storage.FetchQuarantinedMessages(ctx, username)
+}
+
+// DeleteQuarantinedMessages clears a user quarantine queue.
+func (s *Storage) DeleteQuarantinedMessages(ctx context.Context, username string) error {
+	defer s.observe("DeleteQuarantinedMessages", time.Now())
+	return s.Storage.DeleteQuarantinedMessages(ctx, username)
+}
+
+// InsertArchivedMessage inserts a new message into user's archive.
+func (s *Storage) InsertArchivedMessage(ctx context.Context, message *model.ArchivedMessage) error {
+	defer s.observe("InsertArchivedMessage", time.Now())
+	return s.Storage.InsertArchivedMessage(ctx, message)
+}
+
+// FetchArchivedMessages retrieves from storage the messages
+// of user's archive matching a filter.
+func (s *Storage) FetchArchivedMessages(ctx context.Context, username string, filter *storage.ArchiveFilter) ([]model.ArchivedMessage, error) {
+	defer s.observe("FetchArchivedMessages", time.Now())
+	return s.Storage.FetchArchivedMessages(ctx, username, filter)
+}
+
+// InsertOrUpdateArchivePrefs inserts a new user archiving
+// preferences entity into storage, or updates it in case it's been
+// previously inserted.
+func (s *Storage) InsertOrUpdateArchivePrefs(ctx context.Context, prefs *model.ArchivePrefs) error {
+	defer s.observe("InsertOrUpdateArchivePrefs", time.Now())
+	return s.Storage.InsertOrUpdateArchivePrefs(ctx, prefs)
+}
+
+// FetchArchivePrefs retrieves from storage user archiving preferences.
+func (s *Storage) FetchArchivePrefs(ctx context.Context, username string) (*model.ArchivePrefs, error) {
+	defer s.observe("FetchArchivePrefs", time.Now())
+	return s.Storage.FetchArchivePrefs(ctx, username)
+}
+
+// InsertBlockListItems inserts a set of items into their owners block lists.
+func (s *Storage) InsertBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	defer s.observe("InsertBlockListItems", time.Now())
+	return s.Storage.InsertBlockListItems(ctx, items)
+}
+
+// DeleteBlockListItems deletes a set of items from their owners block lists.
+func (s *Storage) DeleteBlockListItems(ctx context.Context, items []model.BlockListItem) error {
+	defer s.observe("DeleteBlockListItems", time.Now())
+	return s.Storage.DeleteBlockListItems(ctx, items)
+}
+
+// FetchBlockListItems retrieves from storage every item of user's block list.
+func (s *Storage) FetchBlockListItems(ctx context.Context, username string) ([]model.BlockListItem, error) {
+	defer s.observe("FetchBlockListItems", time.Now())
+	return s.Storage.FetchBlockListItems(ctx, username)
+}
+
+// InsertOrUpdatePrivacyList inserts or updates a privacy list.
+func (s *Storage) InsertOrUpdatePrivacyList(ctx context.Context, list *model.PrivacyList) error {
+	defer s.observe("InsertOrUpdatePrivacyList", time.Now())
+	return s.Storage.InsertOrUpdatePrivacyList(ctx, list)
+}
+
+// DeletePrivacyList deletes a user's privacy list.
+func (s *Storage) DeletePrivacyList(ctx context.Context, username, name string) error {
+	defer s.observe("DeletePrivacyList", time.Now())
+	return s.Storage.DeletePrivacyList(ctx, username, name)
+}
+
+// FetchPrivacyLists retrieves from storage every user's privacy list.
+func (s *Storage) FetchPrivacyLists(ctx context.Context, username string) ([]model.PrivacyList, error) {
+	defer s.observe("FetchPrivacyLists", time.Now())
+	return s.Storage.FetchPrivacyLists(ctx, username)
+}
+
+// SetDefaultPrivacyList sets user's default privacy list.
+func (s *Storage) SetDefaultPrivacyList(ctx context.Context, username, name string) error {
+	defer s.observe("SetDefaultPrivacyList", time.Now())
+	return s.Storage.SetDefaultPrivacyList(ctx, username, name)
+}
+
+// InsertOrUpdateFeatureFlag inserts a new user feature flag override
+// into storage, or updates it in case it's been previously inserted.
+func (s *Storage) InsertOrUpdateFeatureFlag(ctx context.Context, ff *model.FeatureFlag) error {
+	defer s.observe("InsertOrUpdateFeatureFlag", time.Now())
+	return s.Storage.InsertOrUpdateFeatureFlag(ctx, ff)
+}
+
+// DeleteFeatureFlag deletes a user feature flag override from storage.
+func (s *Storage) DeleteFeatureFlag(ctx context.Context, name, username string) error {
+	defer s.observe("DeleteFeatureFlag", time.Now())
+	return s.Storage.DeleteFeatureFlag(ctx, name, username)
+}
+
+// FetchFeatureFlags retrieves from storage every feature flag
+// override associated to a given user.
+func (s *Storage) FetchFeatureFlags(ctx context.Context, username string) ([]model.FeatureFlag, error) {
+	defer s.observe("FetchFeatureFlags", time.Now())
+	return s.Storage.FetchFeatureFlags(ctx, username)
+}
+
+// InsertInvite inserts a new registration invite into storage.
+func (s *Storage) InsertInvite(ctx context.Context, invite *model.Invite) error {
+	defer s.observe("InsertInvite", time.Now())
+	return s.Storage.InsertInvite(ctx, invite)
+}
+
+// RedeemInvite marks a registration invite as used, returning false
+// if it doesn't exist, has expired or has already been used.
+func (s *Storage) RedeemInvite(ctx context.Context, token string, now time.Time) (bool, error) {
+	defer s.observe("RedeemInvite", time.Now())
+	return s.Storage.RedeemInvite(ctx, token, now)
+}
+
+// InsertStreamSession stores a resumable stream management session
+// persisted on graceful shutdown.
+func (s *Storage) InsertStreamSession(ctx context.Context, session *model.StreamSession) error {
+	defer s.observe("InsertStreamSession", time.Now())
+	return s.Storage.InsertStreamSession(ctx, session)
+}
+
+// FetchStreamSessions retrieves from storage every stream
+// session persisted by a server configuration.
+func (s *Storage) FetchStreamSessions(ctx context.Context, serverID string) ([]model.StreamSession, error) {
+	defer s.observe("FetchStreamSessions", time.Now())
+	return s.Storage.FetchStreamSessions(ctx, serverID)
+}
+
+// DeleteStreamSessions deletes from storage every stream
+// session persisted by a server configuration.
+func (s *Storage) DeleteStreamSessions(ctx context.Context, serverID string) error {
+	defer s.observe("DeleteStreamSessions", time.Now())
+	return s.Storage.DeleteStreamSessions(ctx, serverID)
+}
+
+// Usage returns the storage space taken by every stored entity.
+func (s *Storage) Usage(ctx context.Context) ([]model.EntityUsage, error) {
+	defer s.observe("Usage", time.Now())
+	return s.Storage.Usage(ctx)
+}
+
+// InTransaction runs f within a transaction, accounting
+// every operation it performs as well.
+func (s *Storage) InTransaction(ctx context.Context, f func(tx storage.Storage) error) error {
+	defer s.observe("InTransaction", time.Now())
+	return s.Storage.InTransaction(ctx, func(tx storage.Storage) error {
+		return f(&Storage{Storage: tx, reg: s.reg})
+	})
+}
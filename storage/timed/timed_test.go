@@ -0,0 +1,48 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package timed
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/storage"
+	"github.com/ortuman/jackal/storage/faulty"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTimed_Observe(t *testing.T) {
+	storage.Initialize(&config.Storage{Type: config.Mock})
+	defer storage.Shutdown()
+
+	fs := faulty.New(storage.Instance())
+	require.Nil(t, fs.Enable(map[string]faulty.Fault{"FetchUser": {Latency: time.Millisecond * 10}}))
+
+	reg := stats.NewRegistry()
+	s := New(fs, reg)
+
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman"}))
+	for i := 0; i < 3; i++ {
+		usr, err := s.FetchUser(context.Background(), "ortuman")
+		require.Nil(t, err)
+		require.NotNil(t, usr)
+	}
+	require.Equal(t, int64(1), reg.Counter("storage/calls/InsertOrUpdateUser", "calls").Value())
+	require.Equal(t, int64(3), reg.Counter("storage/calls/FetchUser", "calls").Value())
+	require.True(t, reg.Counter("storage/latency/FetchUser", "microseconds").Value() >= 30000)
+
+	// errors are accounted as well
+	storage.ActivateMockedError()
+	defer storage.DeactivateMockedError()
+
+	_, err := s.FetchRosterItems(context.Background(), "ortuman")
+	require.Equal(t, storage.ErrMockedError, err)
+	require.Equal(t, int64(1), reg.Counter("storage/calls/FetchRosterItems", "calls").Value())
+}
@@ -0,0 +1,109 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"sync"
+	"time"
+
+	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/storage/model"
+)
+
+// usageSampler periodically samples per entity storage usage,
+// exposing last sampled values as 'storage/<entity>/rows' and
+// 'storage/<entity>/bytes' statistics gauges.
+type usageSampler struct {
+	registry        *stats.Registry
+	growthThreshold float64
+
+	mu   sync.RWMutex
+	last map[string]model.EntityUsage
+}
+
+func newUsageSampler(registry *stats.Registry, growthThreshold float64) *usageSampler {
+	return &usageSampler{
+		registry:        registry,
+		growthThreshold: growthThreshold,
+		last:            make(map[string]model.EntityUsage),
+	}
+}
+
+// sample retrieves current storage usage, returning the name of
+// those entities whose growth exceeded configured threshold.
+func (us *usageSampler) sample(s Storage) ([]string, error) {
+	ctx, cancel := QueryContext()
+	defer cancel()
+
+	usage, err := s.Usage(ctx)
+	if err != nil {
+		return nil, err
+	}
+	var exceeded []string
+
+	us.mu.Lock()
+	defer us.mu.Unlock()
+	for _, u := range usage {
+		prev, ok := us.last[u.Entity]
+		us.last[u.Entity] = u
+		if !ok {
+			us.registerGauges(u.Entity)
+			continue
+		}
+		if us.growthThreshold <= 0 {
+			continue
+		}
+		rowsGrowth := growth(prev.Rows, u.Rows)
+		bytesGrowth := growth(prev.Bytes, u.Bytes)
+		if rowsGrowth > us.growthThreshold || bytesGrowth > us.growthThreshold {
+			log.Warnf("storage: %s grew %.1f%% rows (%d) and %.1f%% bytes (%d) since last sample",
+				u.Entity, rowsGrowth, u.Rows, bytesGrowth, u.Bytes)
+			exceeded = append(exceeded, u.Entity)
+		}
+	}
+	return exceeded, nil
+}
+
+func (us *usageSampler) registerGauges(entity string) {
+	us.registry.RegisterGauge("storage/"+entity+"/rows", "rows", func() (int64, error) {
+		us.mu.RLock()
+		defer us.mu.RUnlock()
+		return us.last[entity].Rows, nil
+	})
+	us.registry.RegisterGauge("storage/"+entity+"/bytes", "bytes", func() (int64, error) {
+		us.mu.RLock()
+		defer us.mu.RUnlock()
+		return us.last[entity].Bytes, nil
+	})
+}
+
+// growth returns the percentage increase from prev to cur.
+// Growth from an empty entity is not accounted.
+func growth(prev, cur int64) float64 {
+	if prev <= 0 || cur <= prev {
+		return 0
+	}
+	return float64(cur-prev) * 100 / float64(prev)
+}
+
+func usageLoop(s Storage, us *usageSampler, interval time.Duration, doneCh <-chan struct{}) {
+	if _, err := us.sample(s); err != nil {
+		log.Error(err)
+	}
+	tc := time.NewTicker(interval)
+	defer tc.Stop()
+	for {
+		select {
+		case <-tc.C:
+			if _, err := us.sample(s); err != nil {
+				log.Error(err)
+			}
+		case <-doneCh:
+			return
+		}
+	}
+}
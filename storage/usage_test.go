@@ -0,0 +1,92 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package storage
+
+import (
+	"context"
+	"fmt"
+	"testing"
+
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/storage/model"
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageSampler_Gauges(t *testing.T) {
+	s := newMockStorage()
+	for i := 0; i < 3; i++ {
+		require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: fmt.Sprintf("user%d", i), Password: "1234"}))
+	}
+	require.Nil(t, s.InsertOfflineMessage(context.Background(), xml.NewElementNamespace("message", "jabber:client"), "user0"))
+
+	expected, err := s.Usage(context.Background())
+	require.Nil(t, err)
+
+	reg := stats.NewRegistry()
+	us := newUsageSampler(reg, 0)
+	_, err = us.sample(s)
+	require.Nil(t, err)
+
+	for _, u := range expected {
+		m, ok := reg.Sample("storage/" + u.Entity + "/rows")
+		require.True(t, ok)
+		require.Equal(t, "rows", m.Units)
+		require.Equal(t, u.Rows, m.Value)
+
+		m, ok = reg.Sample("storage/" + u.Entity + "/bytes")
+		require.True(t, ok)
+		require.Equal(t, "bytes", m.Units)
+		require.Equal(t, u.Bytes, m.Value)
+	}
+	m, _ := reg.Sample("storage/users/rows")
+	require.Equal(t, int64(3), m.Value)
+
+	// gauges report last sampled values
+	require.Nil(t, s.DeleteUser(context.Background(), "user2"))
+	m, _ = reg.Sample("storage/users/rows")
+	require.Equal(t, int64(3), m.Value)
+
+	_, err = us.sample(s)
+	require.Nil(t, err)
+	m, _ = reg.Sample("storage/users/rows")
+	require.Equal(t, int64(2), m.Value)
+
+	s.activateMockedError()
+	_, err = us.sample(s)
+	require.Equal(t, ErrMockedError, err)
+	m, _ = reg.Sample("storage/users/rows")
+	require.Equal(t, int64(2), m.Value)
+}
+
+func TestUsageSampler_GrowthThreshold(t *testing.T) {
+	s := newMockStorage()
+	for i := 0; i < 4; i++ {
+		require.Nil(t, s.InsertOfflineMessage(context.Background(), xml.NewElementNamespace("message", "jabber:client"), "ortuman"))
+	}
+	us := newUsageSampler(stats.NewRegistry(), 50)
+
+	exceeded, err := us.sample(s)
+	require.Nil(t, err)
+	require.Nil(t, exceeded) // first sample
+
+	require.Nil(t, s.InsertOfflineMessage(context.Background(), xml.NewElementNamespace("message", "jabber:client"), "ortuman"))
+	exceeded, err = us.sample(s)
+	require.Nil(t, err)
+	require.Nil(t, exceeded) // 25% growth
+
+	for i := 0; i < 3; i++ {
+		require.Nil(t, s.InsertOfflineMessage(context.Background(), xml.NewElementNamespace("message", "jabber:client"), "ortuman"))
+	}
+	require.Nil(t, s.InsertOrUpdateUser(context.Background(), &model.User{Username: "ortuman", Password: "1234"}))
+	exceeded, err = us.sample(s)
+	require.Nil(t, err)
+	require.Equal(t, []string{"offline_messages"}, exceeded) // 60% growth, users grew from none
+
+	require.Equal(t, float64(0), growth(0, 10))
+	require.Equal(t, float64(0), growth(10, 5))
+	require.Equal(t, float64(50), growth(10, 15))
+}
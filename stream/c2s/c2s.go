@@ -6,12 +6,17 @@
 package c2s
 
 import (
+	"errors"
 	"fmt"
+	"net"
 	"sync"
 	"sync/atomic"
+	"time"
 
 	"github.com/ortuman/jackal/config"
 	"github.com/ortuman/jackal/log"
+	"github.com/ortuman/jackal/stats"
+	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
 )
 
@@ -25,10 +30,13 @@ type Stream interface {
 
 	JID() *xml.JID
 
+	RemoteAddr() net.Addr
+
 	Priority() int8
 
 	SendElement(element xml.Element)
 	Disconnect(err error)
+	Terminate(reason *streamerror.Error, text string)
 
 	IsSecured() bool
 	IsAuthenticated() bool
@@ -39,12 +47,42 @@ type Stream interface {
 	IsRosterRequested() bool
 }
 
+var (
+	// ErrSendTimeout is returned when an element couldn't be queued
+	// for writing before timeout elapsed.
+	ErrSendTimeout = errors.New("c2s: send timeout")
+
+	// ErrStreamClosed is returned when sending an element
+	// through an already disconnected stream.
+	ErrStreamClosed = errors.New("c2s: stream closed")
+)
+
+// TimedSender is implemented by streams able to report whether or not
+// an element could be queued for writing, so that callers can detect
+// wedged connections instead of blocking on them.
+type TimedSender interface {
+	SendElementTimeout(element xml.Element, timeout time.Duration) error
+}
+
+// KeepAliveSender is implemented by streams able to write a whitespace
+// keepalive, reporting whether or not it reached the underlying transport
+// before timeout elapsed.
+type KeepAliveSender interface {
+	SendKeepAlive(timeout time.Duration) error
+}
+
 // Manager manages the sessions associated with an account.
 type Manager struct {
 	cfg         *config.C2S
+	pool        *WorkerPool
 	lock        sync.RWMutex
 	strms       map[string]Stream
 	authedStrms map[string][]Stream
+	resources   map[xml.JIDKey]Stream
+	invalidated map[string]struct{}
+
+	// sessLock serializes guarded session writes against invalidation.
+	sessLock sync.RWMutex
 }
 
 // singleton interface
@@ -54,17 +92,30 @@ var (
 	initialized uint32
 )
 
+// defaultWorkerQueueSize is the number of pending stanzas each worker
+// can hold whenever not configured, given that dispatching never blocks.
+const defaultWorkerQueueSize = 256
+
 // Initialize initializes the c2s session manager.
 func Initialize(cfg *config.C2S) {
 	if atomic.CompareAndSwapUint32(&initialized, 0, 1) {
 		instMu.Lock()
 		defer instMu.Unlock()
 
+		queueSize := cfg.WorkerQueueSize
+		if queueSize == 0 {
+			queueSize = defaultWorkerQueueSize
+		}
 		inst = &Manager{
 			cfg:         cfg,
+			pool:        NewWorkerPool(cfg.Workers, queueSize),
 			strms:       make(map[string]Stream),
 			authedStrms: make(map[string][]Stream),
+			resources:   make(map[xml.JIDKey]Stream),
+			invalidated: make(map[string]struct{}),
 		}
+		stats.Default().RegisterGauge("users/online", "users", onlineUsers)
+		stats.Default().RegisterGauge("streams/authenticated", "streams", authenticatedStreams)
 	}
 }
 
@@ -80,15 +131,44 @@ func Instance() *Manager {
 }
 
 // Shutdown shuts down c2s manager system.
-// This method should be used only for testing purposes.
 func Shutdown() {
 	if atomic.CompareAndSwapUint32(&initialized, 1, 0) {
 		instMu.Lock()
 		defer instMu.Unlock()
+
+		inst.pool.Close()
 		inst = nil
 	}
 }
 
+// onlineUsers returns the number of accounts with at least one authenticated stream.
+func onlineUsers() (int64, error) {
+	instMu.RLock()
+	defer instMu.RUnlock()
+	if inst == nil {
+		return 0, nil
+	}
+	inst.lock.RLock()
+	defer inst.lock.RUnlock()
+	return int64(len(inst.authedStrms)), nil
+}
+
+// authenticatedStreams returns the number of authenticated streams across every account.
+func authenticatedStreams() (int64, error) {
+	instMu.RLock()
+	defer instMu.RUnlock()
+	if inst == nil {
+		return 0, nil
+	}
+	inst.lock.RLock()
+	defer inst.lock.RUnlock()
+	var n int64
+	for _, strms := range inst.authedStrms {
+		n += int64(len(strms))
+	}
+	return n, nil
+}
+
 // DefaultLocalDomain returns default local domain.
 func (m *Manager) DefaultLocalDomain() string {
 	return m.cfg.Domains[0]
@@ -104,6 +184,27 @@ func (m *Manager) IsLocalDomain(domain string) bool {
 	return false
 }
 
+// IsAdmin returns true if jid bare representation
+// belongs to a configured server administrator.
+func (m *Manager) IsAdmin(jid *xml.JID) bool {
+	bareJID := jid.ToBareJID().String()
+	for _, admin := range m.cfg.Admins {
+		if admin == bareJID {
+			return true
+		}
+	}
+	return false
+}
+
+// Dispatch schedules stanza processing function f on the manager worker pool.
+// Functions dispatched on behalf of the same originating JID
+// are guaranteed to be run sequentially in dispatch order.
+// It never blocks, returning ErrWorkerQueueFull whenever
+// originating JID's queue is full.
+func (m *Manager) Dispatch(from *xml.JID, f func()) error {
+	return m.pool.TryDispatchJID(from.Key(), f)
+}
+
 // RegisterStream registers the specified client stream.
 // An error will be returned in case the stream has been previously registered.
 func (m *Manager) RegisterStream(strm Stream) error {
@@ -146,7 +247,11 @@ func (m *Manager) UnregisterStream(strm Stream) error {
 			delete(m.authedStrms, strm.Username())
 		}
 	}
+	if k := strm.JID().Key(); m.resources[k] == strm {
+		delete(m.resources, k)
+	}
 	delete(m.strms, strm.ID())
+	delete(m.invalidated, strm.ID())
 	m.lock.Unlock()
 	log.Infof("unregistered stream... (id: %s)", strm.ID())
 	return nil
@@ -164,11 +269,32 @@ func (m *Manager) AuthenticateStream(strm Stream) error {
 	} else {
 		m.authedStrms[strm.Username()] = []Stream{strm}
 	}
+	m.resources[strm.JID().Key()] = strm
 	m.lock.Unlock()
 	log.Infof("authenticated stream... (%s/%s)", strm.Username(), strm.Resource())
 	return nil
 }
 
+// Streams returns every registered stream.
+func (m *Manager) Streams() []Stream {
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	ret := make([]Stream, 0, len(m.strms))
+	for _, strm := range m.strms {
+		ret = append(ret, strm)
+	}
+	return ret
+}
+
+// ResourceStream returns the authenticated stream bound to jid full JID,
+// or nil if none is.
+func (m *Manager) ResourceStream(jid *xml.JID) Stream {
+	m.lock.RLock()
+	strm := m.resources[jid.Key()]
+	m.lock.RUnlock()
+	return strm
+}
+
 // AvailableStreams returns every authenticated stream associated with an account.
 func (m *Manager) AvailableStreams(username string) []Stream {
 	m.lock.RLock()
@@ -176,3 +302,68 @@ func (m *Manager) AvailableStreams(username string) []Stream {
 	m.lock.RUnlock()
 	return res
 }
+
+// StreamsMatchingJID returns every authenticated stream matching jid,
+// that is, the one bound to it if a full JID or else every stream
+// associated with its account.
+func (m *Manager) StreamsMatchingJID(jid *xml.JID) []Stream {
+	if jid.IsFull() {
+		if strm := m.ResourceStream(jid); strm != nil {
+			return []Stream{strm}
+		}
+		return nil
+	}
+	m.lock.RLock()
+	defer m.lock.RUnlock()
+	var res []Stream
+	for _, strm := range m.authedStrms[jid.Node()] {
+		if strm.Domain() == jid.Domain() {
+			res = append(res, strm)
+		}
+	}
+	return res
+}
+
+// InvalidateSessions marks every authenticated stream associated with
+// an account as invalid, returning the invalidated streams.
+// Call blocks until in-flight guarded writes are completed, so that
+// no further account data gets written once it returns.
+func (m *Manager) InvalidateSessions(username string) []Stream {
+	m.sessLock.Lock()
+	defer m.sessLock.Unlock()
+
+	m.lock.Lock()
+	var res []Stream
+	for id, strm := range m.strms {
+		if strm.IsAuthenticated() && strm.Username() == username {
+			m.invalidated[id] = struct{}{}
+			res = append(res, strm)
+		}
+	}
+	m.lock.Unlock()
+	if len(res) > 0 {
+		log.Infof("invalidated %d session(s)... (%s)", len(res), username)
+	}
+	return res
+}
+
+// IsValidSession returns whether or not strm session
+// has not been invalidated.
+func (m *Manager) IsValidSession(strm Stream) bool {
+	m.lock.RLock()
+	_, ok := m.invalidated[strm.ID()]
+	m.lock.RUnlock()
+	return !ok
+}
+
+// GuardSession runs f only if strm session is still valid, returning
+// whether or not it was run. Session won't be invalidated while f is running.
+func (m *Manager) GuardSession(strm Stream, f func()) bool {
+	m.sessLock.RLock()
+	defer m.sessLock.RUnlock()
+	if !m.IsValidSession(strm) {
+		return false
+	}
+	f()
+	return true
+}
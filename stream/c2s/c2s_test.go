@@ -7,8 +7,10 @@ package c2s
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/config"
+	"github.com/ortuman/jackal/stats"
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
 	"github.com/stretchr/testify/require"
@@ -52,6 +54,9 @@ func TestC2SManager(t *testing.T) {
 	require.Equal(t, "ortuman@jackal.im/balcony", strms[0].JID().String())
 	require.Equal(t, "ortuman@jackal.im/garden", strms[1].JID().String())
 
+	online, _ := stats.Default().Sample("users/online")
+	require.Equal(t, int64(1), online.Value)
+
 	err = Instance().UnregisterStream(strm1)
 	require.Nil(t, err)
 	err = Instance().UnregisterStream(strm1)
@@ -62,3 +67,149 @@ func TestC2SManager(t *testing.T) {
 	strms = Instance().AvailableStreams("ortuman")
 	require.Equal(t, 0, len(strms))
 }
+
+func TestC2SManager_IsAdmin(t *testing.T) {
+	Initialize(&config.C2S{Domains: []string{"jackal.im"}, Admins: []string{"admin@jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("admin@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	require.True(t, Instance().IsAdmin(j1))
+	require.True(t, Instance().IsAdmin(j1.ToBareJID()))
+	require.False(t, Instance().IsAdmin(j2))
+}
+
+func TestC2SManager_InvalidateSessions(t *testing.T) {
+	Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("romeo@jackal.im/garden", false)
+	strm1 := NewMockStream(uuid.New(), j1)
+	strm2 := NewMockStream(uuid.New(), j2)
+	for _, strm := range []*MockStream{strm1, strm2} {
+		strm.SetAuthenticated(true)
+		Instance().RegisterStream(strm)
+		Instance().AuthenticateStream(strm)
+	}
+	require.True(t, Instance().IsValidSession(strm1))
+
+	var run bool
+	require.True(t, Instance().GuardSession(strm1, func() { run = true }))
+	require.True(t, run)
+
+	strms := Instance().InvalidateSessions("ortuman")
+	require.Equal(t, 1, len(strms))
+	require.Equal(t, strm1.ID(), strms[0].ID())
+	require.False(t, Instance().IsValidSession(strm1))
+	require.True(t, Instance().IsValidSession(strm2))
+
+	run = false
+	require.False(t, Instance().GuardSession(strm1, func() { run = true }))
+	require.False(t, run)
+
+	// invalidation waits for in-flight guarded writes
+	startedCh := make(chan struct{})
+	releaseCh := make(chan struct{})
+	go Instance().GuardSession(strm2, func() {
+		close(startedCh)
+		<-releaseCh
+	})
+	<-startedCh
+
+	invalidatedCh := make(chan struct{})
+	go func() {
+		Instance().InvalidateSessions("romeo")
+		close(invalidatedCh)
+	}()
+	select {
+	case <-invalidatedCh:
+		require.Fail(t, "sessions invalidated during a guarded write")
+	case <-time.After(time.Millisecond * 50):
+	}
+	close(releaseCh)
+	<-invalidatedCh
+	require.False(t, Instance().IsValidSession(strm2))
+
+	Instance().UnregisterStream(strm1)
+	require.True(t, Instance().IsValidSession(strm1))
+}
+
+func TestC2SManager_StreamsMatchingJID(t *testing.T) {
+	Initialize(&config.C2S{Domains: []string{"jackal.im", "jackal.org"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/garden", false)
+	j3, _ := xml.NewJIDString("ortuman@jackal.org/orchard", false)
+	j4, _ := xml.NewJIDString("romeo@jackal.im/balcony", false)
+	strm1 := NewMockStream(uuid.New(), j1)
+	strm2 := NewMockStream(uuid.New(), j2)
+	strm3 := NewMockStream(uuid.New(), j3)
+	strm4 := NewMockStream(uuid.New(), j4)
+	for _, strm := range []*MockStream{strm1, strm2, strm3, strm4} {
+		strm.SetAuthenticated(true)
+		Instance().RegisterStream(strm)
+		Instance().AuthenticateStream(strm)
+	}
+	strms := Instance().StreamsMatchingJID(j1.ToBareJID())
+	require.Equal(t, 2, len(strms))
+	ids := map[string]bool{strms[0].ID(): true, strms[1].ID(): true}
+	require.True(t, ids[strm1.ID()])
+	require.True(t, ids[strm2.ID()])
+
+	strms = Instance().StreamsMatchingJID(j2)
+	require.Equal(t, 1, len(strms))
+	require.Equal(t, strm2.ID(), strms[0].ID())
+
+	unknown, _ := xml.NewJIDString("juliet@jackal.im", false)
+	require.Equal(t, 0, len(Instance().StreamsMatchingJID(unknown)))
+}
+
+func TestC2SManager_ResourceStream(t *testing.T) {
+	Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/garden", false)
+	strm1 := NewMockStream(uuid.New(), j1)
+	strm2 := NewMockStream(uuid.New(), j2)
+	for _, strm := range []*MockStream{strm1, strm2} {
+		strm.SetAuthenticated(true)
+		Instance().RegisterStream(strm)
+		Instance().AuthenticateStream(strm)
+	}
+
+	// independently parsed JID must resolve the same stream
+	to, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	require.Equal(t, strm1, Instance().ResourceStream(to))
+
+	other, _ := xml.NewJIDString("ortuman@example.org/balcony", false)
+	require.Nil(t, Instance().ResourceStream(other))
+
+	Instance().UnregisterStream(strm1)
+	require.Nil(t, Instance().ResourceStream(to))
+
+	to2, _ := xml.NewJIDString("ortuman@jackal.im/garden", false)
+	require.Equal(t, strm2, Instance().ResourceStream(to2))
+}
+
+func BenchmarkC2SManager_ResourceStream(b *testing.B) {
+	Initialize(&config.C2S{Domains: []string{"jackal.im"}})
+	defer Shutdown()
+
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	strm := NewMockStream(uuid.New(), j)
+	strm.SetAuthenticated(true)
+	Instance().RegisterStream(strm)
+	Instance().AuthenticateStream(strm)
+
+	to, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if Instance().ResourceStream(to) == nil {
+			b.Fatal("stream not found")
+		}
+	}
+}
@@ -6,8 +6,11 @@
 package c2s
 
 import (
+	"net"
 	"sync"
+	"time"
 
+	"github.com/ortuman/jackal/stream/errors"
 	"github.com/ortuman/jackal/xml"
 )
 
@@ -20,12 +23,16 @@ type MockStream struct {
 	resource         string
 	jid              *xml.JID
 	priority         int8
+	remoteAddr       net.Addr
 	disconnected     bool
+	terminationText  string
 	secured          bool
 	authenticated    bool
 	compressed       bool
 	rosterRequested  bool
 	presenceElements []xml.Element
+	sendErr          error
+	keepAlives       int
 	elemCh           chan xml.Element
 	discCh           chan error
 }
@@ -127,6 +134,20 @@ func (m *MockStream) SetPriority(priority int8) {
 	m.priority = priority
 }
 
+// RemoteAddr returns mocked stream remote address.
+func (m *MockStream) RemoteAddr() net.Addr {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.remoteAddr
+}
+
+// SetRemoteAddr sets mocked stream remote address.
+func (m *MockStream) SetRemoteAddr(addr net.Addr) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.remoteAddr = addr
+}
+
 // Disconnect disconnects mocked stream.
 func (m *MockStream) Disconnect(err error) {
 	m.mu.Lock()
@@ -136,6 +157,24 @@ func (m *MockStream) Disconnect(err error) {
 	m.disconnected = true
 }
 
+// Terminate disconnects mocked stream recording termination reason and text.
+func (m *MockStream) Terminate(reason *streamerror.Error, text string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.discCh <- reason
+	m.disconnected = true
+	m.terminationText = text
+}
+
+// TerminationText returns the descriptive text
+// the mocked stream has been terminated with.
+func (m *MockStream) TerminationText() string {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.terminationText
+}
+
 // IsDisconnected returns whether or not the mocked stream has been disconnected.
 func (m *MockStream) IsDisconnected() bool {
 	m.mu.RLock()
@@ -148,6 +187,18 @@ func (m *MockStream) WaitDisconnection() error {
 	return <-m.discCh
 }
 
+// WaitDisconnectionTimeout waits until the mocked stream disconnects.
+// The first returned value reports whether or not it disconnected
+// before timeout elapsed.
+func (m *MockStream) WaitDisconnectionTimeout(timeout time.Duration) (bool, error) {
+	select {
+	case err := <-m.discCh:
+		return true, err
+	case <-time.After(timeout):
+		return false, nil
+	}
+}
+
 // SetSecured sets whether or not the a mocked stream
 // has been secured.
 func (m *MockStream) SetSecured(secured bool) {
@@ -231,8 +282,66 @@ func (m *MockStream) SendElement(element xml.Element) {
 	m.elemCh <- element
 }
 
+// SendElementTimeout sends the given XML element, failing with the mocked
+// send error if any, or if it can't be queued before timeout elapses.
+func (m *MockStream) SendElementTimeout(element xml.Element, timeout time.Duration) error {
+	m.mu.RLock()
+	err := m.sendErr
+	m.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	t := time.NewTimer(timeout)
+	defer t.Stop()
+	select {
+	case m.elemCh <- element:
+		return nil
+	case <-t.C:
+		return ErrSendTimeout
+	}
+}
+
+// SendKeepAlive records a whitespace keepalive write, failing
+// with the mocked send error if any.
+func (m *MockStream) SendKeepAlive(timeout time.Duration) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.sendErr != nil {
+		return m.sendErr
+	}
+	m.keepAlives++
+	return nil
+}
+
+// KeepAlives returns the number of whitespace keepalives
+// written to the mocked stream.
+func (m *MockStream) KeepAlives() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+	return m.keepAlives
+}
+
+// SetSendError sets the error returned by any subsequent
+// SendElementTimeout or SendKeepAlive call, or clears it if nil.
+func (m *MockStream) SetSendError(err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sendErr = err
+}
+
 // FetchElement waits until a new XML element is sent to
 // the mocked stream and returns it.
 func (m *MockStream) FetchElement() xml.Element {
 	return <-m.elemCh
 }
+
+// FetchElementTimeout waits until a new XML element is sent to the
+// mocked stream and returns it, or nil if timeout elapses before.
+func (m *MockStream) FetchElementTimeout(timeout time.Duration) xml.Element {
+	select {
+	case elem := <-m.elemCh:
+		return elem
+	case <-time.After(timeout):
+		return nil
+	}
+}
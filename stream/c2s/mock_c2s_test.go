@@ -6,7 +6,9 @@
 package c2s
 
 import (
+	"net"
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/xml"
 	"github.com/pborman/uuid"
@@ -35,6 +37,10 @@ func TestMockC2Stream(t *testing.T) {
 	require.Equal(t, "romeo@jackal.im/orchard", strm.JID().String())
 	strm.SetPriority(-10)
 	require.Equal(t, int8(-10), strm.Priority())
+	require.Nil(t, strm.RemoteAddr())
+	addr := &net.TCPAddr{IP: net.ParseIP("77.230.105.223"), Port: 5222}
+	strm.SetRemoteAddr(addr)
+	require.Equal(t, addr, strm.RemoteAddr())
 
 	strm.Disconnect(nil)
 	require.True(t, strm.IsDisconnected())
@@ -57,4 +63,32 @@ func TestMockC2Stream(t *testing.T) {
 	fetch := strm.FetchElement()
 	require.NotNil(t, fetch)
 	require.Equal(t, "elem1234", fetch.Name())
+
+	require.Nil(t, strm.FetchElementTimeout(time.Millisecond*10))
+	strm.SendElement(elem)
+	require.Equal(t, "elem1234", strm.FetchElementTimeout(time.Millisecond*10).Name())
+
+	disconnected, err := strm.WaitDisconnectionTimeout(time.Millisecond * 10)
+	require.True(t, disconnected)
+	require.Nil(t, err)
+	disconnected, _ = strm.WaitDisconnectionTimeout(time.Millisecond * 10)
+	require.False(t, disconnected)
+
+	require.Nil(t, strm.SendElementTimeout(elem, time.Millisecond*10))
+	require.Equal(t, "elem1234", strm.FetchElement().Name())
+
+	require.Nil(t, strm.SendKeepAlive(time.Millisecond*10))
+	require.Equal(t, 1, strm.KeepAlives())
+
+	strm.SetSendError(ErrStreamClosed)
+	require.Equal(t, ErrStreamClosed, strm.SendElementTimeout(elem, time.Millisecond*10))
+	require.Equal(t, ErrStreamClosed, strm.SendKeepAlive(time.Millisecond*10))
+	require.Equal(t, 1, strm.KeepAlives())
+	strm.SetSendError(nil)
+
+	// full mailbox
+	for i := 0; i < cap(strm.elemCh); i++ {
+		strm.SendElement(elem)
+	}
+	require.Equal(t, ErrSendTimeout, strm.SendElementTimeout(elem, time.Millisecond*10))
 }
@@ -0,0 +1,140 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import (
+	"errors"
+	"sync"
+
+	"github.com/ortuman/jackal/xml"
+)
+
+// ErrWorkerQueueFull is returned when a task couldn't be dispatched
+// because its queue has no room left.
+var ErrWorkerQueueFull = errors.New("c2s: worker queue full")
+
+const (
+	fnvOffset32 = 2166136261
+	fnvPrime32  = 16777619
+)
+
+// WorkerPool processes tasks concurrently across keys, while
+// guaranteeing FIFO ordering among tasks sharing the same key.
+// Keys are hash-partitioned over a fixed set of bounded queues,
+// each one of them drained by a single worker goroutine.
+type WorkerPool struct {
+	queues    []chan func()
+	doneCh    chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWorkerPool returns a new worker pool made up of size workers,
+// each one of them owning a queue of queueSize pending tasks.
+func NewWorkerPool(size, queueSize int) *WorkerPool {
+	if size < 1 {
+		size = 1
+	}
+	wp := &WorkerPool{
+		queues: make([]chan func(), size),
+		doneCh: make(chan struct{}),
+	}
+	for i := 0; i < size; i++ {
+		wp.queues[i] = make(chan func(), queueSize)
+		go wp.worker(wp.queues[i])
+	}
+	return wp
+}
+
+// Dispatch enqueues f to be run after every task previously
+// dispatched under the same key.
+// Whenever key's queue is full the call blocks until a slot is available,
+// propagating backpressure to the caller. Callers that must never block,
+// such as stream actors a worker may be delivering to, use TryDispatch instead.
+func (wp *WorkerPool) Dispatch(key string, f func()) {
+	wp.enqueue(wp.partition(key), f)
+}
+
+// DispatchJID behaves as Dispatch keying f by jid, without requiring
+// its string representation. Both calls are interchangeable, given
+// that a JID key is mapped to the same queue as its string representation.
+func (wp *WorkerPool) DispatchJID(jid xml.JIDKey, f func()) {
+	wp.enqueue(wp.partitionJID(jid), f)
+}
+
+// TryDispatch behaves as Dispatch, except that it never blocks,
+// returning ErrWorkerQueueFull whenever key's queue is full.
+func (wp *WorkerPool) TryDispatch(key string, f func()) error {
+	return wp.tryEnqueue(wp.partition(key), f)
+}
+
+// TryDispatchJID behaves as DispatchJID, except that it never blocks,
+// returning ErrWorkerQueueFull whenever jid's queue is full.
+func (wp *WorkerPool) TryDispatchJID(jid xml.JIDKey, f func()) error {
+	return wp.tryEnqueue(wp.partitionJID(jid), f)
+}
+
+// Close stops every pool worker. Tasks dispatched from this point on are discarded.
+func (wp *WorkerPool) Close() {
+	wp.closeOnce.Do(func() {
+		close(wp.doneCh)
+	})
+}
+
+func (wp *WorkerPool) enqueue(partition int, f func()) {
+	select {
+	case wp.queues[partition] <- f:
+	case <-wp.doneCh:
+	}
+}
+
+func (wp *WorkerPool) tryEnqueue(partition int, f func()) error {
+	select {
+	case wp.queues[partition] <- f:
+		return nil
+	case <-wp.doneCh:
+		return nil
+	default:
+		return ErrWorkerQueueFull
+	}
+}
+
+func (wp *WorkerPool) partition(key string) int {
+	return int(fnvHash(fnvOffset32, key) % uint32(len(wp.queues)))
+}
+
+func (wp *WorkerPool) partitionJID(jid xml.JIDKey) int {
+	h := uint32(fnvOffset32)
+	if len(jid.Node()) > 0 {
+		h = fnvHash(h, jid.Node())
+		h = fnvHash(h, "@")
+	}
+	h = fnvHash(h, jid.Domain())
+	if len(jid.Resource()) > 0 {
+		h = fnvHash(h, "/")
+		h = fnvHash(h, jid.Resource())
+	}
+	return int(h % uint32(len(wp.queues)))
+}
+
+// fnvHash accumulates s into h FNV-1a hash.
+func fnvHash(h uint32, s string) uint32 {
+	for i := 0; i < len(s); i++ {
+		h ^= uint32(s[i])
+		h *= fnvPrime32
+	}
+	return h
+}
+
+func (wp *WorkerPool) worker(queue chan func()) {
+	for {
+		select {
+		case f := <-queue:
+			f()
+		case <-wp.doneCh:
+			return
+		}
+	}
+}
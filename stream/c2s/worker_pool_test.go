@@ -0,0 +1,229 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package c2s
+
+import (
+	"fmt"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestWorkerPool_Ordering(t *testing.T) {
+	wp := NewWorkerPool(8, 16)
+	defer wp.Close()
+
+	const senders = 10
+	const messageCount = 1000
+
+	var mu sync.Mutex
+	received := make(map[string][]int)
+
+	var wg sync.WaitGroup
+	wg.Add(senders * messageCount)
+	for s := 0; s < senders; s++ {
+		go func(sender string) {
+			for i := 0; i < messageCount; i++ {
+				seq := i
+				wp.Dispatch(sender, func() {
+					if rand.Intn(100) == 0 {
+						time.Sleep(time.Microsecond * 100) // expensive stanza
+					}
+					mu.Lock()
+					received[sender] = append(received[sender], seq)
+					mu.Unlock()
+					wg.Done()
+				})
+			}
+		}(fmt.Sprintf("user%d@jackal.im/balcony", s))
+	}
+	wg.Wait()
+
+	require.Equal(t, senders, len(received))
+	for _, seqs := range received {
+		require.Equal(t, messageCount, len(seqs))
+		for i := 0; i < messageCount; i++ {
+			require.Equal(t, i, seqs[i])
+		}
+	}
+}
+
+func TestWorkerPool_Concurrency(t *testing.T) {
+	wp := NewWorkerPool(4, 16)
+	defer wp.Close()
+
+	// find a key mapped to a different partition
+	k1 := "ortuman@jackal.im/balcony"
+	var k2 string
+	for i := 0; ; i++ {
+		k2 = fmt.Sprintf("noelia@jackal.im/garden%d", i)
+		if wp.partition(k1) != wp.partition(k2) {
+			break
+		}
+	}
+	blockCh := make(chan struct{})
+	defer close(blockCh)
+
+	wp.Dispatch(k1, func() { <-blockCh }) // expensive stanza
+
+	doneCh := make(chan struct{})
+	wp.Dispatch(k2, func() { close(doneCh) })
+	select {
+	case <-doneCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "stanza processing blocked by another sender")
+	}
+}
+
+func TestWorkerPool_DispatchJID(t *testing.T) {
+	wp := NewWorkerPool(16, 16)
+	defer wp.Close()
+
+	for _, s := range []string{"ortuman@jackal.im/balcony", "ortuman@jackal.im", "jackal.im", "jackal.im/balcony"} {
+		j, _ := xml.NewJIDString(s, true)
+		require.Equal(t, wp.partition(s), wp.partitionJID(j.Key()))
+	}
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", true)
+	require.Equal(t, 0.0, testing.AllocsPerRun(100, func() { wp.partitionJID(j.Key()) }))
+
+	doneCh := make(chan struct{})
+	wp.DispatchJID(j.Key(), func() { close(doneCh) })
+	select {
+	case <-doneCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "dispatched task not run")
+	}
+}
+
+func TestWorkerPool_Backpressure(t *testing.T) {
+	wp := NewWorkerPool(1, 1)
+	defer wp.Close()
+
+	blockCh := make(chan struct{})
+	startedCh := make(chan struct{})
+	wp.Dispatch("ortuman@jackal.im/balcony", func() {
+		close(startedCh)
+		<-blockCh
+	})
+	<-startedCh
+	wp.Dispatch("ortuman@jackal.im/balcony", func() {}) // fills the queue
+
+	dispatchedCh := make(chan struct{})
+	go func() {
+		wp.Dispatch("ortuman@jackal.im/balcony", func() {})
+		close(dispatchedCh)
+	}()
+	select {
+	case <-dispatchedCh:
+		require.Fail(t, "dispatch should block while queue is full")
+	case <-time.After(time.Millisecond * 50):
+		break
+	}
+	close(blockCh)
+
+	select {
+	case <-dispatchedCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "dispatch blocked after queue has been drained")
+	}
+}
+
+func TestWorkerPool_TryDispatch(t *testing.T) {
+	wp := NewWorkerPool(1, 1)
+
+	blockCh := make(chan struct{})
+	startedCh := make(chan struct{})
+	require.Nil(t, wp.TryDispatch("ortuman@jackal.im/balcony", func() {
+		close(startedCh)
+		<-blockCh
+	}))
+	<-startedCh
+	require.Nil(t, wp.TryDispatch("ortuman@jackal.im/balcony", func() {})) // fills the queue
+
+	// never blocks while queue is full...
+	j, _ := xml.NewJIDString("ortuman@jackal.im/balcony", true)
+	require.Equal(t, ErrWorkerQueueFull, wp.TryDispatch("ortuman@jackal.im/balcony", func() {}))
+	require.Equal(t, ErrWorkerQueueFull, wp.TryDispatchJID(j.Key(), func() {}))
+
+	// ...succeeding once drained
+	close(blockCh)
+	doneCh := make(chan struct{})
+	for wp.TryDispatchJID(j.Key(), func() { close(doneCh) }) != nil {
+		time.Sleep(time.Millisecond)
+	}
+	select {
+	case <-doneCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "dispatched task not run")
+	}
+
+	// tasks are discarded once closed
+	wp.Close()
+	require.Nil(t, wp.TryDispatch("ortuman@jackal.im/balcony", func() {}))
+}
+
+func TestWorkerPool_Close(t *testing.T) {
+	wp := NewWorkerPool(1, 0)
+	wp.Close()
+	wp.Close()
+
+	// must not block once closed
+	doneCh := make(chan struct{})
+	go func() {
+		wp.Dispatch("ortuman@jackal.im/balcony", func() {})
+		close(doneCh)
+	}()
+	select {
+	case <-doneCh:
+		break
+	case <-time.After(time.Second):
+		require.Fail(t, "dispatch blocked on a closed pool")
+	}
+}
+
+// BenchmarkWorkerPool_MixedWorkload measures cheap stanza latency while
+// another sender keeps issuing expensive stanzas (eg. vCard with a huge photo).
+func BenchmarkWorkerPool_MixedWorkload(b *testing.B) {
+	for _, size := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("workers=%d", size), func(b *testing.B) {
+			wp := NewWorkerPool(size, 16)
+			defer wp.Close()
+
+			stopCh := make(chan struct{})
+			go func() {
+				for {
+					select {
+					case <-stopCh:
+						return
+					default:
+						wp.Dispatch("heavy@jackal.im/balcony", func() { time.Sleep(time.Millisecond) })
+					}
+				}
+			}()
+			var senders []string
+			for i := 0; i < 100; i++ {
+				senders = append(senders, fmt.Sprintf("user%d@jackal.im/balcony", i))
+			}
+			doneCh := make(chan struct{})
+
+			b.ResetTimer()
+			for n := 0; n < b.N; n++ {
+				wp.Dispatch(senders[n%len(senders)], func() { doneCh <- struct{}{} })
+				<-doneCh
+			}
+			b.StopTimer()
+			close(stopCh)
+		})
+	}
+}
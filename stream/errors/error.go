@@ -44,17 +44,42 @@ var (
 
 	// ErrInternalServerError represents 'internal-server-error' stream error.
 	ErrInternalServerError = newStreamError("internal-server-error")
+
+	// ErrConflict represents 'conflict' stream error.
+	ErrConflict = newStreamError("conflict")
+
+	// ErrSystemShutdown represents 'system-shutdown' stream error.
+	ErrSystemShutdown = newStreamError("system-shutdown")
+
+	// ErrPolicyViolation represents 'policy-violation' stream error.
+	ErrPolicyViolation = newStreamError("policy-violation")
+
+	// ErrUndefinedCondition represents 'undefined-condition' stream error.
+	ErrUndefinedCondition = newStreamError("undefined-condition")
 )
 
+const streamErrorNamespace = "urn:ietf:params:xml:ns:xmpp-streams"
+
 func newStreamError(reason string) *Error {
 	return &Error{reason: reason}
 }
 
 // Element returns stream error XML node.
 func (se *Error) Element() xml.Element {
+	return se.ElementWithText("")
+}
+
+// ElementWithText returns stream error XML node
+// including a descriptive text, if not empty.
+func (se *Error) ElementWithText(text string) xml.Element {
 	ret := xml.NewElementName("stream:error")
-	reason := xml.NewElementNamespace(se.reason, "urn:ietf:params:xml:ns:xmpp-streams")
+	reason := xml.NewElementNamespace(se.reason, streamErrorNamespace)
 	ret.AppendElement(reason)
+	if len(text) > 0 {
+		t := xml.NewElementNamespace("text", streamErrorNamespace)
+		t.SetText(text)
+		ret.AppendElement(t)
+	}
 	return ret
 }
 
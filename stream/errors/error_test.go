@@ -41,4 +41,23 @@ func TestStreamError(t *testing.T) {
 
 	require.Equal(t, "internal-server-error", ErrInternalServerError.Error())
 	require.Equal(t, "internal-server-error", ErrInternalServerError.Element().Elements()[0].Name())
+
+	require.Equal(t, "conflict", ErrConflict.Error())
+	require.Equal(t, "conflict", ErrConflict.Element().Elements()[0].Name())
+
+	require.Equal(t, "system-shutdown", ErrSystemShutdown.Error())
+	require.Equal(t, "system-shutdown", ErrSystemShutdown.Element().Elements()[0].Name())
+
+	require.Equal(t, "undefined-condition", ErrUndefinedCondition.Error())
+	require.Equal(t, "undefined-condition", ErrUndefinedCondition.Element().Elements()[0].Name())
+}
+
+func TestStreamErrorText(t *testing.T) {
+	require.Equal(t, 1, ErrConflict.Element().ElementsCount())
+
+	elem := ErrConflict.ElementWithText("Replaced by new connection")
+	require.Equal(t, 2, elem.ElementsCount())
+	text := elem.FindElementNamespace("text", "urn:ietf:params:xml:ns:xmpp-streams")
+	require.NotNil(t, text)
+	require.Equal(t, "Replaced by new connection", text.Text())
 }
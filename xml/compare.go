@@ -0,0 +1,87 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// Equivalent returns whether or not a and b elements are semantically equal.
+// See Diff for the set of differences considered irrelevant.
+func Equivalent(a, b Element) bool {
+	return len(Diff(a, b)) == 0
+}
+
+// Diff describes the first relevant difference found between a and b
+// elements, returning an empty string if both are equivalent.
+//
+// Attribute ordering, empty valued attributes, namespace declarations
+// matching the inherited namespace and whitespace surrounding child
+// elements are not taken into account. Child elements ordering is.
+func Diff(a, b Element) string {
+	return diffElements(a, b, "", "", "/"+a.Name())
+}
+
+func diffElements(a, b Element, nsA, nsB, path string) string {
+	if a.Name() != b.Name() {
+		return fmt.Sprintf("%s: name mismatch (%s != %s)", path, a.Name(), b.Name())
+	}
+	if ns := a.Namespace(); len(ns) > 0 {
+		nsA = ns
+	}
+	if ns := b.Namespace(); len(ns) > 0 {
+		nsB = ns
+	}
+	if nsA != nsB {
+		return fmt.Sprintf("%s: namespace mismatch (%q != %q)", path, nsA, nsB)
+	}
+	attrsA, attrsB := relevantAttributes(a), relevantAttributes(b)
+	labels := make([]string, 0, len(attrsA)+len(attrsB))
+	for label := range attrsA {
+		labels = append(labels, label)
+	}
+	for label := range attrsB {
+		if _, ok := attrsA[label]; !ok {
+			labels = append(labels, label)
+		}
+	}
+	sort.Strings(labels)
+	for _, label := range labels {
+		if attrsA[label] != attrsB[label] {
+			return fmt.Sprintf("%s: attribute %s mismatch (%q != %q)", path, label, attrsA[label], attrsB[label])
+		}
+	}
+	textA, textB := a.Text(), b.Text()
+	if a.ElementsCount() > 0 || b.ElementsCount() > 0 {
+		textA, textB = strings.TrimSpace(textA), strings.TrimSpace(textB)
+	}
+	if textA != textB {
+		return fmt.Sprintf("%s: text mismatch (%q != %q)", path, textA, textB)
+	}
+	elemsA, elemsB := a.Elements(), b.Elements()
+	if len(elemsA) != len(elemsB) {
+		return fmt.Sprintf("%s: child elements count mismatch (%d != %d)", path, len(elemsA), len(elemsB))
+	}
+	for i := 0; i < len(elemsA); i++ {
+		if d := diffElements(elemsA[i], elemsB[i], nsA, nsB, fmt.Sprintf("%s/%s[%d]", path, elemsA[i].Name(), i)); len(d) > 0 {
+			return d
+		}
+	}
+	return ""
+}
+
+func relevantAttributes(e Element) map[string]string {
+	attrs := make(map[string]string, e.AttributesCount())
+	for _, attr := range e.Attributes() {
+		if attr.Label == "xmlns" || len(attr.Value) == 0 {
+			continue
+		}
+		attrs[attr.Label] = attr.Value
+	}
+	return attrs
+}
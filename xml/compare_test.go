@@ -0,0 +1,49 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml_test
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCompare_Equivalent(t *testing.T) {
+	parse := func(s string) xml.Element {
+		elem, err := xml.NewParser(strings.NewReader(s)).ParseElement()
+		require.Nil(t, err)
+		return elem
+	}
+	a := parse(`<iq id="1" type="get"><query xmlns="jabber:iq:roster"><item jid="a@jackal.im"/></query></iq>`)
+
+	// attribute ordering, empty attributes, redundant declarations and surrounding whitespace
+	for _, s := range []string{
+		`<iq type="get" id="1"><query xmlns="jabber:iq:roster"><item jid="a@jackal.im"/></query></iq>`,
+		`<iq id="1" type="get" to=""><query xmlns="jabber:iq:roster"><item jid="a@jackal.im"></item></query></iq>`,
+		`<iq id="1" type="get"><query xmlns="jabber:iq:roster"><item xmlns="jabber:iq:roster" jid="a@jackal.im"/></query></iq>`,
+		"<iq id=\"1\" type=\"get\">\n  <query xmlns=\"jabber:iq:roster\">\n    <item jid=\"a@jackal.im\"/>\n  </query>\n</iq>",
+	} {
+		require.True(t, xml.Equivalent(a, parse(s)), s)
+	}
+
+	// relevant differences
+	for s, diff := range map[string]string{
+		`<message id="1" type="get"/>`: "/iq: name mismatch (iq != message)",
+		`<iq id="2" type="get"><query xmlns="jabber:iq:roster"><item jid="a@jackal.im"/></query></iq>`:               `/iq: attribute id mismatch ("1" != "2")`,
+		`<iq id="1" type="get"><query xmlns="jabber:iq:private"><item jid="a@jackal.im"/></query></iq>`:              `/iq/query[0]: namespace mismatch ("jabber:iq:roster" != "jabber:iq:private")`,
+		`<iq id="1" type="get"><query xmlns="jabber:iq:roster"><item xmlns="urn:x" jid="a@jackal.im"/></query></iq>`: `/iq/query[0]/item[0]: namespace mismatch ("jabber:iq:roster" != "urn:x")`,
+		`<iq id="1" type="get"><query xmlns="jabber:iq:roster"><item jid="a@jackal.im">hi</item></query></iq>`:       `/iq/query[0]/item[0]: text mismatch ("" != "hi")`,
+		`<iq id="1" type="get"><query xmlns="jabber:iq:roster"><item jid="a@jackal.im"/><item/></query></iq>`:        "/iq/query[0]: child elements count mismatch (1 != 2)",
+		`<iq id="1" type="get"><query xmlns="jabber:iq:roster"><item jid="a@jackal.im" name="a"/></query></iq>`:      `/iq/query[0]/item[0]: attribute name mismatch ("" != "a")`,
+	} {
+		require.Equal(t, diff, xml.Diff(a, parse(s)), s)
+	}
+
+	// leaf text whitespace is relevant
+	require.False(t, xml.Equivalent(parse(`<body>hi</body>`), parse(`<body> hi</body>`)))
+}
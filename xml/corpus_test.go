@@ -0,0 +1,66 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml_test
+
+import (
+	"bytes"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/ortuman/jackal/xml"
+	"github.com/stretchr/testify/require"
+)
+
+// corpusDir contains real-world stanzas, also used as go-fuzz seed corpus.
+const corpusDir = "testdata/corpus"
+
+func TestCorpus_RoundTrip(t *testing.T) {
+	files, err := filepath.Glob(filepath.Join(corpusDir, "*.xml"))
+	require.Nil(t, err)
+	require.NotEqual(t, 0, len(files))
+
+	for _, file := range files {
+		t.Run(strings.TrimSuffix(filepath.Base(file), ".xml"), func(t *testing.T) {
+			b, err := ioutil.ReadFile(file)
+			require.Nil(t, err)
+
+			elem, err := xml.NewParser(bytes.NewReader(b)).ParseElement()
+			require.Nil(t, err)
+
+			// parse -> serialize -> parse
+			serialized := elem.String()
+			elem2, err := xml.NewParser(strings.NewReader(serialized)).ParseElement()
+			require.Nil(t, err, serialized)
+			require.Equal(t, "", xml.Diff(elem, elem2))
+
+			// serialization is stable
+			require.Equal(t, serialized, elem2.String())
+
+			// copies and binary encoding preserve semantics
+			require.Equal(t, "", xml.Diff(elem, xml.NewElementFromElement(elem)))
+
+			buf := new(bytes.Buffer)
+			elem.ToBytes(buf)
+			elem3 := &xml.MutableElement{}
+			elem3.FromBytes(buf)
+			require.Equal(t, "", xml.Diff(elem, elem3))
+		})
+	}
+}
+
+func TestCorpus_Escaping(t *testing.T) {
+	b, err := ioutil.ReadFile(filepath.Join(corpusDir, "roster_groups.xml"))
+	require.Nil(t, err)
+	elem, err := xml.NewParser(bytes.NewReader(b)).ParseElement()
+	require.Nil(t, err)
+
+	item := elem.FindElement("query").FindElement("item")
+	require.Equal(t, `Juliet & "Nurse"`, item.Attribute("name"))
+	require.Equal(t, "Capulets <Verona>", item.FindElements("group")[1].Text())
+	require.True(t, strings.HasPrefix(item.String(), `<item jid="juliet@example.com" name="Juliet &amp; &#34;Nurse&#34;" subscription="both">`))
+}
@@ -7,6 +7,8 @@ package xml
 
 import (
 	"time"
+
+	"github.com/ortuman/jackal/xmpputil/timefmt"
 )
 
 const (
@@ -15,12 +17,17 @@ const (
 
 // Delay attaches element's Delayed Delivery information.
 func (m *MutableElement) Delay(from string, text string) {
+	m.DelayAt(from, text, time.Now())
+}
+
+// DelayAt attaches element's Delayed Delivery information,
+// stating it was originally sent at t.
+func (m *MutableElement) DelayAt(from string, text string, t time.Time) {
 	d := NewElementNamespace("delay", delayNamespace)
 	if len(from) > 0 {
 		d.SetAttribute("from", from)
 	}
-	t := time.Now()
-	d.SetAttribute("stamp", t.Format("2006-01-02T15:04:05Z"))
+	d.SetAttribute("stamp", timefmt.Format(t))
 
 	if len(text) > 0 {
 		d.SetText(text)
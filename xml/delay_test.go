@@ -7,8 +7,10 @@ package xml_test
 
 import (
 	"testing"
+	"time"
 
 	"github.com/ortuman/jackal/xml"
+	"github.com/ortuman/jackal/xmpputil/timefmt"
 	"github.com/stretchr/testify/require"
 )
 
@@ -19,4 +21,18 @@ func TestDelay(t *testing.T) {
 	require.NotNil(t, delay)
 	require.Equal(t, "example.org", delay.Attribute("from"))
 	require.Equal(t, "any text", delay.Text())
+
+	stamp, err := timefmt.Parse(delay.Attribute("stamp"))
+	require.Nil(t, err)
+	require.True(t, time.Since(stamp) < time.Second)
+}
+
+func TestDelayAt(t *testing.T) {
+	e := xml.NewElementName("element")
+	e.DelayAt("example.org", "", time.Date(2018, time.June, 26, 10, 15, 30, 0, time.FixedZone("CEST", 2*3600)))
+	delay := e.FindElementNamespace("delay", "urn:xmpp:delay")
+	require.NotNil(t, delay)
+	require.Equal(t, "example.org", delay.Attribute("from"))
+	require.Equal(t, "2018-06-26T08:15:30.000Z", delay.Attribute("stamp"))
+	require.Equal(t, "", delay.Text())
 }
@@ -65,6 +65,7 @@ type Element interface {
 type xElement struct {
 	name     string
 	text     string
+	spool    *spooledText
 	attrs    []Attribute
 	elements []Element
 }
@@ -112,11 +113,17 @@ func (e *xElement) Type() string {
 // Text returns XML node text value.
 // Returns an empty string if not set.
 func (e *xElement) Text() string {
+	if e.spool != nil {
+		return e.spool.text()
+	}
 	return e.text
 }
 
 // TextLen returns XML node text value length.
 func (e *xElement) TextLen() int {
+	if e.spool != nil {
+		return e.spool.runeCount
+	}
 	return utf8.RuneCountInString(e.text)
 }
 
@@ -229,7 +236,7 @@ func (e *xElement) ToXML(w io.Writer, includeClosing bool) {
 		w.Write([]byte(" "))
 		w.Write([]byte(e.attrs[i].Label))
 		w.Write([]byte(`="`))
-		w.Write([]byte(e.attrs[i].Value))
+		escapeText(w, []byte(e.attrs[i].Value), true)
 		w.Write([]byte(`"`))
 	}
 	textLen := e.TextLen()
@@ -237,7 +244,9 @@ func (e *xElement) ToXML(w io.Writer, includeClosing bool) {
 		w.Write([]byte(">"))
 
 		// serialize text
-		if textLen > 0 {
+		if e.spool != nil {
+			e.spool.writeEscaped(w)
+		} else if textLen > 0 {
 			escapeText(w, []byte(e.text), false)
 		}
 		// serialize child elements
@@ -267,7 +276,12 @@ func (e *xElement) Copy() *MutableElement {
 
 func (e *xElement) copyFrom(el Element) {
 	e.name = el.Name()
-	e.text = el.Text()
+	// spooled text is shared instead of being read back
+	if sp, ok := el.(interface{ spooledText() *spooledText }); ok && sp.spooledText() != nil {
+		e.text, e.spool = "", sp.spooledText()
+	} else {
+		e.text, e.spool = el.Text(), nil
+	}
 	e.attrs = make([]Attribute, el.AttributesCount())
 	copy(e.attrs, el.Attributes())
 
@@ -280,6 +294,10 @@ func (e *xElement) copyFrom(el Element) {
 	}
 }
 
+func (e *xElement) spooledText() *spooledText {
+	return e.spool
+}
+
 func (e *xElement) setAttribute(label, value string) {
 	for i := 0; i < len(e.attrs); i++ {
 		if e.attrs[i].Label == label {
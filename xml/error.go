@@ -58,6 +58,7 @@ const (
 	notAllowedErrorReason            = "not-allowed"
 	notAuthroizedErrorReason         = "not-authorized"
 	paymentRequiredErrorReason       = "payment-required"
+	policyViolationErrorReason       = "policy-violation"
 	recipientUnavailableErrorReason  = "recipient-unavailable"
 	redirectErrorReason              = "redirect"
 	registrationRequiredErrorReason  = "registration-required"
@@ -124,6 +125,10 @@ var (
 	// is not authorized to access the requested service because payment is required.
 	ErrPaymentRequired = newErrorElement(402, authErrorType, paymentRequiredErrorReason)
 
+	// ErrPolicyViolation is returned by the stream when the sending entity
+	// has violated some local service policy.
+	ErrPolicyViolation = newErrorElement(406, modifyErrorType, policyViolationErrorReason)
+
 	// ErrRecipientUnavailable is returned by the stream when the intended
 	// recipient is temporarily unavailable.
 	ErrRecipientUnavailable = newErrorElement(404, waitErrorType, recipientUnavailableErrorReason)
@@ -22,6 +22,7 @@ func TestError(t *testing.T) {
 	require.Equal(t, notAcceptableErrorReason, ErrNotAcceptable.Error())
 	require.Equal(t, notAuthroizedErrorReason, ErrNotAuthorized.Error())
 	require.Equal(t, paymentRequiredErrorReason, ErrPaymentRequired.Error())
+	require.Equal(t, policyViolationErrorReason, ErrPolicyViolation.Error())
 	require.Equal(t, recipientUnavailableErrorReason, ErrRecipientUnavailable.Error())
 	require.Equal(t, redirectErrorReason, ErrRedirect.Error())
 	require.Equal(t, registrationRequiredErrorReason, ErrRegistrationRequired.Error())
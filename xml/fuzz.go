@@ -0,0 +1,38 @@
+//go:build gofuzz
+// +build gofuzz
+
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"bytes"
+	"strings"
+)
+
+// Fuzz is the go-fuzz entry point for the element parser.
+//
+// testdata/corpus stanzas act as seed set when fuzzing with testdata
+// as working directory (go-fuzz -bin=xml-fuzz.zip -workdir=testdata).
+func Fuzz(data []byte) int {
+	elem, err := NewParser(bytes.NewReader(data)).ParseElement()
+	if err != nil {
+		if elem != nil {
+			panic("element returned along with an error")
+		}
+		return 0
+	}
+	// a parsed element must always survive a serialization round trip
+	serialized := elem.String()
+	elem2, err := NewParser(strings.NewReader(serialized)).ParseElement()
+	if err != nil {
+		panic(err)
+	}
+	if d := Diff(elem, elem2); len(d) > 0 {
+		panic(d)
+	}
+	return 1
+}
@@ -37,8 +37,9 @@ func (e *xElement) FromBytes(r io.Reader) {
 // binary representation.
 func (e *xElement) ToBytes(w io.Writer) {
 	enc := gob.NewEncoder(w)
+	text := e.Text()
 	enc.Encode(&e.name)
-	enc.Encode(&e.text)
+	enc.Encode(&text)
 	enc.Encode(len(e.attrs))
 	for _, attr := range e.attrs {
 		enc.Encode(&attr.Label)
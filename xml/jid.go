@@ -113,8 +113,12 @@ func NewJIDString(str string, skipStringPrep bool) (*JID, error) {
 	}
 	var node, domain, resource string
 
-	atIndex := strings.Index(str, "@")
 	slashIndex := strings.Index(str, "/")
+	atIndex := strings.Index(str, "@")
+	if slashIndex > 0 && atIndex > slashIndex {
+		// '@' character belongs to resource part
+		atIndex = -1
+	}
 
 	// node
 	if atIndex > 0 {
@@ -216,6 +220,70 @@ func (j *JID) String() string {
 	return buf.String()
 }
 
+// Key returns JID comparable value representation.
+func (j *JID) Key() JIDKey {
+	return JIDKey{node: j.node, domain: j.domain, resource: j.resource}
+}
+
+// BareKey returns bare JID comparable value representation.
+func (j *JID) BareKey() JIDKey {
+	return JIDKey{node: j.node, domain: j.domain}
+}
+
+// JIDKey represents an immutable and comparable JID value,
+// intended to be used as map key. Keys of equivalent JIDs are
+// always equal, no matter whether or not they share the same instance.
+type JIDKey struct {
+	node     string
+	domain   string
+	resource string
+}
+
+// Node returns key node part.
+func (k JIDKey) Node() string {
+	return k.node
+}
+
+// Domain returns key domain part.
+func (k JIDKey) Domain() string {
+	return k.domain
+}
+
+// Resource returns key resource part.
+func (k JIDKey) Resource() string {
+	return k.resource
+}
+
+// Bare returns key with resource part removed.
+func (k JIDKey) Bare() JIDKey {
+	return JIDKey{node: k.node, domain: k.domain}
+}
+
+// Full returns key bound to resource.
+func (k JIDKey) Full(resource string) JIDKey {
+	return JIDKey{node: k.node, domain: k.domain, resource: resource}
+}
+
+// IsBare returns true if key represents a bare JID.
+func (k JIDKey) IsBare() bool {
+	return len(k.node) > 0 && len(k.resource) == 0
+}
+
+// IsFull returns true if key represents a full JID.
+func (k JIDKey) IsFull() bool {
+	return len(k.node) > 0 && len(k.resource) > 0
+}
+
+// JID returns the JID represented by key.
+func (k JIDKey) JID() *JID {
+	return &JID{node: k.node, domain: k.domain, resource: k.resource}
+}
+
+// String returns a string representation of the JID represented by key.
+func (k JIDKey) String() string {
+	return k.JID().String()
+}
+
 func nodeprep(in string) (string, error) {
 	cin := C.CString(in)
 	defer C.free(unsafe.Pointer(cin))
@@ -56,6 +56,13 @@ func TestNewJIDString(t *testing.T) {
 	require.Equal(t, "res", j.Resource())
 	require.Equal(t, "ortuman@jackal.im", j.ToBareJID().String())
 	require.Equal(t, "ortuman@jackal.im/res", j.String())
+
+	// '@' within resource part
+	j, err = xml.NewJIDString("jackal.im/res@ource", false)
+	require.Nil(t, err)
+	require.Equal(t, "", j.Node())
+	require.Equal(t, "jackal.im", j.Domain())
+	require.Equal(t, "res@ource", j.Resource())
 }
 
 func TestJIDEqual(t *testing.T) {
@@ -100,6 +107,58 @@ func TestEqualJID(t *testing.T) {
 	require.True(t, j1.IsEqual(j5))
 }
 
+func TestJIDKey(t *testing.T) {
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/balcony", false)
+
+	// independently parsed JIDs hit the same map entry
+	m := map[xml.JIDKey]int{j1.Key(): 1}
+	require.Equal(t, 1, m[j2.Key()])
+
+	ptrs := map[*xml.JID]int{j1: 1}
+	_, ok := ptrs[j2]
+	require.False(t, ok)
+
+	k := j1.Key()
+	require.Equal(t, "ortuman", k.Node())
+	require.Equal(t, "jackal.im", k.Domain())
+	require.Equal(t, "balcony", k.Resource())
+	require.True(t, k.IsFull())
+	require.Equal(t, "ortuman@jackal.im/balcony", k.String())
+	require.True(t, k.JID().IsEqual(j1))
+
+	require.Equal(t, j1.BareKey(), k.Bare())
+	require.Equal(t, j1.ToBareJID().Key(), k.Bare())
+	require.True(t, k.Bare().IsBare())
+	require.Equal(t, k, k.Bare().Full("balcony"))
+	require.NotEqual(t, k, k.Bare().Full("garden"))
+
+	allocs := testing.AllocsPerRun(100, func() {
+		_ = m[j2.Key().Bare().Full("balcony")]
+	})
+	require.Equal(t, 0.0, allocs)
+}
+
+func BenchmarkJIDMapLookup(b *testing.B) {
+	j1, _ := xml.NewJIDString("ortuman@jackal.im/balcony", true)
+	j2, _ := xml.NewJIDString("ortuman@jackal.im/balcony", true)
+
+	b.Run("string", func(b *testing.B) {
+		m := map[string]int{j1.String(): 1}
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_ = m[j2.String()]
+		}
+	})
+	b.Run("key", func(b *testing.B) {
+		m := map[xml.JIDKey]int{j1.Key(): 1}
+		b.ReportAllocs()
+		for n := 0; n < b.N; n++ {
+			_ = m[j2.Key()]
+		}
+	})
+}
+
 func TestBadPrep(t *testing.T) {
 	badNode := string([]byte{255, 255, 255})
 	badDomain := "\U0001f480"
@@ -75,6 +75,7 @@ func (m *MutableElement) SetName(name string) {
 // SetText sets XML node text value.
 func (m *MutableElement) SetText(text string) {
 	m.text = text
+	m.spool = nil
 }
 
 // SetAttribute sets an XML node attribute (label=value)
@@ -33,7 +33,10 @@ type Parser struct {
 	nextElement  *xElement
 	parsingIndex int
 	parsingStack []*xElement
+	nsStack      []string
 	inElement    bool
+	policy       *LargeTextPolicy
+	size         int
 }
 
 // NewParser creates an empty Parser instance.
@@ -46,6 +49,12 @@ func NewParserTransportType(reader io.Reader, tt config.TransportType) *Parser {
 	return &Parser{tt: tt, dec: xml.NewDecoder(reader), parsingIndex: rootElementIndex}
 }
 
+// SetLargeTextPolicy sets the policy applied to oversized text nodes
+// of subsequently parsed elements.
+func (p *Parser) SetLargeTextPolicy(policy *LargeTextPolicy) {
+	p.policy = policy
+}
+
 // ParseElement parses next available XML element from reader.
 func (p *Parser) ParseElement() (Element, error) {
 	d := p.dec
@@ -53,10 +62,14 @@ func (p *Parser) ParseElement() (Element, error) {
 	if err != nil {
 		return nil, err
 	}
+	p.size = 0
 	for {
 		switch t1 := t.(type) {
 		case xml.StartElement:
 			p.startElement(t1)
+			if err := p.checkSize(); err != nil {
+				return nil, err
+			}
 			if p.tt == config.SocketTransportType && t1.Name.Local == streamName && t1.Name.Space == streamName {
 				p.closeElement()
 				goto done
@@ -64,6 +77,9 @@ func (p *Parser) ParseElement() (Element, error) {
 
 		case xml.CharData:
 			p.setElementText(t1)
+			if err := p.checkSize(); err != nil {
+				return nil, err
+			}
 
 		case xml.EndElement:
 			if p.tt == config.SocketTransportType && t1.Name.Local == streamName && t1.Name.Space == streamName {
@@ -96,13 +112,23 @@ func (p *Parser) startElement(t xml.StartElement) {
 		name = t.Name.Local
 	}
 
+	p.size += len(name)
+
 	var attrs []Attribute
 	for _, a := range t.Attr {
 		name := xmlName(a.Name.Space, a.Name.Local)
 		attrs = append(attrs, Attribute{name, a.Value})
+		p.size += len(name) + len(a.Value)
 	}
 	element := &xElement{name: name, attrs: attrs}
 	p.parsingStack = append(p.parsingStack, element)
+
+	// track in-scope namespace
+	ns := element.Namespace()
+	if len(ns) == 0 && len(p.nsStack) > 0 {
+		ns = p.nsStack[len(p.nsStack)-1]
+	}
+	p.nsStack = append(p.nsStack, ns)
 	p.parsingIndex++
 	p.inElement = true
 }
@@ -111,10 +137,32 @@ func (p *Parser) setElementText(t xml.CharData) {
 	if !p.inElement {
 		return
 	}
+	p.size += len(t)
+
 	elem := p.parsingStack[p.parsingIndex]
+	if p.policy != nil && p.policy.applies(p.nsStack[p.parsingIndex], len(t)) {
+		switch p.policy.Mode {
+		case SpoolLargeText:
+			// keep text in memory if it can't be spooled
+			if st, err := spoolText(p.policy.SpoolDir, t); err == nil {
+				elem.text = ""
+				elem.spool = st
+				return
+			}
+		case TruncateLargeText:
+			t = truncateText(t, p.policy.Threshold)
+		}
+	}
 	elem.text = string(t)
 }
 
+func (p *Parser) checkSize() error {
+	if p.policy != nil && p.policy.CheckSize != nil {
+		return p.policy.CheckSize(p.size)
+	}
+	return nil
+}
+
 func (p *Parser) endElement(t xml.EndElement) error {
 	name := xmlName(t.Name.Space, t.Name.Local)
 	if p.parsingStack[p.parsingIndex].Name() != name {
@@ -127,6 +175,7 @@ func (p *Parser) endElement(t xml.EndElement) error {
 func (p *Parser) closeElement() {
 	element := p.parsingStack[p.parsingIndex]
 	p.parsingStack = p.parsingStack[:p.parsingIndex]
+	p.nsStack = p.nsStack[:p.parsingIndex]
 
 	p.parsingIndex--
 	if p.parsingIndex == rootElementIndex {
@@ -8,7 +8,11 @@ package xml_test
 import (
 	"bytes"
 	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
 	"strings"
+	"sync"
 	"testing"
 
 	"github.com/ortuman/jackal/config"
@@ -86,3 +90,144 @@ func TestStream(t *testing.T) {
 	_, err = p.ParseElement()
 	require.Equal(t, xml.ErrStreamClosedByPeer, err)
 }
+
+func TestLargeTextSpool(t *testing.T) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+
+	photo := strings.Repeat("iVBORw0KGgo&lt;", 100)
+	doc := `<iq type="set"><vCard xmlns="vcard-temp"><FN>Noelia</FN><PHOTO><BINVAL>` + photo + `</BINVAL></PHOTO></vCard>` +
+		`<query xmlns="jabber:iq:private"><note>` + photo + `</note></query></iq>`
+	p := xml.NewParser(strings.NewReader(doc))
+	p.SetLargeTextPolicy(&xml.LargeTextPolicy{
+		Mode:       xml.SpoolLargeText,
+		Threshold:  64,
+		Namespaces: []string{"vcard-temp"},
+		SpoolDir:   dir,
+	})
+	iq, err := p.ParseElement()
+	require.Nil(t, err)
+
+	// only oversized text nodes within configured namespaces get spooled
+	files, _ := ioutil.ReadDir(dir)
+	require.Equal(t, 1, len(files))
+
+	decoded := strings.Replace(photo, "&lt;", "<", -1)
+	binVal := iq.FindElement("vCard").FindElement("PHOTO").FindElement("BINVAL")
+	require.Equal(t, len(decoded), binVal.TextLen())
+	require.Equal(t, decoded, binVal.Text())
+	require.Equal(t, "Noelia", iq.FindElement("vCard").FindElement("FN").Text())
+
+	// spooled text is written back on serialization, even after copying
+	require.Equal(t, doc, iq.String())
+	require.Equal(t, doc, xml.NewElementFromElement(iq).String())
+
+	buf := new(bytes.Buffer)
+	binVal.ToBytes(buf)
+	el := &xml.MutableElement{}
+	el.FromBytes(buf)
+	require.Equal(t, decoded, el.Text())
+
+	cp := xml.NewElementFromElement(binVal)
+	cp.SetText("replaced")
+	require.Equal(t, "<BINVAL>replaced</BINVAL>", cp.String())
+}
+
+func TestLargeTextTruncate(t *testing.T) {
+	doc := `<message><data xmlns="urn:xmpp:bob">` + strings.Repeat("ñ", 100) + `</data><body>` + strings.Repeat("a", 100) + `</body></message>`
+	p := xml.NewParser(strings.NewReader(doc))
+	p.SetLargeTextPolicy(&xml.LargeTextPolicy{
+		Mode:       xml.TruncateLargeText,
+		Threshold:  51,
+		Namespaces: []string{"urn:xmpp:bob"},
+	})
+	msg, err := p.ParseElement()
+	require.Nil(t, err)
+
+	// multi-byte runes are never split
+	require.Equal(t, strings.Repeat("ñ", 25), msg.FindElement("data").Text())
+	require.Equal(t, 100, msg.FindElement("body").TextLen())
+}
+
+func TestLargeTextCheckSize(t *testing.T) {
+	var sizes []int
+	policy := &xml.LargeTextPolicy{CheckSize: func(size int) error {
+		sizes = append(sizes, size)
+		if size > 64 {
+			return xml.ErrStanzaTooLarge
+		}
+		return nil
+	}}
+	doc := `<message to="a"><body>hi</body></message><message><body>` + strings.Repeat("a", 100) + `</body></message>`
+	p := xml.NewParser(strings.NewReader(doc))
+	p.SetLargeTextPolicy(policy)
+
+	_, err := p.ParseElement()
+	require.Nil(t, err)
+	require.Equal(t, []int{10, 14, 16}, sizes)
+
+	// size is reported before the element tree is complete
+	sizes = nil
+	_, err = p.ParseElement()
+	require.Equal(t, xml.ErrStanzaTooLarge, err)
+	require.Equal(t, []int{7, 11, 111}, sizes)
+}
+
+func BenchmarkParseLargeVCards_Keep(b *testing.B) {
+	benchmarkParseLargeVCards(b, nil)
+}
+
+func BenchmarkParseLargeVCards_Spool(b *testing.B) {
+	dir, _ := ioutil.TempDir("", "spool")
+	defer os.RemoveAll(dir)
+	benchmarkParseLargeVCards(b, &xml.LargeTextPolicy{
+		Mode:       xml.SpoolLargeText,
+		Threshold:  64 * 1024,
+		Namespaces: []string{"vcard-temp"},
+		SpoolDir:   dir,
+	})
+}
+
+func BenchmarkParseLargeVCards_Truncate(b *testing.B) {
+	benchmarkParseLargeVCards(b, &xml.LargeTextPolicy{
+		Mode:       xml.TruncateLargeText,
+		Threshold:  64 * 1024,
+		Namespaces: []string{"vcard-temp"},
+	})
+}
+
+// benchmarkParseLargeVCards parses 5 MB vCards from 200 concurrent parsers,
+// logging the heap retained by the resulting element trees.
+func benchmarkParseLargeVCards(b *testing.B, policy *xml.LargeTextPolicy) {
+	const concurrency = 200
+
+	photo := bytes.Repeat([]byte("iVBORw0KGgoAAAANSUhEUgAAAAEAAAABCAYAAAAfFcSJAAAADUlEQVR42mNk"), 5*1024*1024/60)
+	doc := []byte(`<iq type="set"><vCard xmlns="vcard-temp"><FN>Noelia</FN><PHOTO><TYPE>image/png</TYPE><BINVAL>` +
+		string(photo) + `</BINVAL></PHOTO></vCard></iq>`)
+
+	b.SetBytes(int64(len(doc) * concurrency))
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		elems := make([]xml.Element, concurrency)
+		var wg sync.WaitGroup
+		for j := 0; j < concurrency; j++ {
+			wg.Add(1)
+			go func(j int) {
+				defer wg.Done()
+				p := xml.NewParser(bytes.NewReader(doc))
+				p.SetLargeTextPolicy(policy)
+				elems[j], _ = p.ParseElement()
+			}(j)
+		}
+		wg.Wait()
+
+		b.StopTimer()
+		var ms runtime.MemStats
+		runtime.GC()
+		runtime.ReadMemStats(&ms)
+		b.Logf("retained heap: %d MB", ms.HeapAlloc>>20)
+		runtime.KeepAlive(elems)
+		b.StartTimer()
+	}
+}
@@ -139,6 +139,9 @@ func TestPresenceType(t *testing.T) {
 
 	presence.SetType(xml.UnsubscribedType)
 	require.True(t, presence.IsUnsubscribed())
+
+	presence.SetType(xml.ProbeType)
+	require.True(t, presence.IsProbe())
 }
 
 func TestPresenceJID(t *testing.T) {
@@ -0,0 +1,151 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package xml
+
+import (
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"runtime"
+	"unicode/utf8"
+)
+
+// ErrStanzaTooLarge may be returned by a LargeTextPolicy CheckSize function
+// to abort parsing a stanza exceeding the maximum allowed size.
+var ErrStanzaTooLarge = errors.New("stanza too large")
+
+// LargeTextMode represents the way an oversized text node is handled by the parser.
+type LargeTextMode int
+
+const (
+	// KeepLargeText keeps oversized text nodes in memory.
+	KeepLargeText LargeTextMode = iota
+
+	// SpoolLargeText spools oversized text nodes to a temporary file,
+	// read back whenever the element is serialized or its text requested.
+	SpoolLargeText
+
+	// TruncateLargeText discards oversized text nodes content beyond threshold.
+	TruncateLargeText
+)
+
+// LargeTextPolicy determines how the parser handles text nodes
+// larger than Threshold bytes contained in elements qualified
+// by any of Namespaces (either declared or inherited).
+type LargeTextPolicy struct {
+	Mode       LargeTextMode
+	Threshold  int
+	Namespaces []string
+
+	// SpoolDir is the directory where text nodes are spooled.
+	// Defaults to os.TempDir().
+	SpoolDir string
+
+	// CheckSize, if set, is invoked with the decoded size of the stanza
+	// being parsed every time it grows, before the element tree is complete.
+	// A non nil error aborts parsing and is returned by ParseElement.
+	CheckSize func(size int) error
+}
+
+func (lp *LargeTextPolicy) applies(namespace string, textLen int) bool {
+	if lp.Mode == KeepLargeText || textLen <= lp.Threshold {
+		return false
+	}
+	for _, ns := range lp.Namespaces {
+		if ns == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// spooledText represents a text node stored in a temporary file,
+// removed as soon as no element references it.
+type spooledText struct {
+	path      string
+	runeCount int
+}
+
+func spoolText(dir string, text []byte) (*spooledText, error) {
+	f, err := ioutil.TempFile(dir, "jackal-spool-")
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.Write(text)
+	if cErr := f.Close(); err == nil {
+		err = cErr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return nil, err
+	}
+	st := &spooledText{path: f.Name(), runeCount: utf8.RuneCount(text)}
+	runtime.SetFinalizer(st, func(st *spooledText) { os.Remove(st.path) })
+	return st, nil
+}
+
+func (st *spooledText) text() string {
+	b, err := ioutil.ReadFile(st.path)
+	if err != nil {
+		return ""
+	}
+	return string(b)
+}
+
+// writeEscaped writes spooled text escaped to w, never holding
+// more than a single chunk in memory.
+func (st *spooledText) writeEscaped(w io.Writer) error {
+	f, err := os.Open(st.path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	buf := make([]byte, 32*1024)
+	var pending int
+	for {
+		n, err := f.Read(buf[pending:])
+		n += pending
+		end := n
+		if err == nil {
+			end = lastFullRune(buf[:n])
+		}
+		escapeText(w, buf[:end], false)
+		pending = copy(buf, buf[end:n])
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// truncateText returns the longest prefix of text not exceeding
+// size bytes without splitting any multi-byte rune.
+func truncateText(text []byte, size int) []byte {
+	if len(text) <= size {
+		return text
+	}
+	for size > 0 && !utf8.RuneStart(text[size]) {
+		size--
+	}
+	return text[:size]
+}
+
+// lastFullRune returns the length of b excluding
+// a trailing incomplete multi-byte rune, if any.
+func lastFullRune(b []byte) int {
+	for i := 1; i <= utf8.UTFMax && i <= len(b); i++ {
+		if utf8.RuneStart(b[len(b)-i]) {
+			if !utf8.FullRune(b[len(b)-i:]) {
+				return len(b) - i
+			}
+			break
+		}
+	}
+	return len(b)
+}
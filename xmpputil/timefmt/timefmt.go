@@ -0,0 +1,39 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+// Package timefmt formats and parses XEP-0082 date and time profiles.
+package timefmt
+
+import (
+	"fmt"
+	"time"
+)
+
+// DateTimeFormat is the XEP-0082 DateTime profile layout,
+// always produced in UTC with millisecond precision.
+const DateTimeFormat = "2006-01-02T15:04:05.000Z"
+
+// parseLayouts enumerates accepted DateTime layouts, including
+// legacy variants still sent by some clients.
+var parseLayouts = []string{
+	time.RFC3339Nano,                     // fractional seconds are optional
+	"2006-01-02T15:04:05.999999999-0700", // offset without colon
+	"20060102T15:04:05",                  // XEP-0091 legacy delay stamp
+}
+
+// Format returns t as a XEP-0082 DateTime in UTC.
+func Format(t time.Time) string {
+	return t.UTC().Format(DateTimeFormat)
+}
+
+// Parse parses a XEP-0082 DateTime, returning it in UTC.
+func Parse(s string) (time.Time, error) {
+	for _, layout := range parseLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+	return time.Time{}, fmt.Errorf("timefmt: invalid date time: %s", s)
+}
@@ -0,0 +1,51 @@
+/*
+ * Copyright (c) 2018 Miguel Ángel Ortuño.
+ * See the LICENSE file for more information.
+ */
+
+package timefmt
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestFormat(t *testing.T) {
+	loc := time.FixedZone("CEST", 2*60*60)
+	tm := time.Date(2018, 4, 10, 14, 0, 0, 123456789, loc)
+	require.Equal(t, "2018-04-10T12:00:00.123Z", Format(tm))
+	require.Equal(t, "2018-04-10T12:00:00.000Z", Format(tm.Truncate(time.Second)))
+}
+
+func TestParse(t *testing.T) {
+	expected := time.Date(2018, 4, 10, 12, 0, 0, 0, time.UTC)
+	for _, s := range []string{
+		"2018-04-10T12:00:00Z",
+		"2018-04-10T12:00:00.000Z",
+		"2018-04-10T14:00:00+02:00",
+		"2018-04-10T14:00:00+0200",     // no colon in offset
+		"2018-04-10T07:00:00.000-0500", // no colon in offset
+		"20180410T12:00:00",            // XEP-0091
+	} {
+		tm, err := Parse(s)
+		require.Nil(t, err, s)
+		require.True(t, expected.Equal(tm), s)
+		require.Equal(t, time.UTC, tm.Location(), s)
+	}
+	tm, err := Parse("2018-04-10T12:00:00.25Z")
+	require.Nil(t, err)
+	require.Equal(t, 250*time.Millisecond, tm.Sub(expected))
+
+	// round trip
+	now := time.Now()
+	tm, err = Parse(Format(now))
+	require.Nil(t, err)
+	require.True(t, now.Sub(tm) < time.Millisecond)
+
+	for _, s := range []string{"", "2018-04-10", "2018-04-10T12:00:00", "yesterday"} {
+		_, err := Parse(s)
+		require.NotNil(t, err, s)
+	}
+}